@@ -0,0 +1,229 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/vfs"
+)
+
+// 基准测试使用固定的随机数种子和数据量，同一台机器上多次运行的结果可以比较：
+//
+//	go test ./bench -run '^$' -bench . -count 5 > head.txt
+//	go run ./bench/cmd/urnabench compare base.txt head.txt
+const (
+	// benchRecords 是读取和混合负载预先写入的记录数量
+	benchRecords = 20000
+	// recoveryRecords 是恢复测试中每个 region 的记录数量
+	recoveryRecords = 5000
+	benchSeed       = 42
+)
+
+func openFS(tb testing.TB, path string, ordered bool) *vfs.LogStructuredFS {
+	index := vfs.HashIndex
+	if ordered {
+		index = vfs.SkipListIndex
+	}
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    conf.FSPerm,
+		Path:      path,
+		Threshold: 1,
+		Index:     index,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fss
+}
+
+func benchWorkload() *Workload {
+	w := DefaultWorkload()
+	w.RecordCount = benchRecords
+	return w
+}
+
+// preload 插入 [from, from+n) 之间的记录
+func preload(tb testing.TB, db DB, w *Workload, from, n int64) {
+	r := rand.New(rand.NewSource(benchSeed))
+	for i := from; i < from+n; i++ {
+		err := db.Insert(w.Key(i), w.fields(r, true))
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func benchmarkPut(b *testing.B, ordered bool) {
+	fss := openFS(b, b.TempDir(), false)
+	defer fss.CloseFS()
+	db := NewStore(fss)
+
+	w := benchWorkload()
+	w.OrderedInserts = ordered
+	r := rand.New(rand.NewSource(benchSeed))
+	fields := w.fields(r, true)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := db.Insert(w.Key(int64(i)), fields)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPutSequential 按照 key 的顺序插入新的记录
+func BenchmarkPutSequential(b *testing.B) {
+	benchmarkPut(b, true)
+}
+
+// BenchmarkPutRandom 按照哈希打散的顺序插入新的记录
+func BenchmarkPutRandom(b *testing.B) {
+	benchmarkPut(b, false)
+}
+
+func benchmarkRead(b *testing.B, distribution string, reopen bool) {
+	dir := b.TempDir()
+	fss := openFS(b, dir, false)
+	w := benchWorkload()
+	preload(b, NewStore(fss), w, 0, w.RecordCount)
+
+	// 关闭之后重新打开，读取不会命中写入时留下的状态，操作系统的页缓存没有被清除
+	if reopen {
+		err := fss.CloseFS()
+		if err != nil {
+			b.Fatal(err)
+		}
+		fss = openFS(b, dir, false)
+	}
+	defer fss.CloseFS()
+	db := NewStore(fss)
+
+	r := rand.New(rand.NewSource(benchSeed))
+	c := newChooser(distribution, w.RecordCount)
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = w.Key(c.next(r, w.RecordCount))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := db.Read(keys[i%len(keys)])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadHot 按照 zipfian 分布读取刚刚写入的记录，大部分读取集中在少量的热点上
+func BenchmarkReadHot(b *testing.B) {
+	benchmarkRead(b, DistributionZipfian, false)
+}
+
+// BenchmarkReadCold 重新打开存储之后均匀地读取全部记录
+func BenchmarkReadCold(b *testing.B) {
+	benchmarkRead(b, DistributionUniform, true)
+}
+
+// BenchmarkMixed 运行 YCSB 的 workloada，一半读取一半更新，b.N 是操作的数量
+func BenchmarkMixed(b *testing.B) {
+	fss := openFS(b, b.TempDir(), false)
+	defer fss.CloseFS()
+	db := NewStore(fss)
+
+	w, err := CoreWorkload("a")
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.RecordCount = benchRecords
+	preload(b, db, w, 0, w.RecordCount)
+	w.OperationCount = int64(b.N)
+
+	b.ResetTimer()
+	report, err := Run(context.Background(), db, w, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(report.Percentile(OpRead, 99).Microseconds()), "p99-read-us")
+	b.ReportMetric(float64(report.Percentile(OpUpdate, 99).Microseconds()), "p99-update-us")
+}
+
+// dropIndex 删除索引快照、检查点和索引日志，打开时扫描全部 region 恢复索引
+func dropIndex(tb testing.TB, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "index.db" || strings.HasPrefix(name, "ckpt.") || strings.HasSuffix(name, ".wal") {
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkRecovery 测量没有索引快照时打开存储需要的时间，每个 region 中的记录数量相同
+func BenchmarkRecovery(b *testing.B) {
+	for _, regions := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("regions=%d", regions), func(b *testing.B) {
+			dir := b.TempDir()
+			fss := openFS(b, dir, false)
+			db := NewStore(fss)
+			w := benchWorkload()
+			for i := 0; i < regions; i++ {
+				preload(b, db, w, int64(i*recoveryRecords), recoveryRecords)
+				err := fss.RolloverRegion()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			err := fss.CloseFS()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dropIndex(b, dir)
+				b.StartTimer()
+
+				fss = openFS(b, dir, false)
+
+				b.StopTimer()
+				if fss.KeysCount() != regions*recoveryRecords {
+					b.Fatalf("recovered %d keys, expected %d", fss.KeysCount(), regions*recoveryRecords)
+				}
+				err = fss.CloseFS()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// urnabench 使用 YCSB 的 workload 测试存储引擎，并且比较两次 go test -bench 的结果：
+//
+//	urnabench load -path /tmp/ycsb -workload a -p recordcount=100000
+//	urnabench run -path /tmp/ycsb -workload a -threads 8
+//	urnabench compare -threshold 0.1 base.txt head.txt
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/auula/urnadb/bench"
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/vfs"
+)
+
+// properties 是可以重复的 -p key=value 参数
+type properties []string
+
+func (p *properties) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *properties) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("property %q must be key=value", value)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "load", "run":
+		err = workload(os.Args[1], os.Args[2:])
+	case "compare":
+		err = compare(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: urnabench load|run [-path dir] [-workload a|file] [-threads n] [-p key=value]...")
+	fmt.Fprintln(os.Stderr, "       urnabench compare [-threshold 0.1] base.txt head.txt")
+	os.Exit(2)
+}
+
+func workload(phase string, args []string) error {
+	var (
+		props properties
+		fs    = flag.NewFlagSet(phase, flag.ExitOnError)
+		path  = fs.String("path", "", "--path the data directory, a temporary directory by default.")
+		name  = fs.String("workload", "a", "--workload a YCSB core workload a to f or a workload file.")
+		n     = fs.Int("threads", 1, "--threads the number of client goroutines.")
+	)
+	fs.Var(&props, "p", "--p override a workload property, key=value.")
+	_ = fs.Parse(args)
+
+	w, err := bench.LoadWorkload(*name)
+	if err != nil {
+		return err
+	}
+	for _, prop := range props {
+		key, value, _ := strings.Cut(prop, "=")
+		err = w.Set(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Validate()
+	if err != nil {
+		return err
+	}
+
+	if *path == "" {
+		*path, err = os.MkdirTemp("", "urnabench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(*path)
+	}
+
+	// scan 需要有序的 key 索引
+	index := vfs.HashIndex
+	if w.ScanProportion > 0 {
+		index = vfs.SkipListIndex
+	}
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    conf.FSPerm,
+		Path:      *path,
+		Threshold: conf.Default.Region.Threshold,
+		Index:     index,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var report *bench.Report
+	if phase == "load" {
+		report, err = bench.Load(ctx, bench.NewStore(fss), w, *n)
+	} else {
+		report, err = bench.Run(ctx, bench.NewStore(fss), w, *n)
+	}
+	if report != nil {
+		_, _ = report.WriteTo(os.Stdout)
+	}
+	return errors.Join(err, fss.CloseFS())
+}
+
+func compare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 0.1, "--threshold the allowed slowdown, 0.1 allows 10%.")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	var results [2]bench.Results
+	for i, file := range fs.Args() {
+		fd, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		results[i], err = bench.ParseResults(fd)
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+	}
+
+	regressions := bench.Compare(results[0], results[1], *threshold)
+	for _, r := range regressions {
+		fmt.Printf("%s: %.0f ns/op -> %.0f ns/op (%+.1f%%)\n", r.Name, r.Base, r.Head, r.Change*100)
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf("%d benchmark(s) slowed down by more than %.0f%%", len(regressions), *threshold*100)
+	}
+	fmt.Println("no performance regressions")
+	return nil
+}
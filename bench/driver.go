@@ -0,0 +1,306 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operation 是 YCSB 的操作类型
+type Operation int
+
+const (
+	OpRead Operation = iota
+	OpUpdate
+	OpInsert
+	OpScan
+	OpReadModifyWrite
+	operationKinds
+)
+
+var operationNames = [operationKinds]string{"READ", "UPDATE", "INSERT", "SCAN", "READ-MODIFY-WRITE"}
+
+func (op Operation) String() string {
+	return operationNames[op]
+}
+
+// DB 是被测试的存储，和 YCSB 的 DB 接口对应，每条记录是字段名到字段值的映射
+type DB interface {
+	Read(key string) error
+	Scan(start string, count int) error
+	Insert(key string, fields map[string]any) error
+	Update(key string, fields map[string]any) error
+}
+
+// Load 使用 threads 个 goroutine 插入 [insertstart, insertstart+recordcount) 之间的记录，对应 YCSB 的 load 阶段
+func Load(ctx context.Context, db DB, w *Workload, threads int) (*Report, error) {
+	if threads <= 0 {
+		threads = 1
+	}
+	var next atomic.Int64
+	next.Store(w.InsertStart)
+	end := w.InsertStart + w.RecordCount
+
+	return drive(ctx, threads, func(r *rand.Rand, report *Report) bool {
+		n := next.Add(1) - 1
+		if n >= end {
+			return false
+		}
+		fields := w.fields(r, true)
+		start := time.Now()
+		err := db.Insert(w.Key(n), fields)
+		report.record(OpInsert, time.Since(start), err)
+		return true
+	})
+}
+
+// Run 使用 threads 个 goroutine 执行 operationcount 次操作，对应 YCSB 的 run 阶段，
+// 数据需要先通过 Load 插入
+func Run(ctx context.Context, db DB, w *Workload, threads int) (*Report, error) {
+	if threads <= 0 {
+		threads = 1
+	}
+
+	var (
+		remaining atomic.Int64
+		// run 阶段插入的 key 编号从 recordcount 开始，next 是下一个插入的编号，inserted 是已经插入完成的数量
+		next     atomic.Int64
+		inserted atomic.Int64
+		choose   = newChooser(w.RequestDistribution, w.RecordCount)
+		total    = w.total()
+		weights  = w.proportions()
+	)
+	remaining.Store(w.OperationCount)
+	next.Store(w.RecordCount)
+	inserted.Store(w.RecordCount)
+
+	pick := func(r *rand.Rand) Operation {
+		x := r.Float64() * total
+		for op, p := range weights {
+			if x < p {
+				return Operation(op)
+			}
+			x -= p
+		}
+		return OpRead
+	}
+
+	return drive(ctx, threads, func(r *rand.Rand, report *Report) bool {
+		if remaining.Add(-1) < 0 {
+			return false
+		}
+
+		op := pick(r)
+		key := w.Key(w.InsertStart + choose.next(r, inserted.Load()))
+
+		var (
+			err    error
+			fields map[string]any
+		)
+		if op == OpUpdate || op == OpInsert || op == OpReadModifyWrite {
+			fields = w.fields(r, op == OpInsert)
+		}
+		length := 0
+		if op == OpScan {
+			length = 1 + r.Intn(w.MaxScanLength)
+		}
+
+		start := time.Now()
+		switch op {
+		case OpRead:
+			err = db.Read(key)
+		case OpUpdate:
+			err = db.Update(key, fields)
+		case OpInsert:
+			// 插入完成之后才能被其他操作选中，并发插入完成的顺序不同时可能选中还没有完成的 key
+			err = db.Insert(w.Key(w.InsertStart+next.Add(1)-1), fields)
+			if err == nil {
+				inserted.Add(1)
+			}
+		case OpScan:
+			err = db.Scan(key, length)
+		case OpReadModifyWrite:
+			err = db.Read(key)
+			if err == nil {
+				err = db.Update(key, fields)
+			}
+		}
+		report.record(op, time.Since(start), err)
+		return true
+	})
+}
+
+// fields 生成记录的字段，all 为 false 并且 writeallfields 为 false 时只生成一个随机的字段
+func (w *Workload) fields(r *rand.Rand, all bool) map[string]any {
+	if !all && !w.WriteAllFields {
+		return map[string]any{"field" + strconv.Itoa(r.Intn(w.FieldCount)): randomString(r, w.FieldLength)}
+	}
+	fields := make(map[string]any, w.FieldCount)
+	for i := 0; i < w.FieldCount; i++ {
+		fields["field"+strconv.Itoa(i)] = randomString(r, w.FieldLength)
+	}
+	return fields
+}
+
+func randomString(r *rand.Rand, n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = letters[r.Intn(len(letters))]
+	}
+	return string(buf)
+}
+
+// drive 并发执行 step 直到返回 false 或者 ctx 结束，每个 goroutine 使用自己的随机数生成器和统计，
+// 结束之后合并
+func drive(ctx context.Context, threads int, step func(r *rand.Rand, report *Report) bool) (*Report, error) {
+	var (
+		wg      sync.WaitGroup
+		reports = make([]*Report, threads)
+		seed    = time.Now().UnixNano()
+		start   = time.Now()
+	)
+	for i := 0; i < threads; i++ {
+		reports[i] = new(Report)
+		wg.Add(1)
+		go func(r *rand.Rand, report *Report) {
+			defer wg.Done()
+			for ctx.Err() == nil && step(r, report) {
+			}
+		}(rand.New(rand.NewSource(seed+int64(i))), reports[i])
+	}
+	wg.Wait()
+
+	report := &Report{Runtime: time.Since(start)}
+	for _, r := range reports {
+		report.merge(r)
+	}
+	return report, ctx.Err()
+}
+
+// Report 是每种操作的延迟统计，输出格式和 YCSB 的文本输出相同
+type Report struct {
+	Runtime time.Duration
+	ops     [operationKinds]opStats
+}
+
+type opStats struct {
+	latencies []time.Duration
+	errors    int64
+}
+
+func (r *Report) record(op Operation, latency time.Duration, err error) {
+	s := &r.ops[op]
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+func (r *Report) merge(other *Report) {
+	for op := range r.ops {
+		r.ops[op].latencies = append(r.ops[op].latencies, other.ops[op].latencies...)
+		r.ops[op].errors += other.ops[op].errors
+	}
+}
+
+// Operations 返回完成的操作数量，包括失败的操作
+func (r *Report) Operations() int64 {
+	var n int64
+	for _, s := range r.ops {
+		n += int64(len(s.latencies)) + s.errors
+	}
+	return n
+}
+
+// Errors 返回 op 失败的次数
+func (r *Report) Errors(op Operation) int64 {
+	return r.ops[op].errors
+}
+
+// Throughput 返回每秒完成的操作数量
+func (r *Report) Throughput() float64 {
+	if r.Runtime <= 0 {
+		return 0
+	}
+	return float64(r.Operations()) / r.Runtime.Seconds()
+}
+
+// Percentile 返回 op 成功时延迟的第 p 百分位，p 在 0 到 100 之间
+func (r *Report) Percentile(op Operation, p float64) time.Duration {
+	latencies := r.ops[op].latencies
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	i := int(float64(len(latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+// WriteTo 按照 YCSB 的格式输出统计，延迟的单位是微秒
+func (r *Report) WriteTo(out io.Writer) (int64, error) {
+	var n int64
+	write := func(format string, args ...any) error {
+		wn, err := fmt.Fprintf(out, format, args...)
+		n += int64(wn)
+		return err
+	}
+
+	err := write("[OVERALL], RunTime(ms), %d\n[OVERALL], Throughput(ops/sec), %.2f\n",
+		r.Runtime.Milliseconds(), r.Throughput())
+	for op := Operation(0); op < operationKinds && err == nil; op++ {
+		s := r.ops[op]
+		if len(s.latencies) == 0 && s.errors == 0 {
+			continue
+		}
+		var sum time.Duration
+		for _, l := range s.latencies {
+			sum += l
+		}
+		avg := 0.0
+		if len(s.latencies) > 0 {
+			avg = float64(sum.Microseconds()) / float64(len(s.latencies))
+		}
+		err = write("[%[1]s], Operations, %[2]d\n[%[1]s], AverageLatency(us), %.2[3]f\n"+
+			"[%[1]s], MinLatency(us), %[4]d\n[%[1]s], MaxLatency(us), %[5]d\n"+
+			"[%[1]s], 50thPercentileLatency(us), %[6]d\n[%[1]s], 95thPercentileLatency(us), %[7]d\n"+
+			"[%[1]s], 99thPercentileLatency(us), %[8]d\n[%[1]s], Return=OK, %[9]d\n",
+			op, int64(len(s.latencies))+s.errors, avg,
+			r.Percentile(op, 0).Microseconds(), r.Percentile(op, 100).Microseconds(),
+			r.Percentile(op, 50).Microseconds(), r.Percentile(op, 95).Microseconds(),
+			r.Percentile(op, 99).Microseconds(), len(s.latencies))
+		if err == nil && s.errors > 0 {
+			err = write("[%s], Return=ERROR, %d\n", op, s.errors)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Results 是 go test -bench 输出中每个基准测试每次运行的 ns/op，-count 大于 1 时有多个值
+type Results map[string][]float64
+
+// cpuSuffix 是基准测试名称末尾的 GOMAXPROCS，不同机器上不同，比较时去掉
+var cpuSuffix = regexp.MustCompile(`-\d+$`)
+
+// ParseResults 解析 go test -bench 的输出，忽略不是基准测试结果的行
+func ParseResults(r io.Reader) (Results, error) {
+	results := make(Results)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		// BenchmarkName-8  1000  1234 ns/op  ...
+		for i := 2; i+1 < len(fields); i += 2 {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+			ns, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				break
+			}
+			name := cpuSuffix.ReplaceAllString(fields[0], "")
+			results[name] = append(results[name], ns)
+			break
+		}
+	}
+	return results, scanner.Err()
+}
+
+// Regression 是一个变慢超过阈值的基准测试，Base 和 Head 是多次运行的中位数
+type Regression struct {
+	Name   string
+	Base   float64
+	Head   float64
+	Change float64
+}
+
+// Compare 比较两次运行中都存在的基准测试，返回 ns/op 的中位数增加超过 threshold 的基准测试，
+// threshold 是比例，0.1 表示允许慢 10%。只在一边存在的基准测试被忽略
+func Compare(base, head Results, threshold float64) []Regression {
+	var regressions []Regression
+	for name, samples := range head {
+		before, ok := base[name]
+		if !ok || len(before) == 0 || len(samples) == 0 {
+			continue
+		}
+		b, h := median(before), median(samples)
+		if b <= 0 {
+			continue
+		}
+		change := (h - b) / b
+		if change > threshold {
+			regressions = append(regressions, Regression{Name: name, Base: b, Head: h, Change: change})
+		}
+	}
+	sort.Slice(regressions, func(i, j int) bool {
+		return regressions[i].Name < regressions[j].Name
+	})
+	return regressions
+}
+
+func median(samples []float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
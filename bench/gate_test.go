@@ -0,0 +1,65 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResults(t *testing.T) {
+	results, err := ParseResults(strings.NewReader(`goos: linux
+goarch: amd64
+pkg: github.com/auula/urnadb/bench
+BenchmarkPutRandom-8                    	   20000	      5120 ns/op	    1024 B/op	      12 allocs/op
+BenchmarkPutRandom-8                    	   20000	      4880 ns/op	    1024 B/op	      12 allocs/op
+BenchmarkMixed-16                       	   20000	      9000 ns/op	        31.00 p99-read-us
+BenchmarkRecovery/regions=4-8           	      10	 120000000 ns/op
+--- FAIL: BenchmarkBroken
+PASS
+ok  	github.com/auula/urnadb/bench	12.345s
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Results{
+		"BenchmarkPutRandom":          {5120, 4880},
+		"BenchmarkMixed":              {9000},
+		"BenchmarkRecovery/regions=4": {120000000},
+	}, results)
+}
+
+func TestCompare(t *testing.T) {
+	base := Results{
+		"BenchmarkPutRandom": {5000, 5100, 4900},
+		"BenchmarkReadHot":   {1000, 1000},
+		"BenchmarkRemoved":   {100},
+	}
+	head := Results{
+		// 中位数慢了 20%，一次运行的抖动不影响结果
+		"BenchmarkPutRandom": {6000, 6100, 3000},
+		"BenchmarkReadHot":   {1050, 1040},
+		"BenchmarkAdded":     {100},
+	}
+
+	regressions := Compare(base, head, 0.1)
+	assert.Len(t, regressions, 1)
+	assert.Equal(t, "BenchmarkPutRandom", regressions[0].Name)
+	assert.Equal(t, 5000.0, regressions[0].Base)
+	assert.Equal(t, 6000.0, regressions[0].Head)
+	assert.InDelta(t, 0.2, regressions[0].Change, 1e-9)
+
+	assert.Empty(t, Compare(base, head, 0.25))
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+const (
+	// zipfianConstant 和 YCSB 的默认值相同
+	zipfianConstant = 0.99
+	fnvOffsetBasis  = 0xCBF29CE484222325
+	fnvPrime        = 1099511628211
+)
+
+// fnvHash64 和 YCSB 的 Utils.fnvhash64 相同，用于打散 key 的插入顺序和 zipfian 的热点
+func fnvHash64(v int64) int64 {
+	hash := uint64(fnvOffsetBasis)
+	for i := 0; i < 8; i++ {
+		hash ^= uint64(v & 0xff)
+		hash *= fnvPrime
+		v >>= 8
+	}
+	h := int64(hash)
+	if h < 0 && h != math.MinInt64 {
+		h = -h
+	}
+	return h
+}
+
+// zipfian 是 YCSB 的 ZipfianGenerator，返回 [0, items) 之间的整数，越小的数出现得越频繁。
+// 项目数量增加时增量计算 zeta，latest 分布随着插入的 key 增长
+type zipfian struct {
+	mu    sync.Mutex
+	theta float64
+	zeta2 float64
+	alpha float64
+	// zetan 是前 count 项的 zeta
+	zetan float64
+	count int64
+	eta   float64
+}
+
+func newZipfian(items int64) *zipfian {
+	z := &zipfian{theta: zipfianConstant}
+	z.zeta2 = zeta(0, 2, z.theta, 0)
+	z.alpha = 1 / (1 - z.theta)
+	z.grow(items)
+	return z
+}
+
+// zeta 从前 from 项的和 sum 继续计算前 to 项的和
+func zeta(from, to int64, theta, sum float64) float64 {
+	for i := from; i < to; i++ {
+		sum += 1 / math.Pow(float64(i+1), theta)
+	}
+	return sum
+}
+
+// grow 把项目数量增加到 items，调用者必须持有 z.mu
+func (z *zipfian) grow(items int64) {
+	if items <= z.count {
+		return
+	}
+	z.zetan = zeta(z.count, items, z.theta, z.zetan)
+	z.count = items
+	z.eta = (1 - math.Pow(2/float64(items), 1-z.theta)) / (1 - z.zeta2/z.zetan)
+}
+
+// next 返回 [0, items) 之间的整数，items 比构造时大时先增加项目数量
+func (z *zipfian) next(r *rand.Rand, items int64) int64 {
+	z.mu.Lock()
+	z.grow(items)
+	zetan, eta, count := z.zetan, z.eta, z.count
+	z.mu.Unlock()
+
+	u := r.Float64()
+	uz := u * zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+	n := int64(float64(count) * math.Pow(eta*u-eta+1, z.alpha))
+	if n >= items {
+		n = items - 1
+	}
+	return n
+}
+
+// chooser 选择一次操作使用的 key 编号，limit 是当前已经插入的 key 的数量
+type chooser interface {
+	next(r *rand.Rand, limit int64) int64
+}
+
+type uniformChooser struct{}
+
+func (uniformChooser) next(r *rand.Rand, limit int64) int64 {
+	return r.Int63n(limit)
+}
+
+// scrambledZipfian 和 YCSB 的 ScrambledZipfianGenerator 一样把热点打散到整个 key 空间，
+// 避免热点集中在最早插入的 key 上
+type scrambledZipfian struct {
+	z     *zipfian
+	items int64
+}
+
+func (s *scrambledZipfian) next(r *rand.Rand, limit int64) int64 {
+	n := fnvHash64(s.z.next(r, s.items)) % s.items
+	if n >= limit {
+		n %= limit
+	}
+	return n
+}
+
+// latestChooser 偏向最近插入的 key，和 YCSB 的 SkewedLatestGenerator 相同
+type latestChooser struct {
+	z *zipfian
+}
+
+func (l *latestChooser) next(r *rand.Rand, limit int64) int64 {
+	return limit - 1 - l.z.next(r, limit)
+}
+
+// newChooser 根据 requestdistribution 创建 chooser，items 是预计的 key 数量
+func newChooser(distribution string, items int64) chooser {
+	switch distribution {
+	case DistributionZipfian:
+		return &scrambledZipfian{z: newZipfian(items), items: items}
+	case DistributionLatest:
+		return &latestChooser{z: newZipfian(items)}
+	default:
+		return uniformChooser{}
+	}
+}
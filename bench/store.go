@@ -0,0 +1,98 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+)
+
+// Store 把 YCSB 的记录保存为 Table 类型的值，直接调用存储引擎，不经过 HTTP 服务器，
+// 测量的是存储引擎本身的性能
+type Store struct {
+	fs *vfs.LogStructuredFS
+}
+
+// NewStore 创建 fs 上的 DB，Scan 需要 fs 使用 vfs.SkipListIndex 打开
+func NewStore(fs *vfs.LogStructuredFS) *Store {
+	return &Store{fs: fs}
+}
+
+func (s *Store) Read(key string) error {
+	_, seg, err := s.fs.FetchSegment(key)
+	if err != nil {
+		return err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	// 解码记录，和服务器读取时的开销相同
+	table, err := seg.ToTable()
+	if err != nil {
+		return err
+	}
+	utils.ReleaseToPool(table)
+	return nil
+}
+
+// Scan 按照 key 的顺序从 start 开始读取 count 条记录
+func (s *Store) Scan(start string, count int) error {
+	keys, err := s.fs.RangeKeys(start, "", count)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = s.Read(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Insert(key string, fields map[string]any) error {
+	table := types.NewTable()
+	for field, value := range fields {
+		table.AddItem(field, value)
+	}
+	return s.put(key, table)
+}
+
+// Update 把 fields 合并到已有的记录中，没有出现的字段保持不变
+func (s *Store) Update(key string, fields map[string]any) error {
+	_, seg, err := s.fs.FetchSegment(key)
+	if err != nil {
+		return err
+	}
+	table, err := seg.ToTable()
+	utils.ReleaseToPool(seg)
+	if err != nil {
+		return err
+	}
+	defer utils.ReleaseToPool(table)
+
+	for field, value := range fields {
+		table.AddItem(field, value)
+	}
+	return s.put(key, table)
+}
+
+func (s *Store) put(key string, table *types.Table) error {
+	seg, err := vfs.NewSegment(key, table, 0)
+	if err != nil {
+		return err
+	}
+	return s.fs.PutSegment(key, seg)
+}
@@ -0,0 +1,226 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench 包含可以重复运行的存储引擎基准测试和兼容 YCSB 的负载驱动，
+// 用于评估索引、fsync 等改动对性能的影响。
+package bench
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// requestdistribution 支持的分布
+const (
+	DistributionUniform = "uniform"
+	DistributionZipfian = "zipfian"
+	DistributionLatest  = "latest"
+)
+
+// Workload 是 YCSB CoreWorkload 的参数，属性名称和默认值与 YCSB 相同，
+// 不支持的属性在解析时被忽略，YCSB 的 workload 文件可以直接使用
+type Workload struct {
+	RecordCount    int64
+	OperationCount int64
+	InsertStart    int64
+	FieldCount     int
+	FieldLength    int
+	// 各种操作的比例，和不需要等于 1，按照比例归一化
+	ReadProportion            float64
+	UpdateProportion          float64
+	InsertProportion          float64
+	ScanProportion            float64
+	ReadModifyWriteProportion float64
+	RequestDistribution       string
+	MaxScanLength             int
+	// OrderedInserts 为 true 时 key 按照编号顺序插入，否则使用哈希打散，对应 insertorder
+	OrderedInserts bool
+	// WriteAllFields 为 false 时更新只写入一个随机的字段
+	WriteAllFields bool
+	ZeroPadding    int
+}
+
+// DefaultWorkload 返回 YCSB CoreWorkload 的默认参数
+func DefaultWorkload() *Workload {
+	return &Workload{
+		RecordCount:         1000,
+		OperationCount:      1000,
+		FieldCount:          10,
+		FieldLength:         100,
+		ReadProportion:      0.95,
+		UpdateProportion:    0.05,
+		RequestDistribution: DistributionUniform,
+		MaxScanLength:       1000,
+		ZeroPadding:         1,
+	}
+}
+
+// coreWorkloads 是 YCSB 自带的 workloada 到 workloadf
+var coreWorkloads = map[string]string{
+	"a": "readproportion=0.5\nupdateproportion=0.5\nrequestdistribution=zipfian",
+	"b": "readproportion=0.95\nupdateproportion=0.05\nrequestdistribution=zipfian",
+	"c": "readproportion=1\nupdateproportion=0\nrequestdistribution=zipfian",
+	"d": "readproportion=0.95\nupdateproportion=0\ninsertproportion=0.05\nrequestdistribution=latest",
+	"e": "readproportion=0\nupdateproportion=0\nscanproportion=0.95\ninsertproportion=0.05\nrequestdistribution=zipfian\nmaxscanlength=100",
+	"f": "readproportion=0.5\nupdateproportion=0\nreadmodifywriteproportion=0.5\nrequestdistribution=zipfian",
+}
+
+// CoreWorkload 返回 YCSB 自带的 workload，name 是 a 到 f 或者 workloada 到 workloadf
+func CoreWorkload(name string) (*Workload, error) {
+	props, ok := coreWorkloads[strings.TrimPrefix(strings.ToLower(name), "workload")]
+	if !ok {
+		return nil, fmt.Errorf("unknown core workload %q", name)
+	}
+	return ParseWorkload(strings.NewReader(props))
+}
+
+// LoadWorkload 读取 YCSB 的 workload 文件，name 也可以是 CoreWorkload 的名称
+func LoadWorkload(name string) (*Workload, error) {
+	if w, err := CoreWorkload(name); err == nil {
+		return w, nil
+	}
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ParseWorkload(fd)
+}
+
+// ParseWorkload 解析 Java properties 格式的 workload，没有出现的属性使用默认值
+func ParseWorkload(r io.Reader) (*Workload, error) {
+	w := DefaultWorkload()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "!") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key=value", line)
+		}
+		err := w.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return w, w.Validate()
+}
+
+// Set 设置一个 YCSB 属性，对应命令行的 -p key=value，不支持的属性被忽略
+func (w *Workload) Set(key, value string) error {
+	var err error
+	switch key {
+	case "recordcount":
+		w.RecordCount, err = strconv.ParseInt(value, 10, 64)
+	case "operationcount":
+		w.OperationCount, err = strconv.ParseInt(value, 10, 64)
+	case "insertstart":
+		w.InsertStart, err = strconv.ParseInt(value, 10, 64)
+	case "fieldcount":
+		w.FieldCount, err = strconv.Atoi(value)
+	case "fieldlength":
+		w.FieldLength, err = strconv.Atoi(value)
+	case "readproportion":
+		w.ReadProportion, err = strconv.ParseFloat(value, 64)
+	case "updateproportion":
+		w.UpdateProportion, err = strconv.ParseFloat(value, 64)
+	case "insertproportion":
+		w.InsertProportion, err = strconv.ParseFloat(value, 64)
+	case "scanproportion":
+		w.ScanProportion, err = strconv.ParseFloat(value, 64)
+	case "readmodifywriteproportion":
+		w.ReadModifyWriteProportion, err = strconv.ParseFloat(value, 64)
+	case "requestdistribution":
+		w.RequestDistribution = value
+	case "maxscanlength":
+		w.MaxScanLength, err = strconv.Atoi(value)
+	case "insertorder":
+		w.OrderedInserts = value == "ordered"
+	case "writeallfields":
+		w.WriteAllFields, err = strconv.ParseBool(value)
+	case "zeropadding":
+		w.ZeroPadding, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value of %s: %w", key, err)
+	}
+	return nil
+}
+
+// Validate 检查参数是否可以运行
+func (w *Workload) Validate() error {
+	if w.RecordCount <= 0 || w.OperationCount < 0 || w.InsertStart < 0 {
+		return fmt.Errorf("recordcount must be positive, operationcount and insertstart cannot be negative")
+	}
+	if w.FieldCount <= 0 || w.FieldLength <= 0 {
+		return fmt.Errorf("fieldcount and fieldlength must be positive")
+	}
+	for _, p := range w.proportions() {
+		if p < 0 {
+			return fmt.Errorf("operation proportions cannot be negative")
+		}
+	}
+	if w.total() == 0 {
+		return fmt.Errorf("at least one operation proportion must be positive")
+	}
+	if w.ScanProportion > 0 && w.MaxScanLength <= 0 {
+		return fmt.Errorf("maxscanlength must be positive")
+	}
+	switch w.RequestDistribution {
+	case DistributionUniform, DistributionZipfian, DistributionLatest:
+	default:
+		return fmt.Errorf("unsupported requestdistribution %q", w.RequestDistribution)
+	}
+	return nil
+}
+
+// proportions 按照 Operation 的顺序返回每种操作的比例
+func (w *Workload) proportions() [operationKinds]float64 {
+	return [operationKinds]float64{
+		OpRead:            w.ReadProportion,
+		OpUpdate:          w.UpdateProportion,
+		OpInsert:          w.InsertProportion,
+		OpScan:            w.ScanProportion,
+		OpReadModifyWrite: w.ReadModifyWriteProportion,
+	}
+}
+
+func (w *Workload) total() float64 {
+	sum := 0.0
+	for _, p := range w.proportions() {
+		sum += p
+	}
+	return sum
+}
+
+// Key 返回编号为 n 的记录的 key，格式和 YCSB 相同
+func (w *Workload) Key(n int64) string {
+	if !w.OrderedInserts {
+		n = fnvHash64(n)
+	}
+	number := strconv.FormatInt(n, 10)
+	if pad := w.ZeroPadding - len(number); pad > 0 {
+		number = strings.Repeat("0", pad) + number
+	}
+	return "user" + number
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWorkload(t *testing.T) {
+	w, err := ParseWorkload(strings.NewReader(`
+# Yahoo! Cloud System Benchmark
+workload=site.ycsb.workloads.CoreWorkload
+recordcount=5000
+operationcount = 200
+readproportion=0.5
+updateproportion=0.5
+insertorder=ordered
+zeropadding=6
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5000), w.RecordCount)
+	assert.Equal(t, int64(200), w.OperationCount)
+	assert.Equal(t, 0.5, w.UpdateProportion)
+	assert.Equal(t, 10, w.FieldCount)
+	assert.Equal(t, "user000042", w.Key(42))
+
+	_, err = ParseWorkload(strings.NewReader("recordcount=many"))
+	assert.ErrorContains(t, err, "line 1")
+	_, err = ParseWorkload(strings.NewReader("requestdistribution=hotspot"))
+	assert.Error(t, err)
+	_, err = ParseWorkload(strings.NewReader("readproportion=0\nupdateproportion=0"))
+	assert.Error(t, err)
+}
+
+func TestCoreWorkload(t *testing.T) {
+	for _, name := range []string{"a", "b", "c", "d", "e", "workloadf"} {
+		w, err := CoreWorkload(name)
+		assert.NoError(t, err, name)
+		assert.InDelta(t, 1.0, w.total(), 1e-9, name)
+	}
+
+	w, err := CoreWorkload("e")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, w.MaxScanLength)
+
+	_, err = CoreWorkload("g")
+	assert.Error(t, err)
+
+	// 哈希打散的 key 和 YCSB 相同
+	w = DefaultWorkload()
+	assert.Equal(t, "user6284781860667377211", w.Key(0))
+}
+
+func TestChooser(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, distribution := range []string{DistributionUniform, DistributionZipfian, DistributionLatest} {
+		c := newChooser(distribution, 1000)
+		counts := make(map[int64]int)
+		for i := 0; i < 10000; i++ {
+			n := c.next(r, 1000)
+			assert.True(t, n >= 0 && n < 1000, distribution)
+			counts[n]++
+		}
+		if distribution == DistributionUniform {
+			continue
+		}
+
+		// 偏斜的分布中最热的 key 远远超过平均的 10 次
+		hottest := 0
+		for _, count := range counts {
+			if count > hottest {
+				hottest = count
+			}
+		}
+		assert.Greater(t, hottest, 500, distribution)
+	}
+
+	// latest 随着插入的 key 增加，最热的是最新插入的 key
+	c := newChooser(DistributionLatest, 10)
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		n := c.next(r, 2000)
+		assert.True(t, n >= 0 && n < 2000)
+		if n == 1999 {
+			hits++
+		}
+	}
+	assert.Greater(t, hits, 50)
+}
+
+func TestLoadAndRun(t *testing.T) {
+	fss := openFS(t, t.TempDir(), true)
+	defer fss.CloseFS()
+	db := NewStore(fss)
+
+	w, err := CoreWorkload("a")
+	assert.NoError(t, err)
+	w.RecordCount, w.OperationCount = 200, 500
+
+	report, err := Load(context.Background(), db, w, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), report.Operations())
+	assert.Zero(t, report.Errors(OpInsert))
+	assert.Equal(t, 200, fss.KeysCount())
+
+	// 读取、更新、插入、扫描和读改写都不会失败
+	w.ReadProportion, w.UpdateProportion = 0.2, 0.2
+	w.InsertProportion, w.ScanProportion, w.ReadModifyWriteProportion = 0.2, 0.2, 0.2
+	w.MaxScanLength = 10
+	report, err = Run(context.Background(), db, w, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), report.Operations())
+	for op := Operation(0); op < operationKinds; op++ {
+		assert.Zero(t, report.Errors(op), op.String())
+	}
+	assert.Equal(t, 200+len(report.ops[OpInsert].latencies), fss.KeysCount())
+
+	var out bytes.Buffer
+	_, err = report.WriteTo(&out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "[OVERALL], Throughput(ops/sec), ")
+	assert.Contains(t, out.String(), "[READ-MODIFY-WRITE], 99thPercentileLatency(us), ")
+	assert.NotContains(t, out.String(), "Return=ERROR")
+}
@@ -15,11 +15,18 @@
 package clog
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fatih/color"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -29,6 +36,72 @@ const (
 	processName = "UrnaDB"
 )
 
+// Level 日志级别，低于当前级别的日志不会输出
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (lv Level) String() string {
+	switch lv {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(lv)) + ")"
+}
+
+// ParseLevel 解析配置文件中的日志级别，空字符串为 info 级别
+func ParseLevel(text string) (Level, error) {
+	switch strings.ToLower(text) {
+	case "debug":
+		return DebugLevel, nil
+	case "", "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", text)
+}
+
+// Format 日志输出格式
+type Format int32
+
+const (
+	TextFormat Format = iota
+	JSONFormat
+)
+
+// ParseFormat 解析配置文件中的日志格式，空字符串为 text 格式
+func ParseFormat(text string) (Format, error) {
+	switch strings.ToLower(text) {
+	case "", "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return TextFormat, fmt.Errorf("unknown log format %q", text)
+}
+
+// Rotation 日志文件轮转策略，MaxSize 单位 MB，MaxAge 单位天
+type Rotation struct {
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+	Compress   bool
+}
+
 var (
 	// Logger colors and log message prefixes
 	warnColor   = color.New(color.Bold, color.FgYellow)
@@ -40,12 +113,36 @@ var (
 	infoPrefix  = infoColor.Sprintf("[INFO] ")
 	debugPrefix = debugColor.Sprintf("[DEBUG] ")
 
-	IsDebug = false
+	prefixes = map[Level]string{
+		DebugLevel: debugPrefix,
+		InfoLevel:  infoPrefix,
+		WarnLevel:  warnPrefix,
+		ErrorLevel: errorPrefix,
+	}
+
+	// DefaultRotation 默认每个日志文件最大 10 MB，保留 3 个备份，最多保留 7 天
+	DefaultRotation = Rotation{
+		MaxSize:    10,
+		MaxBackups: 3,
+		MaxAge:     7,
+		Compress:   true,
+	}
 )
 
 var (
 	clog *log.Logger
 	dlog *log.Logger
+
+	// JSON 格式下所有日志都写入 writer，mu 保证每行日志完整写入
+	mu     sync.Mutex
+	writer io.Writer = os.Stdout
+
+	minLevel     atomic.Int32
+	outputFormat atomic.Int32
+	// 模块级别覆盖全局日志级别，key 为模块名称
+	modules sync.Map
+
+	std = &Logger{}
 )
 
 func init() {
@@ -55,6 +152,7 @@ func init() {
 	clog = newLogger(os.Stdout, "["+processName+":C] ", log.Ldate|log.Ltime)
 	// [WIREDKV:D] 只能输出日志信息到标准输出中
 	dlog = newLogger(os.Stdout, "["+processName+":D] ", log.Ldate|log.Ltime|log.Lshortfile)
+	minLevel.Store(int32(InfoLevel))
 }
 
 func newLogger(out io.Writer, prefix string, flag int) *log.Logger {
@@ -62,61 +160,250 @@ func newLogger(out io.Writer, prefix string, flag int) *log.Logger {
 }
 
 func multipleLogger(out io.Writer, prefix string, flag int) {
+	mu.Lock()
+	defer mu.Unlock()
+	writer = out
 	clog = log.New(out, prefix, flag)
 }
 
-func SetOutput(path string) {
+// SetOutput 日志同时输出到控制台和 path 文件中，文件按照 rotation 策略轮转
+func SetOutput(path string, rotation Rotation) {
 	// 正常模式的日志记录需要输出到控制台和日志文件中
 	multipleLogger(io.MultiWriter(os.Stdout, &lumberjack.Logger{
 		Filename:   path, // 使用 lumberjack 设置日志轮转
-		MaxSize:    10,   // 每个日志文件最大 10 MB
-		MaxBackups: 3,    // 最多保留 3 个备份
-		MaxAge:     7,    // 日志文件最多保留 7 天
-		Compress:   true, // 启用压缩
+		MaxSize:    rotation.MaxSize,
+		MaxBackups: rotation.MaxBackups,
+		MaxAge:     rotation.MaxAge,
+		Compress:   rotation.Compress,
 	}), "["+processName+":C] ", log.Ldate|log.Ltime)
 }
 
+// SetLevel 设置全局日志级别，没有单独设置级别的模块使用全局级别
+func SetLevel(lv Level) {
+	minLevel.Store(int32(lv))
+}
+
+// GetLevel 返回当前全局日志级别
+func GetLevel() Level {
+	return Level(minLevel.Load())
+}
+
+// SetFormat 设置日志输出格式，JSON 格式方便日志采集系统解析
+func SetFormat(f Format) {
+	outputFormat.Store(int32(f))
+}
+
+// SetModuleLevel 单独设置某个模块的日志级别
+func SetModuleLevel(module string, lv Level) {
+	modules.Store(module, lv)
+}
+
+// ResetModuleLevel 删除模块单独设置的日志级别，之后使用全局级别
+func ResetModuleLevel(module string) {
+	modules.Delete(module)
+}
+
+// ModuleLevels 返回全部单独设置了日志级别的模块
+func ModuleLevels() map[string]Level {
+	levels := make(map[string]Level)
+	modules.Range(func(key, value any) bool {
+		levels[key.(string)] = value.(Level)
+		return true
+	})
+	return levels
+}
+
+// Logger 模块日志记录器，输出的日志会带上模块名称和附加字段
+type Logger struct {
+	module string
+	fields []field
+}
+
+// field 是日志的附加字段，JSON 格式下作为顶层字段输出，文本格式下以 key=value 的形式跟在消息后面
+type field struct {
+	key   string
+	value any
+}
+
+// Module 返回名称为 name 的模块日志记录器，例如 vfs、server、compaction
+func Module(name string) *Logger {
+	return &Logger{module: name}
+}
+
+// With 返回带有附加字段的日志记录器，这个记录器输出的每一行日志都带有这个字段，例如请求 ID
+func (l *Logger) With(key string, value any) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{module: l.module, fields: append(fields, field{key: key, value: value})}
+}
+
+// Enabled 判断 lv 级别的日志是否会被输出
+func (l *Logger) Enabled(lv Level) bool {
+	if l.module != "" {
+		if v, ok := modules.Load(l.module); ok {
+			return lv >= v.(Level)
+		}
+	}
+	return lv >= GetLevel()
+}
+
+func (l *Logger) log(lv Level, message string) {
+	if l.Enabled(lv) {
+		// 调用链为 caller -> Info -> log -> output
+		output(4, lv, l.module, l.fields, message)
+	}
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warn(v ...interface{}) {
+	l.log(WarnLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.log(WarnLevel, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.log(InfoLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.log(InfoLevel, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.log(DebugLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(DebugLevel, fmt.Sprintf(format, v...))
+}
+
+type entry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module,omitempty"`
+	Caller  string `json:"caller,omitempty"`
+	Message string `json:"msg"`
+}
+
+func output(calldepth int, lv Level, module string, fields []field, message string) {
+	if Format(outputFormat.Load()) == JSONFormat {
+		e := entry{
+			Time:    time.Now().Format(time.RFC3339),
+			Level:   lv.String(),
+			Module:  module,
+			Message: message,
+		}
+		// runtime.Caller 比 log.Output 少算了 output 自身这一层
+		if _, file, line, ok := runtime.Caller(calldepth - 1); ok {
+			e.Caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+		bs, _ := json.Marshal(e)
+		if len(fields) > 0 {
+			bs = appendJSONFields(bs[:len(bs)-1], fields)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = writer.Write(append(bs, '\n'))
+		return
+	}
+
+	if module != "" {
+		message = "[" + module + "] " + message
+	}
+	if len(fields) > 0 {
+		message = appendTextFields(message, fields)
+	}
+
+	if lv == DebugLevel {
+		_ = dlog.Output(calldepth, debugPrefix+message)
+		return
+	}
+
+	mu.Lock()
+	logger := clog
+	mu.Unlock()
+	_ = logger.Output(calldepth, prefixes[lv]+message)
+}
+
+// appendJSONFields 把附加字段追加到去掉了结尾 } 的 JSON 对象中，无法编码的值使用字符串
+func appendJSONFields(bs []byte, fields []field) []byte {
+	for _, f := range fields {
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		bs = append(bs, ',')
+		bs = append(bs, key...)
+		bs = append(bs, ':')
+		bs = append(bs, value...)
+	}
+	return append(bs, '}')
+}
+
+// appendTextFields 以 key=value 的形式追加附加字段，包含空白、引号或者等号的值加上引号
+func appendTextFields(message string, fields []field) string {
+	var b strings.Builder
+	b.WriteString(message)
+	for _, f := range fields {
+		value := fmt.Sprint(f.value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		b.WriteByte(' ')
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
 func Error(v ...interface{}) {
-	clog.Output(2, errorPrefix+fmt.Sprint(v...))
+	std.log(ErrorLevel, fmt.Sprint(v...))
 }
 
 func Errorf(format string, v ...interface{}) {
-	clog.Output(2, errorPrefix+fmt.Sprintf(format, v...))
+	std.log(ErrorLevel, fmt.Sprintf(format, v...))
 }
 
 func Warn(v ...interface{}) {
-	clog.Output(2, warnPrefix+fmt.Sprint(v...))
+	std.log(WarnLevel, fmt.Sprint(v...))
 }
 
 func Warnf(format string, v ...interface{}) {
-	clog.Output(2, warnPrefix+fmt.Sprintf(format, v...))
+	std.log(WarnLevel, fmt.Sprintf(format, v...))
 }
 
 func Info(v ...interface{}) {
-	clog.Output(2, infoPrefix+fmt.Sprint(v...))
+	std.log(InfoLevel, fmt.Sprint(v...))
 }
 
 func Infof(format string, v ...interface{}) {
-	clog.Output(2, infoPrefix+fmt.Sprintf(format, v...))
+	std.log(InfoLevel, fmt.Sprintf(format, v...))
 }
 
 func Debug(v ...interface{}) {
-	if IsDebug {
-		dlog.Output(2, debugPrefix+fmt.Sprint(v...))
-	}
+	std.log(DebugLevel, fmt.Sprint(v...))
 }
 
 func Debugf(format string, v ...interface{}) {
-	if IsDebug {
-		dlog.Output(2, debugPrefix+fmt.Sprintf(format, v...))
-	}
+	std.log(DebugLevel, fmt.Sprintf(format, v...))
 }
 
 func Failed(v ...interface{}) {
 	pc, file, line, _ := runtime.Caller(1)
 	function := runtime.FuncForPC(pc)
 	message := fmt.Sprintf("%s:%d %s() %s", file, line, function.Name(), fmt.Sprint(v...))
-	clog.Output(2, errorPrefix+message)
+	output(3, ErrorLevel, "", nil, message)
 	panic(message)
 }
 
@@ -125,6 +412,6 @@ func Failedf(format string, v ...interface{}) {
 	function := runtime.FuncForPC(pc)
 	message := fmt.Sprintf("%s:%d %s() %s", file, line, function.Name(), fmt.Sprint(v...))
 	// 输出日志并触发 panic
-	clog.Output(2, errorPrefix+message)
+	output(3, ErrorLevel, "", nil, message)
 	panic(message)
 }
@@ -15,7 +15,9 @@
 package clog
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -24,7 +26,7 @@ func TestLogging(t *testing.T) {
 	tempFile := "./example-log.txt"
 	defer os.Remove(tempFile) // 退出时删除
 
-	SetOutput(tempFile)
+	SetOutput(tempFile, DefaultRotation)
 
 	Info("info message.")
 
@@ -38,7 +40,8 @@ func TestLogging(t *testing.T) {
 
 	Errorf("error %s", "message.")
 
-	IsDebug = true
+	SetLevel(DebugLevel)
+	defer SetLevel(InfoLevel)
 
 	Debug("debug message.")
 
@@ -46,6 +49,115 @@ func TestLogging(t *testing.T) {
 
 }
 
+func TestParseLevel(t *testing.T) {
+	tests := map[string]Level{
+		"":      InfoLevel,
+		"debug": DebugLevel,
+		"INFO":  InfoLevel,
+		"warn":  WarnLevel,
+		"error": ErrorLevel,
+	}
+	for text, want := range tests {
+		lv, err := ParseLevel(text)
+		if err != nil {
+			t.Fatalf("ParseLevel(%q) returned error: %v", text, err)
+		}
+		if lv != want {
+			t.Errorf("ParseLevel(%q) = %s, want %s", text, lv, want)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel() should reject unknown level")
+	}
+}
+
+func TestJSONModuleLogging(t *testing.T) {
+	tempFile := "./example-json-log.txt"
+	defer os.Remove(tempFile)
+
+	SetOutput(tempFile, DefaultRotation)
+	SetFormat(JSONFormat)
+	defer SetFormat(TextFormat)
+
+	SetModuleLevel("compaction", ErrorLevel)
+	defer ResetModuleLevel("compaction")
+
+	if lv, ok := ModuleLevels()["compaction"]; !ok || lv != ErrorLevel {
+		t.Errorf("ModuleLevels() = %v, want compaction at error level", ModuleLevels())
+	}
+
+	vlog := Module("vfs")
+	vlog.Infof("region %d opened", 1)
+	vlog.Debug("debug message should be filtered.")
+	Module("compaction").Warn("warn message should be filtered.")
+
+	data, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 log line, got %d: %s", len(lines), data)
+	}
+
+	var e entry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("log line is not json: %v", err)
+	}
+
+	if e.Level != "info" || e.Module != "vfs" || e.Message != "region 1 opened" {
+		t.Errorf("unexpected log entry: %+v", e)
+	}
+
+	if !strings.HasPrefix(e.Caller, "log_test.go:") {
+		t.Errorf("unexpected caller: %s", e.Caller)
+	}
+}
+
+func TestLoggerWith(t *testing.T) {
+	tempFile := "./example-fields-log.txt"
+	defer os.Remove(tempFile)
+
+	SetOutput(tempFile, DefaultRotation)
+	SetFormat(JSONFormat)
+
+	base := Module("server")
+	rlog := base.With("request_id", "abc123")
+	rlog.With("status", 200).With("path", "/text/a b").Info("request")
+	base.Info("no fields")
+
+	SetFormat(TextFormat)
+	rlog.With("path", "/text/a b").Warn("request")
+
+	data, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 log lines, got %d: %s", len(lines), data)
+	}
+
+	var e map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("log line is not json: %v", err)
+	}
+	if e["msg"] != "request" || e["request_id"] != "abc123" || e["status"] != float64(200) || e["path"] != "/text/a b" {
+		t.Errorf("unexpected log entry: %v", e)
+	}
+
+	// 附加字段不会影响原来的记录器
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("unexpected fields in log line: %s", lines[1])
+	}
+
+	if !strings.HasSuffix(lines[2], `[server] request request_id=abc123 path="/text/a b"`) {
+		t.Errorf("unexpected text log line: %s", lines[2])
+	}
+}
+
 // 测试 Failed 函数
 func TestFailed(t *testing.T) {
 	msg, panicked := capturePanic(func() {
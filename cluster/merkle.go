@@ -0,0 +1,106 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// MerkleLeaves Merkle 树叶子节点的数量，每个 key 按照哈希值落在其中一个叶子上
+const MerkleLeaves = 1024
+
+// MerkleTree 是用于副本之间反熵修复的 Merkle 树，使用数组按照堆的方式保存，
+// 下标 1 是根节点，下标 i 的子节点是 2i 和 2i+1，叶子从下标 MerkleLeaves 开始。
+// 叶子的值是落在这个叶子上所有 key 摘要的异或，和 key 加入的顺序无关。
+type MerkleTree struct {
+	nodes []uint64
+	dirty bool
+}
+
+// NewMerkleTree 创建一个空的 Merkle 树
+func NewMerkleTree() *MerkleTree {
+	return &MerkleTree{nodes: make([]uint64, 2*MerkleLeaves), dirty: true}
+}
+
+// MerkleTreeFrom 使用 Nodes 返回的数组还原 Merkle 树
+func MerkleTreeFrom(nodes []uint64) (*MerkleTree, error) {
+	if len(nodes) != 2*MerkleLeaves {
+		return nil, fmt.Errorf("merkle tree must have %d nodes, got %d", 2*MerkleLeaves, len(nodes))
+	}
+	return &MerkleTree{nodes: append([]uint64(nil), nodes...)}, nil
+}
+
+// Bucket 返回 key 所在的叶子编号
+func Bucket(key string) int {
+	return int(hashOf(key) % MerkleLeaves)
+}
+
+// Add 把 key 的摘要加入到对应的叶子上
+func (t *MerkleTree) Add(key string, digest uint64) {
+	t.nodes[MerkleLeaves+Bucket(key)] ^= digest
+	t.dirty = true
+}
+
+// Nodes 返回包含根节点和所有叶子的数组
+func (t *MerkleTree) Nodes() []uint64 {
+	t.sum()
+	return t.nodes
+}
+
+// Root 返回根节点的哈希值，两个副本的根节点相同说明数据一致
+func (t *MerkleTree) Root() uint64 {
+	t.sum()
+	return t.nodes[1]
+}
+
+// Diff 从根节点开始逐层比较，返回数据不一致的叶子编号
+func (t *MerkleTree) Diff(other *MerkleTree) []int {
+	t.sum()
+	other.sum()
+
+	var buckets []int
+	var walk func(i int)
+	walk = func(i int) {
+		if t.nodes[i] == other.nodes[i] {
+			return
+		}
+		if i >= MerkleLeaves {
+			buckets = append(buckets, i-MerkleLeaves)
+			return
+		}
+		walk(2 * i)
+		walk(2*i + 1)
+	}
+	walk(1)
+
+	return buckets
+}
+
+func (t *MerkleTree) sum() {
+	if !t.dirty {
+		return
+	}
+
+	var buf [16]byte
+	for i := MerkleLeaves - 1; i >= 1; i-- {
+		binary.LittleEndian.PutUint64(buf[:8], t.nodes[2*i])
+		binary.LittleEndian.PutUint64(buf[8:], t.nodes[2*i+1])
+		t.nodes[i] = murmur3.Sum64(buf[:])
+	}
+	t.dirty = false
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleTree_Diff(t *testing.T) {
+	a, b := NewMerkleTree(), NewMerkleTree()
+	assert.Equal(t, a.Root(), b.Root())
+	assert.Empty(t, a.Diff(b))
+
+	// 加入的顺序不影响结果
+	for i := 0; i < 100; i++ {
+		a.Add(fmt.Sprintf("user:%d", i), uint64(i+1))
+		b.Add(fmt.Sprintf("user:%d", 99-i), uint64(100-i))
+	}
+	assert.Equal(t, a.Root(), b.Root())
+
+	b.Add("user:7", 8)
+	b.Add("user:7", 9)
+	b.Add("user:100", 101)
+	assert.NotEqual(t, a.Root(), b.Root())
+	assert.ElementsMatch(t, []int{Bucket("user:7"), Bucket("user:100")}, a.Diff(b))
+
+	remote, err := MerkleTreeFrom(b.Nodes())
+	assert.NoError(t, err)
+	assert.Equal(t, b.Root(), remote.Root())
+	assert.ElementsMatch(t, a.Diff(b), a.Diff(remote))
+
+	_, err = MerkleTreeFrom([]uint64{1, 2, 3})
+	assert.Error(t, err)
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cluster 实现集群模式下 key 到节点的一致性哈希分片。
+package cluster
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// DefaultVirtualNodes 每个物理节点在哈希环上的虚拟节点数量，数量越多 key 分布越均匀
+const DefaultVirtualNodes = 160
+
+// Ring 是一致性哈希环，增删节点时只有相邻区间的 key 会迁移到其他节点。
+// Ring 创建之后不可修改，可以被多个 goroutine 并发读取。
+type Ring struct {
+	nodes  []string
+	hashes []uint64
+	owners map[uint64]string
+}
+
+// NewRing 根据节点地址列表创建哈希环，vnodes 小于等于 0 时使用 DefaultVirtualNodes
+func NewRing(nodes []string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	ring := &Ring{
+		nodes:  make([]string, 0, len(nodes)),
+		hashes: make([]uint64, 0, len(nodes)*vnodes),
+		owners: make(map[uint64]string, len(nodes)*vnodes),
+	}
+
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		ring.nodes = append(ring.nodes, node)
+		for i := 0; i < vnodes; i++ {
+			hash := hashOf(node + "#" + strconv.Itoa(i))
+			// 哈希冲突的虚拟节点保留第一个节点，所有节点计算出的结果一致
+			if _, ok := ring.owners[hash]; ok {
+				continue
+			}
+			ring.owners[hash] = node
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+
+	return ring
+}
+
+func hashOf(s string) uint64 {
+	return murmur3.Sum64([]byte(s))
+}
+
+// Locate 返回负责 key 的节点，哈希环上没有节点时返回空字符串
+func (r *Ring) Locate(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := hashOf(key)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.owners[r.hashes[i]]
+}
+
+// LocateN 返回负责 key 的 n 个不同节点，第一个和 Locate 的结果相同，
+// 其余的是沿着哈希环顺时针方向遇到的节点，节点数量不足 n 个时返回所有节点
+func (r *Ring) LocateN(key string, n int) []string {
+	if len(r.hashes) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+
+	hash := hashOf(key)
+	start := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+
+	nodes := make([]string, 0, n)
+	for i := 0; i < len(r.hashes) && len(nodes) < n; i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes 返回哈希环上的所有节点，顺序和创建时传入的顺序一致
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Locate(t *testing.T) {
+	empty := NewRing(nil, 0)
+	assert.Equal(t, "", empty.Locate("key"))
+
+	nodes := []string{"10.0.0.1:2668", "10.0.0.2:2668", "10.0.0.3:2668", "10.0.0.1:2668"}
+	ring := NewRing(nodes, 0)
+	assert.Equal(t, nodes[:3], ring.Nodes())
+
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		node := ring.Locate(key)
+		// 相同的 key 总是落在同一个节点上
+		assert.Equal(t, node, ring.Locate(key))
+		counts[node]++
+	}
+
+	assert.Len(t, counts, 3)
+	for _, count := range counts {
+		assert.InEpsilon(t, 10000, count, 0.25)
+	}
+}
+
+func TestRing_Rebalance(t *testing.T) {
+	before := NewRing([]string{"a:1", "b:1", "c:1"}, 0)
+	after := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, 0)
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("order:%d", i)
+		from, to := before.Locate(key), after.Locate(key)
+		if from != to {
+			// 新增节点时 key 只会迁移到新节点
+			assert.Equal(t, "d:1", to)
+			moved++
+		}
+	}
+
+	assert.InEpsilon(t, 2500, moved, 0.3)
+}
+
+func TestRing_LocateN(t *testing.T) {
+	assert.Nil(t, NewRing(nil, 0).LocateN("key", 2))
+
+	ring := NewRing([]string{"a:1", "b:1", "c:1"}, 0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		nodes := ring.LocateN(key, 2)
+		assert.Len(t, nodes, 2)
+		assert.Equal(t, ring.Locate(key), nodes[0])
+		assert.NotEqual(t, nodes[0], nodes[1])
+	}
+
+	assert.ElementsMatch(t, []string{"a:1", "b:1", "c:1"}, ring.LocateN("key", 5))
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"errors"
+	"strings"
+)
+
+// Slice 是 keyspace 的一部分，Prefix 不为空时按照 key 的前缀匹配，
+// 否则匹配哈希值落在 [Start, End) 区间的 key，哈希值和哈希环使用的算法相同
+type Slice struct {
+	Prefix string `json:"prefix,omitempty"`
+	Start  uint64 `json:"start,omitempty"`
+	End    uint64 `json:"end,omitempty"`
+}
+
+// Validate 检查 Slice 是否为空
+func (s Slice) Validate() error {
+	if s.Prefix == "" && s.Start >= s.End {
+		return errors.New("slice requires a prefix or a hash range with start less than end")
+	}
+	return nil
+}
+
+// Contains 返回 key 是否属于这个 Slice
+func (s Slice) Contains(key string) bool {
+	if s.Prefix != "" {
+		return strings.HasPrefix(key, s.Prefix)
+	}
+	hash := Hash(key)
+	return hash >= s.Start && hash < s.End
+}
+
+// Hash 返回 key 在哈希环上的位置
+func Hash(key string) uint64 {
+	return hashOf(key)
+}
+
+// Route 把一个 Slice 固定路由到 Node，优先于哈希环的结果，用于迁移之后的 keyspace
+type Route struct {
+	Slice
+	Node string `json:"node"`
+}
+
+// Lookup 返回第一个包含 key 的路由的节点
+func Lookup(routes []Route, key string) (string, bool) {
+	for _, route := range routes {
+		if route.Contains(key) {
+			return route.Node, true
+		}
+	}
+	return "", false
+}
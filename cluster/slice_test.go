@@ -0,0 +1,46 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlice_Contains(t *testing.T) {
+	assert.Error(t, Slice{}.Validate())
+	assert.Error(t, Slice{Start: 10, End: 10}.Validate())
+	assert.NoError(t, Slice{Prefix: "user:"}.Validate())
+
+	prefix := Slice{Prefix: "user:"}
+	assert.True(t, prefix.Contains("user:1"))
+	assert.False(t, prefix.Contains("order:1"))
+
+	hash := Hash("user:1")
+	assert.True(t, Slice{Start: hash, End: hash + 1}.Contains("user:1"))
+	assert.False(t, Slice{Start: hash + 1, End: hash + 2}.Contains("user:1"))
+
+	routes := []Route{
+		{Slice: Slice{Prefix: "user:"}, Node: "10.0.0.2:2668"},
+		{Slice: Slice{Prefix: "user:vip:"}, Node: "10.0.0.3:2668"},
+	}
+	node, ok := Lookup(routes, "user:vip:1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2:2668", node)
+
+	_, ok = Lookup(routes, "order:1")
+	assert.False(t, ok)
+}
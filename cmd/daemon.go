@@ -0,0 +1,150 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/utils"
+)
+
+// 后台进程通过这个环境变量拿到父进程生成并输出的随机密码
+const daemonAuthEnv = "URNADB_DAEMON_AUTH"
+
+// 父进程等待后台进程写入 pid 文件的最长时间
+const daemonStartTimeout = 10 * time.Second
+
+// status 子命令在服务没有运行时的退出码，和 LSB init 脚本的约定一致
+const exitNotRunning = 3
+
+// runAsDaemon 在新的会话中重新启动当前程序，等待后台进程写入 pid 文件之后退出
+func runAsDaemon() {
+	pidfile := conf.Settings.PidFilePath()
+	if pid, err := utils.ReadPidFile(pidfile); err == nil {
+		clog.Failed(fmt.Errorf("urnadb is already running with PID %d", pid))
+	}
+
+	cmd := exec.Command(os.Args[0], utils.TrimDaemon(os.Args)...)
+	cmd.Env = append(os.Environ(), daemonAuthEnv+"="+conf.Settings.Password)
+	detach(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(daemonStartTimeout)
+
+	for {
+		select {
+		case err := <-exited:
+			clog.Failed(fmt.Errorf("daemon exited during startup: %v, see the log file %s", err, conf.Settings.LogPath))
+		case <-timeout:
+			clog.Warnf("Daemon PID %d has not written the pid file %s yet", cmd.Process.Pid, pidfile)
+			os.Exit(0)
+		case <-ticker.C:
+			pid, err := utils.ReadPidFile(pidfile)
+			if err == nil && pid == cmd.Process.Pid {
+				clog.Infof("Daemon launched PID: %d", pid)
+				os.Exit(0)
+			}
+		}
+	}
+}
+
+// runControl 执行 stop、status、reload 和 upgrade 子命令，通过 pid 文件找到运行中的进程
+func runControl(command string, timeout time.Duration) {
+	pidfile := conf.Settings.PidFilePath()
+	pid, err := utils.ReadPidFile(pidfile)
+	if errors.Is(err, utils.ErrNotRunning) {
+		fmt.Printf("urnadb is not running (%s)\n", pidfile)
+		if command == "status" {
+			os.Exit(exitNotRunning)
+		}
+		if command == "reload" || command == "upgrade" {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	switch command {
+	case "status":
+		fmt.Printf("urnadb is running with PID %d\n", pid)
+	case "reload":
+		err := signalReload(pid)
+		if err != nil {
+			clog.Failed(err)
+		}
+		fmt.Printf("Sent reload signal to urnadb PID %d\n", pid)
+	case "upgrade":
+		err := signalUpgrade(pid)
+		if err != nil {
+			clog.Failed(err)
+		}
+		fmt.Printf("Sent upgrade signal to urnadb PID %d\n", pid)
+		// 新进程恢复完成并且旧进程退出之后 pid 文件中才是新进程
+		deadline := time.Now().Add(timeout)
+		for {
+			next, err := utils.ReadPidFile(pidfile)
+			if err == nil && next != pid && !utils.ProcessAlive(pid) {
+				fmt.Printf("urnadb upgraded from PID %d to PID %d\n", pid, next)
+				break
+			}
+			if time.Now().After(deadline) {
+				clog.Failed(fmt.Errorf("urnadb PID %d did not hand over within %s, see the log file %s", pid, timeout, conf.Settings.LogPath))
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	case "stop":
+		err := signalStop(pid)
+		if err != nil {
+			clog.Failed(err)
+		}
+		// 等待进程关闭服务器并且刷盘之后退出
+		deadline := time.Now().Add(timeout)
+		for utils.ProcessAlive(pid) {
+			if time.Now().After(deadline) {
+				clog.Failed(fmt.Errorf("urnadb PID %d did not exit within %s", pid, timeout))
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Printf("urnadb PID %d stopped\n", pid)
+	}
+	os.Exit(0)
+}
+
+// notify 通知 systemd 服务状态的变化，不是由 systemd 使用 Type=notify 启动时什么都不做
+func notify(state string) {
+	_, err := utils.SdNotify(state)
+	if err != nil {
+		clog.Warnf("failed to notify systemd %q: %v", state, err)
+	}
+}
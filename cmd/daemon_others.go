@@ -0,0 +1,45 @@
+//go:build !unix
+
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// 没有 SIGUSR2 信号的平台不支持升级时交接监听地址
+var upgradeSignals []os.Signal
+
+func detach(cmd *exec.Cmd) {}
+
+// signalStop 在没有信号的平台上只能直接结束进程
+func signalStop(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+func signalReload(pid int) error {
+	return errors.New("reload is not supported on this platform, restart the server instead")
+}
+
+func signalUpgrade(pid int) error {
+	return errors.New("upgrade is not supported on this platform, restart the server instead")
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// upgradeSignals 是让运行中的进程把监听地址和数据目录交给新版本进程的信号
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// detach 让后台进程运行在新的会话中，关闭终端时不会收到 SIGHUP
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// signalStop 发送 SIGTERM，进程关闭服务器之后退出
+func signalStop(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// signalReload 发送 SIGHUP，进程重新加载配置文件
+func signalReload(pid int) error {
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+// signalUpgrade 发送 SIGUSR2，进程启动新的可执行文件并且把监听地址交给它
+func signalUpgrade(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
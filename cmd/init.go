@@ -0,0 +1,122 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/utils"
+	"github.com/gookit/color"
+)
+
+const (
+	// initConfigName 是 init 在数据卷中生成的配置文件
+	initConfigName = "config.yaml"
+	// 生成的密码长度和加密密钥长度，密钥长度对应 AES-256
+	initPasswordSize = 26
+	initSecretSize   = 32
+	// 配置文件中保存了密码和密钥，只有所有者可以读取
+	initConfigPerm = fs.FileMode(0600)
+)
+
+// initConfigPath 返回 init 子命令生成的配置文件路径，root 是数据卷的根目录
+func initConfigPath(root string) string {
+	if initConfig != "" {
+		return initConfig
+	}
+	return filepath.Join(root, initConfigName)
+}
+
+// runInit 在第一次使用空的数据卷启动时生成配置，随机生成访问密码和数据加密密钥，
+// 创建 data 和 logs 目录，生成的密码和密钥只输出这一次。配置文件已经存在时不做任何修改，
+// 数据卷中已经有数据但是没有配置文件时跳过，已有的数据可能没有加密，不能使用新生成的密钥打开。
+// 环境变量设置的配置项写入生成的配置文件，URNADB_AUTH 设置了密码时不生成密码
+func runInit() {
+	root := conf.Settings.Path
+	path := initConfigPath(root)
+
+	if _, err := os.Stat(path); err == nil {
+		clog.Infof("Data volume already initialized with %s", path)
+		os.Exit(0)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		clog.Failed(err)
+	}
+	if len(entries) > 0 {
+		clog.Warnf("Data volume %s is not empty and has no %s, skipping initialization", root, path)
+		os.Exit(0)
+	}
+
+	opt := *conf.Settings
+	opt.Path = filepath.Join(root, "data")
+	opt.LogPath = filepath.Join(root, "logs", "urnadb.log")
+
+	generated := opt.Password == conf.Default.Password
+	if generated {
+		opt.Password, err = utils.SecureRandomString(initPasswordSize)
+		if err != nil {
+			clog.Failed(fmt.Errorf("failed to generate password: %w", err))
+		}
+	}
+	encrypted := opt.Encryptor.Enable
+	if !encrypted {
+		opt.Encryptor.Enable = true
+		opt.Encryptor.Secret, err = utils.SecureRandomString(initSecretSize)
+		if err != nil {
+			clog.Failed(fmt.Errorf("failed to generate encryption secret: %w", err))
+		}
+	}
+
+	err = conf.Vaildated(&opt)
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	for _, dir := range []string{root, opt.Path, filepath.Dir(opt.LogPath)} {
+		err = os.MkdirAll(dir, conf.FSPerm)
+		if err != nil {
+			clog.Failed(fmt.Errorf("failed to create directory %s: %w", dir, err))
+		}
+	}
+
+	err = opt.SavedAs(path)
+	if err == nil {
+		err = os.Chmod(path, initConfigPerm)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		clog.Failed(fmt.Errorf("failed to save generated config: %w", err))
+	}
+
+	clog.Infof("Data volume initialized, config saved to %s", path)
+	if generated {
+		clog.Warnf("The generated password is: %s", color.Yellow.Sprintf("%s", opt.Password))
+	}
+	if !encrypted {
+		clog.Warnf("The generated encryption secret is: %s", color.Yellow.Sprintf("%s", opt.Encryptor.Secret))
+	}
+	if generated || !encrypted {
+		clog.Warn("Generated credentials are only printed once, data cannot be read without the encryption secret")
+	}
+	os.Exit(0)
+}
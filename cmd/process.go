@@ -16,17 +16,25 @@
 package cmd
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/auula/urnadb/clog"
 	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/consensus"
+	"github.com/auula/urnadb/kafka"
+	"github.com/auula/urnadb/objstore"
 	"github.com/auula/urnadb/server"
 	"github.com/auula/urnadb/utils"
 	"github.com/auula/urnadb/vfs"
@@ -43,6 +51,65 @@ var (
 	logo   string
 	banner = fmt.Sprintf(logo, version, website)
 	daemon = false
+	// control 是 stop、status、reload 或者 upgrade 子命令，stopTimeout 是 stop 和 upgrade 等待进程退出的时间
+	control     string
+	stopTimeout time.Duration
+	// validate 子命令检查配置并输出全部问题，不启动服务器
+	validate = false
+	// init 子命令在空的数据卷中生成配置，initConfig 是生成的配置文件路径，默认在数据卷的根目录
+	initialize = false
+	initConfig string
+	// restore 子命令从备份恢复数据目录，pointInTime 为零值时恢复到最新的备份
+	restore     = false
+	pointInTime time.Time
+	// upgrade-data 子命令离线把旧格式的 region 重写为当前的格式，upgradeFrom 和 upgradeTo 是 v1 或者 1 形式的格式版本
+	upgradeData   = false
+	upgradeFrom   string
+	upgradeTo     string
+	upgradeDryRun = false
+	// recoverUntil 不为零值时启动之后先把数据回滚到这个时间点
+	recoverUntil time.Time
+	// insecureOK 为 true 时安全检查发现严重问题也继续启动
+	insecureOK = false
+	// configFile 是启动时使用的配置文件，收到 SIGHUP 信号时重新加载
+	configFile string
+	// reloadable 是运行期间可以修改的配置项，修改其他配置项需要重启
+	reloadable = map[string]bool{
+		"log.level":           true,
+		"log.access":          true,
+		"log.sample":          true,
+		"region.enable":       true,
+		"region.cron":         true,
+		"region.flush":        true,
+		"region.rate":         true,
+		"region.latency":      true,
+		"region.grace":        true,
+		"region.scan":         true,
+		"region.ratio":        true,
+		"checkpoint.enable":   true,
+		"checkpoint.interval": true,
+		"limit.keysize":       true,
+		"limit.valuesize":     true,
+		"allowip":             true,
+		"strict":              true,
+		"session.enable":      true,
+		"session.ttl":         true,
+		"cors.enable":         true,
+		"cors.origins":        true,
+		"cors.methods":        true,
+		"cors.headers":        true,
+		"cors.credentials":    true,
+		"cors.maxage":         true,
+		"bulkhead.enable":     true,
+		"bulkhead.scan":       true,
+		"bulkhead.admin":      true,
+		"bulkhead.queue":      true,
+		"bulkhead.wait":       true,
+		"pool.leakdetect":     true,
+		"codec.default":       true,
+		"codec.types":         true,
+		"codec.namespaces":    true,
+	}
 )
 
 // Initialize components needed globally,
@@ -53,21 +120,63 @@ func init() {
 	color.RGB(255, 123, 34).Println(banner)
 	fl := parseFlags()
 
+	// validate 子命令把无法解析的配置作为检查结果输出
+	failed := clog.Failed
+	if validate {
+		failed = invalidConfig
+	}
+
+	configFile = fl.config
 	if conf.HasCustom(fl.config) {
 		err := conf.Load(fl.config, conf.Settings)
 		if err != nil {
-			clog.Failed(err)
+			failed(err)
 		}
 		clog.Info("Loading custom config file was successfully")
 	}
 
+	// 环境变量覆盖配置文件，命令行参数覆盖环境变量
+	applied, err := conf.LoadEnv(conf.Settings)
+	if err != nil {
+		failed(err)
+	}
+	if len(applied) > 0 {
+		clog.Infof("Configuration overridden by environment: %s", strings.Join(applied, ", "))
+	}
+
 	if fl.debug {
-		conf.Settings.Debug, clog.IsDebug = fl.debug, fl.debug
+		conf.Settings.Debug = fl.debug
+		clog.SetLevel(clog.DebugLevel)
+	}
+
+	if fl.path != conf.Default.Path {
+		conf.Settings.Path = fl.path
+	}
+
+	if fl.port != conf.Default.Port {
+		conf.Settings.Port = fl.port
+	}
+
+	if fl.pidfile != "" {
+		conf.Settings.PidFile = fl.pidfile
+	}
+
+	// stop、status、reload 和 upgrade 子命令只需要找到 pid 文件，validate 子命令自己检查全部配置，
+	// init 子命令自己生成密码，upgrade-data 子命令只读写数据目录
+	if control != "" || validate || initialize || upgradeData {
+		return
 	}
 
 	// Command line password has the highest priority
 	if fl.auth != conf.Default.Password {
 		conf.Settings.Password = fl.auth
+	} else if auth, ok := os.LookupEnv(daemonAuthEnv); ok {
+		// 后台进程使用父进程生成并输出的随机密码
+		conf.Settings.Password = auth
+		_ = os.Unsetenv(daemonAuthEnv)
+	} else if conf.Settings.Password != conf.Default.Password {
+		// 配置文件或者 URNADB_AUTH 环境变量设置的密码
+		clog.Info("Using the password from configuration")
 	} else {
 		// If no password is passed from the command line,
 		// the system randomly generates a 26-character password
@@ -76,68 +185,292 @@ func init() {
 		clog.Warnf("The default password is: %s", auth)
 	}
 
-	if fl.path != conf.Default.Path {
-		conf.Settings.Path = fl.path
+	if restore && fl.pointInTime != "" {
+		at, err := time.Parse(time.RFC3339, fl.pointInTime)
+		if err != nil {
+			clog.Failed(fmt.Errorf("invalid --point-in-time, expected RFC3339 format: %w", err))
+		}
+		pointInTime = at
 	}
 
-	if fl.port != conf.Default.Port {
-		conf.Settings.Port = fl.port
+	if fl.recoverUntil != "" {
+		at, err := time.Parse(time.RFC3339, fl.recoverUntil)
+		if err != nil {
+			clog.Failed(fmt.Errorf("invalid --recover-until, expected RFC3339 format: %w", err))
+		}
+		recoverUntil = at
 	}
 
 	clog.Debug(conf.Settings)
 
 	// Validate the input parameters, even if there is a default configuration,
 	// the command line parameters are not constrained
-	err := conf.Vaildated(conf.Settings)
+	err = conf.Vaildated(conf.Settings)
 	if err != nil {
 		clog.Failed(err)
 	}
 
-	clog.SetOutput(conf.Settings.LogPath)
+	clog.SetLevel(conf.Settings.LogLevel())
+	for module, level := range conf.Settings.LogModuleLevels() {
+		clog.SetModuleLevel(module, level)
+	}
+	clog.SetFormat(conf.Settings.LogFormat())
+	clog.SetOutput(conf.Settings.LogPath, conf.Settings.LogRotation())
 	clog.Info("Logging output initialized successfully")
 }
 
 func StartApp() {
-	if daemon {
+	if control != "" {
+		runControl(control, stopTimeout)
+	} else if validate {
+		runValidate()
+	} else if initialize {
+		runInit()
+	} else if restore {
+		runRestore()
+	} else if upgradeData {
+		runUpgradeData()
+	} else if daemon {
+		auditSecurity()
 		runAsDaemon()
 	} else {
+		auditSecurity()
 		runServer()
 	}
 }
 
-func runAsDaemon() {
-	args := utils.SplitArgs(utils.TrimDaemon(os.Args))
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.Env = os.Environ()
+// auditSecurity 输出启动时的安全检查报告，存在严重问题并且没有 --insecure-ok 参数时拒绝启动
+func auditSecurity() {
+	findings := conf.Audit(conf.Settings)
+	if len(findings) == 0 {
+		clog.Info("Security audit passed")
+		return
+	}
+
+	critical := 0
+	for _, f := range findings {
+		if f.Critical {
+			critical++
+			clog.Errorf("Security audit: %s", f)
+		} else {
+			clog.Warnf("Security audit: %s", f)
+		}
+	}
+	if critical == 0 {
+		return
+	}
+	if !insecureOK {
+		clog.Failed(fmt.Errorf("security audit found %d critical problem(s), fix them or start with --insecure-ok", critical))
+	}
+	clog.Warnf("Starting with %d critical security problem(s) because of --insecure-ok", critical)
+}
+
+// runRestore 把备份恢复到 --path 指定的空目录，恢复之后使用这个目录启动服务器
+func runRestore() {
+	store, err := newObjectStore(conf.Settings.Backup.ObjectStorage)
+	if err != nil {
+		clog.Failed(err)
+	}
 
-	err := cmd.Start()
+	clog.Infof("Restoring backup from %s to %s...", conf.Settings.Backup.Bucket, conf.Settings.Path)
+	result, err := vfs.RestoreBackup(context.Background(), store, conf.Settings.Path, pointInTime)
 	if err != nil {
 		clog.Failed(err)
 	}
 
-	clog.Infof("Daemon launched PID: %d", cmd.Process.Pid)
+	if result.Checkpoint != "" {
+		clog.Infof("Restored checkpoint %s", result.Checkpoint)
+	}
+	clog.Infof("Restored %d regions, skipped %d records written after the point in time", result.Regions, result.Skipped)
 	os.Exit(0)
 }
 
 func runServer() {
+	// 升级启动时从旧进程继承监听地址，旧进程退出之前不能写入 pid 文件
+	next, err := inheritUpgrade()
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	// 先写入 pid 文件，同一个数据目录不能同时启动两个进程，恢复期间也可以使用 stop 和 status
+	pidfile := conf.Settings.PidFilePath()
+	if next == nil {
+		err := utils.WritePidFile(pidfile)
+		if err != nil {
+			clog.Failed(err)
+		}
+	}
+
+	binds, err := conf.Settings.Listeners()
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	var inherited []net.Listener
+	if next != nil {
+		inherited = next.listeners
+	}
+
 	hts, err := server.New(&server.Options{
-		Port: conf.Settings.Port,
-		Auth: conf.Settings.Password,
+		Port:        conf.Settings.Port,
+		Bind:        binds,
+		Listeners:   inherited,
+		SocketMode:  conf.Settings.SocketMode(),
+		SocketGroup: conf.Settings.Socket.Group,
+		Auth:        conf.Settings.Password,
+		Timeout:     time.Duration(conf.Settings.Timeout) * time.Second,
 	})
 	if err != nil {
 		clog.Failed(err)
 	}
 
+	if conf.Settings.IsWhitelistIPEnabled() {
+		hts.SetAllowIP(conf.Settings.AllowIP)
+		clog.Info("Setting server whitelist IP successfully")
+	}
+
+	hts.SetLimits(conf.Settings.KeySizeLimit(), conf.Settings.ValueSizeLimit())
+	hts.SetStrictTypes(conf.Settings.Strict)
+	hts.SetPubSub(conf.Settings.PubSub.Persist, conf.Settings.PubSub.History)
+	hts.SetAccessLog(conf.Settings.Log.Access, conf.Settings.Log.Sample)
+
+	if conf.Settings.IsAnalyticsEnabled() {
+		hts.SetAnalytics(true)
+		clog.Info("Keyspace analytics activated successfully")
+	}
+
+	if conf.Settings.IsLeakDetectEnabled() {
+		hts.SetLeakDetection(true)
+		clog.Info("Object pool leak detection activated successfully")
+	}
+
+	if conf.Settings.IsConsoleEnabled() {
+		hts.SetConsole(conf.Settings.Console.Token)
+		clog.Infof("Admin console available at http://%s:%d/console", hts.IPv4(), hts.Port())
+	}
+
+	if conf.Settings.IsCORSEnabled() {
+		cors := conf.Settings.CORS
+		hts.SetCORS(cors.Origins, cors.Methods, cors.Headers, cors.Credentials, int(cors.MaxAge))
+		clog.Infof("CORS enabled for origins %v", cors.Origins)
+	}
+
+	if conf.Settings.IsSessionEnabled() {
+		hts.SetSession(time.Duration(conf.Settings.SessionTTL()) * time.Second)
+		clog.Infof("Session tokens expire after %d seconds", conf.Settings.Session.TTL)
+	}
+
+	if conf.Settings.IsClusterEnabled() {
+		c := conf.Settings.Cluster
+		hts.SetCluster(c.Self, c.Nodes, c.VNodes, c.Redirect)
+		clog.Infof("Cluster mode activated, %s is one of %d nodes", c.Self, len(c.Nodes))
+		if c.Replicas > 1 {
+			hts.SetReplicas(c.Replicas, c.Hints, time.Duration(c.Repair)*time.Second)
+			clog.Infof("Cluster replication activated, each key is stored on %d nodes", c.Replicas)
+		}
+	}
+
+	if conf.Settings.IsResponseCompressionEnabled() {
+		hts.SetCompression(conf.Settings.Compression.Threshold)
+		clog.Infof("HTTP response compression activated, threshold %d bytes", conf.Settings.Compression.Threshold)
+	}
+
+	if conf.Settings.IsBulkheadEnabled() {
+		b := conf.Settings.Bulkhead
+		hts.SetBulkhead(true, b.Scan, b.Admin, b.Queue, time.Duration(b.Wait)*time.Millisecond)
+		clog.Infof("Request bulkheads activated, scan %d, admin %d, queue %d", b.Scan, b.Admin, b.Queue)
+	}
+
+	if conf.Settings.IsSwaggerEnabled() {
+		hts.SetSwagger(true)
+		clog.Infof("Swagger UI available at http://%s:%d/swagger", hts.IPv4(), hts.Port())
+	}
+
+	if conf.Settings.IsTracingEnabled() {
+		tracing := conf.Settings.Tracing
+		err := hts.SetTracing(tracing.Endpoint, tracing.Insecure, tracing.Ratio)
+		if err != nil {
+			clog.Failed(err)
+		}
+		clog.Infof("OpenTelemetry tracing exporting to %s", tracing.Endpoint)
+	}
+
+	if conf.Settings.IsDiskGuardEnabled() {
+		hts.SetDiskGuard(uint64(conf.Settings.Disk.Watermark), time.Duration(conf.Settings.DiskCheckInterval())*time.Second)
+		clog.Info("Setting disk free space watermark successfully")
+	}
+
+	if conf.Settings.IsKafkaEnabled() {
+		k := conf.Settings.Kafka
+		producer, err := kafka.NewProducer(kafka.Options{
+			Brokers:  k.Brokers,
+			ClientID: k.ClientID,
+			Timeout:  time.Duration(k.Timeout) * time.Second,
+		})
+		if err != nil {
+			clog.Failed(err)
+		}
+		hts.SetKafkaSink(producer, k.Topic, k.Format, k.Batch)
+		clog.Infof("Kafka sink activated, changes are published to topic %s", k.Topic)
+	}
+
+	if conf.Settings.IsFaultInjectionEnabled() {
+		hts.SetFaultInjection(true)
+		clog.Warn("Fault injection is enabled, do not use this configuration in production")
+	}
+
+	if conf.Settings.IsQuotaEnabled() {
+		for namespace, quota := range conf.Settings.Quotas {
+			hts.SetQuota(namespace, quota.MaxKeys, quota.MaxBytes)
+		}
+		clog.Info("Setting namespace quotas successfully")
+	}
+
+	// 先启动 HTTP 服务器，恢复期间 /readyz 返回 503 和恢复进度，
+	// 升级时旧进程在恢复期间继续处理读请求，恢复完成之后才接受连接
+	progress := vfs.NewRecoveryProgress()
+	hts.SetRecoveryProgress(progress)
+
+	startup := func() {
+		go func() {
+			err := hts.Startup()
+			if err != nil {
+				clog.Failed(err)
+			}
+		}()
+	}
+	if next == nil {
+		startup()
+	}
+
 	clog.Info("Loading and parsing region data files...")
+	stop := make(chan struct{})
+	go logRecoveryProgress(progress, stop)
+
+	// 配置文件已经校验过索引类型和校验算法，这里不会出错
+	index, _ := vfs.ParseIndexKind(conf.Settings.Index)
+	checksum, _ := vfs.ParseChecksum(conf.Settings.Region.Checksum)
+
 	fss, err := vfs.OpenFS(&vfs.Options{
 		FSPerm:    conf.FSPerm,
 		Path:      conf.Settings.Path,
 		Threshold: conf.Settings.Region.Threshold,
+		Progress:  progress,
+		Checksum:  checksum,
+		Index:     index,
+		DirectIO:  conf.Settings.IsDirectIOEnabled(),
+		Separator: conf.Settings.Separator,
+		// 时间桶按照序列所在的命名空间分组统计，命名空间配额需要这个分组
+		PrefixGroup: server.SeriesPrefixGroup(conf.Settings.Separator),
 	})
+	close(stop)
 	if err != nil {
 		clog.Failed(err)
 	}
 
+	status := progress.Status()
+	clog.Infof("Recovered %d keys from %d regions in %s", status.KeysLoaded, status.RegionsTotal, status.Elapsed)
+
 	if conf.Settings.IsCompressionEnabled() {
 		// Set file data to use Snappy compression algorithm
 		fss.SetCompressor(vfs.SnappyCompressor)
@@ -150,56 +483,412 @@ func runServer() {
 		clog.Info("Static encryptor activated was successfully")
 	}
 
+	policy, err := codecPolicy(conf.Settings)
+	if err != nil {
+		clog.Failed(err)
+	}
+	fss.SetCodecs(policy)
+
+	fss.SetCompactThrottle(conf.Settings.CompactRate(), time.Duration(conf.Settings.CompactLatency())*time.Millisecond)
+	fss.SetTombstoneGrace(time.Duration(conf.Settings.TombstoneGrace()) * time.Second)
+
 	if conf.Settings.IsCompactRegionEnabled() {
 		fss.RunCompactRegion(conf.Settings.CompactRegionInterval())
 		clog.Info("Regions compression activated successfully")
 	}
 
+	if conf.Settings.ExpiryScanInterval() > 0 {
+		fss.RunExpiryCompaction(conf.Settings.ExpiryScanInterval(), conf.Settings.DeadRatio())
+		clog.Info("Expired regions compaction activated successfully")
+	}
+
 	if conf.Settings.IsCheckpointEnabled() {
 		fss.RunCheckpoint(conf.Settings.CheckpointInterval())
 		clog.Info("Indexs checkpoint activated successfully")
 	}
 
-	if conf.Settings.IsWhitelistIPEnabled() {
-		hts.SetAllowIP(conf.Settings.AllowIP)
-		clog.Info("Setting server whitelist IP successfully")
+	if conf.Settings.IsIndexSpillEnabled() {
+		spill := conf.Settings.Spill
+		err := fss.RunIndexSpill(uint64(spill.Budget)*vfs.MB, time.Duration(spill.Interval)*time.Second)
+		if err != nil {
+			clog.Failed(err)
+		}
+		clog.Infof("Index spill activated, index shards beyond %dMB are spilled to disk", spill.Budget)
+	}
+
+	if conf.Settings.FlushInterval() > 0 {
+		fss.RunFlush(conf.Settings.FlushInterval())
+		clog.Info("Active region flush activated successfully")
+	}
+
+	if conf.Settings.IsTieringEnabled() {
+		err := openTiering(fss)
+		if err != nil {
+			clog.Failed(err)
+		}
+		tiering := conf.Settings.Tiering
+		clog.Infof("Region tiering activated, regions unmodified for %d days are uploaded to %s", tiering.After, tiering.Bucket)
+	}
+
+	if conf.Settings.IsBackupEnabled() {
+		err := openBackup(fss)
+		if err != nil {
+			clog.Failed(err)
+		}
+		clog.Infof("Continuous backup activated, sealed regions are uploaded to %s", conf.Settings.Backup.Bucket)
+	}
+
+	if conf.Settings.IsTrashEnabled() {
+		trash := conf.Settings.Trash
+		err := fss.SetTrash(time.Duration(trash.Retention) * time.Second)
+		if err != nil {
+			clog.Failed(err)
+		}
+		fss.RunTrashPurge(time.Duration(trash.Interval) * time.Second)
+		clog.Infof("Trash activated, deleted keys are kept for %d seconds", trash.Retention)
+	}
+
+	if conf.Settings.IsRaftEnabled() {
+		node, err := openRaft(fss)
+		if err != nil {
+			clog.Failed(err)
+		}
+		fss.SetReplicator(node)
+		hts.SetRaft(node)
+		clog.Infof("Raft replication activated, %s is one of %d peers", node.ID(), len(conf.Settings.Raft.Peers))
+	}
+
+	if !recoverUntil.IsZero() {
+		result, err := fss.RestoreToTime(recoverUntil)
+		if err != nil {
+			clog.Failed(err)
+		}
+		clog.Infof("Rolled back to LSN %d, restored %d keys and deleted %d keys", result.LSN, result.Restored, result.Deleted)
+	}
+
+	history, err := conf.OpenHistory(conf.Settings.Path, conf.Settings, processUser())
+	if err != nil {
+		clog.Failed(err)
 	}
+	apply := applySettings(hts, fss)
+	hts.SetConfigHistory(history, apply)
 
 	hts.SetupFS(fss)
 	clog.Info("File system setup completed successfully")
 
-	go func() {
-		err := hts.Startup()
+	if next != nil {
+		err := next.takeover()
 		if err != nil {
 			clog.Failed(err)
 		}
-	}()
-
-	// Delay output of normal messages
-	time.Sleep(500 * time.Millisecond)
-	clog.Infof("HTTP server started at http://%s:%d 🚀", hts.IPv4(), hts.Port())
+		err = utils.WritePidFile(pidfile)
+		if err != nil {
+			clog.Failed(err)
+		}
+		startup()
+		clog.Info("Took over the listeners from the previous process")
+	}
+	if len(conf.Settings.Bind) == 0 && conf.Settings.Socket.Path == "" {
+		clog.Infof("HTTP server started at http://%s:%d 🚀", hts.IPv4(), hts.Port())
+	} else {
+		for _, bind := range hts.Binds() {
+			clog.Infof("HTTP server listening on %s 🚀", bind)
+		}
+	}
+	notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
 
 	// Keep the daemon process alive
 	blocking := make(chan os.Signal, 1)
-	signal.Notify(blocking, syscall.SIGINT, syscall.SIGTERM)
-
-	// Blocking daemon process
-	<-blocking
+	signal.Notify(blocking, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, upgradeSignals...)...)
+
+	// Blocking daemon process, SIGHUP reloads the configuration file,
+	// SIGUSR2 hands over the listeners to a new process
+	var handoff *os.File
+	for sig := range blocking {
+		if sig == syscall.SIGHUP {
+			notify("RELOADING=1")
+			reloadConfig(history, apply)
+			notify("READY=1")
+			continue
+		}
+		if !isUpgradeSignal(sig) {
+			break
+		}
+		handoff, err = handover(hts, fss)
+		if err == nil {
+			break
+		}
+		clog.Errorf("Upgrade aborted, keep serving requests: %v", err)
+	}
 
-	// Graceful exit from the program process
+	// Graceful exit from the program process, the new process notifies systemd after an upgrade
+	if handoff == nil {
+		notify("STOPPING=1")
+	}
 	err = hts.Shutdown()
 	if err != nil {
 		clog.Failed(err)
 	}
+
+	err = utils.RemovePidFile(pidfile)
+	if err != nil {
+		clog.Warnf("failed to remove pid file %s: %v", pidfile, err)
+	}
+	if handoff != nil {
+		// 新进程读到 EOF 之后写入 pid 文件并开始接受连接
+		handoff.Close()
+	}
 	os.Exit(0)
 }
 
+// applySettings 返回把修改的配置应用到运行中服务器的函数，只要有一个配置项不能在运行期间修改就不会应用任何修改
+func applySettings(hts *server.HttpServer, fss *vfs.LogStructuredFS) conf.ApplyFunc {
+	return func(prev, next *conf.ServerOptions, changes []string) error {
+		changed := make(map[string]bool, len(changes))
+		for _, path := range changes {
+			section, _, _ := strings.Cut(path, ".")
+			if section == "limit" || section == "codec" {
+				// limit.valuesize 和 codec 下每种类型的配置作为一个整体修改
+				path = strings.Join(strings.SplitN(path, ".", 3)[:2], ".")
+			}
+			if !reloadable[path] {
+				return fmt.Errorf("%w: %s", conf.ErrRestartRequired, path)
+			}
+			changed[section] = true
+		}
+
+		if changed["codec"] {
+			policy, err := codecPolicy(next)
+			if err != nil {
+				return fmt.Errorf("%w: %v", conf.ErrInvalidConfig, err)
+			}
+			fss.SetCodecs(policy)
+		}
+
+		if changed["log"] {
+			clog.SetLevel(next.LogLevel())
+			hts.SetAccessLog(next.Log.Access, next.Log.Sample)
+		}
+
+		if changed["region"] {
+			fss.StopCompactRegion()
+			if next.IsCompactRegionEnabled() {
+				err := fss.RunCompactRegion(next.CompactRegionInterval())
+				if err != nil {
+					return err
+				}
+			}
+			fss.StopFlush()
+			fss.RunFlush(next.FlushInterval())
+			fss.SetCompactThrottle(next.CompactRate(), time.Duration(next.CompactLatency())*time.Millisecond)
+			fss.SetTombstoneGrace(time.Duration(next.TombstoneGrace()) * time.Second)
+			fss.StopExpiryCompaction()
+			fss.RunExpiryCompaction(next.ExpiryScanInterval(), next.DeadRatio())
+		}
+
+		if changed["checkpoint"] {
+			fss.StopCheckpoint()
+			if next.IsCheckpointEnabled() {
+				fss.RunCheckpoint(next.CheckpointInterval())
+			}
+		}
+
+		if changed["limit"] {
+			hts.SetLimits(next.KeySizeLimit(), next.ValueSizeLimit())
+		}
+
+		if changed["allowip"] {
+			hts.SetAllowIP(next.AllowIP)
+		}
+
+		if changed["strict"] {
+			hts.SetStrictTypes(next.Strict)
+		}
+
+		if changed["cors"] {
+			cors := next.CORS
+			if !cors.Enable {
+				cors.Origins = nil
+			}
+			hts.SetCORS(cors.Origins, cors.Methods, cors.Headers, cors.Credentials, int(cors.MaxAge))
+		}
+
+		if changed["bulkhead"] {
+			b := next.Bulkhead
+			hts.SetBulkhead(b.Enable, b.Scan, b.Admin, b.Queue, time.Duration(b.Wait)*time.Millisecond)
+		}
+
+		if changed["session"] {
+			hts.SetSession(time.Duration(next.SessionTTL()) * time.Second)
+		}
+
+		if changed["pool"] {
+			hts.SetLeakDetection(next.IsLeakDetectEnabled())
+		}
+
+		clog.Infof("Configuration changes applied: %s", strings.Join(changes, ", "))
+		return nil
+	}
+}
+
+// reloadConfig 重新加载配置文件，命令行参数设置的配置项保持不变
+func reloadConfig(history *conf.History, apply conf.ApplyFunc) {
+	if !conf.HasCustom(configFile) {
+		clog.Warn("Received SIGHUP but the server was started without a config file")
+		return
+	}
+
+	current := history.Current()
+	next := history.Current()
+	err := conf.Load(configFile, next)
+	if err != nil {
+		clog.Errorf("failed to reload config file: %v", err)
+		return
+	}
+
+	// 环境变量在进程运行期间不会变化，重新加载之后继续覆盖配置文件
+	_, err = conf.LoadEnv(next)
+	if err != nil {
+		clog.Errorf("failed to reload config file: %v", err)
+		return
+	}
+	next.Password, next.Path, next.Port, next.Debug = current.Password, current.Path, current.Port, current.Debug
+
+	version, err := history.Apply(next, conf.SourceReload, processUser(), apply)
+	if errors.Is(err, conf.ErrNoChanges) {
+		clog.Info("Config file reloaded without changes")
+		return
+	}
+	if err != nil {
+		clog.Errorf("failed to reload config file: %v", err)
+		return
+	}
+	clog.Infof("Config file reloaded as version %d", version.Version)
+}
+
+// codecPolicy 把配置中的编解码器名称转换为新写入的值使用的编解码规则
+func codecPolicy(opt *conf.ServerOptions) (*vfs.CodecPolicy, error) {
+	return vfs.NewCodecPolicy(opt.Codec.Default, opt.Codec.Types, opt.Codec.Namespaces, opt.Separator)
+}
+
+// processUser 返回运行服务器的系统用户，作为启动和重新加载配置的操作人
+func processUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	return u.Username
+}
+
+// openRaft 启动 raft 节点，开启检查点时使用检查点的间隔生成 raft 快照
+func openRaft(fss *vfs.LogStructuredFS) (*consensus.Node, error) {
+	settings := conf.Settings.Raft
+
+	dir := settings.Dir
+	if dir == "" {
+		dir = filepath.Join(conf.Settings.Path, "raft")
+	}
+
+	peers := make([]consensus.Peer, 0, len(settings.Peers))
+	for _, peer := range settings.Peers {
+		peers = append(peers, consensus.Peer{ID: peer.ID, Addr: peer.Addr, HTTP: peer.HTTP})
+	}
+
+	opt := &consensus.Options{
+		ID:      settings.ID,
+		Bind:    settings.Bind,
+		Dir:     dir,
+		Peers:   peers,
+		Timeout: time.Duration(settings.Timeout) * time.Second,
+	}
+	if conf.Settings.IsCheckpointEnabled() {
+		opt.SnapshotInterval = time.Duration(conf.Settings.CheckpointInterval()) * time.Second
+	}
+
+	return consensus.Open(fss, opt)
+}
+
+// openTiering 连接对象存储，之前上传的 region 在这之后才能读取
+func openTiering(fss *vfs.LogStructuredFS) error {
+	settings := conf.Settings.Tiering
+
+	store, err := newObjectStore(settings.ObjectStorage)
+	if err != nil {
+		return err
+	}
+
+	err = fss.SetTiering(vfs.TieringOptions{
+		Store:        store,
+		After:        time.Duration(settings.After) * 24 * time.Hour,
+		CacheDir:     settings.Cache,
+		CacheRegions: settings.Regions,
+	})
+	if err != nil {
+		return err
+	}
+
+	fss.RunTiering(time.Duration(settings.Interval) * time.Second)
+	return nil
+}
+
+// openBackup 读取备份清单，之后定期上传新封存的 region 和检查点
+func openBackup(fss *vfs.LogStructuredFS) error {
+	settings := conf.Settings.Backup
+
+	store, err := newObjectStore(settings.ObjectStorage)
+	if err != nil {
+		return err
+	}
+
+	err = fss.SetBackup(vfs.BackupOptions{
+		Store:     store,
+		Retention: time.Duration(settings.Retention) * 24 * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+
+	fss.RunBackup(time.Duration(settings.Interval) * time.Second)
+	return nil
+}
+
+func newObjectStore(opt conf.ObjectStorage) (*objstore.S3, error) {
+	return objstore.NewS3(objstore.S3Options{
+		Endpoint:  opt.Endpoint,
+		Region:    opt.Region,
+		Bucket:    opt.Bucket,
+		Prefix:    opt.Prefix,
+		AccessKey: opt.AccessKey,
+		SecretKey: opt.SecretKey,
+	})
+}
+
+// logRecoveryProgress 定期输出启动恢复的进度，直到 stop 被关闭
+func logRecoveryProgress(progress *vfs.RecoveryProgress, stop <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			status := progress.Status()
+			clog.Infof("Recovering regions %d/%d, keys loaded %d, ETA %s",
+				status.RegionsScanned, status.RegionsTotal, status.KeysLoaded, status.ETA)
+		}
+	}
+}
+
 type flags struct {
-	auth   string
-	port   int
-	path   string
-	config string
-	debug  bool
+	auth         string
+	port         int
+	path         string
+	config       string
+	debug        bool
+	pidfile      string
+	pointInTime  string
+	recoverUntil string
 }
 
 func parseFlags() (fl *flags) {
@@ -207,9 +896,55 @@ func parseFlags() (fl *flags) {
 	flag.StringVar(&fl.auth, "auth", conf.Default.Password, "--auth the server authentication password.")
 	flag.StringVar(&fl.path, "path", conf.Default.Path, "--path the data storage directory.")
 	flag.BoolVar(&fl.debug, "debug", conf.Default.Debug, "--debug enable debug mode.")
-	flag.StringVar(&fl.config, "config", "", "--config the configuration file path.")
+	flag.StringVar(&fl.config, "config", "", "--config the configuration file path, yaml, json or toml by extension.")
 	flag.IntVar(&fl.port, "port", conf.Default.Port, "--port the HTTP server port.")
-	flag.BoolVar(&daemon, "daemon", false, "--daemon run with a daemon.")
+	flag.BoolVar(&daemon, "daemon", false, "--daemon run in the background and write the pid file.")
+	flag.StringVar(&fl.pidfile, "pidfile", "", "--pidfile the pid file path, urnadb.pid in the data directory by default.")
+	flag.StringVar(&fl.recoverUntil, "recover-until", "", "--recover-until roll back the changes made after this RFC3339 time at startup.")
+	flag.BoolVar(&insecureOK, "insecure-ok", false, "--insecure-ok start even if the security audit finds critical problems.")
 	flag.Parse()
+
+	if flag.Arg(0) == "restore" {
+		restore = true
+		rs := flag.NewFlagSet("restore", flag.ExitOnError)
+		rs.StringVar(&fl.pointInTime, "point-in-time", "", "--point-in-time restore to this RFC3339 time, the latest backup by default.")
+		rs.StringVar(&fl.path, "path", fl.path, "--path the empty directory to restore into.")
+		rs.StringVar(&fl.config, "config", fl.config, "--config the configuration file with the backup settings.")
+		_ = rs.Parse(flag.Args()[1:])
+	}
+
+	switch flag.Arg(0) {
+	case "stop", "status", "reload", "upgrade":
+		control = flag.Arg(0)
+		cs := flag.NewFlagSet(control, flag.ExitOnError)
+		cs.StringVar(&fl.path, "path", fl.path, "--path the data directory of the server.")
+		cs.StringVar(&fl.config, "config", fl.config, "--config the configuration file of the server.")
+		cs.StringVar(&fl.pidfile, "pidfile", fl.pidfile, "--pidfile the pid file of the server.")
+		cs.DurationVar(&stopTimeout, "timeout", 30*time.Second, "--timeout how long stop and upgrade wait for the server to exit.")
+		_ = cs.Parse(flag.Args()[1:])
+	case "validate":
+		validate = true
+		vs := flag.NewFlagSet("validate", flag.ExitOnError)
+		vs.StringVar(&fl.config, "config", fl.config, "--config the configuration file to check.")
+		vs.StringVar(&fl.path, "path", fl.path, "--path the data storage directory.")
+		vs.IntVar(&fl.port, "port", fl.port, "--port the HTTP server port.")
+		_ = vs.Parse(flag.Args()[1:])
+	case "init":
+		initialize = true
+		is := flag.NewFlagSet("init", flag.ExitOnError)
+		is.StringVar(&fl.path, "path", fl.path, "--path the data volume to initialize.")
+		is.StringVar(&initConfig, "config", "", "--config the generated configuration file, config.yaml in the data volume by default.")
+		_ = is.Parse(flag.Args()[1:])
+	case "upgrade-data":
+		upgradeData = true
+		us := flag.NewFlagSet("upgrade-data", flag.ExitOnError)
+		us.StringVar(&fl.path, "path", fl.path, "--path the data directory to upgrade.")
+		us.StringVar(&fl.config, "config", fl.config, "--config the configuration file of the server.")
+		us.StringVar(&fl.pidfile, "pidfile", fl.pidfile, "--pidfile the pid file of the server.")
+		us.StringVar(&upgradeFrom, "from", "", "--from the format version to upgrade, every older version by default.")
+		us.StringVar(&upgradeTo, "to", "", "--to the format version to write, the current version by default.")
+		us.BoolVar(&upgradeDryRun, "dry-run", false, "--dry-run only verify the regions that would be upgraded.")
+		_ = us.Parse(flag.Args()[1:])
+	}
 	return
 }
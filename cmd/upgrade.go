@@ -0,0 +1,214 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/server"
+	"github.com/auula/urnadb/vfs"
+)
+
+const (
+	// upgradeEnv 是新进程从旧进程继承的监听地址数量，监听地址的文件描述符从 3 开始，
+	// 后面依次是通知旧进程恢复完成的管道和等待旧进程退出的管道
+	upgradeEnv = "URNADB_UPGRADE_LISTENERS"
+	// upgradeDrainTimeout 是旧进程等待正在处理的写请求完成的时间
+	upgradeDrainTimeout = 30 * time.Second
+)
+
+// successor 是升级启动的新进程从旧进程继承的监听地址和管道
+type successor struct {
+	listeners []net.Listener
+	// ready 写入一个字节通知旧进程恢复完成，done 读到 EOF 时旧进程已经关闭服务器
+	ready *os.File
+	done  *os.File
+}
+
+// inheritUpgrade 取出旧进程传过来的监听地址和管道，不是升级启动时返回 nil
+func inheritUpgrade() (*successor, error) {
+	value, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	_ = os.Unsetenv(upgradeEnv)
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid %s: %q", upgradeEnv, value)
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(3+i), "listener-"+strconv.Itoa(i))
+	}
+	listeners, err := server.InheritListeners(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &successor{
+		listeners: listeners,
+		ready:     os.NewFile(uintptr(3+n), "upgrade-ready"),
+		done:      os.NewFile(uintptr(3+n+1), "upgrade-done"),
+	}, nil
+}
+
+// takeover 通知旧进程恢复完成，等旧进程处理完已经接受的请求并且关闭服务器之后返回
+func (s *successor) takeover() error {
+	_, err := s.ready.Write([]byte{1})
+	s.ready.Close()
+	if err != nil {
+		s.done.Close()
+		return fmt.Errorf("previous process is gone: %w", err)
+	}
+
+	_, err = io.Copy(io.Discard, s.done)
+	s.done.Close()
+	return err
+}
+
+// isUpgradeSignal 检查是不是要求升级的信号
+func isUpgradeSignal(sig os.Signal) bool {
+	for _, s := range upgradeSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handover 停止写入之后启动新的可执行文件，把监听地址和数据目录交给它，新进程恢复完成之后返回。
+// 返回的管道在旧进程关闭服务器之后关闭，新进程这时才开始接受连接，交接失败时旧进程恢复写入继续提供服务
+func handover(hts *server.HttpServer, fss *vfs.LogStructuredFS) (*os.File, error) {
+	if conf.Settings.IsClusterEnabled() || conf.Settings.IsRaftEnabled() {
+		return nil, errors.New("upgrade is only supported on single-node deployments, restart the nodes one by one instead")
+	}
+
+	files, err := hts.ListenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	err = hts.BeginHandover(upgradeDrainTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	abort := func(err error) (*os.File, error) {
+		hts.AbortHandover()
+		resumeMaintenance(fss)
+		return nil, err
+	}
+
+	// 停止后台任务并导出索引快照，新进程从快照恢复，旧进程继续处理读请求
+	err = fss.Quiesce()
+	if err != nil {
+		return abort(err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return abort(err)
+	}
+	defer readyR.Close()
+
+	doneR, doneW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return abort(err)
+	}
+
+	// 新进程使用同样的命令行参数和密码，配置文件的修改随升级一起生效
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		daemonAuthEnv+"="+conf.Settings.Password,
+		upgradeEnv+"="+strconv.Itoa(len(files)),
+	)
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), readyW, doneR)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	detach(cmd)
+
+	err = cmd.Start()
+	readyW.Close()
+	doneR.Close()
+	if err != nil {
+		doneW.Close()
+		return abort(err)
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	clog.Infof("Started PID %d to take over, it is recovering %s", cmd.Process.Pid, conf.Settings.Path)
+
+	// 新进程退出时管道的写入端被关闭，这里读到 EOF
+	_, err = readyR.Read(make([]byte, 1))
+	if err != nil {
+		doneW.Close()
+		return abort(fmt.Errorf("PID %d exited before taking over, see the log file %s", cmd.Process.Pid, conf.Settings.LogPath))
+	}
+
+	clog.Infof("PID %d recovered the data directory, handing over listeners", cmd.Process.Pid)
+	return doneW, nil
+}
+
+// resumeMaintenance 交接失败之后重新启动 Quiesce 停止的后台任务
+func resumeMaintenance(fss *vfs.LogStructuredFS) {
+	opt := conf.Settings
+
+	if opt.IsCompactRegionEnabled() {
+		err := fss.RunCompactRegion(opt.CompactRegionInterval())
+		if err != nil {
+			clog.Warnf("failed to resume region compaction: %v", err)
+		}
+	}
+
+	if opt.ExpiryScanInterval() > 0 {
+		fss.RunExpiryCompaction(opt.ExpiryScanInterval(), opt.DeadRatio())
+	}
+
+	if opt.IsCheckpointEnabled() {
+		fss.RunCheckpoint(opt.CheckpointInterval())
+	}
+
+	fss.RunFlush(opt.FlushInterval())
+
+	if opt.IsTieringEnabled() {
+		fss.RunTiering(time.Duration(opt.Tiering.Interval) * time.Second)
+	}
+
+	if opt.IsBackupEnabled() {
+		fss.RunBackup(time.Duration(opt.Backup.Interval) * time.Second)
+	}
+
+	if opt.IsTrashEnabled() {
+		fss.RunTrashPurge(time.Duration(opt.Trash.Interval) * time.Second)
+	}
+}
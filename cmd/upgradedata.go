@@ -0,0 +1,91 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+)
+
+// runUpgradeData 离线把数据目录中旧格式的 region 重写为当前的格式，每个 region 重写之后校验再替换，
+// 中断之后重新执行从剩下的 region 继续。升级期间持有 pid 文件，服务器运行时拒绝执行，也不能同时启动服务器
+func runUpgradeData() {
+	from, err := parseFormatVersion("--from", upgradeFrom)
+	if err != nil {
+		clog.Failed(err)
+	}
+	to, err := parseFormatVersion("--to", upgradeTo)
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	pidfile := conf.Settings.PidFilePath()
+	if pid, err := utils.ReadPidFile(pidfile); err == nil {
+		clog.Failed(fmt.Errorf("urnadb is running with PID %d, stop it before upgrading %s", pid, conf.Settings.Path))
+	}
+	if !upgradeDryRun {
+		err := utils.WritePidFile(pidfile)
+		if err != nil {
+			clog.Failed(err)
+		}
+	}
+
+	result, err := vfs.UpgradeData(conf.Settings.Path, vfs.UpgradeOptions{From: from, To: to, DryRun: upgradeDryRun})
+	if !upgradeDryRun {
+		_ = utils.RemovePidFile(pidfile)
+	}
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	action := "Upgraded"
+	if upgradeDryRun {
+		action = "Verified"
+	}
+	for _, region := range result.Regions {
+		fmt.Printf("%s region %s from v%d to v%d, %d records\n", action, region.Name, region.From, vfs.CurrentFormat(), region.Records)
+	}
+	for _, region := range result.Remaining {
+		fmt.Printf("Skipped region %s in format v%d\n", region.Name, region.From)
+	}
+
+	if upgradeDryRun {
+		fmt.Printf("Dry run: %d region(s) would be upgraded to v%d, %d already current, %d skipped\n",
+			len(result.Regions), vfs.CurrentFormat(), result.Current, len(result.Remaining))
+	} else {
+		fmt.Printf("Upgraded %d region(s) to v%d, %d already current, %d skipped\n",
+			len(result.Regions), vfs.CurrentFormat(), result.Current, len(result.Remaining))
+	}
+	os.Exit(0)
+}
+
+// parseFormatVersion 解析 v1 或者 1 形式的格式版本，空字符串返回 0
+func parseFormatVersion(name, value string) (byte, error) {
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "v"), 10, 8)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a format version like v%d", name, value, vfs.CurrentFormat())
+	}
+	return byte(version), nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/auula/urnadb/conf"
+)
+
+// runValidate 输出配置的全部问题，存在错误时退出码为 1，只有警告时为 0
+func runValidate() {
+	diagnostics := conf.Diagnose(conf.Settings)
+
+	errs, warnings := 0, 0
+	for _, d := range diagnostics {
+		fmt.Println(d)
+		if d.Warning {
+			warnings++
+		} else {
+			errs++
+		}
+	}
+
+	if errs > 0 {
+		fmt.Printf("Configuration is invalid: %d error(s), %d warning(s)\n", errs, warnings)
+		os.Exit(1)
+	}
+	fmt.Printf("Configuration is valid: %d warning(s)\n", warnings)
+	os.Exit(0)
+}
+
+// invalidConfig 在配置文件或者环境变量无法解析时结束 validate 子命令
+func invalidConfig(v ...interface{}) {
+	fmt.Println(conf.Diagnostic{Check: "load", Err: fmt.Errorf("%s", fmt.Sprint(v...))})
+	fmt.Println("Configuration is invalid: 1 error(s), 0 warning(s)")
+	os.Exit(1)
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Finding is an insecure setting found by Audit.
+type Finding struct {
+	Check   string
+	Message string
+	// Critical findings prevent the server from starting unless it is started with --insecure-ok
+	Critical bool
+}
+
+func (f Finding) String() string {
+	level := "warning"
+	if f.Critical {
+		level = "critical"
+	}
+	return fmt.Sprintf("%s [%s] %s", level, f.Check, f.Message)
+}
+
+// Audit 检查启动时的不安全配置，opt 中的密码是最终使用的密码，没有配置密码时启动生成的随机密码不会被报告。
+// 监听了其他主机可以访问的地址并且没有配置白名单时只是警告，但是这时密码容易被猜到是严重问题
+func Audit(opt *ServerOptions) []Finding {
+	var findings []Finding
+	report := func(check string, critical bool, format string, args ...any) {
+		findings = append(findings, Finding{Check: check, Message: fmt.Sprintf(format, args...), Critical: critical})
+	}
+
+	exposed := false
+	if len(opt.AllowIP) == 0 {
+		if addr, ok := exposedBind(opt); ok {
+			exposed = true
+			report("exposed", false, "listening on %s without an allowip list, every host that can reach the port can try the password", addr)
+		}
+	}
+
+	if opt.Password == Default.Password {
+		report("auth", true, "auth is the default password shipped in the sample configuration")
+	} else if entropy(opt.Password) < minSecretEntropy {
+		report("auth", exposed, "auth is estimated below %d bits of entropy", minSecretEntropy)
+	}
+
+	if opt.Encryptor.Enable && opt.Encryptor.Secret == Default.Encryptor.Secret {
+		report("encryptor", true, "encryptor.secret is the default secret shipped in the sample configuration")
+	}
+	if opt.Security.Sensitive && !opt.Encryptor.Enable {
+		report("encryptor", true, "security.sensitive is set but data encryption is disabled")
+	}
+
+	if opt.Fault.Enable {
+		report("fault", false, "fault injection is enabled, disk reads and writes can be made to fail through /admin/faults")
+	}
+	return findings
+}
+
+// exposedBind 返回第一个其他主机可以访问的监听地址，只监听回环地址和 Unix socket 时返回 false，
+// 网卡地址无法解析时按照可以访问处理
+func exposedBind(opt *ServerOptions) (string, bool) {
+	addrs, err := opt.Listeners()
+	if err != nil {
+		return strings.Join(opt.Bind, ", "), true
+	}
+	for _, addr := range addrs {
+		if !addr.IsLocal() {
+			return addr.String(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func auditChecks(opt *ServerOptions) map[string]bool {
+	checks := map[string]bool{}
+	for _, f := range Audit(opt) {
+		checks[f.Check] = checks[f.Check] || f.Critical
+	}
+	return checks
+}
+
+func TestAudit(t *testing.T) {
+	opt := new(ServerOptions)
+	require.NoError(t, opt.Unmarshal([]byte(DefaultConfigJSON)))
+
+	// 启动时生成的随机密码和白名单，没有任何问题
+	opt.Password = "QGVkh8niwL2TSkj72icaKBC9B"
+	opt.AllowIP = []string{"10.0.0.0/8"}
+	assert.Empty(t, Audit(opt))
+
+	// 没有白名单只是警告
+	opt.AllowIP = nil
+	assert.Equal(t, map[string]bool{"exposed": false}, auditChecks(opt))
+
+	// 没有白名单时弱密码是严重问题，有白名单时是警告
+	opt.Password = "password"
+	assert.Equal(t, map[string]bool{"exposed": false, "auth": true}, auditChecks(opt))
+	opt.AllowIP = []string{"127.0.0.1"}
+	assert.Equal(t, map[string]bool{"auth": false}, auditChecks(opt))
+
+	// 只监听回环地址和 Unix socket 时其他主机不能访问
+	opt.AllowIP = nil
+	opt.Bind = []string{"127.0.0.1", "[::1]", "unix:/run/urnadb.sock"}
+	assert.Equal(t, map[string]bool{"auth": false}, auditChecks(opt))
+	opt.Bind = append(opt.Bind, "10.0.0.5")
+	findings := Audit(opt)
+	assert.Equal(t, "warning [exposed] listening on 10.0.0.5:2668 without an allowip list, every host that can reach the port can try the password", findings[0].String())
+	opt.Bind = nil
+	opt.AllowIP = []string{"127.0.0.1"}
+
+	opt.Password = Default.Password
+	assert.Equal(t, map[string]bool{"auth": true}, auditChecks(opt))
+	opt.Password = "QGVkh8niwL2TSkj72icaKBC9B"
+
+	opt.Encryptor.Enable = true
+	assert.Equal(t, map[string]bool{"encryptor": true}, auditChecks(opt))
+	opt.Encryptor.Secret = "q4znrIX2EVc2RB$DP!inY1yyqebnrpR8"
+	assert.Empty(t, Audit(opt))
+
+	opt.Encryptor.Enable = false
+	opt.Security.Sensitive = true
+	assert.Equal(t, map[string]bool{"encryptor": true}, auditChecks(opt))
+
+	opt.Security.Sensitive = false
+	opt.Fault.Enable = true
+	findings = Audit(opt)
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "warning [fault] fault injection is enabled, disk reads and writes can be made to fail through /admin/faults", findings[0].String())
+}
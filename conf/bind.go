@@ -0,0 +1,195 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix 是 bind 中 Unix domain socket 地址的前缀，例如 unix:/run/urnadb.sock
+const unixPrefix = "unix:"
+
+// BindAddr is a resolved listen address of the HTTP server.
+type BindAddr struct {
+	// Network is tcp, tcp4, tcp6 or unix
+	Network string
+	Address string
+}
+
+// IsLocal reports whether only processes on this host can connect to the address.
+func (b BindAddr) IsLocal() bool {
+	if b.Network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(b.Address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// IsAbstract reports whether the address is a Linux abstract unix socket, which has no file.
+func (b BindAddr) IsAbstract() bool {
+	return b.Network == "unix" && strings.HasPrefix(b.Address, "@")
+}
+
+func (b BindAddr) String() string {
+	if b.Network == "unix" {
+		return unixPrefix + b.Address
+	}
+	return b.Address
+}
+
+// parseBind 解析 bind 中的一项，IP 地址使用 port 端口，也可以是 host:port 或者 [IPv6]:port，
+// 不是地址的项作为网卡名称，返回的 iface 不为空时需要展开成这个网卡上的全部地址
+func parseBind(entry string, port int) (addr BindAddr, iface string, err error) {
+	if path, ok := strings.CutPrefix(entry, unixPrefix); ok {
+		switch {
+		case path == "" || path == "@":
+			return addr, "", fmt.Errorf("bind %q has an empty unix socket path", entry)
+		case strings.HasPrefix(path, "@") && runtime.GOOS != "linux":
+			return addr, "", fmt.Errorf("bind %q: abstract unix sockets are only supported on linux", entry)
+		}
+		return BindAddr{Network: "unix", Address: path}, "", nil
+	}
+
+	host, portStr := strings.Trim(entry, "[]"), strconv.Itoa(port)
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return addr, "", fmt.Errorf("bind %q has an invalid port", entry)
+		}
+		if err := validatePort(n); err != nil {
+			return addr, "", fmt.Errorf("bind %q: %w", entry, err)
+		}
+		if h == "" {
+			// :port 在指定的端口上监听全部网卡
+			return BindAddr{Network: "tcp", Address: entry}, "", nil
+		}
+		host, portStr = h, p
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if host == "" || strings.ContainsAny(host, ":[]/ ") {
+			return addr, "", fmt.Errorf("bind %q is not an IP address, interface name or unix socket", entry)
+		}
+		return BindAddr{Network: "tcp", Address: portStr}, host, nil
+	}
+	return tcpBind(ip, "", portStr), "", nil
+}
+
+// tcpBind 按照地址族选择 tcp4 或者 tcp6，0.0.0.0 只监听 IPv4，:: 只监听 IPv6
+func tcpBind(ip net.IP, zone, port string) BindAddr {
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	network := "tcp6"
+	if ip.To4() != nil {
+		network = "tcp4"
+	}
+	return BindAddr{Network: network, Address: net.JoinHostPort(host, port)}
+}
+
+// ResolveBind resolves the bind entries of the configuration into listen addresses. An
+// interface name expands to every address of the interface, and no entries means all
+// interfaces on both IPv4 and IPv6.
+func ResolveBind(entries []string, port int) ([]BindAddr, error) {
+	if len(entries) == 0 {
+		return []BindAddr{{Network: "tcp", Address: net.JoinHostPort("", strconv.Itoa(port))}}, nil
+	}
+
+	var addrs []BindAddr
+	for _, entry := range entries {
+		addr, iface, err := parseBind(entry, port)
+		if err != nil {
+			return nil, err
+		}
+
+		expanded := []BindAddr{addr}
+		if iface != "" {
+			expanded, err = interfaceAddrs(iface, addr.Address)
+			if err != nil {
+				return nil, fmt.Errorf("bind %q: %w", entry, err)
+			}
+		}
+
+		for _, a := range expanded {
+			addrs = appendBind(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+// appendBind 添加一个监听地址，同一个地址只监听一次
+func appendBind(addrs []BindAddr, addr BindAddr) []BindAddr {
+	for _, a := range addrs {
+		if a == addr {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+// parseFileMode 解析八进制的文件权限，例如 0660
+func parseFileMode(mode string) (fs.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, errors.New("not an octal file mode")
+	}
+	if perm > uint64(fs.ModePerm) {
+		return 0, errors.New("file mode cannot be greater than 0777")
+	}
+	return fs.FileMode(perm), nil
+}
+
+// interfaceAddrs 返回网卡上的全部 IP 地址，IPv6 链路本地地址需要带上网卡名称作为 zone
+func interfaceAddrs(name, port string) ([]BindAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("no such network interface %s", name)
+	}
+
+	ifaddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of interface %s: %w", name, err)
+	}
+
+	var addrs []BindAddr
+	for _, ifaddr := range ifaddrs {
+		ipNet, ok := ifaddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		zone := ""
+		if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+			zone = name
+		}
+		addrs = append(addrs, tcpBind(ipNet.IP, zone, port))
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("network interface %s has no IP address", name)
+	}
+	return addrs, nil
+}
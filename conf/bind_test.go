@@ -0,0 +1,147 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"io/fs"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveBind(t *testing.T) {
+	addrs, err := ResolveBind(nil, 2668)
+	require.NoError(t, err)
+	assert.Equal(t, []BindAddr{{Network: "tcp", Address: ":2668"}}, addrs)
+
+	addrs, err = ResolveBind([]string{
+		"0.0.0.0",
+		"::",
+		"[::1]",
+		"127.0.0.1:2669",
+		"[::1]:2670",
+		":2671",
+		"unix:/run/urnadb.sock",
+		"0.0.0.0",
+	}, 2668)
+	require.NoError(t, err)
+	assert.Equal(t, []BindAddr{
+		{Network: "tcp4", Address: "0.0.0.0:2668"},
+		{Network: "tcp6", Address: "[::]:2668"},
+		{Network: "tcp6", Address: "[::1]:2668"},
+		{Network: "tcp4", Address: "127.0.0.1:2669"},
+		{Network: "tcp6", Address: "[::1]:2670"},
+		{Network: "tcp", Address: ":2671"},
+		{Network: "unix", Address: "/run/urnadb.sock"},
+	}, addrs)
+
+	for _, entry := range []string{"", "unix:", "127.0.0.1:80", "127.0.0.1:http", "10.0.0.0/8", "no such interface"} {
+		_, err := ResolveBind([]string{entry}, 2668)
+		assert.Error(t, err, entry)
+	}
+	_, err = ResolveBind([]string{"urnadb-missing0"}, 2668)
+	assert.ErrorContains(t, err, "no such network interface urnadb-missing0")
+}
+
+func TestResolveBind_Interface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	addrs, err := ResolveBind([]string{loopback}, 2668)
+	require.NoError(t, err)
+	require.NotEmpty(t, addrs)
+	for _, addr := range addrs {
+		assert.True(t, addr.IsLocal(), addr.String())
+	}
+	assert.Contains(t, addrs, BindAddr{Network: "tcp4", Address: "127.0.0.1:2668"})
+}
+
+func TestBindAddr_IsLocal(t *testing.T) {
+	assert.True(t, BindAddr{Network: "unix", Address: "/run/urnadb.sock"}.IsLocal())
+	assert.True(t, BindAddr{Network: "tcp4", Address: "127.0.0.1:2668"}.IsLocal())
+	assert.True(t, BindAddr{Network: "tcp6", Address: "[::1]:2668"}.IsLocal())
+	assert.False(t, BindAddr{Network: "tcp", Address: ":2668"}.IsLocal())
+	assert.False(t, BindAddr{Network: "tcp4", Address: "0.0.0.0:2668"}.IsLocal())
+	assert.False(t, BindAddr{Network: "tcp4", Address: "192.168.1.10:2668"}.IsLocal())
+
+	assert.Equal(t, "unix:/run/urnadb.sock", BindAddr{Network: "unix", Address: "/run/urnadb.sock"}.String())
+	assert.Equal(t, "[::1]:2668", BindAddr{Network: "tcp6", Address: "[::1]:2668"}.String())
+}
+
+func TestBindValidator(t *testing.T) {
+	opt := &ServerOptions{Port: 2668, Bind: []string{"127.0.0.1", "[::1]:2669", "eth0", "unix:/run/urnadb.sock"}}
+	assert.NoError(t, BindValidator{}.Validate(opt))
+
+	// 网卡在启动时才展开，校验配置时不要求网卡存在
+	opt.Bind = []string{"urnadb-missing0"}
+	assert.NoError(t, BindValidator{}.Validate(opt))
+
+	opt.Bind = []string{"127.0.0.1:99999"}
+	assert.ErrorContains(t, BindValidator{}.Validate(opt), `bind "127.0.0.1:99999"`)
+}
+
+func TestServerOptions_Listeners(t *testing.T) {
+	opt := &ServerOptions{Port: 2668, Socket: Socket{Path: "/run/urnadb.sock"}}
+	addrs, err := opt.Listeners()
+	require.NoError(t, err)
+	assert.Equal(t, []BindAddr{
+		{Network: "tcp", Address: ":2668"},
+		{Network: "unix", Address: "/run/urnadb.sock"},
+	}, addrs)
+
+	// socket.path 和 bind 中相同的 socket 只监听一次
+	opt.Bind = []string{"127.0.0.1", "unix:/run/urnadb.sock"}
+	addrs, err = opt.Listeners()
+	require.NoError(t, err)
+	assert.Equal(t, []BindAddr{
+		{Network: "tcp4", Address: "127.0.0.1:2668"},
+		{Network: "unix", Address: "/run/urnadb.sock"},
+	}, addrs)
+
+	assert.True(t, BindAddr{Network: "unix", Address: "@urnadb"}.IsAbstract())
+	assert.False(t, BindAddr{Network: "unix", Address: "/run/urnadb.sock"}.IsAbstract())
+}
+
+func TestSocketValidator(t *testing.T) {
+	opt := &ServerOptions{Port: 2668, Socket: Socket{Path: "/run/urnadb.sock", Mode: "0660"}}
+	assert.NoError(t, SocketValidator{}.Validate(opt))
+	assert.Equal(t, fs.FileMode(0660), opt.SocketMode())
+
+	opt.Socket.Mode = "0o660"
+	assert.ErrorContains(t, SocketValidator{}.Validate(opt), `invalid unix socket mode "0o660"`)
+	opt.Socket.Mode = "1777"
+	assert.ErrorContains(t, SocketValidator{}.Validate(opt), "cannot be greater than 0777")
+
+	opt.Socket = Socket{Path: "@"}
+	assert.Error(t, SocketValidator{}.Validate(opt))
+	if runtime.GOOS == "linux" {
+		opt.Socket.Path = "@urnadb"
+		assert.NoError(t, SocketValidator{}.Validate(opt))
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// 密钥的估计熵低于这个位数时给出警告
+const minSecretEntropy = 48
+
+// Diagnostic is a single problem found by Diagnose.
+type Diagnostic struct {
+	// Check is the name of the validator or check that found the problem
+	Check string
+	Err   error
+	// Warning problems do not prevent the server from starting
+	Warning bool
+}
+
+func (d Diagnostic) String() string {
+	level := "error"
+	if d.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s [%s] %v", level, d.Check, d.Err)
+}
+
+// check 是只在 Diagnose 中执行的检查，依赖运行环境，启动时不执行
+type check struct {
+	name    string
+	warning bool
+	run     func(*ServerOptions) error
+}
+
+var checks = []check{
+	{name: "writable", run: func(opt *ServerOptions) error { return checkWritable(opt.Path) }},
+	{name: "listen", run: checkListen},
+	{name: "entropy", warning: true, run: checkSecrets},
+}
+
+// Diagnose runs all validators and the environment checks and returns every problem found,
+// instead of stopping at the first one like Vaildated.
+func Diagnose(opt *ServerOptions) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, validator := range validators() {
+		err := validator.Validate(opt)
+		if err != nil {
+			name := strings.TrimSuffix(reflect.TypeOf(validator).Name(), "Validator")
+			diagnostics = append(diagnostics, Diagnostic{Check: strings.ToLower(name), Err: err})
+		}
+	}
+
+	for _, c := range checks {
+		err := c.run(opt)
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{Check: c.name, Err: err, Warning: c.warning})
+		}
+	}
+	return diagnostics
+}
+
+// checkWritable 检查数据目录可以写入，目录还不存在时检查最近的已经存在的上级目录
+func checkWritable(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	dir := filepath.Clean(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || filepath.Dir(dir) == dir {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	file, err := os.CreateTemp(dir, ".urnadb-validate-*")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %w", path, err)
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkListen 检查每个监听地址可以使用，端口没有被其他进程占用，Unix socket 只检查所在的目录存在
+func checkListen(opt *ServerOptions) error {
+	addrs, err := opt.Listeners()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IsAbstract() {
+			continue
+		}
+		if addr.Network == "unix" {
+			dir := filepath.Dir(addr.Address)
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("directory %s of unix socket does not exist", dir)
+			}
+			continue
+		}
+		ln, err := net.Listen(addr.Network, addr.Address)
+		if err != nil {
+			return fmt.Errorf("address %s is not available: %w", addr, err)
+		}
+		ln.Close()
+	}
+	return nil
+}
+
+// checkSecrets 检查配置的密钥是否容易被猜到，使用默认密码时启动会生成随机密码，不需要检查
+func checkSecrets(opt *ServerOptions) error {
+	secrets := map[string]string{}
+	if opt.Password != Default.Password {
+		secrets["auth"] = opt.Password
+	}
+	if opt.Console.Enable {
+		secrets["console.token"] = opt.Console.Token
+	}
+	if opt.Encryptor.Enable {
+		secrets["encryptor.secret"] = opt.Encryptor.Secret
+	}
+
+	var weak []string
+	for name, secret := range secrets {
+		if secret != "" && entropy(secret) < minSecretEntropy {
+			weak = append(weak, name)
+		}
+	}
+	if len(weak) == 0 {
+		return nil
+	}
+	sort.Strings(weak)
+	return fmt.Errorf("%s estimated below %d bits of entropy, use a longer random value", strings.Join(weak, ", "), minSecretEntropy)
+}
+
+// entropy 按照字符的出现频率估计字符串的熵，单位是位
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+
+	var bits float64
+	for _, n := range counts {
+		p := float64(n) / float64(total)
+		bits -= p * math.Log2(p)
+	}
+	return bits * float64(total)
+}
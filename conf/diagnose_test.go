@@ -0,0 +1,82 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// freePort 返回一个当前没有被占用的端口
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDiagnose(t *testing.T) {
+	opt := new(ServerOptions)
+	require.NoError(t, opt.Unmarshal([]byte(DefaultConfigJSON)))
+	opt.Path = filepath.Join(t.TempDir(), "data")
+	opt.Port = freePort(t)
+	assert.Empty(t, Diagnose(opt))
+
+	// 一次返回全部问题，而不是第一个
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+
+	opt.Port = ln.Addr().(*net.TCPAddr).Port
+	opt.Path = filepath.Join(file, "data")
+	opt.Password = "password"
+	opt.Log.Level = "verbose"
+	opt.Region.Enable = true
+	opt.Region.Schedule = "every day"
+
+	checks := map[string]bool{}
+	for _, d := range Diagnose(opt) {
+		checks[d.Check] = d.Warning
+	}
+	assert.Equal(t, map[string]bool{
+		"log":      false,
+		"writable": false,
+		"schedule": false,
+		"listen":   false,
+		"entropy":  true,
+	}, checks)
+}
+
+func TestValidateCron(t *testing.T) {
+	assert.NoError(t, ValidateCron("0 0 3 * * *"))
+	assert.NoError(t, ValidateCron("@daily"))
+	assert.NoError(t, ValidateCron("@every 6h"))
+	assert.Error(t, ValidateCron("0 3 * * *"))
+}
+
+func TestEntropy(t *testing.T) {
+	assert.Zero(t, entropy(""))
+	assert.Zero(t, entropy("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	assert.Less(t, entropy("password@123"), float64(minSecretEntropy))
+	assert.GreaterOrEqual(t, entropy("QGVkh8niwL2TSkj72icaKBC9B"), float64(minSecretEntropy))
+}
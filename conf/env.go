@@ -0,0 +1,97 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix 是覆盖配置项的环境变量前缀，配置项路径中的 . 替换为 _，例如 URNADB_PORT 和 URNADB_REGION_THRESHOLD
+const EnvPrefix = "URNADB"
+
+// decodeJSONTags 让 viper 按照 json 标签匹配配置项，内嵌的结构体和所属的配置项平铺在一起
+func decodeJSONTags(c *mapstructure.DecoderConfig) {
+	c.TagName = "json"
+	c.Squash = true
+}
+
+// envKeys 返回可以使用环境变量设置的配置项路径，包括基本类型和逗号分隔的字符串列表，
+// map 和结构体列表只能在配置文件中设置
+func envKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			keys = append(keys, envKeys(field.Type, prefix)...)
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			keys = append(keys, envKeys(field.Type, key+".")...)
+		case reflect.Map:
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.String {
+				keys = append(keys, key)
+			}
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// EnvName 返回配置项路径对应的环境变量名
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// LoadEnv 使用环境变量覆盖 opt 中的配置项，返回生效的环境变量名。
+// 优先级从低到高依次是默认配置、配置文件、环境变量和命令行参数，值为空的环境变量会被忽略
+func LoadEnv(opt *ServerOptions) ([]string, error) {
+	v := viper.New()
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	var applied []string
+	for _, key := range envKeys(reflect.TypeOf(opt).Elem(), "") {
+		_ = v.BindEnv(key)
+		if os.Getenv(EnvName(key)) != "" {
+			applied = append(applied, EnvName(key))
+		}
+	}
+
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	err := v.Unmarshal(opt, decodeJSONTags)
+	if err != nil {
+		return nil, fmt.Errorf("%w: environment variables: %v", ErrInvalidConfig, err)
+	}
+	return applied, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEnv(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`
+port: 2668
+auth: "file-password"
+region:
+  cron: "0 3 * * *"
+  threshold: 2
+tiering:
+  endpoint: "http://file:9000"
+  bucket: "regions"
+`), 0644)
+	assert.NoError(t, err)
+
+	opt := new(ServerOptions)
+	assert.NoError(t, Load(configFile, opt))
+
+	// 配置文件中通过 json 标签和内嵌结构体平铺的配置项
+	assert.Equal(t, "file-password", opt.Password)
+	assert.Equal(t, "0 3 * * *", opt.Region.Schedule)
+	assert.Equal(t, "regions", opt.Tiering.Bucket)
+
+	t.Setenv("URNADB_PORT", "3000")
+	t.Setenv("URNADB_AUTH", "env-password")
+	t.Setenv("URNADB_REGION_THRESHOLD", "5")
+	t.Setenv("URNADB_TIERING_ENDPOINT", "http://env:9000")
+	t.Setenv("URNADB_ALLOWIP", "10.0.0.1,10.0.0.2")
+	t.Setenv("URNADB_DEBUG", "")
+
+	applied, err := LoadEnv(opt)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"URNADB_PORT", "URNADB_AUTH", "URNADB_REGION_THRESHOLD",
+		"URNADB_TIERING_ENDPOINT", "URNADB_ALLOWIP",
+	}, applied)
+
+	assert.Equal(t, 3000, opt.Port)
+	assert.Equal(t, "env-password", opt.Password)
+	assert.Equal(t, uint8(5), opt.Region.Threshold)
+	assert.Equal(t, "http://env:9000", opt.Tiering.Endpoint)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, opt.AllowIP)
+
+	// 没有设置环境变量的配置项保留配置文件中的值
+	assert.Equal(t, "0 3 * * *", opt.Region.Schedule)
+	assert.Equal(t, "regions", opt.Tiering.Bucket)
+	assert.False(t, opt.Debug)
+}
+
+func TestLoadEnv_Invalid(t *testing.T) {
+	t.Setenv("URNADB_PORT", "not-a-port")
+
+	_, err := LoadEnv(new(ServerOptions))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "URNADB_PORT", EnvName("port"))
+	assert.Equal(t, "URNADB_REGION_THRESHOLD", EnvName("region.threshold"))
+
+	keys := envKeys(reflect.TypeOf(ServerOptions{}), "")
+	assert.Contains(t, keys, "tiering.endpoint")
+	assert.Contains(t, keys, "allowip")
+	assert.NotContains(t, keys, "quotas")
+	assert.NotContains(t, keys, "log.modules")
+}
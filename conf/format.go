@@ -0,0 +1,98 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// 支持的配置文件格式，键名和 YAML 配置文件相同
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+	formatTOML = "toml"
+)
+
+// configFormat 根据扩展名判断配置文件格式，没有扩展名的文件按照 YAML 处理
+func configFormat(path string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	switch ext {
+	case "", "yml", formatYAML:
+		return formatYAML, nil
+	case formatJSON, formatTOML:
+		return ext, nil
+	}
+	return "", fmt.Errorf("%w: unsupported config file format %q, expected yaml, json or toml", ErrInvalidConfig, ext)
+}
+
+// encodeConfig 按照格式序列化配置，所有格式都使用 json 标签作为键，保存的文件可以再用 Load 读取
+func encodeConfig(format string, opt *ServerOptions) ([]byte, error) {
+	if format == formatJSON {
+		return json.MarshalIndent(opt, "", "  ")
+	}
+
+	jsonData, err := opt.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON 是 YAML 的子集，解析为 MapSlice 保留配置项的顺序，整数也不会变成浮点数
+	var fields yaml.MapSlice
+	err = yaml.Unmarshal(jsonData, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == formatTOML {
+		return toml.Marshal(tomlTable(fields))
+	}
+	return yaml.Marshal(fields)
+}
+
+// tomlTable 把 MapSlice 转换为 TOML 表，TOML 没有 null，值为 null 的配置项直接省略
+func tomlTable(fields yaml.MapSlice) map[string]any {
+	table := make(map[string]any, len(fields))
+	for _, field := range fields {
+		switch value := field.Value.(type) {
+		case nil:
+		case yaml.MapSlice:
+			table[fmt.Sprint(field.Key)] = tomlTable(value)
+		case []any:
+			table[fmt.Sprint(field.Key)] = tomlArray(value)
+		default:
+			table[fmt.Sprint(field.Key)] = value
+		}
+	}
+	return table
+}
+
+// tomlArray 转换列表中的对象，例如集群节点列表
+func tomlArray(values []any) []any {
+	array := make([]any, len(values))
+	for i, value := range values {
+		if item, ok := value.(yaml.MapSlice); ok {
+			array[i] = tomlTable(item)
+		} else {
+			array[i] = value
+		}
+	}
+	return array
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFormatRoundTrip(t *testing.T) {
+	opt := new(ServerOptions)
+	require.NoError(t, opt.Unmarshal([]byte(DefaultConfigJSON)))
+	opt.Port = 8080
+	opt.Password = "password@123"
+	opt.AllowIP = []string{"127.0.0.1", "10.0.0.1"}
+	opt.Region.Schedule = "0 3 * * *"
+	opt.Tiering.Endpoint = "http://minio:9000"
+	// TOML 中空的表加载之后为 nil，这里使用非空的 map 比较
+	opt.Codec.Types = map[string]string{"number": "protobuf"}
+	opt.Codec.Namespaces = map[string]string{"metrics": "cbor"}
+
+	for _, name := range []string{"config.yaml", "config.yml", "config.json", "config.toml", "config.TOML"} {
+		file := filepath.Join(t.TempDir(), name)
+		require.NoError(t, opt.SavedAs(file), name)
+
+		loaded := new(ServerOptions)
+		require.NoError(t, Load(file, loaded), name)
+
+		expected, err := opt.Marshal()
+		require.NoError(t, err)
+		actual, err := loaded.Marshal()
+		require.NoError(t, err)
+		assert.JSONEq(t, string(expected), string(actual), name)
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"config.json": `{"port": 3000, "region": {"threshold": 4}}`,
+		"config.toml": "port = 3000\n\n[region]\nthreshold = 4\n",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+
+		opt := new(ServerOptions)
+		require.NoError(t, Load(file, opt), name)
+		assert.Equal(t, 3000, opt.Port, name)
+		assert.Equal(t, uint8(4), opt.Region.Threshold, name)
+	}
+
+	file := filepath.Join(dir, "config.ini")
+	require.NoError(t, os.WriteFile(file, []byte("port=3000"), 0644))
+	assert.ErrorIs(t, Load(file, new(ServerOptions)), ErrInvalidConfig)
+	assert.ErrorIs(t, new(ServerOptions).SavedAs(file), ErrInvalidConfig)
+}
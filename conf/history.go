@@ -0,0 +1,292 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const historyFileName = "config.history"
+
+// 配置修改的来源
+const (
+	SourceStartup  = "startup"
+	SourceReload   = "reload"
+	SourceAdmin    = "admin"
+	SourceRollback = "rollback"
+)
+
+var (
+	// ErrInvalidConfig 新的配置没有通过校验
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrNoChanges 新的配置和当前的配置相同
+	ErrNoChanges = errors.New("configuration has no changes")
+	// ErrRestartRequired 修改的配置项只能在重启之后生效
+	ErrRestartRequired = errors.New("configuration change requires a restart")
+	// ErrVersionNotFound 配置历史中没有这个版本
+	ErrVersionNotFound = errors.New("configuration version not found")
+)
+
+// ConfigVersion 是一次生效的配置修改，Changes 为修改的配置项路径，例如 region.cron，
+// Options 中的密码和密钥已经被隐藏，不会写入配置历史
+type ConfigVersion struct {
+	Version    uint64         `json:"version"`
+	Time       time.Time      `json:"time"`
+	Source     string         `json:"source"`
+	Author     string         `json:"author"`
+	RollbackTo uint64         `json:"rollback_to,omitempty"`
+	Changes    []string       `json:"changes"`
+	Options    *ServerOptions `json:"options"`
+}
+
+// ApplyFunc 把新的配置应用到运行中的服务器，不能在运行期间修改的配置项返回 ErrRestartRequired
+type ApplyFunc func(prev, next *ServerOptions, changes []string) error
+
+// History 是数据目录中追加写入的配置版本记录，每次生效的配置修改都会保存为一个新的版本，
+// 通过管理接口修改的配置不会写回配置文件，重启之后以配置文件和命令行参数为准
+type History struct {
+	mu       sync.Mutex
+	path     string
+	current  *ServerOptions
+	versions []ConfigVersion
+}
+
+// OpenHistory 读取 dir 中的配置历史，current 和最后一个版本不同时记录为启动时的新版本
+func OpenHistory(dir string, current *ServerOptions, author string) (*History, error) {
+	h := &History{
+		path:    filepath.Join(dir, historyFileName),
+		current: current.clone(),
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read configuration history: %w", err)
+	}
+
+	// 崩溃时最后一行可能没有写完整，截断之后才能继续追加
+	offset := 0
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		var version ConfigVersion
+		if end < 0 || json.Unmarshal(data[offset:offset+end], &version) != nil {
+			if end >= 0 && bytes.IndexByte(data[offset+end+1:], '\n') >= 0 {
+				return nil, fmt.Errorf("failed to parse configuration history at offset %d", offset)
+			}
+			err := os.Truncate(h.path, int64(offset))
+			if err != nil {
+				return nil, fmt.Errorf("failed to truncate configuration history: %w", err)
+			}
+			break
+		}
+		h.versions = append(h.versions, version)
+		offset += end + 1
+	}
+
+	var last *ServerOptions
+	if n := len(h.versions); n > 0 {
+		last = h.versions[n-1].Options
+	}
+	changes := changedFields(last, current.redacted())
+	if len(changes) > 0 {
+		err := h.append(SourceStartup, author, 0, changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// Current 返回当前生效配置的副本
+func (h *History) Current() *ServerOptions {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current.clone()
+}
+
+// Versions 返回全部的配置版本，最新的版本在最后
+func (h *History) Versions() []ConfigVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]ConfigVersion(nil), h.versions...)
+}
+
+// Apply 校验 next 之后通过 apply 应用到运行中的服务器，成功之后记录为新的版本
+func (h *History) Apply(next *ServerOptions, source, author string, apply ApplyFunc) (*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.apply(next, source, author, 0, apply)
+}
+
+// Rollback 把配置恢复为 version 版本，隐藏的密码和密钥保持当前的值
+func (h *History) Rollback(version uint64, author string, apply ApplyFunc) (*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, v := range h.versions {
+		if v.Version == version {
+			next := v.Options.clone()
+			next.copySecrets(h.current)
+			return h.apply(next, SourceRollback, author, version, apply)
+		}
+	}
+
+	return nil, ErrVersionNotFound
+}
+
+func (h *History) apply(next *ServerOptions, source, author string, rollbackTo uint64, apply ApplyFunc) (*ConfigVersion, error) {
+	err := Vaildated(next)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	changes := changedFields(h.current, next)
+	if len(changes) == 0 {
+		return nil, ErrNoChanges
+	}
+
+	err = apply(h.current.clone(), next.clone(), changes)
+	if err != nil {
+		return nil, err
+	}
+
+	h.current = next.clone()
+	err = h.append(source, author, rollbackTo, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &h.versions[len(h.versions)-1], nil
+}
+
+// append 把当前配置作为新的版本追加到配置历史文件，刷盘之后才加入内存中的版本列表
+func (h *History) append(source, author string, rollbackTo uint64, changes []string) error {
+	version := ConfigVersion{
+		Version:    1,
+		Time:       time.Now(),
+		Source:     source,
+		Author:     author,
+		RollbackTo: rollbackTo,
+		Changes:    changes,
+		Options:    h.current.redacted(),
+	}
+	if n := len(h.versions); n > 0 {
+		version.Version = h.versions[n-1].Version + 1
+	}
+
+	line, err := json.Marshal(&version)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(h.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, FSPerm)
+	if err != nil {
+		return fmt.Errorf("failed to open configuration history: %w", err)
+	}
+	defer fd.Close()
+
+	w := bufio.NewWriter(fd)
+	_, _ = w.Write(line)
+	_ = w.WriteByte('\n')
+	err = w.Flush()
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write configuration history: %w", err)
+	}
+
+	h.versions = append(h.versions, version)
+	return nil
+}
+
+func (opt *ServerOptions) clone() *ServerOptions {
+	bs, _ := opt.Marshal()
+	copied := new(ServerOptions)
+	_ = copied.Unmarshal(bs)
+	return copied
+}
+
+// redacted 返回隐藏了密码和密钥的副本
+func (opt *ServerOptions) redacted() *ServerOptions {
+	copied := opt.clone()
+	copied.copySecrets(new(ServerOptions))
+	return copied
+}
+
+// copySecrets 使用 from 中的密码和密钥替换 opt 中的
+func (opt *ServerOptions) copySecrets(from *ServerOptions) {
+	opt.Password = from.Password
+	opt.Encryptor.Secret = from.Encryptor.Secret
+	opt.Console.Token = from.Console.Token
+	opt.Tiering.AccessKey, opt.Tiering.SecretKey = from.Tiering.AccessKey, from.Tiering.SecretKey
+	opt.Backup.AccessKey, opt.Backup.SecretKey = from.Backup.AccessKey, from.Backup.SecretKey
+}
+
+// changedFields 返回两个配置中值不同的配置项路径，prev 为 nil 时返回全部配置项
+func changedFields(prev, next *ServerOptions) []string {
+	before, after := make(map[string]string), make(map[string]string)
+	if prev != nil {
+		flatten("", toMap(prev), before)
+	}
+	flatten("", toMap(next), after)
+
+	var changes []string
+	for path, value := range after {
+		if old, ok := before[path]; !ok || old != value {
+			changes = append(changes, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changes = append(changes, path)
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+func toMap(opt *ServerOptions) map[string]any {
+	bs, _ := opt.Marshal()
+	var m map[string]any
+	_ = json.Unmarshal(bs, &m)
+	return m
+}
+
+// flatten 把嵌套的配置展开为 region.cron 这样的路径，数组作为一个整体比较
+func flatten(prefix string, value any, out map[string]string) {
+	if m, ok := value.(map[string]any); ok && len(m) > 0 {
+		for key, v := range m {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, v, out)
+		}
+		return
+	}
+
+	bs, _ := json.Marshal(value)
+	out[prefix] = string(bs)
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	opt := new(ServerOptions)
+	assert.NoError(t, opt.Unmarshal([]byte(DefaultConfigJSON)))
+	opt.Path, opt.Password = dir, "securepassword"
+
+	history, err := OpenHistory(dir, opt, "root")
+	assert.NoError(t, err)
+	versions := history.Versions()
+	assert.Len(t, versions, 1)
+	assert.Equal(t, SourceStartup, versions[0].Source)
+	assert.Empty(t, versions[0].Options.Password)
+
+	var applied []string
+	apply := func(prev, next *ServerOptions, changes []string) error {
+		for _, path := range changes {
+			if path == "port" {
+				return fmt.Errorf("%w: %s", ErrRestartRequired, path)
+			}
+		}
+		applied = changes
+		return nil
+	}
+
+	next := history.Current()
+	assert.Equal(t, "securepassword", next.Password)
+	next.Region.Schedule = "0 30 2 * * *"
+	version, err := history.Apply(next, SourceAdmin, "alice@127.0.0.1", apply)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), version.Version)
+	assert.Equal(t, []string{"region.cron"}, version.Changes)
+	assert.Equal(t, []string{"region.cron"}, applied)
+
+	_, err = history.Apply(next, SourceAdmin, "alice@127.0.0.1", apply)
+	assert.ErrorIs(t, err, ErrNoChanges)
+
+	next = history.Current()
+	next.Port = 80
+	_, err = history.Apply(next, SourceAdmin, "alice@127.0.0.1", apply)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	next.Port = 3000
+	_, err = history.Apply(next, SourceAdmin, "alice@127.0.0.1", apply)
+	assert.ErrorIs(t, err, ErrRestartRequired)
+	assert.Len(t, history.Versions(), 2)
+
+	// 回滚之后密码保持当前的值
+	version, err = history.Rollback(1, "bob@127.0.0.1", apply)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version.RollbackTo)
+	assert.Equal(t, SourceRollback, version.Source)
+	assert.Equal(t, opt.Region.Schedule, history.Current().Region.Schedule)
+	assert.Equal(t, "securepassword", history.Current().Password)
+
+	_, err = history.Rollback(9, "bob@127.0.0.1", apply)
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+
+	// 崩溃时没有写完整的最后一行被截断，配置没有变化时不记录新的版本
+	fd, err := os.OpenFile(filepath.Join(dir, historyFileName), os.O_WRONLY|os.O_APPEND, FSPerm)
+	assert.NoError(t, err)
+	_, err = fd.WriteString(`{"version": 4, "ti`)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	history, err = OpenHistory(dir, opt, "root")
+	assert.NoError(t, err)
+	versions = history.Versions()
+	assert.Len(t, versions, 3)
+	assert.Equal(t, "alice@127.0.0.1", versions[1].Author)
+
+	opt.Region.Schedule = "0 0 4 * * *"
+	history, err = OpenHistory(dir, opt, "root")
+	assert.NoError(t, err)
+	versions = history.Versions()
+	assert.Len(t, versions, 4)
+	assert.Equal(t, []string{"region.cron"}, versions[3].Changes)
+}
@@ -17,32 +17,69 @@ package conf
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
+	"net"
 	"os"
 	"path/filepath"
 
+	"github.com/auula/urnadb/clog"
+	"github.com/robfig/cron/v3"
 	"github.com/spf13/viper"
-	"gopkg.in/yaml.v2"
 )
 
+// cronParser 和 region 回收任务的 cron.WithSeconds 格式相同，第一个字段是秒
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
 const (
-	extension       = "yaml"
+	extension       = formatYAML
 	fileName        = "config"
 	defaultFilePath = ""
 	// Default file system permission
 	FSPerm = fs.FileMode(0755)
+	// Maximum key length in bytes that can be configured
+	maxKeySize = 4096
+	// Maximum length of the key prefix separator
+	maxSeparatorSize = 8
+	// Minimum length of the admin console token
+	minConsoleTokenSize = 16
+	// Maximum number of messages in a kafka produce request
+	maxKafkaBatch = 1000
 	// DefaultConfigJSON configure json string
 	DefaultConfigJSON = `
 	{
 		"port": 2668,
 		"path": "/tmp/urnadb",
+		"index": "hash",
+		"separator": ":",
+		"strict": false,
 		"debug": false,
+		"timeout": 3,
 		"logpath": "/tmp/urnadb/out.log",
+		"pidfile": "",
+		"log": {
+			"level": "info",
+			"format": "text",
+			"maxsize": 10,
+			"maxbackups": 3,
+			"maxage": 7,
+			"compress": true,
+			"access": false,
+			"sample": 1.0
+		},
 		"auth": "Are we wide open to the world?",
 		"region": {
 			"enable": true,
 			"cron": "0 0 3 * * *",
-			"threshold": 2
+			"threshold": 2,
+			"checksum": "crc32",
+			"flush": 1,
+			"direct": false,
+			"rate": 64,
+			"latency": 50,
+			"grace": 86400,
+			"scan": 600,
+			"ratio": 50
 		},
 		"encryptor": {
 			"enable": false,
@@ -51,10 +88,149 @@ const (
 		"compressor": {
 			"enable": false
 		},
+		"codec": {
+			"default": "msgpack",
+			"types": {},
+			"namespaces": {}
+		},
 		"checkpoint": {
 			"enable": false,
 			"interval":  1800
 		},
+		"spill": {
+			"enable": false,
+			"budget": 4096,
+			"interval": 60
+		},
+		"limit": {
+			"keysize": 256,
+			"valuesize": {
+				"set": 8388608,
+				"zset": 8388608,
+				"text": 4194304,
+				"table": 16777216,
+				"number": 1024,
+				"collection": 16777216
+			}
+		},
+		"pubsub": {
+			"persist": false,
+			"history": 100
+		},
+		"disk": {
+			"watermark": 1073741824,
+			"interval": 10
+		},
+		"analytics": {
+			"enable": false
+		},
+		"pool": {
+			"leakdetect": false
+		},
+		"console": {
+			"enable": false,
+			"token": ""
+		},
+		"session": {
+			"enable": false,
+			"ttl": 3600
+		},
+		"swagger": {
+			"enable": false
+		},
+		"compression": {
+			"enable": false,
+			"threshold": 1024
+		},
+		"bulkhead": {
+			"enable": false,
+			"scan": 4,
+			"admin": 2,
+			"queue": 16,
+			"wait": 1000
+		},
+		"cors": {
+			"enable": false,
+			"origins": [],
+			"methods": ["GET", "HEAD", "PUT", "POST", "DELETE"],
+			"headers": ["Auth-Token", "Admin-Token", "Authorization", "Content-Type", "If-Match", "X-Author"],
+			"credentials": false,
+			"maxage": 600
+		},
+		"cluster": {
+			"enable": false,
+			"self": "",
+			"nodes": [],
+			"vnodes": 160,
+			"redirect": false,
+			"replicas": 1,
+			"hints": 10000,
+			"repair": 600
+		},
+		"raft": {
+			"enable": false,
+			"id": "",
+			"bind": "",
+			"dir": "",
+			"timeout": 5,
+			"peers": []
+		},
+		"tiering": {
+			"enable": false,
+			"after": 30,
+			"interval": 3600,
+			"cache": "",
+			"regions": 4,
+			"endpoint": "",
+			"region": "us-east-1",
+			"bucket": "",
+			"prefix": "",
+			"accesskey": "",
+			"secretkey": ""
+		},
+		"backup": {
+			"enable": false,
+			"interval": 300,
+			"retention": 7,
+			"endpoint": "",
+			"region": "us-east-1",
+			"bucket": "",
+			"prefix": "",
+			"accesskey": "",
+			"secretkey": ""
+		},
+		"trash": {
+			"enable": false,
+			"retention": 86400,
+			"interval": 3600
+		},
+		"tracing": {
+			"enable": false,
+			"endpoint": "127.0.0.1:4318",
+			"insecure": true,
+			"ratio": 1.0
+		},
+		"kafka": {
+			"enable": false,
+			"brokers": [],
+			"topic": "urnadb",
+			"format": "json",
+			"batch": 500,
+			"clientid": "urnadb",
+			"timeout": 10
+		},
+		"fault": {
+			"enable": false
+		},
+		"security": {
+			"sensitive": false
+		},
+		"bind": [],
+		"socket": {
+			"path": "",
+			"mode": "0660",
+			"group": ""
+		},
 		"allow_ip": null
 	}
 `
@@ -107,6 +283,393 @@ func (AuthValidator) Validate(opt *ServerOptions) error {
 	return validatePassword(opt.Password)
 }
 
+type LimitValidator struct{}
+
+func (LimitValidator) Validate(opt *ServerOptions) error {
+	return validateLimit(opt.Limit)
+}
+
+type QuotaValidator struct{}
+
+func (QuotaValidator) Validate(opt *ServerOptions) error {
+	err := validateQuotas(opt.Quotas)
+	if err != nil {
+		return err
+	}
+	if len(opt.Quotas) > 0 && opt.Separator == "" {
+		return errors.New("namespace quotas require the key prefix separator")
+	}
+	return nil
+}
+
+type PubSubValidator struct{}
+
+func (PubSubValidator) Validate(opt *ServerOptions) error {
+	if opt.PubSub.History < 0 {
+		return errors.New("pubsub history size cannot be negative")
+	}
+	// 每次发布都会重写频道的历史消息，必须限制历史消息的数量
+	if opt.PubSub.Persist && opt.PubSub.History == 0 {
+		return errors.New("pubsub history size must be positive when persist is enabled")
+	}
+	return nil
+}
+
+type DiskValidator struct{}
+
+func (DiskValidator) Validate(opt *ServerOptions) error {
+	if opt.Disk.Watermark < 0 {
+		return errors.New("disk free space watermark cannot be negative")
+	}
+	return nil
+}
+
+type IndexValidator struct{}
+
+func (IndexValidator) Validate(opt *ServerOptions) error {
+	switch opt.Index {
+	case "", "hash", "skiplist", "fingerprint":
+		return nil
+	}
+	return fmt.Errorf("unsupported index kind: %s", opt.Index)
+}
+
+type SeparatorValidator struct{}
+
+func (SeparatorValidator) Validate(opt *ServerOptions) error {
+	if len(opt.Separator) > maxSeparatorSize {
+		return fmt.Errorf("key prefix separator cannot be longer than %d bytes", maxSeparatorSize)
+	}
+	return nil
+}
+
+type AllowIPValidator struct{}
+
+// AllowIP 中的每一项是一个 IP 地址或者 CIDR 网段
+func (AllowIPValidator) Validate(opt *ServerOptions) error {
+	for _, entry := range opt.AllowIP {
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("allowed IP %q is not an IP address or CIDR range", entry)
+		}
+	}
+	return nil
+}
+
+type BindValidator struct{}
+
+// Bind 中的每一项是 IP 地址、host:port、网卡名称或者 unix: 开头的 socket 路径，网卡在启动时才展开
+func (BindValidator) Validate(opt *ServerOptions) error {
+	for _, entry := range opt.Bind {
+		_, _, err := parseBind(entry, opt.Port)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type SocketValidator struct{}
+
+// Socket.Mode 是八进制的文件权限，例如 0660，Group 在启动时才查找
+func (SocketValidator) Validate(opt *ServerOptions) error {
+	if opt.Socket.Path != "" {
+		_, _, err := parseBind(unixPrefix+opt.Socket.Path, opt.Port)
+		if err != nil {
+			return err
+		}
+	}
+	if opt.Socket.Mode != "" {
+		_, err := parseFileMode(opt.Socket.Mode)
+		if err != nil {
+			return fmt.Errorf("invalid unix socket mode %q: %w", opt.Socket.Mode, err)
+		}
+	}
+	return nil
+}
+
+type ChecksumValidator struct{}
+
+func (ChecksumValidator) Validate(opt *ServerOptions) error {
+	switch opt.Region.Checksum {
+	case "", "crc32", "crc32c", "xxh3":
+		return nil
+	}
+	return fmt.Errorf("unsupported region checksum algorithm: %s", opt.Region.Checksum)
+}
+
+// codecTypes 是每种编解码器可以序列化的数据类型，nil 表示全部类型
+var codecTypes = map[string]map[string]bool{
+	"msgpack": nil,
+	"cbor": {
+		"set": true, "zset": true, "text": true, "table": true, "number": true,
+		"collection": true, "hll": true, "series": true,
+	},
+	"protobuf": {"number": true, "table": true},
+}
+
+// dataTypes 是可以按照类型选择编解码器的数据类型
+var dataTypes = map[string]bool{
+	"set": true, "zset": true, "text": true, "table": true, "number": true,
+	"collection": true, "stream": true, "hll": true, "queue": true, "series": true,
+}
+
+type CodecValidator struct{}
+
+func (CodecValidator) Validate(opt *ServerOptions) error {
+	codec := opt.Codec
+	if codec.Default != "" && codec.Default != "msgpack" && codec.Default != "cbor" {
+		return fmt.Errorf("default value codec must be msgpack or cbor: %s", codec.Default)
+	}
+
+	for kind, name := range codec.Types {
+		supported, ok := codecTypes[name]
+		if !ok {
+			return fmt.Errorf("unsupported value codec for %s: %s", kind, name)
+		}
+		if !dataTypes[kind] {
+			return fmt.Errorf("unknown data type in codec types: %s", kind)
+		}
+		if supported != nil && !supported[kind] {
+			return fmt.Errorf("%s values cannot be encoded with %s", kind, name)
+		}
+	}
+
+	for namespace, name := range codec.Namespaces {
+		if _, ok := codecTypes[name]; !ok {
+			return fmt.Errorf("unsupported value codec for namespace %s: %s", namespace, name)
+		}
+	}
+	if len(codec.Namespaces) > 0 && opt.Separator == "" {
+		return errors.New("codec namespaces require the key prefix separator")
+	}
+	return nil
+}
+
+// ScheduleValidator 使用 region 回收任务实际使用的解析器检查 cron 表达式
+type ScheduleValidator struct{}
+
+func (ScheduleValidator) Validate(opt *ServerOptions) error {
+	if !opt.IsCompactRegionEnabled() {
+		return nil
+	}
+	return ValidateCron(opt.CompactRegionInterval())
+}
+
+type DeadRatioValidator struct{}
+
+func (DeadRatioValidator) Validate(opt *ServerOptions) error {
+	if opt.Region.Scan > 0 && (opt.Region.Ratio == 0 || opt.Region.Ratio > 100) {
+		return fmt.Errorf("region dead ratio must be between 1 and 100: %d", opt.Region.Ratio)
+	}
+	return nil
+}
+
+type ClusterValidator struct{}
+
+func (ClusterValidator) Validate(opt *ServerOptions) error {
+	if !opt.Cluster.Enable {
+		return nil
+	}
+	if opt.Cluster.VNodes < 0 {
+		return errors.New("cluster virtual nodes cannot be negative")
+	}
+	if opt.Cluster.Replicas < 0 || opt.Cluster.Replicas > len(opt.Cluster.Nodes) {
+		return fmt.Errorf("cluster replicas must be between 0 and the number of nodes %d", len(opt.Cluster.Nodes))
+	}
+	if opt.Cluster.Hints < 0 {
+		return errors.New("cluster hints limit cannot be negative")
+	}
+	for _, node := range opt.Cluster.Nodes {
+		if node == opt.Cluster.Self {
+			return nil
+		}
+	}
+	return fmt.Errorf("cluster self address %q must be one of the nodes", opt.Cluster.Self)
+}
+
+type RaftValidator struct{}
+
+func (RaftValidator) Validate(opt *ServerOptions) error {
+	if !opt.Raft.Enable {
+		return nil
+	}
+	if opt.Cluster.Enable {
+		return errors.New("raft replication and cluster mode cannot be enabled together")
+	}
+	for _, peer := range opt.Raft.Peers {
+		if peer.ID == "" || peer.Addr == "" || peer.HTTP == "" {
+			return errors.New("raft peer id, addr and http cannot be empty")
+		}
+	}
+	for _, peer := range opt.Raft.Peers {
+		if peer.ID == opt.Raft.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("raft node id %q must be one of the peers", opt.Raft.ID)
+}
+
+type TieringValidator struct{}
+
+func (TieringValidator) Validate(opt *ServerOptions) error {
+	if !opt.Tiering.Enable {
+		return nil
+	}
+	if opt.Tiering.Endpoint == "" || opt.Tiering.Bucket == "" {
+		return errors.New("tiering object storage endpoint and bucket cannot be empty")
+	}
+	if opt.Tiering.Interval == 0 {
+		return errors.New("tiering interval must be greater than 0")
+	}
+	if opt.Tiering.Regions < 0 {
+		return errors.New("tiering cached regions cannot be negative")
+	}
+	return nil
+}
+
+type BackupValidator struct{}
+
+func (BackupValidator) Validate(opt *ServerOptions) error {
+	if !opt.Backup.Enable {
+		return nil
+	}
+	if opt.Backup.Endpoint == "" || opt.Backup.Bucket == "" {
+		return errors.New("backup object storage endpoint and bucket cannot be empty")
+	}
+	if opt.Backup.Interval == 0 {
+		return errors.New("backup interval must be greater than 0")
+	}
+	return nil
+}
+
+type TrashValidator struct{}
+
+func (TrashValidator) Validate(opt *ServerOptions) error {
+	if !opt.Trash.Enable {
+		return nil
+	}
+	if opt.Trash.Retention == 0 || opt.Trash.Interval == 0 {
+		return errors.New("trash retention and purge interval must be greater than 0")
+	}
+	return nil
+}
+
+type SpillValidator struct{}
+
+func (SpillValidator) Validate(opt *ServerOptions) error {
+	if opt.Spill.Enable && (opt.Spill.Budget == 0 || opt.Spill.Interval == 0) {
+		return errors.New("index spill budget and interval must be greater than 0")
+	}
+	return nil
+}
+
+type CompressionValidator struct{}
+
+func (CompressionValidator) Validate(opt *ServerOptions) error {
+	if opt.Compression.Enable && opt.Compression.Threshold <= 0 {
+		return errors.New("response compression threshold must be greater than 0")
+	}
+	return nil
+}
+
+type BulkheadValidator struct{}
+
+func (BulkheadValidator) Validate(opt *ServerOptions) error {
+	if !opt.Bulkhead.Enable {
+		return nil
+	}
+	if opt.Bulkhead.Scan <= 0 || opt.Bulkhead.Admin <= 0 {
+		return errors.New("bulkhead scan and admin concurrency must be greater than 0")
+	}
+	if opt.Bulkhead.Queue < 0 {
+		return errors.New("bulkhead queue size cannot be negative")
+	}
+	return nil
+}
+
+type CORSValidator struct{}
+
+func (CORSValidator) Validate(opt *ServerOptions) error {
+	if !opt.CORS.Enable {
+		return nil
+	}
+	if len(opt.CORS.Origins) == 0 {
+		return errors.New("cors allowed origins cannot be empty")
+	}
+	for _, origin := range opt.CORS.Origins {
+		if origin == "*" && opt.CORS.Credentials {
+			return errors.New("cors cannot allow credentials for any origin")
+		}
+	}
+	return nil
+}
+
+type LogValidator struct{}
+
+func (LogValidator) Validate(opt *ServerOptions) error {
+	return validateLog(opt.Log)
+}
+
+type SessionValidator struct{}
+
+func (SessionValidator) Validate(opt *ServerOptions) error {
+	if opt.Session.Enable && opt.Session.TTL == 0 {
+		return errors.New("session token ttl must be greater than 0")
+	}
+	return nil
+}
+
+type ConsoleValidator struct{}
+
+func (ConsoleValidator) Validate(opt *ServerOptions) error {
+	if opt.Console.Enable && len(opt.Console.Token) < minConsoleTokenSize {
+		return fmt.Errorf("console admin token must be at least %d characters", minConsoleTokenSize)
+	}
+	return nil
+}
+
+type TracingValidator struct{}
+
+func (TracingValidator) Validate(opt *ServerOptions) error {
+	if !opt.Tracing.Enable {
+		return nil
+	}
+	if opt.Tracing.Endpoint == "" {
+		return errors.New("tracing otlp endpoint cannot be empty")
+	}
+	if opt.Tracing.Ratio < 0 || opt.Tracing.Ratio > 1 {
+		return errors.New("tracing sample ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+type KafkaValidator struct{}
+
+func (KafkaValidator) Validate(opt *ServerOptions) error {
+	if !opt.Kafka.Enable {
+		return nil
+	}
+	if len(opt.Kafka.Brokers) == 0 || opt.Kafka.Topic == "" {
+		return errors.New("kafka brokers and topic cannot be empty")
+	}
+	for _, broker := range opt.Kafka.Brokers {
+		_, _, err := net.SplitHostPort(broker)
+		if err != nil {
+			return fmt.Errorf("invalid kafka broker address: %s", broker)
+		}
+	}
+	if opt.Kafka.Format != "" && opt.Kafka.Format != "json" && opt.Kafka.Format != "msgpack" {
+		return fmt.Errorf("unknown kafka message format: %s", opt.Kafka.Format)
+	}
+	if opt.Kafka.Batch < 0 || opt.Kafka.Batch > maxKafkaBatch {
+		return fmt.Errorf("kafka batch must be between 0 and %d", maxKafkaBatch)
+	}
+	return nil
+}
+
 type EncryptorValidator struct{}
 
 func (EncryptorValidator) Validate(opt *ServerOptions) error {
@@ -123,6 +686,51 @@ func validateEncryptor(encryptor Encryptor) error {
 	return errors.New("invalid secret key length it must be 16, 24, or 32 bytes")
 }
 
+func validateLog(l Log) error {
+	if _, err := clog.ParseLevel(l.Level); err != nil {
+		return err
+	}
+	for module, level := range l.Modules {
+		if _, err := clog.ParseLevel(level); err != nil {
+			return fmt.Errorf("log level of module %s: %w", module, err)
+		}
+	}
+	if _, err := clog.ParseFormat(l.Format); err != nil {
+		return err
+	}
+	if l.MaxSize < 0 || l.MaxBackups < 0 || l.MaxAge < 0 {
+		return errors.New("log rotation limits cannot be negative")
+	}
+	if l.Sample < 0 || l.Sample > 1 {
+		return errors.New("access log sample ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func validateLimit(limit Limit) error {
+	if limit.KeySize < 0 || limit.KeySize > maxKeySize {
+		return fmt.Errorf("key size limit must be between 0 and %d bytes", maxKeySize)
+	}
+	for kind, size := range limit.ValueSize {
+		if size < 0 {
+			return fmt.Errorf("value size limit of %s cannot be negative", kind)
+		}
+	}
+	return nil
+}
+
+func validateQuotas(quotas map[string]Quota) error {
+	for namespace, quota := range quotas {
+		if namespace == "" {
+			return errors.New("quota namespace cannot be empty")
+		}
+		if quota.MaxKeys < 0 || quota.MaxBytes < 0 {
+			return fmt.Errorf("quota of namespace %s cannot be negative", namespace)
+		}
+	}
+	return nil
+}
+
 func validatePort(port int) error {
 	if port <= 1024 || port >= 65535 {
 		return errors.New("port range must be between 1025 and 65534")
@@ -137,6 +745,16 @@ func validatePath(path string) error {
 	return nil
 }
 
+// ValidateCron checks a region compaction schedule, either a cron expression with a leading
+// seconds field or a descriptor such as @daily and @every 6h.
+func ValidateCron(spec string) error {
+	_, err := cronParser.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("invalid region cron %q: %v", spec, err)
+	}
+	return nil
+}
+
 func validatePassword(password string) error {
 	if password == "" {
 		return errors.New("auth password cannot be empty")
@@ -144,15 +762,45 @@ func validatePassword(password string) error {
 	return nil
 }
 
-func Vaildated(opt *ServerOptions) error {
-	validators := []Validator{
+// validators 返回启动时检查配置的全部校验器，Vaildated 遇到第一个错误就返回，Diagnose 收集全部错误
+func validators() []Validator {
+	return []Validator{
 		PortValidator{},
 		PathValidator{},
 		AuthValidator{},
 		EncryptorValidator{},
+		LimitValidator{},
+		QuotaValidator{},
+		PubSubValidator{},
+		DiskValidator{},
+		LogValidator{},
+		TracingValidator{},
+		ConsoleValidator{},
+		SessionValidator{},
+		CompressionValidator{},
+		BulkheadValidator{},
+		CORSValidator{},
+		IndexValidator{},
+		SeparatorValidator{},
+		AllowIPValidator{},
+		BindValidator{},
+		SocketValidator{},
+		ChecksumValidator{},
+		CodecValidator{},
+		ScheduleValidator{},
+		DeadRatioValidator{},
+		ClusterValidator{},
+		RaftValidator{},
+		TieringValidator{},
+		BackupValidator{},
+		TrashValidator{},
+		SpillValidator{},
+		KafkaValidator{},
 	}
+}
 
-	for _, validator := range validators {
+func Vaildated(opt *ServerOptions) error {
+	for _, validator := range validators() {
 		err := validator.Validate(opt)
 		if err != nil {
 			return err
@@ -162,15 +810,20 @@ func Vaildated(opt *ServerOptions) error {
 	return nil
 }
 
-// Load through a configuration file
+// Load through a configuration file, the format is detected from the extension
 func Load(file string, opt *ServerOptions) error {
 	_, err := os.Stat(file)
 	if err != nil {
 		return err
 	}
 
+	format, err := configFormat(file)
+	if err != nil {
+		return err
+	}
+
 	v := viper.New()
-	v.SetConfigType(extension)
+	v.SetConfigType(format)
 	v.SetConfigFile(file)
 
 	err = v.ReadInConfig()
@@ -178,12 +831,21 @@ func Load(file string, opt *ServerOptions) error {
 		return err
 	}
 
-	return v.Unmarshal(opt)
+	return v.Unmarshal(opt, decodeJSONTags)
 }
 
+// saved 按照扩展名选择格式保存配置，和 Load 支持的格式对称
 func saved(path string, opt *ServerOptions) error {
-	yamlData, _ := yaml.Marshal(&opt)
-	return os.WriteFile(path, yamlData, FSPerm)
+	format, err := configFormat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeConfig(format, opt)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, FSPerm)
 }
 
 func (opt *ServerOptions) SavedAs(path string) error {
@@ -230,6 +892,18 @@ func (opt *ServerOptions) Secret() []byte {
 	return []byte(opt.Encryptor.Secret)
 }
 
+func (opt *ServerOptions) KeySizeLimit() int {
+	return opt.Limit.KeySize
+}
+
+func (opt *ServerOptions) ValueSizeLimit() map[string]int64 {
+	return opt.Limit.ValueSize
+}
+
+func (opt *ServerOptions) IsQuotaEnabled() bool {
+	return len(opt.Quotas) > 0
+}
+
 func (opt *ServerOptions) IsCheckpointEnabled() bool {
 	return opt.Checkpoint.Enable
 }
@@ -238,28 +912,270 @@ func (opt *ServerOptions) CheckpointInterval() uint32 {
 	return opt.Checkpoint.Interval
 }
 
+func (opt *ServerOptions) FlushInterval() uint32 {
+	return opt.Region.Flush
+}
+
+func (opt *ServerOptions) IsDirectIOEnabled() bool {
+	return opt.Region.Direct
+}
+
+func (opt *ServerOptions) CompactRate() uint32 {
+	return opt.Region.Rate
+}
+
+func (opt *ServerOptions) CompactLatency() uint32 {
+	return opt.Region.Latency
+}
+
+func (opt *ServerOptions) TombstoneGrace() uint32 {
+	return opt.Region.Grace
+}
+
+func (opt *ServerOptions) ExpiryScanInterval() uint32 {
+	return opt.Region.Scan
+}
+
+func (opt *ServerOptions) DeadRatio() float64 {
+	return float64(opt.Region.Ratio) / 100
+}
+
+func (opt *ServerOptions) IsAnalyticsEnabled() bool {
+	return opt.Analytics.Enable
+}
+
+func (opt *ServerOptions) IsLeakDetectEnabled() bool {
+	return opt.Pool.LeakDetect
+}
+
+func (opt *ServerOptions) IsConsoleEnabled() bool {
+	return opt.Console.Enable
+}
+
+func (opt *ServerOptions) IsCORSEnabled() bool {
+	return opt.CORS.Enable
+}
+
+func (opt *ServerOptions) IsSessionEnabled() bool {
+	return opt.Session.Enable
+}
+
+// SessionTTL 返回会话令牌有效的秒数，没有开启时返回 0
+func (opt *ServerOptions) SessionTTL() uint32 {
+	if !opt.Session.Enable {
+		return 0
+	}
+	return opt.Session.TTL
+}
+
+func (opt *ServerOptions) IsSwaggerEnabled() bool {
+	return opt.Swagger.Enable
+}
+
+func (opt *ServerOptions) IsClusterEnabled() bool {
+	return opt.Cluster.Enable
+}
+
+func (opt *ServerOptions) IsRaftEnabled() bool {
+	return opt.Raft.Enable
+}
+
+func (opt *ServerOptions) IsTieringEnabled() bool {
+	return opt.Tiering.Enable
+}
+
+func (opt *ServerOptions) IsBackupEnabled() bool {
+	return opt.Backup.Enable
+}
+
+func (opt *ServerOptions) IsTrashEnabled() bool {
+	return opt.Trash.Enable
+}
+
+func (opt *ServerOptions) IsIndexSpillEnabled() bool {
+	return opt.Spill.Enable
+}
+
+func (opt *ServerOptions) IsResponseCompressionEnabled() bool {
+	return opt.Compression.Enable
+}
+
+func (opt *ServerOptions) IsBulkheadEnabled() bool {
+	return opt.Bulkhead.Enable
+}
+
+func (opt *ServerOptions) IsTracingEnabled() bool {
+	return opt.Tracing.Enable
+}
+
+func (opt *ServerOptions) IsKafkaEnabled() bool {
+	return opt.Kafka.Enable
+}
+
+func (opt *ServerOptions) IsFaultInjectionEnabled() bool {
+	return opt.Fault.Enable
+}
+
+func (opt *ServerOptions) IsDiskGuardEnabled() bool {
+	return opt.Disk.Watermark > 0
+}
+
+func (opt *ServerOptions) DiskCheckInterval() uint32 {
+	if opt.Disk.Interval == 0 {
+		return 10
+	}
+	return opt.Disk.Interval
+}
+
+// LogLevel 返回全局日志级别，开启 debug 模式时强制为 debug 级别
+func (opt *ServerOptions) LogLevel() clog.Level {
+	if opt.Debug {
+		return clog.DebugLevel
+	}
+	level, _ := clog.ParseLevel(opt.Log.Level)
+	return level
+}
+
+// LogModuleLevels 返回单独设置了日志级别的模块
+func (opt *ServerOptions) LogModuleLevels() map[string]clog.Level {
+	levels := make(map[string]clog.Level, len(opt.Log.Modules))
+	for module, text := range opt.Log.Modules {
+		level, _ := clog.ParseLevel(text)
+		levels[module] = level
+	}
+	return levels
+}
+
+func (opt *ServerOptions) LogFormat() clog.Format {
+	format, _ := clog.ParseFormat(opt.Log.Format)
+	return format
+}
+
+// Listeners 返回 HTTP 服务器的全部监听地址，包括 bind 中的地址和 socket.path
+func (opt *ServerOptions) Listeners() ([]BindAddr, error) {
+	addrs, err := ResolveBind(opt.Bind, opt.Port)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Socket.Path != "" {
+		addrs = appendBind(addrs, BindAddr{Network: "unix", Address: opt.Socket.Path})
+	}
+	return addrs, nil
+}
+
+// SocketMode 返回 Unix socket 文件的权限，没有设置时为 0
+func (opt *ServerOptions) SocketMode() fs.FileMode {
+	mode, _ := parseFileMode(opt.Socket.Mode)
+	return mode
+}
+
+// PidFilePath 返回 pid 文件的路径，没有设置时放在数据目录下
+func (opt *ServerOptions) PidFilePath() string {
+	if opt.PidFile != "" {
+		return opt.PidFile
+	}
+	return filepath.Join(opt.Path, "urnadb.pid")
+}
+
+// LogRotation 返回日志文件轮转策略，未设置的字段使用 clog 默认值
+func (opt *ServerOptions) LogRotation() clog.Rotation {
+	rotation := clog.DefaultRotation
+	if opt.Log.MaxSize > 0 {
+		rotation.MaxSize = opt.Log.MaxSize
+	}
+	if opt.Log.MaxBackups > 0 {
+		rotation.MaxBackups = opt.Log.MaxBackups
+	}
+	if opt.Log.MaxAge > 0 {
+		rotation.MaxAge = opt.Log.MaxAge
+	}
+	rotation.Compress = opt.Log.Compress
+	return rotation
+}
+
 func toString(opt *ServerOptions) string {
 	bs, _ := opt.Marshal()
 	return string(bs)
 }
 
 type ServerOptions struct {
-	Port       int        `json:"port"`
-	Path       string     `json:"path"`
-	Debug      bool       `json:"debug"`
-	LogPath    string     `json:"logpath"`
-	Password   string     `json:"auth"`
-	Region     Region     `json:"region"`
-	Encryptor  Encryptor  `json:"encryptor"`
-	Compressor Compressor `json:"compressor"`
-	Checkpoint Checkpoint `json:"checkpoint"`
-	AllowIP    []string   `json:"allowip"`
+	Port        int              `json:"port"`
+	Path        string           `json:"path"`
+	Index       string           `json:"index"`
+	Separator   string           `json:"separator"`
+	Strict      bool             `json:"strict"`
+	Debug       bool             `json:"debug"`
+	Timeout     uint32           `json:"timeout"`
+	LogPath     string           `json:"logpath"`
+	PidFile     string           `json:"pidfile"`
+	Log         Log              `json:"log"`
+	Password    string           `json:"auth"`
+	Region      Region           `json:"region"`
+	Encryptor   Encryptor        `json:"encryptor"`
+	Compressor  Compressor       `json:"compressor"`
+	Codec       Codec            `json:"codec"`
+	Checkpoint  Checkpoint       `json:"checkpoint"`
+	Spill       Spill            `json:"spill"`
+	Limit       Limit            `json:"limit"`
+	Quotas      map[string]Quota `json:"quotas"`
+	PubSub      PubSub           `json:"pubsub"`
+	Disk        Disk             `json:"disk"`
+	Analytics   Analytics        `json:"analytics"`
+	Pool        Pool             `json:"pool"`
+	Console     Console          `json:"console"`
+	Session     Session          `json:"session"`
+	Swagger     Swagger          `json:"swagger"`
+	Compression Compression      `json:"compression"`
+	Bulkhead    Bulkhead         `json:"bulkhead"`
+	CORS        CORS             `json:"cors"`
+	Cluster     Cluster          `json:"cluster"`
+	Raft        Raft             `json:"raft"`
+	Tiering     Tiering          `json:"tiering"`
+	Backup      Backup           `json:"backup"`
+	Trash       Trash            `json:"trash"`
+	Tracing     Tracing          `json:"tracing"`
+	Kafka       Kafka            `json:"kafka"`
+	Fault       Fault            `json:"fault"`
+	Security    Security         `json:"security"`
+	Bind        []string         `json:"bind"`
+	Socket      Socket           `json:"socket"`
+	AllowIP     []string         `json:"allowip"`
+}
+
+// Log 日志级别、输出格式和 LogPath 文件轮转策略，MaxSize 单位 MB，MaxAge 单位天
+type Log struct {
+	Level      string            `json:"level"`
+	Format     string            `json:"format"`
+	Modules    map[string]string `json:"modules"`
+	MaxSize    int               `json:"maxsize"`
+	MaxBackups int               `json:"maxbackups"`
+	MaxAge     int               `json:"maxage"`
+	Compress   bool              `json:"compress"`
+	// Access 开启访问日志，Sample 是成功请求写入访问日志的比例，失败的请求总是写入
+	Access bool    `json:"access"`
+	Sample float64 `json:"sample"`
 }
 
 type Region struct {
 	Enable    bool   `json:"enable"`
 	Schedule  string `json:"cron"`
 	Threshold uint8  `json:"threshold"`
+	// Checksum 新写入的 region 使用的校验算法，算法记录在 region 头部，修改之后旧的 region 仍然可以读取
+	Checksum string `json:"checksum"`
+	// Flush 后台同步 active region 的周期（秒），写入不等待同步，0 表示只在切换 region 和关闭时同步
+	Flush uint32 `json:"flush"`
+	// Direct 写入 active region 时绕过页缓存，Linux 使用 O_DIRECT，macOS 使用 F_NOCACHE，避免大量导入数据挤出热数据
+	Direct bool `json:"direct"`
+	// Rate 垃圾回收读写的速率上限（MB/s），0 表示不限速
+	Rate uint32 `json:"rate"`
+	// Latency 前台请求 p99 延迟的目标（毫秒），超过之后垃圾回收自动降低速率，0 表示不退避
+	Latency uint32 `json:"latency"`
+	// Grace 墓碑的保留时间（秒），垃圾回收只丢弃超过这个时间的墓碑，避免还没有看到删除的副本和备份恢复出已经删除的数据
+	Grace uint32 `json:"grace"`
+	// Scan 统计 region 中过期数据的周期（秒），死数据比例超过 Ratio 的 region 立即回收，0 表示只按照 cron 回收
+	Scan uint32 `json:"scan"`
+	// Ratio 触发回收的死数据比例（百分比），包括被覆盖、删除和过期的数据
+	Ratio uint8 `json:"ratio"`
 }
 
 type Encryptor struct {
@@ -271,7 +1187,211 @@ type Compressor struct {
 	Enable bool `json:"enable"`
 }
 
+// Codec 选择新写入的值的序列化格式，编解码器记录在每条记录中，修改之后已有的值仍然可以读取。
+// Namespaces 按照 key 的一级前缀选择，优先于按照数据类型选择的 Types，都没有配置时使用 Default，
+// protobuf 只支持 number 和 table，命名空间的编解码器不支持值的类型时按照 Types 和 Default 选择
+type Codec struct {
+	Default    string            `json:"default"`
+	Types      map[string]string `json:"types"`
+	Namespaces map[string]string `json:"namespaces"`
+}
+
 type Checkpoint struct {
 	Enable   bool   `json:"enable"`
 	Interval uint32 `json:"interval"`
 }
+
+// Spill 索引内存超过 Budget MB 时把最久没有访问的索引分片溢出到磁盘，每 Interval 秒检查一次
+type Spill struct {
+	Enable   bool   `json:"enable"`
+	Budget   uint32 `json:"budget"`
+	Interval uint32 `json:"interval"`
+}
+
+// Limit 请求数据大小限制，0 表示使用服务端默认值
+type Limit struct {
+	KeySize   int              `json:"keysize"`
+	ValueSize map[string]int64 `json:"valuesize"`
+}
+
+// Quota 命名空间存储配额，0 表示不限制
+type Quota struct {
+	MaxKeys  int64 `json:"maxkeys"`
+	MaxBytes int64 `json:"maxbytes"`
+}
+
+type PubSub struct {
+	Persist bool `json:"persist"`
+	History int  `json:"history"`
+}
+
+// Analytics 开启之后在内存中增量维护键空间统计，会额外占用每个 key 的内存
+type Analytics struct {
+	Enable bool `json:"enable"`
+}
+
+// Pool 对象池的泄漏检测，开启之后借出的对象没有归还就被回收时输出警告日志，对性能有影响，只用于排查问题
+type Pool struct {
+	LeakDetect bool `json:"leakdetect"`
+}
+
+// Console 管理控制台，使用独立的管理员 Token 访问
+type Console struct {
+	Enable bool   `json:"enable"`
+	Token  string `json:"token"`
+}
+
+// Swagger 开启 /swagger 页面浏览 /openapi.json 接口文档
+// Session 使用 auth 密码在 /auth/login 换取的会话令牌，TTL 为令牌有效的秒数
+type Session struct {
+	Enable bool   `json:"enable"`
+	TTL    uint32 `json:"ttl"`
+}
+
+type Swagger struct {
+	Enable bool `json:"enable"`
+}
+
+// Compression HTTP 响应压缩，超过 Threshold 字节的 JSON 响应才会压缩，和 Compressor 静态数据压缩相互独立
+type Compression struct {
+	Enable    bool `json:"enable"`
+	Threshold int  `json:"threshold"`
+}
+
+// Bulkhead 扫描请求和管理请求的并发隔离，Scan 和 Admin 是两类请求各自的最大并发数量，
+// 超过并发数量的请求最多 Queue 个排队，排队超过 Wait 毫秒返回 429，读写单个 key 不受限制
+type Bulkhead struct {
+	Enable bool   `json:"enable"`
+	Scan   int    `json:"scan"`
+	Admin  int    `json:"admin"`
+	Queue  int    `json:"queue"`
+	Wait   uint32 `json:"wait"`
+}
+
+// CORS 浏览器跨域访问，Origins 中的 * 允许任意来源，允许任意来源时不能携带凭证
+type CORS struct {
+	Enable      bool     `json:"enable"`
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods"`
+	Headers     []string `json:"headers"`
+	Credentials bool     `json:"credentials"`
+	MaxAge      uint32   `json:"maxage"`
+}
+
+// Cluster 静态节点列表的集群模式，Self 为本节点在 Nodes 中的地址，
+// 所有节点的 Nodes 和 VNodes 必须一致，否则同一个 key 会被路由到不同的节点。
+// Replicas 大于 1 时每个 key 保存在哈希环上连续的 Replicas 个节点上，
+// Hints 为副本节点不可用时暂存的写操作上限，Repair 为反熵修复的间隔秒数，0 表示不修复
+type Cluster struct {
+	Enable   bool     `json:"enable"`
+	Self     string   `json:"self"`
+	Nodes    []string `json:"nodes"`
+	VNodes   int      `json:"vnodes"`
+	Redirect bool     `json:"redirect"`
+	Replicas int      `json:"replicas"`
+	Hints    int      `json:"hints"`
+	Repair   uint32   `json:"repair"`
+}
+
+// Raft 强一致的复制模式，写操作提交到 raft 日志之后才返回，
+// Dir 为空时保存在数据目录的 raft 子目录，Timeout 为写操作等待提交的秒数
+type Raft struct {
+	Enable  bool       `json:"enable"`
+	ID      string     `json:"id"`
+	Bind    string     `json:"bind"`
+	Dir     string     `json:"dir"`
+	Timeout uint32     `json:"timeout"`
+	Peers   []RaftPeer `json:"peers"`
+}
+
+// RaftPeer 是 raft 集群中的一个节点，Addr 为 raft 通信地址，HTTP 为数据接口地址
+type RaftPeer struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+	HTTP string `json:"http"`
+}
+
+// Tiering 把超过 After 天没有修改的封存 region 上传到 S3 兼容的对象存储，本地只保留存根和索引，
+// 读取时下载到 Cache 目录并且最多缓存 Regions 个，Cache 为空时使用数据目录下的 cache 目录，
+// Interval 为检查冷数据的间隔秒数，多个节点共用一个 Bucket 时需要使用不同的 Prefix
+type Tiering struct {
+	Enable   bool   `json:"enable"`
+	After    uint32 `json:"after"`
+	Interval uint32 `json:"interval"`
+	Cache    string `json:"cache"`
+	Regions  int    `json:"regions"`
+	ObjectStorage
+}
+
+// Backup 每隔 Interval 秒把新封存的 region 和最新的检查点上传到对象存储，
+// 被回收的 region 和旧的检查点保留 Retention 天，0 表示永久保留，可以恢复到保留期内的任意时间点
+type Backup struct {
+	Enable    bool   `json:"enable"`
+	Interval  uint32 `json:"interval"`
+	Retention uint32 `json:"retention"`
+	ObjectStorage
+}
+
+// Trash 回收站，开启之后删除的 key 移动到 __trash__ 命名空间保留 Retention 秒，
+// 可以通过 /admin/undelete 恢复，每隔 Interval 秒清理超过保留时间的 key
+type Trash struct {
+	Enable    bool   `json:"enable"`
+	Retention uint32 `json:"retention"`
+	Interval  uint32 `json:"interval"`
+}
+
+// ObjectStorage 是 S3 兼容对象存储的连接配置，在配置文件中和所属的配置项平铺在一起
+type ObjectStorage struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accesskey"`
+	SecretKey string `json:"secretkey"`
+}
+
+// Tracing 通过 OTLP HTTP 协议导出 OpenTelemetry 链路数据，Ratio 为采样比例
+type Tracing struct {
+	Enable   bool    `json:"enable"`
+	Endpoint string  `json:"endpoint"`
+	Insecure bool    `json:"insecure"`
+	Ratio    float64 `json:"ratio"`
+}
+
+// Kafka 把提交的写入和删除按照 LSN 的顺序发送到 Topic，消息的 key 是数据的 key，Format 为消息的编码格式 json 或者 msgpack，
+// Batch 为每次发送的最大消息数量，Timeout 为等待 broker 确认的秒数。发送成功的位置保存在数据目录中，
+// 重启之后从上次的位置继续发送，消息至少发送一次，可能会重复
+type Kafka struct {
+	Enable   bool     `json:"enable"`
+	Brokers  []string `json:"brokers"`
+	Topic    string   `json:"topic"`
+	Format   string   `json:"format"`
+	Batch    int      `json:"batch"`
+	ClientID string   `json:"clientid"`
+	Timeout  uint32   `json:"timeout"`
+}
+
+// Fault 开启之后可以通过 /admin/faults 给磁盘读写注入延迟、错误和不完整的写入，用于测试客户端的重试和崩溃恢复，
+// 不要在生产环境中开启
+type Fault struct {
+	Enable bool `json:"enable"`
+}
+
+// Security 描述部署的安全要求，Sensitive 表示保存的是敏感数据，没有开启数据加密时拒绝启动
+type Security struct {
+	Sensitive bool `json:"sensitive"`
+}
+
+// Socket 是给同一台主机上的 sidecar 使用的 Unix socket，和 bind 中的地址同时监听，Mode 和 Group 也用于 bind 中的 Unix socket。
+// Path 以 @ 开头时是 Linux 的抽象 socket，不会创建文件，同一个网络命名空间中的进程都可以连接，Mode 和 Group 不起作用
+type Socket struct {
+	Path  string `json:"path"`
+	Mode  string `json:"mode"`
+	Group string `json:"group"`
+}
+
+// Disk 数据目录剩余空间低于 Watermark 字节时切换为只读，0 表示不检查
+type Disk struct {
+	Watermark int64  `json:"watermark"`
+	Interval  uint32 `json:"interval"`
+}
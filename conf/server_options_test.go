@@ -15,6 +15,7 @@
 package conf
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -305,6 +306,7 @@ func TestVaildated(t *testing.T) {
 		Port:     2668,
 		Path:     "/tmp/wiredb",
 		Password: "securepassword",
+		Index:    "fingerprint",
 		Region: Region{
 			Enable:    true,
 			Schedule:  "0 0 3 * * *",
@@ -413,6 +415,271 @@ func TestVaildated(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid secret key length it must be 16, 24, or 32 bytes")
 
+	// Invalid configuration: negative value size limit
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Limit: Limit{
+			KeySize:   128,
+			ValueSize: map[string]int64{"table": -1},
+		},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "value size limit of table cannot be negative")
+
+	// Invalid configuration: negative namespace quota
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Quotas: map[string]Quota{
+			"tenant-a": {MaxKeys: -1},
+		},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "quota of namespace tenant-a cannot be negative")
+
+	// Invalid configuration: namespace quotas without the key prefix separator
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Quotas: map[string]Quota{
+			"tenant-a": {MaxKeys: 10},
+		},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "namespace quotas require the key prefix separator")
+
+	// Invalid configuration: negative disk watermark
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Disk:     Disk{Watermark: -1},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "disk free space watermark cannot be negative")
+
+	// Invalid configuration: unknown log level
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Log:      Log{Level: "verbose"},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown log level")
+
+	// Invalid configuration: tracing sample ratio out of range
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Tracing:  Tracing{Enable: true, Endpoint: "127.0.0.1:4318", Ratio: 2},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tracing sample ratio must be between 0 and 1")
+
+	// Invalid configuration: kafka message format
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Kafka:    Kafka{Enable: true, Brokers: []string{"127.0.0.1:9092"}, Topic: "urnadb", Format: "avro"},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown kafka message format")
+
+	// Invalid configuration: console admin token too short
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Console:  Console{Enable: true, Token: "admin"},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "console admin token must be at least 16 characters")
+
+	// Invalid configuration: allowed IP is neither an address nor a CIDR range
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		AllowIP:  []string{"10.0.0.0/8", "192.168.1.300"},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `allowed IP "192.168.1.300" is not an IP address or CIDR range`)
+
+	// Invalid configuration: credentials allowed for any origin
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		CORS:     CORS{Enable: true, Origins: []string{"https://app.example.com", "*"}, Credentials: true},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cors cannot allow credentials for any origin")
+
+	// Invalid configuration: session tokens that expire immediately
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Session:  Session{Enable: true},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "session token ttl must be greater than 0")
+
+	// Invalid configuration: cluster self address not in nodes
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Cluster:  Cluster{Enable: true, Self: "10.0.0.9:2668", Nodes: []string{"10.0.0.1:2668"}},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must be one of the nodes")
+
+	// Invalid configuration: more replicas than cluster nodes
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Cluster:  Cluster{Enable: true, Self: "10.0.0.1:2668", Nodes: []string{"10.0.0.1:2668"}, Replicas: 2},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cluster replicas must be between")
+
+	// Invalid configuration: raft node id not in peers
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Raft: Raft{Enable: true, ID: "node-3", Peers: []RaftPeer{
+			{ID: "node-1", Addr: "10.0.0.1:7000", HTTP: "10.0.0.1:2668"},
+		}},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must be one of the peers")
+
+	// Invalid configuration: tiering without object storage bucket
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Tiering:  Tiering{Enable: true, Interval: 3600, ObjectStorage: ObjectStorage{Endpoint: "http://127.0.0.1:9000"}},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "endpoint and bucket cannot be empty")
+
+	// Invalid configuration: backup without interval
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Backup:   Backup{Enable: true, ObjectStorage: ObjectStorage{Endpoint: "http://127.0.0.1:9000", Bucket: "backup"}},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "backup interval must be greater than 0")
+
+	// Invalid configuration: trash without retention
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Trash:    Trash{Enable: true, Interval: 3600},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "trash retention and purge interval must be greater than 0")
+
+	// Invalid configuration: index spill without budget
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Spill:    Spill{Enable: true, Interval: 60},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "index spill budget and interval must be greater than 0")
+
+	// Invalid configuration: unknown index kind
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Index:    "btree",
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported index kind: btree")
+
+	// Invalid configuration: response compression without threshold
+	invalidConfig = &ServerOptions{
+		Port:        2668,
+		Path:        "/tmp/wiredb",
+		Password:    "securepassword",
+		Compression: Compression{Enable: true},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "response compression threshold must be greater than 0")
+
+	// Invalid configuration: bulkhead without concurrency
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		Bulkhead: Bulkhead{Enable: true, Scan: 4},
+	}
+	err = Vaildated(invalidConfig)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bulkhead scan and admin concurrency must be greater than 0")
+
+	// Invalid configuration: value codecs
+	for codec, message := range map[string]string{
+		`{"default": "protobuf"}`:                              "default value codec must be msgpack or cbor",
+		`{"types": {"text": "protobuf"}}`:                      "text values cannot be encoded with protobuf",
+		`{"types": {"queue": "cbor"}}`:                         "queue values cannot be encoded with cbor",
+		`{"types": {"document": "cbor"}}`:                      "unknown data type in codec types: document",
+		`{"namespaces": {"metrics": "json"}}`:                  "unsupported value codec for namespace metrics: json",
+		`{"default": "cbor", "types": {"number": "protobuf"}}`: "",
+		`{"namespaces": {"metrics": "protobuf"}, "types": {}}`: "",
+	} {
+		invalidConfig = &ServerOptions{
+			Port:      2668,
+			Path:      "/tmp/wiredb",
+			Password:  "securepassword",
+			Separator: ":",
+		}
+		assert.NoError(t, json.Unmarshal([]byte(codec), &invalidConfig.Codec))
+		err = Vaildated(invalidConfig)
+		if message == "" {
+			assert.NoError(t, err, codec)
+		} else {
+			assert.ErrorContains(t, err, message, codec)
+		}
+	}
+
 	// // Invalid configuration: encryptor disable
 	invalidConfig = &ServerOptions{
 		Port:     2668,
@@ -436,6 +703,17 @@ func TestVaildated(t *testing.T) {
 	if err != nil {
 		assert.Error(t, err)
 	}
+
+	// Invalid configuration: persisted pubsub without a history limit
+	invalidConfig = &ServerOptions{
+		Port:     2668,
+		Path:     "/tmp/wiredb",
+		Password: "securepassword",
+		PubSub:   PubSub{Persist: true},
+	}
+	assert.ErrorContains(t, Vaildated(invalidConfig), "pubsub history size must be positive")
+	invalidConfig.PubSub.History = 100
+	assert.NoError(t, Vaildated(invalidConfig))
 }
 
 // TestSaved tests saving the configuration to a file
@@ -480,7 +758,7 @@ func TestMarshal(t *testing.T) {
 	require.NoError(t, err)
 
 	// Verify the marshaled data is correct
-	expectedJSON := `{"port":8080,"path":"/tmp/myconfig","debug":false,"logpath":"","auth":"testpassword","region":{"enable":false,"cron":"","threshold":0},"encryptor":{"enable":false,"secret":""},"compressor":{"enable":false},"checkpoint":{"enable":false,"interval":0},"allowip":null}`
+	expectedJSON := `{"port":8080,"path":"/tmp/myconfig","index":"","separator":"","strict":false,"debug":false,"timeout":0,"logpath":"","pidfile":"","log":{"level":"","format":"","modules":null,"maxsize":0,"maxbackups":0,"maxage":0,"compress":false,"access":false,"sample":0},"auth":"testpassword","region":{"enable":false,"cron":"","threshold":0,"checksum":"","flush":0,"direct":false,"rate":0,"latency":0,"grace":0,"scan":0,"ratio":0},"encryptor":{"enable":false,"secret":""},"compressor":{"enable":false},"codec":{"default":"","types":null,"namespaces":null},"checkpoint":{"enable":false,"interval":0},"spill":{"enable":false,"budget":0,"interval":0},"limit":{"keysize":0,"valuesize":null},"quotas":null,"pubsub":{"persist":false,"history":0},"disk":{"watermark":0,"interval":0},"analytics":{"enable":false},"pool":{"leakdetect":false},"console":{"enable":false,"token":""},"session":{"enable":false,"ttl":0},"swagger":{"enable":false},"compression":{"enable":false,"threshold":0},"bulkhead":{"enable":false,"scan":0,"admin":0,"queue":0,"wait":0},"cors":{"enable":false,"origins":null,"methods":null,"headers":null,"credentials":false,"maxage":0},"cluster":{"enable":false,"self":"","nodes":null,"vnodes":0,"redirect":false,"replicas":0,"hints":0,"repair":0},"raft":{"enable":false,"id":"","bind":"","dir":"","timeout":0,"peers":null},"tiering":{"enable":false,"after":0,"interval":0,"cache":"","regions":0,"endpoint":"","region":"","bucket":"","prefix":"","accesskey":"","secretkey":""},"backup":{"enable":false,"interval":0,"retention":0,"endpoint":"","region":"","bucket":"","prefix":"","accesskey":"","secretkey":""},"trash":{"enable":false,"retention":0,"interval":0},"tracing":{"enable":false,"endpoint":"","insecure":false,"ratio":0},"kafka":{"enable":false,"brokers":null,"topic":"","format":"","batch":0,"clientid":"","timeout":0},"fault":{"enable":false},"security":{"sensitive":false},"bind":null,"socket":{"path":"","mode":"","group":""},"allowip":null}`
 	assert.JSONEq(t, expectedJSON, string(data))
 }
 
@@ -0,0 +1,123 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consensus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/hashicorp/raft"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// fsm 把 raft 日志中提交的写操作应用到本地文件系统。
+// vfs 自身的数据是持久化的，重启之后不需要从快照恢复，
+// 只需要跳过已经应用过的日志，所以最后应用的日志索引也要持久化。
+type fsm struct {
+	fs      *vfs.LogStructuredFS
+	applied uint64
+	fd      *os.File
+}
+
+func newFSM(fss *vfs.LogStructuredFS, path string) (*fsm, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft applied index file: %w", err)
+	}
+
+	var buf [8]byte
+	n, err := fd.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		fd.Close()
+		return nil, fmt.Errorf("failed to read raft applied index: %w", err)
+	}
+
+	f := &fsm{fs: fss, fd: fd}
+	if n == len(buf) {
+		f.applied = binary.LittleEndian.Uint64(buf[:])
+	}
+
+	return f, nil
+}
+
+// Apply 返回的 error 会作为 ApplyFuture 的 Response 交给 Node.Replicate
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	if log.Type != raft.LogCommand || log.Index <= f.applied {
+		return nil
+	}
+
+	var op vfs.Operation
+	err := msgpack.Unmarshal(log.Data, &op)
+	if err == nil {
+		// 写入失败也是确定性的结果，每个节点都会得到一样的错误，所以索引照样前进
+		err = f.fs.Apply(&op)
+	}
+
+	f.setApplied(log.Index)
+	return err
+}
+
+func (f *fsm) setApplied(index uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], index)
+	_, err := f.fd.WriteAt(buf[:], 0)
+	if err != nil {
+		rlog.Errorf("failed to persist raft applied index %d: %v", index, err)
+	}
+	f.applied = index
+}
+
+// Snapshot 和 Apply 不会同时执行，这里固定的视图正好包含已经应用的日志，真正的数据在 Persist 中生成
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{fs: f.fs, view: f.fs.Snapshot()}, nil
+}
+
+// Restore 使用 leader 发送过来的快照替换本地数据
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	return f.fs.Restore(rc)
+}
+
+func (f *fsm) Close() error {
+	return f.fd.Close()
+}
+
+// snapshot 先生成 vfs 的索引检查点，再把视图中所有存活的 Segment 写入快照，
+// 生成快照期间应用的日志不会包含在快照中。
+type snapshot struct {
+	fs   *vfs.LogStructuredFS
+	view *vfs.Snapshot
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	err := s.fs.Checkpoint()
+	if err == nil || errors.Is(err, vfs.ErrCheckpointRunning) {
+		err = s.view.Export(context.Background(), sink)
+	}
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {
+	s.view.Release()
+}
@@ -0,0 +1,293 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consensus 基于 hashicorp/raft 实现强一致的复制模式，
+// 所有写操作先提交到 raft 日志，多数节点确认并应用到本地之后才返回。
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/vfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DefaultTimeout 写操作等待提交的默认超时时间
+const DefaultTimeout = 5 * time.Second
+
+// rlog raft 模块日志记录器
+var rlog = clog.Module("raft")
+
+// Peer 是 raft 集群中的一个节点，Addr 为 raft 通信地址，HTTP 为数据接口地址
+type Peer struct {
+	ID   string
+	Addr string
+	HTTP string
+}
+
+type Options struct {
+	// ID 为本节点在 Peers 中的 ID
+	ID string
+	// Bind 为 raft 通信监听的地址，为空时使用本节点的 Addr
+	Bind string
+	// Dir 保存 raft 日志和快照
+	Dir   string
+	Peers []Peer
+	// Timeout 为 0 时使用 DefaultTimeout
+	Timeout time.Duration
+	// SnapshotInterval 和 SnapshotThreshold 为 0 时使用 raft 的默认值
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+}
+
+// Node 是本地的 raft 节点，实现了 vfs.Replicator
+type Node struct {
+	id        string
+	raft      *raft.Raft
+	fsm       *fsm
+	store     *raftboltdb.BoltStore
+	transport *raft.NetworkTransport
+	peers     map[raft.ServerID]Peer
+	timeout   time.Duration
+}
+
+// Open 启动本地 raft 节点，第一次启动时使用 Peers 初始化集群，
+// 所有节点使用相同的 Peers 启动即可，不需要指定某个节点来初始化。
+func Open(fss *vfs.LogStructuredFS, opt *Options) (node *Node, err error) {
+	peers := make(map[raft.ServerID]Peer, len(opt.Peers))
+	servers := make([]raft.Server, 0, len(opt.Peers))
+	for _, peer := range opt.Peers {
+		peers[raft.ServerID(peer.ID)] = peer
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(peer.ID),
+			Address: raft.ServerAddress(peer.Addr),
+		})
+	}
+
+	self, ok := peers[raft.ServerID(opt.ID)]
+	if !ok {
+		return nil, fmt.Errorf("raft node %s is not one of the peers", opt.ID)
+	}
+
+	err = os.MkdirAll(opt.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %w", err)
+	}
+
+	node = &Node{id: opt.ID, peers: peers, timeout: opt.Timeout}
+	if node.timeout <= 0 {
+		node.timeout = DefaultTimeout
+	}
+
+	// 启动过程中任何一步失败都要释放已经打开的资源
+	defer func() {
+		if err != nil {
+			node.close()
+			node = nil
+		}
+	}()
+
+	node.fsm, err = newFSM(fss, filepath.Join(opt.Dir, "applied"))
+	if err != nil {
+		return
+	}
+
+	node.store, err = raftboltdb.NewBoltStore(filepath.Join(opt.Dir, "raft.db"))
+	if err != nil {
+		return node, fmt.Errorf("failed to open raft log store: %w", err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:        "raft",
+		Output:      logWriter{},
+		DisableTime: true,
+		Level:       hclog.Info,
+	})
+
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(opt.Dir, 2, logger)
+	if err != nil {
+		return node, fmt.Errorf("failed to open raft snapshot store: %w", err)
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", self.Addr)
+	if err != nil {
+		return node, fmt.Errorf("failed to resolve raft address: %w", err)
+	}
+
+	bind := opt.Bind
+	if bind == "" {
+		bind = self.Addr
+	}
+	node.transport, err = raft.NewTCPTransportWithLogger(bind, advertise, 3, 10*time.Second, logger)
+	if err != nil {
+		return node, fmt.Errorf("failed to listen raft transport: %w", err)
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(opt.ID)
+	config.Logger = logger
+	// vfs 的数据重启之后还在，不需要从快照恢复，只需要重放快照之后的日志
+	config.NoSnapshotRestoreOnStart = true
+	if opt.SnapshotInterval > 0 {
+		config.SnapshotInterval = opt.SnapshotInterval
+	}
+	if opt.SnapshotThreshold > 0 {
+		config.SnapshotThreshold = opt.SnapshotThreshold
+	}
+
+	existing, err := raft.HasExistingState(node.store, node.store, snapshots)
+	if err != nil {
+		return node, fmt.Errorf("failed to check raft state: %w", err)
+	}
+
+	node.raft, err = raft.NewRaft(config, node.fsm, node.store, node.store, snapshots, node.transport)
+	if err != nil {
+		return node, fmt.Errorf("failed to start raft node: %w", err)
+	}
+
+	if !existing {
+		err = node.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			return node, fmt.Errorf("failed to bootstrap raft cluster: %w", err)
+		}
+		err = nil
+	}
+
+	return node, nil
+}
+
+// Replicate 把写操作提交到 raft 日志，等待本地应用之后返回写操作的结果，
+// 只有 leader 可以提交，ctx 的截止时间优先于默认的超时时间
+func (n *Node) Replicate(ctx context.Context, op *vfs.Operation) error {
+	timeout := n.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	data, err := msgpack.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("failed to encode replicated operation: %w", err)
+	}
+
+	future := n.raft.Apply(data, timeout)
+	err = future.Error()
+	if err != nil {
+		return err
+	}
+
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// ID 返回本节点的 ID
+func (n *Node) ID() string {
+	return n.id
+}
+
+// IsLeader 返回本节点当前是否为 leader
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader 返回当前 leader 节点，还没有选举出 leader 时 ok 为 false
+func (n *Node) Leader() (peer Peer, ok bool) {
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return Peer{}, false
+	}
+	peer, ok = n.peers[id]
+	return peer, ok
+}
+
+// State 返回本节点的 raft 状态，例如 Leader、Follower 和 Candidate
+func (n *Node) State() string {
+	return n.raft.State().String()
+}
+
+// AppliedIndex 返回已经应用到本地存储的最后一条日志的索引，Replicate 在日志应用之后才返回，
+// 所以 leader 上已经确认的写入都不超过这个索引。follower 的 AppliedIndex 不小于 leader 在某个时刻返回的索引时，
+// follower 的数据至少和 leader 在那个时刻一样新
+func (n *Node) AppliedIndex() uint64 {
+	return n.raft.AppliedIndex()
+}
+
+// Lag 返回已经提交但是还没有应用到本地的日志数量。follower 的提交索引只在收到日志时更新，
+// 心跳不会更新，所以 Lag 为 0 并不表示 follower 追上了 leader，有界过期的读取需要比较 leader 返回的 AppliedIndex
+func (n *Node) Lag() uint64 {
+	commit, err := strconv.ParseUint(n.raft.Stats()["commit_index"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	if applied := n.raft.AppliedIndex(); commit > applied {
+		return commit - applied
+	}
+	return 0
+}
+
+// Close 停止 raft 节点，需要在关闭文件系统之前调用
+func (n *Node) Close() error {
+	return n.close()
+}
+
+func (n *Node) close() error {
+	var errs []error
+	if n.raft != nil {
+		errs = append(errs, n.raft.Shutdown().Error())
+	}
+	if n.transport != nil {
+		errs = append(errs, n.transport.Close())
+	}
+	if n.store != nil {
+		errs = append(errs, n.store.Close())
+	}
+	if n.fsm != nil {
+		errs = append(errs, n.fsm.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// logWriter 把 raft 的日志按照级别输出到 clog
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimSpace(p)
+	switch {
+	case bytes.HasPrefix(line, []byte("[ERROR]")):
+		rlog.Error(string(bytes.TrimSpace(line[len("[ERROR]"):])))
+	case bytes.HasPrefix(line, []byte("[WARN]")):
+		rlog.Warn(string(bytes.TrimSpace(line[len("[WARN]"):])))
+	case bytes.HasPrefix(line, []byte("[DEBUG]")), bytes.HasPrefix(line, []byte("[TRACE]")):
+		rlog.Debug(string(bytes.TrimSpace(line[len("[DEBUG]"):])))
+	default:
+		rlog.Info(string(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("[INFO]")))))
+	}
+	return len(p), nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consensus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestSingleNode(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	opt := &Options{
+		ID:    "node-1",
+		Dir:   t.TempDir(),
+		Peers: []Peer{{ID: "node-1", Addr: freeAddr(t), HTTP: "127.0.0.1:2668"}},
+	}
+
+	open := func() *Node {
+		node, err := Open(fss, opt)
+		assert.NoError(t, err)
+		assert.Eventually(t, node.IsLeader, 10*time.Second, 50*time.Millisecond)
+		return node
+	}
+
+	node := open()
+	leader, ok := node.Leader()
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:2668", leader.HTTP)
+	assert.Equal(t, "Leader", node.State())
+	assert.Zero(t, node.Lag())
+
+	fss.SetReplicator(node)
+	put := func(key, content string) {
+		seg, err := vfs.NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	applied := node.AppliedIndex()
+	put("user:1", "hello")
+	put("user:2", "world")
+	// Replicate 在日志应用之后才返回
+	assert.Equal(t, applied+2, node.AppliedIndex())
+	assert.NoError(t, node.raft.Snapshot().Error())
+
+	// 快照之后的日志在重启时会重放，已经应用过的日志需要跳过
+	seg, err := vfs.NewSegment("user:1", types.NewText("again"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.UpdateSegmentWithCAS("user:1", 0, seg))
+	assert.NoError(t, fss.DeleteSegment("user:2"))
+	assert.NoError(t, node.Close())
+
+	node = open()
+	defer node.Close()
+	fss.SetReplicator(node)
+
+	// 等待重放完成之后再检查 CAS 没有被重复执行
+	put("user:3", "barrier")
+	version, seg, err := fss.FetchSegment("user:1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version)
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "again", text.Content)
+
+	_, _, err = fss.FetchSegment("user:2")
+	assert.Error(t, err)
+	assert.Equal(t, 2, fss.KeysCount())
+}
@@ -0,0 +1,17 @@
+#!/bin/sh
+set -e
+
+# URNADB_VOLUME 是挂载的数据卷，第一次使用空的数据卷启动时生成配置、访问密码和加密密钥
+URNADB_VOLUME=${URNADB_VOLUME:-/tmp/urnadb}
+
+# 没有参数或者参数是选项时启动服务器，否则执行传入的命令，例如 urnadb validate
+if [ $# -eq 0 ] || [ "${1#-}" != "$1" ]; then
+    urnadb init --path "$URNADB_VOLUME"
+    # 已有数据但是没有配置文件的数据卷继续使用默认配置启动
+    if [ -f "$URNADB_VOLUME/config.yaml" ]; then
+        set -- --config "$URNADB_VOLUME/config.yaml" "$@"
+    fi
+    set -- urnadb "$@"
+fi
+
+exec "$@"
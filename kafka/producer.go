@@ -0,0 +1,388 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka 实现 Kafka 生产者协议的最小子集，用于把写入同步到 Kafka topic。
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	// 响应大小的上限，超过时认为连接的不是 Kafka broker
+	maxResponseSize = 64 << 20
+)
+
+// Options 是生产者的连接配置，Brokers 是用于获取集群元数据的初始 broker 地址，
+// Timeout 是每个请求等待 broker 响应的时间，也是 broker 等待副本确认的时间
+type Options struct {
+	Brokers  []string
+	ClientID string
+	Timeout  time.Duration
+}
+
+// Producer 按照 key 的哈希把消息发送到分区的 leader，等待全部同步副本确认（acks=all）之后才返回，
+// 失败时整批消息都需要重新发送，已经写入的分区会产生重复的消息。Producer 可以被多个 goroutine 并发使用，
+// 请求按照顺序发送
+type Producer struct {
+	opt         Options
+	mu          sync.Mutex
+	correlation int32
+	// brokers 是 node id 到地址的映射，topics 是每个分区的 leader，下标为分区编号
+	brokers map[int32]string
+	topics  map[string][]int32
+	conns   map[string]*conn
+}
+
+// NewProducer 创建生产者，第一次发送消息时才会连接 broker
+func NewProducer(opt Options) (*Producer, error) {
+	if len(opt.Brokers) == 0 {
+		return nil, errors.New("kafka brokers cannot be empty")
+	}
+	for _, addr := range opt.Brokers {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kafka broker address %q: %w", addr, err)
+		}
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultTimeout
+	}
+
+	return &Producer{
+		opt:     opt,
+		brokers: make(map[int32]string),
+		topics:  make(map[string][]int32),
+		conns:   make(map[string]*conn),
+	}, nil
+}
+
+// Produce 把 msgs 发送到 topic，同一个分区的消息保持 msgs 中的顺序
+func (p *Producer) Produce(ctx context.Context, topic string, msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	leaders, ok := p.topics[topic]
+	if !ok {
+		err := p.refreshMetadata(ctx, topic)
+		if err != nil {
+			return err
+		}
+		leaders = p.topics[topic]
+	}
+
+	batches := make(map[int32][]Message)
+	for _, msg := range msgs {
+		partition := partitionFor(msg.Key, len(leaders))
+		batches[partition] = append(batches[partition], msg)
+	}
+
+	nodes := make(map[int32][]int32)
+	for partition := range batches {
+		leader := leaders[partition]
+		nodes[leader] = append(nodes[leader], partition)
+	}
+
+	for leader, partitions := range nodes {
+		err := p.produce(ctx, leader, topic, partitions, batches)
+		if err != nil {
+			// leader 可能已经切换，下一次发送之前重新获取元数据
+			delete(p.topics, topic)
+			return err
+		}
+	}
+	return nil
+}
+
+// produce 把 partitions 的消息发送给它们共同的 leader
+func (p *Producer) produce(ctx context.Context, leader int32, topic string, partitions []int32, batches map[int32][]Message) error {
+	addr, ok := p.brokers[leader]
+	if !ok {
+		return fmt.Errorf("kafka: unknown leader broker %d", leader)
+	}
+
+	e := &encoder{}
+	// transactional_id
+	e.nullableString("")
+	// acks=all
+	e.int16(-1)
+	e.int32(int32(p.opt.Timeout / time.Millisecond))
+	e.int32(1)
+	e.string(topic)
+	e.int32(int32(len(partitions)))
+	for _, partition := range partitions {
+		e.int32(partition)
+		e.bytes(encodeRecordBatch(batches[partition]))
+	}
+
+	d, err := p.roundTrip(ctx, addr, apiProduce, produceVersion, e.buf)
+	if err != nil {
+		return err
+	}
+
+	acked := 0
+	for i, topics := 0, d.arrayLen(); i < topics; i++ {
+		name := d.string()
+		for j, n := 0, d.arrayLen(); j < n; j++ {
+			partition := d.int32()
+			code := d.int16()
+			// base_offset 和 log_append_time
+			d.int64()
+			d.int64()
+			if d.err != nil {
+				break
+			}
+			if code != errNone {
+				return &Error{Code: code, Topic: name, Partition: partition}
+			}
+			acked++
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if acked != len(partitions) {
+		return errMalformedResponse
+	}
+	return nil
+}
+
+// refreshMetadata 从任意一个可以连接的 broker 获取 topic 的分区和 leader
+func (p *Producer) refreshMetadata(ctx context.Context, topic string) error {
+	e := &encoder{}
+	e.int32(1)
+	e.string(topic)
+
+	// 先尝试配置的 broker，集群扩容之后这些地址可能已经下线
+	addrs := append([]string(nil), p.opt.Brokers...)
+	for _, addr := range p.brokers {
+		addrs = append(addrs, addr)
+	}
+
+	var err error
+	for _, addr := range addrs {
+		var d *decoder
+		d, err = p.roundTrip(ctx, addr, apiMetadata, metadataVersion, e.buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			continue
+		}
+		return p.parseMetadata(d, topic)
+	}
+	return fmt.Errorf("kafka: no broker is reachable: %w", err)
+}
+
+func (p *Producer) parseMetadata(d *decoder, topic string) error {
+	brokers := make(map[int32]string)
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		// rack
+		d.string()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	// controller_id
+	d.int32()
+
+	var leaders []int32
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := d.int16()
+		name := d.string()
+		// is_internal
+		d.int8()
+
+		partitions := d.arrayLen()
+		current := make([]int32, partitions)
+		for j := 0; j < partitions; j++ {
+			// 分区的错误码和 leader 为 -1 时都表示没有可用的 leader
+			d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			for k, replicas := 0, d.arrayLen(); k < replicas; k++ {
+				d.int32()
+			}
+			for k, isr := 0, d.arrayLen(); k < isr; k++ {
+				d.int32()
+			}
+			if d.err != nil {
+				return d.err
+			}
+			if partition < 0 || int(partition) >= partitions {
+				return errMalformedResponse
+			}
+			current[partition] = leader
+		}
+
+		if d.err != nil {
+			return d.err
+		}
+		if name != topic {
+			continue
+		}
+		if code != errNone {
+			return &Error{Code: code, Topic: topic, Partition: -1}
+		}
+		if partitions == 0 {
+			return &Error{Code: errUnknownTopicOrPartition, Topic: topic, Partition: -1}
+		}
+		for partition, leader := range current {
+			if _, ok := brokers[leader]; !ok {
+				return &Error{Code: errLeaderNotAvailable, Topic: topic, Partition: int32(partition)}
+			}
+		}
+		leaders = current
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if leaders == nil {
+		return &Error{Code: errUnknownTopicOrPartition, Topic: topic, Partition: -1}
+	}
+
+	p.brokers = brokers
+	p.topics[topic] = leaders
+	return nil
+}
+
+// roundTrip 发送一个请求并且读取响应，出错时关闭连接，下一次请求重新连接
+func (p *Producer) roundTrip(ctx context.Context, addr string, api, version int16, body []byte) (*decoder, error) {
+	c, err := p.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.correlation++
+	payload, err := c.roundTrip(ctx, p.opt.Timeout, p.correlation, api, version, p.opt.ClientID, body)
+	if err != nil {
+		c.Close()
+		delete(p.conns, addr)
+		return nil, err
+	}
+	return &decoder{buf: payload}, nil
+}
+
+func (p *Producer) dial(ctx context.Context, addr string) (*conn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+
+	dialer := net.Dialer{Timeout: p.opt.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	p.conns[addr] = c
+	return c, nil
+}
+
+// Close 关闭所有 broker 连接
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for addr, c := range p.conns {
+		errs = append(errs, c.Close())
+		delete(p.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) roundTrip(ctx context.Context, timeout time.Duration, correlation int32, api, version int16, clientID string, body []byte) ([]byte, error) {
+	// broker 等待副本确认最多 timeout，再留出网络传输的时间
+	deadline := time.Now().Add(2 * timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err := c.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	// 取消 ctx 时让阻塞的读写立即返回
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	payload, err := c.exchange(correlation, api, version, clientID, body)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return payload, err
+}
+
+func (c *conn) exchange(correlation int32, api, version int16, clientID string, body []byte) ([]byte, error) {
+	e := &encoder{buf: make([]byte, 0, 32+len(body))}
+	size := e.reserve()
+	e.int16(api)
+	e.int16(version)
+	e.int32(correlation)
+	e.nullableString(clientID)
+	e.buf = append(e.buf, body...)
+	e.fill(size)
+
+	_, err := c.Write(e.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	_, err = io.ReadFull(c.r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 4 || n > maxResponseSize {
+		return nil, errMalformedResponse
+	}
+	if int32(binary.BigEndian.Uint32(header[4:])) != correlation {
+		return nil, errors.New("kafka: response correlation id mismatch")
+	}
+
+	payload := make([]byte, n-4)
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
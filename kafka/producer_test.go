@@ -0,0 +1,287 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur2(t *testing.T) {
+	// Kafka Java 客户端 UtilsTest 中的测试数据
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, want := range cases {
+		assert.Equal(t, want, murmur2([]byte(key)), key)
+	}
+}
+
+// fakeBroker 是只有一个节点的 Kafka 集群，topic 有 partitions 个分区，leader 都是自己
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	partitions int32
+
+	mu sync.Mutex
+	// notLeader 大于 0 时 Produce 返回 NOT_LEADER_FOR_PARTITION 并减一
+	notLeader int
+	lookups   int
+	messages  map[int32][]Message
+}
+
+func newFakeBroker(t *testing.T, partitions int32) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	b := &fakeBroker{t: t, ln: ln, partitions: partitions, messages: make(map[int32][]Message)}
+	go b.serve()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		c, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(c)
+	}
+}
+
+func (b *fakeBroker) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		d := &decoder{buf: req}
+		api, version, correlation := d.int16(), d.int16(), d.int32()
+		d.string()
+
+		e := &encoder{}
+		n := e.reserve()
+		e.int32(correlation)
+		switch {
+		case api == apiMetadata && version == metadataVersion:
+			b.metadata(d, e)
+		case api == apiProduce && version == produceVersion:
+			b.produce(d, e)
+		default:
+			b.t.Errorf("unexpected api %d version %d", api, version)
+			return
+		}
+		assert.NoError(b.t, d.err)
+		e.fill(n)
+		if _, err := c.Write(e.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) metadata(d *decoder, e *encoder) {
+	topics := make([]string, d.arrayLen())
+	for i := range topics {
+		topics[i] = d.string()
+	}
+
+	b.mu.Lock()
+	b.lookups++
+	b.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	e.int32(1)
+	e.int32(0)
+	e.string(host)
+	e.int32(int32(p))
+	e.nullableString("")
+	e.int32(0)
+
+	e.int32(int32(len(topics)))
+	for _, topic := range topics {
+		e.int16(errNone)
+		e.string(topic)
+		e.int8(0)
+		e.int32(b.partitions)
+		// 倒序返回分区，检查按照分区编号保存 leader
+		for i := b.partitions - 1; i >= 0; i-- {
+			e.int16(errNone)
+			e.int32(i)
+			e.int32(0)
+			e.int32(1)
+			e.int32(0)
+			e.int32(1)
+			e.int32(0)
+		}
+	}
+}
+
+func (b *fakeBroker) produce(d *decoder, e *encoder) {
+	d.string()
+	assert.Equal(b.t, int16(-1), d.int16())
+	d.int32()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := d.arrayLen()
+	e.int32(int32(topics))
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLen()
+		e.int32(int32(partitions))
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			batch := d.take(int(d.int32()))
+			code := errNone
+			if b.notLeader > 0 {
+				b.notLeader--
+				code = errNotLeaderForPartition
+			} else {
+				b.messages[partition] = append(b.messages[partition], b.decodeBatch(batch)...)
+			}
+			e.int32(partition)
+			e.int16(code)
+			e.int64(0)
+			e.int64(-1)
+		}
+	}
+	e.int32(0)
+}
+
+func (b *fakeBroker) decodeBatch(batch []byte) []Message {
+	d := &decoder{buf: batch}
+	d.int64()
+	assert.Equal(b.t, len(batch)-12, int(d.int32()))
+	d.int32()
+	assert.Equal(b.t, recordBatchMagic, d.int8())
+	crc := uint32(d.int32())
+	assert.Equal(b.t, crc32.Checksum(d.buf, castagnoli), crc)
+	d.int16()
+	d.int32()
+	first := d.int64()
+	d.int64()
+	d.int64()
+	d.int16()
+	d.int32()
+
+	varint := func() int64 {
+		v, n := binary.Varint(d.buf)
+		d.take(n)
+		return v
+	}
+
+	msgs := make([]Message, d.int32())
+	for i := range msgs {
+		varint()
+		d.int8()
+		ts := varint()
+		assert.Equal(b.t, int64(i), varint())
+		msgs[i].Key = d.take(int(varint()))
+		msgs[i].Value = d.take(int(varint()))
+		assert.Equal(b.t, int64(0), varint())
+		msgs[i].Time = time.UnixMilli(first + ts)
+	}
+	assert.NoError(b.t, d.err)
+	assert.Empty(b.t, d.buf)
+	return msgs
+}
+
+func TestProducer(t *testing.T) {
+	broker := newFakeBroker(t, 3)
+	p, err := NewProducer(Options{Brokers: []string{broker.ln.Addr().String()}, ClientID: "urnadb"})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	now := time.UnixMilli(time.Now().UnixMilli())
+	var msgs []Message
+	for i := 0; i < 20; i++ {
+		key := []byte("user:" + strconv.Itoa(i%5))
+		msgs = append(msgs, Message{Key: key, Value: []byte(strconv.Itoa(i)), Time: now.Add(time.Duration(i) * time.Millisecond)})
+	}
+	assert.NoError(t, p.Produce(context.Background(), "changes", msgs))
+	assert.NoError(t, p.Produce(context.Background(), "changes", nil))
+
+	broker.mu.Lock()
+	total := 0
+	for partition, received := range broker.messages {
+		last := map[string]int{}
+		for _, msg := range received {
+			assert.Equal(t, partition, partitionFor(msg.Key, 3))
+			// 同一个 key 的消息保持发送的顺序
+			i, _ := strconv.Atoi(string(msg.Value))
+			if prev, ok := last[string(msg.Key)]; ok {
+				assert.Less(t, prev, i)
+			}
+			last[string(msg.Key)] = i
+			assert.Equal(t, now.Add(time.Duration(i)*time.Millisecond), msg.Time)
+		}
+		total += len(received)
+	}
+	assert.Equal(t, 20, total)
+	assert.Equal(t, 1, broker.lookups)
+	broker.notLeader = 1
+	broker.mu.Unlock()
+
+	// leader 切换之后返回可以重试的错误，重试之前重新获取元数据
+	err = p.Produce(context.Background(), "changes", msgs[:1])
+	var kerr *Error
+	assert.ErrorAs(t, err, &kerr)
+	assert.True(t, kerr.Retriable())
+	assert.NoError(t, p.Produce(context.Background(), "changes", msgs[:1]))
+
+	broker.mu.Lock()
+	assert.Equal(t, 2, broker.lookups)
+	broker.mu.Unlock()
+}
+
+func TestProducerUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p, err := NewProducer(Options{Brokers: []string{addr}, Timeout: time.Second})
+	assert.NoError(t, err)
+	err = p.Produce(context.Background(), "changes", []Message{{Key: []byte("a"), Time: time.Now()}})
+	assert.ErrorContains(t, err, "no broker is reachable")
+
+	_, err = NewProducer(Options{})
+	assert.Error(t, err)
+	_, err = NewProducer(Options{Brokers: []string{"localhost"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,311 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// 只实现生产者需要的 Metadata v1 和 Produce v3 两个请求，Produce v3 是第一个使用 v2 RecordBatch 的版本，
+// Kafka 0.11 之后的 broker 都支持
+const (
+	apiProduce  int16 = 0
+	apiMetadata int16 = 3
+
+	produceVersion  int16 = 3
+	metadataVersion int16 = 1
+
+	recordBatchMagic int8 = 2
+)
+
+// broker 返回的错误码，只列出需要区分处理的
+const (
+	errNone                    int16 = 0
+	errUnknownTopicOrPartition int16 = 3
+	errLeaderNotAvailable      int16 = 5
+	errNotLeaderForPartition   int16 = 6
+	errRequestTimedOut         int16 = 7
+	errNotEnoughReplicas       int16 = 19
+	errNotEnoughReplicasAfter  int16 = 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errMalformedResponse = errors.New("kafka: malformed response")
+
+// Error 是 broker 返回的错误码
+type Error struct {
+	Code      int16
+	Topic     string
+	Partition int32
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kafka: broker returned error code %d for %s/%d", e.Code, e.Topic, e.Partition)
+}
+
+// Retriable 返回刷新元数据之后重新发送是否可能成功，例如分区的 leader 发生了切换
+func (e *Error) Retriable() bool {
+	switch e.Code {
+	case errUnknownTopicOrPartition, errLeaderNotAvailable, errNotLeaderForPartition,
+		errRequestTimedOut, errNotEnoughReplicas, errNotEnoughReplicasAfter:
+		return true
+	}
+	return false
+}
+
+// encoder 按照 Kafka 协议的大端序编码请求
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// nullableString 编码可以为 null 的字符串，空字符串编码为 null
+func (e *encoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// varbytes 编码 record 中的 key 和 value，nil 编码为 null
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// reserve 预留 4 字节的长度，返回的位置交给 fill 填写
+func (e *encoder) reserve() int {
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	return len(e.buf)
+}
+
+// fill 填写从 reserve 返回的位置到当前位置的字节数
+func (e *encoder) fill(pos int) {
+	binary.BigEndian.PutUint32(e.buf[pos-4:pos], uint32(len(e.buf)-pos))
+}
+
+// decoder 解码响应，读取越界时记录错误，之后的读取都返回零值
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errMalformedResponse
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (d *decoder) int16() int16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (d *decoder) int32() int32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (d *decoder) int64() int64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// arrayLen 返回数组的长度，null 数组返回 0，每个元素至少占一个字节，用于拒绝明显错误的长度
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		d.err = errMalformedResponse
+		return 0
+	}
+	return int(n)
+}
+
+// Message 是发送到 topic 的一条消息，相同 Key 的消息写入同一个分区
+type Message struct {
+	Key   []byte
+	Value []byte
+	Time  time.Time
+}
+
+// encodeRecordBatch 把消息编码为 v2 RecordBatch，不压缩，不使用幂等生产者
+func encodeRecordBatch(msgs []Message) []byte {
+	first, last := msgs[0].Time.UnixMilli(), msgs[0].Time.UnixMilli()
+	for _, msg := range msgs {
+		ts := msg.Time.UnixMilli()
+		if ts < first {
+			first = ts
+		}
+		if ts > last {
+			last = ts
+		}
+	}
+
+	e := &encoder{buf: make([]byte, 0, 64)}
+	// baseOffset 由 broker 分配
+	e.int64(0)
+	length := e.reserve()
+	// partitionLeaderEpoch
+	e.int32(-1)
+	e.int8(recordBatchMagic)
+	crc := e.reserve()
+	// attributes：不压缩，CreateTime 时间戳
+	e.int16(0)
+	e.int32(int32(len(msgs) - 1))
+	e.int64(first)
+	e.int64(last)
+	// producerId、producerEpoch 和 baseSequence 为 -1 表示不使用幂等生产者
+	e.int64(-1)
+	e.int16(-1)
+	e.int32(-1)
+	e.int32(int32(len(msgs)))
+
+	record := &encoder{}
+	for i, msg := range msgs {
+		record.buf = record.buf[:0]
+		// attributes
+		record.int8(0)
+		record.varint(msg.Time.UnixMilli() - first)
+		record.varint(int64(i))
+		record.varbytes(msg.Key)
+		record.varbytes(msg.Value)
+		// headers
+		record.varint(0)
+
+		e.varint(int64(len(record.buf)))
+		e.buf = append(e.buf, record.buf...)
+	}
+
+	e.fill(length)
+	binary.BigEndian.PutUint32(e.buf[crc-4:crc], crc32.Checksum(e.buf[crc:], castagnoli))
+	return e.buf
+}
+
+// murmur2 和 Java 客户端默认分区器使用的哈希算法相同，相同的 key 和其他客户端写入同一个分区
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// partitionFor 返回 key 所在的分区，和 Java 客户端一样取哈希值的低 31 位
+func partitionFor(key []byte, partitions int) int32 {
+	return int32((murmur2(key) & 0x7fffffff) % int32(partitions))
+}
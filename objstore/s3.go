@@ -0,0 +1,323 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package objstore 实现 S3 兼容的对象存储客户端，用于冷数据分层和持续备份。
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+)
+
+const (
+	// DefaultPartSize 超过这个大小的对象使用分片上传，S3 单次 PUT 的上限是 5GB
+	DefaultPartSize = 64 << 20
+	defaultRegion   = "us-east-1"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Options 是 S3 兼容存储的连接配置，Endpoint 例如 https://s3.us-east-1.amazonaws.com
+// 或者 http://127.0.0.1:9000，使用 path-style 地址访问 Bucket，对象名称加上 Prefix
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PartSize  int64
+}
+
+// S3 使用 AWS Signature Version 4 签名请求，可以被多个 goroutine 并发使用
+type S3 struct {
+	opt      S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+var _ vfs.ObjectStore = (*S3)(nil)
+
+// NewS3 创建 S3 客户端，不会检查 Bucket 是否存在
+func NewS3(opt S3Options) (*S3, error) {
+	endpoint, err := url.Parse(opt.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q must be an http or https url", opt.Endpoint)
+	}
+	if opt.Bucket == "" {
+		return nil, errors.New("s3 bucket cannot be empty")
+	}
+	if opt.Region == "" {
+		opt.Region = defaultRegion
+	}
+	if opt.PartSize <= 0 {
+		opt.PartSize = DefaultPartSize
+	}
+
+	return &S3{
+		opt:      opt,
+		endpoint: endpoint,
+		// region 文件很大，超时由调用方的 context 控制
+		client: &http.Client{},
+	}, nil
+}
+
+// Upload 上传大小为 size 的对象，超过 PartSize 时使用分片上传
+func (s *S3) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	if size <= s.opt.PartSize {
+		resp, err := s.do(ctx, http.MethodPut, s.objectURL(name, nil), r, size, unsignedPayload)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return s.uploadParts(ctx, name, r, size)
+}
+
+// Download 返回对象的内容，调用方需要关闭，对象不存在时返回 vfs.ErrObjectNotFound
+func (s *S3) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(name, nil), nil, 0, emptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Remove 删除对象，对象不存在时不返回错误
+func (s *S3) Remove(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(name, nil), nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+// uploadParts 按照 PartSize 顺序上传分片，失败时取消分片上传，避免对象存储保留不完整的分片
+func (s *S3) uploadParts(ctx context.Context, name string, r io.Reader, size int64) (err error) {
+	resp, err := s.do(ctx, http.MethodPost, s.objectURL(name, url.Values{"uploads": {""}}), nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode multipart upload: %w", err)
+	}
+
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+	defer func() {
+		if err != nil {
+			resp, inner := s.do(context.Background(), http.MethodDelete, s.objectURL(name, upload), nil, 0, emptyPayload)
+			if inner == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var parts []completePart
+	for offset, number := int64(0), 1; offset < size; number++ {
+		n := s.opt.PartSize
+		if size-offset < n {
+			n = size - offset
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, s.objectURL(name, query), io.LimitReader(r, n), n, unsignedPayload)
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", number, err)
+		}
+		resp.Body.Close()
+
+		parts = append(parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		offset += n
+	}
+
+	body, err := xml.Marshal(completeUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	resp, err = s.do(ctx, http.MethodPost, s.objectURL(name, upload), bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 完成分片上传的请求可能返回 200 但是响应内容是错误
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete multipart upload: %s", data)
+	}
+	return nil
+}
+
+func (s *S3) objectURL(name string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.opt.Bucket + "/" + s.opt.Prefix + name
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do 签名并且发送请求，响应状态码不是 2xx 时返回错误，404 时包装 vfs.ErrObjectNotFound
+func (s *S3) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("s3 %s %s: %w: %s", method, u.Path, vfs.ErrObjectNotFound, bytes.TrimSpace(msg))
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// sign 按照 AWS Signature Version 4 计算 Authorization 请求头
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.opt.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opt.SecretKey), date)
+	key = hmacSHA256(key, s.opt.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opt.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery 按照签名要求排序和编码查询参数，同时用作发送的查询字符串
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode 只保留 RFC 3986 的非保留字符，encodeSlash 为 false 时保留路径中的 /
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
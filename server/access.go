@@ -0,0 +1,181 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// requestIDHeader 是请求 ID 的请求头和响应头，客户端没有携带时由服务器生成
+	requestIDHeader = "X-Request-ID"
+	// 客户端携带的请求 ID 超过这个长度或者包含其他字符时重新生成
+	maxRequestIDSize = 128
+	// requestIDKey 和 credentialKey 是保存在 gin.Context 中的请求 ID 和认证方式
+	requestIDKey  = "urnadb.request_id"
+	credentialKey = "urnadb.credential"
+)
+
+var (
+	// alog 访问日志记录器，可以通过 log.modules 单独设置 access 模块的级别
+	alog = clog.Module("access")
+
+	accessLog struct {
+		enable atomic.Bool
+		// sample 是 float64 的位表示
+		sample atomic.Uint64
+	}
+)
+
+// setAccessLog 开启或者关闭访问日志，sample 是成功的请求写入访问日志的比例
+func setAccessLog(enable bool, sample float64) {
+	accessLog.sample.Store(math.Float64bits(sample))
+	accessLog.enable.Store(enable)
+}
+
+// validRequestID 检查客户端携带的请求 ID，只允许可见的 ASCII 字母、数字和部分分隔符，避免伪造日志内容
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDSize {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID 生成 32 个十六进制字符的随机请求 ID
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDMiddleware 为每个请求分配请求 ID，写入响应头并传递给集群转发和 pipeline 子请求，
+// 请求处理完成之后写入访问日志
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			c.Request.Header.Set(requestIDHeader, id)
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		if accessLog.enable.Load() {
+			logAccess(c, time.Since(start))
+		}
+	}
+}
+
+// requestID 返回请求 ID，没有经过 requestIDMiddleware 的请求返回空字符串
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// requestLog 返回带有请求 ID 的日志记录器，处理请求时输出的日志都应该使用这个记录器
+func requestLog(c *gin.Context) *clog.Logger {
+	if id := requestID(c); id != "" {
+		return slog.With("request_id", id)
+	}
+	return slog
+}
+
+// setCredential 记录请求使用的认证方式，会话令牌使用令牌的指纹区分，访问日志中不会出现密码和令牌
+func setCredential(c *gin.Context, kind, token string) {
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		kind += ":" + hex.EncodeToString(sum[:4])
+	}
+	c.Set(credentialKey, kind)
+}
+
+// accessEntry 是访问日志中的一行，Token 是认证方式和会话令牌的指纹
+type accessEntry struct {
+	RequestID string
+	Method    string
+	Path      string
+	Status    int
+	Latency   time.Duration
+	Bytes     int
+	ClientIP  string
+	Token     string
+}
+
+// writeAccess 输出一行访问日志，JSON 格式下每个字段都是顶层字段
+var writeAccess = func(e accessEntry) {
+	alog.With("request_id", e.RequestID).
+		With("method", e.Method).
+		With("path", e.Path).
+		With("status", e.Status).
+		With("latency_ms", float64(e.Latency.Microseconds())/1000).
+		With("bytes", e.Bytes).
+		With("client_ip", e.ClientIP).
+		With("token", e.Token).
+		Info("request")
+}
+
+// logAccess 写入一行访问日志，失败的请求总是写入，成功的请求按照比例采样
+func logAccess(c *gin.Context, latency time.Duration) {
+	status := c.Writer.Status()
+	if status < http.StatusBadRequest {
+		sample := math.Float64frombits(accessLog.sample.Load())
+		if sample < 1 && mrand.Float64() >= sample {
+			return
+		}
+	}
+
+	e := accessEntry{
+		RequestID: requestID(c),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Status:    status,
+		Latency:   latency,
+		Bytes:     c.Writer.Size(),
+		ClientIP:  clientOrigin(c),
+		Token:     c.GetString(credentialKey),
+	}
+	if e.Bytes < 0 {
+		e.Bytes = 0
+	}
+	if localConn(c) {
+		e.ClientIP = "unix"
+	}
+	if e.Token == "" {
+		e.Token = "-"
+	}
+	writeAccess(e)
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, validRequestID("0f8fad5b-d9cb-469f-a165-70867728950e"))
+	assert.True(t, validRequestID("client_1.retry:2"))
+	assert.False(t, validRequestID(""))
+	assert.False(t, validRequestID("id with spaces"))
+	assert.False(t, validRequestID("id\nstatus=200"))
+	assert.False(t, validRequestID(strings.Repeat("a", maxRequestIDSize+1)))
+
+	id := newRequestID()
+	assert.Len(t, id, 32)
+	assert.True(t, validRequestID(id))
+	assert.NotEqual(t, id, newRequestID())
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	request := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	// 客户端携带的请求 ID 原样返回，不合法的请求 ID 重新生成
+	w := request("client-request-1")
+	assert.Equal(t, "client-request-1", w.Header().Get(requestIDHeader))
+
+	w = request("bad id")
+	assert.Len(t, w.Header().Get(requestIDHeader), 32)
+
+	w = request("")
+	assert.Len(t, w.Header().Get(requestIDHeader), 32)
+}
+
+func TestAccessLog(t *testing.T) {
+	wasReady := ready.Load()
+	ready.Store(true)
+
+	var entries []accessEntry
+	write := writeAccess
+	writeAccess = func(e accessEntry) {
+		entries = append(entries, e)
+	}
+	defer func() {
+		ready.Store(wasReady)
+		writeAccess = write
+		setAccessLog(false, 1)
+	}()
+
+	request := func(path, auth string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(requestIDHeader, "access-"+auth)
+		if auth != "" {
+			req.Header.Set("Auth-Token", auth)
+		}
+		req.RemoteAddr = "192.0.2.7:5000"
+		root.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// 关闭时不写入访问日志
+	request("/admin/allowlist", authPassword)
+	assert.Empty(t, entries)
+
+	// 采样比例为 0 时只写入失败的请求
+	setAccessLog(true, 0)
+	request("/admin/allowlist", authPassword)
+	request("/admin/allowlist", "wrong")
+	require.Len(t, entries, 1)
+	e := entries[0]
+	assert.Equal(t, "access-wrong", e.RequestID)
+	assert.Equal(t, http.MethodGet, e.Method)
+	assert.Equal(t, "/admin/allowlist", e.Path)
+	assert.Equal(t, http.StatusUnauthorized, e.Status)
+	assert.Equal(t, "192.0.2.7", e.ClientIP)
+	assert.Equal(t, "-", e.Token)
+	assert.Positive(t, e.Bytes)
+
+	// 日志中只有认证方式，不会出现密码
+	setAccessLog(true, 1)
+	request("/admin/allowlist", authPassword)
+	require.Len(t, entries, 2)
+	assert.Equal(t, http.StatusOK, entries[1].Status)
+	assert.Equal(t, "auth", entries[1].Token)
+}
+
+func TestSetCredential(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	setCredential(c, "session", "eyJhbGciOiJIUzI1NiJ9.payload.signature")
+	token := c.GetString(credentialKey)
+	assert.True(t, strings.HasPrefix(token, "session:"))
+	assert.Len(t, token, len("session:")+8)
+	assert.NotContains(t, token, "eyJ")
+}
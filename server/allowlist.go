@@ -0,0 +1,223 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/gin-gonic/gin"
+)
+
+// 最多单独统计的被拒绝的客户端地址个数，超过之后只增加总数
+const maxRejectedOrigins = 1024
+
+// allowList 是编译之后的白名单，IP 地址使用规范化的字符串比较，CIDR 网段逐个匹配
+type allowList struct {
+	entries []string
+	ips     map[string]bool
+	nets    []*net.IPNet
+}
+
+// 白名单在运行期间可以通过 /admin/allowlist 替换，为空时不开启
+var allowIPs atomic.Pointer[allowList]
+
+type rejectedOrigin struct {
+	IP    string    `json:"ip"`
+	Count uint64    `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// rejections 统计被白名单拒绝的请求
+var rejections struct {
+	mu      sync.Mutex
+	total   uint64
+	origins map[string]*rejectedOrigin
+}
+
+// compileAllowList 解析白名单，既不是 IP 也不是 CIDR 的项按照原来的方式和客户端地址直接比较
+func compileAllowList(entries []string) *allowList {
+	list := &allowList{
+		entries: entries,
+		ips:     make(map[string]bool, len(entries)),
+	}
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			list.ips[ip.String()] = true
+		} else if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			list.nets = append(list.nets, ipnet)
+		} else {
+			list.ips[entry] = true
+		}
+	}
+	return list
+}
+
+func (l *allowList) allows(origin string) bool {
+	ip := net.ParseIP(origin)
+	if ip == nil {
+		return l.ips[origin]
+	}
+	if l.ips[ip.String()] {
+		return true
+	}
+	for _, ipnet := range l.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAllowList 检查白名单的每一项是 IP 地址或者 CIDR 网段
+func validateAllowList(entries []string) error {
+	return conf.AllowIPValidator{}.Validate(&conf.ServerOptions{AllowIP: entries})
+}
+
+func setAllowList(entries []string) {
+	if len(entries) == 0 {
+		allowIPs.Store(nil)
+		return
+	}
+	allowIPs.Store(compileAllowList(entries))
+}
+
+// clientOrigin 返回客户端地址，X-Forwarded-For 是代理链时使用第一个地址
+func clientOrigin(c *gin.Context) string {
+	ip := c.GetHeader("X-Forwarded-For")
+	if ip == "" {
+		ip = c.ClientIP()
+	}
+	ip = strings.TrimSpace(strings.Split(ip, ",")[0])
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// allowOrigin 检查客户端地址是否在白名单中，拒绝时记录次数
+func allowOrigin(c *gin.Context, origin string) bool {
+	list := allowIPs.Load()
+	if list == nil || list.allows(origin) {
+		return true
+	}
+
+	rejections.mu.Lock()
+	rejections.total++
+	count := rejections.total
+	if r, ok := rejections.origins[origin]; ok {
+		r.Count++
+		r.Last = time.Now()
+		count = r.Count
+	} else if len(rejections.origins) < maxRejectedOrigins {
+		if rejections.origins == nil {
+			rejections.origins = make(map[string]*rejectedOrigin)
+		}
+		rejections.origins[origin] = &rejectedOrigin{IP: origin, Count: 1, Last: time.Now()}
+		count = 1
+	}
+	rejections.mu.Unlock()
+
+	requestLog(c).Warnf("Rejected client IP %s not in the allowlist, %d rejections", origin, count)
+	return false
+}
+
+func rejectedTotal() uint64 {
+	rejections.mu.Lock()
+	defer rejections.mu.Unlock()
+	return rejections.total
+}
+
+// GetAllowListController 返回当前的白名单和被拒绝次数最多的客户端地址
+func GetAllowListController(ctx *gin.Context) {
+	entries := make([]string, 0)
+	if list := allowIPs.Load(); list != nil {
+		entries = list.entries
+	}
+
+	rejections.mu.Lock()
+	total := rejections.total
+	origins := make([]rejectedOrigin, 0, len(rejections.origins))
+	for _, r := range rejections.origins {
+		origins = append(origins, *r)
+	}
+	rejections.mu.Unlock()
+
+	sort.Slice(origins, func(i, j int) bool {
+		if origins[i].Count == origins[j].Count {
+			return origins[i].IP < origins[j].IP
+		}
+		return origins[i].Count > origins[j].Count
+	})
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"enabled":   len(entries) > 0,
+		"allowlist": entries,
+		"rejected":  total,
+		"origins":   origins,
+	})
+}
+
+// PutAllowListController 替换白名单，空列表关闭白名单。开启配置历史时作为 allowip 配置项的修改记录下来，
+// 新的白名单不包含当前客户端时需要 force=true，避免把自己挡在外面
+func PutAllowListController(ctx *gin.Context) {
+	var req struct {
+		AllowList []string `json:"allowlist"`
+	}
+	if err := bindBody(ctx, &req); err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	force, err := strconv.ParseBool(ctx.DefaultQuery("force", "false"))
+	if err == nil {
+		err = validateAllowList(req.AllowList)
+	}
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	if len(req.AllowList) == 0 {
+		req.AllowList = nil
+	} else if origin := clientOrigin(ctx); !force && !localConn(ctx) && !compileAllowList(req.AllowList).allows(origin) {
+		respondError(ctx, CodeConflict, fmt.Sprintf("allowlist does not include client IP %s, set force=true to apply it anyway.", origin))
+		return
+	}
+
+	if configs.history != nil {
+		next := configs.history.Current()
+		next.AllowIP = req.AllowList
+		_, err := configs.history.Apply(next, conf.SourceAdmin, configAuthor(ctx), configs.apply)
+		if err != nil && !errors.Is(err, conf.ErrNoChanges) {
+			configResponse(ctx, nil, err)
+			return
+		}
+	} else {
+		setAllowList(req.AllowList)
+	}
+
+	requestLog(ctx).Infof("Allowlist changed to %v by %s", req.AllowList, configAuthor(ctx))
+	GetAllowListController(ctx)
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowList(t *testing.T) {
+	list := compileAllowList([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "localhost"})
+	assert.True(t, list.allows("10.1.2.3"))
+	assert.True(t, list.allows("192.168.1.10"))
+	assert.True(t, list.allows("2001:db8::1"))
+	assert.True(t, list.allows("localhost"))
+	assert.False(t, list.allows("192.168.1.11"))
+	assert.False(t, list.allows("11.0.0.1"))
+
+	assert.NoError(t, validateAllowList([]string{"10.0.0.0/8", "::1"}))
+	assert.Error(t, validateAllowList([]string{"10.0.0.0/33"}))
+}
+
+func TestAllowListController(t *testing.T) {
+	wasReady := ready.Load()
+	ready.Store(true)
+	defer func() {
+		ready.Store(wasReady)
+		setAllowList(nil)
+		rejections.mu.Lock()
+		rejections.total, rejections.origins = 0, nil
+		rejections.mu.Unlock()
+	}()
+
+	request := func(method, path, origin, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", origin)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/admin/allowlist", "10.0.0.1", `{"allowlist": ["10.0.0.0/8", "bad"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 新的白名单不包含当前客户端
+	w = request(http.MethodPut, "/admin/allowlist", "192.168.1.1", `{"allowlist": ["10.0.0.0/8"]}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request(http.MethodPut, "/admin/allowlist", "10.0.0.1", `{"allowlist": ["10.0.0.0/8"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodGet, "/admin/allowlist", "10.20.30.40, 172.16.0.1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = request(http.MethodGet, "/admin/allowlist", "192.168.1.1:5000", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w = request(http.MethodGet, "/admin/allowlist", "172.16.0.1", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = request(http.MethodGet, "/admin/allowlist", "10.0.0.1", "")
+	var result struct {
+		Enabled   bool             `json:"enabled"`
+		AllowList []string         `json:"allowlist"`
+		Rejected  uint64           `json:"rejected"`
+		Origins   []rejectedOrigin `json:"origins"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.True(t, result.Enabled)
+	assert.Equal(t, []string{"10.0.0.0/8"}, result.AllowList)
+	assert.Equal(t, uint64(3), result.Rejected)
+	assert.Len(t, result.Origins, 2)
+	assert.Equal(t, "192.168.1.1", result.Origins[0].IP)
+	assert.Equal(t, uint64(2), result.Origins[0].Count)
+
+	w = request(http.MethodGet, "/metrics", "10.0.0.1", "")
+	assert.Contains(t, w.Body.String(), "urnadb_allowlist_rejected_total 3")
+
+	// force 可以应用不包含当前客户端的白名单，空列表关闭白名单
+	w = request(http.MethodPut, "/admin/allowlist?force=true", "10.0.0.1", `{"allowlist": ["127.0.0.1"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodGet, "/admin/allowlist", "10.0.0.1", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	setAllowList(nil)
+	w = request(http.MethodPut, "/admin/allowlist", "10.0.0.1", `{"allowlist": []}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"enabled": false`)
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultTopKeys = 10
+
+// 值大小分布的桶上界，按 4 倍递增，最后一个桶表示超过 1MB
+var sizeBuckets = []struct {
+	label string
+	limit uint32
+}{
+	{"64B", 64},
+	{"256B", 256},
+	{"1KB", 1 << 10},
+	{"4KB", 4 << 10},
+	{"16KB", 16 << 10},
+	{"64KB", 64 << 10},
+	{"256KB", 256 << 10},
+	{"1MB", 1 << 20},
+	{">1MB", ^uint32(0)},
+}
+
+// TTL 分布的桶上界，剩余时间超过最后一个桶的归入 >7d
+var ttlBuckets = []struct {
+	label string
+	limit time.Duration
+}{
+	{"1m", time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+var (
+	analyticsEnabled bool
+	// 为 nil 表示没有开启键空间分析
+	analytics *keyspace
+)
+
+type keyStat struct {
+	kind      vfs.Kind
+	size      uint32
+	expiredAt uint64
+}
+
+// keyspace 通过存储的写入钩子增量维护键空间统计，不需要扫描数据文件
+type keyspace struct {
+	mu    sync.Mutex
+	keys  map[string]keyStat
+	kinds map[vfs.Kind]int64
+	sizes []int64
+}
+
+type KeyUsage struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Size uint32 `json:"size"`
+}
+
+type Analytics struct {
+	KeyCount  int64            `json:"key_count"`
+	TotalSize int64            `json:"total_size"`
+	Types     map[string]int64 `json:"types"`
+	Sizes     map[string]int64 `json:"sizes"`
+	TTLs      map[string]int64 `json:"ttls"`
+	Largest   []KeyUsage       `json:"largest"`
+}
+
+func newKeyspace() *keyspace {
+	return &keyspace{
+		keys:  make(map[string]keyStat),
+		kinds: make(map[vfs.Kind]int64),
+		sizes: make([]int64, len(sizeBuckets)),
+	}
+}
+
+func sizeBucket(size uint32) int {
+	for i, b := range sizeBuckets {
+		if size <= b.limit {
+			return i
+		}
+	}
+	return len(sizeBuckets) - 1
+}
+
+func ttlBucket(expiredAt uint64, now time.Time) string {
+	if expiredAt == 0 {
+		return "none"
+	}
+	remaining := time.Duration(int64(expiredAt) - now.UnixNano())
+	for _, b := range ttlBuckets {
+		if remaining <= b.limit {
+			return b.label
+		}
+	}
+	return ">7d"
+}
+
+// 调用者必须持有 ks.mu
+func (ks *keyspace) remove(key string) {
+	if old, ok := ks.keys[key]; ok {
+		ks.kinds[old.kind] -= 1
+		ks.sizes[sizeBucket(old.size)] -= 1
+		delete(ks.keys, key)
+	}
+}
+
+// 调用者必须持有 ks.mu
+func (ks *keyspace) add(key string, stat keyStat) {
+	ks.keys[key] = stat
+	ks.kinds[stat.kind] += 1
+	ks.sizes[sizeBucket(stat.size)] += 1
+}
+
+// observe 是注册到存储上的写入钩子，覆盖写时先减去旧值的统计
+func (ks *keyspace) observe(seg *vfs.Segment) {
+	key := seg.GetKeyString()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.remove(key)
+	if !seg.IsTombstone() {
+		ks.add(key, keyStat{kind: seg.Type, size: seg.Size(), expiredAt: seg.ExpiredAt})
+	}
+}
+
+// loadKeyspace 启动时扫描一次数据文件建立初始统计，之后只做增量更新
+func loadKeyspace(fss *vfs.LogStructuredFS) (*keyspace, error) {
+	ks := newKeyspace()
+	err := fss.RangeSegments(func(seg *vfs.Segment) bool {
+		ks.add(seg.GetKeyString(), keyStat{kind: seg.Type, size: seg.Size(), expiredAt: seg.ExpiredAt})
+		return true
+	})
+	return ks, err
+}
+
+// keyHeap 是按大小排序的小顶堆，用于选出最大的 N 个 key
+type keyHeap []KeyUsage
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(KeyUsage)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// snapshot 汇总当前的统计，顺便清理已经过期的 key
+func (ks *keyspace) snapshot(top int) Analytics {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	result := Analytics{
+		Types: make(map[string]int64),
+		Sizes: make(map[string]int64),
+		TTLs:  make(map[string]int64),
+	}
+
+	largest := make(keyHeap, 0, top)
+	for key, stat := range ks.keys {
+		if stat.expiredAt != 0 && stat.expiredAt <= uint64(now.UnixNano()) {
+			ks.remove(key)
+			continue
+		}
+
+		result.KeyCount += 1
+		result.TotalSize += int64(stat.size)
+		result.TTLs[ttlBucket(stat.expiredAt, now)] += 1
+
+		if top <= 0 {
+			continue
+		}
+		if largest.Len() < top {
+			heap.Push(&largest, KeyUsage{Key: key, Type: vfs.KindToString[stat.kind], Size: stat.size})
+		} else if stat.size > largest[0].Size {
+			largest[0] = KeyUsage{Key: key, Type: vfs.KindToString[stat.kind], Size: stat.size}
+			heap.Fix(&largest, 0)
+		}
+	}
+
+	for kind, count := range ks.kinds {
+		if count > 0 {
+			result.Types[vfs.KindToString[kind]] = count
+		}
+	}
+
+	for i, b := range sizeBuckets {
+		result.Sizes[b.label] = ks.sizes[i]
+	}
+
+	sort.Slice(largest, func(i, j int) bool {
+		return largest[i].Size > largest[j].Size
+	})
+	result.Largest = largest
+
+	return result
+}
+
+func GetAnalyticsController(ctx *gin.Context) {
+	if analytics == nil {
+		respondError(ctx, CodeNotImplemented, "keyspace analytics is not enabled.")
+		return
+	}
+
+	top, err := strconv.Atoi(ctx.DefaultQuery("top", strconv.Itoa(defaultTopKeys)))
+	if err != nil || top < 0 {
+		respondError(ctx, CodeBadRequest, "top must be a non-negative integer.")
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, analytics.snapshot(top))
+}
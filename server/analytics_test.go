@@ -0,0 +1,62 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyspace_Observe(t *testing.T) {
+	ks := newKeyspace()
+
+	text, err := vfs.NewSegment("text-01", types.NewText(strings.Repeat("a", 2048)), 0)
+	assert.NoError(t, err)
+	ks.observe(text)
+
+	number, err := vfs.NewSegment("number-01", types.NewNumber(1), 60)
+	assert.NoError(t, err)
+	ks.observe(number)
+
+	// 覆盖写不应该重复计数
+	ks.observe(number)
+
+	result := ks.snapshot(1)
+	assert.Equal(t, int64(2), result.KeyCount)
+	assert.Equal(t, map[string]int64{"text": 1, "number": 1}, result.Types)
+	assert.Equal(t, int64(1), result.Sizes["4KB"])
+	assert.Equal(t, int64(1), result.TTLs["none"])
+	assert.Equal(t, int64(1), result.TTLs["1m"])
+	assert.Len(t, result.Largest, 1)
+	assert.Equal(t, "text-01", result.Largest[0].Key)
+
+	ks.observe(vfs.NewTombstoneSegment("text-01"))
+	result = ks.snapshot(10)
+	assert.Equal(t, int64(1), result.KeyCount)
+	assert.Equal(t, map[string]int64{"number": 1}, result.Types)
+	assert.Equal(t, int64(0), result.Sizes["4KB"])
+}
+
+func TestTTLBucket(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, "none", ttlBucket(0, now))
+	assert.Equal(t, "1h", ttlBucket(uint64(now.Add(30*time.Minute).UnixNano()), now))
+	assert.Equal(t, ">7d", ttlBucket(uint64(now.Add(30*24*time.Hour).UnixNano()), now))
+}
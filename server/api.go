@@ -16,10 +16,8 @@ package server
 
 import (
 	"fmt"
-	"net/http"
-	"strings"
 
-	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/vfs"
 	"github.com/gin-gonic/gin"
 )
 
@@ -28,7 +26,6 @@ const version = "momentdb/1.1.2"
 var (
 	root         *gin.Engine
 	authPassword string
-	allowIpList  []string
 )
 
 // http://192.168.101.225:2668/{types}/{key}
@@ -40,14 +37,125 @@ func init() {
 	gin.SetMode(gin.ReleaseMode)
 	root = gin.New()
 
+	root.Use(requestIDMiddleware())
+	root.Use(tracingMiddleware())
+	root.Use(corsMiddleware())
+	root.Use(compressMiddleware())
 	root.Use(authMiddleware())
+	root.Use(clusterMiddleware())
+	root.Use(raftMiddleware())
+	root.Use(readyMiddleware())
+	root.Use(handoverMiddleware())
+	root.Use(readOnlyMiddleware())
+	root.Use(limitMiddleware())
+	root.Use(strictTypeMiddleware())
+	root.Use(hotkeyMiddleware())
+	root.Use(deadlineMiddleware())
+	root.Use(bulkheadMiddleware())
 	root.NoRoute(Error404Handler)
 	root.GET("/", GetHealthController)
+	root.GET("/livez", GetLivezController)
+	root.GET("/readyz", GetReadyzController)
+	root.GET("/metrics", GetMetricsController)
+	root.GET("/console", GetConsoleController)
+	root.GET("/console/assets/*filepath", GetConsoleAssetController)
+	root.GET("/openapi.json", GetOpenAPIController)
+	root.GET("/swagger", GetSwaggerController)
+	root.POST(loginPath, LoginController)
+	root.POST(logoutPath, LogoutController)
+
+	admin := root.Group("/admin")
+	{
+		admin.GET("/namespaces", GetNamespacesController)
+		admin.GET("/prefixes", GetPrefixesController)
+		admin.GET("/prefixes/:prefix/keys", ListPrefixKeysController)
+		admin.DELETE("/prefixes/:prefix", DeletePrefixController)
+		admin.GET("/analytics", GetAnalyticsController)
+		admin.GET("/hotkeys", GetHotKeysController)
+		admin.GET("/cluster", GetClusterController)
+		admin.GET("/routes", GetRoutesController)
+		admin.PUT("/routes", PutRoutesController)
+		admin.GET("/migrations", ListMigrationsController)
+		admin.POST("/migrations", CreateMigrationController)
+		admin.GET("/raft", GetRaftController)
+		admin.GET("/keys", ListKeysController)
+		admin.POST("/delete", BulkDeleteController)
+		admin.GET("/keys/:key", InspectKeyController)
+		admin.PUT("/keys/:key/ttl", PutKeyTTLController)
+		admin.GET("/compact/schedule", GetCompactScheduleController)
+		admin.POST("/compact", CompactController)
+		admin.POST("/compact/pause", PauseCompactionController)
+		admin.POST("/compact/resume", ResumeCompactionController)
+		admin.GET("/regions", GetRegionsController)
+		admin.GET("/index", GetIndexController)
+		admin.GET("/tiering", GetTieringController)
+		admin.POST("/tiering", TieringController)
+		admin.GET("/backup", GetBackupController)
+		admin.POST("/backup", BackupController)
+		admin.GET("/rollback", GetRollbackController)
+		admin.POST("/rollback", RollbackController)
+		admin.POST("/undelete/:key", UndeleteController)
+		admin.GET("/allowlist", GetAllowListController)
+		admin.PUT("/allowlist", PutAllowListController)
+		admin.GET("/config", GetConfigController)
+		admin.PUT("/config", PutConfigController)
+		admin.GET("/config/history", GetConfigHistoryController)
+		admin.POST("/config/rollback", RollbackConfigController)
+		admin.GET("/loglevel", GetLogLevelController)
+		admin.PUT("/loglevel", PutLogLevelController)
+		admin.GET("/faults", GetFaultsController)
+		admin.PUT("/faults", PutFaultsController)
+		admin.DELETE("/faults", DeleteFaultsController)
+		admin.GET("/scripts", ListProceduresController)
+		admin.GET("/scripts/:name", GetProcedureController)
+		admin.PUT("/scripts/:name", PutProcedureController)
+		admin.DELETE("/scripts/:name", DeleteProcedureController)
+		admin.GET("/schemas", ListSchemasController)
+		admin.GET("/schemas/:prefix", GetSchemaController)
+		admin.PUT("/schemas/:prefix", PutSchemaController)
+		admin.DELETE("/schemas/:prefix", DeleteSchemaController)
+		admin.GET("/hooks", ListHooksController)
+		admin.PUT("/hooks/:name", PutHookController)
+		admin.DELETE("/hooks/:name", DeleteHookController)
+		admin.GET("/hooks/:name/dead", ListDeadLettersController)
+		admin.POST("/hooks/:name/replay", ReplayDeadLettersController)
+		admin.GET("/transforms", ListTransformsController)
+		admin.POST("/transforms", CreateTransformController)
+		admin.GET("/transforms/:id", GetTransformController)
+		admin.POST("/transforms/:id/cancel", CancelTransformController)
+		admin.POST("/transforms/:id/resume", ResumeTransformController)
+	}
+
+	root.POST("/pipeline", PipelineController)
+	root.POST("/eval", EvalController)
+	root.POST("/call/:name", CallProcedureController)
+	root.POST("/publish/:channel", PublishController)
+	root.GET("/subscribe/:channel", SubscribeController)
+
+	root.GET("/keys", RangeKeysController)
+	root.GET("/meta/:key", GetMetaController)
+	root.GET("/exists/:key", ExistsController)
+	root.GET("/diff/:key", DiffController)
+	root.GET("/cdc", ChangesController)
+
+	// 根据值的形状推断类型的通用接口
+	root.GET("/kv/:key", GetKVController)
+	root.PUT("/kv/:key", PutKVController)
+
+	// 副本节点之间复制写操作和反熵修复使用的接口
+	replica := root.Group("/replica")
+	{
+		replica.POST("", ReplicaController)
+		replica.GET("/merkle", GetMerkleController)
+		replica.GET("/digests/:bucket", GetDigestsController)
+		replica.GET("/segments/:key", GetReplicaSegmentController)
+	}
 
 	query := root.Group("/query")
 	{
 		// 简单的查询使用 GET
 		query.GET("/:key", QueryController)
+		query.HEAD("/:key", ExistsController)
 		// 后续复杂查询使用 POST
 	}
 
@@ -55,6 +163,7 @@ func init() {
 	set := root.Group("/set")
 	{
 		set.GET("/:key", GetSetController)
+		set.HEAD("/:key", ExistsController)
 		set.PUT("/:key", PutSetController)
 		set.DELETE("/:key", DeleteSetController)
 	}
@@ -62,13 +171,17 @@ func init() {
 	zset := root.Group("/zset")
 	{
 		zset.GET("/:key", GetZsetController)
+		zset.HEAD("/:key", ExistsController)
 		zset.PUT("/:key", PutZsetController)
 		zset.DELETE("/:key", DeleteZsetController)
+		zset.POST("/:key/add", AddZSetController)
+		zset.POST("/:key/remove", RemoveZSetController)
 	}
 
 	text := root.Group("/text")
 	{
 		text.GET("/:key", GetTextController)
+		text.HEAD("/:key", ExistsController)
 		text.PUT("/:key", PutTextController)
 		text.DELETE("/:key", DeleteTextController)
 	}
@@ -76,6 +189,7 @@ func init() {
 	table := root.Group("/table")
 	{
 		table.GET("/:key", GetTableController)
+		table.HEAD("/:key", ExistsController)
 		table.PUT("/:key", PutTableController)
 		table.DELETE("/:key", DeleteTableController)
 	}
@@ -83,74 +197,136 @@ func init() {
 	number := root.Group("/number")
 	{
 		number.GET("/:key", GetNumberController)
+		number.HEAD("/:key", ExistsController)
 		number.PUT("/:key", PutNumberController)
 		number.DELETE("/:key", DeleteNumberController)
 	}
 
+	stream := root.Group("/stream")
+	{
+		stream.GET("/:key", GetStreamController)
+		stream.HEAD("/:key", ExistsController)
+		stream.PUT("/:key", PutStreamController)
+		stream.DELETE("/:key", DeleteStreamController)
+		stream.POST("/:key/add", AddStreamController)
+		stream.POST("/:key/group/:group", ReadStreamGroupController)
+	}
+
+	hll := root.Group("/hll")
+	{
+		hll.GET("/:key", GetHLLController)
+		hll.HEAD("/:key", ExistsController)
+		hll.PUT("/:key", PutHLLController)
+		hll.DELETE("/:key", DeleteHLLController)
+		hll.POST("/:key/add", AddHLLController)
+		hll.POST("/:key/merge", MergeHLLController)
+	}
+
+	queue := root.Group("/queue")
+	{
+		queue.GET("/:key", GetQueueController)
+		queue.HEAD("/:key", ExistsController)
+		queue.PUT("/:key", PutQueueController)
+		queue.DELETE("/:key", DeleteQueueController)
+		queue.POST("/:key/enqueue", EnqueueController)
+		queue.POST("/:key/dequeue", DequeueController)
+		queue.POST("/:key/ack", AckController)
+	}
+
+	// 时间序列按照时间桶存储，范围查询依赖 skiplist 有序索引
+	ts := root.Group("/ts")
+	{
+		ts.GET("/:series", QuerySeriesController)
+		ts.POST("/:series", AppendSeriesController)
+		ts.DELETE("/:series", DeleteSeriesController)
+	}
+
 	collection := root.Group("/collection")
 	{
 		collection.GET("/:key", GetCollectionController)
+		collection.HEAD("/:key", ExistsController)
 		collection.PUT("/:key", PutCollectionController)
 		collection.DELETE("/:key", DeleteCollectionController)
+		collection.GET("/:key/size", CollectionSizeController)
+		collection.POST("/:key/push", PushCollectionController)
 	}
 }
 
+// SystemInfo 中内存和磁盘的字段在当前平台不支持获取时省略
 type SystemInfo struct {
 	KeyCount    int    `json:"key_count"`
 	Version     string `json:"version"`
 	GCState     int8   `json:"gc_state"`
-	DiskFree    string `json:"disk_free"`
-	DiskUsed    string `json:"disk_used"`
-	DiskTotal   string `json:"disk_total"`
-	MemoryFree  string `json:"mem_free"`
-	MemoryTotal string `json:"mem_total"`
-	DiskPercent string `json:"disk_percent"`
+	DiskFree    string `json:"disk_free,omitempty"`
+	DiskUsed    string `json:"disk_used,omitempty"`
+	DiskTotal   string `json:"disk_total,omitempty"`
+	MemoryFree  string `json:"mem_free,omitempty"`
+	MemoryTotal string `json:"mem_total,omitempty"`
+	DiskPercent string `json:"disk_percent,omitempty"`
+	// 存储引擎的内部状态，用于监控告警，字节数和秒数不做格式化
+	ActiveRegion      uint64  `json:"active_region"`
+	RegionCount       int     `json:"region_count"`
+	CompactionBacklog uint64  `json:"compaction_backlog_bytes"`
+	CheckpointAge     int64   `json:"checkpoint_age_seconds"`
+	IndexMemory       uint64  `json:"index_memory_bytes"`
+	IndexSpilled      uint64  `json:"index_spilled_bytes"`
+	Uptime            int64   `json:"uptime_seconds"`
+	RecoveryDuration  float64 `json:"recovery_seconds"`
+	// GCStatus 是回收状态机的状态名，以及暂停或者失败的原因
+	GCStatus vfs.CompactionStatus `json:"gc_status"`
+}
+
+// publicPath 不需要认证也不需要等待存储系统就绪的路由
+func publicPath(path string) bool {
+	return probePaths[path] || consolePaths[path] || openapiPaths[path]
 }
 
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Server", version)
 
+		// 探针接口、控制台静态资源和接口文档需要在没有认证信息的情况下也能被访问
+		if publicPath(c.FullPath()) {
+			c.Next()
+			return
+		}
+
 		// 从请求头中获取 "Auth-Token" 字段的值
 		auth := c.GetHeader("Auth-Token")
-		clog.Debugf("HTTP request header authorization: %v", c.Request)
+		rlog := requestLog(c)
 
-		// 获取客户端 IP 地址
-		ip := c.GetHeader("X-Forwarded-For")
-		if ip == "" {
-			ip = c.ClientIP()
+		// 检查 IP 白名单，白名单中可以是 IP 地址或者 CIDR 网段，Unix socket 连接没有客户端 IP
+		ip := clientOrigin(c)
+		if !localConn(c) && !allowOrigin(c, ip) {
+			respondError(c, CodeIPNotAllowed, fmt.Sprintf("client IP %s is not allowed!", ip))
+			c.Abort()
+			return
 		}
 
-		// 检查 IP 白名单
-		if len(allowIpList) > 0 {
-			ok := false
-			for _, allowedIP := range allowIpList {
-				// 只要找到匹配的 IP，就终止循环
-				if allowedIP == strings.Split(ip, ":")[0] {
-					ok = true
-					break
-				}
-			}
-			if !ok {
-				clog.Warnf("Unauthorized IP address: %s", ip)
-				c.JSON(http.StatusUnauthorized, gin.H{
-					"message": fmt.Sprintf("client IP %s is not allowed!", ip),
-				})
-				c.Abort()
-				return
-			}
+		// 登录接口使用请求体中的密码换取会话令牌
+		if c.FullPath() == loginPath {
+			c.Next()
+			return
 		}
 
-		if auth != authPassword {
-			clog.Warnf("Unauthorized access attempt from client %s", ip)
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"message": "access not authorised!",
-			})
+		// 控制台使用管理员 Token 访问管理接口
+		admin := adminToken != "" && c.GetHeader("Admin-Token") == adminToken && isAdminPath(c.FullPath())
+
+		switch {
+		case auth == authPassword:
+			setCredential(c, "auth", "")
+		case admin:
+			setCredential(c, "admin", "")
+		case validSession(c):
+			setCredential(c, "session", bearerToken(c))
+		default:
+			rlog.Warnf("Unauthorized access attempt from client %s", ip)
+			respondError(c, CodeUnauthorized, "access not authorised!")
 			c.Abort()
 			return
 		}
 
-		clog.Infof("Client %s connection successfully", ip)
+		rlog.Debugf("Client %s connection successfully", ip)
 
 		// 如果验证通过，继续执行后续的处理程序
 		c.Next()
@@ -0,0 +1,181 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// bulkheadScan 是遍历 key 和日志的请求，bulkheadAdmin 是触发垃圾回收、备份和批量修改的管理请求
+	bulkheadScan  = "scan"
+	bulkheadAdmin = "admin"
+	// 排队超时之后建议客户端重试的秒数
+	bulkheadRetryAfter = 1
+)
+
+// bulkheadRoutes 是每个昂贵的路由所属的隔离舱，不在这里的路由不限制并发，读写单个 key 不会被昂贵的请求挤占
+var bulkheadRoutes = map[string]string{
+	"GET /keys":                        bulkheadScan,
+	"GET /cdc":                         bulkheadScan,
+	"GET /admin/keys":                  bulkheadScan,
+	"GET /admin/prefixes":              bulkheadScan,
+	"GET /admin/prefixes/:prefix/keys": bulkheadScan,
+	"GET /replica/merkle":              bulkheadScan,
+	"GET /replica/digests/:bucket":     bulkheadScan,
+
+	"POST /admin/compact":               bulkheadAdmin,
+	"POST /admin/tiering":               bulkheadAdmin,
+	"POST /admin/backup":                bulkheadAdmin,
+	"POST /admin/rollback":              bulkheadAdmin,
+	"POST /admin/delete":                bulkheadAdmin,
+	"DELETE /admin/prefixes/:prefix":    bulkheadAdmin,
+	"POST /admin/migrations":            bulkheadAdmin,
+	"POST /admin/transforms":            bulkheadAdmin,
+	"POST /admin/transforms/:id/resume": bulkheadAdmin,
+	"POST /admin/hooks/:name/replay":    bulkheadAdmin,
+}
+
+// bulkheads 是当前生效的隔离舱，为 nil 时不限制并发，重新配置时整体替换，
+// 已经占用旧隔离舱的请求在旧隔离舱中释放
+var bulkheads atomic.Pointer[map[string]*bulkhead]
+
+// bulkhead 限制一类请求的并发数量，超过并发数量的请求最多 maxQueue 个排队等待 wait 时间
+type bulkhead struct {
+	slots    chan struct{}
+	maxQueue int64
+	wait     time.Duration
+
+	queued   atomic.Int64
+	rejected atomic.Uint64
+}
+
+func newBulkhead(limit, queue int, wait time.Duration) *bulkhead {
+	return &bulkhead{
+		slots:    make(chan struct{}, limit),
+		maxQueue: int64(queue),
+		wait:     wait,
+	}
+}
+
+// acquire 占用一个并发位置，排队已满、等待超时或者请求被取消时返回 false
+func (b *bulkhead) acquire(ctx context.Context) bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if b.queued.Add(1) > b.maxQueue {
+		b.queued.Add(-1)
+		b.rejected.Add(1)
+		return false
+	}
+	defer b.queued.Add(-1)
+
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	b.rejected.Add(1)
+	return false
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+// setBulkheads 设置扫描请求和管理请求的并发数量，limits 为 nil 时关闭并发隔离
+func setBulkheads(limits map[string]int, queue int, wait time.Duration) {
+	if limits == nil {
+		bulkheads.Store(nil)
+		return
+	}
+	heads := make(map[string]*bulkhead, len(limits))
+	for class, limit := range limits {
+		heads[class] = newBulkhead(limit, queue, wait)
+	}
+	bulkheads.Store(&heads)
+}
+
+// bulkheadMiddleware 限制昂贵请求的并发数量，排队超时之后返回 429 和 Retry-After，
+// 放在认证之后，没有通过认证的请求不会占用并发位置
+func bulkheadMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		heads := bulkheads.Load()
+		if heads == nil {
+			c.Next()
+			return
+		}
+
+		class, ok := bulkheadRoutes[c.Request.Method+" "+c.FullPath()]
+		head := (*heads)[class]
+		if !ok || head == nil {
+			c.Next()
+			return
+		}
+
+		if !head.acquire(c.Request.Context()) {
+			c.Header("Retry-After", strconv.Itoa(bulkheadRetryAfter))
+			respondError(c, CodeTooManyRequests, fmt.Sprintf("too many concurrent %s requests, retry later.", class))
+			c.Abort()
+			return
+		}
+		defer head.release()
+
+		c.Next()
+	}
+}
+
+// BulkheadStats 是一个隔离舱的并发数量、排队数量和拒绝的请求数
+type BulkheadStats struct {
+	Class    string `json:"class"`
+	Limit    int    `json:"limit"`
+	InFlight int    `json:"in_flight"`
+	Queued   int64  `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// bulkheadStats 返回按照名称排序的隔离舱统计信息，没有开启时返回 nil
+func bulkheadStats() []BulkheadStats {
+	heads := bulkheads.Load()
+	if heads == nil {
+		return nil
+	}
+	stats := make([]BulkheadStats, 0, len(*heads))
+	for class, head := range *heads {
+		stats = append(stats, BulkheadStats{
+			Class:    class,
+			Limit:    cap(head.slots),
+			InFlight: len(head.slots),
+			Queued:   head.queued.Load(),
+			Rejected: head.rejected.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Class < stats[j].Class })
+	return stats
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkhead_Acquire(t *testing.T) {
+	b := newBulkhead(1, 1, 50*time.Millisecond)
+	require.True(t, b.acquire(context.Background()))
+
+	// 排队的请求在并发位置释放之后继续执行
+	done := make(chan bool, 1)
+	go func() {
+		done <- b.acquire(context.Background())
+	}()
+	require.Eventually(t, func() bool { return b.queued.Load() == 1 }, time.Second, time.Millisecond)
+
+	// 排队已满直接拒绝
+	assert.False(t, b.acquire(context.Background()))
+	assert.Equal(t, uint64(1), b.rejected.Load())
+
+	b.release()
+	assert.True(t, <-done)
+	assert.Equal(t, int64(0), b.queued.Load())
+
+	// 等待超时或者请求被取消时拒绝
+	assert.False(t, b.acquire(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, b.acquire(ctx))
+	assert.Equal(t, uint64(3), b.rejected.Load())
+
+	b.release()
+	assert.True(t, b.acquire(context.Background()))
+}
+
+func TestBulkheadMiddleware(t *testing.T) {
+	wasReady := ready.Load()
+	ready.Store(true)
+	defer func() {
+		ready.Store(wasReady)
+		setBulkheads(nil, 0, 0)
+	}()
+
+	hts := &HttpServer{}
+	hts.SetBulkhead(true, 1, 1, 0, 10*time.Millisecond)
+
+	// 占满扫描请求的并发位置
+	heads := bulkheads.Load()
+	require.NotNil(t, heads)
+	scan := (*heads)[bulkheadScan]
+	require.True(t, scan.acquire(context.Background()))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/keys")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	var body APIError
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, CodeTooManyRequests, body.Code)
+	assert.True(t, body.Retryable)
+
+	// 不属于任何隔离舱的请求不受影响
+	w = request("/admin/allowlist")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := bulkheadStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, BulkheadStats{Class: bulkheadAdmin, Limit: 1}, stats[0])
+	assert.Equal(t, BulkheadStats{Class: bulkheadScan, Limit: 1, InFlight: 1, Rejected: 1}, stats[1])
+
+	w = request("/metrics")
+	assert.True(t, strings.Contains(w.Body.String(), `urnadb_bulkhead_rejected_total{class="scan"} 1`))
+
+	// 关闭之后不限制并发
+	scan.release()
+	hts.SetBulkhead(false, 0, 0, 0, 0)
+	assert.Nil(t, bulkheadStats())
+}
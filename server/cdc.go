@@ -0,0 +1,150 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultChangeLimit = 100
+	maxChangeLimit     = 1000
+	// 长轮询最多等待的时间，超过之后返回空的结果，客户端使用同一个 since 继续轮询
+	maxChangeWait = time.Minute
+)
+
+// Change 是 CDC 流中的一次写入或者删除，删除没有 Type 和 Value
+type Change struct {
+	LSN       uint64          `json:"lsn"`
+	Key       string          `json:"key"`
+	Op        string          `json:"op"`
+	Type      string          `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	CreatedAt uint64          `json:"created_at"`
+	ExpiredAt uint64          `json:"expired_at,omitempty"`
+}
+
+// newChange 把记录转换为 CDC 事件，写入的值使用和 /admin/keys/:key 相同的 JSON 格式，
+// 封存过分块的列表返回拼接之后的完整列表
+func newChange(ctx context.Context, seg *vfs.Segment) (Change, error) {
+	change := Change{
+		LSN:       seg.LSN,
+		Key:       seg.GetKeyString(),
+		Op:        hookEventPut,
+		CreatedAt: seg.CreatedAt,
+		ExpiredAt: seg.ExpiredAt,
+	}
+	if seg.IsTombstone() {
+		change.Op = hookEventDelete
+		return change, nil
+	}
+
+	full, err := sealedSegment(ctx, seg)
+	if err != nil {
+		return change, err
+	}
+	if full != nil {
+		defer utils.ReleaseToPool(full)
+		seg = full
+	}
+
+	value, err := seg.ToJSON()
+	if err != nil {
+		return change, err
+	}
+	change.Type = seg.GetTypeString()
+	change.Value = value
+	return change, nil
+}
+
+// ChangesController 按照 LSN 的顺序返回 since 之后提交的写入和删除，next 是下一次请求使用的 since，
+// 客户端保存收到的 next 之后重新连接不会丢失或者重复事件。没有新的写入时最多等待 wait 秒再返回，
+// since 之前的历史已经被 region 回收丢弃时返回 410，客户端需要重新复制全部数据。
+// 内部使用的 key 默认不返回，internal=true 时返回全部记录
+func ChangesController(ctx *gin.Context) {
+	since, err := strconv.ParseUint(ctx.DefaultQuery("since", "0"), 10, 64)
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "since must be a log sequence number.")
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultChangeLimit)))
+	if err != nil || limit <= 0 || limit > maxChangeLimit {
+		respondError(ctx, CodeBadRequest, "limit must be between 1 and "+strconv.Itoa(maxChangeLimit)+".")
+		return
+	}
+
+	wait, err := strconv.Atoi(ctx.DefaultQuery("wait", "0"))
+	if err != nil || wait < 0 || time.Duration(wait)*time.Second > maxChangeWait {
+		respondError(ctx, CodeBadRequest, "wait must be between 0 and "+strconv.Itoa(int(maxChangeWait.Seconds()))+" seconds.")
+		return
+	}
+
+	internal := ctx.Query("internal") == "true"
+
+	if wait > 0 {
+		// 长轮询超过 HTTP 服务器的写超时，写超时延长到等待结束之后再留出正常请求的时间
+		err = http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Now().Add(time.Duration(wait)*time.Second + timeout + requestTimeout))
+		if err != nil {
+			slog.Warnf("failed to extend write deadline of change stream: %v", err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx.Request.Context(), time.Duration(wait)*time.Second)
+		err = storage.WaitLSN(waitCtx, since)
+		cancel()
+		// 等待超时不是错误，返回空的结果
+		if err != nil && ctx.Request.Context().Err() != nil {
+			storageFailed(ctx, CodeInternal, ctx.Request.Context().Err())
+			return
+		}
+	}
+
+	segs, err := storage.ReadChanges(ctx.Request.Context(), since, limit)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	// 跳过的内部 key 同样推进 next
+	next := since
+	changes := make([]Change, 0, len(segs))
+	for _, seg := range segs {
+		next = seg.LSN
+		if !internal && isInternalKey(seg.GetKeyString()) {
+			continue
+		}
+		change, err := newChange(ctx.Request.Context(), seg)
+		if err != nil {
+			failed(ctx, CodeInternal, err)
+			return
+		}
+		changes = append(changes, change)
+	}
+
+	// 值已经是 JSON，不使用 render 按照 Accept 重新编码
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"changes": changes,
+		"next":    next,
+		"more":    len(segs) == limit,
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	type result struct {
+		Changes []Change `json:"changes"`
+		Next    uint64   `json:"next"`
+		More    bool     `json:"more"`
+	}
+	changes := func(query string) result {
+		w := request(http.MethodGet, "/cdc"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var r result
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &r))
+		return r
+	}
+
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "/table/a", `{"table": {"n": 1}}`).Code)
+	// 内部使用的 key 只能由服务端写入
+	seg, err := vfs.NewSegment(hookKeyPrefix+"x", types.NewText("{}"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment(hookKeyPrefix+"x", seg))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/table/a", "").Code)
+
+	r := changes("")
+	assert.Len(t, r.Changes, 2)
+	assert.Equal(t, uint64(3), r.Next)
+	assert.False(t, r.More)
+	assert.Equal(t, "a", r.Changes[0].Key)
+	assert.Equal(t, hookEventPut, r.Changes[0].Op)
+	assert.Equal(t, "table", r.Changes[0].Type)
+	assert.NotEmpty(t, r.Changes[0].Value)
+	assert.Equal(t, hookEventDelete, r.Changes[1].Op)
+	assert.Empty(t, r.Changes[1].Value)
+
+	r = changes("?limit=2&internal=true")
+	assert.Len(t, r.Changes, 2)
+	assert.Equal(t, uint64(2), r.Next)
+	assert.True(t, r.More)
+	assert.Equal(t, hookKeyPrefix+"x", r.Changes[1].Key)
+
+	r = changes("?since=3")
+	assert.Empty(t, r.Changes)
+	assert.Equal(t, uint64(3), r.Next)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		request(http.MethodPut, "/table/b", `{"table": {"n": 2}}`)
+	}()
+	r = changes("?since=3&wait=5")
+	assert.Len(t, r.Changes, 1)
+	assert.Equal(t, "b", r.Changes[0].Key)
+	assert.Equal(t, uint64(4), r.Next)
+
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/cdc?since=x", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/cdc?limit=0", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/cdc?wait=120", "").Code)
+
+	// 长轮询等待的时间超过 HTTP 服务器的写超时仍然能返回响应
+	server := httptest.NewUnstartedServer(root)
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/cdc?since=4&wait=1", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Auth-Token", authPassword)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+	assert.Empty(t, r.Changes)
+	assert.Equal(t, uint64(4), r.Next)
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/auula/urnadb/cluster"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 转发请求时带上来源节点，收到转发请求的节点直接在本地处理，避免节点列表不一致时循环转发
+	forwardedHeader = "Urnadb-Forwarded-By"
+	// 响应中返回负责这个 key 的节点，客户端可以缓存分片信息直接访问
+	ownerHeader = "Urnadb-Node"
+)
+
+// shards 为空表示没有开启集群模式
+var shards struct {
+	ring     *cluster.Ring
+	self     string
+	redirect bool
+	proxies  map[string]*httputil.ReverseProxy
+}
+
+func newNodeProxy(node string) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: node})
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		id := r.Header.Get(requestIDHeader)
+		slog.With("request_id", id).Warnf("Failed to proxy request to node %s: %v", node, err)
+		body, _ := json.Marshal(&APIError{
+			Code:      CodeNodeUnavailable,
+			Message:   "cluster node " + node + " is unavailable.",
+			Retryable: true,
+			RequestID: id,
+		})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write(body)
+	}
+	return proxy
+}
+
+// routingKey 返回请求操作的 key，只有单 key 的数据接口会按照分片路由
+func routingKey(c *gin.Context) string {
+	if key := c.Param("key"); key != "" && !isAdminPath(c.FullPath()) {
+		return key
+	}
+	// 时间序列的所有时间桶都保存在序列名称对应的节点上
+	return c.Param("series")
+}
+
+// clusterMiddleware 把不属于本节点的请求转发到负责这个 key 的节点，
+// redirect 模式下返回 307 让客户端自己重新请求，类似 Redis 的 MOVED
+func clusterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := routingKey(c)
+		if shards.ring == nil || key == "" {
+			c.Next()
+			return
+		}
+
+		// 已经转发过的请求只会因为迁移之后的路由再次转发，这时其他节点的路由表还没有更新
+		owner, routed := locateOwner(key)
+		if (c.GetHeader(forwardedHeader) != "" && !routed) || owner == "" || owner == shards.self {
+			c.Next()
+			return
+		}
+
+		c.Header(ownerHeader, owner)
+
+		if shards.redirect {
+			location := url.URL{Scheme: "http", Host: owner, Path: c.Request.URL.Path, RawQuery: c.Request.URL.RawQuery}
+			c.Redirect(http.StatusTemporaryRedirect, location.String())
+			c.Abort()
+			return
+		}
+
+		c.Request.Header.Set(forwardedHeader, shards.self)
+		shards.proxies[owner].ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
+
+// GetClusterController 返回集群节点列表，传入 key 时返回负责这个 key 的节点
+func GetClusterController(ctx *gin.Context) {
+	if shards.ring == nil {
+		respondError(ctx, CodeFeatureDisabled, "cluster mode is not enabled.")
+		return
+	}
+
+	result := gin.H{
+		"self":  shards.self,
+		"nodes": shards.ring.Nodes(),
+		"mode":  "proxy",
+	}
+	if shards.redirect {
+		result["mode"] = "redirect"
+	}
+	if list := currentRoutes(); len(list) > 0 {
+		result["routes"] = list
+	}
+	if key := ctx.Query("key"); key != "" {
+		result["key"] = key
+		result["owner"], _ = locateOwner(key)
+	}
+
+	ctx.IndentedJSON(http.StatusOK, result)
+}
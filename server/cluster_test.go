@@ -0,0 +1,111 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// ReverseProxy 需要 http.CloseNotifier，httptest.ResponseRecorder 没有实现
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (closeNotifyRecorder) CloseNotify() <-chan bool {
+	return nil
+}
+
+func TestClusterMiddleware(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	// 另外一个节点只记录收到的请求
+	var forwarded string
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(forwardedHeader)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"node":"remote","path":"` + r.URL.Path + `"}`))
+	}))
+	defer remote.Close()
+
+	self, other := "127.0.0.1:1", strings.TrimPrefix(remote.URL, "http://")
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	hs := new(HttpServer)
+	hs.SetCluster(self, []string{self, other}, 0, false)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		shards.ring, shards.proxies, shards.redirect = nil, nil, false
+	}()
+
+	var localKey, remoteKey string
+	for i := 0; localKey == "" || remoteKey == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if shards.ring.Locate(key) == self {
+			localKey = key
+		} else {
+			remoteKey = key
+		}
+	}
+
+	request := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"content":"hello"}`))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(closeNotifyRecorder{w}, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/text/"+localKey, http.Header{})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get(ownerHeader))
+
+	w = request(http.MethodPut, "/text/"+remoteKey, http.Header{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, other, w.Header().Get(ownerHeader))
+	assert.JSONEq(t, `{"node":"remote","path":"/text/`+remoteKey+`"}`, w.Body.String())
+	assert.Equal(t, self, forwarded)
+
+	// 已经被转发过的请求在本地处理
+	w = request(http.MethodPut, "/text/"+remoteKey, http.Header{forwardedHeader: {other}})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	shards.redirect = true
+	w = request(http.MethodGet, "/text/"+remoteKey+"?a=1", http.Header{})
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, remote.URL+"/text/"+remoteKey+"?a=1", w.Header().Get("Location"))
+
+	w = request(http.MethodGet, "/admin/cluster?key="+remoteKey, http.Header{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"owner": "`+other+`"`)
+}
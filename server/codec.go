@@ -0,0 +1,229 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	mimeJSON    = "application/json"
+	mimeMsgPack = "application/msgpack"
+	mimeCBOR    = "application/cbor"
+)
+
+// MessagePack 还没有正式注册的 MIME 类型，常见的几种写法都支持
+var mediaAliases = map[string]string{
+	"application/x-msgpack":   mimeMsgPack,
+	"application/vnd.msgpack": mimeMsgPack,
+}
+
+// 协商顺序，客户端没有指定 Accept 的时候默认使用 JSON
+var offeredMedia = []string{mimeJSON, mimeMsgPack, mimeCBOR, "application/x-msgpack", "application/vnd.msgpack"}
+
+// CBOR 默认把对象解码为 map[any]any，和 JSON 保持一致解码为 map[string]any
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+func mediaType(contentType string) string {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return mimeJSON
+	}
+	media = strings.ToLower(media)
+	if alias, ok := mediaAliases[media]; ok {
+		return alias
+	}
+	return media
+}
+
+// acceptMedia 根据 Accept 请求头选择响应的编码格式
+func acceptMedia(ctx *gin.Context) string {
+	media := ctx.NegotiateFormat(offeredMedia...)
+	if media == "" {
+		return mimeJSON
+	}
+	return mediaType(media)
+}
+
+// bindBody 根据 Content-Type 使用 JSON、MessagePack 或 CBOR 解析请求体，
+// MessagePack 和 CBOR 使用和 JSON 相同的字段名，并且同样会校验 binding 标签
+func bindBody(ctx *gin.Context, obj any) error {
+	var err error
+	switch mediaType(ctx.ContentType()) {
+	case mimeMsgPack:
+		dec := msgpack.NewDecoder(ctx.Request.Body)
+		dec.SetCustomStructTag("json")
+		dec.UseLooseInterfaceDecoding(true)
+		err = dec.Decode(obj)
+	case mimeCBOR:
+		err = cborDecMode.NewDecoder(ctx.Request.Body).Decode(obj)
+	default:
+		if ctx.Request.Body == nil {
+			return errors.New("invalid request")
+		}
+		err = decodeJSON(ctx.Request.Body, obj)
+	}
+
+	if err != nil {
+		return err
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
+
+// decodeJSON 使用 json.Number 解析 JSON，再把 any 类型位置上的数字转换为 int64、uint64 或 float64，
+// 直接解析为 float64 时超过 2^53 的整数会丢失精度，例如雪花算法生成的 ID
+func decodeJSON(r io.Reader, obj any) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err := dec.Decode(obj)
+	if err != nil {
+		return err
+	}
+	normalizeNumbers(reflect.ValueOf(obj))
+	return nil
+}
+
+// numberValue 把 json.Number 转换为能够精确表示它的类型
+func numberValue(n json.Number) any {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u
+	}
+	f, _ := strconv.ParseFloat(string(n), 64)
+	return f
+}
+
+// normalizeAny 转换 JSON 对象和数组中的 json.Number，对象和数组原地修改
+func normalizeAny(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		return numberValue(v)
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeAny(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeAny(item)
+		}
+	}
+	return value
+}
+
+// normalizeNumbers 遍历解析的结果，只有 any 类型的位置才会出现 json.Number
+func normalizeNumbers(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			normalizeNumbers(v.Elem())
+		}
+	case reflect.Interface:
+		if !v.IsNil() && v.CanSet() {
+			v.Set(reflect.ValueOf(normalizeAny(v.Interface())))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				normalizeNumbers(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			normalizeNumbers(v.Index(i))
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.Interface {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if !iter.Value().IsNil() {
+				v.SetMapIndex(iter.Key(), reflect.ValueOf(normalizeAny(iter.Value().Interface())))
+			}
+		}
+	}
+}
+
+func marshalMsgPack(obj any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(obj)
+	return buf.Bytes(), err
+}
+
+// render 根据 Accept 请求头使用 JSON、MessagePack 或 CBOR 编码响应
+func render(ctx *gin.Context, code int, obj any) {
+	var (
+		data  []byte
+		err   error
+		media = acceptMedia(ctx)
+	)
+
+	switch media {
+	case mimeMsgPack:
+		data, err = marshalMsgPack(obj)
+	case mimeCBOR:
+		data, err = cbor.Marshal(obj)
+	default:
+		ctx.IndentedJSON(code, obj)
+		return
+	}
+
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.Data(code, media, data)
+}
+
+// renderRaw 在客户端接受 MessagePack 的时候直接返回存储的 msgpack 数据，
+// 不需要先解码为数据结构再重新编码，返回 false 表示需要走正常的解码流程。
+// 只有 Set、ZSet、Text、Table、Number、Collection 存储的是裸值可以直接透传。
+func renderRaw(ctx *gin.Context, field string, seg *vfs.Segment) bool {
+	// 使用其他编解码器保存的值和 intset 编码的 Set 需要先解码
+	if acceptMedia(ctx) != mimeMsgPack || seg.Codec != vfs.MsgPack || seg.IsIntSet() {
+		return false
+	}
+
+	data, err := msgpack.Marshal(map[string]msgpack.RawMessage{
+		field: seg.ToBytes(),
+	})
+	if err != nil {
+		return false
+	}
+
+	ctx.Data(http.StatusOK, mimeMsgPack, data)
+	return true
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestCodecNegotiation(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	body, err := msgpack.Marshal(map[string]any{
+		"collection": []any{"a", int64(1), true},
+		"ttl":        60,
+	})
+	assert.NoError(t, err)
+	w := request(http.MethodPut, "/collection/codec-msgpack", mimeMsgPack, "", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 直接透传存储的 msgpack 数据
+	w = request(http.MethodGet, "/collection/codec-msgpack", "", "application/x-msgpack", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, mimeMsgPack, w.Header().Get("Content-Type"))
+	var collection struct {
+		Collection []any `msgpack:"collection"`
+	}
+	assert.NoError(t, msgpack.Unmarshal(w.Body.Bytes(), &collection))
+	assert.Equal(t, []any{"a", int64(1), true}, collection.Collection)
+
+	w = request(http.MethodGet, "/collection/codec-msgpack", "", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"collection":["a",1,true]}`, w.Body.String())
+
+	body, err = cbor.Marshal(map[string]any{
+		"table": map[string]any{"name": "urnadb", "tags": []string{"kv"}},
+	})
+	assert.NoError(t, err)
+	w = request(http.MethodPut, "/table/codec-cbor", mimeCBOR, "", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/table/codec-cbor", "", mimeCBOR, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, mimeCBOR, w.Header().Get("Content-Type"))
+	var table struct {
+		Table map[string]any `cbor:"table"`
+	}
+	assert.NoError(t, cbor.Unmarshal(w.Body.Bytes(), &table))
+	assert.Equal(t, "urnadb", table.Table["name"])
+
+	body, err = msgpack.Marshal(map[string]any{"collection": "not an array"})
+	assert.NoError(t, err)
+	w = request(http.MethodPut, "/collection/codec-invalid", mimeMsgPack, "", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPut, "/collection/codec-invalid", mimeCBOR, "", []byte{0xff, 0x00})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 使用 protobuf 保存的值不能透传，解码之后再编码为 msgpack
+	policy, err := vfs.NewCodecPolicy("msgpack", map[string]string{"table": "protobuf"}, nil, ":")
+	assert.NoError(t, err)
+	fss.SetCodecs(policy)
+	defer fss.SetCodecs(nil)
+
+	w = request(http.MethodPut, "/table/codec-protobuf", "application/json", "", []byte(`{"table": {"name": "urnadb"}}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/table/codec-protobuf", "", mimeMsgPack, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var decoded struct {
+		Table map[string]any `msgpack:"table"`
+	}
+	assert.NoError(t, msgpack.Unmarshal(w.Body.Bytes(), &decoded))
+	assert.Equal(t, "urnadb", decoded.Table["name"])
+
+	w = request(http.MethodGet, "/query/codec-protobuf", "", "", nil)
+	assert.Contains(t, w.Body.String(), `"codec": "protobuf"`)
+
+	// intset 编码的 Set 同样需要解码之后再编码为 msgpack
+	w = request(http.MethodPut, "/set/codec-intset", "application/json", "", []byte(`{"set": {"1": true, "2": true, "30": true}}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/set/codec-intset", "", mimeMsgPack, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var set struct {
+		Set map[string]bool `msgpack:"set"`
+	}
+	assert.NoError(t, msgpack.Unmarshal(w.Body.Bytes(), &set))
+	assert.Equal(t, map[string]bool{"1": true, "2": true, "30": true}, set.Set)
+
+	w = request(http.MethodGet, "/query/codec-intset", "", "", nil)
+	assert.Contains(t, w.Body.String(), `"encoding": "intset"`)
+}
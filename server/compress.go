@@ -0,0 +1,235 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 响应体小于 compressThreshold 字节时不压缩，0 表示关闭响应压缩
+var compressThreshold int
+
+// 服务端支持的压缩算法，q 值相同的时候按照这个顺序优先选择
+var encodings = []string{"zstd", "gzip"}
+
+// 压缩器创建的开销比较大，使用对象池复用
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	},
+	"zstd": {
+		New: func() any {
+			encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return encoder
+		},
+	},
+}
+
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+func getEncoder(encoding string, w io.Writer) encoder {
+	enc := encoderPools[encoding].Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func putEncoder(encoding string, enc encoder) {
+	encoderPools[encoding].Put(enc)
+}
+
+// negotiateEncoding 根据 Accept-Encoding 选择 q 值最高的压缩算法，没有可用的算法返回空字符串
+func negotiateEncoding(accept string) string {
+	var (
+		best     string
+		bestQ    float64
+		wildcard = -1.0
+		quality  = make(map[string]float64)
+	)
+
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			quality[name] = q
+		}
+	}
+
+	for _, encoding := range encodings {
+		q, ok := quality[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter 先缓存响应体，超过阈值并且是 JSON 响应才开始压缩，
+// 其他响应例如 SSE 订阅会直接透传，不影响 Flush 推送
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	status   int
+	decided  bool
+	buffer   bytes.Buffer
+	encoder  encoder
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	w.decide(false)
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Status() int {
+	if !w.decided && w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if !isJSON(w.Header().Get("Content-Type")) || w.Header().Get("Content-Encoding") != "" {
+			w.decide(false)
+		} else {
+			w.buffer.Write(data)
+			if w.buffer.Len() >= compressThreshold {
+				w.decide(true)
+			}
+			return len(data), nil
+		}
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	w.decide(false)
+	if w.encoder != nil {
+		_ = w.encoder.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide 决定是否压缩并写出响应头和已经缓存的数据
+func (w *compressWriter) decide(compress bool) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	if compress {
+		header := w.Header()
+		header.Set("Content-Encoding", w.encoding)
+		header.Add("Vary", "Accept-Encoding")
+		header.Del("Content-Length")
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+
+	if compress {
+		w.encoder = getEncoder(w.encoding, w.ResponseWriter)
+		_, _ = w.encoder.Write(w.buffer.Bytes())
+	} else if w.buffer.Len() > 0 {
+		_, _ = w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+	w.buffer.Reset()
+}
+
+func (w *compressWriter) close() {
+	w.decide(false)
+	if w.encoder != nil {
+		err := w.encoder.Close()
+		if err != nil {
+			slog.Warnf("failed to compress response: %v", err)
+		}
+		putEncoder(w.encoding, w.encoder)
+		w.encoder = nil
+	}
+}
+
+func isJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json")
+}
+
+// compressMiddleware 根据 Accept-Encoding 使用 zstd 或 gzip 压缩超过阈值的 JSON 响应
+func compressMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if compressThreshold <= 0 || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = cw
+		defer func() {
+			cw.close()
+			c.Writer = cw.ResponseWriter
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0", ""},
+		{"*", "zstd"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, negotiateEncoding(tt.accept), tt.accept)
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady, threshold := storage, ready.Load(), compressThreshold
+	storage, compressThreshold = fss, 256
+	ready.Store(true)
+	defer func() {
+		storage, compressThreshold = old, threshold
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, encoding, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authPassword)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	large := `{"content":"` + strings.Repeat("urnadb ", 200) + `"}`
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "/text/large", "", large).Code)
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "/text/small", "", `{"content":"hi"}`).Code)
+
+	plain := request(http.MethodGet, "/text/large", "", "")
+	assert.Equal(t, http.StatusOK, plain.Code)
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+
+	w := request(http.MethodGet, "/text/large", "gzip", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	gr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(gr)
+	assert.NoError(t, err)
+	assert.Equal(t, plain.Body.String(), string(body))
+
+	w = request(http.MethodGet, "/text/large", "gzip, zstd", "")
+	assert.Equal(t, "zstd", w.Header().Get("Content-Encoding"))
+	zr, err := zstd.NewReader(w.Body)
+	assert.NoError(t, err)
+	defer zr.Close()
+	body, err = io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, plain.Body.String(), string(body))
+
+	// 小于阈值的响应和非 JSON 响应不压缩
+	w = request(http.MethodGet, "/text/small", "gzip", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Contains(t, w.Body.String(), "hi")
+
+	w = request(http.MethodGet, "/console", "gzip", "")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	w = request(http.MethodDelete, "/text/small", "gzip", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
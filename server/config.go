@@ -0,0 +1,117 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/gin-gonic/gin"
+)
+
+// authorHeader 是修改配置时记录的操作人，没有设置时只记录客户端 IP
+const authorHeader = "X-Author"
+
+// configs 保存配置历史和把配置应用到运行中服务器的函数
+var configs struct {
+	history *conf.History
+	apply   conf.ApplyFunc
+}
+
+// configAuthor 返回配置修改的操作人，格式为 name@ip
+func configAuthor(ctx *gin.Context) string {
+	if name := ctx.GetHeader(authorHeader); name != "" {
+		return name + "@" + ctx.ClientIP()
+	}
+	return ctx.ClientIP()
+}
+
+func configDisabled(ctx *gin.Context) bool {
+	if configs.history == nil {
+		respondError(ctx, CodeFeatureDisabled, "configuration history is not enabled.")
+		return true
+	}
+	return false
+}
+
+// GetConfigController 返回当前生效的配置，密码和密钥已经被隐藏
+func GetConfigController(ctx *gin.Context) {
+	if configDisabled(ctx) {
+		return
+	}
+
+	versions := configs.history.Versions()
+	ctx.IndentedJSON(http.StatusOK, versions[len(versions)-1])
+}
+
+// GetConfigHistoryController 返回全部的配置版本
+func GetConfigHistoryController(ctx *gin.Context) {
+	if configDisabled(ctx) {
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"versions": configs.history.Versions(),
+	})
+}
+
+// PutConfigController 把请求体中的配置项合并到当前配置，应用成功之后记录为新的版本
+func PutConfigController(ctx *gin.Context) {
+	if configDisabled(ctx) {
+		return
+	}
+
+	body, err := io.ReadAll(ctx.Request.Body)
+	next := configs.history.Current()
+	if err == nil {
+		err = json.Unmarshal(body, next)
+	}
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "request body must be a JSON object of configuration changes.")
+		return
+	}
+
+	version, err := configs.history.Apply(next, conf.SourceAdmin, configAuthor(ctx), configs.apply)
+	configResponse(ctx, version, err)
+}
+
+// RollbackConfigController 把配置恢复为历史中的某个版本
+func RollbackConfigController(ctx *gin.Context) {
+	if configDisabled(ctx) {
+		return
+	}
+
+	var req struct {
+		Version uint64 `json:"version"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Version == 0 {
+		respondError(ctx, CodeBadRequest, "version of the configuration history is required.")
+		return
+	}
+
+	version, err := configs.history.Rollback(req.Version, configAuthor(ctx), configs.apply)
+	configResponse(ctx, version, err)
+}
+
+// configResponse 返回应用之后的配置版本，配置错误的错误码由 errorCodeOf 决定
+func configResponse(ctx *gin.Context, version *conf.ConfigVersion, err error) {
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, version)
+}
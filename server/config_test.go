@@ -0,0 +1,108 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigController(t *testing.T) {
+	wasReady := ready.Load()
+	ready.Store(true)
+	defer func() {
+		configs.history, configs.apply = nil, nil
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set(authorHeader, "alice")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "/admin/config/history", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	dir := t.TempDir()
+	opt := new(conf.ServerOptions)
+	assert.NoError(t, opt.Unmarshal([]byte(conf.DefaultConfigJSON)))
+	opt.Path, opt.Password = dir, "config-test-password"
+	history, err := conf.OpenHistory(dir, opt, "root")
+	assert.NoError(t, err)
+
+	var schedule string
+	hts := new(HttpServer)
+	hts.SetConfigHistory(history, func(prev, next *conf.ServerOptions, changes []string) error {
+		if changes[0] != "region.cron" {
+			return fmt.Errorf("%w: %s", conf.ErrRestartRequired, changes[0])
+		}
+		schedule = next.Region.Schedule
+		return nil
+	})
+
+	w = request(http.MethodPut, "/admin/config", `{"region": {"cron": "0 0 4 * * *"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0 0 4 * * *", schedule)
+
+	var version conf.ConfigVersion
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &version))
+	assert.Equal(t, uint64(2), version.Version)
+	assert.Equal(t, "alice@192.0.2.1", version.Author)
+	assert.Equal(t, []string{"region.cron"}, version.Changes)
+
+	w = request(http.MethodPut, "/admin/config", `{"port": 3000}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request(http.MethodPut, "/admin/config", `{"port": 80}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPut, "/admin/config", `[]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 返回的配置中不包含密码
+	w = request(http.MethodGet, "/admin/config", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"cron": "0 0 4 * * *"`)
+	assert.NotContains(t, w.Body.String(), "config-test-password")
+
+	w = request(http.MethodPost, "/admin/config/rollback", `{"version": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0 0 3 * * *", schedule)
+
+	w = request(http.MethodPost, "/admin/config/rollback", `{"version": 9}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var page struct {
+		Versions []conf.ConfigVersion `json:"versions"`
+	}
+	w = request(http.MethodGet, "/admin/config/history", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Versions, 3)
+	assert.Equal(t, conf.SourceRollback, page.Versions[2].Source)
+	assert.Equal(t, uint64(1), page.Versions[2].RollbackTo)
+}
@@ -0,0 +1,458 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+var (
+	//go:embed console
+	consoleFiles embed.FS
+	consoleFS    = mustSubFS(consoleFiles, "console")
+	// 管理员 Token 为空时控制台不开启，/console 返回 404
+	adminToken string
+)
+
+// 控制台静态资源不包含数据，不需要认证，数据接口需要在请求头中携带 Admin-Token
+var consolePaths = map[string]bool{
+	"/console":                  true,
+	"/console/assets/*filepath": true,
+}
+
+// 管理员 Token 只能访问健康检查和 /admin 下的管理接口
+func isAdminPath(path string) bool {
+	return path == "/" || strings.HasPrefix(path, "/admin/")
+}
+
+func mustSubFS(fsys fs.FS, dir string) http.FileSystem {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
+
+// KeyInfo 是控制台浏览 key 时返回的元数据
+type KeyInfo struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Size uint32 `json:"size"`
+	TTL  int64  `json:"ttl"`
+}
+
+func GetConsoleController(ctx *gin.Context) {
+	if adminToken == "" {
+		Error404Handler(ctx)
+		return
+	}
+
+	file, err := consoleFS.Open("index.html")
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.DataFromReader(http.StatusOK, stat.Size(), "text/html; charset=utf-8", file, nil)
+}
+
+func GetConsoleAssetController(ctx *gin.Context) {
+	if adminToken == "" {
+		Error404Handler(ctx)
+		return
+	}
+	ctx.FileFromFS(ctx.Param("filepath"), consoleFS)
+}
+
+// ListKeysController 按照写入顺序分页返回 key，prefix 过滤 key 前缀
+func ListKeysController(ctx *gin.Context) {
+	prefix := ctx.Query("prefix")
+	pageKeys(ctx, func(fn func(seg *vfs.Segment) bool) error {
+		return storage.RangeSegments(func(seg *vfs.Segment) bool {
+			if !strings.HasPrefix(seg.GetKeyString(), prefix) {
+				return true
+			}
+			return fn(seg)
+		})
+	})
+}
+
+// pageKeys 按照 offset 和 limit 查询参数分页返回 scan 遍历到的 key
+func pageKeys(ctx *gin.Context, scan func(fn func(seg *vfs.Segment) bool) error) {
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		respondError(ctx, CodeBadRequest, "offset must be a non-negative integer.")
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultKeysLimit)))
+	if err != nil || limit <= 0 || limit > maxKeysLimit {
+		respondError(ctx, CodeBadRequest, "limit must be between 1 and "+strconv.Itoa(maxKeysLimit)+".")
+		return
+	}
+
+	keys, skipped := make([]KeyInfo, 0, limit), 0
+	// 多取一个用来判断是否还有下一页
+	err = scan(func(seg *vfs.Segment) bool {
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		keys = append(keys, KeyInfo{
+			Key:  seg.GetKeyString(),
+			Type: seg.GetTypeString(),
+			Size: seg.Size(),
+			TTL:  seg.TTL(),
+		})
+		return len(keys) <= limit
+	})
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	more := len(keys) > limit
+	if more {
+		keys = keys[:limit]
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"keys": keys,
+		"more": more,
+	})
+}
+
+// InspectKeyController 返回 key 的元数据和按照数据类型解码之后的值
+func InspectKeyController(ctx *gin.Context) {
+	version, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+
+	seg, err = expandSegment(ctx.Request.Context(), seg)
+	if err != nil {
+		utils.ReleaseToPool(seg)
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	value, err := seg.ToJSON()
+	if err != nil {
+		utils.ReleaseToPool(seg)
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"key":   seg.GetKeyString(),
+		"type":  seg.GetTypeString(),
+		"size":  seg.Size(),
+		"ttl":   seg.TTL(),
+		"mvcc":  version,
+		"lsn":   seg.LSN,
+		"value": json.RawMessage(value),
+	})
+
+	utils.ReleaseToPool(seg)
+}
+
+// PutKeyTTLController 修改 key 的过期时间，ttl 为 0 表示永不过期
+func PutKeyTTLController(ctx *gin.Context) {
+	var req struct {
+		TTL *uint64 `json:"ttl"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.TTL == nil {
+		respondError(ctx, CodeBadRequest, "ttl must be a non-negative integer.")
+		return
+	}
+
+	key := ctx.Param("key")
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	version, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), key)
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+
+	newseg, err := seg.WithTTL(*req.TTL)
+	utils.ReleaseToPool(seg)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	// 封存过分块的列表的清单和分块使用相同的过期时间
+	err = expireQuicklist(ctx.Request.Context(), key, *req.TTL)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	// 使用 CAS 更新，避免覆盖掉读取之后其他客户端写入的数据
+	err = storage.UpdateSegmentWithCASContext(ctx.Request.Context(), key, version, newseg)
+	if err != nil {
+		storageFailed(ctx, CodeConflict, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"key": key,
+		"ttl": newseg.TTL(),
+	})
+}
+
+// GetIndexController 返回索引分片在内存和溢出文件中的分布，keys 参数估算指定数量的 key 全部常驻内存需要的内存
+func GetIndexController(ctx *gin.Context) {
+	stats := storage.IndexStats()
+	if ctx.Query("keys") == "" {
+		ctx.IndentedJSON(http.StatusOK, stats)
+		return
+	}
+
+	keys, err := strconv.ParseUint(ctx.Query("keys"), 10, 64)
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "keys must be a non-negative integer.")
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"index":           stats,
+		"keys":            keys,
+		"estimated_bytes": keys * stats.EntryBytes,
+	})
+}
+
+// GetTieringController 返回本地和对象存储中的 region 数量
+func GetTieringController(ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, storage.TieringStats())
+}
+
+// GetRegionsController 返回每个 region 的 key 数量、有效数据和死数据的大小，用于判断写放大和是否需要回收
+func GetRegionsController(ctx *gin.Context) {
+	regions, err := storage.Regions()
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, regions)
+}
+
+// TieringController 立即把冷数据 region 上传到对象存储
+func TieringController(ctx *gin.Context) {
+	n, err := storage.TierRegions(ctx.Request.Context())
+	if errors.Is(err, vfs.ErrTieringDisabled) {
+		failed(ctx, CodeNotFound, err)
+		return
+	}
+	if errors.Is(err, vfs.ErrTieringRunning) || errors.Is(err, vfs.ErrCompactRunning) {
+		failed(ctx, CodeConflict, err)
+		return
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "cold regions uploaded to object storage.",
+		"regions": n,
+	})
+}
+
+// GetBackupController 返回对象存储中备份的 region 和检查点数量
+func GetBackupController(ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, storage.BackupStats())
+}
+
+// BackupController 立即把新封存的 region 和最新的检查点备份到对象存储
+func BackupController(ctx *gin.Context) {
+	n, err := storage.Backup(ctx.Request.Context())
+	if errors.Is(err, vfs.ErrBackupDisabled) {
+		failed(ctx, CodeNotFound, err)
+		return
+	}
+	if errors.Is(err, vfs.ErrBackupRunning) {
+		failed(ctx, CodeConflict, err)
+		return
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "sealed regions backed up to object storage.",
+		"regions": n,
+	})
+}
+
+// GetRollbackController 返回最新的 LSN 和可以回滚到的最小 LSN
+func GetRollbackController(ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"lsn":     storage.LSN(),
+		"horizon": storage.LSNHorizon(),
+	})
+}
+
+// RollbackController 把 lsn 或者 until 时间之后修改过的 key 回滚到当时的值
+func RollbackController(ctx *gin.Context) {
+	var req struct {
+		LSN   *uint64   `json:"lsn"`
+		Until time.Time `json:"until"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || (req.LSN == nil) == req.Until.IsZero() {
+		respondError(ctx, CodeBadRequest, "exactly one of lsn or until (RFC3339 time) is required.")
+		return
+	}
+
+	var (
+		result *vfs.RollbackResult
+		err    error
+	)
+	if req.LSN != nil {
+		result, err = storage.RestoreToLSN(*req.LSN)
+	} else {
+		result, err = storage.RestoreToTime(req.Until)
+	}
+	if errors.Is(err, vfs.ErrLSNUnavailable) {
+		failed(ctx, CodeConflict, err)
+		return
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, result)
+}
+
+// UndeleteController 把回收站中的 key 恢复到删除之前的值
+func UndeleteController(ctx *gin.Context) {
+	key := ctx.Param("key")
+	err := storage.Undelete(key)
+	if errors.Is(err, vfs.ErrNotInTrash) {
+		failed(ctx, CodeNotFound, err)
+		return
+	}
+	if errors.Is(err, vfs.ErrKeyExists) {
+		failed(ctx, CodeConflict, err)
+		return
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "key restored from trash.",
+		"key":     key,
+	})
+}
+
+// 最多返回的 region 回收计划执行时间个数
+const maxScheduleRuns = 100
+
+// GetCompactScheduleController 返回 region 回收的计划和接下来 n 次执行的时间
+func GetCompactScheduleController(ctx *gin.Context) {
+	n, err := strconv.Atoi(ctx.DefaultQuery("n", "5"))
+	if err != nil || n <= 0 || n > maxScheduleRuns {
+		respondError(ctx, CodeBadRequest, fmt.Sprintf("n must be an integer between 1 and %d.", maxScheduleRuns))
+		return
+	}
+
+	schedule, runs := storage.CompactSchedule(n)
+	next := make([]gin.H, 0, len(runs))
+	for _, run := range runs {
+		next = append(next, gin.H{
+			"at": run,
+			"in": time.Until(run).Round(time.Second).String(),
+		})
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"enabled":  schedule != "",
+		"schedule": schedule,
+		"next":     next,
+	})
+}
+
+// CompactController 立即触发一次 region 垃圾回收
+func CompactController(ctx *gin.Context) {
+	err := storage.CompactRegions()
+	if errors.Is(err, vfs.ErrCompactRunning) || errors.Is(err, vfs.ErrCompactPaused) {
+		failed(ctx, CodeConflict, err)
+		return
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "region compaction completed.",
+	})
+}
+
+// PauseCompactionController 暂停 region 垃圾回收，请求体中可以附带暂停的原因，
+// 正在执行的回收迁移完当前的 region 之后停止
+func PauseCompactionController(ctx *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			respondError(ctx, CodeBadRequest, "reason must be a string.")
+			return
+		}
+	}
+
+	storage.PauseCompaction(req.Reason)
+	ctx.IndentedJSON(http.StatusOK, storage.GCStatus())
+}
+
+// ResumeCompactionController 恢复被暂停的 region 垃圾回收
+func ResumeCompactionController(ctx *gin.Context) {
+	if !storage.ResumeCompaction() {
+		respondError(ctx, CodeConflict, "region compaction is not paused.")
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, storage.GCStatus())
+}
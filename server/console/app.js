@@ -0,0 +1,247 @@
+// UrnaDB admin console, talks to the /admin API with the Admin-Token header.
+(function () {
+  "use strict";
+
+  const PAGE_SIZE = 50;
+  const HISTORY = 60;
+  const HEALTH_INTERVAL = 5000;
+
+  const state = {
+    token: sessionStorage.getItem("urnadb-admin-token") || "",
+    prefix: "",
+    offset: 0,
+    selected: "",
+    timer: null,
+    history: { keys: [], disk: [], mem: [] },
+  };
+
+  const $ = (id) => document.getElementById(id);
+
+  async function api(method, path, body) {
+    const headers = { "Admin-Token": state.token };
+    if (body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    const resp = await fetch(path, {
+      method: method,
+      headers: headers,
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const data = await resp.json().catch(() => ({}));
+    if (resp.status === 401) {
+      logout("Admin token rejected.");
+      throw new Error("unauthorized");
+    }
+    if (!resp.ok) {
+      throw new Error(data.message || resp.statusText);
+    }
+    return data;
+  }
+
+  function status(message, isError) {
+    const el = $("status");
+    el.textContent = message;
+    el.className = isError ? "error" : "muted";
+  }
+
+  function gigabytes(text) {
+    return parseFloat(text) || 0;
+  }
+
+  function push(series, value) {
+    series.push(value);
+    if (series.length > HISTORY) {
+      series.shift();
+    }
+  }
+
+  function draw(canvas, series, max) {
+    const ctx = canvas.getContext("2d");
+    const w = canvas.width;
+    const h = canvas.height;
+    ctx.clearRect(0, 0, w, h);
+    if (series.length < 2) {
+      return;
+    }
+    const top = max || Math.max.apply(null, series) || 1;
+    ctx.strokeStyle = "#ff7b22";
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    series.forEach((v, i) => {
+      const x = (i / (HISTORY - 1)) * w;
+      const y = h - (v / top) * (h - 8) - 4;
+      if (i === 0) {
+        ctx.moveTo(x, y);
+      } else {
+        ctx.lineTo(x, y);
+      }
+    });
+    ctx.stroke();
+  }
+
+  async function refreshHealth() {
+    try {
+      const info = await api("GET", "/");
+      const memTotal = gigabytes(info.mem_total);
+      const memUsed = memTotal > 0 ? ((memTotal - gigabytes(info.mem_free)) / memTotal) * 100 : 0;
+
+      push(state.history.keys, info.key_count);
+      push(state.history.disk, parseFloat(info.disk_percent) || 0);
+      push(state.history.mem, memUsed);
+
+      $("health-summary").innerHTML = "";
+      [
+        ["Version", info.version],
+        ["Keys", info.key_count],
+        ["Disk", info.disk_total ? info.disk_used + " / " + info.disk_total : "n/a"],
+        ["Memory free", info.mem_total ? info.mem_free + " / " + info.mem_total : "n/a"],
+        ["GC state", info.gc_status.state + (info.gc_status.reason ? " (" + info.gc_status.reason + ")" : "")],
+        ["Regions", info.region_count + " (active " + info.active_region + ")"],
+        ["Compaction backlog", (info.compaction_backlog_bytes / 1048576).toFixed(2) + "MB"],
+        ["Uptime", info.uptime_seconds + "s"],
+      ].forEach(([label, value]) => {
+        const item = document.createElement("div");
+        item.textContent = label + ": ";
+        const strong = document.createElement("span");
+        strong.textContent = value;
+        item.appendChild(strong);
+        $("health-summary").appendChild(item);
+      });
+
+      draw($("graph-keys"), state.history.keys);
+      draw($("graph-disk"), state.history.disk, 100);
+      draw($("graph-mem"), state.history.mem, 100);
+    } catch (err) {
+      status("Health: " + err.message, true);
+    }
+  }
+
+  async function loadKeys() {
+    const query = new URLSearchParams({
+      prefix: state.prefix,
+      offset: state.offset,
+      limit: PAGE_SIZE,
+    });
+    try {
+      const data = await api("GET", "/admin/keys?" + query.toString());
+      const body = $("keys");
+      body.innerHTML = "";
+      data.keys.forEach((item) => {
+        const row = document.createElement("tr");
+        [item.key, item.type, item.size, item.ttl < 0 ? "never" : item.ttl + "s"].forEach((value) => {
+          const cell = document.createElement("td");
+          cell.textContent = value;
+          row.appendChild(cell);
+        });
+        row.addEventListener("click", () => inspect(item.key));
+        body.appendChild(row);
+      });
+      $("prev").disabled = state.offset === 0;
+      $("next").disabled = !data.more;
+    } catch (err) {
+      status("Keys: " + err.message, true);
+    }
+  }
+
+  async function inspect(key) {
+    try {
+      const data = await api("GET", "/admin/keys/" + encodeURIComponent(key));
+      state.selected = key;
+      $("inspector-empty").classList.add("hidden");
+      $("inspector-body").classList.remove("hidden");
+      $("inspect-key").textContent = data.key;
+      $("inspect-type").textContent = data.type;
+      $("inspect-size").textContent = data.size + " bytes";
+      $("inspect-mvcc").textContent = data.mvcc;
+      $("ttl").value = data.ttl < 0 ? 0 : data.ttl;
+      $("inspect-value").textContent = JSON.stringify(data.value, null, 2);
+    } catch (err) {
+      status("Inspect: " + err.message, true);
+    }
+  }
+
+  async function saveTTL(event) {
+    event.preventDefault();
+    try {
+      const ttl = parseInt($("ttl").value, 10);
+      await api("PUT", "/admin/keys/" + encodeURIComponent(state.selected) + "/ttl", { ttl: ttl });
+      status("TTL of " + state.selected + " updated.");
+      await inspect(state.selected);
+      await loadKeys();
+    } catch (err) {
+      status("TTL: " + err.message, true);
+    }
+  }
+
+  async function compact() {
+    if (!confirm("Run region compaction now?")) {
+      return;
+    }
+    $("compact").disabled = true;
+    try {
+      const data = await api("POST", "/admin/compact");
+      status(data.message);
+    } catch (err) {
+      status("Compact: " + err.message, true);
+    } finally {
+      $("compact").disabled = false;
+    }
+  }
+
+  function show(loggedIn) {
+    $("login").classList.toggle("hidden", loggedIn);
+    $("app").classList.toggle("hidden", !loggedIn);
+    $("compact").classList.toggle("hidden", !loggedIn);
+    $("logout").classList.toggle("hidden", !loggedIn);
+  }
+
+  function start() {
+    show(true);
+    refreshHealth();
+    loadKeys();
+    state.timer = setInterval(refreshHealth, HEALTH_INTERVAL);
+  }
+
+  function logout(message) {
+    sessionStorage.removeItem("urnadb-admin-token");
+    state.token = "";
+    clearInterval(state.timer);
+    show(false);
+    $("login-error").textContent = message || "";
+  }
+
+  $("login-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    state.token = $("token").value;
+    sessionStorage.setItem("urnadb-admin-token", state.token);
+    $("login-error").textContent = "";
+    start();
+  });
+
+  $("search-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    state.prefix = $("prefix").value;
+    state.offset = 0;
+    loadKeys();
+  });
+
+  $("prev").addEventListener("click", () => {
+    state.offset = Math.max(0, state.offset - PAGE_SIZE);
+    loadKeys();
+  });
+
+  $("next").addEventListener("click", () => {
+    state.offset += PAGE_SIZE;
+    loadKeys();
+  });
+
+  $("ttl-form").addEventListener("submit", saveTTL);
+  $("compact").addEventListener("click", compact);
+  $("logout").addEventListener("click", () => logout());
+
+  if (state.token) {
+    start();
+  } else {
+    show(false);
+  }
+})();
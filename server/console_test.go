@@ -0,0 +1,241 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsole(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady, password := storage, ready.Load(), authPassword
+	storage, authPassword = fss, "console-test-password"
+	ready.Store(true)
+	defer func() {
+		storage, authPassword, adminToken = old, password, ""
+		ready.Store(wasReady)
+	}()
+
+	for _, key := range []string{"user:1", "user:2", "order:1"} {
+		seg, err := vfs.NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Admin-Token", token)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	// 没有设置管理员 Token 时控制台不开启
+	w := request(http.MethodGet, "/console", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	adminToken = "console-admin-token"
+
+	w = request(http.MethodGet, "/console", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "UrnaDB Console")
+
+	w = request(http.MethodGet, "/console/assets/app.js", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 管理接口需要正确的管理员 Token
+	w = request(http.MethodGet, "/admin/keys", "wrong-token", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 管理员 Token 不能访问数据接口
+	w = request(http.MethodGet, "/text/user:1", adminToken, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = request(http.MethodGet, "/admin/keys?prefix=user:&limit=1", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Keys []KeyInfo `json:"keys"`
+		More bool      `json:"more"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, []KeyInfo{{Key: "user:1", Type: "text", Size: page.Keys[0].Size, TTL: -1}}, page.Keys)
+	assert.True(t, page.More)
+
+	w = request(http.MethodGet, "/admin/keys?prefix=user:&offset=1&limit=1", adminToken, "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, "user:2", page.Keys[0].Key)
+	assert.False(t, page.More)
+
+	w = request(http.MethodGet, "/admin/keys/order:1", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"value": "hello"`)
+
+	w = request(http.MethodPut, "/admin/keys/order:1/ttl", adminToken, `{"ttl": 3600}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, seg, err := fss.FetchSegment("order:1")
+	assert.NoError(t, err)
+	assert.InDelta(t, 3600, seg.TTL(), 1)
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", text.Content)
+
+	w = request(http.MethodPut, "/admin/keys/order:1/ttl", adminToken, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/compact", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 暂停期间手动触发回收返回冲突，恢复之后重新可以执行
+	w = request(http.MethodPost, "/admin/compact/pause", adminToken, `{"reason": "peak traffic"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status vfs.CompactionStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "paused", status.State)
+	assert.Equal(t, "peak traffic", status.Reason)
+	assert.Equal(t, vfs.GC_PAUSED, fss.GCState())
+
+	w = request(http.MethodPost, "/admin/compact", adminToken, "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), vfs.ErrCompactPaused.Error())
+
+	w = request(http.MethodPost, "/admin/compact/pause", adminToken, `{"reason": 1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/compact/resume", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "idle", status.State)
+
+	w = request(http.MethodPost, "/admin/compact/resume", adminToken, "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request(http.MethodPost, "/admin/compact/pause", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "paused", fss.GCStatus().State)
+	assert.True(t, fss.ResumeCompaction())
+
+	w = request(http.MethodGet, "/admin/compact/schedule", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"enabled": false`)
+
+	assert.NoError(t, fss.RunCompactRegion("@every 6h"))
+	defer fss.StopCompactRegion()
+
+	w = request(http.MethodGet, "/admin/compact/schedule?n=3", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var schedule struct {
+		Schedule string `json:"schedule"`
+		Next     []struct {
+			In string `json:"in"`
+		} `json:"next"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &schedule))
+	assert.Equal(t, "@every 6h", schedule.Schedule)
+	assert.Len(t, schedule.Next, 3)
+	// @every 的下一次执行时间按秒截断
+	assert.Contains(t, []string{"5h59m59s", "6h0m0s"}, schedule.Next[0].In)
+
+	w = request(http.MethodGet, "/admin/compact/schedule?n=0", adminToken, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodGet, "/admin/regions", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"active": true`)
+	assert.Contains(t, w.Body.String(), `"dead_bytes"`)
+
+	w = request(http.MethodGet, "/admin/index", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var index vfs.IndexStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &index))
+	assert.Equal(t, 3, index.ResidentKeys)
+	assert.Zero(t, index.SpilledShards)
+
+	w = request(http.MethodGet, "/admin/index?keys=1000", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var estimate struct {
+		Estimated uint64 `json:"estimated_bytes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &estimate))
+	assert.Equal(t, 1000*index.EntryBytes, estimate.Estimated)
+
+	w = request(http.MethodGet, "/admin/index?keys=-1", adminToken, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/tiering", adminToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodGet, "/admin/tiering", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"remote_regions": 0`)
+
+	w = request(http.MethodPost, "/admin/backup", adminToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodGet, "/admin/backup", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"regions": 0`)
+
+	// 回滚掉修改过期时间的写入
+	w = request(http.MethodGet, "/admin/rollback", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"lsn": 4`)
+
+	w = request(http.MethodPost, "/admin/rollback", adminToken, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/rollback", adminToken, `{"lsn": 3}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"lsn": 3, "restored": 1, "deleted": 0}`, w.Body.String())
+
+	_, seg, err = fss.FetchSegment("order:1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), seg.TTL())
+
+	// 没有开启回收站时删除的 key 不能恢复
+	w = request(http.MethodPost, "/admin/undelete/order:1", adminToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.NoError(t, fss.SetTrash(time.Hour))
+	assert.NoError(t, fss.DeleteSegment("order:1"))
+	w = request(http.MethodPost, "/admin/undelete/order:1", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "restored from trash")
+
+	w = request(http.MethodPost, "/admin/undelete/order:1", adminToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	_, _, err = fss.FetchSegment("order:1")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 浏览器可以读取的响应头，用于乐观锁和集群中定位 key 所在的节点
+var corsExposeHeaders = strings.Join([]string{"ETag", ownerHeader}, ", ")
+
+// corsPolicy 是编译之后的跨域配置
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	methods     string
+	headers     string
+	credentials bool
+	maxAge      string
+}
+
+// 为 nil 时不处理跨域请求，浏览器按照同源策略拒绝
+var corsRules atomic.Pointer[corsPolicy]
+
+func newCORSPolicy(origins, methods, headers []string, credentials bool, maxAge int) *corsPolicy {
+	policy := &corsPolicy{
+		origins:     make(map[string]bool, len(origins)),
+		methods:     strings.Join(methods, ", "),
+		headers:     strings.Join(headers, ", "),
+		credentials: credentials,
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			policy.anyOrigin = true
+		}
+		policy.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if maxAge > 0 {
+		policy.maxAge = strconv.Itoa(maxAge)
+	}
+	return policy
+}
+
+// corsMiddleware 在认证之前处理跨域请求，预检请求不带认证信息，直接返回 204。
+// 来源不在列表中的请求不设置跨域响应头，由浏览器拒绝
+func corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := corsRules.Load()
+		origin := c.GetHeader("Origin")
+		if policy == nil || origin == "" {
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Add("Vary", "Origin")
+		if !policy.anyOrigin && !policy.origins[origin] {
+			c.Next()
+			return
+		}
+
+		if policy.anyOrigin {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if policy.credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", policy.methods)
+			header.Set("Access-Control-Allow-Headers", policy.headers)
+			if policy.maxAge != "" {
+				header.Set("Access-Control-Max-Age", policy.maxAge)
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		header.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		c.Next()
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	hs := new(HttpServer)
+	defer hs.SetCORS(nil, nil, nil, false, 0)
+
+	request := func(method, path, origin string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "Auth-Token, Content-Type",
+	}
+
+	// 没有开启时不返回跨域响应头
+	w := request(http.MethodOptions, "/text/greeting", "https://app.example.com", preflight)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	hs.SetCORS([]string{"https://app.example.com"}, []string{"GET", "PUT"}, []string{"Auth-Token", "Content-Type"}, true, 600)
+
+	// 预检请求不需要认证
+	w = request(http.MethodOptions, "/text/greeting", "https://app.example.com", preflight)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, PUT", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Auth-Token, Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+
+	// 实际请求仍然需要认证，错误响应也带有跨域响应头，浏览器才能读取
+	w = request(http.MethodGet, "/livez", "https://app.example.com", nil)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "ETag")
+	w = request(http.MethodGet, "/text/greeting", "https://app.example.com", map[string]string{"Auth-Token": "wrong-password"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// 不在列表中的来源
+	w = request(http.MethodOptions, "/text/greeting", "https://evil.example.com", preflight)
+	assert.NotEqual(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	hs.SetCORS([]string{"*"}, []string{"GET"}, nil, false, 0)
+	w = request(http.MethodOptions, "/text/greeting", "https://any.example.com", preflight)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Empty(t, w.Header().Get("Access-Control-Max-Age"))
+}
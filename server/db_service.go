@@ -15,8 +15,15 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/auula/urnadb/types"
 	"github.com/auula/urnadb/utils"
@@ -26,481 +33,1086 @@ import (
 
 var storage *vfs.LogStructuredFS
 
-func GetCollectionController(ctx *gin.Context) {
-	_, seg, err := storage.FetchSegment(ctx.Param("key"))
-	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+// isDeadline 判断存储操作是否因为请求超时或者客户端断开而被放弃
+func isDeadline(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// storageFailed 根据写入失败的原因返回响应，请求超时或者客户端断开时返回 504，
+// 存储系统没有定义的错误使用 fallback 错误码
+func storageFailed(ctx *gin.Context, fallback ErrorCode, err error) {
+	if isDeadline(err) {
+		respondError(ctx, CodeDeadlineExceeded, "request deadline exceeded.")
 		return
 	}
+	failed(ctx, fallback, err)
+}
 
-	collection, err := seg.ToCollection()
-	if err != nil {
-		utils.ReleaseToPool(seg)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+// fetchFailed 根据读取失败的原因返回响应，数据校验失败不能被当作 key 不存在
+func fetchFailed(ctx *gin.Context, err error) {
+	if isDeadline(err) {
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, gin.H{
-		"collection": collection.Collection,
-	})
+	var cerr *vfs.CorruptedError
+	if errors.As(err, &cerr) {
+		requestLog(ctx).Errorf("Failed to read key %s: %v", cerr.Key, err)
+		respondError(ctx, CodeDataCorrupted, "key data corrupted.")
+		return
+	}
 
-	// 使用完返回回去
-	utils.ReleaseToPool(seg, collection)
+	if !errors.Is(err, vfs.ErrKeyNotFound) {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	respondError(ctx, CodeKeyNotFound, "key data not found.")
 }
 
-func PutCollectionController(ctx *gin.Context) {
+// missingOK 解析 missing_ok 参数，为 true 时删除不存在的 key 也返回 204
+func missingOK(ctx *gin.Context) (bool, bool) {
+	ok, err := strconv.ParseBool(ctx.DefaultQuery("missing_ok", "false"))
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "missing_ok must be a boolean.")
+		return false, false
+	}
+	return ok, true
+}
+
+// deleteKey 是所有类型共用的删除流程，删除成功返回 204 并且没有响应体，key 不存在时返回 404 并且不写入墓碑，
+// 重复的删除请求不会改变存储的状态，客户端重试时可以使用 missing_ok=true 得到相同的响应
+func deleteKey(ctx *gin.Context) {
+	missing, valid := missingOK(ctx)
+	if !valid {
+		return
+	}
+
 	key := ctx.Param("key")
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if _, exists := storage.StatSegment(key); !exists {
+		if missing {
+			ctx.Status(http.StatusNoContent)
+			return
+		}
+		respondError(ctx, CodeKeyNotFound, "key data not found.")
+		return
+	}
 
-	collection := types.AcquireCollection()
-	err := ctx.ShouldBindJSON(collection)
+	err := storage.DeleteSegmentContext(ctx.Request.Context(), key)
 	if err != nil {
-		utils.ReleaseToPool(collection)
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	seg, err := vfs.AcquirePoolSegment(key, collection, collection.TTL)
+	// 删除 Collection 时一起删除封存的分块
+	err = dropQuicklist(ctx.Request.Context(), key)
 	if err != nil {
-		utils.ReleaseToPool(collection)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	ctx.Status(http.StatusNoContent)
+}
+
+// 每种类型在 JSON 请求体中对应的字段名
+var valueFields = map[string]string{
+	"set":        "set",
+	"zset":       "zset",
+	"text":       "content",
+	"table":      "table",
+	"number":     "number",
+	"collection": "collection",
+}
+
+// decodeValue 把一个通用的值转换为指定类型的数据结构，
+// Set 类型既可以是成员数组，也可以是 {member: true} 形式的对象。
+func decodeValue(kind string, value any) (vfs.Serializable, error) {
+	field, ok := valueFields[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported value type: %s", kind)
+	}
+
+	if members, ok := value.([]any); ok && kind == "set" {
+		set := make(map[string]bool, len(members))
+		for _, member := range members {
+			set[fmt.Sprint(member)] = true
+		}
+		value = set
+	}
+
+	document, err := json.Marshal(map[string]any{field: value})
 	if err != nil {
-		utils.ReleaseToPool(seg, collection)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
-		return
+		return nil, err
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "request processed succeed.",
-	})
+	var data vfs.Serializable
+	switch kind {
+	case "set":
+		data = types.NewSet()
+	case "zset":
+		data = types.NewZSet()
+	case "text":
+		data = types.NewText("")
+	case "table":
+		data = types.NewTable()
+	case "number":
+		data = types.NewNumber(0)
+	case "collection":
+		data = types.NewCollection()
+	}
 
-	// 放回到复用池里
-	utils.ReleaseToPool(seg, collection)
+	err = decodeJSON(bytes.NewReader(document), data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", kind, err)
+	}
+
+	return data, nil
 }
 
-func DeleteCollectionController(ctx *gin.Context) {
+func GetCollectionController(ctx *gin.Context) {
+	// 带有范围参数时只返回部分项目，时间线这类列表不需要下载整个列表
+	for _, name := range []string{"start", "end", "reverse"} {
+		if _, ok := ctx.GetQuery(name); ok {
+			getCollectionRange(ctx)
+			return
+		}
+	}
+	// 封存过分块的列表需要拼接分块和尾部
+	if _, sealed := storage.StatSegment(quicklistMetaKey(ctx.Param("key"))); sealed {
+		getCollectionRange(ctx)
+		return
+	}
+	collectionType.get(ctx)
+}
+
+// getCollectionRange 返回下标在 [start, end] 之间的项目，负数下标从末尾开始计算，
+// reverse 为 true 时下标从最后一项开始计算并且倒序返回
+func getCollectionRange(ctx *gin.Context) {
+	start, err := strconv.Atoi(ctx.DefaultQuery("start", "0"))
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "start must be an integer.")
+		return
+	}
+
+	end, err := strconv.Atoi(ctx.DefaultQuery("end", "-1"))
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "end must be an integer.")
+		return
+	}
+
+	reverse, err := strconv.ParseBool(ctx.DefaultQuery("reverse", "false"))
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "reverse must be a boolean.")
+		return
+	}
+
 	key := ctx.Param("key")
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), key)
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	if seg.Type != vfs.Collection {
+		respondError(ctx, CodeTypeMismatch, "key data is not a collection.")
+		return
+	}
+	setRevision(ctx, seg)
 
-	err := storage.DeleteSegment(key)
+	// 只读取范围覆盖到的分块
+	view, err := loadCollectionView(ctx.Request.Context(), key, seg)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		storageFailed(ctx, CodeInternal, err)
+		return
 	}
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "delete data succeed.",
+	items, err := view.rangeItems(ctx.Request.Context(), start, end, reverse)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, gin.H{
+		"collection": items,
+		"total":      view.size(),
 	})
 }
 
+func PutCollectionController(ctx *gin.Context) {
+	collectionType.put(ctx)
+}
+
+func DeleteCollectionController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+// 分页读取 table 时每页默认和最多返回的字段数
+const (
+	defaultTableLimit = 100
+	maxTableLimit     = 1000
+)
+
 func GetTableController(ctx *gin.Context) {
-	_, seg, err := storage.FetchSegment(ctx.Param("key"))
+	// 带有分页参数时只返回部分字段，避免一次序列化整个大 table
+	for _, name := range []string{"offset", "limit", "fields"} {
+		if _, ok := ctx.GetQuery(name); ok {
+			getTablePage(ctx)
+			return
+		}
+	}
+	tableType.get(ctx)
+}
+
+// getTablePage 按照字段名排序之后返回 offset 开始的 limit 个字段，fields 只返回指定的字段
+func getTablePage(ctx *gin.Context) {
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		respondError(ctx, CodeBadRequest, "offset must be a non-negative integer.")
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultTableLimit)))
+	if err != nil || limit <= 0 || limit > maxTableLimit {
+		respondError(ctx, CodeBadRequest, "limit must be between 1 and "+strconv.Itoa(maxTableLimit)+".")
+		return
+	}
+
+	var fields []string
+	for _, field := range strings.Split(ctx.Query("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchFailed(ctx, err)
 		return
 	}
+	defer utils.ReleaseToPool(seg)
 
-	tab, err := seg.ToTable()
+	if seg.Type != vfs.Table {
+		respondError(ctx, CodeTypeMismatch, "key data is not a table.")
+		return
+	}
+	setRevision(ctx, seg)
+
+	page, err := seg.ToTablePage(offset, limit, fields)
 	if err != nil {
-		utils.ReleaseToPool(seg)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, gin.H{
-		"table": tab.Table,
+	render(ctx, http.StatusOK, gin.H{
+		"table": page.Entries,
+		"total": page.Total,
+		"more":  page.More,
 	})
-
-	utils.ReleaseToPool(seg, tab)
 }
 
 func PutTableController(ctx *gin.Context) {
-	key := ctx.Param("key")
+	tableType.put(ctx)
+}
+
+func DeleteTableController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+func GetZsetController(ctx *gin.Context) {
+	zsetType.get(ctx)
+}
+
+func PutZsetController(ctx *gin.Context) {
+	zsetType.put(ctx)
+}
+
+func DeleteZsetController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+func GetTextController(ctx *gin.Context) {
+	textType.get(ctx)
+}
+
+func PutTextController(ctx *gin.Context) {
+	textType.put(ctx)
+}
+
+func DeleteTextController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+func GetNumberController(ctx *gin.Context) {
+	numberType.get(ctx)
+}
+
+func PutNumberController(ctx *gin.Context) {
+	numberType.put(ctx)
+}
+
+func DeleteNumberController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+func GetSetController(ctx *gin.Context) {
+	setType.get(ctx)
+}
+
+func PutSetController(ctx *gin.Context) {
+	setType.put(ctx)
+}
+
+func DeleteSetController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+func QueryController(ctx *gin.Context) {
+	version, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+	seg, err = expandSegment(ctx.Request.Context(), seg)
+	defer utils.ReleaseToPool(seg)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	body := gin.H{
+		"type":  seg.GetTypeString(),
+		"key":   seg.GetKeyString(),
+		"codec": seg.GetCodecString(),
+		"value": seg.ToBytes(),
+		"ttl":   seg.TTL(),
+		"mvcc":  version,
+	}
+	if seg.IsIntSet() {
+		body["encoding"] = "intset"
+	}
+	render(ctx, http.StatusOK, body)
+}
 
-	tab := types.AcquireTable()
-	err := ctx.ShouldBindJSON(tab)
+// ExistsController 只查询内存索引判断 key 是否存在并且没有过期，不读取磁盘也不返回响应体
+func ExistsController(ctx *gin.Context) {
+	if _, ok := storage.StatSegment(ctx.Param("key")); !ok {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// GetMetaController 返回 key 的元数据和存储位置，不读取也不解码 value
+func GetMetaController(ctx *gin.Context) {
+	meta, err := storage.StatKey(ctx.Request.Context(), ctx.Param("key"))
 	if err != nil {
-		utils.ReleaseToPool(tab)
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		fetchFailed(ctx, err)
 		return
 	}
 
-	seg, err := vfs.AcquirePoolSegment(key, tab, tab.TTL)
+	render(ctx, http.StatusOK, meta)
+}
+
+func GetHealthController(ctx *gin.Context) {
+	health, err := newHealth(storage.GetDirectory())
 	if err != nil {
-		utils.ReleaseToPool(tab)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	engine, err := storage.EngineStats()
 	if err != nil {
-		utils.ReleaseToPool(seg, tab)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "request processed succeed.",
-	})
+	// 没有生成过检查点时为 -1
+	checkpointAge := int64(-1)
+	if !engine.LastCheckpoint.IsZero() {
+		checkpointAge = int64(time.Since(engine.LastCheckpoint).Seconds())
+	}
 
-	utils.ReleaseToPool(seg, tab)
+	info := SystemInfo{
+		Version:           version,
+		GCState:           storage.GCState(),
+		GCStatus:          storage.GCStatus(),
+		KeyCount:          storage.KeysCount(),
+		ActiveRegion:      engine.ActiveRegion,
+		RegionCount:       engine.Regions,
+		CompactionBacklog: engine.CompactionBacklog,
+		CheckpointAge:     checkpointAge,
+		IndexMemory:       engine.IndexMemory,
+		IndexSpilled:      engine.IndexSpilled,
+		Uptime:            int64(time.Since(startedAt).Seconds()),
+		RecoveryDuration:  engine.Recovery.Seconds(),
+	}
+	if health.HasDisk() {
+		info.DiskFree = fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetFreeDisk()))
+		info.DiskUsed = fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetUsedDisk()))
+		info.DiskTotal = fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetTotalDisk()))
+		info.DiskPercent = fmt.Sprintf("%.2f%%", health.GetDiskPercent())
+	}
+	if health.HasMemory() {
+		info.MemoryFree = fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetFreeMemory()))
+		info.MemoryTotal = fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetTotalMemory()))
+	}
+
+	render(ctx, http.StatusOK, info)
 }
 
-func DeleteTableController(ctx *gin.Context) {
-	key := ctx.Param("key")
+func Error404Handler(ctx *gin.Context) {
+	respondError(ctx, CodeNotFound, "Oops! 404 Not Found!")
+}
 
-	err := storage.DeleteSegment(key)
+func GetStreamController(ctx *gin.Context) {
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		fetchFailed(ctx, err)
+		return
 	}
+	setRevision(ctx, seg)
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "delete data succeed.",
+	stream, err := seg.ToStream()
+	if err != nil {
+		utils.ReleaseToPool(seg)
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	count, _ := strconv.Atoi(ctx.Query("count"))
+	entries, err := stream.Range(ctx.Query("start"), ctx.Query("end"), count)
+	if err != nil {
+		utils.ReleaseToPool(seg, stream)
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, gin.H{
+		"stream": entries,
+		"groups": stream.Groups,
 	})
+
+	utils.ReleaseToPool(seg, stream)
 }
 
-func GetZsetController(ctx *gin.Context) {
-	_, seg, err := storage.FetchSegment(ctx.Param("key"))
+func PutStreamController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	stream := types.AcquireStream()
+	err := bindBody(ctx, stream)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		utils.ReleaseToPool(stream)
+		failed(ctx, CodeBadRequest, err)
 		return
 	}
 
-	zset, err := seg.ToZSet()
+	seg, err := vfs.AcquirePoolSegment(key, stream, stream.TTL)
 	if err != nil {
-		utils.ReleaseToPool(seg)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		utils.ReleaseToPool(stream)
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, gin.H{
-		"list": zset.ZSet,
+	version, err := putSegment(ctx.Request.Context(), key, seg)
+	if err != nil {
+		utils.ReleaseToPool(seg, stream)
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	putSucceed(ctx, version, seg)
+
+	utils.ReleaseToPool(seg, stream)
+}
+
+func DeleteStreamController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+// fetchStream 读取 key 对应的 Stream 和版本号，key 不存在时返回一个新的 Stream
+func fetchStream(ctx context.Context, key string) (*types.Stream, uint64, uint64, bool, error) {
+	version, seg, err := storage.FetchSegmentContext(ctx, key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return types.AcquireStream(), 0, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	stream, err := seg.ToStream()
+	if err != nil {
+		return nil, 0, 0, true, err
+	}
+
+	return stream, version, remainingTTL(seg), true, nil
+}
+
+// remainingTTL 返回 Segment 剩余的存活秒数，用于读改写时保留原有的过期时间
+func remainingTTL(seg *vfs.Segment) uint64 {
+	if seg.TTL() > 0 {
+		return uint64(seg.TTL())
+	}
+	return 0
+}
+
+// saveSegment 通过 MVCC 版本号把读改写之后的数据写回，避免并发修改时相互覆盖
+func saveSegment(ctx context.Context, key string, data vfs.Serializable, version, ttl uint64, exists bool) error {
+	seg, err := vfs.AcquirePoolSegment(key, data, ttl)
+	if err != nil {
+		return err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	return storeSegment(ctx, key, seg, version, exists)
+}
+
+// storeSegment 检查命名空间配额之后写入已经编码的 segment，key 已经存在时使用 CAS 更新
+func storeSegment(ctx context.Context, key string, seg *vfs.Segment, version uint64, exists bool) error {
+	return withQuota(key, int64(seg.Size()), func() error {
+		if exists {
+			return storage.UpdateSegmentWithCASContext(ctx, key, version, seg)
+		}
+
+		_, err := storage.PutSegmentContext(ctx, key, seg)
+		return err
 	})
+}
 
-	utils.ReleaseToPool(seg, zset)
+// putSegment 检查命名空间配额之后覆盖写入 segment，返回新的版本号
+func putSegment(ctx context.Context, key string, seg *vfs.Segment) (uint64, error) {
+	var version uint64
+	err := withQuota(key, int64(seg.Size()), func() (err error) {
+		version, err = storage.PutSegmentContext(ctx, key, seg)
+		return err
+	})
+	return version, err
 }
 
-func PutZsetController(ctx *gin.Context) {
+func AddStreamController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	zset := types.AcquireZSet()
-	err := ctx.ShouldBindJSON(zset)
+	var body struct {
+		Fields map[string]any `json:"fields" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
 	if err != nil {
-		utils.ReleaseToPool(zset)
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		failed(ctx, CodeBadRequest, err)
 		return
 	}
 
-	seg, err := vfs.AcquirePoolSegment(key, zset, zset.TTL)
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
+		return
+	}
+
+	stream, version, ttl, exists, err := fetchStream(ctx.Request.Context(), key)
 	if err != nil {
-		utils.ReleaseToPool(zset)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	id := stream.Append(body.Fields)
+
+	err = saveSegment(ctx.Request.Context(), key, stream, version, ttl, exists)
 	if err != nil {
-		utils.ReleaseToPool(seg, zset)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		utils.ReleaseToPool(stream)
+		storageFailed(ctx, CodeConflict, err)
 		return
 	}
 
 	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "request processed succeed.",
+		"id": id,
 	})
 
-	utils.ReleaseToPool(seg, zset)
+	utils.ReleaseToPool(stream)
 }
 
-func DeleteZsetController(ctx *gin.Context) {
+func ReadStreamGroupController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	stream, version, ttl, exists, err := fetchStream(ctx.Request.Context(), key)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		storageFailed(ctx, CodeInternal, err)
+		return
 	}
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "delete data succeed.",
+	if !exists {
+		utils.ReleaseToPool(stream)
+		respondError(ctx, CodeKeyNotFound, "key data not found.")
+		return
+	}
+
+	count, _ := strconv.Atoi(ctx.Query("count"))
+	entries := stream.ReadGroup(ctx.Param("group"), count)
+
+	// 只有偏移量发生变化时才需要写回
+	if len(entries) > 0 {
+		err = saveSegment(ctx.Request.Context(), key, stream, version, ttl, exists)
+		if err != nil {
+			utils.ReleaseToPool(stream)
+			storageFailed(ctx, CodeConflict, err)
+			return
+		}
+	}
+
+	render(ctx, http.StatusOK, gin.H{
+		"stream": entries,
 	})
+
+	utils.ReleaseToPool(stream)
 }
 
-func GetTextController(ctx *gin.Context) {
-	_, seg, err := storage.FetchSegment(ctx.Param("key"))
+func GetHLLController(ctx *gin.Context) {
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchFailed(ctx, err)
 		return
 	}
+	setRevision(ctx, seg)
 
-	text, err := seg.ToText()
+	hll, err := seg.ToHLL()
 	if err != nil {
 		utils.ReleaseToPool(seg)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, gin.H{
-		"text": text.Content,
+	render(ctx, http.StatusOK, gin.H{
+		"hll": hll.Count(),
 	})
 
-	utils.ReleaseToPool(seg, text)
+	utils.ReleaseToPool(seg, hll)
 }
 
-func PutTextController(ctx *gin.Context) {
+func PutHLLController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	text := types.AcquireText()
-	err := ctx.ShouldBindJSON(text)
+	hll := types.AcquireHLL()
+	err := bindBody(ctx, hll)
 	if err != nil {
-		utils.ReleaseToPool(text)
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		utils.ReleaseToPool(hll)
+		failed(ctx, CodeBadRequest, err)
 		return
 	}
 
-	seg, err := vfs.AcquirePoolSegment(key, text, text.TTL)
+	for _, member := range hll.Members {
+		hll.Add(member)
+	}
+
+	seg, err := vfs.AcquirePoolSegment(key, hll, hll.TTL)
 	if err != nil {
-		utils.ReleaseToPool(text)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		utils.ReleaseToPool(hll)
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	version, err := putSegment(ctx.Request.Context(), key, seg)
 	if err != nil {
-		utils.ReleaseToPool(seg, text)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		utils.ReleaseToPool(seg, hll)
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "request processed succeed.",
-	})
+	putSucceed(ctx, version, seg)
 
-	utils.ReleaseToPool(seg, text)
+	utils.ReleaseToPool(seg, hll)
 }
 
-func DeleteTextController(ctx *gin.Context) {
-	key := ctx.Param("key")
+func DeleteHLLController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
 
-	err := storage.DeleteSegment(key)
+// fetchHLL 读取 key 对应的 HLL 和版本号，key 不存在时返回一个新的 HLL
+func fetchHLL(ctx context.Context, key string) (*types.HLL, uint64, uint64, bool, error) {
+	version, seg, err := storage.FetchSegmentContext(ctx, key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return types.AcquireHLL(), 0, 0, false, nil
+	}
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		return nil, 0, 0, false, err
 	}
+	defer utils.ReleaseToPool(seg)
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "delete data succeed.",
-	})
+	hll, err := seg.ToHLL()
+	if err != nil {
+		return nil, 0, 0, true, err
+	}
+
+	return hll, version, remainingTTL(seg), true, nil
 }
 
-func GetNumberController(ctx *gin.Context) {
-	_, seg, err := storage.FetchSegment(ctx.Param("key"))
+func AddHLLController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var body struct {
+		Members []string `json:"members" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
 		return
 	}
 
-	number, err := seg.ToNumber()
+	hll, version, ttl, exists, err := fetchHLL(ctx.Request.Context(), key)
 	if err != nil {
-		utils.ReleaseToPool(seg)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, gin.H{
-		"number": number.Value,
+	changed := false
+	for _, member := range body.Members {
+		if hll.Add(member) {
+			changed = true
+		}
+	}
+
+	if changed || !exists {
+		err = saveSegment(ctx.Request.Context(), key, hll, version, ttl, exists)
+		if err != nil {
+			utils.ReleaseToPool(hll)
+			storageFailed(ctx, CodeConflict, err)
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"hll":     hll.Count(),
+		"changed": changed,
 	})
 
-	utils.ReleaseToPool(seg, number)
+	utils.ReleaseToPool(hll)
 }
 
-func PutNumberController(ctx *gin.Context) {
+func MergeHLLController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	number := types.AcquireNumber()
-	err := ctx.ShouldBindJSON(number)
+	var body struct {
+		Keys []string `json:"keys" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
 	if err != nil {
-		utils.ReleaseToPool(number)
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		failed(ctx, CodeBadRequest, err)
 		return
 	}
 
-	seg, err := vfs.AcquirePoolSegment(key, number, number.TTL)
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
+		return
+	}
+
+	hll, version, ttl, exists, err := fetchHLL(ctx.Request.Context(), key)
 	if err != nil {
-		utils.ReleaseToPool(number)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	for _, source := range body.Keys {
+		_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), source)
+		if err != nil {
+			utils.ReleaseToPool(hll)
+			if !errors.Is(err, vfs.ErrKeyNotFound) {
+				fetchFailed(ctx, err)
+				return
+			}
+			e := newAPIError(ctx, CodeKeyNotFound, fmt.Sprintf("source key %s not found.", source))
+			e.Key = source
+			ctx.JSON(e.Status(), e)
+			return
+		}
+
+		other, err := seg.ToHLL()
+		utils.ReleaseToPool(seg)
+		if err != nil {
+			utils.ReleaseToPool(hll)
+			failed(ctx, CodeBadRequest, err)
+			return
+		}
+
+		err = hll.Merge(other)
+		utils.ReleaseToPool(other)
+		if err != nil {
+			utils.ReleaseToPool(hll)
+			failed(ctx, CodeInternal, err)
+			return
+		}
+	}
+
+	err = saveSegment(ctx.Request.Context(), key, hll, version, ttl, exists)
 	if err != nil {
-		utils.ReleaseToPool(seg, number)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		utils.ReleaseToPool(hll)
+		storageFailed(ctx, CodeConflict, err)
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "request processed succeed.",
+	ctx.JSON(http.StatusOK, gin.H{
+		"hll": hll.Count(),
 	})
 
-	utils.ReleaseToPool(seg, number)
+	utils.ReleaseToPool(hll)
 }
 
-func DeleteNumberController(ctx *gin.Context) {
-	key := ctx.Param("key")
+// 默认的消息不可见时间
+const defaultVisibility = 30 * time.Second
 
-	err := storage.DeleteSegment(key)
+func GetQueueController(ctx *gin.Context) {
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		fetchFailed(ctx, err)
+		return
 	}
+	setRevision(ctx, seg)
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "delete data succeed.",
+	queue, err := seg.ToQueue()
+	if err != nil {
+		utils.ReleaseToPool(seg)
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	render(ctx, http.StatusOK, gin.H{
+		"queue":   queue.Messages,
+		"visible": queue.Visible(),
 	})
+
+	utils.ReleaseToPool(seg, queue)
 }
 
-func GetSetController(ctx *gin.Context) {
-	_, seg, err := storage.FetchSegment(ctx.Param("key"))
+func PutQueueController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var body struct {
+		Queue []any  `json:"queue" binding:"required"`
+		TTL   uint64 `json:"ttl,omitempty"`
+	}
+
+	err := bindBody(ctx, &body)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		failed(ctx, CodeBadRequest, err)
 		return
 	}
 
-	set, err := seg.ToSet()
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	// 覆盖已有的队列时从原来的序号继续，已经投递过的消息 ID 不会被复用，原来的值不是队列时直接覆盖
+	old, _, _, exists, err := fetchQueue(ctx.Request.Context(), key)
+	if err != nil && !exists {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+	var sequence uint64
+	if err == nil {
+		sequence = old.Sequence
+		utils.ReleaseToPool(old)
+	}
+
+	// 重新入队生成消息 ID，避免和客户端传入的 ID 冲突
+	queue := types.AcquireQueue()
+	queue.Sequence = sequence
+	for _, item := range body.Queue {
+		queue.Enqueue(item)
+	}
+
+	seg, err := vfs.AcquirePoolSegment(key, queue, body.TTL)
 	if err != nil {
-		utils.ReleaseToPool(seg)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		utils.ReleaseToPool(queue)
+		failed(ctx, CodeInternal, err)
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{
-		"set": set.Set,
-	})
+	version, err := putSegment(ctx.Request.Context(), key, seg)
+	if err != nil {
+		utils.ReleaseToPool(seg, queue)
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	putSucceed(ctx, version, seg)
 
-	utils.ReleaseToPool(seg, set)
+	utils.ReleaseToPool(seg, queue)
 }
 
-func PutSetController(ctx *gin.Context) {
+func DeleteQueueController(ctx *gin.Context) {
+	deleteKey(ctx)
+}
+
+// fetchQueue 读取 key 对应的 Queue 和版本号，key 不存在时返回一个新的 Queue
+func fetchQueue(ctx context.Context, key string) (*types.Queue, uint64, uint64, bool, error) {
+	version, seg, err := storage.FetchSegmentContext(ctx, key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return types.AcquireQueue(), 0, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	queue, err := seg.ToQueue()
+	if err != nil {
+		return nil, 0, 0, true, err
+	}
+
+	return queue, version, remainingTTL(seg), true, nil
+}
+
+func EnqueueController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	set := types.AcquireSet()
-	err := ctx.ShouldBindJSON(set)
+	var body struct {
+		Body any `json:"body" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
 	if err != nil {
-		utils.ReleaseToPool(set)
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
 		return
 	}
 
-	seg, err := vfs.AcquirePoolSegment(key, set, set.TTL)
+	queue, version, ttl, exists, err := fetchQueue(ctx.Request.Context(), key)
 	if err != nil {
-		utils.ReleaseToPool(set)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		storageFailed(ctx, CodeInternal, err)
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	id := queue.Enqueue(body.Body)
+
+	err = saveSegment(ctx.Request.Context(), key, queue, version, ttl, exists)
 	if err != nil {
-		utils.ReleaseToPool(seg, set)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		utils.ReleaseToPool(queue)
+		storageFailed(ctx, CodeConflict, err)
 		return
 	}
 
 	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "request processed succeed.",
+		"id": id,
 	})
 
-	utils.ReleaseToPool(seg, set)
+	utils.ReleaseToPool(queue)
 }
 
-func DeleteSetController(ctx *gin.Context) {
+func DequeueController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	visibility := defaultVisibility
+	if v := ctx.Query("visibility"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondError(ctx, CodeBadRequest, fmt.Sprintf("invalid visibility timeout: %s", v))
+			return
+		}
+		visibility = d
+	}
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	queue, version, ttl, exists, err := fetchQueue(ctx.Request.Context(), key)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		storageFailed(ctx, CodeInternal, err)
+		return
 	}
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "delete data succeed.",
-	})
-}
+	if !exists {
+		utils.ReleaseToPool(queue)
+		respondError(ctx, CodeKeyNotFound, "key data not found.")
+		return
+	}
 
-func QueryController(ctx *gin.Context) {
-	version, seg, err := storage.FetchSegment(ctx.Param("key"))
+	msg, ok := queue.Dequeue(visibility)
+	if !ok {
+		utils.ReleaseToPool(queue)
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+
+	err = saveSegment(ctx.Request.Context(), key, queue, version, ttl, exists)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		utils.ReleaseToPool(queue)
+		storageFailed(ctx, CodeConflict, err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, gin.H{
-		"type":  seg.GetTypeString(),
-		"key":   seg.GetKeyString(),
-		"value": seg.ToBytes(),
-		"ttl":   seg.TTL(),
-		"mvcc":  version,
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": msg,
 	})
+
+	utils.ReleaseToPool(queue)
 }
 
-func GetHealthController(ctx *gin.Context) {
-	health, err := newHealth(storage.GetDirectory())
+func AckController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var body struct {
+		Receipt string `json:"receipt" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
-	}
-
-	ctx.IndentedJSON(http.StatusOK, SystemInfo{
-		Version:     version,
-		GCState:     storage.GCState(),
-		KeyCount:    storage.KeysCount(),
-		DiskFree:    fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetFreeDisk())),
-		DiskUsed:    fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetUsedDisk())),
-		DiskTotal:   fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetTotalDisk())),
-		MemoryFree:  fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetFreeMemory())),
-		MemoryTotal: fmt.Sprintf("%.2fGB", utils.BytesToGB(health.GetTotalMemory())),
-		DiskPercent: fmt.Sprintf("%.2f%%", health.GetDiskPercent()),
-	})
-}
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
 
-func Error404Handler(ctx *gin.Context) {
-	ctx.JSON(http.StatusNotFound, gin.H{
-		"message": "Oops! 404 Not Found!",
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	queue, version, ttl, exists, err := fetchQueue(ctx.Request.Context(), key)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	if !exists {
+		utils.ReleaseToPool(queue)
+		respondError(ctx, CodeKeyNotFound, "key data not found.")
+		return
+	}
+
+	err = queue.Ack(body.Receipt)
+	if err != nil {
+		utils.ReleaseToPool(queue)
+		failed(ctx, CodeGone, err)
+		return
+	}
+
+	err = saveSegment(ctx.Request.Context(), key, queue, version, ttl, exists)
+	if err != nil {
+		utils.ReleaseToPool(queue)
+		storageFailed(ctx, CodeConflict, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "message acknowledged.",
 	})
+
+	utils.ReleaseToPool(queue)
 }
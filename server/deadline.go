@@ -0,0 +1,59 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeout 数据请求的最长处理时间，超时之后存储系统放弃还没有完成的读写，为 0 时不限制
+var requestTimeout time.Duration
+
+// 不受请求超时限制的路由，订阅是长连接，变更流的长轮询最多等待 maxChangeWait，
+// 副本同步和管理接口可能需要更长的时间
+var deadlineExempt = []string{"/subscribe/", "/cdc", "/replica"}
+
+func exemptDeadline(path string) bool {
+	if path == "" || publicPath(path) || isAdminPath(path) {
+		return true
+	}
+	for _, prefix := range deadlineExempt {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadlineMiddleware 给数据请求的 context 设置截止时间，客户端断开时 context 同样会被取消，
+// 控制器把 ctx.Request.Context() 传给存储系统，慢速磁盘上的读写不会一直占用 goroutine
+func deadlineMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if requestTimeout <= 0 || exemptDeadline(c.FullPath()) {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
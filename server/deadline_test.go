@@ -0,0 +1,91 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadlineMiddleware(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady, timeout := storage, ready.Load(), requestTimeout
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage, requestTimeout = old, timeout
+		ready.Store(wasReady)
+	}()
+
+	seg, err := vfs.NewSegment("key-01", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+
+	request := func(ctx context.Context, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(context.Background(), http.MethodGet, "/text/key-01", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 请求超时之后存储系统放弃读写
+	requestTimeout = time.Nanosecond
+	w = request(context.Background(), http.MethodGet, "/text/key-01", "")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	w = request(context.Background(), http.MethodPut, "/text/key-02", `{"content": "world"}`)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	w = request(context.Background(), http.MethodDelete, "/text/key-01", "")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	// 管理接口不受请求超时限制
+	w = request(context.Background(), http.MethodGet, "/admin/keys/key-01", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 变更流的长轮询不受请求超时限制
+	w = request(context.Background(), http.MethodGet, "/cdc?wait=1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 客户端断开时同样放弃读写
+	requestTimeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = request(ctx, http.MethodGet, "/text/key-01", "")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	assert.Equal(t, 1, fss.KeysCount())
+}
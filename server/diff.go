@@ -0,0 +1,222 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// itemChange 是 Collection 中一个位置上的变化
+type itemChange struct {
+	Index int `json:"index"`
+	From  any `json:"from,omitempty"`
+	To    any `json:"to,omitempty"`
+}
+
+// fieldChange 是 Table 中一个字段的新旧值
+type fieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// sameValue 比较 JSON 编码之后的值，不同编解码器读取出来的整数类型可能不同，
+// 例如 CBOR 的正整数是 uint64，MessagePack 是 int64
+func sameValue(a, b any) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// diffTables 返回新增、删除和修改的字段
+func diffTables(from, to map[string]any) (map[string]any, map[string]any, map[string]fieldChange) {
+	added := make(map[string]any)
+	removed := make(map[string]any)
+	changed := make(map[string]fieldChange)
+
+	for field, value := range from {
+		next, ok := to[field]
+		if !ok {
+			removed[field] = value
+			continue
+		}
+		if !sameValue(value, next) {
+			changed[field] = fieldChange{From: value, To: next}
+		}
+	}
+	for field, value := range to {
+		if _, ok := from[field]; !ok {
+			added[field] = value
+		}
+	}
+	return added, removed, changed
+}
+
+// diffCollections 去掉两个版本相同的开头和结尾之后逐个位置比较剩下的项目，多出来的项目是新增或者删除的，
+// 追加、在开头插入和删除中间的项目都只会报告变化的项目。新增的下标是新版本中的下标，删除的是旧版本中的
+func diffCollections(from, to []any) ([]itemChange, []itemChange, []itemChange) {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && sameValue(from[prefix], to[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix &&
+		sameValue(from[len(from)-1-suffix], to[len(to)-1-suffix]) {
+		suffix++
+	}
+
+	var (
+		added   = []itemChange{}
+		removed = []itemChange{}
+		changed = []itemChange{}
+		old     = from[prefix : len(from)-suffix]
+		next    = to[prefix : len(to)-suffix]
+	)
+
+	i := 0
+	for ; i < len(old) && i < len(next); i++ {
+		if !sameValue(old[i], next[i]) {
+			changed = append(changed, itemChange{Index: prefix + i, From: old[i], To: next[i]})
+		}
+	}
+	for j := i; j < len(old); j++ {
+		removed = append(removed, itemChange{Index: prefix + j, From: old[j]})
+	}
+	for j := i; j < len(next); j++ {
+		added = append(added, itemChange{Index: prefix + j, To: next[j]})
+	}
+	return added, removed, changed
+}
+
+// revisionQuery 解析 revision 查询参数，参数不存在时返回 fallback
+func revisionQuery(ctx *gin.Context, name string, fallback uint64) (uint64, bool) {
+	value, ok := ctx.GetQuery(name)
+	if !ok {
+		return fallback, true
+	}
+	revision, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return revision, true
+}
+
+// DiffController 比较 key 在两个 revision 时的 Table 或者 Collection 值，revision 是读取时 ETag 返回的 LSN，
+// 每个 revision 使用不超过它的最后一次写入，to 默认为当前的 LSN。历史版本从还没有被回收的 region 中扫描，
+// 比较早的 revision 被回收之后返回 410。Collection 只比较没有封存的尾部
+func DiffController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	from, err := strconv.ParseUint(ctx.Query("from"), 10, 64)
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "from must be a revision returned in ETag.")
+		return
+	}
+	to, ok := revisionQuery(ctx, "to", storage.LSN())
+	if !ok || to < from {
+		respondError(ctx, CodeBadRequest, "to must be a revision not lower than from.")
+		return
+	}
+
+	segs, err := storage.FetchSegmentsAt(ctx.Request.Context(), key, from, to)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+	old, next := segs[0], segs[1]
+	if old == nil && next == nil {
+		respondError(ctx, CodeKeyNotFound, "key data not found at either revision.")
+		return
+	}
+
+	kind := vfs.Table
+	for _, seg := range segs {
+		if seg != nil && seg.Type != vfs.Table && seg.Type != vfs.Collection {
+			respondError(ctx, CodeTypeMismatch, "diff is only supported for table and collection values.")
+			return
+		}
+		if seg != nil {
+			kind = seg.Type
+		}
+	}
+	if old != nil && next != nil && old.Type != next.Type {
+		respondError(ctx, CodeTypeMismatch, "key data changed its type between the revisions.")
+		return
+	}
+
+	body := gin.H{
+		"key":  key,
+		"type": vfs.KindToString[kind],
+		"from": from,
+		"to":   to,
+	}
+
+	// key 在其中一个 revision 时不存在，按照空的值比较
+	if kind == vfs.Table {
+		var tables [2]map[string]any
+		for i, seg := range segs {
+			if seg == nil {
+				continue
+			}
+			table, err := seg.ToTable()
+			if err != nil {
+				failed(ctx, CodeInternal, err)
+				return
+			}
+			defer utils.ReleaseToPool(table)
+			tables[i] = table.Table
+		}
+		body["added"], body["removed"], body["changed"] = diffTables(tables[0], tables[1])
+	} else {
+		var collections [2][]any
+		for i, seg := range segs {
+			if seg == nil {
+				continue
+			}
+			// 历史版本的尾部同样只拼接在它之前封存的分块
+			full, err := sealedSegment(ctx.Request.Context(), seg)
+			if err != nil {
+				storageFailed(ctx, CodeInternal, err)
+				return
+			}
+			if full != nil {
+				defer utils.ReleaseToPool(full)
+				seg = full
+			}
+			collection, err := seg.ToCollection()
+			if err != nil {
+				failed(ctx, CodeInternal, err)
+				return
+			}
+			defer utils.ReleaseToPool(collection)
+			collections[i] = collection.Collection
+		}
+		body["added"], body["removed"], body["changed"] = diffCollections(collections[0], collections[1])
+	}
+
+	render(ctx, http.StatusOK, body)
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffCollections(t *testing.T) {
+	tests := []struct {
+		from, to                []any
+		added, removed, changed int
+	}{
+		{[]any{1, 2}, []any{1, 2, 3}, 1, 0, 0},
+		{[]any{1, 2}, []any{0, 1, 2}, 1, 0, 0},
+		{[]any{1, 2, 3}, []any{1, 3}, 0, 1, 0},
+		{[]any{1, 2, 3}, []any{1, 4, 3}, 0, 0, 1},
+		{nil, []any{1}, 1, 0, 0},
+		{[]any{1, 1}, []any{1}, 0, 1, 0},
+	}
+	for _, tt := range tests {
+		added, removed, changed := diffCollections(tt.from, tt.to)
+		assert.Len(t, added, tt.added, tt)
+		assert.Len(t, removed, tt.removed, tt)
+		assert.Len(t, changed, tt.changed, tt)
+	}
+
+	added, _, _ := diffCollections([]any{"a", "b"}, []any{"x", "a", "b"})
+	assert.Equal(t, []itemChange{{Index: 0, To: "x"}}, added)
+}
+
+func TestDiffController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+	revision := func(key string) string {
+		etag := request(http.MethodGet, "/table/"+key, "").Header().Get("ETag")
+		value, err := strconv.Unquote(etag)
+		assert.NoError(t, err)
+		return value
+	}
+
+	w := request(http.MethodPut, "/table/config", `{"table": {"host": "a", "port": 80, "debug": true}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	first := revision("config")
+
+	w = request(http.MethodPut, "/table/config", `{"table": {"host": "b", "port": 80, "tls": true}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	second := revision("config")
+
+	w = request(http.MethodGet, "/diff/config?from="+first+"&to="+second, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"key": "config", "type": "table", "from": `+first+`, "to": `+second+`,
+		"added": {"tls": true},
+		"removed": {"debug": true},
+		"changed": {"host": {"from": "a", "to": "b"}}
+	}`, w.Body.String())
+
+	// to 默认是最新的版本，key 在 from 时不存在时全部是新增的
+	w = request(http.MethodGet, "/diff/config?from=0", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"host": "b"`)
+
+	w = request(http.MethodPut, "/collection/feed", `{"collection": ["a", "b"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	from := strconv.FormatUint(fss.LSN(), 10)
+	w = request(http.MethodPut, "/collection/feed", `{"collection": ["a", "c", "b", "d"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/diff/feed?from="+from, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"removed": []`)
+	assert.Contains(t, w.Body.String(), `"to": "d"`)
+
+	w = request(http.MethodPut, "/text/note", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusConflict, request(http.MethodGet, "/diff/note?from=0", "").Code)
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/diff/missing?from=0", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/diff/config", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/diff/config?from="+second+"&to="+first, "").Code)
+}
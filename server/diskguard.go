@@ -0,0 +1,91 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// 剩余空间低于水位线时切换为只读，0 表示不开启磁盘空间保护
+	diskWatermark uint64
+	diskInterval  = 10 * time.Second
+	diskGuardStop chan struct{}
+)
+
+// updateReadOnly 根据剩余空间切换只读状态，恢复写入需要高出水位线 10%，
+// 避免剩余空间在水位线附近波动时频繁切换。
+func updateReadOnly(free uint64) {
+	if !readOnly.Load() && free < diskWatermark {
+		readOnly.Store(true)
+		slog.Warnf("Disk free space %d bytes below watermark %d bytes, switch to read-only", free, diskWatermark)
+		return
+	}
+
+	if readOnly.Load() && free >= diskWatermark+diskWatermark/10 {
+		readOnly.Store(false)
+		slog.Infof("Disk free space %d bytes recovered, resume writes", free)
+	}
+}
+
+// runDiskGuard 定期检查数据目录所在磁盘的剩余空间，直到 stop 被关闭，当前平台不支持获取磁盘使用情况时直接返回
+func runDiskGuard(path string, stop <-chan struct{}) {
+	check := func() {
+		usage, err := diskUsage(path)
+		if err != nil {
+			slog.Warnf("failed to get disk usage of %s: %v", path, err)
+			return
+		}
+		updateReadOnly(usage.Free)
+	}
+
+	if _, err := diskUsage(path); errors.Is(err, errHealthUnsupported) {
+		slog.Warnf("Disk guard disabled: %v", err)
+		return
+	}
+
+	check()
+
+	ticker := time.NewTicker(diskInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// readOnlyMiddleware 只读期间拒绝写请求，删除操作可以继续执行以便配合压缩释放空间
+func readOnlyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if !readOnly.Load() || probePaths[c.FullPath()] ||
+			(method != http.MethodPut && method != http.MethodPost && method != http.MethodPatch) {
+			c.Next()
+			return
+		}
+
+		respondError(c, CodeInsufficientStorage, "storage is read-only due to low disk space.")
+		c.Abort()
+	}
+}
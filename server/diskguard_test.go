@@ -0,0 +1,68 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateReadOnly(t *testing.T) {
+	old := diskWatermark
+	diskWatermark = 1000
+	defer func() {
+		diskWatermark = old
+		readOnly.Store(false)
+	}()
+
+	updateReadOnly(2000)
+	assert.False(t, readOnly.Load())
+
+	updateReadOnly(999)
+	assert.True(t, readOnly.Load())
+
+	// 没有高出水位线 10% 之前保持只读
+	updateReadOnly(1050)
+	assert.True(t, readOnly.Load())
+
+	updateReadOnly(1100)
+	assert.False(t, readOnly.Load())
+}
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	readOnly.Store(true)
+	defer readOnly.Store(false)
+
+	engine := gin.New()
+	engine.Use(readOnlyMiddleware())
+	engine.Any("/text/:key", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for method, code := range map[string]int{
+		http.MethodGet:    http.StatusOK,
+		http.MethodDelete: http.StatusOK,
+		http.MethodPut:    http.StatusInsufficientStorage,
+		http.MethodPost:   http.StatusInsufficientStorage,
+	} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(method, "/text/key-01", nil))
+		assert.Equal(t, code, w.Code, method)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorCode 是错误响应中机器可读的错误码，客户端根据错误码处理错误，不需要匹配错误信息
+type ErrorCode string
+
+const (
+	CodeBadRequest          ErrorCode = "bad_request"
+	CodeUnauthorized        ErrorCode = "unauthorized"
+	CodeIPNotAllowed        ErrorCode = "ip_not_allowed"
+	CodeNotFound            ErrorCode = "not_found"
+	CodeKeyNotFound         ErrorCode = "key_not_found"
+	CodeFeatureDisabled     ErrorCode = "feature_disabled"
+	CodeConflict            ErrorCode = "conflict"
+	CodeKeyExists           ErrorCode = "key_exists"
+	CodeTypeMismatch        ErrorCode = "type_mismatch"
+	CodeVersionConflict     ErrorCode = "version_conflict"
+	CodeBusy                ErrorCode = "busy"
+	CodeRestartRequired     ErrorCode = "restart_required"
+	CodeGone                ErrorCode = "gone"
+	CodeRevisionMismatch    ErrorCode = "revision_mismatch"
+	CodePayloadTooLarge     ErrorCode = "payload_too_large"
+	CodeSchemaMismatch      ErrorCode = "schema_mismatch"
+	CodeScriptError         ErrorCode = "script_error"
+	CodeInternal            ErrorCode = "internal"
+	CodeDataCorrupted       ErrorCode = "data_corrupted"
+	CodeNotImplemented      ErrorCode = "not_implemented"
+	CodeNodeUnavailable     ErrorCode = "node_unavailable"
+	CodeUnavailable         ErrorCode = "unavailable"
+	CodeDeadlineExceeded    ErrorCode = "deadline_exceeded"
+	CodeInsufficientStorage ErrorCode = "insufficient_storage"
+	CodeQuotaExceeded       ErrorCode = "quota_exceeded"
+	CodeTooManyRequests     ErrorCode = "too_many_requests"
+)
+
+// errorSpec 是错误码对应的 HTTP 状态码，retryable 表示同样的请求稍后重试可能成功
+type errorSpec struct {
+	status    int
+	retryable bool
+}
+
+var errorCodes = map[ErrorCode]errorSpec{
+	CodeBadRequest:          {http.StatusBadRequest, false},
+	CodeUnauthorized:        {http.StatusUnauthorized, false},
+	CodeIPNotAllowed:        {http.StatusUnauthorized, false},
+	CodeNotFound:            {http.StatusNotFound, false},
+	CodeKeyNotFound:         {http.StatusNotFound, false},
+	CodeFeatureDisabled:     {http.StatusNotFound, false},
+	CodeConflict:            {http.StatusConflict, false},
+	CodeKeyExists:           {http.StatusConflict, false},
+	CodeTypeMismatch:        {http.StatusConflict, false},
+	CodeVersionConflict:     {http.StatusConflict, true},
+	CodeBusy:                {http.StatusConflict, true},
+	CodeRestartRequired:     {http.StatusConflict, false},
+	CodeGone:                {http.StatusGone, false},
+	CodeRevisionMismatch:    {http.StatusPreconditionFailed, false},
+	CodePayloadTooLarge:     {http.StatusRequestEntityTooLarge, false},
+	CodeSchemaMismatch:      {http.StatusUnprocessableEntity, false},
+	CodeScriptError:         {http.StatusUnprocessableEntity, false},
+	CodeInternal:            {http.StatusInternalServerError, false},
+	CodeDataCorrupted:       {http.StatusInternalServerError, false},
+	CodeNotImplemented:      {http.StatusNotImplemented, false},
+	CodeNodeUnavailable:     {http.StatusBadGateway, true},
+	CodeUnavailable:         {http.StatusServiceUnavailable, true},
+	CodeDeadlineExceeded:    {http.StatusGatewayTimeout, true},
+	CodeInsufficientStorage: {http.StatusInsufficientStorage, true},
+	CodeQuotaExceeded:       {http.StatusInsufficientStorage, false},
+	CodeTooManyRequests:     {http.StatusTooManyRequests, true},
+}
+
+// errorCodeNames 返回排序之后的全部错误码，用于生成接口文档
+func errorCodeNames() []string {
+	names := make([]string, 0, len(errorCodes))
+	for code := range errorCodes {
+		names = append(names, string(code))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// APIError 是所有接口统一的错误响应，Key 是请求路径中的 key，RequestID 和响应头 X-Request-ID 相同
+type APIError struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Key       string    `json:"key,omitempty"`
+	Retryable bool      `json:"retryable"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func newAPIError(ctx *gin.Context, code ErrorCode, message string) *APIError {
+	return &APIError{
+		Code:      code,
+		Message:   message,
+		Key:       ctx.Param("key"),
+		Retryable: errorCodes[code].retryable,
+		RequestID: requestID(ctx),
+	}
+}
+
+// Status 返回错误码对应的 HTTP 状态码
+func (e *APIError) Status() int {
+	if spec, ok := errorCodes[e.Code]; ok {
+		return spec.status
+	}
+	return http.StatusInternalServerError
+}
+
+// with 返回带有附加字段的错误响应，例如严格类型检查返回已经存在的类型
+func (e *APIError) with(fields gin.H) gin.H {
+	body := gin.H{
+		"code":      e.Code,
+		"message":   e.Message,
+		"retryable": e.Retryable,
+	}
+	if e.Key != "" {
+		body["key"] = e.Key
+	}
+	if e.RequestID != "" {
+		body["request_id"] = e.RequestID
+	}
+	for k, v := range fields {
+		body[k] = v
+	}
+	return body
+}
+
+// respondError 使用错误码对应的状态码返回错误响应，中间件需要自己调用 Abort
+func respondError(ctx *gin.Context, code ErrorCode, message string) {
+	e := newAPIError(ctx, code, message)
+	ctx.JSON(e.Status(), e)
+}
+
+// failed 返回 err 对应的错误响应，存储系统和配置以外的错误使用 fallback 错误码
+func failed(ctx *gin.Context, fallback ErrorCode, err error) {
+	respondError(ctx, errorCodeOf(err, fallback), err.Error())
+}
+
+// errorCodeOf 返回存储系统和配置错误对应的错误码，不认识的错误返回 fallback
+func errorCodeOf(err error, fallback ErrorCode) ErrorCode {
+	var cerr *vfs.CorruptedError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return CodeDeadlineExceeded
+	case errors.As(err, &cerr), errors.Is(err, vfs.ErrChecksumMismatch):
+		return CodeDataCorrupted
+	case errors.Is(err, vfs.ErrVersionConflict):
+		return CodeVersionConflict
+	case errors.Is(err, errRevisionMismatch):
+		return CodeRevisionMismatch
+	case errors.Is(err, errInvalidRevision), errors.Is(err, conf.ErrInvalidConfig), errors.Is(err, conf.ErrNoChanges):
+		return CodeBadRequest
+	case errors.Is(err, errInvalidSession):
+		return CodeUnauthorized
+	case errors.Is(err, vfs.ErrNotInTrash), errors.Is(err, vfs.ErrKeyNotFound):
+		return CodeKeyNotFound
+	case errors.Is(err, vfs.ErrKeyExists):
+		return CodeKeyExists
+	case errors.Is(err, vfs.ErrUnorderedIndex):
+		return CodeNotImplemented
+	case errors.Is(err, vfs.ErrPrefixDisabled), errors.Is(err, vfs.ErrTieringDisabled), errors.Is(err, vfs.ErrBackupDisabled):
+		return CodeFeatureDisabled
+	case errors.Is(err, vfs.ErrCompactPaused), errors.Is(err, vfs.ErrKeyCollision):
+		return CodeConflict
+	case errors.Is(err, vfs.ErrCompactRunning), errors.Is(err, vfs.ErrCheckpointRunning),
+		errors.Is(err, vfs.ErrTieringRunning), errors.Is(err, vfs.ErrBackupRunning):
+		return CodeBusy
+	case errors.Is(err, errQuotaExceeded):
+		return CodeQuotaExceeded
+	case errors.Is(err, vfs.ErrLSNUnavailable):
+		return CodeGone
+	case errors.Is(err, conf.ErrVersionNotFound):
+		return CodeNotFound
+	case errors.Is(err, conf.ErrRestartRequired):
+		return CodeRestartRequired
+	}
+	return fallback
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{context.DeadlineExceeded, CodeDeadlineExceeded},
+		{fmt.Errorf("put: %w", vfs.ErrVersionConflict), CodeVersionConflict},
+		{&vfs.CorruptedError{Key: "user", Err: vfs.ErrChecksumMismatch}, CodeDataCorrupted},
+		{errRevisionMismatch, CodeRevisionMismatch},
+		{vfs.ErrCompactRunning, CodeBusy},
+		{vfs.ErrPrefixDisabled, CodeFeatureDisabled},
+		{conf.ErrRestartRequired, CodeRestartRequired},
+		{errors.New("unknown"), CodeInternal},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, errorCodeOf(tt.err, CodeInternal), tt.err.Error())
+	}
+
+	// 每个错误码都有对应的状态码
+	for code, spec := range errorCodes {
+		assert.GreaterOrEqual(t, spec.status, 400, string(code))
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path string) (int, APIError) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+
+		var e APIError
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+		// 错误响应中的请求 ID 和响应头相同
+		assert.NotEmpty(t, e.RequestID)
+		assert.Equal(t, w.Header().Get(requestIDHeader), e.RequestID)
+		e.RequestID = ""
+		return w.Code, e
+	}
+
+	status, e := request(http.MethodGet, "/text/missing")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, APIError{Code: CodeKeyNotFound, Message: "key data not found.", Key: "missing"}, e)
+
+	status, e = request(http.MethodGet, "/no/such/route")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, CodeNotFound, e.Code)
+	assert.Empty(t, e.Key)
+
+	ready.Store(false)
+	status, e = request(http.MethodGet, "/text/missing")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, CodeUnavailable, e.Code)
+	assert.True(t, e.Retryable)
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// faultInjection 为 false 时 /admin/faults 不可用，避免在生产环境中误开启故障注入
+var faultInjection bool
+
+// faultSettings 是 /admin/faults 的请求和响应，概率的取值为 0 到 1
+type faultSettings struct {
+	DelayMS        int64   `json:"delay_ms"`
+	ReadErrorRate  float64 `json:"read_error_rate"`
+	WriteErrorRate float64 `json:"write_error_rate"`
+	TornWriteRate  float64 `json:"torn_write_rate"`
+}
+
+func newFaultSettings(f vfs.Faults) faultSettings {
+	return faultSettings{
+		DelayMS:        f.Delay.Milliseconds(),
+		ReadErrorRate:  f.ReadErrorRate,
+		WriteErrorRate: f.WriteErrorRate,
+		TornWriteRate:  f.TornWriteRate,
+	}
+}
+
+// SetFaultInjection 设置是否允许通过 /admin/faults 注入磁盘故障
+func (hs *HttpServer) SetFaultInjection(enable bool) {
+	faultInjection = enable
+}
+
+func faultInjectionEnabled(ctx *gin.Context) bool {
+	if !faultInjection {
+		respondError(ctx, CodeFeatureDisabled, "fault injection is not enabled.")
+		return false
+	}
+	return true
+}
+
+// GetFaultsController 返回当前注入的磁盘故障
+func GetFaultsController(ctx *gin.Context) {
+	if !faultInjectionEnabled(ctx) {
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, newFaultSettings(storage.Faults()))
+}
+
+// PutFaultsController 替换注入的磁盘故障，delay_ms 加在每次 region 读写上，读写错误按照概率返回，
+// 不完整的写入只写入记录的一部分之后失败，用于测试客户端的重试和存储系统的恢复
+func PutFaultsController(ctx *gin.Context) {
+	if !faultInjectionEnabled(ctx) {
+		return
+	}
+
+	var req faultSettings
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "invalid fault injection settings.")
+		return
+	}
+
+	err = storage.SetFaults(vfs.Faults{
+		Delay:          time.Duration(req.DelayMS) * time.Millisecond,
+		ReadErrorRate:  req.ReadErrorRate,
+		WriteErrorRate: req.WriteErrorRate,
+		TornWriteRate:  req.TornWriteRate,
+	})
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	requestLog(ctx).Warnf("Disk fault injection changed to %+v", req)
+	ctx.IndentedJSON(http.StatusOK, newFaultSettings(storage.Faults()))
+}
+
+// DeleteFaultsController 停止注入磁盘故障
+func DeleteFaultsController(ctx *gin.Context) {
+	if !faultInjectionEnabled(ctx) {
+		return
+	}
+
+	err := storage.SetFaults(vfs.Faults{})
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
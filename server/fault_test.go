@@ -0,0 +1,83 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultsController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		faultInjection = false
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/admin/faults", `{"write_error_rate": 1}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), string(CodeFeatureDisabled))
+
+	var hs *HttpServer
+	hs.SetFaultInjection(true)
+
+	w = request(http.MethodPut, "/admin/faults", `{"read_error_rate": 1.5}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPut, "/admin/faults", `{"delay_ms": 5, "write_error_rate": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"delay_ms": 5`)
+	assert.Contains(t, w.Body.String(), `"write_error_rate": 1`)
+
+	w = request(http.MethodPut, "/text/chaos", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = request(http.MethodGet, "/admin/faults", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"write_error_rate": 1`)
+
+	w = request(http.MethodDelete, "/admin/faults", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, vfs.Faults{}, fss.Faults())
+
+	w = request(http.MethodPut, "/text/chaos", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
@@ -14,28 +14,52 @@
 
 package server
 
-import (
-	"github.com/shirou/gopsutil/v3/disk"
-	"github.com/shirou/gopsutil/v3/mem"
-)
+import "errors"
+
+// errHealthUnsupported 表示当前平台无法获取内存或者磁盘的使用情况，健康检查接口不返回对应的字段
+var errHealthUnsupported = errors.New("system resource usage is not supported on this platform")
+
+// memoryStat 和 diskStat 是不同平台的探测实现返回的统一结果，单位都是字节
+type memoryStat struct {
+	Total     uint64
+	Available uint64
+}
+
+type diskStat struct {
+	Total       uint64
+	Free        uint64
+	Used        uint64
+	UsedPercent float64
+}
 
 type health struct {
-	mem  *mem.VirtualMemoryStat
-	disk *disk.UsageStat
+	mem  *memoryStat
+	disk *diskStat
 }
 
+// newHealth 获取系统内存和 path 所在磁盘的使用情况，当前平台不支持的部分为 nil
 func newHealth(path string) (*health, error) {
-	mem, err := mem.VirtualMemory()
-	if err != nil {
+	mem, err := memoryUsage()
+	if err != nil && !errors.Is(err, errHealthUnsupported) {
 		return nil, err
 	}
-	disk, err := disk.Usage(path)
-	if err != nil {
+	disk, err := diskUsage(path)
+	if err != nil && !errors.Is(err, errHealthUnsupported) {
 		return nil, err
 	}
 	return &health{mem: mem, disk: disk}, nil
 }
 
+// HasMemory 返回当前平台是否支持获取内存的使用情况
+func (h *health) HasMemory() bool {
+	return h.mem != nil
+}
+
+// HasDisk 返回当前平台是否支持获取磁盘的使用情况
+func (h *health) HasDisk() bool {
+	return h.disk != nil
+}
+
 // GetTotalMemory returns the total system memory in bytes.
 func (h *health) GetTotalMemory() uint64 {
 	return h.mem.Total
@@ -0,0 +1,45 @@
+//go:build linux || darwin || windows || freebsd || openbsd || netbsd || solaris || aix
+
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// memoryUsage 使用 gopsutil 获取内存的使用情况，gopsutil 在这些平台上同时实现了内存和磁盘的统计，
+// 其他平台上只有返回未实现错误的空实现，见 health_others.go
+func memoryUsage() (*memoryStat, error) {
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+	return &memoryStat{Total: vm.Total, Available: vm.Available}, nil
+}
+
+func diskUsage(path string) (*diskStat, error) {
+	usage, err := disk.Usage(path)
+	if err != nil {
+		return nil, err
+	}
+	return &diskStat{
+		Total:       usage.Total,
+		Free:        usage.Free,
+		Used:        usage.Used,
+		UsedPercent: usage.UsedPercent,
+	}, nil
+}
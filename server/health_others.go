@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !windows && !freebsd && !openbsd && !netbsd && !solaris && !aix
+
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+func memoryUsage() (*memoryStat, error) {
+	return nil, errHealthUnsupported
+}
+
+func diskUsage(path string) (*diskStat, error) {
+	return nil, errHealthUnsupported
+}
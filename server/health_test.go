@@ -0,0 +1,33 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHealth(t *testing.T) {
+	health, err := newHealth(t.TempDir())
+	assert.NoError(t, err)
+
+	// 测试运行的平台都有 gopsutil 的实现
+	assert.True(t, health.HasMemory())
+	assert.True(t, health.HasDisk())
+	assert.Greater(t, health.GetTotalMemory(), uint64(0))
+	assert.Greater(t, health.GetTotalDisk(), uint64(0))
+	assert.LessOrEqual(t, health.GetFreeDisk(), health.GetTotalDisk())
+}
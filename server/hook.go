@@ -0,0 +1,656 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// 写入钩子以 Text 类型的 Segment 持久化，key 为 hook:<name>，重试之后仍然投递失败的事件
+// 作为死信保存在 hookdlq:<name>:<纳秒时间戳> 中，可以查看或者重新投递
+const (
+	hookKeyPrefix       = internalKeyPrefix + "hook:"
+	deadLetterKeyPrefix = internalKeyPrefix + "hookdlq:"
+	// 每个钩子在内存中排队的事件上限，超出时丢弃最旧的事件
+	maxHookBacklog     = 10000
+	defaultHookRetries = 5
+	hookEventPut       = "put"
+	hookEventDelete    = "delete"
+)
+
+var (
+	hookClient = &http.Client{Timeout: timeout}
+	// hookBackoff 是第一次重试之前的等待时间，之后每次翻倍，最多等待 maxHookBackoff
+	hookBackoff    = 500 * time.Millisecond
+	maxHookBackoff = 30 * time.Second
+)
+
+var errHookStopped = errors.New("hook was removed or replaced")
+
+// Hook 在 key 匹配 Pattern 的写入或者删除之后异步投递事件，Pattern 是 path.Match 的 glob 模式，
+// Events 为空时 put 和 delete 都会投递。事件可以 POST 到 URL，设置了 Secret 时带有 HMAC-SHA256 签名，
+// 也可以调用 Procedure 指定的存储过程，ARGV 依次为事件名、值和类型。同一个钩子的事件按照写入的顺序投递，
+// 失败时按照指数退避重试 Retries 次，进程重启时还在内存中排队的事件会丢失
+type Hook struct {
+	Name      string   `json:"name"`
+	Pattern   string   `json:"pattern"`
+	Events    []string `json:"events,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Secret    string   `json:"secret,omitempty"`
+	Procedure string   `json:"procedure,omitempty"`
+	Retries   int      `json:"retries"`
+}
+
+// HookEvent 是投递给钩子的事件，删除事件没有 Type 和 Value
+type HookEvent struct {
+	Hook  string          `json:"hook"`
+	Event string          `json:"event"`
+	Key   string          `json:"key"`
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	LSN   uint64          `json:"lsn"`
+	Time  time.Time       `json:"time"`
+}
+
+// HookFunc 是嵌入 UrnaDB 的 Go 程序注册的钩子回调，返回错误时和 webhook 一样重试
+type HookFunc func(event HookEvent) error
+
+// HookStats 是钩子的投递统计，只保存在内存中
+type HookStats struct {
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`
+	Dropped   uint64 `json:"dropped"`
+	Pending   int    `json:"pending"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// DeadLetter 是重试之后仍然投递失败的事件
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Event    HookEvent `json:"event"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// hookTask 是排队中的事件，写入事件的值在投递之前才从 seg 编码为 JSON，避免在存储的锁内解码
+type hookTask struct {
+	event HookEvent
+	seg   *vfs.Segment
+}
+
+type hookRunner struct {
+	info   Hook
+	fn     HookFunc
+	mu     sync.Mutex
+	queue  []hookTask
+	stats  HookStats
+	notify chan struct{}
+	stop   chan struct{}
+}
+
+// hooks 是所有已经注册的钩子，写入钩子在存储的锁内调用 dispatch，只做匹配和入队
+var hooks = &hookRegistry{
+	runners: make(map[string]*hookRunner),
+}
+
+type hookRegistry struct {
+	mu      sync.RWMutex
+	runners map[string]*hookRunner
+}
+
+// validateHook 检查钩子的定义并填充默认值，嵌入程序注册的钩子没有 URL 和存储过程
+func validateHook(h *Hook, embedded bool) error {
+	if _, err := path.Match(h.Pattern, ""); h.Pattern == "" || err != nil {
+		return fmt.Errorf("invalid key pattern %q", h.Pattern)
+	}
+	for _, event := range h.Events {
+		if event != hookEventPut && event != hookEventDelete {
+			return fmt.Errorf("unsupported hook event %q", event)
+		}
+	}
+	if !embedded && (h.URL == "") == (h.Procedure == "") {
+		return errors.New("hook must have exactly one of url and procedure")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid hook url %q", h.URL)
+		}
+	}
+	if h.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	if h.Retries == 0 {
+		h.Retries = defaultHookRetries
+	}
+	return nil
+}
+
+func newHookRunner(info Hook, fn HookFunc) *hookRunner {
+	return &hookRunner{
+		info:   info,
+		fn:     fn,
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+}
+
+// set 注册或者替换钩子，被替换的钩子还没有投递的事件交给新的钩子
+func (r *hookRegistry) set(runner *hookRunner) {
+	r.mu.Lock()
+	old, ok := r.runners[runner.info.Name]
+	r.runners[runner.info.Name] = runner
+	r.mu.Unlock()
+
+	if ok {
+		close(old.stop)
+		old.mu.Lock()
+		runner.queue = append(runner.queue, old.queue...)
+		old.queue = nil
+		old.mu.Unlock()
+	}
+
+	go runner.run()
+	runner.wake()
+}
+
+func (r *hookRegistry) remove(name string) bool {
+	r.mu.Lock()
+	runner, ok := r.runners[name]
+	delete(r.runners, name)
+	r.mu.Unlock()
+
+	if ok {
+		close(runner.stop)
+	}
+	return ok
+}
+
+func (r *hookRegistry) get(name string) (*hookRunner, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	runner, ok := r.runners[name]
+	return runner, ok
+}
+
+// dispatch 把写入交给匹配的钩子，在存储的锁内调用，seg 在返回之后会被调用者回收，排队的是它的副本
+func (r *hookRegistry) dispatch(seg *vfs.Segment) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.runners) == 0 {
+		return
+	}
+
+	key := seg.GetKeyString()
+	if isInternalKey(key) {
+		return
+	}
+
+	event := HookEvent{Event: hookEventPut, Key: key, LSN: seg.LSN, Time: time.Now()}
+	if seg.IsTombstone() {
+		event.Event = hookEventDelete
+	}
+
+	var value *vfs.Segment
+	for _, runner := range r.runners {
+		if !runner.matches(event.Event, key) {
+			continue
+		}
+		if value == nil && event.Event == hookEventPut {
+			event.Type = seg.GetTypeString()
+			value = &vfs.Segment{Type: seg.Type, Codec: seg.Codec, Value: append([]byte(nil), seg.Value...)}
+		}
+		task := hookTask{event: event, seg: value}
+		task.event.Hook = runner.info.Name
+		runner.push(task)
+	}
+}
+
+func (h *hookRunner) matches(event, key string) bool {
+	if ok, _ := path.Match(h.info.Pattern, key); !ok {
+		return false
+	}
+	if len(h.info.Events) == 0 {
+		return true
+	}
+	for _, e := range h.info.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hookRunner) push(task hookTask) {
+	h.mu.Lock()
+	if len(h.queue) >= maxHookBacklog {
+		h.queue = h.queue[1:]
+		h.stats.Dropped++
+	}
+	h.queue = append(h.queue, task)
+	h.mu.Unlock()
+	h.wake()
+}
+
+func (h *hookRunner) wake() {
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *hookRunner) snapshot() HookStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.stats
+	stats.Pending = len(h.queue)
+	return stats
+}
+
+// run 按照顺序投递事件，事件投递成功或者成为死信之后才出队
+func (h *hookRunner) run() {
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-h.notify:
+		}
+
+		for {
+			h.mu.Lock()
+			if len(h.queue) == 0 {
+				h.mu.Unlock()
+				break
+			}
+			task := h.queue[0]
+			h.mu.Unlock()
+
+			if errors.Is(h.deliver(task), errHookStopped) {
+				return
+			}
+
+			h.mu.Lock()
+			// 等待期间钩子被替换时队列已经交给了新的钩子
+			if len(h.queue) > 0 {
+				h.queue = h.queue[1:]
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// deliver 投递一个事件，失败时按照指数退避重试，重试次数用完之后保存为死信
+func (h *hookRunner) deliver(task hookTask) error {
+	event := task.event
+	if task.seg != nil {
+		seg, err := sealedSegment(context.Background(), task.seg)
+		if seg == nil {
+			seg = task.seg
+		} else {
+			defer utils.ReleaseToPool(seg)
+		}
+		if err != nil {
+			return h.deadLetter(event, err, 0)
+		}
+		value, err := seg.ToJSON()
+		if err != nil {
+			return h.deadLetter(event, err, 0)
+		}
+		event.Value = value
+	}
+
+	var (
+		err     error
+		backoff = hookBackoff
+	)
+	for attempt := 0; attempt <= h.info.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-h.stop:
+				return errHookStopped
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxHookBackoff {
+				backoff = maxHookBackoff
+			}
+		}
+
+		err = h.send(event)
+		if err == nil {
+			h.mu.Lock()
+			h.stats.Delivered++
+			h.mu.Unlock()
+			return nil
+		}
+	}
+
+	return h.deadLetter(event, err, h.info.Retries+1)
+}
+
+// send 投递一次事件，webhook 只有返回 2xx 才算成功
+func (h *hookRunner) send(event HookEvent) error {
+	switch {
+	case h.fn != nil:
+		return h.fn(event)
+	case h.info.Procedure != "":
+		return callHookProcedure(h.info.Procedure, event)
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.info.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mimeJSON)
+	req.Header.Set("X-UrnaDB-Event", event.Event)
+	if h.info.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.info.Secret))
+		mac.Write(body)
+		req.Header.Set("X-UrnaDB-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func callHookProcedure(name string, event HookEvent) error {
+	source, err := fetchProcedure(name)
+	if err != nil {
+		return fmt.Errorf("script %s not found", name)
+	}
+
+	var value any
+	if len(event.Value) > 0 {
+		err = decodeJSON(bytes.NewReader(event.Value), &value)
+		if err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	_, err = runScript(context.Background(), source, []string{event.Key}, []any{event.Event, value, event.Type})
+	procedures.record(name, time.Since(start), err)
+	return err
+}
+
+func deadLetterKey(name, id string) string {
+	return deadLetterKeyPrefix + name + ":" + id
+}
+
+// deadLetter 保存投递失败的事件，ID 是固定宽度的纳秒时间戳，按照 key 排序就是失败的顺序
+func (h *hookRunner) deadLetter(event HookEvent, cause error, attempts int) error {
+	h.mu.Lock()
+	h.stats.Failed++
+	h.stats.LastError = cause.Error()
+	h.mu.Unlock()
+
+	letter := DeadLetter{
+		ID:       fmt.Sprintf("%020d", time.Now().UnixNano()),
+		Event:    event,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+	document, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	key := deadLetterKey(h.info.Name, letter.ID)
+	seg, err := vfs.AcquirePoolSegment(key, types.NewText(string(document)), 0)
+	if err != nil {
+		return err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	err = storage.PutSegment(key, seg)
+	if err != nil {
+		slog.Errorf("failed to save dead letter of hook %s for key %s: %v", h.info.Name, event.Key, err)
+	}
+	return err
+}
+
+// loadHooks 启动时注册存储中保存的全部钩子
+func loadHooks(fss *vfs.LogStructuredFS) error {
+	return fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if !strings.HasPrefix(key, hookKeyPrefix) {
+			return true
+		}
+
+		text, err := seg.ToText()
+		if err == nil {
+			var info Hook
+			err = json.Unmarshal([]byte(text.Content), &info)
+			if err == nil {
+				hooks.set(newHookRunner(info, nil))
+			}
+			utils.ReleaseToPool(text)
+		}
+		if err != nil {
+			slog.Warnf("failed to load hook %s: %v", strings.TrimPrefix(key, hookKeyPrefix), err)
+		}
+		return true
+	})
+}
+
+// fetchDeadLetters 按照失败的顺序返回钩子的死信
+func fetchDeadLetters(name string) ([]DeadLetter, error) {
+	keys, err := storage.MatchKeys(deadLetterKeyPrefix+name+":", "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	letters := make([]DeadLetter, 0, len(keys))
+	for _, key := range keys {
+		_, seg, err := storage.FetchSegment(key)
+		if err != nil {
+			continue
+		}
+		text, err := seg.ToText()
+		utils.ReleaseToPool(seg)
+		if err != nil {
+			return nil, err
+		}
+
+		var letter DeadLetter
+		err = json.Unmarshal([]byte(text.Content), &letter)
+		utils.ReleaseToPool(text)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+func ListHooksController(ctx *gin.Context) {
+	type hook struct {
+		Hook
+		Embedded bool      `json:"embedded,omitempty"`
+		Stats    HookStats `json:"stats"`
+	}
+
+	hooks.mu.RLock()
+	list := make([]hook, 0, len(hooks.runners))
+	for _, runner := range hooks.runners {
+		info := runner.info
+		info.Secret = ""
+		list = append(list, hook{Hook: info, Embedded: runner.fn != nil, Stats: runner.snapshot()})
+	}
+	hooks.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"hooks": list,
+	})
+}
+
+func PutHookController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	err := validateKey(name)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	var info Hook
+	err = ctx.ShouldBindJSON(&info)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+	info.Name = name
+
+	err = validateHook(&info, false)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	if runner, ok := hooks.get(name); ok && runner.fn != nil {
+		respondError(ctx, CodeConflict, "hook is registered by the embedding program.")
+		return
+	}
+
+	document, err := json.Marshal(info)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	seg, err := vfs.AcquirePoolSegment(hookKeyPrefix+name, types.NewText(string(document)), 0)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	_, err = storage.PutSegmentContext(ctx.Request.Context(), hookKeyPrefix+name, seg)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	hooks.set(newHookRunner(info, nil))
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "hook registered successfully.",
+	})
+}
+
+func DeleteHookController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	if runner, ok := hooks.get(name); !ok || runner.fn != nil {
+		respondError(ctx, CodeNotFound, "hook not found.")
+		return
+	}
+
+	err := storage.DeleteSegmentContext(ctx.Request.Context(), hookKeyPrefix+name)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	hooks.remove(name)
+	ctx.Status(http.StatusNoContent)
+}
+
+func ListDeadLettersController(ctx *gin.Context) {
+	letters, err := fetchDeadLetters(ctx.Param("name"))
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"dead_letters": letters,
+	})
+}
+
+// ReplayDeadLettersController 把钩子的死信按照原来的顺序重新排队，排队之后删除死信，再次失败时重新成为死信
+func ReplayDeadLettersController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	runner, ok := hooks.get(name)
+	if !ok {
+		respondError(ctx, CodeNotFound, "hook not found.")
+		return
+	}
+
+	letters, err := fetchDeadLetters(name)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	for _, letter := range letters {
+		err = storage.DeleteSegmentContext(ctx.Request.Context(), deadLetterKey(name, letter.ID))
+		if err != nil {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+		runner.push(hookTask{event: letter.Event})
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"replayed": len(letters),
+	})
+}
+
+// RegisterHook 注册嵌入程序的 Go 回调，只保存在内存中，每次启动都需要重新注册
+func (hs *HttpServer) RegisterHook(name, pattern string, retries int, fn HookFunc) error {
+	info := Hook{Name: name, Pattern: pattern, Retries: retries}
+	err := validateHook(&info, true)
+	if err != nil {
+		return err
+	}
+	hooks.set(newHookRunner(info, fn))
+	return nil
+}
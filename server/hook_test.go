@@ -0,0 +1,174 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+	fss.SetWriteHook(observeWrite)
+
+	old, wasReady, backoff := storage, ready.Load(), hookBackoff
+	storage = fss
+	ready.Store(true)
+	hookBackoff = time.Millisecond
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		hookBackoff = backoff
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	var (
+		mu      sync.Mutex
+		events  []HookEvent
+		healthy atomic.Bool
+	)
+	healthy.Store(true)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-UrnaDB-Signature"))
+
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event HookEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer downstream.Close()
+
+	received := func(n int) []HookEvent {
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(events) >= n
+		}, 5*time.Second, 5*time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]HookEvent(nil), events...)
+	}
+
+	w := request(http.MethodPut, "/admin/hooks/search", `{"pattern": "user:*", "url": "ftp://example.com"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPut, "/admin/hooks/search", `{"pattern": "user:*", "url": "`+downstream.URL+`", "secret": "s3cret", "retries": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	defer hooks.remove("search")
+
+	// 嵌入程序注册的 Go 回调和 webhook 接收同样的事件
+	var embedded atomic.Int32
+	assert.NoError(t, new(HttpServer).RegisterHook("embedded", "user:*", 0, func(event HookEvent) error {
+		embedded.Add(1)
+		return nil
+	}))
+	defer hooks.remove("embedded")
+
+	w = request(http.MethodPut, "/table/user:1", `{"table": {"name": "alice", "id": 9007199254740993}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPut, "/table/order:1", `{"table": {"total": 1}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodDelete, "/table/user:1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	got := received(2)
+	assert.Len(t, got, 2)
+	assert.Equal(t, "search", got[0].Hook)
+	assert.Equal(t, hookEventPut, got[0].Event)
+	assert.Equal(t, "user:1", got[0].Key)
+	assert.Equal(t, "table", got[0].Type)
+	assert.Contains(t, string(got[0].Value), "9007199254740993")
+	assert.Equal(t, hookEventDelete, got[1].Event)
+	assert.Empty(t, got[1].Value)
+	assert.Eventually(t, func() bool { return embedded.Load() == 2 }, 5*time.Second, 5*time.Millisecond)
+
+	// 下游不可用时重试之后成为死信，恢复之后重新投递
+	healthy.Store(false)
+	w = request(http.MethodPut, "/text/user:2", `{"content": "bob"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var letters struct {
+		DeadLetters []DeadLetter `json:"dead_letters"`
+	}
+	assert.Eventually(t, func() bool {
+		w = request(http.MethodGet, "/admin/hooks/search/dead", "")
+		return json.Unmarshal(w.Body.Bytes(), &letters) == nil && len(letters.DeadLetters) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, "user:2", letters.DeadLetters[0].Event.Key)
+	assert.Equal(t, 2, letters.DeadLetters[0].Attempts)
+	assert.Contains(t, letters.DeadLetters[0].Error, "503")
+
+	healthy.Store(true)
+	w = request(http.MethodPost, "/admin/hooks/search/replay", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	got = received(3)
+	assert.Equal(t, "user:2", got[2].Key)
+	assert.Equal(t, `"bob"`, string(got[2].Value))
+
+	w = request(http.MethodGet, "/admin/hooks/search/dead", "")
+	assert.Contains(t, w.Body.String(), `"dead_letters": []`)
+
+	// 钩子的列表不返回密钥，嵌入程序注册的钩子不能通过接口删除
+	w = request(http.MethodGet, "/admin/hooks", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "s3cret")
+	assert.Contains(t, w.Body.String(), `"delivered": 3`)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/admin/hooks/embedded", "").Code)
+
+	// 重启之后从存储中恢复钩子
+	hooks.remove("search")
+	assert.NoError(t, loadHooks(fss))
+	_, ok := hooks.get("search")
+	assert.True(t, ok)
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/admin/hooks/search", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/admin/hooks/search", "").Code)
+}
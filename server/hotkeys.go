@@ -0,0 +1,192 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 允许的计数误差为总访问次数的 0.1%
+	hotkeyEpsilon = 0.001
+	// 统计窗口，返回的结果覆盖最近一到两个窗口
+	hotkeyWindow  = time.Minute
+	defaultHotkey = 20
+)
+
+var hotkeys = struct {
+	reads  *slidingCounter
+	writes *slidingCounter
+}{
+	reads:  newSlidingCounter(hotkeyEpsilon, hotkeyWindow),
+	writes: newSlidingCounter(hotkeyEpsilon, hotkeyWindow),
+}
+
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type lossyEntry struct {
+	count uint64
+	delta uint64
+}
+
+// lossyCounter 是 Manku-Motwani 的 Lossy Counting 算法，
+// 每处理 1/epsilon 个元素就删除计数很小的 key，内存占用与访问的 key 数量无关。
+type lossyCounter struct {
+	width   uint64
+	total   uint64
+	bucket  uint64
+	entries map[string]*lossyEntry
+}
+
+func newLossyCounter(epsilon float64) *lossyCounter {
+	return &lossyCounter{
+		width:   uint64(1/epsilon + 0.5),
+		bucket:  1,
+		entries: make(map[string]*lossyEntry),
+	}
+}
+
+func (lc *lossyCounter) add(key string) {
+	if e, ok := lc.entries[key]; ok {
+		e.count += 1
+	} else {
+		lc.entries[key] = &lossyEntry{count: 1, delta: lc.bucket - 1}
+	}
+
+	lc.total += 1
+	if lc.total%lc.width == 0 {
+		for k, e := range lc.entries {
+			if e.count+e.delta <= lc.bucket {
+				delete(lc.entries, k)
+			}
+		}
+		lc.bucket += 1
+	}
+}
+
+// slidingCounter 用当前窗口和上一个窗口两个计数器近似滑动窗口
+type slidingCounter struct {
+	mu       sync.Mutex
+	epsilon  float64
+	window   time.Duration
+	rotated  time.Time
+	current  *lossyCounter
+	previous *lossyCounter
+}
+
+func newSlidingCounter(epsilon float64, window time.Duration) *slidingCounter {
+	return &slidingCounter{
+		epsilon:  epsilon,
+		window:   window,
+		rotated:  time.Now(),
+		current:  newLossyCounter(epsilon),
+		previous: newLossyCounter(epsilon),
+	}
+}
+
+// 调用者必须持有 sc.mu
+func (sc *slidingCounter) rotate(now time.Time) {
+	elapsed := now.Sub(sc.rotated)
+	if elapsed < sc.window {
+		return
+	}
+
+	// 超过两个窗口没有访问，上一个窗口的数据也已经过期了
+	if elapsed >= 2*sc.window {
+		sc.previous = newLossyCounter(sc.epsilon)
+	} else {
+		sc.previous = sc.current
+	}
+	sc.current = newLossyCounter(sc.epsilon)
+	sc.rotated = now
+}
+
+func (sc *slidingCounter) add(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.rotate(time.Now())
+	sc.current.add(key)
+}
+
+// top 返回最近窗口内访问次数最多的 n 个 key
+func (sc *slidingCounter) top(n int) []HotKey {
+	sc.mu.Lock()
+	counts := make(map[string]uint64)
+	sc.rotate(time.Now())
+	for _, lc := range []*lossyCounter{sc.previous, sc.current} {
+		for key, e := range lc.entries {
+			counts[key] += e.count
+		}
+	}
+	sc.mu.Unlock()
+
+	result := make([]HotKey, 0, len(counts))
+	for key, count := range counts {
+		result = append(result, HotKey{Key: key, Count: count})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count == result[j].Count {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Count > result[j].Count
+	})
+
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// hotkeyMiddleware 记录每个带 key 的请求，GET 和 HEAD 记为读，其他方法记为写
+func hotkeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		key := c.Param("key")
+		if key == "" || c.IsAborted() {
+			return
+		}
+
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			hotkeys.reads.add(key)
+		} else {
+			hotkeys.writes.add(key)
+		}
+	}
+}
+
+func GetHotKeysController(ctx *gin.Context) {
+	n, err := strconv.Atoi(ctx.DefaultQuery("n", strconv.Itoa(defaultHotkey)))
+	if err != nil || n <= 0 {
+		respondError(ctx, CodeBadRequest, "n must be a positive integer.")
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"window": hotkeyWindow.String(),
+		"reads":  hotkeys.reads.top(n),
+		"writes": hotkeys.writes.top(n),
+	})
+}
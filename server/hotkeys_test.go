@@ -0,0 +1,57 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLossyCounter(t *testing.T) {
+	lc := newLossyCounter(0.01)
+
+	for i := 0; i < 1000; i++ {
+		lc.add("hot")
+		lc.add(fmt.Sprintf("cold-%d", i))
+	}
+
+	// 只出现一次的 key 会被定期清理掉，热点 key 的计数是准确的
+	assert.Equal(t, uint64(1000), lc.entries["hot"].count)
+	assert.Less(t, len(lc.entries), 200)
+}
+
+func TestSlidingCounter(t *testing.T) {
+	sc := newSlidingCounter(0.01, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		sc.add("key-a")
+	}
+	sc.add("key-b")
+
+	top := sc.top(1)
+	assert.Equal(t, []HotKey{{Key: "key-a", Count: 3}}, top)
+
+	// 滚动一个窗口之后上一个窗口的数据仍然可见
+	sc.rotated = sc.rotated.Add(-time.Minute)
+	sc.add("key-b")
+	assert.Equal(t, []HotKey{{Key: "key-a", Count: 3}, {Key: "key-b", Count: 2}}, sc.top(10))
+
+	// 超过两个窗口之后旧数据全部过期
+	sc.rotated = sc.rotated.Add(-2 * time.Minute)
+	assert.Empty(t, sc.top(10))
+}
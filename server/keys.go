@@ -0,0 +1,62 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// RangeKeysController 按照字典序返回 [start, end) 范围内的 key，end 为空表示没有上界，
+// 需要使用 skiplist 索引。返回的 next 可以作为下一页的 start 继续扫描。
+func RangeKeysController(ctx *gin.Context) {
+	start, end := ctx.Query("start"), ctx.Query("end")
+	if end != "" && end <= start {
+		respondError(ctx, CodeBadRequest, "end must be greater than start.")
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultKeysLimit)))
+	if err != nil || limit <= 0 || limit > maxKeysLimit {
+		respondError(ctx, CodeBadRequest, "limit must be between 1 and "+strconv.Itoa(maxKeysLimit)+".")
+		return
+	}
+
+	// 多取一个用来判断是否还有下一页
+	keys, err := storage.RangeKeys(start, end, limit+1)
+	if err != nil {
+		if errors.Is(err, vfs.ErrUnorderedIndex) {
+			respondError(ctx, CodeNotImplemented, "key range scans require the skiplist index.")
+			return
+		}
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	next := ""
+	if len(keys) > limit {
+		next = keys[limit]
+		keys = keys[:limit]
+	}
+
+	render(ctx, http.StatusOK, gin.H{
+		"keys": keys,
+		"next": next,
+	})
+}
@@ -0,0 +1,221 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeKeysController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+		Index:     vfs.SkipListIndex,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	for _, key := range []string{"log:03", "log:01", "log:02", "metric:01"} {
+		seg, err := vfs.NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	var page struct {
+		Keys []string `json:"keys"`
+		Next string   `json:"next"`
+	}
+
+	w := request("/keys?start=log:&end=log%3B&limit=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, []string{"log:01", "log:02"}, page.Keys)
+	assert.Equal(t, "log:03", page.Next)
+
+	w = request("/keys?start=" + page.Next + "&end=log%3B")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, []string{"log:03"}, page.Keys)
+	assert.Empty(t, page.Next)
+
+	assert.Equal(t, http.StatusBadRequest, request("/keys?start=b&end=a").Code)
+	assert.Equal(t, http.StatusBadRequest, request("/keys?limit=0").Code)
+}
+
+func TestGetMetaController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	seg, err := vfs.NewSegment("user:1", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("user:1", seg))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/meta/user:1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var meta vfs.KeyMeta
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &meta))
+	assert.Equal(t, "user:1", meta.Key)
+	assert.Equal(t, "text", meta.Type)
+	assert.NotZero(t, meta.Size)
+
+	w = request("/meta/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestExistsController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	seg, err := vfs.NewSegment("user:1", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("user:1", seg))
+
+	seg, err = vfs.NewSegment("session:1", types.NewText("token"), 0)
+	assert.NoError(t, err)
+	seg.ExpiredAt = uint64(time.Now().Add(-time.Second).UnixNano())
+	assert.NoError(t, fss.PutSegment("session:1", seg))
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/exists/user:1", "/text/user:1", "/query/user:1"} {
+		method := http.MethodHead
+		if path == "/exists/user:1" {
+			method = http.MethodGet
+		}
+		w := request(method, path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Zero(t, w.Body.Len(), path)
+	}
+
+	// 过期的 key 和不存在的 key 一样返回 404
+	w := request(http.MethodHead, "/set/session:1")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request(http.MethodGet, "/exists/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Zero(t, w.Body.Len())
+}
+
+func TestDeleteController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	seg, err := vfs.NewSegment("user:1", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("user:1", seg))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/text/user:1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Zero(t, w.Body.Len())
+	_, exists := fss.StatSegment("user:1")
+	assert.False(t, exists)
+
+	// 重复删除返回 404，并且不会再写入墓碑
+	written := fss.CompactionStats().TombstonesWritten
+	w = request("/text/user:1")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"key_not_found"`)
+	w = request("/zset/user:1?missing_ok=true")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, written, fss.CompactionStats().TombstonesWritten)
+
+	w = request("/text/user:1?missing_ok=maybe")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// kvTypes 是 /kv 接口可以写入和读取的类型
+var kvTypes = map[string]valueLoader{
+	"collection": collectionType,
+	"table":      tableType,
+	"text":       textType,
+	"number":     numberType,
+}
+
+var (
+	errUnsupportedValue = errors.New("value must be an object, array, string or integer")
+	errNumberRange      = errors.New("number must be a 64-bit integer")
+)
+
+// decodeKVValue 根据 Content-Type 把请求体解析为任意的值。
+// JSON 顶层的数字直接按照整数解析，避免超过 2^53 的整数经过 float64 丢失精度
+func decodeKVValue(ctx *gin.Context) (any, error) {
+	var value any
+	switch mediaType(ctx.ContentType()) {
+	case mimeMsgPack:
+		err := msgpack.NewDecoder(ctx.Request.Body).Decode(&value)
+		return value, err
+	case mimeCBOR:
+		err := cborDecMode.NewDecoder(ctx.Request.Body).Decode(&value)
+		return value, err
+	}
+
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && (body[0] == '-' || (body[0] >= '0' && body[0] <= '9')) {
+		n, err := strconv.ParseInt(string(body), 10, 64)
+		if err != nil {
+			return nil, errNumberRange
+		}
+		return n, nil
+	}
+
+	err = decodeJSON(bytes.NewReader(body), &value)
+	return value, err
+}
+
+// inferValue 根据值的形状选择数据类型：数组为 Collection，对象为 Table，字符串为 Text，整数为 Number
+func inferValue(value any) (vfs.Serializable, string, error) {
+	switch v := value.(type) {
+	case []any:
+		collection := types.NewCollection()
+		collection.Collection = v
+		return collection, "collection", nil
+	case map[string]any:
+		table := types.NewTable()
+		table.Table = v
+		return table, "table", nil
+	case string:
+		return types.NewText(v), "text", nil
+	case int64:
+		return types.NewNumber(v), "number", nil
+	case int8, int16, int32, int:
+		return types.NewNumber(reflect.ValueOf(v).Int()), "number", nil
+	case uint8, uint16, uint32, uint64:
+		n := reflect.ValueOf(v).Uint()
+		if n > math.MaxInt64 {
+			return nil, "", errNumberRange
+		}
+		return types.NewNumber(int64(n)), "number", nil
+	case float32:
+		return inferFloat(float64(v))
+	case float64:
+		return inferFloat(v)
+	}
+	return nil, "", errUnsupportedValue
+}
+
+// inferFloat 只接受没有小数部分的浮点数，MessagePack 和 CBOR 客户端可能把整数编码为浮点数
+func inferFloat(f float64) (vfs.Serializable, string, error) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, "", errNumberRange
+	}
+	return types.NewNumber(int64(f)), "number", nil
+}
+
+// PutKVController 根据请求体的形状推断类型并写入，ttl 通过查询参数设置
+func PutKVController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	ttl, err := strconv.ParseUint(ctx.DefaultQuery("ttl", "0"), 10, 64)
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "ttl must be a non-negative integer.")
+		return
+	}
+
+	value, err := decodeKVValue(ctx)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	data, kind, err := inferValue(value)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	// 推断出类型之后再按照对应类型的限制检查请求体大小
+	if limit := maxValueSize[kind]; limit > 0 && ctx.Request.ContentLength > limit {
+		respondError(ctx, CodePayloadTooLarge, fmt.Sprintf("request body exceeds limit of %d bytes", limit))
+		return
+	}
+
+	if !checkStrictType(ctx, key, kind) {
+		return
+	}
+
+	seg, err := vfs.AcquirePoolSegment(key, data, ttl)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	version, err := putSegment(ctx.Request.Context(), key, seg)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	err = dropQuicklist(ctx.Request.Context(), key)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	putSucceed(ctx, version, seg)
+}
+
+// GetKVController 返回解码之后的值和类型，只支持 /kv 可以写入的四种类型
+func GetKVController(ctx *gin.Context) {
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+	seg, err = expandSegment(ctx.Request.Context(), seg)
+	defer utils.ReleaseToPool(seg)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	kind := seg.GetTypeString()
+	loader, ok := kvTypes[kind]
+	if !ok {
+		e := newAPIError(ctx, CodeTypeMismatch, fmt.Sprintf("key %s has type %s, use /%s/:key instead.", seg.GetKeyString(), kind, kind))
+		ctx.JSON(e.Status(), e.with(gin.H{"type": kind}))
+		return
+	}
+
+	value, data, err := loader.load(seg)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(data)
+
+	render(ctx, http.StatusOK, gin.H{
+		"type":  kind,
+		"value": value,
+		"ttl":   seg.TTL(),
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		key  string
+		body string
+		kind string
+	}{
+		{"list", `["a", 1, true]`, "collection"},
+		{"user", `{"name": "alice", "age": 30}`, "table"},
+		{"greeting", `"hello"`, "text"},
+		{"counter", `42`, "number"},
+		{"big", ` 9007199254740993 `, "number"},
+		{"ids", `[9007199254740993, -9223372036854775808, 0.5]`, "collection"},
+	}
+
+	for _, tt := range tests {
+		w := request(http.MethodPut, "/kv/"+tt.key, tt.body)
+		assert.Equal(t, http.StatusCreated, w.Code, tt.key)
+
+		meta, err := fss.StatKey(context.Background(), tt.key)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.kind, meta.Type)
+
+		w = request(http.MethodGet, "/kv/"+tt.key, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var entry struct {
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+		assert.Equal(t, tt.kind, entry.Type)
+		assert.JSONEq(t, tt.body, string(entry.Value))
+	}
+
+	// 超过 2^53 的整数不能经过 float64 丢失精度
+	w := request(http.MethodGet, "/kv/big", "")
+	assert.Contains(t, w.Body.String(), "9007199254740993")
+	w = request(http.MethodGet, "/kv/ids", "")
+	assert.Contains(t, w.Body.String(), "9007199254740993")
+
+	for _, body := range []string{`1.5`, `true`, `null`, `99999999999999999999`, `{`} {
+		w = request(http.MethodPut, "/kv/invalid", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	_, ok := fss.StatSegment("invalid")
+	assert.False(t, ok)
+
+	w = request(http.MethodPut, "/kv/session?ttl=60", `"token"`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodGet, "/kv/session", "")
+	var entry struct {
+		TTL int64 `json:"ttl"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Greater(t, entry.TTL, int64(0))
+	assert.LessOrEqual(t, entry.TTL, int64(60))
+
+	w = request(http.MethodPut, "/kv/session?ttl=-1", `"token"`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// /kv 不能读取其他类型的值
+	set := types.NewSet()
+	set.Add("alice")
+	seg, err := vfs.NewSegment("members", set, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("members", seg))
+
+	w = request(http.MethodGet, "/kv/members", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"type":"set"`)
+
+	// 严格模式按照推断出来的类型检查
+	w = request(http.MethodPut, "/kv/members?strict=true", `["alice"]`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"type_mismatch"`)
+
+	w = request(http.MethodPut, "/kv/list?strict=true", `["b"]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/kv/missing", "").Code)
+}
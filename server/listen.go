@@ -0,0 +1,121 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSocketPerm 是 Unix socket 文件的默认权限，同一个用户组的 sidecar 进程可以连接
+const defaultSocketPerm = fs.FileMode(0660)
+
+// localConnKey 标记通过 Unix socket 建立的连接
+type localConnKey struct{}
+
+// socketOwner 是 Unix socket 文件的权限和所属的用户组，gid 为 -1 时不修改用户组
+type socketOwner struct {
+	mode fs.FileMode
+	gid  int
+}
+
+// newSocketOwner 查找 socket 文件所属的用户组，group 可以是组名或者 gid
+func newSocketOwner(mode fs.FileMode, group string) (socketOwner, error) {
+	owner := socketOwner{mode: mode, gid: -1}
+	if owner.mode == 0 {
+		owner.mode = defaultSocketPerm
+	}
+	if group == "" {
+		return owner, nil
+	}
+
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return owner, fmt.Errorf("unix socket group: %w", err)
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return owner, fmt.Errorf("unix socket group %s has no numeric gid", group)
+		}
+	}
+	owner.gid = gid
+	return owner, nil
+}
+
+// listen 打开一个监听地址，Unix socket 文件已经存在时先删除上一次没有清理的文件，
+// 不是 socket 的文件不会被删除，抽象 socket 没有文件，不需要清理和设置权限
+func listen(bind conf.BindAddr, owner socketOwner) (net.Listener, error) {
+	if bind.Network != "unix" || bind.IsAbstract() {
+		return net.Listen(bind.Network, bind.Address)
+	}
+
+	info, err := os.Lstat(bind.Address)
+	if err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a unix socket", bind.Address)
+		}
+		// 还有进程在这个 socket 上监听时不能删除
+		conn, err := net.Dial("unix", bind.Address)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", bind.Address)
+		}
+		err = os.Remove(bind.Address)
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", bind.Address)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(bind.Address, owner.mode)
+	if err == nil && owner.gid >= 0 {
+		err = os.Chown(bind.Address, -1, owner.gid)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// markLocalConn 标记 Unix socket 连接，这些连接没有客户端 IP，只有本机的进程可以建立
+func markLocalConn(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.LocalAddr().(*net.UnixAddr); ok {
+		return context.WithValue(ctx, localConnKey{}, true)
+	}
+	return ctx
+}
+
+// localConn 检查请求是不是通过 Unix socket 发送的，这些请求不检查 IP 白名单，但是仍然需要认证
+func localConn(c *gin.Context) bool {
+	local, _ := c.Request.Context().Value(localConnKey{}).(bool)
+	return local
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urnadb.sock")
+	bind := conf.BindAddr{Network: "unix", Address: path}
+
+	// 上一次没有清理的 socket 文件会被删除
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	owner, err := newSocketOwner(0640, strconv.Itoa(os.Getgid()))
+	require.NoError(t, err)
+	ln, err := listen(bind, owner)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0640), info.Mode().Perm())
+
+	// 还在使用的 socket 不能被删除
+	_, err = listen(bind, owner)
+	assert.ErrorContains(t, err, "already in use")
+
+	require.NoError(t, ln.Close())
+	assert.NoFileExists(t, path)
+
+	// 不是 socket 的文件不会被删除
+	require.NoError(t, os.WriteFile(path, nil, fs.FileMode(0644)))
+	_, err = listen(bind, owner)
+	assert.ErrorContains(t, err, "is not a unix socket")
+	assert.FileExists(t, path)
+}
+
+func TestListen_AbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are only supported on linux")
+	}
+
+	bind := conf.BindAddr{Network: "unix", Address: fmt.Sprintf("@urnadb-test-%d", os.Getpid())}
+	owner, err := newSocketOwner(0, "")
+	require.NoError(t, err)
+	ln, err := listen(bind, owner)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	conn, err := net.Dial("unix", bind.Address)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestNewSocketOwner(t *testing.T) {
+	owner, err := newSocketOwner(0, "")
+	require.NoError(t, err)
+	assert.Equal(t, socketOwner{mode: defaultSocketPerm, gid: -1}, owner)
+
+	owner, err = newSocketOwner(0600, "1234")
+	require.NoError(t, err)
+	assert.Equal(t, socketOwner{mode: 0600, gid: 1234}, owner)
+
+	_, err = newSocketOwner(0, "urnadb-no-such-group")
+	assert.Error(t, err)
+}
+
+func TestHttpServer_Bind(t *testing.T) {
+	wasReady := ready.Load()
+	ready.Store(true)
+	defer func() {
+		ready.Store(wasReady)
+		setAllowList(nil)
+		rejections.mu.Lock()
+		rejections.total, rejections.origins = 0, nil
+		rejections.mu.Unlock()
+	}()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	socket := filepath.Join(t.TempDir(), "urnadb.sock")
+	opt := &conf.ServerOptions{
+		Port:   2668,
+		Bind:   []string{fmt.Sprintf("127.0.0.1:%d", port)},
+		Socket: conf.Socket{Path: socket},
+	}
+	binds, err := opt.Listeners()
+	require.NoError(t, err)
+	hts, err := New(&Options{Port: opt.Port, Bind: binds})
+	require.NoError(t, err)
+	assert.Equal(t, []conf.BindAddr{
+		{Network: "tcp4", Address: fmt.Sprintf("127.0.0.1:%d", port)},
+		{Network: "unix", Address: socket},
+	}, hts.Binds())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hts.Startup()
+	}()
+
+	tcpClient := &http.Client{Timeout: time.Second}
+	unixClient := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	get := func(client *http.Client, url string) (int, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Auth-Token", authPassword)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	tcpURL := fmt.Sprintf("http://127.0.0.1:%d/admin/allowlist", port)
+	require.Eventually(t, func() bool {
+		_, tcpErr := get(tcpClient, tcpURL)
+		_, unixErr := get(unixClient, "http://unix/admin/allowlist")
+		return tcpErr == nil && unixErr == nil
+	}, 3*time.Second, 20*time.Millisecond)
+
+	// 白名单不包含本机地址时只有 Unix socket 可以访问
+	setAllowList([]string{"10.0.0.0/8"})
+	code, err := get(tcpClient, tcpURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, err = get(unixClient, "http://unix/admin/allowlist")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	require.NoError(t, hts.serv.Shutdown(context.Background()))
+	assert.NoError(t, <-done)
+	assert.NoFileExists(t, socket)
+}
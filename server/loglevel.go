@@ -0,0 +1,176 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/gin-gonic/gin"
+)
+
+// logState 是修改日志级别之前的状态，TTL 到期之后恢复
+type logState struct {
+	level   clog.Level
+	modules map[string]clog.Level
+	debug   bool
+}
+
+// loglevel 运行期间临时修改的日志级别，只在内存中生效，不会记录到配置历史
+var loglevel struct {
+	mu       sync.Mutex
+	saved    *logState
+	timer    *time.Timer
+	revertAt time.Time
+	// generation 区分不同修改的定时器，已经被替换的定时器到期之后不恢复
+	generation uint64
+}
+
+// LogLevelInfo 是当前的日志级别，RevertAt 不为空时到期之后恢复修改之前的级别
+type LogLevelInfo struct {
+	Level    string            `json:"level"`
+	Modules  map[string]string `json:"modules"`
+	Debug    bool              `json:"debug"`
+	RevertAt *time.Time        `json:"revert_at,omitempty"`
+}
+
+func currentLogState() *logState {
+	return &logState{
+		level:   clog.GetLevel(),
+		modules: clog.ModuleLevels(),
+		debug:   gin.Mode() == gin.DebugMode,
+	}
+}
+
+func (s *logState) restore() {
+	clog.SetLevel(s.level)
+	current := clog.ModuleLevels()
+	for module := range current {
+		if _, ok := s.modules[module]; !ok {
+			clog.ResetModuleLevel(module)
+		}
+	}
+	for module, level := range s.modules {
+		clog.SetModuleLevel(module, level)
+	}
+	setDebugMode(s.debug)
+}
+
+func setDebugMode(debug bool) {
+	if debug {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+}
+
+func logLevelInfo() LogLevelInfo {
+	info := LogLevelInfo{
+		Level:   clog.GetLevel().String(),
+		Modules: make(map[string]string),
+		Debug:   gin.Mode() == gin.DebugMode,
+	}
+	for module, level := range clog.ModuleLevels() {
+		info.Modules[module] = level.String()
+	}
+	if loglevel.timer != nil {
+		revertAt := loglevel.revertAt
+		info.RevertAt = &revertAt
+	}
+	return info
+}
+
+// revertLogLevel 恢复第一次临时修改之前的日志级别
+func revertLogLevel(generation uint64) {
+	loglevel.mu.Lock()
+	defer loglevel.mu.Unlock()
+
+	if loglevel.generation != generation || loglevel.saved == nil {
+		return
+	}
+	loglevel.saved.restore()
+	loglevel.saved, loglevel.timer = nil, nil
+	slog.Infof("Log level reverted to %s", clog.GetLevel())
+}
+
+// GetLogLevelController 返回当前的日志级别和恢复的时间
+func GetLogLevelController(ctx *gin.Context) {
+	loglevel.mu.Lock()
+	defer loglevel.mu.Unlock()
+	ctx.IndentedJSON(http.StatusOK, logLevelInfo())
+}
+
+// PutLogLevelController 修改全局或者某个模块的日志级别，debug 同时切换 gin 的调试模式，
+// ttl 秒之后恢复到第一次修改之前的状态，没有 ttl 的修改一直生效
+func PutLogLevelController(ctx *gin.Context) {
+	var req struct {
+		Level  string `json:"level"`
+		Module string `json:"module"`
+		Debug  *bool  `json:"debug"`
+		TTL    uint32 `json:"ttl"`
+	}
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil || (req.Level == "" && req.Debug == nil) {
+		respondError(ctx, CodeBadRequest, "level or debug is required.")
+		return
+	}
+
+	// 只开启调试模式时日志级别切换为 debug，只关闭调试模式时日志级别保持不变
+	level, change := clog.DebugLevel, req.Level != "" || *req.Debug
+	if req.Level != "" {
+		level, err = clog.ParseLevel(req.Level)
+		if err != nil {
+			failed(ctx, CodeBadRequest, err)
+			return
+		}
+	}
+
+	loglevel.mu.Lock()
+	defer loglevel.mu.Unlock()
+
+	if loglevel.timer != nil {
+		loglevel.timer.Stop()
+		loglevel.timer = nil
+	}
+	loglevel.generation++
+	if req.TTL > 0 {
+		// 连续的临时修改到期之后都恢复到第一次修改之前的状态
+		if loglevel.saved == nil {
+			loglevel.saved = currentLogState()
+		}
+		generation := loglevel.generation
+		loglevel.timer = time.AfterFunc(time.Duration(req.TTL)*time.Second, func() {
+			revertLogLevel(generation)
+		})
+		loglevel.revertAt = time.Now().Add(time.Duration(req.TTL) * time.Second)
+	} else {
+		loglevel.saved = nil
+	}
+
+	if change && req.Module != "" {
+		clog.SetModuleLevel(req.Module, level)
+	} else if change {
+		clog.SetLevel(level)
+	}
+	if req.Debug != nil {
+		setDebugMode(*req.Debug)
+	}
+
+	info := logLevelInfo()
+	requestLog(ctx).Infof("Log level changed to %s with modules %v and debug mode %t by %s", info.Level, info.Modules, info.Debug, ctx.ClientIP())
+	ctx.JSON(http.StatusOK, info)
+}
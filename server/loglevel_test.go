@@ -0,0 +1,87 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/clog"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelController(t *testing.T) {
+	wasReady := ready.Load()
+	ready.Store(true)
+	defer func() {
+		clog.SetLevel(clog.InfoLevel)
+		clog.ResetModuleLevel("vfs")
+		gin.SetMode(gin.ReleaseMode)
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, body string) (*httptest.ResponseRecorder, LogLevelInfo) {
+		req := httptest.NewRequest(method, "/admin/loglevel", strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		var info LogLevelInfo
+		_ = json.Unmarshal(w.Body.Bytes(), &info)
+		return w, info
+	}
+
+	w, _ := request(http.MethodPut, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, _ = request(http.MethodPut, `{"level": "verbose"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 开启调试模式之后到期恢复为修改之前的状态
+	w, info := request(http.MethodPut, `{"debug": true, "ttl": 600}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "debug", info.Level)
+	assert.True(t, info.Debug)
+	assert.NotNil(t, info.RevertAt)
+	assert.Equal(t, gin.DebugMode, gin.Mode())
+
+	w, info = request(http.MethodPut, `{"level": "error", "module": "vfs", "ttl": 600}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "error", info.Modules["vfs"])
+
+	// 被替换的定时器到期之后不会恢复
+	revertLogLevel(loglevel.generation - 1)
+	_, info = request(http.MethodGet, "")
+	assert.Equal(t, "debug", info.Level)
+
+	revertLogLevel(loglevel.generation)
+	_, info = request(http.MethodGet, "")
+	assert.Equal(t, "info", info.Level)
+	assert.False(t, info.Debug)
+	assert.Empty(t, info.Modules)
+	assert.Nil(t, info.RevertAt)
+	assert.Equal(t, gin.ReleaseMode, gin.Mode())
+
+	// 没有 ttl 的修改一直生效
+	w, info = request(http.MethodPut, `{"level": "warn"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "warn", info.Level)
+	assert.Nil(t, info.RevertAt)
+	assert.Equal(t, clog.WarnLevel, clog.GetLevel())
+}
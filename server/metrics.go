@@ -0,0 +1,101 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// Prometheus 文本格式的 Content-Type
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// poolMetrics 是对象池导出的指标，value 从对象池的统计信息中取出对应的值
+var poolMetrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(s utils.PoolStats) any
+}{
+	{"urnadb_pool_acquired_total", "counter", "Objects handed out by the object pool.", func(s utils.PoolStats) any { return s.Acquired }},
+	{"urnadb_pool_released_total", "counter", "Objects returned to the object pool.", func(s utils.PoolStats) any { return s.Released }},
+	{"urnadb_pool_in_use", "gauge", "Objects handed out and not returned yet.", func(s utils.PoolStats) any { return s.InUse }},
+	{"urnadb_pool_leaked_total", "counter", "Objects garbage collected without being returned, only counted with leak detection enabled.", func(s utils.PoolStats) any { return s.Leaked }},
+}
+
+// compactionMetrics 是垃圾回收导出的墓碑和回收空间的指标
+var compactionMetrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(s vfs.CompactionStats) uint64
+}{
+	{"urnadb_tombstones_written_total", "counter", "Tombstones appended by deletes.", func(s vfs.CompactionStats) uint64 { return s.TombstonesWritten }},
+	{"urnadb_tombstones_retained", "gauge", "Tombstones kept by the last compaction because they are within the grace period.", func(s vfs.CompactionStats) uint64 { return s.TombstonesRetained }},
+	{"urnadb_tombstones_reclaimed_total", "counter", "Tombstones dropped by compaction.", func(s vfs.CompactionStats) uint64 { return s.TombstonesReclaimed }},
+	{"urnadb_tombstones_reclaimed_bytes_total", "counter", "Bytes of tombstones dropped by compaction.", func(s vfs.CompactionStats) uint64 { return s.TombstoneBytesReclaimed }},
+	{"urnadb_compaction_reclaimed_bytes_total", "counter", "Bytes freed by compaction, including stale records and dropped tombstones.", func(s vfs.CompactionStats) uint64 { return s.BytesReclaimed }},
+}
+
+// bulkheadMetrics 是并发隔离导出的指标，没有开启并发隔离时只输出指标说明
+var bulkheadMetrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(s BulkheadStats) any
+}{
+	{"urnadb_bulkhead_in_flight", "gauge", "Expensive requests being processed in the bulkhead.", func(s BulkheadStats) any { return s.InFlight }},
+	{"urnadb_bulkhead_queued", "gauge", "Expensive requests waiting for a free slot in the bulkhead.", func(s BulkheadStats) any { return s.Queued }},
+	{"urnadb_bulkhead_rejected_total", "counter", "Expensive requests rejected because the bulkhead queue was full or the wait timed out.", func(s BulkheadStats) any { return s.Rejected }},
+}
+
+// 被白名单拒绝的请求数，每个客户端地址的次数通过 /admin/allowlist 查看
+const rejectedMetric = "urnadb_allowlist_rejected_total"
+
+// GetMetricsController 以 Prometheus 文本格式返回服务器的指标
+func GetMetricsController(ctx *gin.Context) {
+	stats := utils.ReadPoolStats()
+
+	var buf bytes.Buffer
+	for _, m := range poolMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range stats {
+			fmt.Fprintf(&buf, "%s{pool=%q} %v\n", m.name, s.Name, m.value(s))
+		}
+	}
+
+	fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", rejectedMetric, "Requests rejected by the client IP allowlist.", rejectedMetric, rejectedMetric, rejectedTotal())
+
+	for _, m := range bulkheadMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range bulkheadStats() {
+			fmt.Fprintf(&buf, "%s{class=%q} %v\n", m.name, s.Class, m.value(s))
+		}
+	}
+
+	if storage != nil {
+		compaction := storage.CompactionStats()
+		for _, m := range compactionMetrics {
+			fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value(compaction))
+		}
+	}
+
+	ctx.Data(http.StatusOK, metricsContentType, buf.Bytes())
+}
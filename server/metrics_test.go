@@ -0,0 +1,88 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	inUse := func(pool string) int {
+		w := request(http.MethodGet, "/metrics", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+		m := regexp.MustCompile(`urnadb_pool_in_use\{pool="` + pool + `"\} (-?\d+)`).FindStringSubmatch(w.Body.String())
+		if !assert.Len(t, m, 2) {
+			return 0
+		}
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+
+	w := request(http.MethodPut, "/text/note", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	request(http.MethodPut, "/hll/visitors", `{"members": ["a"]}`)
+
+	segments, hlls := inUse("segment"), inUse("hll")
+
+	// 读取、通用查询和读改写的每条路径都要归还 Segment
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, request(http.MethodGet, "/text/note", "").Code)
+		assert.Equal(t, http.StatusOK, request(http.MethodGet, "/query/note", "").Code)
+		assert.Equal(t, http.StatusOK, request(http.MethodPost, "/hll/visitors/add", `{"members": ["b"]}`).Code)
+		assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/hll/visitors/merge", `{"keys": ["note"]}`).Code)
+	}
+
+	assert.Equal(t, segments, inUse("segment"))
+	assert.Equal(t, hlls, inUse("hll"))
+
+	w = request(http.MethodGet, "/metrics", "")
+	assert.Contains(t, w.Body.String(), "urnadb_tombstones_written_total ")
+	assert.Contains(t, w.Body.String(), "urnadb_compaction_reclaimed_bytes_total ")
+}
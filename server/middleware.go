@@ -0,0 +1,137 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultKeySize   = 256
+	defaultValueSize = int64(8 << 20) // 8MB
+)
+
+var (
+	maxKeySize   = defaultKeySize
+	maxValueSize = map[string]int64{
+		"set":        defaultValueSize,
+		"zset":       defaultValueSize,
+		"text":       defaultValueSize / 2,
+		"table":      defaultValueSize * 2,
+		"number":     1024,
+		"collection": defaultValueSize * 2,
+	}
+	// Key 只允许可见的 ASCII 字母、数字和部分分隔符
+	keyPattern = regexp.MustCompile(`^[a-zA-Z0-9_\-:.@]+$`)
+)
+
+// validateKey 检查 key 的长度和字符集是否合法
+func validateKey(key string) error {
+	if len(key) > maxKeySize {
+		return fmt.Errorf("key length %d exceeds limit of %d bytes", len(key), maxKeySize)
+	}
+	if !keyPattern.MatchString(key) {
+		return errors.New("key contains illegal characters")
+	}
+	return nil
+}
+
+// errReservedKey 是客户端通过数据接口写入内部使用的 key 时返回的错误
+var errReservedKey = errors.New("key prefix is reserved for internal use")
+
+// isUserWrite 判断请求是否为数据接口的写入，管理接口可以修改内部使用的 key
+func isUserWrite(c *gin.Context) bool {
+	method := c.Request.Method
+	return method != http.MethodGet && method != http.MethodHead && !isAdminPath(c.FullPath())
+}
+
+// valueSizeLimit 根据请求路由 /{types}/:key 找到对应类型的请求体大小限制
+func valueSizeLimit(route string) int64 {
+	kind := strings.Split(strings.TrimPrefix(route, "/"), "/")[0]
+	if limit, ok := maxValueSize[kind]; ok {
+		return limit
+	}
+	return defaultValueSize
+}
+
+// limitMiddleware 在进入控制器之前校验 key 并限制请求体大小，
+// gin 绑定 JSON 时会把请求体全部读入内存，超大的请求体必须在这里拦截掉。
+func limitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		if key != "" {
+			err := validateKey(key)
+			if err != nil {
+				failed(c, CodeBadRequest, err)
+				c.Abort()
+				return
+			}
+			// 存储过程、钩子等内部使用的 key 只能通过各自的接口修改
+			if isUserWrite(c) && isInternalKey(key) {
+				failed(c, CodeBadRequest, errReservedKey)
+				c.Abort()
+				return
+			}
+		}
+
+		// 频道名称会拼接为持久化消息的 key，和 key 使用相同的校验规则
+		channel := c.Param("channel")
+		if channel != "" {
+			err := validateKey(channel)
+			if err != nil {
+				failed(c, CodeBadRequest, err)
+				c.Abort()
+				return
+			}
+		}
+
+		if c.Request.Body == nil || c.Request.Method == http.MethodGet {
+			c.Next()
+			return
+		}
+
+		limit := valueSizeLimit(c.FullPath())
+		if c.Request.ContentLength > limit {
+			respondError(c, CodePayloadTooLarge, fmt.Sprintf("request body exceeds limit of %d bytes", limit))
+			c.Abort()
+			return
+		}
+
+		// Content-Length 可能不存在或者被伪造，最多只读取 limit 个字节
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				respondError(c, CodePayloadTooLarge, fmt.Sprintf("request body exceeds limit of %d bytes", limit))
+			} else {
+				failed(c, CodeBadRequest, err)
+			}
+			c.Abort()
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		c.Next()
+	}
+}
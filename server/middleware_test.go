@@ -0,0 +1,59 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateKey(t *testing.T) {
+	assert.NoError(t, validateKey("user-01:profile"))
+	assert.Error(t, validateKey("user 01"))
+	assert.Error(t, validateKey(strings.Repeat("k", maxKeySize+1)))
+}
+
+func TestLimitMiddleware(t *testing.T) {
+	router := gin.New()
+	router.Use(limitMiddleware())
+	router.PUT("/number/:key", func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{name: "accepted", path: "/number/key-01", body: `{"number": 1}`, want: http.StatusCreated},
+		{name: "illegal key", path: "/number/key%2301", body: `{"number": 1}`, want: http.StatusBadRequest},
+		{name: "too large", path: "/number/key-01", body: strings.Repeat("1", 2048), want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body))
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/urnadb/cluster"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	migrationStreaming = "streaming"
+	migrationCutover   = "cutover"
+	migrationDone      = "done"
+	migrationFailed    = "failed"
+	// 迁移的写操作积压超过 migrationBacklog 时暂停扫描，等待目标节点追上
+	migrationBacklog = defaultMaxHints / 2
+	// 目标节点超过 migrationTimeout 没有处理任何写操作时迁移失败
+	migrationTimeout = time.Minute
+)
+
+// cutoverGrace 切换路由之后等待已经进入本节点的写请求处理完成
+var cutoverGrace = timeout
+
+// routes 是迁移之后固定的路由，优先于哈希环的结果，所有节点的路由表通过广播保持一致
+var routes struct {
+	mu   sync.RWMutex
+	list []cluster.Route
+	path string
+}
+
+// Migration 是把一部分 keyspace 从本节点迁移到 Target 的任务
+type Migration struct {
+	ID         int           `json:"id"`
+	Slice      cluster.Slice `json:"slice"`
+	Target     string        `json:"target"`
+	State      string        `json:"state"`
+	Keys       int           `json:"keys"`
+	Error      string        `json:"error,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+type migration struct {
+	info  Migration
+	queue *handoff
+	stop  chan struct{}
+}
+
+var migrations struct {
+	mu      sync.Mutex
+	history []*migration
+	// 迁移期间本地的写入同时转发到目标节点
+	active atomic.Pointer[migration]
+}
+
+// locateOwner 返回负责 key 的节点，routed 表示结果来自迁移之后的路由
+func locateOwner(key string) (owner string, routed bool) {
+	routes.mu.RLock()
+	owner, routed = cluster.Lookup(routes.list, placementKey(key))
+	routes.mu.RUnlock()
+	if routed {
+		return owner, true
+	}
+	return shards.ring.Locate(key), false
+}
+
+// loadRoutes 从数据目录恢复迁移之后的路由
+func loadRoutes(dir string) error {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+
+	routes.path = filepath.Join(dir, "routes.json")
+	data, err := os.ReadFile(routes.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &routes.list)
+}
+
+// setRoutes 替换路由表并且保存到数据目录
+func setRoutes(list []cluster.Route) error {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+
+	routes.list = list
+	if routes.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(routes.path, data, 0644)
+}
+
+func currentRoutes() []cluster.Route {
+	routes.mu.RLock()
+	defer routes.mu.RUnlock()
+	return append([]cluster.Route{}, routes.list...)
+}
+
+// observeWrite 是注册到存储上的写入钩子，更新键空间统计并转发迁移中的写入
+func observeWrite(seg *vfs.Segment) {
+	if analytics != nil {
+		analytics.observe(seg)
+	}
+	if m := migrations.active.Load(); m != nil {
+		m.forward(seg)
+	}
+	hooks.dispatch(seg)
+}
+
+// forward 把属于迁移范围的写入发送到目标节点，删除带上时间戳用于比较新旧
+func (m *migration) forward(seg *vfs.Segment) {
+	key := seg.GetKeyString()
+	if !m.info.Slice.Contains(placementKey(key)) {
+		return
+	}
+
+	op := vfs.Operation{Kind: vfs.OpPut, Key: key, Segment: seg}
+	if seg.IsTombstone() {
+		op.Kind = vfs.OpDelete
+	}
+
+	payload, err := msgpack.Marshal(&op)
+	if err != nil {
+		slog.Errorf("failed to encode migrated write of key %s: %v", key, err)
+		return
+	}
+	m.queue.push(payload)
+}
+
+func (m *migration) update(fn func(info *Migration)) {
+	migrations.mu.Lock()
+	fn(&m.info)
+	migrations.mu.Unlock()
+}
+
+// backlog 返回还没有发送到目标节点的写操作数量
+func (h *handoff) backlog() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.pending)
+}
+
+// waitBacklog 等待积压的写操作减少到 limit 以内，目标节点长时间没有进展时返回错误
+func (h *handoff) waitBacklog(limit int) error {
+	last, deadline := h.backlog(), time.Now().Add(migrationTimeout)
+	for {
+		n := h.backlog()
+		if n <= limit {
+			return nil
+		}
+		if n < last {
+			last, deadline = n, time.Now().Add(migrationTimeout)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("node %s made no progress with %d pending writes", h.node, n)
+		}
+		select {
+		case h.notify <- struct{}{}:
+		default:
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (m *migration) run(fss *vfs.LogStructuredFS) {
+	err := m.stream(fss)
+	if err == nil {
+		err = m.cutover(fss)
+	}
+
+	migrations.active.CompareAndSwap(m, nil)
+	close(m.stop)
+
+	now := time.Now()
+	m.update(func(info *Migration) {
+		info.FinishedAt = &now
+		info.State = migrationDone
+		if err != nil {
+			info.State = migrationFailed
+			info.Error = err.Error()
+		}
+	})
+
+	if err != nil {
+		slog.Errorf("Migration %d to node %s failed: %v", m.info.ID, m.info.Target, err)
+		return
+	}
+	slog.Infof("Migration %d moved %d keys to node %s", m.info.ID, m.info.Keys, m.info.Target)
+}
+
+// stream 扫描本地的数据文件，把属于迁移范围的 key 发送到目标节点，
+// 扫描期间的新写入由写入钩子转发，目标节点按照创建时间保留更新的版本
+func (m *migration) stream(fss *vfs.LogStructuredFS) error {
+	var inner error
+	err := fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if !m.info.Slice.Contains(placementKey(key)) {
+			return true
+		}
+
+		// 扫描到的版本已经被更新或者删除时，新的写操作已经转发过去了
+		_, current, err := fss.FetchSegment(key)
+		if err != nil {
+			return true
+		}
+		moved := current.CreatedAt != seg.CreatedAt
+		utils.ReleaseToPool(current)
+		if moved {
+			return true
+		}
+
+		encoded, err := seg.Reencode()
+		if err != nil {
+			inner = err
+			return false
+		}
+		payload, err := msgpack.Marshal(&vfs.Operation{Kind: vfs.OpPut, Key: key, Segment: encoded})
+		if err != nil {
+			inner = err
+			return false
+		}
+
+		inner = m.queue.waitBacklog(migrationBacklog)
+		if inner != nil {
+			return false
+		}
+		m.queue.push(payload)
+		m.update(func(info *Migration) { info.Keys++ })
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return inner
+}
+
+// cutover 等待数据全部发送完成之后切换路由，再删除本地已经迁移走的 key
+func (m *migration) cutover(fss *vfs.LogStructuredFS) error {
+	m.update(func(info *Migration) { info.State = migrationCutover })
+
+	err := m.queue.waitBacklog(0)
+	if err != nil {
+		return err
+	}
+
+	list := append(currentRoutes(), cluster.Route{Slice: m.info.Slice, Node: m.info.Target})
+	err = setRoutes(list)
+	if err != nil {
+		return fmt.Errorf("failed to save routes: %w", err)
+	}
+	broadcastRoutes(list)
+
+	// 切换路由之前进入本节点的写请求还会写入本地，等待它们处理完并且转发过去
+	time.Sleep(cutoverGrace)
+	err = m.queue.waitBacklog(0)
+	if err != nil {
+		return err
+	}
+	migrations.active.CompareAndSwap(m, nil)
+
+	var keys []string
+	err = fss.RangeSegments(func(seg *vfs.Segment) bool {
+		if m.info.Slice.Contains(placementKey(seg.GetKeyString())) {
+			keys = append(keys, seg.GetKeyString())
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// 直接删除本地数据，不能复制到其他节点
+	for _, key := range keys {
+		err := fss.Apply(&vfs.Operation{Kind: vfs.OpDelete, Key: key})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// broadcastRoutes 把路由表发送给其他节点，发送失败的节点仍然会被本节点转发到正确的节点
+func broadcastRoutes(list []cluster.Route) {
+	body, err := json.Marshal(gin.H{"routes": list})
+	if err != nil {
+		slog.Errorf("failed to encode routes: %v", err)
+		return
+	}
+
+	for _, node := range shards.ring.Nodes() {
+		if node == shards.self {
+			continue
+		}
+		resp, err := peerRequest(http.MethodPut, replicaURL(node, "/admin/routes", nil), mimeJSON, bytes.NewReader(body))
+		if err != nil {
+			slog.Warnf("Failed to update routes of node %s: %v", node, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+func inRing(node string) bool {
+	for _, n := range shards.ring.Nodes() {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+type MigrationRequest struct {
+	cluster.Slice
+	Target string `json:"target" binding:"required"`
+}
+
+// CreateMigrationController 开始把一部分 keyspace 迁移到其他节点，迁移在后台进行，同一时间只能有一个迁移
+func CreateMigrationController(ctx *gin.Context) {
+	if shards.ring == nil {
+		respondError(ctx, CodeFeatureDisabled, "cluster mode is not enabled.")
+		return
+	}
+
+	var req MigrationRequest
+	err := bindBody(ctx, &req)
+	if err == nil {
+		err = req.Slice.Validate()
+	}
+	if err == nil && (req.Target == shards.self || !inRing(req.Target)) {
+		err = fmt.Errorf("target %s must be another node of the cluster", req.Target)
+	}
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	dir := filepath.Join(storage.GetDirectory(), "migrations")
+	err = os.MkdirAll(dir, 0755)
+	var queue *handoff
+	if err == nil {
+		queue, err = openHandoff(dir, req.Target)
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	migrations.mu.Lock()
+	m := &migration{
+		info: Migration{
+			ID:        len(migrations.history) + 1,
+			Slice:     req.Slice,
+			Target:    req.Target,
+			State:     migrationStreaming,
+			StartedAt: time.Now(),
+		},
+		queue: queue,
+		stop:  make(chan struct{}),
+	}
+	if !migrations.active.CompareAndSwap(nil, m) {
+		migrations.mu.Unlock()
+		respondError(ctx, CodeBusy, "another migration is running.")
+		return
+	}
+	migrations.history = append(migrations.history, m)
+	info := m.info
+	migrations.mu.Unlock()
+
+	go queue.run(m.stop)
+	go m.run(storage)
+
+	ctx.IndentedJSON(http.StatusAccepted, info)
+}
+
+// ListMigrationsController 返回所有迁移任务和它们的进度
+func ListMigrationsController(ctx *gin.Context) {
+	migrations.mu.Lock()
+	list := make([]Migration, 0, len(migrations.history))
+	for _, m := range migrations.history {
+		list = append(list, m.info)
+	}
+	migrations.mu.Unlock()
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"migrations": list,
+	})
+}
+
+// GetRoutesController 返回迁移之后固定的路由
+func GetRoutesController(ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"routes": currentRoutes(),
+	})
+}
+
+type RoutesRequest struct {
+	Routes []cluster.Route `json:"routes"`
+}
+
+// PutRoutesController 替换本节点的路由表，迁移完成时由源节点广播给所有节点
+func PutRoutesController(ctx *gin.Context) {
+	if shards.ring == nil {
+		respondError(ctx, CodeFeatureDisabled, "cluster mode is not enabled.")
+		return
+	}
+
+	var req RoutesRequest
+	err := bindBody(ctx, &req)
+	if err == nil {
+		for _, route := range req.Routes {
+			err = route.Validate()
+			if err == nil && !inRing(route.Node) {
+				err = fmt.Errorf("route node %s is not a node of the cluster", route.Node)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	err = setRoutes(req.Routes)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"routes": req.Routes,
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/cluster"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigration(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	target := &fakeReplica{up: true, ops: make(map[string]vfs.OpKind)}
+	remote := httptest.NewServer(target)
+	defer remote.Close()
+
+	self, other := "127.0.0.1:1", strings.TrimPrefix(remote.URL, "http://")
+
+	old, wasReady, grace := storage, ready.Load(), cutoverGrace
+	storage = fss
+	ready.Store(true)
+	cutoverGrace = 10 * time.Millisecond
+	hs := new(HttpServer)
+	hs.SetCluster(self, []string{self, other}, 0, true)
+	assert.NoError(t, loadRoutes(fss.GetDirectory()))
+	fss.SetWriteHook(observeWrite)
+	defer func() {
+		fss.SetWriteHook(nil)
+		storage = old
+		ready.Store(wasReady)
+		cutoverGrace = grace
+		shards.ring, shards.proxies, shards.redirect = nil, nil, false
+		routes.list, routes.path = nil, ""
+		migrations.history = nil
+	}()
+
+	for _, key := range []string{"user:1", "user:2", "order:1"} {
+		seg, err := vfs.NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", mimeJSON)
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(closeNotifyRecorder{w}, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/admin/migrations", `{"prefix":"user:","target":"`+self+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPost, "/admin/migrations", `{"target":"`+other+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/migrations", `{"prefix":"user:","target":"`+other+`"}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var list struct {
+		Migrations []Migration `json:"migrations"`
+	}
+	assert.Eventually(t, func() bool {
+		w := request(http.MethodGet, "/admin/migrations", "")
+		return json.Unmarshal(w.Body.Bytes(), &list) == nil &&
+			len(list.Migrations) == 1 && list.Migrations[0].State == migrationDone
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, list.Migrations[0].Keys)
+
+	// 迁移范围内的 key 发送到目标节点之后从本地删除
+	ops := target.received()
+	assert.Equal(t, vfs.OpPut, ops["user:1"])
+	assert.Equal(t, vfs.OpPut, ops["user:2"])
+	assert.NotContains(t, ops, "order:1")
+	_, _, err = fss.FetchSegment("user:1")
+	assert.Error(t, err)
+	_, _, err = fss.FetchSegment("order:1")
+	assert.NoError(t, err)
+
+	// 路由表保存到数据目录并且广播给其他节点
+	assert.Equal(t, []cluster.Route{{Slice: cluster.Slice{Prefix: "user:"}, Node: other}}, currentRoutes())
+	assert.True(t, fileExists(filepath.Join(fss.GetDirectory(), "routes.json")))
+	target.mu.Lock()
+	assert.Contains(t, string(target.routes), `"prefix":"user:"`)
+	target.mu.Unlock()
+
+	// 迁移走的 key 即使哈希环上属于本节点也会重定向到目标节点
+	w = request(http.MethodGet, "/text/user:1", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, remote.URL+"/text/user:1", w.Header().Get("Location"))
+
+	w = request(http.MethodGet, "/admin/routes", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), other)
+
+	w = request(http.MethodPut, "/admin/routes", `{"routes":[{"prefix":"user:","node":"127.0.0.1:2"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPut, "/admin/routes", `{"routes":[]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, currentRoutes())
+}
@@ -0,0 +1,497 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openapi.json 在构建之前由 go generate 根据注册的路由和下面的接口描述生成，
+// 修改了路由之后需要重新生成，TestOpenAPISpec 会检查文档是否和路由一致。
+//
+//go:generate go test -run TestOpenAPISpec -update .
+
+//go:embed openapi.json
+var openapiSpec []byte
+
+// 接口文档不包含数据，不需要认证
+var openapiPaths = map[string]bool{
+	"/openapi.json": true,
+	"/swagger":      true,
+}
+
+// 是否开启 /swagger 页面，文档本身始终可以访问
+var swaggerEnabled bool
+
+// operation 描述一个接口，Body 和 Response 为 components/schemas 中的名称
+type operation struct {
+	Tag      string
+	Summary  string
+	Body     string
+	Response string
+	Status   int
+	Query    []string
+}
+
+// 每种数据类型都有相同的 GET/PUT/DELETE 接口，Body 为对应类型的请求体
+var dataTypes = []struct {
+	Name   string
+	Schema string
+}{
+	{"set", "Set"},
+	{"zset", "ZSet"},
+	{"text", "Text"},
+	{"table", "Table"},
+	{"number", "Number"},
+	{"stream", "Stream"},
+	{"hll", "HLL"},
+	{"queue", "Queue"},
+	{"collection", "Collection"},
+}
+
+var operations = map[string]operation{
+	"GET /":                             {Tag: "system", Summary: "Server version, key count and resource usage.", Response: "SystemInfo"},
+	"GET /livez":                        {Tag: "system", Summary: "Liveness probe, the process is able to serve HTTP requests."},
+	"GET /readyz":                       {Tag: "system", Summary: "Readiness probe with dependency checks and recovery progress."},
+	"GET /metrics":                      {Tag: "system", Summary: "Object pool metrics in the Prometheus text format."},
+	"GET /openapi.json":                 {Tag: "system", Summary: "This OpenAPI document."},
+	"GET /swagger":                      {Tag: "system", Summary: "Swagger UI for this OpenAPI document."},
+	"POST /auth/login":                  {Tag: "auth", Summary: "Exchange the auth password for a short-lived session token sent as Authorization: Bearer.", Body: "Login", Response: "Session"},
+	"POST /auth/logout":                 {Tag: "auth", Summary: "Revoke the session token of this request on this node.", Status: http.StatusNoContent},
+	"GET /console":                      {Tag: "console", Summary: "Admin web console page."},
+	"GET /console/assets/*filepath":     {Tag: "console", Summary: "Admin web console static assets."},
+	"GET /admin/namespaces":             {Tag: "admin", Summary: "Key count and disk usage of namespaces with quotas."},
+	"GET /admin/prefixes":               {Tag: "admin", Summary: "Key count and bytes of every first-level key prefix."},
+	"GET /admin/prefixes/:prefix/keys":  {Tag: "admin", Summary: "Browse keys under a first-level key prefix in write order.", Query: []string{"offset", "limit"}},
+	"DELETE /admin/prefixes/:prefix":    {Tag: "admin", Summary: "Delete every key under a first-level key prefix, call again with the returned token to confirm.", Query: []string{"confirm"}},
+	"GET /admin/analytics":              {Tag: "admin", Summary: "Keyspace value size and TTL histograms.", Query: []string{"top"}},
+	"GET /admin/hotkeys":                {Tag: "admin", Summary: "Most frequently accessed keys.", Query: []string{"n"}},
+	"GET /admin/cluster":                {Tag: "admin", Summary: "Cluster nodes, and the node owning key when it is given.", Query: []string{"key"}},
+	"GET /admin/raft":                   {Tag: "admin", Summary: "Raft state of this node, the current leader, its applied log index and the last index reported by the leader."},
+	"GET /admin/routes":                 {Tag: "admin", Summary: "Fixed routes of keyspace slices moved by migrations."},
+	"PUT /admin/routes":                 {Tag: "admin", Summary: "Replace the fixed routes of this node.", Body: "Routes"},
+	"GET /admin/migrations":             {Tag: "admin", Summary: "List keyspace migrations and their progress."},
+	"POST /admin/migrations":            {Tag: "admin", Summary: "Move a hash range or key prefix to another node while serving traffic.", Body: "Migration", Status: http.StatusAccepted},
+	"POST /replica":                     {Tag: "replica", Summary: "Apply a write replicated from another node, encoded as MessagePack.", Status: http.StatusOK},
+	"GET /replica/merkle":               {Tag: "replica", Summary: "Merkle tree of the keys shared with node, used by anti-entropy repair.", Query: []string{"node"}},
+	"GET /replica/digests/:bucket":      {Tag: "replica", Summary: "Digests of the keys shared with node in one Merkle tree bucket.", Query: []string{"node"}},
+	"GET /replica/segments/:key":        {Tag: "replica", Summary: "Msgpack encoded record of a key, used to repair a corrupted record on another replica."},
+	"GET /admin/keys":                   {Tag: "admin", Summary: "Browse keys in write order.", Query: []string{"prefix", "offset", "limit"}},
+	"POST /admin/delete":                {Tag: "admin", Summary: "Delete the keys matching a prefix and glob pattern, dry_run only counts them.", Query: []string{"prefix", "pattern", "dry_run"}},
+	"GET /admin/keys/:key":              {Tag: "admin", Summary: "Inspect the metadata and decoded value of a key."},
+	"PUT /admin/keys/:key/ttl":          {Tag: "admin", Summary: "Change the TTL of a key, 0 never expires.", Body: "KeyTTL"},
+	"GET /admin/compact/schedule":       {Tag: "admin", Summary: "Region compaction schedule and its next n run times.", Query: []string{"n"}},
+	"POST /admin/compact":               {Tag: "admin", Summary: "Run region compaction immediately."},
+	"POST /admin/compact/pause":         {Tag: "admin", Summary: "Pause region compaction until it is resumed, a running compaction stops after its current region.", Body: "CompactPause", Response: "CompactionStatus"},
+	"POST /admin/compact/resume":        {Tag: "admin", Summary: "Resume paused region compaction.", Response: "CompactionStatus"},
+	"GET /admin/regions":                {Tag: "admin", Summary: "Per-region live keys, live and dead bytes, creation time and size."},
+	"GET /admin/index":                  {Tag: "admin", Summary: "Index shards and keys in memory and in spill files, keys estimates the memory of that many resident keys.", Query: []string{"keys"}},
+	"GET /admin/tiering":                {Tag: "admin", Summary: "Number of regions stored locally and in object storage."},
+	"POST /admin/tiering":               {Tag: "admin", Summary: "Upload cold sealed regions to object storage immediately."},
+	"GET /admin/backup":                 {Tag: "admin", Summary: "Regions and checkpoints kept in the continuous backup."},
+	"POST /admin/backup":                {Tag: "admin", Summary: "Back up sealed regions and the latest checkpoint immediately."},
+	"GET /admin/rollback":               {Tag: "admin", Summary: "Current log sequence number and the lowest one rollback can restore."},
+	"POST /admin/rollback":              {Tag: "admin", Summary: "Roll back keys changed after a log sequence number or a time.", Body: "Rollback"},
+	"POST /admin/undelete/:key":         {Tag: "admin", Summary: "Restore a deleted key from the trash."},
+	"GET /admin/allowlist":              {Tag: "admin", Summary: "Client IP allowlist and the most rejected client addresses."},
+	"PUT /admin/allowlist":              {Tag: "admin", Summary: "Replace the client IP allowlist of IPs and CIDR ranges, an empty list disables it.", Body: "AllowList", Query: []string{"force"}},
+	"GET /admin/config":                 {Tag: "admin", Summary: "Current configuration version with secrets hidden."},
+	"PUT /admin/config":                 {Tag: "admin", Summary: "Apply configuration changes to the running server, recorded as a new version.", Body: "Config"},
+	"GET /admin/config/history":         {Tag: "admin", Summary: "Every applied configuration version with its author and changed settings."},
+	"POST /admin/config/rollback":       {Tag: "admin", Summary: "Roll the configuration back to a previous version.", Body: "ConfigRollback"},
+	"GET /admin/loglevel":               {Tag: "admin", Summary: "Current log levels, debug mode and when a temporary change reverts."},
+	"PUT /admin/loglevel":               {Tag: "admin", Summary: "Change the global or a module log level and debug mode, reverted after ttl seconds.", Body: "LogLevel"},
+	"GET /admin/faults":                 {Tag: "admin", Summary: "Disk faults currently injected, requires fault injection in the configuration."},
+	"PUT /admin/faults":                 {Tag: "admin", Summary: "Inject delays, read and write errors and torn writes into region I/O for chaos testing.", Body: "Faults"},
+	"DELETE /admin/faults":              {Tag: "admin", Summary: "Stop injecting disk faults.", Status: http.StatusNoContent},
+	"GET /admin/scripts":                {Tag: "scripts", Summary: "List stored procedures with their metrics."},
+	"GET /admin/scripts/:name":          {Tag: "scripts", Summary: "Get a stored procedure."},
+	"PUT /admin/scripts/:name":          {Tag: "scripts", Summary: "Create or replace a stored procedure.", Body: "Procedure"},
+	"DELETE /admin/scripts/:name":       {Tag: "scripts", Summary: "Delete a stored procedure.", Status: http.StatusNoContent},
+	"GET /admin/schemas":                {Tag: "admin", Summary: "List key prefixes with a registered table schema."},
+	"GET /admin/schemas/:prefix":        {Tag: "admin", Summary: "Get the JSON Schema of tables under a key prefix."},
+	"PUT /admin/schemas/:prefix":        {Tag: "admin", Summary: "Register a JSON Schema that tables written under a key prefix must match.", Body: "JSONSchema"},
+	"DELETE /admin/schemas/:prefix":     {Tag: "admin", Summary: "Remove the table schema of a key prefix.", Status: http.StatusNoContent},
+	"GET /admin/hooks":                  {Tag: "admin", Summary: "List write hooks with their delivery statistics."},
+	"PUT /admin/hooks/:name":            {Tag: "admin", Summary: "Register a hook delivering put and delete events of keys matching a glob pattern to a webhook or stored procedure.", Body: "Hook"},
+	"DELETE /admin/hooks/:name":         {Tag: "admin", Summary: "Remove a write hook.", Status: http.StatusNoContent},
+	"GET /admin/hooks/:name/dead":       {Tag: "admin", Summary: "List the events of a hook that failed after all retries."},
+	"POST /admin/hooks/:name/replay":    {Tag: "admin", Summary: "Queue the dead letters of a hook for delivery again.", Status: http.StatusAccepted},
+	"GET /admin/transforms":             {Tag: "admin", Summary: "List data transforms with their progress."},
+	"POST /admin/transforms":            {Tag: "admin", Summary: "Start a background transform rewriting values of a type under a key prefix with a Lua script.", Body: "Transform", Status: http.StatusAccepted},
+	"GET /admin/transforms/:id":         {Tag: "admin", Summary: "Get the progress of a data transform."},
+	"POST /admin/transforms/:id/cancel": {Tag: "admin", Summary: "Cancel a running data transform.", Status: http.StatusAccepted},
+	"POST /admin/transforms/:id/resume": {Tag: "admin", Summary: "Resume a failed or canceled data transform after the last processed key.", Status: http.StatusAccepted},
+	"POST /pipeline":                    {Tag: "query", Summary: "Run get, put and delete operations in order and return the result of each one.", Body: "Pipeline"},
+	"POST /eval":                        {Tag: "scripts", Summary: "Evaluate a Lua script atomically.", Body: "Eval"},
+	"POST /call/:name":                  {Tag: "scripts", Summary: "Call a stored procedure.", Body: "Call"},
+	"POST /publish/:channel":            {Tag: "pubsub", Summary: "Publish a message to a channel.", Body: "Publish"},
+	"GET /subscribe/:channel":           {Tag: "pubsub", Summary: "Subscribe to a channel with server-sent events.", Query: []string{"replay"}},
+	"GET /keys":                         {Tag: "query", Summary: "Scan keys in [start, end) in lexicographic order, requires the skiplist index.", Query: []string{"start", "end", "limit"}},
+	"GET /query/:key":                   {Tag: "query", Summary: "Get the raw value of a key of any type."},
+	"HEAD /query/:key":                  {Tag: "query", Summary: "Check whether a key exists without reading its value, 404 when it does not."},
+	"GET /exists/:key":                  {Tag: "query", Summary: "Check whether a key exists from the in-memory index, 404 when it does not."},
+	"GET /meta/:key":                    {Tag: "query", Summary: "Get the type, timestamps, size, storage location and version of a key without reading its value."},
+	"GET /cdc":                          {Tag: "query", Summary: "Tail committed writes and deletes after the LSN since in order, wait long-polls up to wait seconds when there are none.", Query: []string{"since", "limit", "wait", "internal"}},
+	"GET /diff/:key":                    {Tag: "query", Summary: "Diff a table or collection between two revisions returned in ETag, to defaults to the latest revision.", Query: []string{"from", "to"}},
+	"POST /stream/:key/add":             {Tag: "stream", Summary: "Append an entry to a stream.", Body: "StreamFields", Status: http.StatusCreated},
+	"POST /stream/:key/group/:group":    {Tag: "stream", Summary: "Read new entries of a consumer group.", Query: []string{"count"}},
+	"POST /hll/:key/add":                {Tag: "hll", Summary: "Add members to a HyperLogLog.", Body: "HLLMembers"},
+	"GET /collection/:key/size":         {Tag: "collection", Summary: "Number of items of a collection, read from the chunk manifest and the array header without decoding the items."},
+	"POST /collection/:key/push":        {Tag: "collection", Summary: "Append items to a collection, full chunks are sealed into separate records so a push only rewrites the open tail.", Body: "PushItems"},
+	"POST /zset/:key/add":               {Tag: "zset", Summary: "Add a member or update its score, concurrent updates of the same key are serialized.", Body: "ZSetMember"},
+	"POST /zset/:key/remove":            {Tag: "zset", Summary: "Remove a member, 404 when the key does not exist.", Body: "ZSetRemove"},
+	"POST /hll/:key/merge":              {Tag: "hll", Summary: "Merge other HyperLogLogs into this key.", Body: "HLLKeys"},
+	"POST /queue/:key/enqueue":          {Tag: "queue", Summary: "Enqueue a message.", Body: "QueueMessage", Status: http.StatusCreated},
+	"POST /queue/:key/dequeue":          {Tag: "queue", Summary: "Dequeue a message with a visibility timeout.", Query: []string{"visibility"}},
+	"GET /ts/:series":                   {Tag: "ts", Summary: "Query points in [start, end), downsampled to min/max/avg when interval is set.", Query: []string{"start", "end", "interval"}},
+	"POST /ts/:series":                  {Tag: "ts", Summary: "Append timestamped points to a time series.", Body: "SeriesPoints", Status: http.StatusCreated},
+	"DELETE /ts/:series":                {Tag: "ts", Summary: "Delete all points of a time series, 404 when it has none unless missing_ok is true.", Status: http.StatusNoContent, Query: []string{"missing_ok"}},
+	"POST /queue/:key/ack":              {Tag: "queue", Summary: "Acknowledge a dequeued message.", Body: "QueueAck"},
+	"GET /kv/:key":                      {Tag: "kv", Summary: "Get a collection, table, text or number value together with its type.", Response: "KVEntry"},
+	"PUT /kv/:key":                      {Tag: "kv", Summary: "Store any JSON value, an array becomes a collection, an object a table, a string a text and an integer a number.", Body: "KVValue", Status: http.StatusCreated, Query: []string{"ttl", "strict"}},
+}
+
+func init() {
+	for _, dt := range dataTypes {
+		operations["GET /"+dt.Name+"/:key"] = operation{Tag: dt.Name, Summary: "Get a " + dt.Name + " value."}
+		operations["PUT /"+dt.Name+"/:key"] = operation{Tag: dt.Name, Summary: "Create or replace a " + dt.Name + " value.", Body: dt.Schema, Status: http.StatusCreated}
+		operations["DELETE /"+dt.Name+"/:key"] = operation{Tag: dt.Name, Summary: "Delete a " + dt.Name + " value, 404 when the key does not exist unless missing_ok is true.", Status: http.StatusNoContent, Query: []string{"missing_ok"}}
+		operations["HEAD /"+dt.Name+"/:key"] = operation{Tag: dt.Name, Summary: "Check whether a key exists without reading its value, 404 when it does not."}
+	}
+
+	// table 支持分页读取部分字段
+	get := operations["GET /table/:key"]
+	get.Summary = "Get a table value, offset, limit and fields return a page of its entries in field name order."
+	get.Query = []string{"offset", "limit", "fields"}
+	operations["GET /table/:key"] = get
+
+	// collection 支持按下标范围读取
+	get = operations["GET /collection/:key"]
+	get.Summary = "Get a collection value, start and end select the items in [start, end], negative indexes count from the last item and reverse counts from the last item and returns them newest first."
+	get.Query = []string{"start", "end", "reverse"}
+	operations["GET /collection/:key"] = get
+
+	// stream 支持按 ID 范围读取
+	get = operations["GET /stream/:key"]
+	get.Query = []string{"start", "end", "count"}
+	operations["GET /stream/:key"] = get
+}
+
+var (
+	anyValue  = map[string]any{}
+	ttlSchema = map[string]any{"type": "integer", "minimum": 0, "description": "Expire after seconds, 0 never expires."}
+)
+
+func object(required []string, properties map[string]any) map[string]any {
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func arrayOf(items map[string]any) map[string]any {
+	return map[string]any{"type": "array", "items": items}
+}
+
+func mapOf(values map[string]any) map[string]any {
+	return map[string]any{"type": "object", "additionalProperties": values}
+}
+
+var (
+	stringSchema  = map[string]any{"type": "string"}
+	integerSchema = map[string]any{"type": "integer"}
+	numberSchema  = map[string]any{"type": "number"}
+	booleanSchema = map[string]any{"type": "boolean"}
+)
+
+var schemas = map[string]any{
+	"Error": object([]string{"code", "message", "retryable"}, map[string]any{
+		"code":       map[string]any{"type": "string", "enum": errorCodeNames()},
+		"message":    stringSchema,
+		"key":        stringSchema,
+		"retryable":  map[string]any{"type": "boolean", "description": "The same request may succeed when retried later."},
+		"request_id": map[string]any{"type": "string", "description": "Same as the X-Request-ID response header, use it when reporting the error."},
+	}),
+	"Login": object([]string{"password"}, map[string]any{"password": stringSchema}),
+	"Session": object([]string{"token", "token_type", "expires_at"}, map[string]any{
+		"token":      stringSchema,
+		"token_type": stringSchema,
+		"expires_at": map[string]any{"type": "string", "format": "date-time"},
+	}),
+	"SystemInfo": object(nil, map[string]any{
+		"key_count": integerSchema, "version": stringSchema, "gc_state": integerSchema,
+		"gc_status": schemaRef("CompactionStatus"),
+		"disk_free": stringSchema, "disk_used": stringSchema, "disk_total": stringSchema,
+		"mem_free": stringSchema, "mem_total": stringSchema, "disk_percent": stringSchema,
+		"active_region": integerSchema, "region_count": integerSchema, "compaction_backlog_bytes": integerSchema,
+		"index_memory_bytes": integerSchema, "index_spilled_bytes": integerSchema, "uptime_seconds": integerSchema, "recovery_seconds": numberSchema,
+		"checkpoint_age_seconds": map[string]any{"type": "integer", "description": "Seconds since the last index checkpoint, -1 when there is none."},
+	}),
+	"Set":        object([]string{"set"}, map[string]any{"set": mapOf(booleanSchema), "ttl": ttlSchema}),
+	"ZSet":       object([]string{"zset"}, map[string]any{"zset": mapOf(numberSchema), "ttl": ttlSchema}),
+	"Text":       object([]string{"content"}, map[string]any{"content": stringSchema, "ttl": ttlSchema}),
+	"Table":      object([]string{"table"}, map[string]any{"table": mapOf(anyValue), "ttl": ttlSchema}),
+	"Number":     object([]string{"number"}, map[string]any{"number": integerSchema, "ttl": ttlSchema}),
+	"Collection": object([]string{"collection"}, map[string]any{"collection": arrayOf(anyValue), "ttl": ttlSchema}),
+	"Stream": object([]string{"stream"}, map[string]any{
+		"stream": arrayOf(object([]string{"id", "fields"}, map[string]any{"id": stringSchema, "fields": mapOf(anyValue)})),
+		"groups": mapOf(stringSchema),
+		"ttl":    ttlSchema,
+	}),
+	"HLL":          object([]string{"hll"}, map[string]any{"hll": arrayOf(stringSchema), "ttl": ttlSchema}),
+	"Queue":        object([]string{"queue"}, map[string]any{"queue": arrayOf(anyValue), "ttl": ttlSchema}),
+	"StreamFields": object([]string{"fields"}, map[string]any{"fields": mapOf(anyValue)}),
+	"HLLMembers":   object([]string{"members"}, map[string]any{"members": arrayOf(stringSchema)}),
+	"PushItems":    object([]string{"items"}, map[string]any{"items": arrayOf(anyValue)}),
+	"ZSetMember":   object([]string{"member", "score"}, map[string]any{"member": stringSchema, "score": numberSchema}),
+	"ZSetRemove":   object([]string{"member"}, map[string]any{"member": stringSchema}),
+	"KVValue":      map[string]any{"description": "An array, object, string or 64-bit integer."},
+	"KVEntry": object([]string{"type", "value", "ttl"}, map[string]any{
+		"type":  map[string]any{"type": "string", "enum": []string{"collection", "table", "text", "number"}},
+		"value": anyValue,
+		"ttl":   integerSchema,
+	}),
+	"HLLKeys":      object([]string{"keys"}, map[string]any{"keys": arrayOf(stringSchema)}),
+	"QueueMessage": object([]string{"body"}, map[string]any{"body": anyValue}),
+	"SeriesPoints": object([]string{"points"}, map[string]any{
+		"points": arrayOf(object([]string{"value"}, map[string]any{
+			"ts":    map[string]any{"type": "integer", "description": "Millisecond timestamp, defaults to now."},
+			"value": numberSchema,
+		})),
+		"ttl": ttlSchema,
+	}),
+	"QueueAck":     object([]string{"receipt"}, map[string]any{"receipt": stringSchema}),
+	"KeyTTL":       object([]string{"ttl"}, map[string]any{"ttl": ttlSchema}),
+	"CompactPause": object(nil, map[string]any{"reason": stringSchema}),
+	"CompactionStatus": object([]string{"state", "since"}, map[string]any{
+		"state":   map[string]any{"type": "string", "enum": []string{"idle", "running", "paused", "failed"}},
+		"reason":  map[string]any{"type": "string", "description": "Why compaction is paused or why the last compaction failed."},
+		"since":   map[string]any{"type": "string", "format": "date-time"},
+		"pausing": map[string]any{"type": "boolean", "description": "A running compaction will stop after its current region."},
+	}),
+	"Publish":   object([]string{"message"}, map[string]any{"message": anyValue}),
+	"Procedure": object([]string{"script"}, map[string]any{"script": stringSchema}),
+	"Eval": object([]string{"script"}, map[string]any{
+		"script": stringSchema, "keys": arrayOf(stringSchema), "args": arrayOf(anyValue),
+	}),
+	"Call": object(nil, map[string]any{"keys": arrayOf(stringSchema), "args": arrayOf(anyValue)}),
+	"Pipeline": arrayOf(object([]string{"op", "type", "key"}, map[string]any{
+		"op":    map[string]any{"type": "string", "enum": []string{"get", "put", "delete"}},
+		"type":  stringSchema,
+		"key":   stringSchema,
+		"value": map[string]any{"description": "Request body of the PUT endpoint of the type, required by put."},
+	})),
+	"Migration": object([]string{"target"}, map[string]any{
+		"prefix": stringSchema, "start": integerSchema, "end": integerSchema, "target": stringSchema,
+	}),
+	"Routes": object([]string{"routes"}, map[string]any{
+		"routes": arrayOf(object([]string{"node"}, map[string]any{
+			"prefix": stringSchema, "start": integerSchema, "end": integerSchema, "node": stringSchema,
+		})),
+	}),
+	"Config": map[string]any{
+		"type":        "object",
+		"description": "Configuration sections to change, e.g. {\"region\": {\"cron\": \"0 0 3 * * *\"}}.",
+	},
+	"JSONSchema": map[string]any{
+		"type":        "object",
+		"description": "JSON Schema document validating the table field of table values, remote $ref is not allowed.",
+	},
+	"Transform": object([]string{"type", "version", "script"}, map[string]any{
+		"type":    stringSchema,
+		"prefix":  stringSchema,
+		"version": map[string]any{"type": "integer", "description": "Version of the value format after the transform, must be greater than the applied version."},
+		"script":  map[string]any{"type": "string", "description": "Lua script reading KEY and VALUE and returning the new value, nil keeps the value unchanged."},
+		"rate":    map[string]any{"type": "integer", "description": "Maximum keys transformed per second, 0 means unlimited."},
+	}),
+	"Hook": object([]string{"pattern"}, map[string]any{
+		"pattern":   map[string]any{"type": "string", "description": "Glob pattern of path.Match the keys must match."},
+		"events":    arrayOf(map[string]any{"type": "string", "enum": []string{"put", "delete"}}),
+		"url":       map[string]any{"type": "string", "description": "Webhook receiving events with POST, exclusive with procedure."},
+		"secret":    map[string]any{"type": "string", "description": "Key of the HMAC-SHA256 signature sent in X-UrnaDB-Signature."},
+		"procedure": map[string]any{"type": "string", "description": "Stored procedure called with the event, value and type in ARGV."},
+		"retries":   map[string]any{"type": "integer", "description": "Retries with exponential backoff before the event becomes a dead letter, default 5."},
+	}),
+	"AllowList":      object([]string{"allowlist"}, map[string]any{"allowlist": arrayOf(stringSchema)}),
+	"ConfigRollback": object([]string{"version"}, map[string]any{"version": integerSchema}),
+	"LogLevel": object(nil, map[string]any{
+		"level":  map[string]any{"type": "string", "enum": []string{"debug", "info", "warn", "error"}},
+		"module": stringSchema,
+		"debug":  booleanSchema,
+		"ttl":    map[string]any{"type": "integer", "description": "Seconds until the previous log levels are restored, 0 keeps the change."},
+	}),
+	"Faults": object(nil, map[string]any{
+		"delay_ms":         map[string]any{"type": "integer", "description": "Milliseconds added to every region read and write."},
+		"read_error_rate":  map[string]any{"type": "number", "description": "Probability between 0 and 1 that a read fails."},
+		"write_error_rate": map[string]any{"type": "number", "description": "Probability between 0 and 1 that a write fails."},
+		"torn_write_rate":  map[string]any{"type": "number", "description": "Probability between 0 and 1 that a write stores part of the record and fails."},
+	}),
+	"Rollback": object(nil, map[string]any{
+		"lsn":   integerSchema,
+		"until": map[string]any{"type": "string", "format": "date-time"},
+	}),
+}
+
+func schemaRef(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// gin 路由参数 :key 和 *filepath 转换为 OpenAPI 的 {key} 和 {filepath}
+var routeParam = regexp.MustCompile(`[:*](\w+)`)
+
+// buildOpenAPI 根据注册的路由生成 OpenAPI 3 文档，没有描述的路由会被忽略
+func buildOpenAPI(routes gin.RoutesInfo) ([]byte, error) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path == routes[j].Path {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Path < routes[j].Path
+	})
+
+	paths := make(map[string]map[string]any)
+	for _, route := range routes {
+		op, ok := operations[route.Method+" "+route.Path]
+		if !ok {
+			continue
+		}
+
+		parameters := make([]any, 0)
+		for _, match := range routeParam.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name": match[1], "in": "path", "required": true, "schema": stringSchema,
+			})
+		}
+		for _, name := range op.Query {
+			parameters = append(parameters, map[string]any{
+				"name": name, "in": "query", "schema": stringSchema,
+			})
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		if op.Response != "" {
+			success["content"] = jsonContent(schemaRef(op.Response))
+		}
+
+		doc := map[string]any{
+			"tags":        []string{op.Tag},
+			"summary":     op.Summary,
+			"operationId": operationID(route),
+			"parameters":  parameters,
+			"responses": map[string]any{
+				strconv.Itoa(status): success,
+				"default": map[string]any{
+					"description": "Error",
+					"content":     jsonContent(schemaRef("Error")),
+				},
+			},
+		}
+		if op.Body != "" {
+			doc["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(schemaRef(op.Body)),
+			}
+		}
+		if publicPath(route.Path) || route.Path == loginPath {
+			doc["security"] = []any{}
+		}
+
+		path := routeParam.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(route.Method)] = doc
+	}
+
+	return json.MarshalIndent(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "UrnaDB HTTP API",
+			"version": strings.TrimPrefix(version, "momentdb/"),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"AuthToken":   map[string]any{"type": "apiKey", "in": "header", "name": "Auth-Token"},
+				"AdminToken":  map[string]any{"type": "apiKey", "in": "header", "name": "Admin-Token"},
+				"BearerToken": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []any{
+			map[string]any{"AuthToken": []string{}},
+			map[string]any{"AdminToken": []string{}},
+			map[string]any{"BearerToken": []string{}},
+		},
+	}, "", "  ")
+}
+
+// operationID 使用控制器的函数名，例如 github.com/auula/urnadb/server.GetSetController，
+// 所有类型的 HEAD 接口共用一个控制器，使用路径的第一段区分，例如 HeadSet
+func operationID(route gin.RouteInfo) string {
+	if route.Method == http.MethodHead {
+		kind := strings.Split(strings.TrimPrefix(route.Path, "/"), "/")[0]
+		return "Head" + strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	handler := route.Handler
+	return strings.TrimSuffix(handler[strings.LastIndex(handler, ".")+1:], "Controller")
+}
+
+func GetOpenAPIController(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", openapiSpec)
+}
+
+// swagger UI 的静态资源从 CDN 加载，避免把整个 swagger-ui 打包进二进制文件
+const swaggerPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>UrnaDB API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+func GetSwaggerController(ctx *gin.Context) {
+	if !swaggerEnabled {
+		Error404Handler(ctx)
+		return
+	}
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerPage))
+}
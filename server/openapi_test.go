@@ -0,0 +1,84 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "regenerate openapi.json from the registered routes")
+
+func TestOpenAPISpec(t *testing.T) {
+	// 每个注册的路由都必须有接口描述，否则文档会缺少这个接口
+	for _, route := range root.Routes() {
+		_, ok := operations[route.Method+" "+route.Path]
+		assert.True(t, ok, "route %s %s is missing from operations", route.Method, route.Path)
+	}
+
+	spec, err := buildOpenAPI(root.Routes())
+	assert.NoError(t, err)
+	spec = append(spec, '\n')
+
+	if *update {
+		assert.NoError(t, os.WriteFile("openapi.json", spec, 0644))
+		return
+	}
+
+	assert.JSONEq(t, string(spec), string(openapiSpec), "openapi.json is stale, run go generate ./server")
+}
+
+func TestOpenAPIController(t *testing.T) {
+	old, password := ready.Load(), authPassword
+	authPassword = "openapi-test-password"
+	ready.Store(false)
+	defer func() {
+		authPassword, swaggerEnabled = password, false
+		ready.Store(old)
+	}()
+
+	// 不需要认证，存储系统没有就绪时也可以访问
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	w := httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	assert.Contains(t, doc.Paths["/set/{key}"], "put")
+	assert.Contains(t, doc.Paths["/admin/keys/{key}/ttl"], "put")
+
+	req = httptest.NewRequest(http.MethodGet, "/swagger", nil)
+	w = httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	swaggerEnabled = true
+	req = httptest.NewRequest(http.MethodGet, "/swagger", nil)
+	w = httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "/openapi.json")
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPipelineOps 一次 pipeline 请求最多包含的操作数
+const maxPipelineOps = 1000
+
+// pipeline 中的操作对应的 HTTP 方法
+var pipelineMethods = map[string]string{
+	"get":    http.MethodGet,
+	"put":    http.MethodPut,
+	"delete": http.MethodDelete,
+}
+
+// pipelineHeaders 子请求从 pipeline 请求中继承的请求头，用于密码和会话令牌认证、IP 白名单、集群转发、有界过期的读取和关联日志，
+// pipeline 只能访问数据接口，不需要继承管理员令牌
+var pipelineHeaders = []string{"Auth-Token", "Authorization", "X-Forwarded-For", forwardedHeader, maxStalenessHeader, requestIDHeader}
+
+// PipelineOp 是 pipeline 中的一个操作，Value 为 put 时对应类型的请求体
+type PipelineOp struct {
+	Op    string          `json:"op"`
+	Type  string          `json:"type"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// PipelineResult 是一个操作的结果，Status 和 Result 与单独请求对应接口时的响应相同
+type PipelineResult struct {
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// pipelineWriter 在内存中保存子请求的响应
+type pipelineWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *pipelineWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipelineWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *pipelineWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func isDataType(kind string) bool {
+	for _, dt := range dataTypes {
+		if dt.Name == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePipelineOp(op *PipelineOp) error {
+	if _, ok := pipelineMethods[op.Op]; !ok {
+		return fmt.Errorf("unsupported operation %q", op.Op)
+	}
+	if !isDataType(op.Type) {
+		return fmt.Errorf("unsupported value type %q", op.Type)
+	}
+	if op.Key == "" {
+		return fmt.Errorf("key of %s operation cannot be empty", op.Op)
+	}
+	if op.Op == "put" && len(op.Value) == 0 {
+		return fmt.Errorf("value of put operation on key %s cannot be empty", op.Key)
+	}
+	return nil
+}
+
+// runPipelineOp 把操作作为子请求交给路由处理，和单独请求一样经过 key 校验、配额、集群转发和请求超时等中间件
+func runPipelineOp(ctx *gin.Context, op *PipelineOp) PipelineResult {
+	var body io.Reader = http.NoBody
+	if op.Op == "put" {
+		body = bytes.NewReader(op.Value)
+	}
+
+	path := "/" + op.Type + "/" + url.PathEscape(op.Key)
+	req, err := http.NewRequestWithContext(ctx.Request.Context(), pipelineMethods[op.Op], path, body)
+	if err != nil {
+		result, _ := json.Marshal(&APIError{Code: CodeBadRequest, Message: err.Error(), Key: op.Key, RequestID: requestID(ctx)})
+		return PipelineResult{Status: http.StatusBadRequest, Result: result}
+	}
+
+	req.RemoteAddr = ctx.Request.RemoteAddr
+	req.Header.Set("Content-Type", "application/json")
+	for _, name := range pipelineHeaders {
+		if value := ctx.GetHeader(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	w := &pipelineWriter{header: make(http.Header)}
+	root.ServeHTTP(w, req)
+
+	result := PipelineResult{Status: w.status}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	if json.Valid(w.body.Bytes()) {
+		result.Result = w.body.Bytes()
+	}
+	return result
+}
+
+// PipelineController 按顺序执行一组不同类型的 get/put/delete 操作并返回每个操作的结果，
+// 类似 Redis 的 pipeline，操作之间不是原子的，某个操作失败之后后面的操作继续执行
+func PipelineController(ctx *gin.Context) {
+	var ops []PipelineOp
+	err := ctx.ShouldBindJSON(&ops)
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "request body must be an array of operations.")
+		return
+	}
+
+	if len(ops) == 0 || len(ops) > maxPipelineOps {
+		respondError(ctx, CodeBadRequest, fmt.Sprintf("pipeline must contain between 1 and %d operations.", maxPipelineOps))
+		return
+	}
+
+	// 格式错误的 pipeline 一个操作都不执行
+	for i := range ops {
+		err := validatePipelineOp(&ops[i])
+		if err != nil {
+			respondError(ctx, CodeBadRequest, fmt.Sprintf("operation %d: %s", i, err.Error()))
+			return
+		}
+	}
+
+	results := make([]PipelineResult, 0, len(ops))
+	for i := range ops {
+		results = append(results, runPipelineOp(ctx, &ops[i]))
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"results": results,
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/pipeline", strings.NewReader(body))
+		req.Header.Set("Auth-Token", token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(authPassword, `[
+		{"op": "put", "type": "text", "key": "pipe-01", "value": {"content": "hello"}},
+		{"op": "put", "type": "number", "key": "pipe-02", "value": {"number": 42}},
+		{"op": "get", "type": "text", "key": "pipe-01"},
+		{"op": "put", "type": "text", "key": "bad key", "value": {"content": "hello"}},
+		{"op": "delete", "type": "text", "key": "pipe-01"},
+		{"op": "get", "type": "text", "key": "pipe-01"},
+		{"op": "get", "type": "number", "key": "pipe-02"}
+	]`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var page struct {
+		Results []PipelineResult `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+
+	// 每个操作的结果和单独请求对应接口时相同，失败的操作不影响后面的操作
+	var status []int
+	for _, result := range page.Results {
+		status = append(status, result.Status)
+	}
+	assert.Equal(t, []int{
+		http.StatusCreated, http.StatusCreated, http.StatusOK, http.StatusBadRequest,
+		http.StatusNoContent, http.StatusNotFound, http.StatusOK,
+	}, status)
+	assert.JSONEq(t, `{"text": "hello"}`, string(page.Results[2].Result))
+	assert.Contains(t, string(page.Results[3].Result), "illegal characters")
+	assert.Empty(t, page.Results[4].Result)
+	assert.JSONEq(t, `{"number": 42}`, string(page.Results[6].Result))
+
+	// 格式错误的 pipeline 一个操作都不执行
+	w = request(authPassword, `[
+		{"op": "delete", "type": "number", "key": "pipe-02"},
+		{"op": "incr", "type": "number", "key": "pipe-02"}
+	]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "operation 1")
+	assert.Equal(t, 1, fss.KeysCount())
+
+	w = request(authPassword, `[{"op": "get", "type": "ts", "key": "pipe-02"}]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(authPassword, `[]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(authPassword, `{"op": "get"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request("wrong-password", `[{"op": "get", "type": "number", "key": "pipe-02"}]`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 使用会话令牌认证的 pipeline，子请求同样使用会话令牌认证
+	password := authPassword
+	authPassword = "pipeline-password"
+	sessionTTL.Store(int64(time.Hour))
+	defer func() {
+		authPassword = password
+		sessionTTL.Store(0)
+	}()
+	token, _, err := issueSession(time.Hour)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/pipeline", strings.NewReader(`[
+		{"op": "put", "type": "text", "key": "pipe-03", "value": {"content": "hello"}},
+		{"op": "get", "type": "number", "key": "pipe-02"}
+	]`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, http.StatusCreated, page.Results[0].Status)
+	assert.Equal(t, http.StatusOK, page.Results[1].Status)
+}
@@ -0,0 +1,213 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// 按前缀删除的确认令牌有效期
+const prefixConfirmTTL = time.Minute
+
+type prefixConfirmation struct {
+	token     string
+	expiresAt time.Time
+}
+
+// 每个前缀只保留最新生成的确认令牌，令牌使用一次之后失效
+var (
+	confirmMu     sync.Mutex
+	confirmations = make(map[string]prefixConfirmation)
+)
+
+// prefixDisabled 在没有配置分隔符时返回 404
+func prefixDisabled(ctx *gin.Context, err error) bool {
+	if errors.Is(err, vfs.ErrPrefixDisabled) {
+		failed(ctx, CodeFeatureDisabled, err)
+		return true
+	}
+	return false
+}
+
+// GetPrefixesController 返回每个一级前缀的 key 数量和字节数
+func GetPrefixesController(ctx *gin.Context) {
+	prefixes, err := storage.Prefixes()
+	if prefixDisabled(ctx, err) {
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"separator": storage.Separator(),
+		"prefixes":  prefixes,
+	})
+}
+
+// ListPrefixKeysController 按照写入顺序分页返回一级前缀下的 key
+func ListPrefixKeysController(ctx *gin.Context) {
+	prefix := ctx.Param("prefix")
+	if storage.Separator() == "" {
+		prefixDisabled(ctx, vfs.ErrPrefixDisabled)
+		return
+	}
+
+	pageKeys(ctx, func(fn func(seg *vfs.Segment) bool) error {
+		return storage.ScanPrefix(prefix, fn)
+	})
+}
+
+// DeletePrefixController 删除一级前缀下的所有 key，第一次请求返回确认令牌和将要删除的数据量，
+// 带上 confirm 令牌再次请求才会真正删除
+func DeletePrefixController(ctx *gin.Context) {
+	prefix := ctx.Param("prefix")
+	usage, err := storage.PrefixUsage(prefix)
+	if prefixDisabled(ctx, err) {
+		return
+	}
+
+	token := ctx.Query("confirm")
+	if token == "" {
+		token, err := newPrefixConfirmation(prefix)
+		if err != nil {
+			failed(ctx, CodeInternal, err)
+			return
+		}
+
+		ctx.IndentedJSON(http.StatusAccepted, gin.H{
+			"prefix":     prefix,
+			"keys":       usage.Keys,
+			"bytes":      usage.Bytes,
+			"confirm":    token,
+			"expires_in": int(prefixConfirmTTL.Seconds()),
+		})
+		return
+	}
+
+	if !consumePrefixConfirmation(prefix, token) {
+		respondError(ctx, CodeConflict, "confirmation token is invalid or expired.")
+		return
+	}
+
+	deleted, err := storage.DeletePrefix(prefix)
+	if err == nil {
+		// 删除的列表封存的分块不在前缀下，需要单独删除
+		err = dropOrphanQuicklists(ctx.Request.Context(), prefix)
+	}
+	if err != nil {
+		e := newAPIError(ctx, errorCodeOf(err, CodeInternal), err.Error())
+		ctx.JSON(e.Status(), e.with(gin.H{"deleted": deleted}))
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"prefix":  prefix,
+		"deleted": deleted,
+	})
+}
+
+func newPrefixConfirmation(prefix string) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(buf)
+	confirmMu.Lock()
+	confirmations[prefix] = prefixConfirmation{
+		token:     token,
+		expiresAt: time.Now().Add(prefixConfirmTTL),
+	}
+	confirmMu.Unlock()
+	return token, nil
+}
+
+// consumePrefixConfirmation 校验并且作废前缀的确认令牌
+func consumePrefixConfirmation(prefix, token string) bool {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	c, ok := confirmations[prefix]
+	if !ok || c.token != token {
+		return false
+	}
+	delete(confirmations, prefix)
+	return time.Now().Before(c.expiresAt)
+}
+
+// 预演批量删除时最多返回的 key 个数
+const maxDryRunKeys = 100
+
+// BulkDeleteController 删除以 prefix 开头并且匹配 pattern 的所有 key，dry_run 只返回将要删除的 key 数量
+func BulkDeleteController(ctx *gin.Context) {
+	prefix, pattern := ctx.Query("prefix"), ctx.Query("pattern")
+	// 不允许一次删除所有的 key
+	if prefix == "" && (pattern == "" || strings.Trim(pattern, "*") == "") {
+		respondError(ctx, CodeBadRequest, "prefix or a pattern matching a subset of keys is required.")
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(ctx.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		respondError(ctx, CodeBadRequest, "dry_run must be a boolean.")
+		return
+	}
+
+	keys, err := storage.MatchKeys(prefix, pattern)
+	if errors.Is(err, path.ErrBadPattern) {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	if dryRun {
+		sample := keys
+		if len(sample) > maxDryRunKeys {
+			sample = sample[:maxDryRunKeys]
+		}
+		ctx.IndentedJSON(http.StatusOK, gin.H{
+			"matched": len(keys),
+			"keys":    sample,
+		})
+		return
+	}
+
+	deleted, err := storage.DeleteKeys(prefix, pattern)
+	if err == nil {
+		err = dropOrphanQuicklists(ctx.Request.Context(), prefix)
+	}
+	if err != nil {
+		e := newAPIError(ctx, errorCodeOf(err, CodeInternal), err.Error())
+		ctx.JSON(e.Status(), e.with(gin.H{"deleted": deleted}))
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"deleted": deleted,
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixControllers(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+		Separator: ":",
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, oldQuotas, wasReady := storage, quotas, ready.Load()
+	storage, adminToken = fss, "prefix-admin-token"
+	quotas = map[string]*namespaceQuota{"user": {maxKeys: 10}}
+	ready.Store(true)
+	defer func() {
+		storage, quotas, adminToken = old, oldQuotas, ""
+		ready.Store(wasReady)
+	}()
+
+	for _, key := range []string{"user:1", "user:2", "order:1", "plain"} {
+		seg, err := vfs.NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	keys, _ := prefixUsageOf(fss, "user")
+	assert.Equal(t, int64(2), keys)
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Admin-Token", adminToken)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "/admin/prefixes")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats struct {
+		Separator string           `json:"separator"`
+		Prefixes  []vfs.PrefixInfo `json:"prefixes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, ":", stats.Separator)
+	assert.Len(t, stats.Prefixes, 3)
+	assert.Equal(t, "user", stats.Prefixes[2].Prefix)
+	assert.Equal(t, int64(2), stats.Prefixes[2].Keys)
+
+	w = request(http.MethodGet, "/admin/prefixes/user/keys?limit=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Keys []KeyInfo `json:"keys"`
+		More bool      `json:"more"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, "user:1", page.Keys[0].Key)
+	assert.True(t, page.More)
+
+	// 第一次请求只返回确认令牌，不删除数据
+	w = request(http.MethodDelete, "/admin/prefixes/user")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var confirm struct {
+		Keys    int64  `json:"keys"`
+		Confirm string `json:"confirm"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirm))
+	assert.Equal(t, int64(2), confirm.Keys)
+	assert.NotEmpty(t, confirm.Confirm)
+	_, ok := fss.StatSegment("user:1")
+	assert.True(t, ok)
+
+	w = request(http.MethodDelete, "/admin/prefixes/order?confirm="+confirm.Confirm)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request(http.MethodDelete, "/admin/prefixes/user?confirm="+confirm.Confirm)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"deleted": 2`)
+	_, ok = fss.StatSegment("user:1")
+	assert.False(t, ok)
+	_, ok = fss.StatSegment("order:1")
+	assert.True(t, ok)
+	keys, _ = prefixUsageOf(fss, "user")
+	assert.Equal(t, int64(0), keys)
+
+	// 令牌只能使用一次
+	w = request(http.MethodDelete, "/admin/prefixes/user?confirm="+confirm.Confirm)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 批量删除需要前缀或者只匹配部分 key 的模式
+	w = request(http.MethodPost, "/admin/delete?pattern=*")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/delete?prefix=order:&dry_run=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"matched": 1`)
+	_, ok = fss.StatSegment("order:1")
+	assert.True(t, ok)
+
+	w = request(http.MethodPost, "/admin/delete?pattern=[")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/admin/delete?pattern=ord*")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"deleted": 1`)
+	_, ok = fss.StatSegment("order:1")
+	assert.False(t, ok)
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// 存储系统恢复完成并且调用 SetupFS 之后才变为 true
+	ready atomic.Bool
+	// 磁盘空间不足时切换为只读，只读期间节点不接收写流量
+	readOnly atomic.Bool
+	// 启动恢复的进度，没有设置时 readyz 不返回进度信息
+	recovery *vfs.RecoveryProgress
+	// 进程启动时间，用于 livez 返回运行时长
+	startedAt = time.Now()
+)
+
+// 探针接口不需要认证，也不受就绪状态的限制
+var probePaths = map[string]bool{
+	"/livez":  true,
+	"/readyz": true,
+}
+
+// ProbeCheck 是单项依赖检查的结果，Reason 说明检查失败的原因
+type ProbeCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// readinessChecks 按顺序执行的就绪依赖检查，前一项失败不影响后面的检查
+var readinessChecks = []struct {
+	name  string
+	check func() error
+}{
+	{"storage", checkStorageOpen},
+	{"disk_writable", checkDiskWritable},
+	{"read_write", checkReadWrite},
+}
+
+func checkStorageOpen() error {
+	if !ready.Load() {
+		status := recovery.Status()
+		return fmt.Errorf("storage is recovering, regions scanned %d/%d", status.RegionsScanned, status.RegionsTotal)
+	}
+	return nil
+}
+
+// checkDiskWritable 在数据目录下创建一个临时文件来确认磁盘可写
+func checkDiskWritable() error {
+	if !ready.Load() {
+		return fmt.Errorf("storage is not open")
+	}
+
+	fd, err := os.CreateTemp(storage.GetDirectory(), ".probe-*")
+	if err != nil {
+		return fmt.Errorf("data directory is not writable: %w", err)
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+func checkReadWrite() error {
+	if readOnly.Load() {
+		return fmt.Errorf("storage is read-only due to low disk space")
+	}
+	return nil
+}
+
+// readyMiddleware 在存储系统恢复完成之前拒绝所有数据请求，避免访问还没有初始化的存储
+func readyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if publicPath(c.FullPath()) || ready.Load() {
+			c.Next()
+			return
+		}
+
+		respondError(c, CodeUnavailable, "storage is recovering, please try again later.")
+		c.Abort()
+	}
+}
+
+// GetLivezController 只表示进程存活并且能处理 HTTP 请求，不检查任何依赖
+func GetLivezController(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "alive",
+		"uptime": time.Since(startedAt).String(),
+	})
+}
+
+// GetReadyzController 检查节点是否可以接收流量，任何一项检查失败都返回 503
+func GetReadyzController(ctx *gin.Context) {
+	checks := make([]ProbeCheck, 0, len(readinessChecks))
+	ok := true
+	for _, rc := range readinessChecks {
+		check := ProbeCheck{Name: rc.name, OK: true}
+		if err := rc.check(); err != nil {
+			check.OK, check.Reason = false, err.Error()
+			ok = false
+		}
+		checks = append(checks, check)
+	}
+
+	code, status := http.StatusOK, "ready"
+	if !ok {
+		code, status = http.StatusServiceUnavailable, "unready"
+	}
+
+	ctx.JSON(code, gin.H{
+		"status":   status,
+		"checks":   checks,
+		"recovery": recovery.Status(),
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbes(t *testing.T) {
+	wasReady := ready.Load()
+	defer ready.Store(wasReady)
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		// 探针请求不带认证信息
+		root.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	ready.Store(false)
+	w := request("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"unready"`)
+	assert.Contains(t, w.Body.String(), `"name":"storage","ok":false`)
+
+	// 存储没有就绪时进程仍然是存活的
+	w = request("/livez")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 恢复期间数据请求也返回 503，认证通过之后才会走到就绪检查
+	req := httptest.NewRequest(http.MethodGet, "/text/key-01", nil)
+	req.Header.Set("Auth-Token", authPassword)
+	w = httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old := storage
+	storage = fss
+	defer func() { storage = old }()
+
+	ready.Store(true)
+	w = request("/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"ready"`)
+
+	readOnly.Store(true)
+	defer readOnly.Store(false)
+	w = request("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"read_write","ok":false`)
+}
+
+func TestGetHealthController(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Auth-Token", authPassword)
+	w := httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var info SystemInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, 1, info.RegionCount)
+	assert.Equal(t, int64(-1), info.CheckpointAge)
+	assert.GreaterOrEqual(t, info.Uptime, int64(0))
+	assert.Greater(t, info.RecoveryDuration, 0.0)
+}
@@ -0,0 +1,255 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// 存储过程以 Text 类型的 Segment 持久化，key 为 script:<name>，script: 是内部使用的前缀，客户端不能直接写入
+const procedureKeyPrefix = internalKeyPrefix + "script:"
+
+var procedures = &procedureMetrics{
+	metrics: make(map[string]*ProcedureMetrics),
+}
+
+// procedureNames 是已经注册的存储过程名称，启动时从存储中加载，列出存储过程时不需要扫描全部数据
+var procedureNames = types.NewSyncSet(nil)
+
+// listProcedures 返回按照名称排序的存储过程
+func listProcedures() []string {
+	var names []string
+	procedureNames.View(func(set *types.Set) {
+		names = make([]string, 0, set.Size())
+		for name := range set.Set {
+			names = append(names, name)
+		}
+	})
+	sort.Strings(names)
+	return names
+}
+
+// loadProcedures 启动时加载存储中保存的全部存储过程名称
+func loadProcedures(fss *vfs.LogStructuredFS) error {
+	return fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if strings.HasPrefix(key, procedureKeyPrefix) {
+			procedureNames.Add(strings.TrimPrefix(key, procedureKeyPrefix))
+		}
+		return true
+	})
+}
+
+// ProcedureMetrics 记录单个存储过程的执行情况，只保存在内存中，重启后清零
+type ProcedureMetrics struct {
+	Calls        uint64        `json:"calls"`
+	Errors       uint64        `json:"errors"`
+	TotalTime    time.Duration `json:"total_time"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastCalledAt time.Time     `json:"last_called_at,omitempty"`
+}
+
+type procedureMetrics struct {
+	mu      sync.Mutex
+	metrics map[string]*ProcedureMetrics
+}
+
+func (pm *procedureMetrics) record(name string, elapsed time.Duration, err error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	m, ok := pm.metrics[name]
+	if !ok {
+		m = new(ProcedureMetrics)
+		pm.metrics[name] = m
+	}
+
+	m.Calls += 1
+	m.TotalTime += elapsed
+	m.LastDuration = elapsed
+	m.LastCalledAt = time.Now()
+	if err != nil {
+		m.Errors += 1
+	}
+}
+
+func (pm *procedureMetrics) get(name string) ProcedureMetrics {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if m, ok := pm.metrics[name]; ok {
+		return *m
+	}
+	return ProcedureMetrics{}
+}
+
+func (pm *procedureMetrics) reset(name string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.metrics, name)
+}
+
+// fetchProcedure 读取已经注册的存储过程源码
+func fetchProcedure(name string) (string, error) {
+	_, seg, err := storage.FetchSegment(procedureKeyPrefix + name)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := seg.ToText()
+	if err != nil {
+		utils.ReleaseToPool(seg)
+		return "", err
+	}
+
+	source := text.Content
+	utils.ReleaseToPool(seg, text)
+	return source, nil
+}
+
+func ListProceduresController(ctx *gin.Context) {
+	type procedure struct {
+		Name    string           `json:"name"`
+		Metrics ProcedureMetrics `json:"metrics"`
+	}
+
+	list := make([]procedure, 0)
+	for _, name := range listProcedures() {
+		list = append(list, procedure{Name: name, Metrics: procedures.get(name)})
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"scripts": list,
+	})
+}
+
+func GetProcedureController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	source, err := fetchProcedure(name)
+	if err != nil {
+		respondError(ctx, CodeNotFound, "script not found.")
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"name":    name,
+		"script":  source,
+		"metrics": procedures.get(name),
+	})
+}
+
+func PutProcedureController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	err := validateKey(name)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	var body struct {
+		Script string `json:"script" binding:"required"`
+	}
+
+	err = ctx.ShouldBindJSON(&body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	// 注册时先做一次语法检查，避免调用时才发现脚本无法编译
+	_, err = parse.Parse(strings.NewReader(body.Script), name)
+	if err != nil {
+		failed(ctx, CodeScriptError, err)
+		return
+	}
+
+	seg, err := vfs.AcquirePoolSegment(procedureKeyPrefix+name, types.NewText(body.Script), 0)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	_, err = storage.PutSegmentContext(ctx.Request.Context(), procedureKeyPrefix+name, seg)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	// 脚本被替换之后旧的统计数据不再有意义
+	procedures.reset(name)
+	procedureNames.Add(name)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "script registered successfully.",
+	})
+}
+
+func DeleteProcedureController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	err := storage.DeleteSegment(procedureKeyPrefix + name)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	procedures.reset(name)
+	procedureNames.Remove(name)
+	ctx.Status(http.StatusNoContent)
+}
+
+func CallProcedureController(ctx *gin.Context) {
+	name := ctx.Param("name")
+	source, err := fetchProcedure(name)
+	if err != nil {
+		respondError(ctx, CodeNotFound, "script not found.")
+		return
+	}
+
+	var body struct {
+		Keys []string `json:"keys"`
+		Args []any    `json:"args"`
+	}
+
+	// 没有参数的存储过程允许空请求体
+	if ctx.Request.ContentLength != 0 {
+		err = ctx.ShouldBindJSON(&body)
+		if err != nil {
+			failed(ctx, CodeBadRequest, err)
+			return
+		}
+	}
+
+	start := time.Now()
+	result, err := runScript(ctx.Request.Context(), source, body.Keys, body.Args)
+	procedures.record(name, time.Since(start), err)
+	if err != nil {
+		failed(ctx, CodeScriptError, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"result": result,
+	})
+}
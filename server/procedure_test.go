@@ -0,0 +1,104 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcedureMetrics(t *testing.T) {
+	pm := &procedureMetrics{metrics: make(map[string]*ProcedureMetrics)}
+
+	pm.record("incr", 2*time.Millisecond, nil)
+	pm.record("incr", 4*time.Millisecond, errors.New("failed"))
+
+	m := pm.get("incr")
+	assert.Equal(t, uint64(2), m.Calls)
+	assert.Equal(t, uint64(1), m.Errors)
+	assert.Equal(t, 6*time.Millisecond, m.TotalTime)
+	assert.Equal(t, 4*time.Millisecond, m.LastDuration)
+
+	pm.reset("incr")
+	assert.Equal(t, uint64(0), pm.get("incr").Calls)
+}
+
+func TestProcedureRegistry(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/admin/scripts/broken", `{"script": "return ("}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = request(http.MethodPut, "/admin/scripts/double", `{"script": "return ARGV[1] * 2"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodPost, "/call/double", `{"args": [21]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"result": 42}`, w.Body.String())
+	assert.Equal(t, uint64(1), procedures.get("double").Calls)
+
+	w = request(http.MethodGet, "/admin/scripts", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name": "double"`)
+
+	// 数据接口和脚本不能绕过语法检查直接覆盖存储过程
+	w = request(http.MethodPut, "/text/"+procedureKeyPrefix+"double", `{"content": "return ("}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPost, "/eval", `{"script": "urna.put('text', KEYS[1], 'return (')", "keys": ["`+procedureKeyPrefix+`double"]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// 和内部 key 旧的前缀相同的用户 key 可以正常写入
+	w = request(http.MethodPut, "/text/script:double", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPost, "/call/double", `{"args": [1]}`)
+	assert.JSONEq(t, `{"result": 2}`, w.Body.String())
+
+	w = request(http.MethodDelete, "/admin/scripts/double", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = request(http.MethodPost, "/call/double", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, listProcedures())
+}
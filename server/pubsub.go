@@ -0,0 +1,235 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 每个订阅者的缓冲区大小，消费过慢的订阅者会丢弃消息
+	subscriberBuffer = 64
+	// 持久化频道消息使用的 key 前缀
+	channelKeyPrefix = internalKeyPrefix + "pubsub:"
+)
+
+var pubsub = newBroker()
+
+type Message struct {
+	Channel     string `json:"channel" msgpack:"channel"`
+	Payload     any    `json:"payload" msgpack:"payload"`
+	PublishedAt int64  `json:"published_at" msgpack:"published_at"`
+}
+
+// broker 是和存储引擎解耦的发布订阅中心，只有开启持久化时才会把消息写入 Collection
+type broker struct {
+	mu       sync.RWMutex
+	wmu      sync.Mutex
+	persist  bool
+	history  int
+	channels map[string]map[chan *Message]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{
+		channels: make(map[string]map[chan *Message]struct{}),
+	}
+}
+
+func (b *broker) subscribe(channel string) chan *Message {
+	sub := make(chan *Message, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.channels[channel]; !ok {
+		b.channels[channel] = make(map[chan *Message]struct{})
+	}
+	b.channels[channel][sub] = struct{}{}
+
+	return sub
+}
+
+func (b *broker) unsubscribe(channel string, sub chan *Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs, ok := b.channels[channel]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; ok {
+		delete(subs, sub)
+		close(sub)
+	}
+	if len(subs) == 0 {
+		delete(b.channels, channel)
+	}
+}
+
+// publish 把消息投递给频道内所有订阅者，返回成功投递的订阅者数量
+func (b *broker) publish(msg *Message) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	receivers := 0
+	for sub := range b.channels[msg.Channel] {
+		select {
+		case sub <- msg:
+			receivers += 1
+		default:
+			slog.Warnf("subscriber of channel %s is too slow, message dropped", msg.Channel)
+		}
+	}
+	return receivers
+}
+
+// closeAll 关闭所有订阅者，让长连接的 SSE 请求能够结束
+func (b *broker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for channel, subs := range b.channels {
+		for sub := range subs {
+			close(sub)
+		}
+		delete(b.channels, channel)
+	}
+}
+
+// store 把消息追加到频道对应的 Collection 中，只保留最近 history 条用于回放
+func (b *broker) store(msg *Message) error {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+
+	key := channelKeyPrefix + msg.Channel
+	collection := types.AcquireCollection()
+	_, seg, err := storage.FetchSegment(key)
+	if err == nil {
+		old, err := seg.ToCollection()
+		utils.ReleaseToPool(seg)
+		if err == nil {
+			collection.Collection = append(collection.Collection, old.Collection...)
+			utils.ReleaseToPool(old)
+		}
+	}
+
+	collection.AddItem(map[string]any{
+		"channel":      msg.Channel,
+		"payload":      msg.Payload,
+		"published_at": msg.PublishedAt,
+	})
+
+	if b.history > 0 && collection.Size() > b.history {
+		collection.Collection = collection.Collection[collection.Size()-b.history:]
+	}
+
+	newseg, err := vfs.AcquirePoolSegment(key, collection, 0)
+	if err != nil {
+		utils.ReleaseToPool(collection)
+		return err
+	}
+	defer utils.ReleaseToPool(newseg, collection)
+
+	return storage.PutSegment(key, newseg)
+}
+
+// replay 返回频道中持久化的历史消息
+func (b *broker) replay(channel string) []any {
+	_, seg, err := storage.FetchSegment(channelKeyPrefix + channel)
+	if err != nil {
+		return nil
+	}
+	defer utils.ReleaseToPool(seg)
+
+	collection, err := seg.ToCollection()
+	if err != nil {
+		return nil
+	}
+	defer utils.ReleaseToPool(collection)
+
+	return append([]any(nil), collection.Collection...)
+}
+
+func PublishController(ctx *gin.Context) {
+	var body struct {
+		Message any `json:"message" binding:"required"`
+	}
+
+	err := ctx.ShouldBindJSON(&body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	msg := &Message{
+		Channel:     ctx.Param("channel"),
+		Payload:     body.Message,
+		PublishedAt: time.Now().UnixNano(),
+	}
+
+	if pubsub.persist {
+		err := pubsub.store(msg)
+		if err != nil {
+			failed(ctx, CodeInternal, err)
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"receivers": pubsub.publish(msg),
+	})
+}
+
+func SubscribeController(ctx *gin.Context) {
+	channel := ctx.Param("channel")
+
+	// SSE 是长连接，需要取消 HTTP 服务器的写超时
+	err := http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{})
+	if err != nil {
+		slog.Warnf("failed to disable write deadline of subscriber: %v", err)
+	}
+
+	sub := pubsub.subscribe(channel)
+	defer pubsub.unsubscribe(channel, sub)
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+
+	if pubsub.persist && ctx.Query("replay") == "true" {
+		for _, msg := range pubsub.replay(channel) {
+			ctx.SSEvent("message", msg)
+		}
+		ctx.Writer.Flush()
+	}
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-sub:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent("message", msg)
+			return true
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
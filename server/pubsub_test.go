@@ -0,0 +1,98 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	b := newBroker()
+
+	sub1 := b.subscribe("news")
+	sub2 := b.subscribe("news")
+	other := b.subscribe("sports")
+
+	n := b.publish(&Message{Channel: "news", Payload: "hello"})
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, "hello", (<-sub1).Payload)
+	assert.Equal(t, "hello", (<-sub2).Payload)
+	assert.Len(t, other, 0)
+
+	b.unsubscribe("news", sub1)
+	_, ok := <-sub1
+	assert.False(t, ok)
+	assert.Equal(t, 1, b.publish(&Message{Channel: "news", Payload: "world"}))
+
+	b.closeAll()
+	_, ok = <-other
+	assert.False(t, ok)
+	assert.Equal(t, 0, b.publish(&Message{Channel: "news"}))
+}
+
+func TestPublishController_History(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	persist, history := pubsub.persist, pubsub.history
+	storage = fss
+	ready.Store(true)
+	pubsub.persist, pubsub.history = true, 3
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		pubsub.persist, pubsub.history = persist, history
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 5; i++ {
+		w := request(http.MethodPost, "/publish/news", fmt.Sprintf(`{"message": %d}`, i))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// 只保留最近 history 条消息
+	messages := pubsub.replay("news")
+	assert.Len(t, messages, 3)
+	assert.EqualValues(t, 2, messages[0].(map[string]any)["payload"])
+
+	// 频道名称和 key 使用相同的校验规则
+	w := request(http.MethodPost, "/publish/bad%20channel", `{"message": 1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPost, "/publish/"+strings.Repeat("c", maxKeySize+1), `{"message": 1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
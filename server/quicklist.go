@@ -0,0 +1,510 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// 类似 Redis 的 quicklist，通过 push 追加的 Collection 超过 quicklistChunk 项之后，较早的项目按照
+// quicklistChunk 项一组封存到内部的 key 中，Collection 的 key 只保存还没有封存的尾部，
+// 追加时只需要重写尾部，不需要重写整个列表。封存的分块记录在 Text 类型的清单中，
+// 清单和分块的 key 分别为 quicklist:meta:<key> 和 quicklist:chunk:<key>:<id>。
+// Collection 的 key 决定列表是否存在，尾部不存在时清单和分块都被忽略。
+// 分块记录封存时尾部的 LSN，某个版本的尾部只拼接在它之前封存的分块，CDC 和 diff 读取到的历史版本同样是完整的列表。
+// /kv、/query、脚本、CDC 和数据转换等通用的读取路径通过 expandSegment 读取完整的列表，
+// 整体替换、删除和修改过期时间时需要同时处理清单和分块。
+const (
+	quicklistKeyPrefix   = internalKeyPrefix + "quicklist:"
+	quicklistMetaPrefix  = quicklistKeyPrefix + "meta:"
+	quicklistChunkPrefix = quicklistKeyPrefix + "chunk:"
+)
+
+// quicklistChunk 是每个封存分块的项目数量
+var quicklistChunk = 1024
+
+// quicklist 是列表封存分块的清单，分块按照在列表中的顺序排列
+type quicklist struct {
+	Chunks []quicklistPart `json:"chunks"`
+	Next   uint64          `json:"next"`
+	// 创建清单时的 LSN，LSN 不超过 Base 的尾部属于清单创建之前的列表，不拼接任何分块
+	Base uint64 `json:"base"`
+}
+
+type quicklistPart struct {
+	ID    uint64 `json:"id"`
+	Count int    `json:"count"`
+	// 封存时仍然包含这些项目的尾部的 LSN，写入清单之后尾部写回之前中断时，
+	// 这个尾部仍然包含被封存的项目，只有 LSN 更大的尾部才拼接这个分块
+	Tail uint64 `json:"tail"`
+}
+
+func quicklistMetaKey(key string) string {
+	return quicklistMetaPrefix + key
+}
+
+func quicklistChunkKey(key string, id uint64) string {
+	return quicklistChunkPrefix + key + ":" + strconv.FormatUint(id, 10)
+}
+
+// chunks 返回 LSN 为 lsn 的尾部需要拼接的分块
+func (ql *quicklist) chunks(lsn uint64) []quicklistPart {
+	if ql == nil || lsn <= ql.Base {
+		return nil
+	}
+	parts := make([]quicklistPart, 0, len(ql.Chunks))
+	for _, part := range ql.Chunks {
+		if part.Tail < lsn {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// loadQuicklist 读取 key 的清单，key 没有封存的分块时返回 nil
+func loadQuicklist(ctx context.Context, key string) (*quicklist, error) {
+	_, seg, err := storage.FetchSegmentContext(ctx, quicklistMetaKey(key))
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	text, err := seg.ToText()
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ReleaseToPool(text)
+
+	ql := new(quicklist)
+	err = json.Unmarshal([]byte(text.Content), ql)
+	if err != nil {
+		return nil, err
+	}
+	return ql, nil
+}
+
+func saveQuicklist(ctx context.Context, key string, ql *quicklist, ttl uint64) error {
+	document, err := json.Marshal(ql)
+	if err != nil {
+		return err
+	}
+
+	seg, err := vfs.AcquirePoolSegment(quicklistMetaKey(key), types.NewText(string(document)), ttl)
+	if err != nil {
+		return err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	_, err = storage.PutSegmentContext(ctx, quicklistMetaKey(key), seg)
+	return err
+}
+
+// dropQuicklist 删除 key 的清单和全部分块，列表被替换或者删除时调用
+func dropQuicklist(ctx context.Context, key string) error {
+	ql, err := loadQuicklist(ctx, key)
+	if err != nil || ql == nil {
+		return err
+	}
+
+	err = dropChunks(ctx, key, ql.Chunks)
+	if err != nil {
+		return err
+	}
+	return storage.DeleteSegmentContext(ctx, quicklistMetaKey(key))
+}
+
+// dropChunks 删除分块，已经不存在的分块被忽略，中断之后可以重新删除
+func dropChunks(ctx context.Context, key string, parts []quicklistPart) error {
+	for _, part := range parts {
+		err := storage.DeleteSegmentContext(ctx, quicklistChunkKey(key, part.ID))
+		if err != nil && !errors.Is(err, vfs.ErrKeyNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropOrphanQuicklists 删除列表已经不存在的清单和分块，按照前缀或者模式批量删除 key 之后调用，
+// prefix 限定检查的范围
+func dropOrphanQuicklists(ctx context.Context, prefix string) error {
+	metas, err := storage.MatchKeys(quicklistMetaPrefix+prefix, "")
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		key := strings.TrimPrefix(meta, quicklistMetaPrefix)
+		unlock := storage.LockKey(key)
+		if _, exists := storage.StatSegment(key); !exists {
+			err = dropQuicklist(ctx, key)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireQuicklist 把清单和分块的过期时间修改为 ttl，和列表的尾部保持一致
+func expireQuicklist(ctx context.Context, key string, ttl uint64) error {
+	ql, err := loadQuicklist(ctx, key)
+	if err != nil || ql == nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(ql.Chunks)+1)
+	for _, part := range ql.Chunks {
+		keys = append(keys, quicklistChunkKey(key, part.ID))
+	}
+	keys = append(keys, quicklistMetaKey(key))
+
+	for _, k := range keys {
+		version, seg, err := storage.FetchSegmentContext(ctx, k)
+		if errors.Is(err, vfs.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		newseg, err := seg.WithTTL(ttl)
+		utils.ReleaseToPool(seg)
+		if err != nil {
+			return err
+		}
+		err = storage.UpdateSegmentWithCASContext(ctx, k, version, newseg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadChunk 读取一个封存的分块
+func loadChunk(ctx context.Context, key string, id uint64) ([]any, error) {
+	_, seg, err := storage.FetchSegmentContext(ctx, quicklistChunkKey(key, id))
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	chunk, err := seg.ToCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ReleaseToPool(chunk)
+
+	return chunk.Collection, nil
+}
+
+// collectionView 是封存的分块和尾部拼接而成的完整列表，只有读取到的分块才会被解码
+type collectionView struct {
+	key   string
+	ql    *quicklist
+	parts []quicklistPart
+	tail  []any
+}
+
+func (v *collectionView) size() int {
+	n := len(v.tail)
+	for _, part := range v.parts {
+		n += part.Count
+	}
+	return n
+}
+
+// slice 返回下标在 [from, to] 之间的项目，下标必须在列表的范围内
+func (v *collectionView) slice(ctx context.Context, from, to int) ([]any, error) {
+	items := make([]any, 0, to-from+1)
+
+	offset := 0
+	for _, part := range v.parts {
+		start, end := offset, offset+part.Count-1
+		offset += part.Count
+		if end < from || start > to {
+			continue
+		}
+
+		chunk, err := loadChunk(ctx, v.key, part.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) != part.Count {
+			return nil, errors.New("collection chunk does not match its manifest")
+		}
+
+		lo, hi := from-start, to-start
+		if lo < 0 {
+			lo = 0
+		}
+		if hi >= part.Count {
+			hi = part.Count - 1
+		}
+		items = append(items, chunk[lo:hi+1]...)
+	}
+
+	if to >= offset {
+		lo := from - offset
+		if lo < 0 {
+			lo = 0
+		}
+		items = append(items, v.tail[lo:to-offset+1]...)
+	}
+
+	return items, nil
+}
+
+// rangeItems 和 Collection 的 Range、RevRange 规则相同
+func (v *collectionView) rangeItems(ctx context.Context, start, end int, reverse bool) ([]any, error) {
+	size := v.size()
+	start, end, ok := types.RangeBounds(size, start, end)
+	if !ok {
+		return []any{}, nil
+	}
+	if !reverse {
+		return v.slice(ctx, start, end)
+	}
+
+	items, err := v.slice(ctx, size-1-end, size-1-start)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, nil
+}
+
+// loadCollectionView 读取列表的尾部和清单，seg 是尾部的 Segment，调用者负责释放
+func loadCollectionView(ctx context.Context, key string, seg *vfs.Segment) (*collectionView, error) {
+	ql, err := loadQuicklist(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	tail, err := seg.ToCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ReleaseToPool(tail)
+
+	return &collectionView{
+		key:   key,
+		ql:    ql,
+		parts: ql.chunks(seg.LSN),
+		tail:  append([]any(nil), tail.Collection...),
+	}, nil
+}
+
+// expandSegment 在 seg 是封存过分块的列表时释放 seg 并返回拼接之后的完整 Segment，否则返回 seg 本身，
+// 通用的读取路径读取到 Segment 之后立即调用，出错时返回的仍然是 seg，调用者负责释放
+func expandSegment(ctx context.Context, seg *vfs.Segment) (*vfs.Segment, error) {
+	full, err := sealedSegment(ctx, seg)
+	if err != nil || full == nil {
+		return seg, err
+	}
+	utils.ReleaseToPool(seg)
+	return full, nil
+}
+
+// sealedSegment 返回封存过分块的列表拼接之后的完整 Segment，保留 seg 的 LSN 和过期时间，
+// seg 不是封存过分块的列表时返回 nil
+func sealedSegment(ctx context.Context, seg *vfs.Segment) (*vfs.Segment, error) {
+	if seg.Type != vfs.Collection || seg.IsTombstone() {
+		return nil, nil
+	}
+	key := seg.GetKeyString()
+	if _, sealed := storage.StatSegment(quicklistMetaKey(key)); !sealed {
+		return nil, nil
+	}
+
+	view, err := loadCollectionView(ctx, key, seg)
+	if err != nil || len(view.parts) == 0 {
+		return nil, err
+	}
+
+	items, err := view.slice(ctx, 0, view.size()-1)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := types.NewCollection()
+	collection.Collection = items
+	full, err := vfs.AcquirePoolSegment(key, collection, 0)
+	if err != nil {
+		return nil, err
+	}
+	full.CreatedAt, full.ExpiredAt, full.LSN = seg.CreatedAt, seg.ExpiredAt, seg.LSN
+	return full, nil
+}
+
+// PushCollectionController 在列表末尾追加项目，尾部达到分块大小时封存为分块，key 不存在时创建新的列表
+func PushCollectionController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var body struct {
+		Items []any `json:"items" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
+		return
+	}
+
+	version, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), key)
+	if err != nil && !errors.Is(err, vfs.ErrKeyNotFound) {
+		fetchFailed(ctx, err)
+		return
+	}
+
+	var (
+		view    *collectionView
+		ttl     uint64
+		tailLSN uint64
+		exists  = err == nil
+	)
+	if exists && seg.Type != vfs.Collection {
+		utils.ReleaseToPool(seg)
+		respondError(ctx, CodeTypeMismatch, "key data is not a collection.")
+		return
+	}
+	if exists {
+		view, err = loadCollectionView(ctx.Request.Context(), key, seg)
+		ttl, tailLSN = remainingTTL(seg), seg.LSN
+		utils.ReleaseToPool(seg)
+		if err == nil && view.ql != nil && len(view.parts) < len(view.ql.Chunks) {
+			// 上一次封存写入清单之后尾部没有写回，这些分块的项目仍然在尾部中
+			err = dropChunks(ctx.Request.Context(), key, view.ql.Chunks[len(view.parts):])
+			view.ql.Chunks = view.parts
+		}
+		if err != nil {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+	} else {
+		// 尾部不存在时残留的清单和分块属于已经删除的列表
+		err = dropQuicklist(ctx.Request.Context(), key)
+		if err != nil {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+		view = &collectionView{key: key}
+	}
+
+	view.tail = append(view.tail, body.Items...)
+
+	if sealed := len(view.tail) - len(view.tail)%quicklistChunk; sealed > 0 {
+		if view.ql == nil {
+			view.ql = &quicklist{Next: 1, Base: storage.LSN()}
+		}
+		if !exists {
+			tailLSN = view.ql.Base
+		}
+
+		for i := 0; i < sealed; i += quicklistChunk {
+			chunk := types.NewCollection()
+			chunk.Collection = view.tail[i : i+quicklistChunk]
+			err = saveSegment(ctx.Request.Context(), quicklistChunkKey(key, view.ql.Next), chunk, 0, ttl, false)
+			if err != nil {
+				storageFailed(ctx, CodeInternal, err)
+				return
+			}
+			view.ql.Chunks = append(view.ql.Chunks, quicklistPart{ID: view.ql.Next, Count: quicklistChunk, Tail: tailLSN})
+			view.ql.Next++
+		}
+
+		err = saveQuicklist(ctx.Request.Context(), key, view.ql, ttl)
+		if err != nil {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+		view.tail = view.tail[sealed:]
+	}
+
+	tail := types.NewCollection()
+	tail.Collection = view.tail
+	err = saveSegment(ctx.Request.Context(), key, tail, version, ttl, exists)
+	if err != nil {
+		storageFailed(ctx, CodeConflict, err)
+		return
+	}
+
+	view.parts = view.ql.chunks(math.MaxUint64)
+	ctx.JSON(http.StatusOK, gin.H{
+		"size": view.size(),
+	})
+}
+
+// CollectionSizeController 返回列表的项目数量，只读取清单和尾部数组的长度，不会解码项目
+func CollectionSizeController(ctx *gin.Context) {
+	key := ctx.Param("key")
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), key)
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	if seg.Type != vfs.Collection {
+		respondError(ctx, CodeTypeMismatch, "key data is not a collection.")
+		return
+	}
+
+	size, err := seg.CollectionSize()
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ql, err := loadQuicklist(ctx.Request.Context(), key)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	parts := ql.chunks(seg.LSN)
+	for _, part := range parts {
+		size += part.Count
+	}
+	chunks := len(parts)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"size":   size,
+		"chunks": chunks,
+	})
+}
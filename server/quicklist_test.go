@@ -0,0 +1,225 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuicklist(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady, oldChunk := storage, ready.Load(), quicklistChunk
+	storage, adminToken = fss, "quicklist-admin-token"
+	ready.Store(true)
+	quicklistChunk = 4
+	defer func() {
+		storage, adminToken = old, ""
+		ready.Store(wasReady)
+		quicklistChunk = oldChunk
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Admin-Token", adminToken)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/collection/feed/push", `{"items": [0, 1, 2]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"size": 3}`, w.Body.String())
+	_, sealed := fss.StatSegment(quicklistMetaKey("feed"))
+	assert.False(t, sealed)
+
+	// 超过分块大小之后封存完整的分块，尾部只保留剩下的项目
+	w = request(http.MethodPost, "/collection/feed/push", `{"items": [3, 4, 5, 6, 7, 8]}`)
+	assert.JSONEq(t, `{"size": 9}`, w.Body.String())
+	w = request(http.MethodGet, "/collection/feed/size", "")
+	assert.JSONEq(t, `{"size": 9, "chunks": 2}`, w.Body.String())
+
+	_, seg, err := fss.FetchSegment("feed")
+	assert.NoError(t, err)
+	size, err := seg.CollectionSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	tests := []struct {
+		query    string
+		response string
+	}{
+		{"", `{"collection": [0, 1, 2, 3, 4, 5, 6, 7, 8], "total": 9}`},
+		{"?start=3&end=5", `{"collection": [3, 4, 5], "total": 9}`},
+		{"?start=-2", `{"collection": [7, 8], "total": 9}`},
+		{"?start=0&end=4&reverse=true", `{"collection": [8, 7, 6, 5, 4], "total": 9}`},
+		{"?start=4&end=100", `{"collection": [4, 5, 6, 7, 8], "total": 9}`},
+	}
+	for _, tt := range tests {
+		w = request(http.MethodGet, "/collection/feed"+tt.query, "")
+		assert.Equal(t, http.StatusOK, w.Code, tt.query)
+		assert.JSONEq(t, tt.response, w.Body.String(), tt.query)
+	}
+
+	w = request(http.MethodPost, "/collection/feed/push", `{"items": [9, 10, 11]}`)
+	assert.JSONEq(t, `{"size": 12}`, w.Body.String())
+	w = request(http.MethodGet, "/collection/feed?start=7", "")
+	assert.JSONEq(t, `{"collection": [7, 8, 9, 10, 11], "total": 12}`, w.Body.String())
+
+	// 通用的读取接口和脚本读取到完整的列表
+	w = request(http.MethodGet, "/kv/feed", "")
+	assert.JSONEq(t, `{"type": "collection", "value": [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11], "ttl": -1}`, w.Body.String())
+	result, err := runScript(context.Background(), `return #urna.get(KEYS[1])`, []string{"feed"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(12), result)
+
+	// CDC 中每个版本的尾部只拼接在它之前封存的分块
+	segs, err := fss.ReadChanges(context.Background(), 0, 100)
+	assert.NoError(t, err)
+	sizes := make([]int, 0)
+	for _, seg := range segs {
+		if seg.GetKeyString() != "feed" {
+			continue
+		}
+		change, err := newChange(context.Background(), seg)
+		assert.NoError(t, err)
+		var items []any
+		assert.NoError(t, json.Unmarshal(change.Value, &items))
+		sizes = append(sizes, len(items))
+	}
+	assert.Equal(t, []int{3, 9, 12}, sizes)
+
+	// 修改过期时间时分块和清单使用相同的过期时间
+	w = request(http.MethodPut, "/admin/keys/feed/ttl", `{"ttl": 600}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, chunk, err := fss.FetchSegment(quicklistChunkKey("feed", 2))
+	assert.NoError(t, err)
+	assert.Greater(t, chunk.TTL(), int64(0))
+	_, meta, err := fss.FetchSegment(quicklistMetaKey("feed"))
+	assert.NoError(t, err)
+	assert.Greater(t, meta.TTL(), int64(0))
+
+	// 整体替换之后之前封存的分块被删除
+	w = request(http.MethodPut, "/collection/feed", `{"collection": ["a"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	_, sealed = fss.StatSegment(quicklistMetaKey("feed"))
+	assert.False(t, sealed)
+	_, sealed = fss.StatSegment(quicklistChunkKey("feed", 1))
+	assert.False(t, sealed)
+	w = request(http.MethodGet, "/collection/feed/size", "")
+	assert.JSONEq(t, `{"size": 1, "chunks": 0}`, w.Body.String())
+
+	w = request(http.MethodPost, "/collection/feed/push", `{"items": [1, 2, 3, 4]}`)
+	assert.JSONEq(t, `{"size": 5}`, w.Body.String())
+	w = request(http.MethodDelete, "/collection/feed", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	_, sealed = fss.StatSegment(quicklistMetaKey("feed"))
+	assert.False(t, sealed)
+
+	// 批量删除之后残留的清单和分块被删除
+	w = request(http.MethodPost, "/collection/feed/push", `{"items": [1, 2, 3, 4, 5]}`)
+	assert.JSONEq(t, `{"size": 5}`, w.Body.String())
+	w = request(http.MethodPost, "/admin/delete?prefix=feed", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, sealed = fss.StatSegment(quicklistMetaKey("feed"))
+	assert.False(t, sealed)
+	_, sealed = fss.StatSegment(quicklistChunkKey("feed", 1))
+	assert.False(t, sealed)
+
+	w = request(http.MethodPut, "/text/plain", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPost, "/collection/plain/push", `{"items": [1]}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = request(http.MethodGet, "/collection/plain/size", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = request(http.MethodPost, "/collection/plain/push", `{"item": 1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestQuicklistInterruptedSeal(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	ctx := context.Background()
+	tail := types.NewCollection()
+	tail.Collection = []any{"a", "b", "c"}
+	assert.NoError(t, saveSegment(ctx, "feed", tail, 0, 0, false))
+	_, seg, err := fss.FetchSegment("feed")
+	assert.NoError(t, err)
+
+	// 分块和清单已经写入，尾部还没有写回时中断
+	chunk := types.NewCollection()
+	chunk.Collection = []any{"a", "b"}
+	assert.NoError(t, saveSegment(ctx, quicklistChunkKey("feed", 1), chunk, 0, 0, false))
+	ql := &quicklist{
+		Chunks: []quicklistPart{{ID: 1, Count: 2, Tail: seg.LSN}},
+		Next:   2,
+		Base:   fss.LSN(),
+	}
+	assert.NoError(t, saveQuicklist(ctx, "feed", ql, 0))
+
+	view, err := loadCollectionView(ctx, "feed", seg)
+	assert.NoError(t, err)
+	items, err := view.rangeItems(ctx, 0, -1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"a", "b", "c"}, items)
+
+	// 之后写入的尾部拼接这个分块
+	seg.LSN = fss.LSN() + 1
+	view, err = loadCollectionView(ctx, "feed", seg)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, view.size())
+
+	// 下一次追加删除中断时写入的分块，不会重复封存
+	req := httptest.NewRequest(http.MethodPost, "/collection/feed/push", strings.NewReader(`{"items": ["d"]}`))
+	req.Header.Set("Auth-Token", authPassword)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	root.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"size": 4}`, w.Body.String())
+	_, sealed := fss.StatSegment(quicklistChunkKey("feed", 1))
+	assert.False(t, sealed)
+}
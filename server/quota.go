@@ -0,0 +1,187 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultNamespace = "default"
+	// 清理过期 key 释放命名空间配额的间隔
+	quotaSweepInterval = 30 * time.Second
+)
+
+// errQuotaExceeded 是写入之后命名空间的用量超出配额时返回的错误
+var errQuotaExceeded = errors.New("namespace quota exceeded")
+
+// 命名空间的分隔符，和存储引擎前缀统计的分隔符相同，为空时不能使用配额
+var namespaceSeparator string
+
+// 只读的配额表，在服务启动之前设置完成
+var quotas = make(map[string]*namespaceQuota)
+
+// 关闭时停止清理过期 key 的协程
+var quotaSweepStop chan struct{}
+
+// namespaceQuota 是命名空间的配额，用量直接使用存储引擎的前缀统计，
+// 任何写入路径写入的 key 都会计入用量，mu 串行化同一个命名空间的准入检查和写入
+type namespaceQuota struct {
+	mu       sync.Mutex
+	maxKeys  int64
+	maxBytes int64
+}
+
+type NamespaceUsage struct {
+	Namespace string `json:"namespace"`
+	Keys      int64  `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+	MaxKeys   int64  `json:"max_keys"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// namespaceOf 返回 key 所属的命名空间，没有分隔符的 key 属于 default 命名空间，
+// 时间序列的时间桶属于序列所在的命名空间
+func namespaceOf(key string) string {
+	return namespaceIn(placementKey(key), namespaceSeparator)
+}
+
+func namespaceIn(key, separator string) string {
+	if separator == "" {
+		return defaultNamespace
+	}
+	if i := strings.Index(key, separator); i > 0 {
+		return key[:i]
+	}
+	return defaultNamespace
+}
+
+// quotaOf 返回 key 所属命名空间的配额，没有配额或者存储引擎没有前缀统计时返回 nil
+func quotaOf(key string) (*namespaceQuota, string) {
+	if storage == nil || namespaceSeparator == "" {
+		return nil, ""
+	}
+	namespace := namespaceOf(key)
+	return quotas[namespace], namespace
+}
+
+// exceeded 检查写入后的用量是否会超出配额
+func (nq *namespaceQuota) exceeded(keys, bytes int64) bool {
+	return (nq.maxKeys > 0 && keys > nq.maxKeys) ||
+		(nq.maxBytes > 0 && bytes > nq.maxBytes)
+}
+
+// admit 检查用 size 字节的 segment 覆盖 key 之后命名空间的用量是否超出配额，调用方持有 nq.mu。
+// 过期的 key 在被清理之前仍然计入前缀统计，由 runQuotaSweep 在后台定期清理
+func (nq *namespaceQuota) admit(namespace, key string, size int64) error {
+	keys, bytes := prefixUsageOf(storage, namespace)
+	bytes += size
+	if old, exists := storage.StatSegment(key); exists {
+		bytes -= int64(old.Length)
+	} else {
+		keys += 1
+	}
+	if nq.exceeded(keys, bytes) {
+		return fmt.Errorf("%w: %s", errQuotaExceeded, namespace)
+	}
+	return nil
+}
+
+// withQuota 在命名空间配额的准入检查通过之后调用 write 写入 key，size 是编码之后的 segment 大小。
+// 同一个命名空间的准入检查和写入被串行化，调用方需要的 key 锁必须在这之前获取，
+// 所有写入路径都按照先 key 锁再配额锁的顺序加锁，不会相互死锁
+func withQuota(key string, size int64, write func() error) error {
+	nq, namespace := quotaOf(key)
+	if nq == nil {
+		return write()
+	}
+	nq.mu.Lock()
+	defer nq.mu.Unlock()
+
+	err := nq.admit(namespace, key, size)
+	if err != nil {
+		return err
+	}
+	return write()
+}
+
+// prefixUsageOf 从存储引擎的前缀统计中计算命名空间的用量，default 命名空间包含没有分隔符的 key，
+// 时间桶通过前缀分组计入序列所在的命名空间
+func prefixUsageOf(fss *vfs.LogStructuredFS, namespace string) (keys, bytes int64) {
+	prefixes := []string{seriesGroup(namespace, namespaceSeparator)}
+	// 一级前缀 ts 下都是时间桶，已经分组计入各自的命名空间
+	if namespace != seriesRoot {
+		prefixes = append(prefixes, namespace)
+	}
+	if namespace == defaultNamespace {
+		prefixes = append(prefixes, "")
+	}
+	for _, prefix := range prefixes {
+		usage, err := fss.PrefixUsage(prefix)
+		if err == nil {
+			keys += usage.Keys
+			bytes += usage.Bytes
+		}
+	}
+	return keys, bytes
+}
+
+// runQuotaSweep 定期清理过期的 key，过期的 key 不再占用命名空间的配额
+func runQuotaSweep(stop <-chan struct{}) {
+	ticker := time.NewTicker(quotaSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			storage.KeysCount()
+		}
+	}
+}
+
+func GetNamespacesController(ctx *gin.Context) {
+	// 清理过期的 key，返回的用量不包含已经过期的 key
+	if len(quotas) > 0 && namespaceSeparator != "" {
+		storage.KeysCount()
+	}
+
+	usages := make([]NamespaceUsage, 0, len(quotas))
+	for namespace, nq := range quotas {
+		usage := NamespaceUsage{Namespace: namespace, MaxKeys: nq.maxKeys, MaxBytes: nq.maxBytes}
+		if namespaceSeparator != "" {
+			usage.Keys, usage.Bytes = prefixUsageOf(storage, namespace)
+		}
+		usages = append(usages, usage)
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Namespace < usages[j].Namespace
+	})
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"namespaces": usages,
+	})
+}
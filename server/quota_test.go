@@ -0,0 +1,176 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceOf(t *testing.T) {
+	old := namespaceSeparator
+	namespaceSeparator = ":"
+	defer func() { namespaceSeparator = old }()
+
+	assert.Equal(t, "tenant-a", namespaceOf("tenant-a:user-01"))
+	assert.Equal(t, defaultNamespace, namespaceOf("user-01"))
+	assert.Equal(t, defaultNamespace, namespaceOf(":user-01"))
+
+	// 时间桶属于序列所在的命名空间
+	assert.Equal(t, "tenant-a", namespaceOf(bucketKey("tenant-a:cpu", 0)))
+	assert.Equal(t, defaultNamespace, namespaceOf(bucketKey("cpu", 0)))
+	group := SeriesPrefixGroup(":")
+	assert.Equal(t, "ts:tenant-a", group(bucketKey("tenant-a:cpu", 0)))
+	assert.Equal(t, "ts:default", group(bucketKey("cpu", 0)))
+	assert.Equal(t, "", group("tenant-a:user-01"))
+}
+
+func TestNamespaceQuota_Exceeded(t *testing.T) {
+	nq := &namespaceQuota{maxKeys: 2, maxBytes: 1024}
+	assert.False(t, nq.exceeded(2, 1024))
+	assert.True(t, nq.exceeded(3, 100))
+	assert.True(t, nq.exceeded(1, 1025))
+
+	// 0 表示不限制
+	unlimited := &namespaceQuota{}
+	assert.False(t, unlimited.exceeded(1e9, 1e12))
+}
+
+// setupQuotaStorage 使用带有时间桶分组的存储引擎和配额表 limits，返回发送请求的函数
+func setupQuotaStorage(t *testing.T, limits map[string]*namespaceQuota) (*vfs.LogStructuredFS, func(method, path, body string) *httptest.ResponseRecorder) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:      fs.FileMode(0755),
+		Path:        t.TempDir(),
+		Threshold:   1,
+		Separator:   ":",
+		PrefixGroup: SeriesPrefixGroup(":"),
+	})
+	assert.NoError(t, err)
+
+	old, oldQuotas, oldSeparator, wasReady := storage, quotas, namespaceSeparator, ready.Load()
+	storage, namespaceSeparator, quotas = fss, ":", limits
+	ready.Store(true)
+	t.Cleanup(func() {
+		storage, quotas, namespaceSeparator = old, oldQuotas, oldSeparator
+		ready.Store(wasReady)
+		fss.CloseFS()
+	})
+
+	return fss, func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+}
+
+func TestQuotaWritePaths(t *testing.T) {
+	seg, err := vfs.NewSegment("fits:1", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	size := int64(seg.Size())
+
+	fss, request := setupQuotaStorage(t, map[string]*namespaceQuota{
+		"tenant":  {maxKeys: 2},
+		"metrics": {maxKeys: 1},
+		"fits":    {maxBytes: size},
+		"over":    {maxBytes: size - 1},
+	})
+
+	w := request(http.MethodPut, "/text/tenant:1", `{"content":"hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 脚本写入的 key 同样计入配额
+	_, err = runScript(context.Background(), `
+		urna.put("number", KEYS[1], 1)
+		urna.put("number", KEYS[2], 2)
+	`, []string{"tenant:2", "tenant:3"}, nil)
+	assert.ErrorContains(t, err, errQuotaExceeded.Error())
+	_, ok := fss.StatSegment("tenant:2")
+	assert.False(t, ok)
+
+	_, err = runScript(context.Background(), `urna.put("number", KEYS[1], 1)`, []string{"tenant:2"}, nil)
+	assert.NoError(t, err)
+
+	w = request(http.MethodPut, "/text/tenant:3", `{"content":"hello"}`)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	// 覆盖已经存在的 key 不会增加 key 的数量
+	w = request(http.MethodPut, "/text/tenant:1", `{"content":"world"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 时序数据的每个分桶都是一个 key，计入序列所在的命名空间
+	w = request(http.MethodPost, "/ts/metrics:cpu", `{"points":[{"ts":1000,"value":1}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPost, "/ts/metrics:cpu", `{"points":[{"ts":3601000,"value":1}]}`)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	w = request(http.MethodPost, "/ts/tenant:cpu", `{"points":[{"ts":1000,"value":1}]}`)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	// 字节配额按照编码之后的 segment 大小计算
+	w = request(http.MethodPut, "/text/fits:1", `{"content":"hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPut, "/text/over:1", `{"content":"hello"}`)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	// 删除的 key 不再计入用量
+	w = request(http.MethodDelete, "/text/tenant:1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = request(http.MethodPut, "/text/tenant:3", `{"content":"hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestQuotaConcurrentWrites(t *testing.T) {
+	_, request := setupQuotaStorage(t, map[string]*namespaceQuota{"tenant": {maxKeys: 100}})
+
+	// 所有写入路径都先获取 key 锁再获取配额锁，并发写入同一个 key 不会死锁
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				request(http.MethodPut, "/text/tenant:1", `{"content":"hello"}`)
+			}()
+			go func() {
+				defer wg.Done()
+				request(http.MethodPost, "/eval", `{"script": "urna.put('text', KEYS[1], 'world')", "keys": ["tenant:1"]}`)
+			}()
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent writes deadlocked")
+	}
+
+	w := request(http.MethodGet, "/text/tenant:1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
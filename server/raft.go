@@ -0,0 +1,189 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/consensus"
+	"github.com/gin-gonic/gin"
+)
+
+// raftNode 是 consensus.Node 中服务器用到的部分
+type raftNode interface {
+	ID() string
+	IsLeader() bool
+	Leader() (consensus.Peer, bool)
+	State() string
+	AppliedIndex() uint64
+	Lag() uint64
+	Close() error
+}
+
+const (
+	// maxStalenessHeader 是客户端允许读取到的数据最多过期的时间，例如 5s，没有这个请求头时 follower 直接读取本地的数据
+	maxStalenessHeader = "Max-Staleness"
+	// appliedIndexHeader 是 leader 处理请求之前已经应用的日志索引
+	appliedIndexHeader = "Urnadb-Applied-Index"
+)
+
+// replication 为空表示没有开启 raft 复制模式
+var replication struct {
+	node    raftNode
+	mu      sync.Mutex
+	proxies map[string]*httputil.ReverseProxy
+	// leader 最近返回的日志索引和转发请求的时间，leader 在这个时间之前确认的写入都不超过这个索引
+	readIndex uint64
+	readAt    time.Time
+}
+
+// leaderProxy 返回转发到 leader 的代理，leader 会变化所以按需创建
+func leaderProxy(addr string) *httputil.ReverseProxy {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if replication.proxies == nil {
+		replication.proxies = make(map[string]*httputil.ReverseProxy)
+	}
+	proxy, ok := replication.proxies[addr]
+	if !ok {
+		proxy = newNodeProxy(addr)
+		replication.proxies[addr] = proxy
+	}
+	return proxy
+}
+
+// observeReadIndex 记录 leader 在 at 之后返回的日志索引，只保留最新的一个
+func observeReadIndex(index uint64, at time.Time) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if at.After(replication.readAt) {
+		replication.readIndex, replication.readAt = index, at
+	}
+}
+
+// freshEnough 判断本节点的数据是否最多过期 maxStaleness，本节点需要已经应用 leader 在
+// maxStaleness 之内返回的日志索引，没有收到过 leader 的索引时无法判断
+func freshEnough(node raftNode, maxStaleness time.Duration) bool {
+	replication.mu.Lock()
+	index, at := replication.readIndex, replication.readAt
+	replication.mu.Unlock()
+
+	return !at.IsZero() && time.Since(at) <= maxStaleness && node.AppliedIndex() >= index
+}
+
+// maxStalenessOf 解析请求允许的最大过期时间，没有 Max-Staleness 请求头时 ok 为 false
+func maxStalenessOf(c *gin.Context) (maxStaleness time.Duration, ok bool, err error) {
+	value := c.GetHeader(maxStalenessHeader)
+	if value == "" {
+		return 0, false, nil
+	}
+	maxStaleness, err = time.ParseDuration(value)
+	if err != nil || maxStaleness < 0 {
+		return 0, false, fmt.Errorf("%s must be a non-negative duration such as 5s", maxStalenessHeader)
+	}
+	return maxStaleness, true, nil
+}
+
+// raftMiddleware 只有 leader 可以提交写操作，follower 收到的写请求转发给 leader。
+// 读请求默认由本节点直接处理，带有 Max-Staleness 请求头的读请求只有在本节点的数据足够新时才在本地处理，
+// 否则转发给 leader。leader 的响应带有处理请求之前已经应用的日志索引，follower 用它判断本地的数据是否足够新
+func raftMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		node := replication.node
+		if node == nil || publicPath(c.FullPath()) || sessionPaths[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		if node.IsLeader() {
+			c.Header(appliedIndexHeader, strconv.FormatUint(node.AppliedIndex(), 10))
+			c.Next()
+			return
+		}
+
+		if c.GetHeader(forwardedHeader) != "" {
+			c.Next()
+			return
+		}
+
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead {
+			maxStaleness, bounded, err := maxStalenessOf(c)
+			if err != nil {
+				failed(c, CodeBadRequest, err)
+				c.Abort()
+				return
+			}
+			if !bounded || freshEnough(node, maxStaleness) {
+				c.Next()
+				return
+			}
+		}
+
+		leader, ok := node.Leader()
+		if !ok {
+			respondError(c, CodeUnavailable, "raft leader is not elected yet.")
+			c.Abort()
+			return
+		}
+
+		at := time.Now()
+		c.Header(ownerHeader, leader.HTTP)
+		c.Request.Header.Set(forwardedHeader, node.ID())
+		leaderProxy(leader.HTTP).ServeHTTP(c.Writer, c.Request)
+		if index, err := strconv.ParseUint(c.Writer.Header().Get(appliedIndexHeader), 10, 64); err == nil {
+			observeReadIndex(index, at)
+		}
+		c.Abort()
+	}
+}
+
+// GetRaftController 返回本节点的 raft 状态、当前的 leader、已经应用的日志索引和还没有应用的日志数量，
+// follower 还会返回最近收到的 leader 的日志索引，读取时带有 Max-Staleness 的请求根据它判断是否在本地处理
+func GetRaftController(ctx *gin.Context) {
+	node := replication.node
+	if node == nil {
+		respondError(ctx, CodeFeatureDisabled, "raft replication is not enabled.")
+		return
+	}
+
+	result := gin.H{
+		"id":    node.ID(),
+		"state": node.State(),
+	}
+	if leader, ok := node.Leader(); ok {
+		result["leader"] = gin.H{"id": leader.ID, "http": leader.HTTP}
+	}
+	result["applied_index"] = node.AppliedIndex()
+	result["lag"] = node.Lag()
+
+	replication.mu.Lock()
+	if !node.IsLeader() && !replication.readAt.IsZero() {
+		result["read_index"] = gin.H{
+			"index":  replication.readIndex,
+			"age_ms": time.Since(replication.readAt).Milliseconds(),
+		}
+	}
+	replication.mu.Unlock()
+
+	ctx.IndentedJSON(http.StatusOK, result)
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/consensus"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRaftNode 模拟 raft 节点的角色、leader 和已经应用的日志索引
+type fakeRaftNode struct {
+	leader  bool
+	peer    consensus.Peer
+	applied uint64
+}
+
+func (n *fakeRaftNode) ID() string     { return "node-2" }
+func (n *fakeRaftNode) IsLeader() bool { return n.leader }
+func (n *fakeRaftNode) Close() error   { return nil }
+
+func (n *fakeRaftNode) Leader() (consensus.Peer, bool) {
+	return n.peer, n.peer.ID != ""
+}
+
+func (n *fakeRaftNode) AppliedIndex() uint64 { return n.applied }
+func (n *fakeRaftNode) Lag() uint64          { return 3 }
+
+func (n *fakeRaftNode) State() string {
+	if n.leader {
+		return "Leader"
+	}
+	return "Follower"
+}
+
+func TestRaftMiddleware(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	// leader 节点只记录收到的请求，并且返回已经应用的日志索引
+	var forwarded string
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(forwardedHeader)
+		w.Header().Set(appliedIndexHeader, "10")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"node":"leader","path":"` + r.URL.Path + `"}`))
+	}))
+	defer remote.Close()
+
+	node := &fakeRaftNode{}
+	old, wasReady := storage, ready.Load()
+	storage, replication.node = fss, node
+	ready.Store(true)
+	defer func() {
+		storage, replication.node, replication.proxies = old, nil, nil
+		replication.readIndex, replication.readAt = 0, time.Time{}
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"content":"hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authPassword)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(closeNotifyRecorder{w}, req)
+		return w
+	}
+
+	// 还没有选举出 leader 时拒绝写请求
+	w := request(http.MethodPut, "/text/raft-key")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = request(http.MethodGet, "/admin/raft")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"state": "Follower"`)
+	assert.NotContains(t, w.Body.String(), `"leader"`)
+	assert.NotContains(t, w.Body.String(), `"read_index"`)
+
+	leaderHTTP := strings.TrimPrefix(remote.URL, "http://")
+	node.peer = consensus.Peer{ID: "node-1", Addr: "127.0.0.1:7001", HTTP: leaderHTTP}
+
+	w = request(http.MethodPut, "/text/raft-key")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, leaderHTTP, w.Header().Get(ownerHeader))
+	assert.JSONEq(t, `{"node":"leader","path":"/text/raft-key"}`, w.Body.String())
+	assert.Equal(t, "node-2", forwarded)
+
+	// follower 直接处理读请求
+	w = request(http.MethodGet, "/text/raft-key")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodGet, "/admin/raft")
+	assert.Contains(t, w.Body.String(), `"lag": 3`)
+	assert.Contains(t, w.Body.String(), `"index": 10`)
+
+	// 本节点还没有应用 leader 返回的日志索引，有界过期的读请求转发给 leader
+	w = request(http.MethodGet, "/text/raft-key", maxStalenessHeader, "5s")
+	assert.JSONEq(t, `{"node":"leader","path":"/text/raft-key"}`, w.Body.String())
+
+	// 应用之后在本地处理
+	node.applied = 10
+	w = request(http.MethodGet, "/text/raft-key", maxStalenessHeader, "5s")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// leader 返回的日志索引超过允许的过期时间之后重新转发给 leader
+	replication.readAt = time.Now().Add(-10 * time.Second)
+	w = request(http.MethodGet, "/text/raft-key", maxStalenessHeader, "5s")
+	assert.JSONEq(t, `{"node":"leader","path":"/text/raft-key"}`, w.Body.String())
+	w = request(http.MethodGet, "/text/raft-key", maxStalenessHeader, "5s")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodGet, "/text/raft-key", maxStalenessHeader, "soon")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	node.leader = true
+	w = request(http.MethodPut, "/text/raft-key")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "10", w.Header().Get(appliedIndexHeader))
+
+	w = request(http.MethodGet, "/admin/raft")
+	assert.Contains(t, w.Body.String(), `"http": "`+leaderHTTP+`"`)
+}
@@ -0,0 +1,689 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/cluster"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	"github.com/spaolacci/murmur3"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// 副本节点不可用时每隔 handoffInterval 尝试重新发送暂存的写操作
+	handoffInterval = 5 * time.Second
+	defaultMaxHints = 10000
+)
+
+// replicas.n 小于 2 表示没有开启副本复制
+var replicas struct {
+	n        int
+	maxHints int
+	repair   time.Duration
+	peers    map[string]*handoff
+	stop     chan struct{}
+}
+
+// peerClient 用于节点之间复制和迁移数据
+var peerClient = &http.Client{Timeout: timeout}
+
+// placementKey 返回决定 key 保存在哪些节点上的 key，时间序列的时间桶和序列名称保存在同一组节点上
+func placementKey(key string) string {
+	if strings.HasPrefix(key, "ts:") {
+		series := strings.TrimPrefix(key, "ts:")
+		if i := strings.LastIndexByte(series, ':'); i > 0 {
+			return series[:i]
+		}
+	}
+	return key
+}
+
+// replicaNodes 返回 key 的副本节点
+func replicaNodes(key string) []string {
+	return shards.ring.LocateN(placementKey(key), replicas.n)
+}
+
+// sharedWith 返回 key 是否同时保存在本节点和 node 上
+func sharedWith(key, node string) bool {
+	nodes := replicaNodes(key)
+	self, peer := false, false
+	for _, n := range nodes {
+		self = self || n == shards.self
+		peer = peer || n == node
+	}
+	return self && peer
+}
+
+// segmentDigest 计算 Segment 的摘要，同一次写入复制到不同节点的摘要相同
+func segmentDigest(seg *vfs.Segment) uint64 {
+	h := murmur3.New64()
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], seg.CreatedAt)
+	binary.LittleEndian.PutUint64(buf[8:], seg.ExpiredAt)
+	_, _ = h.Write(seg.Key)
+	_, _ = h.Write(buf[:])
+	_, _ = h.Write(seg.Value)
+	return h.Sum64()
+}
+
+// replicaSet 实现了 vfs.Replicator，本地写入成功之后异步复制到其他副本节点
+type replicaSet struct {
+	fs *vfs.LogStructuredFS
+}
+
+func (r replicaSet) Replicate(ctx context.Context, op *vfs.Operation) error {
+	err := r.fs.Apply(op)
+	if err != nil {
+		return err
+	}
+
+	// 副本节点之间的版本号不一致，CAS 更新按照普通写入复制，删除带上时间戳用于比较新旧
+	replica := vfs.Operation{Kind: op.Kind, Key: op.Key, Segment: op.Segment}
+	switch op.Kind {
+	case vfs.OpCAS:
+		replica.Kind = vfs.OpPut
+	case vfs.OpDelete:
+		replica.Segment = vfs.NewTombstoneSegment(op.Key)
+	}
+
+	// 调用方返回之后会把 Segment 放回对象池，必须在这里完成编码
+	payload, err := msgpack.Marshal(&replica)
+	if err != nil {
+		slog.Errorf("failed to encode replica of key %s: %v", op.Key, err)
+		return nil
+	}
+
+	for _, node := range replicaNodes(op.Key) {
+		if h, ok := replicas.peers[node]; ok {
+			h.push(payload)
+		}
+	}
+
+	return nil
+}
+
+// handoff 按顺序把写操作发送到一个副本节点，节点不可用时把写操作暂存到 hints 文件，
+// 节点恢复之后再按照原来的顺序发送过去
+type handoff struct {
+	node    string
+	path    string
+	mu      sync.Mutex
+	pending [][]byte
+	// head 是 pending 第一个写操作的序号，丢弃和发送成功都会让它递增
+	head   uint64
+	down   bool
+	notify chan struct{}
+}
+
+func openHandoff(dir, node string) (*handoff, error) {
+	h := &handoff{
+		node:   node,
+		path:   filepath.Join(dir, strings.ReplaceAll(node, ":", "_")+".hints"),
+		notify: make(chan struct{}, 1),
+	}
+
+	fd, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	dec := msgpack.NewDecoder(bufio.NewReader(fd))
+	for {
+		var payload []byte
+		err := dec.Decode(&payload)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// 最后一条记录可能没有写完整，前面的记录照样发送
+			slog.Warnf("failed to decode hints of node %s: %v", node, err)
+			break
+		}
+		h.pending = append(h.pending, payload)
+	}
+
+	if over := len(h.pending) - replicas.maxHints; replicas.maxHints > 0 && over > 0 {
+		h.pending = h.pending[over:]
+	}
+	h.down = len(h.pending) > 0
+
+	return h, nil
+}
+
+func (h *handoff) push(payload []byte) {
+	limit := replicas.maxHints
+	if limit <= 0 {
+		limit = defaultMaxHints
+	}
+
+	h.mu.Lock()
+	// 超出上限的写操作直接丢弃最旧的，由反熵修复补齐
+	if len(h.pending) >= limit {
+		h.pending = h.pending[1:]
+		h.head++
+		slog.Warnf("Hints of node %s exceed limit %d, dropping the oldest", h.node, limit)
+	}
+	h.pending = append(h.pending, payload)
+	if h.down {
+		err := h.appendHint(payload)
+		if err != nil {
+			slog.Errorf("failed to persist hint of node %s: %v", h.node, err)
+		}
+	}
+	h.mu.Unlock()
+
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *handoff) appendHint(payload []byte) error {
+	fd, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return msgpack.NewEncoder(fd).Encode(payload)
+}
+
+// saveHints 用内存中还没有发送的写操作覆盖 hints 文件，调用方需要持有锁
+func (h *handoff) saveHints() error {
+	if len(h.pending) == 0 {
+		err := os.Remove(h.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	for _, payload := range h.pending {
+		err := enc.Encode(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp := h.path + ".tmp"
+	err := os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+func (h *handoff) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(handoffInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-h.notify:
+		case <-ticker.C:
+		}
+		h.deliver()
+	}
+}
+
+// deliver 按顺序发送暂存的写操作，遇到失败时停止并把剩下的写操作保存到 hints 文件
+func (h *handoff) deliver() {
+	h.mu.Lock()
+	wasDown := h.down
+	h.mu.Unlock()
+
+	delivered := 0
+	for {
+		h.mu.Lock()
+		if len(h.pending) == 0 {
+			break
+		}
+		payload, head := h.pending[0], h.head
+		h.mu.Unlock()
+
+		err := sendReplica(h.node, payload)
+
+		h.mu.Lock()
+		if err != nil {
+			if !h.down {
+				slog.Warnf("Replica node %s is unavailable, queuing hinted writes: %v", h.node, err)
+			}
+			h.down = true
+			break
+		}
+		// 发送期间超出上限的写操作可能已经被丢弃
+		if h.head == head {
+			h.pending = h.pending[1:]
+			h.head++
+		}
+		h.mu.Unlock()
+		delivered++
+	}
+	defer h.mu.Unlock()
+
+	// 节点一直不可用时 hints 文件已经是最新的，不需要重写
+	if !h.down || (wasDown && delivered == 0) {
+		return
+	}
+
+	err := h.saveHints()
+	if err != nil {
+		slog.Errorf("failed to save hints of node %s: %v", h.node, err)
+	}
+
+	if len(h.pending) == 0 {
+		h.down = false
+		slog.Infof("Replica node %s is back, delivered %d hinted writes", h.node, delivered)
+	}
+}
+
+func replicaURL(node, path string, query url.Values) string {
+	u := url.URL{Scheme: "http", Host: node, Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// peerRequest 使用服务器的密码请求其他节点，响应状态码不是 200 时返回错误
+func peerRequest(method, target, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Auth-Token", authPassword)
+	req.Header.Set(forwardedHeader, shards.self)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("replica node responded with status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func sendReplica(node string, payload []byte) error {
+	resp, err := peerRequest(http.MethodPost, replicaURL(node, "/replica", nil), mimeMsgPack, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// startReplication 恢复 hints 文件并启动每个副本节点的发送协程和反熵修复协程
+func startReplication(fss *vfs.LogStructuredFS) error {
+	dir := filepath.Join(fss.GetDirectory(), "hints")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	replicas.stop = make(chan struct{})
+	replicas.peers = make(map[string]*handoff)
+	for _, node := range shards.ring.Nodes() {
+		if node == shards.self {
+			continue
+		}
+		h, err := openHandoff(dir, node)
+		if err != nil {
+			return fmt.Errorf("failed to open hints of node %s: %w", node, err)
+		}
+		replicas.peers[node] = h
+		go h.run(replicas.stop)
+	}
+
+	fss.SetReplicator(replicaSet{fs: fss})
+	fss.SetRepairer(repairFromReplica)
+
+	if replicas.repair > 0 {
+		go runAntiEntropy(fss, replicas.stop)
+	}
+
+	return nil
+}
+
+func stopReplication() {
+	if replicas.stop != nil {
+		close(replicas.stop)
+		replicas.stop = nil
+	}
+}
+
+// runAntiEntropy 定期和每个副本节点比较 Merkle 树，把本节点上更新的数据推送过去，
+// 对方节点也会做同样的事情，所以两个节点最终会一致
+func runAntiEntropy(fss *vfs.LogStructuredFS, stop <-chan struct{}) {
+	ticker := time.NewTicker(replicas.repair)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for node, h := range replicas.peers {
+				h.mu.Lock()
+				down := h.down
+				h.mu.Unlock()
+				// 节点不可用时先等待 hints 发送完成
+				if down {
+					continue
+				}
+				repaired, err := repairReplica(fss, node)
+				if err != nil {
+					slog.Warnf("Anti-entropy repair with node %s failed: %v", node, err)
+					continue
+				}
+				if repaired > 0 {
+					slog.Infof("Anti-entropy repaired %d keys on node %s", repaired, node)
+				}
+			}
+		}
+	}
+}
+
+// buildMerkleTree 使用本节点和 node 共同保存的 key 生成 Merkle 树
+func buildMerkleTree(fss *vfs.LogStructuredFS, node string) (*cluster.MerkleTree, error) {
+	tree := cluster.NewMerkleTree()
+	err := fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if sharedWith(key, node) {
+			tree.Add(key, segmentDigest(seg))
+		}
+		return true
+	})
+	return tree, err
+}
+
+// KeyDigest 是一个 key 在副本节点上的摘要
+type KeyDigest struct {
+	Key       string `json:"key"`
+	CreatedAt uint64 `json:"created_at"`
+	Digest    uint64 `json:"digest"`
+}
+
+// repairReplica 找出和 node 不一致的叶子，把本节点上更新或者 node 上缺少的 key 推送过去
+func repairReplica(fss *vfs.LogStructuredFS, node string) (int, error) {
+	local, err := buildMerkleTree(fss, node)
+	if err != nil {
+		return 0, err
+	}
+
+	var tree struct {
+		Nodes []uint64 `json:"nodes"`
+	}
+	err = fetchReplicaJSON(replicaURL(node, "/replica/merkle", url.Values{"node": {shards.self}}), &tree)
+	if err != nil {
+		return 0, err
+	}
+	remote, err := cluster.MerkleTreeFrom(tree.Nodes)
+	if err != nil {
+		return 0, err
+	}
+
+	buckets := local.Diff(remote)
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+
+	differs := make(map[int]map[string]KeyDigest, len(buckets))
+	for _, bucket := range buckets {
+		var page struct {
+			Keys []KeyDigest `json:"keys"`
+		}
+		target := replicaURL(node, "/replica/digests/"+strconv.Itoa(bucket), url.Values{"node": {shards.self}})
+		err := fetchReplicaJSON(target, &page)
+		if err != nil {
+			return 0, err
+		}
+		digests := make(map[string]KeyDigest, len(page.Keys))
+		for _, d := range page.Keys {
+			digests[d.Key] = d
+		}
+		differs[bucket] = digests
+	}
+
+	var stale []*vfs.Segment
+	err = fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		digests, ok := differs[cluster.Bucket(key)]
+		if !ok || !sharedWith(key, node) {
+			return true
+		}
+
+		// 创建时间相同但是内容不同时，两个节点按照摘要大小选出同一个版本
+		remote, ok := digests[key]
+		digest := segmentDigest(seg)
+		if !ok || remote.CreatedAt < seg.CreatedAt ||
+			(remote.CreatedAt == seg.CreatedAt && remote.Digest < digest) {
+			stale = append(stale, seg)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	h := replicas.peers[node]
+	for _, seg := range stale {
+		encoded, err := seg.Reencode()
+		if err != nil {
+			return 0, err
+		}
+		payload, err := msgpack.Marshal(&vfs.Operation{Kind: vfs.OpPut, Key: seg.GetKeyString(), Segment: encoded})
+		if err != nil {
+			return 0, err
+		}
+		h.push(payload)
+	}
+
+	return len(stale), nil
+}
+
+func fetchReplicaJSON(target string, v any) error {
+	resp, err := peerRequest(http.MethodGet, target, mimeJSON, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// repairFromReplica 实现了 vfs.Repairer，本地记录损坏时依次从其他副本节点读取 key 的最新记录
+func repairFromReplica(key string) (*vfs.Segment, error) {
+	errs := make([]error, 0, replicas.n)
+	for _, node := range replicaNodes(key) {
+		if node == shards.self {
+			continue
+		}
+		seg, err := fetchReplicaSegment(node, key)
+		if err == nil {
+			return seg, nil
+		}
+		errs = append(errs, fmt.Errorf("node %s: %w", node, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no other replica of key")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func fetchReplicaSegment(node, key string) (*vfs.Segment, error) {
+	resp, err := peerRequest(http.MethodGet, replicaURL(node, "/replica/segments/"+url.PathEscape(key), nil), mimeMsgPack, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var seg vfs.Segment
+	err = msgpack.NewDecoder(resp.Body).Decode(&seg)
+	if err != nil {
+		return nil, err
+	}
+	return &seg, nil
+}
+
+// GetReplicaSegmentController 返回 key 在本节点上的记录，用于其他副本修复损坏的记录，
+// 本节点的记录也损坏时直接返回错误，不会再去其他节点修复
+func GetReplicaSegmentController(ctx *gin.Context) {
+	if replicas.n < 2 {
+		respondError(ctx, CodeFeatureDisabled, "replication is not enabled.")
+		return
+	}
+
+	_, seg, err := storage.FetchSegmentContext(vfs.WithoutRepair(ctx.Request.Context()), ctx.Param("key"))
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	payload, err := msgpack.Marshal(seg)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.Data(http.StatusOK, mimeMsgPack, payload)
+}
+
+// ReplicaController 应用其他节点复制或者迁移过来的写操作，本地已经有更新的版本时忽略
+func ReplicaController(ctx *gin.Context) {
+	if shards.ring == nil {
+		respondError(ctx, CodeFeatureDisabled, "cluster mode is not enabled.")
+		return
+	}
+
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	var op vfs.Operation
+	err = msgpack.Unmarshal(body, &op)
+	if err != nil || op.Segment == nil || (op.Kind != vfs.OpPut && op.Kind != vfs.OpDelete) {
+		respondError(ctx, CodeBadRequest, "invalid replicated operation.")
+		return
+	}
+
+	_, current, err := storage.FetchSegment(op.Key)
+	exists := err == nil
+	if exists {
+		defer utils.ReleaseToPool(current)
+	}
+	if exists && current.CreatedAt > op.Segment.CreatedAt {
+		ctx.JSON(http.StatusOK, gin.H{
+			"message": "replica is outdated, skipped.",
+		})
+		return
+	}
+
+	if op.Kind == vfs.OpDelete && !exists {
+		ctx.JSON(http.StatusOK, gin.H{
+			"message": "replica applied successfully.",
+		})
+		return
+	}
+
+	// 直接写入本地，不能再次复制出去
+	err = storage.Apply(&op)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "replica applied successfully.",
+	})
+}
+
+// GetMerkleController 返回本节点和请求节点共同保存的 key 生成的 Merkle 树
+func GetMerkleController(ctx *gin.Context) {
+	if replicas.n < 2 {
+		respondError(ctx, CodeFeatureDisabled, "replication is not enabled.")
+		return
+	}
+
+	tree, err := buildMerkleTree(storage, ctx.Query("node"))
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"nodes": tree.Nodes(),
+	})
+}
+
+// GetDigestsController 返回 Merkle 树一个叶子上所有 key 的摘要
+func GetDigestsController(ctx *gin.Context) {
+	if replicas.n < 2 {
+		respondError(ctx, CodeFeatureDisabled, "replication is not enabled.")
+		return
+	}
+
+	bucket, err := strconv.Atoi(ctx.Param("bucket"))
+	if err != nil || bucket < 0 || bucket >= cluster.MerkleLeaves {
+		respondError(ctx, CodeBadRequest, "invalid merkle tree bucket.")
+		return
+	}
+
+	node := ctx.Query("node")
+	keys := make([]KeyDigest, 0)
+	err = storage.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if cluster.Bucket(key) == bucket && sharedWith(key, node) {
+			keys = append(keys, KeyDigest{Key: key, CreatedAt: seg.CreatedAt, Digest: segmentDigest(seg)})
+		}
+		return true
+	})
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"keys": keys,
+	})
+}
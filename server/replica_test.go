@@ -0,0 +1,246 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/cluster"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// fakeReplica 模拟另外一个副本节点，记录收到的写操作
+type fakeReplica struct {
+	mu       sync.Mutex
+	up       bool
+	ops      map[string]vfs.OpKind
+	routes   []byte
+	segments map[string][]byte
+}
+
+func (f *fakeReplica) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.up {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/replica/merkle":
+		_ = json.NewEncoder(w).Encode(map[string]any{"nodes": cluster.NewMerkleTree().Nodes()})
+	case strings.HasPrefix(r.URL.Path, "/replica/digests/"):
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	case r.URL.Path == "/admin/routes":
+		f.routes, _ = io.ReadAll(r.Body)
+	case strings.HasPrefix(r.URL.Path, "/replica/segments/"):
+		payload, ok := f.segments[strings.TrimPrefix(r.URL.Path, "/replica/segments/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(payload)
+	default:
+		body, _ := io.ReadAll(r.Body)
+		var op vfs.Operation
+		if msgpack.Unmarshal(body, &op) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.ops[op.Key] = op.Kind
+	}
+}
+
+func (f *fakeReplica) received() map[string]vfs.OpKind {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ops := make(map[string]vfs.OpKind, len(f.ops))
+	for key, kind := range f.ops {
+		ops[key] = kind
+	}
+	return ops
+}
+
+func TestReplication(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	replica := &fakeReplica{ops: make(map[string]vfs.OpKind), segments: make(map[string][]byte)}
+	remote := httptest.NewServer(replica)
+	defer remote.Close()
+
+	self, other := "127.0.0.1:1", strings.TrimPrefix(remote.URL, "http://")
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	hs := new(HttpServer)
+	hs.SetCluster(self, []string{self, other}, 0, false)
+	hs.SetReplicas(2, 3, 0)
+	assert.NoError(t, startReplication(fss))
+	defer func() {
+		stopReplication()
+		fss.SetReplicator(nil)
+		storage = old
+		ready.Store(wasReady)
+		shards.ring, shards.proxies = nil, nil
+		replicas.n, replicas.peers = 0, nil
+	}()
+
+	put := func(key, content string) {
+		seg, err := vfs.NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 副本节点不可用时写操作暂存到 hints 文件，超出上限时丢弃最旧的
+	hints := filepath.Join(fss.GetDirectory(), "hints", strings.ReplaceAll(other, ":", "_")+".hints")
+	for _, key := range []string{"user:1", "user:2", "user:3", "user:4"} {
+		put(key, "hello")
+	}
+	assert.Eventually(t, func() bool { return fileExists(hints) }, 3*time.Second, 10*time.Millisecond)
+	assert.Empty(t, replica.received())
+
+	h, err := openHandoff(filepath.Dir(hints), other)
+	assert.NoError(t, err)
+	assert.True(t, h.down)
+	assert.LessOrEqual(t, len(h.pending), 3)
+
+	// 节点恢复之后按顺序发送暂存的写操作
+	replica.mu.Lock()
+	replica.up = true
+	replica.mu.Unlock()
+
+	replicas.peers[other].deliver()
+	assert.NoError(t, fss.DeleteSegment("user:4"))
+	assert.Eventually(t, func() bool {
+		ops := replica.received()
+		return ops["user:2"] == vfs.OpPut && ops["user:3"] == vfs.OpPut && ops["user:4"] == vfs.OpDelete
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, replica.received(), "user:1")
+	assert.Eventually(t, func() bool { return !fileExists(hints) }, 3*time.Second, 10*time.Millisecond)
+
+	// 反熵修复把对方缺少的 key 推送过去
+	repaired, err := repairReplica(fss, other)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, repaired)
+	assert.Eventually(t, func() bool {
+		_, ok := replica.received()["user:1"]
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+
+	request := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", mimeMsgPack)
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set(forwardedHeader, other)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "/replica/merkle?node="+other, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tree struct {
+		Nodes []uint64 `json:"nodes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tree))
+	local, err := buildMerkleTree(fss, other)
+	assert.NoError(t, err)
+	assert.Equal(t, local.Nodes(), tree.Nodes)
+
+	w = request(http.MethodGet, "/replica/digests/1024?node="+other, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodGet, "/replica/digests/"+strconv.Itoa(cluster.Bucket("user:1"))+"?node="+other, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"key":"user:1"`)
+
+	// 应用其他节点复制过来的写操作，本地更新的版本不会被覆盖
+	replicate := func(kind vfs.OpKind, key string, seg *vfs.Segment) *httptest.ResponseRecorder {
+		payload, err := msgpack.Marshal(&vfs.Operation{Kind: kind, Key: key, Segment: seg})
+		assert.NoError(t, err)
+		return request(http.MethodPost, "/replica", payload)
+	}
+
+	outdated, err := vfs.NewSegment("user:1", types.NewText("outdated"), 0)
+	assert.NoError(t, err)
+	newer, err := vfs.NewSegment("user:1", types.NewText("newer"), 0)
+	assert.NoError(t, err)
+
+	w = replicate(vfs.OpPut, "user:1", newer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = replicate(vfs.OpPut, "user:1", outdated)
+	assert.Contains(t, w.Body.String(), "outdated")
+
+	_, seg, err := fss.FetchSegment("user:1")
+	assert.NoError(t, err)
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "newer", text.Content)
+
+	w = replicate(vfs.OpDelete, "user:1", vfs.NewTombstoneSegment("user:1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, _, err = fss.FetchSegment("user:1")
+	assert.Error(t, err)
+
+	w = request(http.MethodPost, "/replica", []byte("invalid"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 本地记录损坏时从其他副本读取记录修复
+	w = request(http.MethodGet, "/replica/segments/user:2", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	replica.mu.Lock()
+	replica.segments["user:2"] = w.Body.Bytes()
+	replica.mu.Unlock()
+
+	seg, err = repairFromReplica("user:2")
+	assert.NoError(t, err)
+	text, err = seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", text.Content)
+
+	_, err = repairFromReplica("user:1")
+	assert.Error(t, err)
+
+	w = request(http.MethodGet, "/replica/segments/user:1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// key 的 revision 是最后一次写入的 LSN，读取时通过 ETag 返回，写入时通过 If-Match 传回，
+// 读取之后被其他客户端修改过的 key 返回 412，客户端重新读取之后重试，不会覆盖别人的修改
+var (
+	errRevisionMismatch = errors.New("revision does not match the current revision of the key")
+	errInvalidRevision  = errors.New("If-Match must be a revision returned in ETag")
+)
+
+// setRevision 在响应头中返回 Segment 的 revision，通过复制日志写入的 Segment 没有本地的 LSN
+func setRevision(ctx *gin.Context, seg *vfs.Segment) {
+	if seg.LSN > 0 {
+		ctx.Header("ETag", strconv.Quote(strconv.FormatUint(seg.LSN, 10)))
+	}
+}
+
+// ifMatch 解析 If-Match 请求头中的 revision，没有请求头时 ok 为 false
+func ifMatch(ctx *gin.Context) (revision uint64, ok bool, err error) {
+	value := strings.TrimSpace(ctx.GetHeader("If-Match"))
+	if value == "" {
+		return 0, false, nil
+	}
+
+	revision, err = strconv.ParseUint(strings.Trim(value, `"`), 10, 64)
+	if err != nil {
+		return 0, false, errInvalidRevision
+	}
+	return revision, true, nil
+}
+
+// currentRevision 返回 key 当前的 revision 和 MVCC 版本号，key 不存在时返回 errRevisionMismatch
+func currentRevision(ctx *gin.Context, key string) (uint64, uint64, error) {
+	version, current, err := storage.FetchSegmentContext(ctx.Request.Context(), key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return 0, 0, errRevisionMismatch
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	lsn := current.LSN
+	utils.ReleaseToPool(current)
+	return lsn, version, nil
+}
+
+// putRevision 写入 Segment 并返回写入之后的 MVCC 版本号，请求带有 If-Match 时只有 key 当前的 revision 相同才写入
+func putRevision(ctx *gin.Context, key string, seg *vfs.Segment) (uint64, error) {
+	revision, ok, err := ifMatch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return putSegment(ctx.Request.Context(), key, seg)
+	}
+
+	lsn, version, err := currentRevision(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if lsn != revision {
+		return 0, errRevisionMismatch
+	}
+
+	// 读取和写入之间 key 被修改时版本号已经变化，CAS 失败
+	err = storeSegment(ctx.Request.Context(), key, seg, version, true)
+	if errors.Is(err, vfs.ErrVersionConflict) {
+		return 0, errRevisionMismatch
+	}
+	return version + 1, err
+}
+
+// matchRevision 检查修改元素的请求中的 If-Match，没有请求头时直接返回 true，不匹配时返回响应。
+// 调用方必须已经持有 key 的锁，并且读取之后使用 CAS 写回，检查之后 key 被整体覆盖时 CAS 失败
+func matchRevision(ctx *gin.Context, key string) bool {
+	revision, ok, err := ifMatch(ctx)
+	if err == nil && ok {
+		var lsn uint64
+		lsn, _, err = currentRevision(ctx, key)
+		if err == nil && lsn != revision {
+			err = errRevisionMismatch
+		}
+	}
+	if err != nil {
+		putFailed(ctx, err)
+		return false
+	}
+	return true
+}
+
+// putSucceed 返回写入之后 key 的 MVCC 版本号和 LSN，客户端可以用版本号继续发起条件写入，
+// 或者等待副本的 LSN 追上之后再读取，通过复制日志写入的 Segment 没有本地的 LSN
+func putSucceed(ctx *gin.Context, version uint64, seg *vfs.Segment) {
+	setRevision(ctx, seg)
+
+	body := gin.H{
+		"message": "request processed succeed.",
+		"version": version,
+	}
+	if seg.LSN > 0 {
+		body["lsn"] = seg.LSN
+	}
+	ctx.JSON(http.StatusCreated, body)
+}
+
+// putFailed 根据写入失败的原因返回响应，版本不匹配返回 412，If-Match 格式错误返回 400
+func putFailed(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errRevisionMismatch):
+		failed(ctx, CodeRevisionMismatch, err)
+	case errors.Is(err, errInvalidRevision):
+		failed(ctx, CodeBadRequest, err)
+	default:
+		storageFailed(ctx, CodeInternal, err)
+	}
+}
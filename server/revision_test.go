@@ -0,0 +1,136 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevision(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, revision, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		if revision != "" {
+			req.Header.Set("If-Match", revision)
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	// key 不存在时带有 If-Match 的写入失败
+	w := request(http.MethodPut, "/collection/list", `"1"`, `{"collection": [1]}`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = request(http.MethodPut, "/collection/list", "", `{"collection": [1]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := w.Header().Get("ETag")
+	assert.NotEmpty(t, created)
+
+	w = request(http.MethodGet, "/collection/list", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, created, w.Header().Get("ETag"))
+
+	// 两个客户端读取同一个 revision，第二个写入的客户端需要重新读取之后重试
+	w = request(http.MethodPut, "/collection/list", created, `{"collection": [1, 2]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	updated := w.Header().Get("ETag")
+	assert.NotEqual(t, created, updated)
+
+	w = request(http.MethodPut, "/collection/list", created, `{"collection": [1, 3]}`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = request(http.MethodGet, "/collection/list", "", "")
+	assert.JSONEq(t, `{"collection": [1, 2]}`, w.Body.String())
+	assert.Equal(t, updated, w.Header().Get("ETag"))
+
+	w = request(http.MethodPut, "/table/cart", "", `{"table": {"a": 1}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPut, "/table/cart", w.Header().Get("ETag"), `{"table": {"a": 2}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodPut, "/table/cart", "latest", `{"table": {"a": 3}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 写入的响应中返回新的版本号和 LSN，覆盖写和条件写入都会递增版本号
+	var result struct {
+		Version uint64 `json:"version"`
+		LSN     uint64 `json:"lsn"`
+	}
+	w = request(http.MethodPut, "/text/note", "", `{"content": "v1"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, uint64(0), result.Version)
+	assert.Equal(t, fss.LSN(), result.LSN)
+	assert.Equal(t, strconv.Quote(strconv.FormatUint(result.LSN, 10)), w.Header().Get("ETag"))
+
+	w = request(http.MethodPut, "/text/note", "", `{"content": "v2"}`)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, uint64(1), result.Version)
+
+	w = request(http.MethodGet, "/table/cart", "", "")
+	w = request(http.MethodPut, "/table/cart", w.Header().Get("ETag"), `{"table": {"a": 4}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, uint64(2), result.Version)
+
+	version, seg, err := fss.FetchSegment("cart")
+	assert.NoError(t, err)
+	assert.Equal(t, result.Version, version)
+	seg.ReleaseToPool()
+
+	// 修改元素的接口同样检查 If-Match
+	w = request(http.MethodPost, "/collection/list/push", created, `{"items": [4]}`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = request(http.MethodPost, "/collection/list/push", updated, `{"items": [4]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodPost, "/zset/board/add", `"1"`, `{"member": "alice", "score": 1}`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = request(http.MethodPost, "/zset/board/add", "", `{"member": "alice", "score": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodGet, "/zset/board", "", "")
+	revision := w.Header().Get("ETag")
+	w = request(http.MethodPost, "/zset/board/add", revision, `{"member": "bob", "score": 2}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodPost, "/zset/board/remove", revision, `{"member": "bob"}`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
@@ -0,0 +1,263 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Table 的 JSON Schema 以 Text 类型的 Segment 持久化，key 为 schema:<prefix>
+const schemaKeyPrefix = internalKeyPrefix + "schema:"
+
+// tableSchemas 是按照 key 前缀注册的 Table JSON Schema，启动时从存储中加载
+var tableSchemas = &schemaRegistry{
+	compiled: make(map[string]*jsonschema.Schema),
+}
+
+type schemaRegistry struct {
+	mu       sync.RWMutex
+	compiled map[string]*jsonschema.Schema
+}
+
+// SchemaError 是 Table 不符合 Schema 的一处错误，Path 为 Table 中对应值的 JSON Pointer
+type SchemaError struct {
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Error   string `json:"error"`
+}
+
+// compileSchema 编译 JSON Schema，不允许通过 $ref 读取本地文件或者远程的 Schema
+func compileSchema(prefix string, document []byte) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("loading schema %s is not allowed", s)
+	}
+
+	url := "urnadb://schemas/" + prefix
+	err := compiler.AddResource(url, bytes.NewReader(document))
+	if err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
+
+func (r *schemaRegistry) set(prefix string, schema *jsonschema.Schema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compiled[prefix] = schema
+}
+
+func (r *schemaRegistry) remove(prefix string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.compiled, prefix)
+}
+
+// match 返回和 key 匹配的最长前缀的 Schema
+func (r *schemaRegistry) match(key string) (string, *jsonschema.Schema) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var (
+		matched string
+		schema  *jsonschema.Schema
+	)
+	for prefix, s := range r.compiled {
+		if strings.HasPrefix(key, prefix) && (schema == nil || len(prefix) > len(matched)) {
+			matched, schema = prefix, s
+		}
+	}
+	return matched, schema
+}
+
+// loadSchemas 启动时编译存储中保存的全部 Schema
+func loadSchemas(fss *vfs.LogStructuredFS) error {
+	return fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if !strings.HasPrefix(key, schemaKeyPrefix) {
+			return true
+		}
+
+		prefix := strings.TrimPrefix(key, schemaKeyPrefix)
+		text, err := seg.ToText()
+		if err == nil {
+			var schema *jsonschema.Schema
+			schema, err = compileSchema(prefix, []byte(text.Content))
+			if err == nil {
+				tableSchemas.set(prefix, schema)
+			}
+			utils.ReleaseToPool(text)
+		}
+		if err != nil {
+			slog.Warnf("failed to load table schema of prefix %s: %v", prefix, err)
+		}
+		return true
+	})
+}
+
+// validateTable 使用和 key 匹配的 Schema 校验 Table，没有匹配的 Schema 时不校验
+func validateTable(key string, tab *types.Table) (string, []SchemaError, error) {
+	prefix, schema := tableSchemas.match(key)
+	if schema == nil {
+		return "", nil, nil
+	}
+
+	// 请求体可能是 MessagePack 或者 CBOR，统一转换成 JSON 的数据模型再校验
+	data, err := json.Marshal(tab.Table)
+	if err != nil {
+		return prefix, nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document any
+	err = decoder.Decode(&document)
+	if err != nil {
+		return prefix, nil, err
+	}
+
+	err = schema.Validate(document)
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return prefix, nil, err
+	}
+
+	result := make([]SchemaError, 0)
+	for _, e := range verr.BasicOutput().Errors {
+		// 只返回具体的错误，不返回 "doesn't validate with" 这样的汇总信息
+		if strings.HasPrefix(e.Error, "doesn't validate with") {
+			continue
+		}
+		result = append(result, SchemaError{Path: e.InstanceLocation, Keyword: e.KeywordLocation, Error: e.Error})
+	}
+	if len(result) == 0 {
+		result = append(result, SchemaError{Path: verr.InstanceLocation, Keyword: verr.KeywordLocation, Error: verr.Message})
+	}
+	return prefix, result, nil
+}
+
+// fetchSchema 读取已经注册的 Schema 文档
+func fetchSchema(prefix string) (json.RawMessage, error) {
+	_, seg, err := storage.FetchSegment(schemaKeyPrefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := seg.ToText()
+	utils.ReleaseToPool(seg)
+	if err != nil {
+		return nil, err
+	}
+
+	document := json.RawMessage(text.Content)
+	utils.ReleaseToPool(text)
+	return document, nil
+}
+
+func ListSchemasController(ctx *gin.Context) {
+	tableSchemas.mu.RLock()
+	prefixes := make([]string, 0, len(tableSchemas.compiled))
+	for prefix := range tableSchemas.compiled {
+		prefixes = append(prefixes, prefix)
+	}
+	tableSchemas.mu.RUnlock()
+
+	sort.Strings(prefixes)
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"prefixes": prefixes,
+	})
+}
+
+func GetSchemaController(ctx *gin.Context) {
+	prefix := ctx.Param("prefix")
+	document, err := fetchSchema(prefix)
+	if err != nil {
+		respondError(ctx, CodeNotFound, "schema not found.")
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"prefix": prefix,
+		"schema": document,
+	})
+}
+
+// PutSchemaController 注册 key 前缀的 Table JSON Schema，请求体为 Schema 文档，
+// 之后写入这个前缀下的 Table 都需要通过校验，已经存在的数据不受影响
+func PutSchemaController(ctx *gin.Context) {
+	prefix := ctx.Param("prefix")
+	err := validateKey(prefix)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	document, err := io.ReadAll(ctx.Request.Body)
+	if err != nil || !json.Valid(document) {
+		respondError(ctx, CodeBadRequest, "request body must be a JSON Schema document.")
+		return
+	}
+
+	schema, err := compileSchema(prefix, document)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	seg, err := vfs.AcquirePoolSegment(schemaKeyPrefix+prefix, types.NewText(string(document)), 0)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	_, err = storage.PutSegmentContext(ctx.Request.Context(), schemaKeyPrefix+prefix, seg)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	tableSchemas.set(prefix, schema)
+	requestLog(ctx).Infof("Table schema of prefix %s registered by %s", prefix, ctx.ClientIP())
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "schema registered successfully.",
+	})
+}
+
+func DeleteSchemaController(ctx *gin.Context) {
+	prefix := ctx.Param("prefix")
+	err := storage.DeleteSegmentContext(ctx.Request.Context(), schemaKeyPrefix+prefix)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	tableSchemas.remove(prefix)
+	ctx.Status(http.StatusNoContent)
+}
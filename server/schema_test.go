@@ -0,0 +1,117 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	path := t.TempDir()
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      path,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		tableSchemas.remove("user-")
+		tableSchemas.remove("user-admin-")
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/admin/schemas/user-", `{"type": "object", "required": [1]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPut, "/admin/schemas/user-", `{
+		"type": "object",
+		"required": ["name", "age"],
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodPut, "/table/user-1", `{"table": {"name": "leon", "age": 18}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 不符合 Schema 的 Table 返回每一处错误的位置
+	w = request(http.MethodPut, "/table/user-2", `{"table": {"name": 1, "age": -1}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var failed struct {
+		Errors []SchemaError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &failed))
+	paths := make([]string, 0, len(failed.Errors))
+	for _, e := range failed.Errors {
+		paths = append(paths, e.Path)
+	}
+	assert.ElementsMatch(t, []string{"/name", "/age"}, paths)
+
+	w = request(http.MethodGet, "/table/user-2", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// 没有匹配的 Schema 的 key 不校验
+	w = request(http.MethodPut, "/table/order-1", `{"table": {"name": 1}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 使用最长的前缀匹配 Schema
+	w = request(http.MethodPut, "/admin/schemas/user-admin-", `{"type": "object", "required": ["role"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodPut, "/table/user-admin-1", `{"table": {"role": "root"}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/admin/schemas", "")
+	assert.JSONEq(t, `{"prefixes": ["user-", "user-admin-"]}`, w.Body.String())
+
+	// 启动时从存储中加载已经注册的 Schema
+	tableSchemas.remove("user-")
+	tableSchemas.remove("user-admin-")
+	assert.NoError(t, loadSchemas(fss))
+	w = request(http.MethodPut, "/table/user-3", `{"table": {"name": "leon"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = request(http.MethodDelete, "/admin/schemas/user-", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = request(http.MethodGet, "/admin/schemas/user-", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request(http.MethodPut, "/table/user-3", `{"table": {"name": "leon"}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	assert.NoError(t, fss.CloseFS())
+}
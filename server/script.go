@@ -0,0 +1,432 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var scriptTimeout = 2 * time.Second
+
+// errUndeclaredKey 是脚本读写没有在 KEYS 中声明的 key 时返回的错误，
+// 只有声明的 key 在脚本执行期间被锁定，脚本对其他写入来说才是原子的
+var errUndeclaredKey = errors.New("key is not declared in KEYS")
+
+// scriptWrite 是脚本执行期间缓冲的写操作，data 为 nil 表示删除
+type scriptWrite struct {
+	key  string
+	ttl  uint64
+	data vfs.Serializable
+}
+
+// scriptRead 是脚本第一次读取 key 时的版本，提交时 key 被修改过说明脚本读到的是旧的值
+type scriptRead struct {
+	version uint64
+	exists  bool
+}
+
+// scriptTx 缓冲脚本中的写操作，脚本成功执行完毕之后才一次性写入存储，
+// 脚本执行失败或者提交到一半失败时不会留下部分写入的数据。
+type scriptTx struct {
+	ctx    context.Context
+	keys   map[string]struct{}
+	reads  map[string]scriptRead
+	writes []scriptWrite
+	index  map[string]int
+}
+
+func newScriptTx(ctx context.Context, keys []string) *scriptTx {
+	tx := &scriptTx{
+		ctx:    ctx,
+		keys:   make(map[string]struct{}, len(keys)),
+		reads:  make(map[string]scriptRead),
+		writes: make([]scriptWrite, 0),
+		index:  make(map[string]int),
+	}
+	for _, key := range keys {
+		tx.keys[key] = struct{}{}
+	}
+	return tx
+}
+
+// checkKey 检查脚本是否可以读写 key
+func (tx *scriptTx) checkKey(key string) error {
+	if _, ok := tx.keys[key]; !ok {
+		return fmt.Errorf("%w: %s", errUndeclaredKey, key)
+	}
+	return nil
+}
+
+func (tx *scriptTx) stage(w scriptWrite) error {
+	if err := tx.checkKey(w.key); err != nil {
+		return err
+	}
+	if isInternalKey(w.key) {
+		return fmt.Errorf("%w: %s", errReservedKey, w.key)
+	}
+
+	if i, ok := tx.index[w.key]; ok {
+		tx.writes[i] = w
+		return nil
+	}
+	tx.index[w.key] = len(tx.writes)
+	tx.writes = append(tx.writes, w)
+	return nil
+}
+
+// get 优先读取本次脚本中还没有提交的写入，key 不存在以外的读取错误会终止脚本
+func (tx *scriptTx) get(key string) (string, any, bool, error) {
+	if err := tx.checkKey(key); err != nil {
+		return "", nil, false, err
+	}
+
+	if i, ok := tx.index[key]; ok {
+		w := tx.writes[i]
+		if w.data == nil {
+			return "", nil, false, nil
+		}
+		value, err := serializableToValue(w.data)
+		return vfs.KindToString[vfs.KindOf(w.data)], value, true, err
+	}
+
+	version, seg, err := storage.FetchSegmentContext(tx.ctx, key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		tx.read(key, 0, false)
+		return "", nil, false, nil
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	seg, err = expandSegment(tx.ctx, seg)
+	defer utils.ReleaseToPool(seg)
+	if err != nil {
+		return "", nil, false, err
+	}
+	tx.read(key, version, true)
+
+	bytes, err := seg.ToJSON()
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	var value any
+	err = json.Unmarshal(bytes, &value)
+	return seg.GetTypeString(), value, true, err
+}
+
+func (tx *scriptTx) read(key string, version uint64, exists bool) {
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = scriptRead{version: version, exists: exists}
+	}
+}
+
+// scriptUndo 是提交之前 key 的值，提交失败时用来恢复已经写入的 key，seg 为 nil 表示 key 原来不存在
+type scriptUndo struct {
+	key string
+	seg *vfs.Segment
+}
+
+// commit 写入缓冲的写操作，脚本读取之后被整体覆盖的 key 返回 ErrVersionConflict，
+// 写入到一半失败时把已经写入的 key 恢复为原来的值
+func (tx *scriptTx) commit() error {
+	undo := make([]scriptUndo, 0, len(tx.writes))
+	defer func() {
+		for _, u := range undo {
+			if u.seg != nil {
+				utils.ReleaseToPool(u.seg)
+			}
+		}
+	}()
+
+	versions := make([]uint64, 0, len(tx.writes))
+	for _, w := range tx.writes {
+		version, seg, err := storage.FetchSegmentContext(tx.ctx, w.key)
+		if err != nil && !errors.Is(err, vfs.ErrKeyNotFound) {
+			return err
+		}
+		undo = append(undo, scriptUndo{key: w.key, seg: seg})
+		versions = append(versions, version)
+
+		read, ok := tx.reads[w.key]
+		if ok && (read.exists != (seg != nil) || read.version != version) {
+			return vfs.ErrVersionConflict
+		}
+	}
+
+	for i, w := range tx.writes {
+		err := tx.apply(w, undo[i].seg != nil, versions[i])
+		if err != nil {
+			return tx.rollback(undo[:i], err)
+		}
+	}
+
+	// 全部写入成功之后才删除被替换的列表封存的分块，回滚恢复的尾部仍然可以拼接这些分块
+	for _, w := range tx.writes {
+		err := dropQuicklist(tx.ctx, w.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *scriptTx) apply(w scriptWrite, exists bool, version uint64) error {
+	if w.data == nil {
+		if !exists {
+			return nil
+		}
+		return storage.DeleteSegmentContext(tx.ctx, w.key)
+	}
+
+	seg, err := vfs.AcquirePoolSegment(w.key, w.data, w.ttl)
+	if err != nil {
+		return err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	return storeSegment(tx.ctx, w.key, seg, version, exists)
+}
+
+// rollback 恢复已经写入的 key，不使用请求的 context，请求超时之后同样需要恢复
+func (tx *scriptTx) rollback(undo []scriptUndo, cause error) error {
+	for _, u := range undo {
+		var err error
+		if u.seg == nil {
+			err = storage.DeleteSegment(u.key)
+		} else {
+			err = storage.PutSegment(u.key, u.seg)
+		}
+		if err != nil {
+			return fmt.Errorf("%w, failed to roll back key %s: %v", cause, u.key, err)
+		}
+	}
+	return cause
+}
+
+func serializableToValue(data vfs.Serializable) (any, error) {
+	encoder, ok := data.(interface{ ToJSON() ([]byte, error) })
+	if !ok {
+		return nil, fmt.Errorf("unsupported value type %T", data)
+	}
+
+	bytes, err := encoder.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	err = json.Unmarshal(bytes, &value)
+	return value, err
+}
+
+// newLuaState 创建一个受限的 Lua 虚拟机，只开放基础库、字符串、表和数学库
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// 去掉可以访问文件系统的基础函数
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// runScript 在受限的 Lua 虚拟机中执行脚本，
+// 通过全局的 urna 表暴露 get/put/del 接口，KEYS 和 ARGV 为调用时传入的参数，脚本只能读写 KEYS 中的 key。
+func runScript(ctx context.Context, source string, keys []string, args []any) (any, error) {
+	// 锁定脚本声明的全部 key，读改写接口和其他脚本不会看到脚本执行到一半的状态
+	unlock := storage.LockKeys(keys...)
+	defer unlock()
+
+	L := newLuaState()
+	defer L.Close()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, scriptTimeout)
+	defer cancel()
+	L.SetContext(timeoutCtx)
+
+	tx := newScriptTx(ctx, keys)
+	L.SetGlobal("urna", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get": func(L *lua.LState) int {
+			kind, value, ok, err := tx.get(L.CheckString(1))
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+				return 0
+			}
+			if !ok {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(toLuaValue(L, value))
+			L.Push(lua.LString(kind))
+			return 2
+		},
+		"put": func(L *lua.LState) int {
+			kind, key := L.CheckString(1), L.CheckString(2)
+			ttl := L.OptInt64(4, 0)
+			if ttl < 0 {
+				L.RaiseError("ttl must be a non-negative integer")
+				return 0
+			}
+			data, err := decodeValue(kind, fromLuaValue(L.CheckAny(3)))
+			if err == nil {
+				err = tx.stage(scriptWrite{key: key, ttl: uint64(ttl), data: data})
+			}
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			return 0
+		},
+		"del": func(L *lua.LState) int {
+			err := tx.stage(scriptWrite{key: L.CheckString(1)})
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			return 0
+		},
+	}))
+
+	L.SetGlobal("KEYS", toLuaValue(L, toAnySlice(keys)))
+	L.SetGlobal("ARGV", toLuaValue(L, args))
+
+	err := L.DoString(source)
+	if err != nil {
+		return nil, err
+	}
+
+	result := fromLuaValue(L.Get(-1))
+
+	err = tx.commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit script writes: %w", err)
+	}
+
+	return result, nil
+}
+
+func toAnySlice(values []string) []any {
+	result := make([]any, 0, len(values))
+	for _, v := range values {
+		result = append(result, v)
+	}
+	return result
+}
+
+// toLuaValue 把 JSON 解码得到的 Go 值转换为 Lua 值，数组转换为从 1 开始的序列表
+func toLuaValue(L *lua.LState, value any) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case []any:
+		table := L.NewTable()
+		for _, item := range v {
+			table.Append(toLuaValue(L, item))
+		}
+		return table
+	case map[string]any:
+		table := L.NewTable()
+		for key, item := range v {
+			table.RawSetString(key, toLuaValue(L, item))
+		}
+		return table
+	}
+	return lua.LString(fmt.Sprint(value))
+}
+
+// fromLuaValue 把 Lua 值转换为 Go 值，键为连续整数的表转换为数组，其他表转换为 map
+func fromLuaValue(value lua.LValue) any {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 {
+			array := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				array = append(array, fromLuaValue(v.RawGetInt(i)))
+			}
+			return array
+		}
+
+		object := make(map[string]any)
+		v.ForEach(func(key, item lua.LValue) {
+			object[key.String()] = fromLuaValue(item)
+		})
+		return object
+	}
+	return value.String()
+}
+
+func EvalController(ctx *gin.Context) {
+	var body struct {
+		Script string   `json:"script" binding:"required"`
+		Keys   []string `json:"keys"`
+		Args   []any    `json:"args"`
+	}
+
+	err := ctx.ShouldBindJSON(&body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	result, err := runScript(ctx.Request.Context(), body.Script, body.Keys, body.Args)
+	if err != nil {
+		failed(ctx, CodeScriptError, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"result": result,
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLuaValueConversion(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	value := map[string]any{
+		"name": "urnadb",
+		"tags": []any{"kv", "log"},
+		"size": float64(3),
+		"ok":   true,
+	}
+
+	assert.Equal(t, value, fromLuaValue(toLuaValue(L, value)))
+	assert.Nil(t, fromLuaValue(toLuaValue(L, nil)))
+}
+
+func TestDecodeValue(t *testing.T) {
+	data, err := decodeValue("set", []any{"a", "b"})
+	assert.NoError(t, err)
+	assert.True(t, data.(*types.Set).Contains("a"))
+
+	data, err = decodeValue("number", float64(42))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), data.(*types.Number).Get())
+
+	_, err = decodeValue("number", "abc")
+	assert.Error(t, err)
+
+	_, err = decodeValue("queue", []any{})
+	assert.Error(t, err)
+}
+
+func TestRunScript(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old := storage
+	storage = fss
+	defer func() { storage = old }()
+
+	result, err := runScript(context.Background(), `
+		urna.put("number", KEYS[1], ARGV[1])
+		local value, kind = urna.get(KEYS[1])
+		return {value = value, kind = kind}
+	`, []string{"counter"}, []any{float64(7)})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"value": float64(7), "kind": "number"}, result)
+
+	_, seg, err := fss.FetchSegment("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, "number", seg.GetTypeString())
+
+	// 脚本出错时缓冲的写操作不会被提交
+	_, err = runScript(context.Background(), `
+		urna.del(KEYS[1])
+		error("boom")
+	`, []string{"counter"}, nil)
+	assert.Error(t, err)
+
+	_, _, err = fss.FetchSegment("counter")
+	assert.NoError(t, err)
+
+	// 只能读写 KEYS 中声明的 key，TTL 不能是负数
+	_, err = runScript(context.Background(), `urna.get("counter")`, nil, nil)
+	assert.ErrorContains(t, err, errUndeclaredKey.Error())
+	_, err = runScript(context.Background(), `urna.put("number", KEYS[1], 1, -1)`, []string{"counter"}, nil)
+	assert.Error(t, err)
+
+	// 提交到一半失败时已经写入的 key 被恢复，原来不存在的 key 被删除
+	_, original, err := fss.FetchSegment("counter")
+	assert.NoError(t, err)
+	_, err = runScript(context.Background(), `
+		urna.put("number", KEYS[1], 8)
+		urna.put("number", KEYS[2], 9)
+	`, []string{"counter", "created"}, nil)
+	assert.NoError(t, err)
+
+	tx := newScriptTx(context.Background(), nil)
+	cause := errors.New("boom")
+	err = tx.rollback([]scriptUndo{{key: "counter", seg: original}, {key: "created"}}, cause)
+	assert.Equal(t, cause, err)
+
+	_, seg, err = fss.FetchSegment("counter")
+	assert.NoError(t, err)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), number.Get())
+	_, _, err = fss.FetchSegment("created")
+	assert.ErrorIs(t, err, vfs.ErrKeyNotFound)
+
+	// 沙箱中不允许访问文件系统
+	_, err = runScript(context.Background(), `dofile("/etc/passwd")`, nil, nil)
+	assert.Error(t, err)
+}
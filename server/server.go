@@ -18,18 +18,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net"
 	"net/http"
-	"strconv"
+	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/auula/urnadb/clog"
+	"github.com/auula/urnadb/cluster"
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/consensus"
+	"github.com/auula/urnadb/utils"
 	"github.com/auula/urnadb/vfs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 var (
 	// ipv4 return local IPv4 address
 	ipv4 string = "127.0.0.1"
+	// slog server 模块日志记录器
+	slog = clog.Module("server")
 )
 
 const (
@@ -42,13 +52,13 @@ func init() {
 	// Initialized local server ip address
 	addrs, err := net.Interfaces()
 	if err != nil {
-		clog.Errorf("get server IPv4 address failed: %s", err)
+		slog.Errorf("get server IPv4 address failed: %s", err)
 	}
 
 	for _, face := range addrs {
 		adders, err := face.Addrs()
 		if err != nil {
-			clog.Errorf("get server IPv4 address failed: %s", err)
+			slog.Errorf("get server IPv4 address failed: %s", err)
 		}
 
 		for _, addr := range adders {
@@ -63,13 +73,29 @@ func init() {
 }
 
 type HttpServer struct {
-	serv *http.Server
-	port int
+	serv   *http.Server
+	port   int
+	binds  []conf.BindAddr
+	socket socketOwner
+	// inherited 是升级时从旧进程继承的监听地址，listeners 是正在接受连接的监听地址
+	inherited []net.Listener
+	mu        sync.Mutex
+	listeners []net.Listener
 }
 
 type Options struct {
 	Port int
-	Auth string
+	// Bind 是 conf.ServerOptions.Listeners 返回的监听地址，为空时监听全部网卡
+	Bind []conf.BindAddr
+	// Listeners 是升级时通过 InheritListeners 从旧进程继承的监听地址，不为空时不再打开 Bind 中的地址
+	Listeners []net.Listener
+	// SocketMode 和 SocketGroup 是 Unix socket 文件的权限和所属的用户组，
+	// SocketMode 为 0 时使用 0660，SocketGroup 为空时不修改
+	SocketMode  fs.FileMode
+	SocketGroup string
+	Auth        string
+	// Timeout 是数据请求的最长处理时间，为 0 时不限制
+	Timeout time.Duration
 	// CertMagic *tls.Config
 }
 
@@ -83,14 +109,32 @@ func New(opt *Options) (*HttpServer, error) {
 		authPassword = opt.Auth
 	}
 
+	binds := opt.Bind
+	if len(opt.Listeners) > 0 {
+		binds = inheritedBinds(opt.Listeners)
+	} else if len(binds) == 0 {
+		binds, _ = conf.ResolveBind(nil, opt.Port)
+	}
+
+	owner, err := newSocketOwner(opt.SocketMode, opt.SocketGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	requestTimeout = opt.Timeout
+
+	// 写超时需要在请求超时之后留出返回 504 响应的时间
 	hs := HttpServer{
 		serv: &http.Server{
 			Handler:      root,
-			Addr:         net.JoinHostPort("0.0.0.0", strconv.Itoa(opt.Port)),
-			WriteTimeout: timeout,
+			ConnContext:  markLocalConn,
+			WriteTimeout: timeout + requestTimeout,
 			ReadTimeout:  timeout,
 		},
-		port: opt.Port,
+		port:      opt.Port,
+		binds:     binds,
+		socket:    owner,
+		inherited: opt.Listeners,
 	}
 
 	// 开启 HTTP Keep-Alive 长连接
@@ -99,12 +143,241 @@ func New(opt *Options) (*HttpServer, error) {
 	return &hs, nil
 }
 
+// SetupFS 设置存储系统，之后服务才会变为就绪状态开始处理数据请求
 func (hs *HttpServer) SetupFS(fss *vfs.LogStructuredFS) {
 	storage = fss
+	namespaceSeparator = fss.Separator()
+	if len(quotas) > 0 && namespaceSeparator == "" {
+		slog.Warnf("namespace quotas are disabled without the key prefix separator")
+	}
+
+	err := loadSchemas(fss)
+	if err != nil {
+		slog.Warnf("failed to load table schemas: %v", err)
+	}
+
+	err = loadTransforms(fss)
+	if err != nil {
+		slog.Warnf("failed to load transforms: %v", err)
+	}
+
+	if analyticsEnabled {
+		ks, err := loadKeyspace(fss)
+		if err != nil {
+			slog.Warnf("failed to load keyspace analytics: %v", err)
+		} else {
+			analytics = ks
+		}
+	}
+
+	if shards.ring != nil {
+		err := loadRoutes(fss.GetDirectory())
+		if err != nil {
+			slog.Warnf("failed to load cluster routes: %v", err)
+		}
+	}
+
+	err = loadHooks(fss)
+	if err != nil {
+		slog.Warnf("failed to load hooks: %v", err)
+	}
+
+	err = loadProcedures(fss)
+	if err != nil {
+		slog.Warnf("failed to load stored procedures: %v", err)
+	}
+
+	// 写入钩子同时负责键空间统计、迁移期间的写入转发和投递钩子事件，钩子可以在运行期间注册
+	fss.SetWriteHook(observeWrite)
+
+	if replicas.n > 1 && shards.ring != nil {
+		err := startReplication(fss)
+		if err != nil {
+			slog.Errorf("failed to start replication: %v", err)
+		}
+	}
+
+	if sink.producer != nil && sink.cancel == nil {
+		err := startSink(fss)
+		if err != nil {
+			slog.Errorf("failed to start kafka sink: %v", err)
+		}
+	}
+
+	if len(quotas) > 0 && namespaceSeparator != "" && quotaSweepStop == nil {
+		quotaSweepStop = make(chan struct{})
+		go runQuotaSweep(quotaSweepStop)
+	}
+
+	if diskWatermark > 0 && diskGuardStop == nil {
+		diskGuardStop = make(chan struct{})
+		go runDiskGuard(fss.GetDirectory(), diskGuardStop)
+	}
+
+	ready.Store(true)
+}
+
+// SetAnalytics 设置是否开启键空间分析，必须在 SetupFS 之前调用
+func (hs *HttpServer) SetAnalytics(enable bool) {
+	analyticsEnabled = enable
+}
+
+// SetLeakDetection 开启或者关闭对象池的泄漏检测，借出的对象没有归还就被回收时输出警告日志
+func (hs *HttpServer) SetLeakDetection(enable bool) {
+	if !enable {
+		utils.SetLeakDetection(nil)
+		return
+	}
+	utils.SetLeakDetection(func(pool string) {
+		slog.Warnf("Object of pool %s was garbage collected without ReleaseToPool", pool)
+	})
 }
 
+// SetDiskGuard 设置磁盘剩余空间水位线和检查间隔，必须在 SetupFS 之前调用
+func (hs *HttpServer) SetDiskGuard(watermark uint64, interval time.Duration) {
+	diskWatermark = watermark
+	if interval > 0 {
+		diskInterval = interval
+	}
+}
+
+// SetCluster 开启集群模式，self 为本节点在 nodes 中的地址，
+// redirect 为 true 时返回 307 重定向，否则由本节点代理转发到负责 key 的节点
+func (hs *HttpServer) SetCluster(self string, nodes []string, vnodes int, redirect bool) {
+	shards.ring = cluster.NewRing(nodes, vnodes)
+	shards.self = self
+	shards.redirect = redirect
+	shards.proxies = make(map[string]*httputil.ReverseProxy, len(nodes))
+	for _, node := range shards.ring.Nodes() {
+		if node != self {
+			shards.proxies[node] = newNodeProxy(node)
+		}
+	}
+}
+
+// SetReplicas 在集群模式下把每个 key 保存到 n 个节点上，必须在 SetCluster 之后、SetupFS 之前调用，
+// maxHints 为副本节点不可用时每个节点最多暂存的写操作数量，repair 为反熵修复的间隔，0 表示不修复
+func (hs *HttpServer) SetReplicas(n, maxHints int, repair time.Duration) {
+	replicas.n = n
+	replicas.maxHints = maxHints
+	if maxHints <= 0 {
+		replicas.maxHints = defaultMaxHints
+	}
+	replicas.repair = repair
+}
+
+// SetRaft 开启 raft 复制模式，follower 收到的写请求会转发给 leader，
+// 存储系统需要通过 SetReplicator 把写操作交给同一个 node
+func (hs *HttpServer) SetRaft(node *consensus.Node) {
+	replication.node = node
+}
+
+// SetConsole 开启 /console 管理控制台，token 为访问管理接口的管理员 Token
+func (hs *HttpServer) SetConsole(token string) {
+	adminToken = token
+}
+
+// SetCORS 允许 origins 中的来源跨域访问，origins 为空时关闭
+func (hs *HttpServer) SetCORS(origins, methods, headers []string, credentials bool, maxAge int) {
+	if len(origins) == 0 {
+		corsRules.Store(nil)
+		return
+	}
+	corsRules.Store(newCORSPolicy(origins, methods, headers, credentials, maxAge))
+}
+
+// SetSession 开启 /auth/login 签发会话令牌，令牌在 ttl 之后过期，ttl 为 0 时关闭
+func (hs *HttpServer) SetSession(ttl time.Duration) {
+	sessionTTL.Store(int64(ttl))
+}
+
+// SetCompression 开启 JSON 响应压缩，响应体超过 threshold 字节时按照 Accept-Encoding 使用 zstd 或者 gzip 压缩
+func (hs *HttpServer) SetCompression(threshold int) {
+	compressThreshold = threshold
+}
+
+// SetAccessLog 开启或者关闭访问日志，sample 是成功的请求写入访问日志的比例，失败的请求总是写入
+func (hs *HttpServer) SetAccessLog(enable bool, sample float64) {
+	setAccessLog(enable, sample)
+}
+
+// SetBulkhead 限制扫描请求和管理请求的并发数量，超过并发数量的请求最多 queue 个排队等待 wait 时间，
+// 排队已满或者等待超时返回 429，enable 为 false 时不限制
+func (hs *HttpServer) SetBulkhead(enable bool, scan, admin, queue int, wait time.Duration) {
+	if !enable {
+		setBulkheads(nil, 0, 0)
+		return
+	}
+	setBulkheads(map[string]int{bulkheadScan: scan, bulkheadAdmin: admin}, queue, wait)
+}
+
+// SetSwagger 设置是否开启 /swagger 接口文档页面
+func (hs *HttpServer) SetSwagger(enable bool) {
+	swaggerEnabled = enable
+}
+
+// SetTracing 开启 OpenTelemetry 链路追踪，通过 OTLP HTTP 协议导出到 endpoint，
+// ratio 为根 span 的采样比例，必须在 Startup 之前调用
+func (hs *HttpServer) SetTracing(endpoint string, insecure bool, ratio float64) error {
+	tp, err := newTracerProvider(endpoint, insecure, ratio)
+	if err != nil {
+		return fmt.Errorf("failed to create otlp trace exporter: %w", err)
+	}
+
+	tracerProvider = tp
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	return nil
+}
+
+// SetRecoveryProgress 设置存储系统启动恢复的进度，通过 /readyz 接口对外暴露
+func (hs *HttpServer) SetRecoveryProgress(progress *vfs.RecoveryProgress) {
+	recovery = progress
+}
+
+// SetQuota 设置命名空间的 key 数量和磁盘字节数配额，必须在 SetupFS 之前调用
+func (hs *HttpServer) SetQuota(namespace string, maxKeys, maxBytes int64) {
+	quotas[namespace] = &namespaceQuota{
+		maxKeys:  maxKeys,
+		maxBytes: maxBytes,
+	}
+}
+
+// SetConfigHistory 开启 /admin/config 管理接口，修改的配置通过 apply 应用到运行中的服务器
+func (hs *HttpServer) SetConfigHistory(history *conf.History, apply conf.ApplyFunc) {
+	configs.history = history
+	configs.apply = apply
+}
+
+// SetAllowIP 设置客户端 IP 白名单，可以是 IP 地址或者 CIDR 网段，空列表关闭白名单
 func (hs *HttpServer) SetAllowIP(allowd []string) {
-	allowIpList = allowd
+	setAllowList(allowd)
+}
+
+// SetLimits 设置 key 的最大长度和每种类型请求体的最大大小，0 值保持默认限制
+func (hs *HttpServer) SetLimits(keySize int, valueSize map[string]int64) {
+	if keySize > 0 {
+		maxKeySize = keySize
+	}
+	for kind, size := range valueSize {
+		if size > 0 {
+			maxValueSize[kind] = size
+		}
+	}
+}
+
+// SetStrictTypes 设置 PUT 已经存在的其他类型的 key 时是否默认返回 409
+func (hs *HttpServer) SetStrictTypes(strict bool) {
+	strictTypes.Store(strict)
+}
+
+// SetPubSub 设置是否把发布的消息持久化为 Collection，以及每个频道保留的历史消息数量
+func (hs *HttpServer) SetPubSub(persist bool, history int) {
+	pubsub.persist = persist
+	pubsub.history = history
 }
 
 func (hs *HttpServer) Port() int {
@@ -116,22 +389,69 @@ func (hs *HttpServer) IPv4() string {
 	return ipv4
 }
 
-// Startup blocking goroutine
+// Binds 返回服务器的全部监听地址
+func (hs *HttpServer) Binds() []conf.BindAddr {
+	return hs.binds
+}
+
+// Startup blocking goroutine，可以在 SetupFS 之前启动，
+// 存储系统就绪之前数据请求会返回 503
 func (hs *HttpServer) Startup() error {
-	if storage == nil {
-		return errors.New("file storage system is not initialized")
+	// 先打开全部监听地址，任何一个地址不能监听时都不启动，升级时直接使用继承的监听地址
+	listeners := hs.inherited
+	if len(listeners) == 0 {
+		listeners = make([]net.Listener, 0, len(hs.binds))
+		for _, bind := range hs.binds {
+			ln, err := listen(bind, hs.socket)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return fmt.Errorf("failed to start http api server :%w", err)
+			}
+			listeners = append(listeners, ln)
+		}
 	}
 
-	// 这个函数是一个阻塞函数
-	err := hs.serv.ListenAndServe()
-	if err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("failed to start http api server :%w", err)
+	hs.mu.Lock()
+	hs.listeners = listeners
+	hs.mu.Unlock()
+
+	// 这个函数是一个阻塞函数，Shutdown 之后全部监听地址都会返回 http.ErrServerClosed
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- hs.serv.Serve(ln)
+		}(ln)
 	}
 
-	return nil
+	var first error
+	for range listeners {
+		err := <-errs
+		if err != nil && err != http.ErrServerClosed && first == nil {
+			first = fmt.Errorf("failed to start http api server :%w", err)
+			_ = hs.serv.Close()
+		}
+	}
+	return first
 }
 
 func (hs *HttpServer) Shutdown() error {
+	// 先断开所有订阅者的长连接，否则 Shutdown 会一直等待
+	pubsub.closeAll()
+
+	stopReplication()
+
+	if diskGuardStop != nil {
+		close(diskGuardStop)
+		diskGuardStop = nil
+	}
+
+	if quotaSweepStop != nil {
+		close(quotaSweepStop)
+		quotaSweepStop = nil
+	}
+
 	// 先关闭 http 服务器停止接受数据请求
 	err := hs.serv.Shutdown(context.Background())
 	if err != nil && err != http.ErrServerClosed {
@@ -142,14 +462,32 @@ func (hs *HttpServer) Shutdown() error {
 		}
 		return err
 	}
-	return closeStorage()
+	return errors.Join(closeStorage(), shutdownTracing())
 }
 
 func closeStorage() error {
+	// raft 节点还会继续应用日志，需要在关闭文件系统之前停止
+	if replication.node != nil {
+		err := replication.node.Close()
+		replication.node = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	// 没有发送的写入在下一次启动之后从保存的位置继续发送
+	err := stopSink()
+	if err != nil {
+		slog.Warnf("failed to close kafka producer: %v", err)
+	}
+
 	if storage != nil {
 		// 先停止垃圾回收线程和检查点生成线程
 		storage.StopCheckpoint()
 		storage.StopCompactRegion()
+		storage.StopTiering()
+		storage.StopBackup()
+		storage.StopTrashPurge()
 		err := storage.CloseFS()
 		if err != nil {
 			return err
@@ -53,7 +53,10 @@ func TestHttpServer_Port(t *testing.T) {
 
 // 测试 Startup 方法（非阻塞）
 func TestHttpServer_Startup(t *testing.T) {
-	conf.Settings.Path = "./_temp/"
+	path := conf.Settings.Path
+	conf.Settings.Path = t.TempDir()
+	t.Cleanup(func() { conf.Settings.Path = path })
+
 	server, err := New(&Options{Port: 8081})
 	assert.NoError(t, err)
 
@@ -0,0 +1,224 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	loginPath  = "/auth/login"
+	logoutPath = "/auth/logout"
+)
+
+// 会话接口由每个节点自己处理，不转发给 leader，注销的令牌只在收到请求的节点上失效
+var sessionPaths = map[string]bool{
+	loginPath:  true,
+	logoutPath: true,
+}
+
+// 会话令牌的有效期，为 0 时不开启 /auth/login，只能使用 Auth-Token 密码访问
+var sessionTTL atomic.Int64
+
+// HS256 的 JWT 头部是固定的，只接受这一种算法
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var errInvalidSession = errors.New("session token is invalid or expired")
+
+type sessionClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// 注销的令牌在过期之前都保存在内存中，jti 对应令牌的过期时间，重启之后列表清空
+var (
+	revokedMu sync.Mutex
+	revoked   = make(map[string]int64)
+)
+
+// sessionKey 从 auth 密码派生签名密钥，修改密码之后已经签发的令牌全部失效
+func sessionKey() []byte {
+	sum := sha256.Sum256([]byte("urnadb-session:" + authPassword))
+	return sum[:]
+}
+
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueSession 签发一个 ttl 之后过期的令牌
+func issueSession(ttl time.Duration) (string, *sessionClaims, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	claims := &sessionClaims{
+		Subject:   "urnadb",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        hex.EncodeToString(buf),
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signSession(payload), claims, nil
+}
+
+// parseSession 校验令牌的签名、过期时间和注销列表
+func parseSession(token string) (*sessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidSession
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(signSession(parts[0]+"."+parts[1]))) {
+		return nil, errInvalidSession
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidSession
+	}
+
+	var claims sessionClaims
+	err = json.Unmarshal(data, &claims)
+	if err != nil || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errInvalidSession
+	}
+
+	revokedMu.Lock()
+	_, ok := revoked[claims.ID]
+	revokedMu.Unlock()
+	if ok {
+		return nil, errInvalidSession
+	}
+
+	return &claims, nil
+}
+
+// revokeSession 注销令牌，同时清理已经过期的注销记录
+func revokeSession(claims *sessionClaims) {
+	now := time.Now().Unix()
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+
+	for id, exp := range revoked {
+		if now >= exp {
+			delete(revoked, id)
+		}
+	}
+	revoked[claims.ID] = claims.ExpiresAt
+}
+
+// bearerToken 返回请求头 Authorization: Bearer <token> 中的令牌
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// validSession 判断请求是否携带了有效的会话令牌
+func validSession(c *gin.Context) bool {
+	if sessionTTL.Load() == 0 {
+		return false
+	}
+	token := bearerToken(c)
+	if token == "" {
+		return false
+	}
+	_, err := parseSession(token)
+	return err == nil
+}
+
+type loginRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// LoginController 使用 auth 密码换取一个短期有效的会话令牌，之后的请求使用 Authorization: Bearer 携带令牌
+func LoginController(ctx *gin.Context) {
+	ttl := time.Duration(sessionTTL.Load())
+	if ttl == 0 {
+		Error404Handler(ctx)
+		return
+	}
+
+	var req loginRequest
+	if err := bindBody(ctx, &req); err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Password), []byte(authPassword)) != 1 {
+		requestLog(ctx).Warnf("Failed login attempt from client %s", ctx.ClientIP())
+		respondError(ctx, CodeUnauthorized, "access not authorised!")
+		return
+	}
+
+	token, claims, err := issueSession(ttl)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_at": time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// LogoutController 注销请求中携带的会话令牌
+func LogoutController(ctx *gin.Context) {
+	if sessionTTL.Load() == 0 {
+		Error404Handler(ctx)
+		return
+	}
+
+	claims, err := parseSession(bearerToken(ctx))
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	revokeSession(claims)
+	ctx.Status(http.StatusNoContent)
+}
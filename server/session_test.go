@@ -0,0 +1,111 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady, password := storage, ready.Load(), authPassword
+	storage, authPassword = fss, "session-password"
+	ready.Store(true)
+	defer func() {
+		storage, authPassword = old, password
+		ready.Store(wasReady)
+		sessionTTL.Store(0)
+	}()
+
+	request := func(method, path, bearer, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	// 没有开启时登录接口不存在
+	w := request(http.MethodPost, loginPath, "", `{"password": "session-password"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	sessionTTL.Store(int64(time.Hour))
+
+	w = request(http.MethodPost, loginPath, "", `{"password": "wrong"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = request(http.MethodPost, loginPath, "", `{"password": "session-password"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var session struct {
+		Token     string    `json:"token"`
+		TokenType string    `json:"token_type"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "Bearer", session.TokenType)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.ExpiresAt, time.Minute)
+
+	w = request(http.MethodGet, "/exists/missing", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = request(http.MethodGet, "/exists/missing", session.Token, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// 篡改的令牌和修改密码之前签发的令牌都不能使用
+	w = request(http.MethodGet, "/exists/missing", session.Token+"x", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	authPassword = "changed-password"
+	w = request(http.MethodGet, "/exists/missing", session.Token, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	authPassword = "session-password"
+
+	// 过期的令牌
+	expired, _, err := issueSession(-time.Second)
+	assert.NoError(t, err)
+	w = request(http.MethodGet, "/exists/missing", expired, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 注销之后令牌失效
+	w = request(http.MethodPost, logoutPath, session.Token, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = request(http.MethodGet, "/exists/missing", session.Token, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 关闭之后已经签发的令牌也不能使用
+	w = request(http.MethodPost, loginPath, "", `{"password": "session-password"}`)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	sessionTTL.Store(0)
+	w = request(http.MethodGet, "/exists/missing", session.Token, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
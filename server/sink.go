@@ -0,0 +1,282 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auula/urnadb/kafka"
+	"github.com/auula/urnadb/vfs"
+)
+
+// Kafka 消息的编码格式
+const (
+	SinkFormatJSON    = "json"
+	SinkFormatMsgPack = "msgpack"
+
+	defaultSinkBatch = 500
+	// sinkOffsetFile 保存已经发送成功的 LSN，在数据目录中
+	sinkOffsetFile = "kafka.offset"
+)
+
+// SinkProducer 把消息发送到消息队列的 topic，返回之前消息必须已经被确认，kafka.Producer 实现了这个接口
+type SinkProducer interface {
+	Produce(ctx context.Context, topic string, msgs []kafka.Message) error
+	Close() error
+}
+
+var _ SinkProducer = (*kafka.Producer)(nil)
+
+var (
+	// sinkBackoff 是发送失败之后第一次重试之前的等待时间，之后每次翻倍，最多等待 maxSinkBackoff
+	sinkBackoff    = 500 * time.Millisecond
+	maxSinkBackoff = 30 * time.Second
+)
+
+// sink 按照 LSN 的顺序把提交的写入和删除发送到 Kafka，发送成功之后才保存位置，所以消息至少发送一次。
+// 位置之前的历史已经被 region 回收丢弃时，先发送全部存活的 key 作为快照，再从快照开始时的 LSN 继续发送
+var sink struct {
+	producer SinkProducer
+	topic    string
+	format   string
+	batch    int
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// sinkMessage 和 Change 的字段相同，msgpack 格式的值需要解码之后重新编码，否则会被编码为 JSON 文本的二进制
+type sinkMessage struct {
+	LSN       uint64 `json:"lsn"`
+	Key       string `json:"key"`
+	Op        string `json:"op"`
+	Type      string `json:"type,omitempty"`
+	Value     any    `json:"value,omitempty"`
+	CreatedAt uint64 `json:"created_at"`
+	ExpiredAt uint64 `json:"expired_at,omitempty"`
+}
+
+// SetKafkaSink 开启 Kafka 同步，format 为 json 或者 msgpack，batch 为每次发送的最大消息数量，
+// 必须在 SetupFS 之前调用，Shutdown 时关闭 producer
+func (hs *HttpServer) SetKafkaSink(producer SinkProducer, topic, format string, batch int) {
+	if format == "" {
+		format = SinkFormatJSON
+	}
+	if batch <= 0 {
+		batch = defaultSinkBatch
+	}
+	sink.producer = producer
+	sink.topic = topic
+	sink.format = format
+	sink.batch = batch
+}
+
+// startSink 读取保存的位置并且启动发送的后台任务
+func startSink(fss *vfs.LogStructuredFS) error {
+	path := filepath.Join(fss.GetDirectory(), sinkOffsetFile)
+	offset, err := loadSinkOffset(path)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink.cancel = cancel
+	sink.done = make(chan struct{})
+	go func() {
+		defer close(sink.done)
+		runSink(ctx, fss, path, offset)
+	}()
+	return nil
+}
+
+// stopSink 等待正在发送的消息完成之后关闭 producer，必须在关闭文件系统之前调用
+func stopSink() error {
+	if sink.cancel == nil {
+		return nil
+	}
+	sink.cancel()
+	<-sink.done
+	sink.cancel = nil
+	return sink.producer.Close()
+}
+
+func loadSinkOffset(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func saveSinkOffset(path string, offset uint64) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(strconv.FormatUint(offset, 10)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func runSink(ctx context.Context, fss *vfs.LogStructuredFS, path string, offset uint64) {
+	backoff := sinkBackoff
+	for ctx.Err() == nil {
+		next, err := deliverChanges(ctx, fss, offset)
+		if errors.Is(err, vfs.ErrLSNUnavailable) {
+			slog.Warnf("Kafka sink fell behind region compaction at LSN %d, sending a snapshot of all keys", offset)
+			next, err = deliverSnapshot(ctx, fss)
+		}
+		if err == nil && next != offset {
+			err = saveSinkOffset(path, next)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warnf("failed to send changes to kafka topic %s, retrying in %s: %v", sink.topic, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxSinkBackoff {
+				backoff = maxSinkBackoff
+			}
+			continue
+		}
+
+		backoff = sinkBackoff
+		if next == offset {
+			// 没有新的写入，等待下一次写入或者停止
+			_ = fss.WaitLSN(ctx, offset)
+		}
+		offset = next
+	}
+}
+
+// deliverChanges 发送 since 之后的一批写入，返回发送之后的位置，跳过的内部 key 同样推进位置
+func deliverChanges(ctx context.Context, fss *vfs.LogStructuredFS, since uint64) (uint64, error) {
+	segs, err := fss.ReadChanges(ctx, since, sink.batch)
+	if err != nil || len(segs) == 0 {
+		return since, err
+	}
+
+	msgs := make([]kafka.Message, 0, len(segs))
+	for _, seg := range segs {
+		if isInternalKey(seg.GetKeyString()) {
+			continue
+		}
+		msg, err := sinkRecord(ctx, seg)
+		if err != nil {
+			return since, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	err = sink.producer.Produce(ctx, sink.topic, msgs)
+	if err != nil {
+		return since, err
+	}
+	return segs[len(segs)-1].LSN, nil
+}
+
+// deliverSnapshot 发送固定视图中全部存活的 key，返回视图的 LSN，之后的写入从这个 LSN 开始通过变更日志发送
+func deliverSnapshot(ctx context.Context, fss *vfs.LogStructuredFS) (uint64, error) {
+	snap := fss.Snapshot()
+	defer snap.Release()
+	lsn := snap.LSN()
+
+	var failure error
+	msgs := make([]kafka.Message, 0, sink.batch)
+	flush := func() bool {
+		failure = sink.producer.Produce(ctx, sink.topic, msgs)
+		msgs = msgs[:0]
+		return failure == nil
+	}
+
+	err := snap.Range(ctx, func(seg *vfs.Segment) bool {
+		if isInternalKey(seg.GetKeyString()) {
+			return true
+		}
+		msg, err := sinkRecord(ctx, seg)
+		if err != nil {
+			failure = err
+			return false
+		}
+		msgs = append(msgs, msg)
+		return len(msgs) < sink.batch || flush()
+	})
+	if err != nil {
+		return 0, err
+	}
+	if failure != nil || !flush() {
+		return 0, failure
+	}
+	return lsn, nil
+}
+
+// sinkRecord 把记录编码为 Kafka 消息，消息的 key 是数据的 key，删除的消息也有 value，
+// 消费者可以通过 op 区分，不依赖 Kafka 的墓碑消息
+func sinkRecord(ctx context.Context, seg *vfs.Segment) (kafka.Message, error) {
+	change, err := newChange(ctx, seg)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	var value []byte
+	if sink.format == SinkFormatMsgPack {
+		value, err = marshalSinkMsgPack(change)
+	} else {
+		value, err = json.Marshal(change)
+	}
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	return kafka.Message{
+		Key:   []byte(change.Key),
+		Value: value,
+		Time:  time.Unix(0, int64(seg.CreatedAt)),
+	}, nil
+}
+
+func marshalSinkMsgPack(change Change) ([]byte, error) {
+	msg := sinkMessage{
+		LSN:       change.LSN,
+		Key:       change.Key,
+		Op:        change.Op,
+		Type:      change.Type,
+		CreatedAt: change.CreatedAt,
+		ExpiredAt: change.ExpiredAt,
+	}
+	if change.Value != nil {
+		err := decodeJSON(bytes.NewReader(change.Value), &msg.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return marshalMsgPack(msg)
+}
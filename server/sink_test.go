@@ -0,0 +1,172 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/kafka"
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// fakeProducer 记录收到的消息，failures 大于 0 时返回错误并减一
+type fakeProducer struct {
+	mu       sync.Mutex
+	failures int
+	msgs     []kafka.Message
+	closed   bool
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, topic string, msgs []kafka.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker is unavailable")
+	}
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func (p *fakeProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *fakeProducer) keys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.msgs))
+	for _, msg := range p.msgs {
+		keys = append(keys, string(msg.Key))
+	}
+	return keys
+}
+
+func TestKafkaSink(t *testing.T) {
+	dir := t.TempDir()
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      dir,
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old := sinkBackoff
+	sinkBackoff = 10 * time.Millisecond
+	defer func() {
+		sinkBackoff = old
+		sink.producer = nil
+	}()
+
+	put := func(key, content string) {
+		seg, err := vfs.NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("a", "v1")
+	put(hookKeyPrefix+"x", "{}")
+	put("b", "v1")
+
+	producer := &fakeProducer{failures: 2}
+	var hs *HttpServer
+	hs.SetKafkaSink(producer, "changes", "", 2)
+	assert.NoError(t, startSink(fss))
+
+	assert.Eventually(t, func() bool {
+		return len(producer.keys()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a", "b"}, producer.keys())
+
+	// 停止之后写入的记录在重新启动时从保存的位置继续发送
+	put("a", "v2")
+	assert.Eventually(t, func() bool {
+		return len(producer.keys()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, stopSink())
+	assert.True(t, producer.closed)
+
+	assert.NoError(t, fss.DeleteSegment("b"))
+	offset, err := loadSinkOffset(filepath.Join(dir, sinkOffsetFile))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), offset)
+
+	producer = &fakeProducer{}
+	hs.SetKafkaSink(producer, "changes", SinkFormatJSON, 10)
+	assert.NoError(t, startSink(fss))
+	assert.Eventually(t, func() bool {
+		return len(producer.keys()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, stopSink())
+
+	var change Change
+	assert.NoError(t, json.Unmarshal(producer.msgs[0].Value, &change))
+	assert.Equal(t, "b", change.Key)
+	assert.Equal(t, hookEventDelete, change.Op)
+	assert.Equal(t, uint64(5), change.LSN)
+
+	_, err = os.Stat(filepath.Join(dir, sinkOffsetFile+".tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKafkaSnapshot(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+	defer func() {
+		sink.producer = nil
+	}()
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		seg, err := vfs.NewSegment(key, types.NewText(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	assert.NoError(t, fss.DeleteSegment("c"))
+
+	producer := &fakeProducer{}
+	var hs *HttpServer
+	hs.SetKafkaSink(producer, "changes", SinkFormatMsgPack, 1)
+
+	lsn, err := deliverSnapshot(context.Background(), fss)
+	assert.NoError(t, err)
+	assert.Equal(t, fss.LSN(), lsn)
+	assert.ElementsMatch(t, []string{"a", "b"}, producer.keys())
+
+	var msg map[string]any
+	assert.NoError(t, msgpack.Unmarshal(producer.msgs[0].Value, &msg))
+	assert.Equal(t, hookEventPut, msg["op"])
+	assert.Equal(t, "text", msg["type"])
+	assert.NotNil(t, msg["value"])
+}
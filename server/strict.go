@@ -0,0 +1,90 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 是否默认开启严格类型检查，请求中的 strict 参数优先
+var strictTypes atomic.Bool
+
+// typedKinds 是有 PUT /<type>/:key 接口的数据类型
+var typedKinds = func() map[string]bool {
+	kinds := make(map[string]bool, len(dataTypes))
+	for _, dt := range dataTypes {
+		kinds[dt.Name] = true
+	}
+	return kinds
+}()
+
+// strictTypeMiddleware 在严格模式下拒绝用 PUT 覆盖其他类型的 key，返回 409 和已经存在的类型。
+// 检查和写入之间不加锁，并发写入同一个 key 时仍然可能覆盖。
+func strictTypeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		kind := strings.Split(strings.TrimPrefix(c.FullPath(), "/"), "/")[0]
+		if key == "" || c.Request.Method != http.MethodPut || !typedKinds[kind] || storage == nil {
+			c.Next()
+			return
+		}
+
+		if !checkStrictType(c, key, kind) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// checkStrictType 检查写入 kind 类型的值是否会覆盖其他类型的 key，不允许写入时已经返回了响应。
+// /kv 接口在解析请求体推断出类型之后调用
+func checkStrictType(c *gin.Context, key, kind string) bool {
+	strict := strictTypes.Load()
+	if v := c.Query("strict"); v != "" {
+		var err error
+		strict, err = strconv.ParseBool(v)
+		if err != nil {
+			respondError(c, CodeBadRequest, "strict must be a boolean.")
+			return false
+		}
+	}
+
+	// 只有 key 存在时才需要读取记录头部里的类型
+	if _, ok := storage.StatSegment(key); !strict || !ok {
+		return true
+	}
+
+	meta, err := storage.StatKey(c.Request.Context(), key)
+	if err != nil {
+		storageFailed(c, CodeInternal, err)
+		return false
+	}
+
+	if meta.Type != kind {
+		e := newAPIError(c, CodeTypeMismatch, fmt.Sprintf("key %s already exists with type %s.", key, meta.Type))
+		c.JSON(e.Status(), e.with(gin.H{"type": meta.Type}))
+		return false
+	}
+
+	return true
+}
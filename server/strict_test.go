@@ -0,0 +1,84 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrictTypeMiddleware(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		strictTypes.Store(false)
+	}()
+
+	request := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/zset/leaderboard", `{"zset": {"alice": 1}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 默认不检查类型，请求参数可以单独开启
+	w = request("/table/leaderboard?strict=true", `{"table": {"name": "alice"}}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"type":"zset"`)
+
+	w = request("/table/leaderboard?strict=yes", `{"table": {"name": "alice"}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	strictTypes.Store(true)
+
+	// 相同类型和不存在的 key 可以写入
+	w = request("/zset/leaderboard", `{"zset": {"bob": 2}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request("/table/profile", `{"table": {"name": "alice"}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request("/table/leaderboard", `{"table": {"name": "alice"}}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request("/table/leaderboard?strict=false", `{"table": {"name": "alice"}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	meta, err := fss.StatKey(context.Background(), "leaderboard")
+	assert.NoError(t, err)
+	assert.Equal(t, "table", meta.Type)
+}
@@ -0,0 +1,346 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 每个时间桶保存一个小时的数据点，存储为一个 Series 类型的 key
+	seriesBucket = int64(time.Hour / time.Millisecond)
+	// 时间桶 key 中的时间戳补齐为固定长度，保证字典序和时间顺序一致
+	seriesStampWidth = 20
+	// 一次范围查询最多读取的时间桶数量
+	maxSeriesBuckets = 24 * 366
+	// 所有时间桶 key 的一级前缀
+	seriesRoot = "ts"
+)
+
+// seriesPrefix 返回时间序列所有时间桶 key 的公共前缀
+func seriesPrefix(series string) string {
+	return seriesRoot + ":" + series + ":"
+}
+
+// seriesGroup 是存储引擎前缀统计中命名空间的时间桶所在的分组
+func seriesGroup(namespace, separator string) string {
+	return seriesRoot + separator + namespace
+}
+
+// SeriesPrefixGroup 返回存储引擎的前缀分组函数，时间桶按照序列所在的命名空间分组，
+// 命名空间配额使用分组的统计把时间桶计入序列所在的命名空间
+func SeriesPrefixGroup(separator string) func(key string) string {
+	return func(key string) string {
+		if !strings.HasPrefix(key, seriesRoot+":") {
+			return ""
+		}
+		return seriesGroup(namespaceIn(placementKey(key), separator), separator)
+	}
+}
+
+// bucketKey 返回毫秒时间戳 ts 所在时间桶的 key，例如 ts:cpu:00000001704067200000
+func bucketKey(series string, ts int64) string {
+	bucket := ts - ts%seriesBucket
+	return fmt.Sprintf("%s%0*d", seriesPrefix(series), seriesStampWidth, bucket)
+}
+
+// bucketKeys 通过有序索引找到时间范围 [start, end) 覆盖的所有时间桶 key
+func bucketKeys(series string, start, end int64) ([]string, error) {
+	prefix := seriesPrefix(series)
+	keys, err := storage.RangeKeys(bucketKey(series, start), bucketKey(series, end-1)+"\x00", maxSeriesBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	// 名称中带有 : 的其他序列可能落在范围内，只保留时间戳部分合法的 key
+	buckets := keys[:0]
+	for _, key := range keys {
+		stamp := strings.TrimPrefix(key, prefix)
+		if len(stamp) != seriesStampWidth {
+			continue
+		}
+		if _, err := strconv.ParseUint(stamp, 10, 64); err != nil {
+			continue
+		}
+		buckets = append(buckets, key)
+	}
+
+	return buckets, nil
+}
+
+func validateSeries(ctx *gin.Context) (string, bool) {
+	series := ctx.Param("series")
+	err := validateKey(seriesPrefix(series) + strings.Repeat("0", seriesStampWidth))
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return "", false
+	}
+	return series, true
+}
+
+// fetchSeries 读取时间桶和版本号，时间桶不存在时返回一个新的 Series
+func fetchSeries(ctx context.Context, key string) (*types.Series, uint64, uint64, bool, error) {
+	version, seg, err := storage.FetchSegmentContext(ctx, key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return types.AcquireSeries(), 0, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	series, err := seg.ToSeries()
+	if err != nil {
+		return nil, 0, 0, true, err
+	}
+
+	return series, version, remainingTTL(seg), true, nil
+}
+
+// AppendSeriesController 追加数据点，ts 为毫秒时间戳，不传时使用服务器当前时间
+func AppendSeriesController(ctx *gin.Context) {
+	series, ok := validateSeries(ctx)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Points []struct {
+			Time  *int64   `json:"ts"`
+			Value *float64 `json:"value" binding:"required"`
+		} `json:"points" binding:"required,min=1"`
+		TTL uint64 `json:"ttl,omitempty"`
+	}
+
+	err := bindBody(ctx, &body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	buckets := make(map[string][]types.Point)
+	for _, p := range body.Points {
+		point := types.Point{Time: now, Value: *p.Value}
+		if p.Time != nil {
+			point.Time = *p.Time
+		}
+		if point.Time < 0 {
+			respondError(ctx, CodeBadRequest, "point timestamp cannot be negative.")
+			return
+		}
+		if math.IsNaN(point.Value) || math.IsInf(point.Value, 0) {
+			respondError(ctx, CodeBadRequest, "point value must be a finite number.")
+			return
+		}
+		key := bucketKey(series, point.Time)
+		buckets[key] = append(buckets[key], point)
+	}
+
+	keys := make([]string, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	unlock := storage.LockKeys(keys...)
+	defer unlock()
+
+	for key, points := range buckets {
+		data, version, ttl, exists, err := fetchSeries(ctx.Request.Context(), key)
+		if err != nil {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+
+		data.Add(points...)
+		if body.TTL > 0 {
+			ttl = body.TTL
+		}
+
+		seg, err := vfs.AcquirePoolSegment(key, data, ttl)
+		utils.ReleaseToPool(data)
+		if err != nil {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+
+		err = storeSegment(ctx.Request.Context(), key, seg, version, exists)
+		utils.ReleaseToPool(seg)
+		if err != nil {
+			storageFailed(ctx, CodeConflict, err)
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"message": "request processed succeed.",
+		"points":  len(body.Points),
+	})
+}
+
+func parseMillis(ctx *gin.Context, name string, def int64) (int64, error) {
+	v := ctx.Query(name)
+	if v == "" {
+		return def, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative millisecond timestamp.", name)
+	}
+	return ms, nil
+}
+
+// QuerySeriesController 返回 [start, end) 时间范围内的数据点，
+// 设置了 interval 时按照时间间隔降采样，返回每个间隔的 min、max、avg
+func QuerySeriesController(ctx *gin.Context) {
+	series, ok := validateSeries(ctx)
+	if !ok {
+		return
+	}
+
+	start, err := parseMillis(ctx, "start", 0)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	end, err := parseMillis(ctx, "end", time.Now().UnixMilli()+1)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	if end <= start {
+		respondError(ctx, CodeBadRequest, "end must be greater than start.")
+		return
+	}
+
+	querySeries(ctx, series, start, end)
+}
+
+func querySeries(ctx *gin.Context, series string, start, end int64) {
+	var interval int64
+	if v := ctx.Query("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Millisecond {
+			respondError(ctx, CodeBadRequest, "interval must be a duration of at least 1ms, for example 5m.")
+			return
+		}
+		interval = d.Milliseconds()
+	}
+
+	keys, err := bucketKeys(series, start, end)
+	if err != nil {
+		if errors.Is(err, vfs.ErrUnorderedIndex) {
+			respondError(ctx, CodeNotImplemented, "time series queries require the skiplist index.")
+			return
+		}
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	points := make([]types.Point, 0)
+	for _, key := range keys {
+		_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), key)
+		if isDeadline(err) {
+			storageFailed(ctx, CodeInternal, err)
+			return
+		}
+		if err != nil {
+			// 时间桶可能在扫描之后过期或者被删除
+			continue
+		}
+
+		data, err := seg.ToSeries()
+		utils.ReleaseToPool(seg)
+		if err != nil {
+			failed(ctx, CodeInternal, err)
+			return
+		}
+
+		points = append(points, data.Range(start, end)...)
+		utils.ReleaseToPool(data)
+	}
+
+	if interval == 0 {
+		render(ctx, http.StatusOK, gin.H{
+			"series": series,
+			"points": points,
+		})
+		return
+	}
+
+	render(ctx, http.StatusOK, gin.H{
+		"series":   series,
+		"interval": interval,
+		"buckets":  types.Downsample(points, interval),
+	})
+}
+
+// DeleteSeriesController 删除时间序列的所有时间桶
+func DeleteSeriesController(ctx *gin.Context) {
+	series, ok := validateSeries(ctx)
+	if !ok {
+		return
+	}
+	missing, ok := missingOK(ctx)
+	if !ok {
+		return
+	}
+
+	// 每次最多找到 maxSeriesBuckets 个时间桶，循环删除直到没有剩余
+	deleted := 0
+	for {
+		keys, err := bucketKeys(series, 0, math.MaxInt64)
+		if err != nil {
+			if errors.Is(err, vfs.ErrUnorderedIndex) {
+				respondError(ctx, CodeNotImplemented, "time series queries require the skiplist index.")
+				return
+			}
+			failed(ctx, CodeInternal, err)
+			return
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		for _, key := range keys {
+			err := storage.DeleteSegmentContext(ctx.Request.Context(), key)
+			if err != nil {
+				storageFailed(ctx, CodeInternal, err)
+				return
+			}
+		}
+		deleted += len(keys)
+	}
+
+	if deleted == 0 && !missing {
+		respondError(ctx, CodeKeyNotFound, fmt.Sprintf("time series %s not found.", series))
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
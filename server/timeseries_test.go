@@ -0,0 +1,121 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeSeries(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+		Index:     vfs.SkipListIndex,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	const hour = 3600000
+	// 数据点跨越两个时间桶
+	w := request(http.MethodPost, "/ts/cpu", `{"points":[
+		{"ts":1000,"value":1},{"ts":2000,"value":3},
+		{"ts":3601000,"value":5},{"ts":3602000,"value":7}
+	]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// 名称有公共前缀的其他序列不会被查询到
+	w = request(http.MethodPost, "/ts/cpu:1", `{"points":[{"ts":1500,"value":100}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	keys, err := fss.RangeKeys("ts:cpu:", "ts:cpu;", 10)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+
+	var raw struct {
+		Points []struct {
+			Time  int64   `json:"ts"`
+			Value float64 `json:"value"`
+		} `json:"points"`
+	}
+	w = request(http.MethodGet, "/ts/cpu?start=0&end=3601500", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+	assert.Len(t, raw.Points, 3)
+	assert.Equal(t, int64(3601000), raw.Points[2].Time)
+
+	var downsampled struct {
+		Interval int64 `json:"interval"`
+		Buckets  []struct {
+			Time  int64   `json:"ts"`
+			Min   float64 `json:"min"`
+			Max   float64 `json:"max"`
+			Avg   float64 `json:"avg"`
+			Count int     `json:"count"`
+		} `json:"buckets"`
+	}
+	w = request(http.MethodGet, "/ts/cpu?start=0&end=7200000&interval=1h", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &downsampled))
+	assert.Equal(t, int64(hour), downsampled.Interval)
+	assert.Len(t, downsampled.Buckets, 2)
+	assert.Equal(t, 1.0, downsampled.Buckets[0].Min)
+	assert.Equal(t, 3.0, downsampled.Buckets[0].Max)
+	assert.Equal(t, 2.0, downsampled.Buckets[0].Avg)
+	assert.Equal(t, int64(hour), downsampled.Buckets[1].Time)
+	assert.Equal(t, 6.0, downsampled.Buckets[1].Avg)
+
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/ts/cpu?start=10&end=5", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/ts/cpu?interval=abc", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/ts/cpu", `{"points":[]}`).Code)
+
+	w = request(http.MethodDelete, "/ts/cpu", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/ts/cpu", "").Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/ts/cpu?missing_ok=true", "").Code)
+	w = request(http.MethodGet, "/ts/cpu?start=0&end=7200000", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+	assert.Empty(t, raw.Points)
+
+	// 其他序列不受影响
+	keys, err = fss.RangeKeys("ts:cpu:1:", "ts:cpu:1;", 10)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+}
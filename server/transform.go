@@ -0,0 +1,537 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	transformRunning  = "running"
+	transformDone     = "done"
+	transformFailed   = "failed"
+	transformCanceled = "canceled"
+	// 每处理 transformCheckpoint 个 key 保存一次进度
+	transformCheckpoint = 100
+	// 限速时每秒最多处理的 key 数量
+	maxTransformRate = 100000
+)
+
+var errTransformCanceled = errors.New("transform canceled")
+
+// internalKeyPrefix 是存储过程、Schema、钩子等内部使用的 key 的公共前缀，用户的 key 不会使用这个前缀，
+// 只有这个前缀被保留，内部使用的 key 不会被转换
+const internalKeyPrefix = "__urnadb:"
+
+// isInternalKey 判断 key 是否为存储过程、Schema、钩子等内部使用的 key
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+// Transform 是用 Lua 脚本把 Prefix 下 Type 类型的值转换为新格式的后台任务，
+// 脚本通过全局变量 KEY 和 VALUE 读取当前的值，返回新的值，返回 nil 表示不需要修改。
+// Version 是转换之后数据格式的版本，同一个 Type 和 Prefix 只能应用更高的版本。
+// Cursor 是已经处理完的最后一个 key，任务中断之后从 Cursor 之后继续扫描。
+type Transform struct {
+	ID         int        `json:"id"`
+	Version    uint32     `json:"version"`
+	Type       string     `json:"type"`
+	Prefix     string     `json:"prefix"`
+	Script     string     `json:"script"`
+	Rate       int        `json:"rate"`
+	State      string     `json:"state"`
+	Cursor     string     `json:"cursor,omitempty"`
+	Total      int        `json:"total"`
+	Scanned    int        `json:"scanned"`
+	Migrated   int        `json:"migrated"`
+	Failed     int        `json:"failed"`
+	LastError  string     `json:"last_error,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type transformJob struct {
+	info Transform
+	stop chan struct{}
+}
+
+// transforms 记录所有的转换任务，进度保存在数据目录的 transforms.json 中，重启之后继续执行
+var transforms struct {
+	mu   sync.Mutex
+	jobs []*transformJob
+	path string
+}
+
+// transformError 是单个 key 转换失败的原因，不会中断整个任务
+type transformError struct {
+	key string
+	err error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("key %s: %v", e.key, e.err)
+}
+
+// loadTransforms 从数据目录恢复转换任务，继续执行重启之前没有完成的任务
+func loadTransforms(fss *vfs.LogStructuredFS) error {
+	transforms.mu.Lock()
+	defer transforms.mu.Unlock()
+
+	transforms.path = filepath.Join(fss.GetDirectory(), "transforms.json")
+	data, err := os.ReadFile(transforms.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []Transform
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+
+	transforms.jobs = make([]*transformJob, 0, len(list))
+	for _, info := range list {
+		job := &transformJob{info: info, stop: make(chan struct{})}
+		transforms.jobs = append(transforms.jobs, job)
+		if info.State == transformRunning {
+			slog.Infof("Resuming transform %d of %s values under prefix %q after key %q", info.ID, info.Type, info.Prefix, info.Cursor)
+			go job.run(fss)
+		}
+	}
+	return nil
+}
+
+// saveTransforms 保存所有任务的进度，调用方需要持有 transforms.mu
+func saveTransforms() error {
+	if transforms.path == "" {
+		return nil
+	}
+
+	list := make([]Transform, 0, len(transforms.jobs))
+	for _, job := range transforms.jobs {
+		list = append(list, job.info)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(transforms.path, data, 0644)
+}
+
+func findTransform(id string) *transformJob {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 || n > len(transforms.jobs) {
+		return nil
+	}
+	return transforms.jobs[n-1]
+}
+
+func runningTransform() *transformJob {
+	for _, job := range transforms.jobs {
+		if job.info.State == transformRunning {
+			return job
+		}
+	}
+	return nil
+}
+
+// appliedVersion 返回 Type 和 Prefix 已经应用的最高版本，调用方需要持有 transforms.mu
+func appliedVersion(kind, prefix string) uint32 {
+	var version uint32
+	for _, job := range transforms.jobs {
+		info := job.info
+		if info.Type == kind && info.Prefix == prefix && info.State == transformDone && info.Version > version {
+			version = info.Version
+		}
+	}
+	return version
+}
+
+// update 修改任务的状态，checkpoint 为 true 时同时保存进度
+func (j *transformJob) update(checkpoint bool, fn func(info *Transform)) {
+	transforms.mu.Lock()
+	defer transforms.mu.Unlock()
+
+	fn(&j.info)
+	if checkpoint {
+		err := saveTransforms()
+		if err != nil {
+			slog.Warnf("failed to save progress of transform %d: %v", j.info.ID, err)
+		}
+	}
+}
+
+func (j *transformJob) run(fss *vfs.LogStructuredFS) {
+	err := j.scan(fss)
+
+	var (
+		now    = time.Now()
+		result Transform
+	)
+	j.update(true, func(info *Transform) {
+		info.FinishedAt = &now
+		switch {
+		case errors.Is(err, errTransformCanceled):
+			info.State = transformCanceled
+		case err != nil:
+			info.State = transformFailed
+			info.Error = err.Error()
+		default:
+			info.State = transformDone
+		}
+		result = *info
+	})
+
+	if err != nil {
+		slog.Warnf("Transform %d of %s values under prefix %q stopped: %v", result.ID, result.Type, result.Prefix, err)
+		return
+	}
+	slog.Infof("Transform %d migrated %d %s values under prefix %q to version %d", result.ID, result.Migrated, result.Type, result.Prefix, result.Version)
+}
+
+// transformKeys 返回 Cursor 之后需要转换的 key，按照字典序排列，中断之后可以从 Cursor 继续
+func transformKeys(fss *vfs.LogStructuredFS, kind, prefix, cursor string) ([]string, error) {
+	keys := make([]string, 0)
+	err := fss.RangeSegments(func(seg *vfs.Segment) bool {
+		key := seg.GetKeyString()
+		if seg.GetTypeString() != kind || !strings.HasPrefix(key, prefix) || key <= cursor || isInternalKey(key) {
+			return true
+		}
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// scan 按照 key 的顺序逐个转换，Rate 大于 0 时限制每秒处理的 key 数量，避免影响线上的读写
+func (j *transformJob) scan(fss *vfs.LogStructuredFS) error {
+	L := newLuaState()
+	defer L.Close()
+
+	fn, err := L.LoadString(j.info.Script)
+	if err != nil {
+		return err
+	}
+
+	keys, err := transformKeys(fss, j.info.Type, j.info.Prefix, j.info.Cursor)
+	if err != nil {
+		return err
+	}
+	j.update(false, func(info *Transform) { info.Total = info.Scanned + len(keys) })
+
+	var tick <-chan time.Time
+	if j.info.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(j.info.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for i, key := range keys {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-j.stop:
+				return errTransformCanceled
+			}
+		}
+		select {
+		case <-j.stop:
+			return errTransformCanceled
+		default:
+		}
+
+		migrated, err := j.transformKey(fss, L, fn, key)
+		var failed *transformError
+		if err != nil && !errors.As(err, &failed) {
+			return err
+		}
+
+		j.update((i+1)%transformCheckpoint == 0, func(info *Transform) {
+			info.Cursor = key
+			info.Scanned++
+			if migrated {
+				info.Migrated++
+			}
+			if failed != nil {
+				info.Failed++
+				info.LastError = failed.Error()
+			}
+		})
+	}
+
+	return nil
+}
+
+// transformKey 用脚本转换 key 当前的值，使用 CAS 写入新的版本，转换期间被客户端修改过的 key 不再转换。
+// 封存过分块的列表按照完整的列表转换，写入之后分块被删除，转换期间锁定 key 避免和 push 交错
+func (j *transformJob) transformKey(fss *vfs.LogStructuredFS, L *lua.LState, fn *lua.LFunction, key string) (bool, error) {
+	unlock := fss.LockKey(key)
+	defer unlock()
+
+	version, current, err := fss.FetchSegment(key)
+	if err != nil {
+		// 扫描之后 key 已经被删除或者过期
+		return false, nil
+	}
+	current, err = expandSegment(context.Background(), current)
+	defer utils.ReleaseToPool(current)
+	if err != nil {
+		return false, err
+	}
+
+	// 任务开始之后写入的值已经是新的格式，任务中断之前已经转换过的 key 也会被跳过
+	if current.GetTypeString() != j.info.Type || current.CreatedAt >= uint64(j.info.StartedAt.UnixNano()) {
+		return false, nil
+	}
+
+	bytes, err := current.ToJSON()
+	if err != nil {
+		return false, &transformError{key: key, err: err}
+	}
+	var value any
+	err = json.Unmarshal(bytes, &value)
+	if err != nil {
+		return false, &transformError{key: key, err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	L.SetContext(ctx)
+	L.SetGlobal("KEY", lua.LString(key))
+	L.SetGlobal("VALUE", toLuaValue(L, value))
+	L.Push(fn)
+	err = L.PCall(0, 1, nil)
+	L.RemoveContext()
+	cancel()
+	if err != nil {
+		return false, &transformError{key: key, err: err}
+	}
+
+	result := L.Get(-1)
+	L.Pop(1)
+	if result == lua.LNil {
+		return false, nil
+	}
+
+	data, err := decodeValue(j.info.Type, fromLuaValue(result))
+	if err != nil {
+		return false, &transformError{key: key, err: err}
+	}
+
+	// 保留 key 剩余的过期时间
+	var ttl uint64
+	if current.ExpiredAt > 0 {
+		ttl = 1
+		if remaining := current.TTL(); remaining > 1 {
+			ttl = uint64(remaining)
+		}
+	}
+
+	seg, err := vfs.AcquirePoolSegment(key, data, ttl)
+	if err != nil {
+		return false, &transformError{key: key, err: err}
+	}
+	defer utils.ReleaseToPool(seg)
+
+	err = fss.UpdateSegmentWithCAS(key, version, seg)
+	if errors.Is(err, vfs.ErrVersionConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, dropQuicklist(context.Background(), key)
+}
+
+type TransformRequest struct {
+	Type    string `json:"type" binding:"required"`
+	Prefix  string `json:"prefix"`
+	Version uint32 `json:"version" binding:"required"`
+	Script  string `json:"script" binding:"required"`
+	Rate    int    `json:"rate"`
+}
+
+// CreateTransformController 开始一个转换任务，任务在后台执行，同一时间只能有一个任务
+func CreateTransformController(ctx *gin.Context) {
+	var req TransformRequest
+	err := bindBody(ctx, &req)
+	if err == nil && (req.Rate < 0 || req.Rate > maxTransformRate) {
+		err = fmt.Errorf("rate must be between 0 and %d", maxTransformRate)
+	}
+	if _, ok := valueFields[req.Type]; err == nil && !ok {
+		err = fmt.Errorf("values of type %s cannot be transformed", req.Type)
+	}
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	// 创建时先做一次语法检查，避免任务开始之后才发现脚本无法编译
+	_, err = parse.Parse(strings.NewReader(req.Script), "transform")
+	if err != nil {
+		failed(ctx, CodeScriptError, err)
+		return
+	}
+
+	transforms.mu.Lock()
+	defer transforms.mu.Unlock()
+
+	if runningTransform() != nil {
+		respondError(ctx, CodeBusy, "another transform is running.")
+		return
+	}
+	if applied := appliedVersion(req.Type, req.Prefix); req.Version <= applied {
+		respondError(ctx, CodeConflict, fmt.Sprintf("version must be greater than the applied version %d.", applied))
+		return
+	}
+
+	job := &transformJob{
+		info: Transform{
+			ID:        len(transforms.jobs) + 1,
+			Version:   req.Version,
+			Type:      req.Type,
+			Prefix:    req.Prefix,
+			Script:    req.Script,
+			Rate:      req.Rate,
+			State:     transformRunning,
+			StartedAt: time.Now(),
+		},
+		stop: make(chan struct{}),
+	}
+	transforms.jobs = append(transforms.jobs, job)
+	err = saveTransforms()
+	if err != nil {
+		transforms.jobs = transforms.jobs[:len(transforms.jobs)-1]
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	go job.run(storage)
+	requestLog(ctx).Infof("Transform %d of %s values under prefix %q started by %s", job.info.ID, req.Type, req.Prefix, ctx.ClientIP())
+
+	ctx.IndentedJSON(http.StatusAccepted, job.info)
+}
+
+// ListTransformsController 返回所有转换任务和它们的进度
+func ListTransformsController(ctx *gin.Context) {
+	transforms.mu.Lock()
+	list := make([]Transform, 0, len(transforms.jobs))
+	for _, job := range transforms.jobs {
+		list = append(list, job.info)
+	}
+	transforms.mu.Unlock()
+
+	ctx.IndentedJSON(http.StatusOK, gin.H{
+		"transforms": list,
+	})
+}
+
+func GetTransformController(ctx *gin.Context) {
+	transforms.mu.Lock()
+	job := findTransform(ctx.Param("id"))
+	var info Transform
+	if job != nil {
+		info = job.info
+	}
+	transforms.mu.Unlock()
+
+	if job == nil {
+		respondError(ctx, CodeNotFound, "transform not found.")
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, info)
+}
+
+// CancelTransformController 停止正在执行的任务，已经转换的 key 不会恢复，之后可以继续执行
+func CancelTransformController(ctx *gin.Context) {
+	transforms.mu.Lock()
+	defer transforms.mu.Unlock()
+
+	job := findTransform(ctx.Param("id"))
+	if job == nil {
+		respondError(ctx, CodeNotFound, "transform not found.")
+		return
+	}
+	if job.info.State != transformRunning {
+		respondError(ctx, CodeConflict, "transform is not running.")
+		return
+	}
+
+	select {
+	case <-job.stop:
+	default:
+		close(job.stop)
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "transform is being canceled.",
+	})
+}
+
+// ResumeTransformController 从上次处理完的 key 之后继续执行失败或者被取消的任务
+func ResumeTransformController(ctx *gin.Context) {
+	transforms.mu.Lock()
+	defer transforms.mu.Unlock()
+
+	job := findTransform(ctx.Param("id"))
+	if job == nil {
+		respondError(ctx, CodeNotFound, "transform not found.")
+		return
+	}
+	if job.info.State != transformFailed && job.info.State != transformCanceled {
+		respondError(ctx, CodeConflict, "only failed or canceled transforms can be resumed.")
+		return
+	}
+	if runningTransform() != nil {
+		respondError(ctx, CodeBusy, "another transform is running.")
+		return
+	}
+
+	job.info.State = transformRunning
+	job.info.Error = ""
+	job.info.FinishedAt = nil
+	job.stop = make(chan struct{})
+	err := saveTransforms()
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+
+	go job.run(storage)
+
+	ctx.IndentedJSON(http.StatusAccepted, job.info)
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+const splitNameScript = `
+if VALUE.full_name == nil then
+	if KEY == "user-bad" then error("broken document") end
+	return nil
+end
+local first, last = string.match(VALUE.full_name, "(%S+)%s+(%S+)")
+return {first_name = first, last_name = last, age = VALUE.age}
+`
+
+func TestTransform(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	assert.NoError(t, loadTransforms(fss))
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		transforms.jobs, transforms.path = nil, ""
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	wait := func(id int, state string) Transform {
+		var info Transform
+		assert.Eventually(t, func() bool {
+			w := request(http.MethodGet, fmt.Sprintf("/admin/transforms/%d", id), "")
+			_ = json.Unmarshal(w.Body.Bytes(), &info)
+			return info.State == state
+		}, 5*time.Second, 10*time.Millisecond)
+		return info
+	}
+
+	for i := 1; i <= 3; i++ {
+		w := request(http.MethodPut, fmt.Sprintf("/table/user-%d", i), fmt.Sprintf(`{"table": {"full_name": "leon ding%d", "age": %d}}`, i, 20+i))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	request(http.MethodPut, "/table/user-bad", `{"table": {"nickname": "x"}}`)
+	request(http.MethodPut, "/table/order-1", `{"table": {"full_name": "leon ding"}}`)
+	request(http.MethodPut, "/text/user-note", `{"content": "hello"}`)
+
+	w := request(http.MethodPost, "/admin/transforms", `{"type": "stream", "version": 1, "script": "return VALUE"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPost, "/admin/transforms", `{"type": "table", "version": 1, "script": "return {"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	body, _ := json.Marshal(TransformRequest{Type: "table", Prefix: "user-", Version: 1, Script: splitNameScript})
+	w = request(http.MethodPost, "/admin/transforms", string(body))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	info := wait(1, transformDone)
+	assert.Equal(t, 4, info.Total)
+	assert.Equal(t, 4, info.Scanned)
+	assert.Equal(t, 3, info.Migrated)
+	assert.Equal(t, 1, info.Failed)
+	assert.Contains(t, info.LastError, "user-bad")
+
+	w = request(http.MethodGet, "/table/user-2", "")
+	assert.JSONEq(t, `{"table": {"first_name": "leon", "last_name": "ding2", "age": 22}}`, w.Body.String())
+	w = request(http.MethodGet, "/table/order-1", "")
+	assert.JSONEq(t, `{"table": {"full_name": "leon ding"}}`, w.Body.String())
+	w = request(http.MethodGet, "/text/user-note", "")
+	assert.JSONEq(t, `{"text": "hello"}`, w.Body.String())
+
+	// 已经应用的版本不能再次执行
+	w = request(http.MethodPost, "/admin/transforms", string(body))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 限速执行的任务在处理第一个 key 之前被取消
+	for i := 4; i <= 6; i++ {
+		request(http.MethodPut, fmt.Sprintf("/table/user-%d", i), fmt.Sprintf(`{"table": {"full_name": "leon ding%d"}}`, i))
+	}
+	body, _ = json.Marshal(TransformRequest{Type: "table", Prefix: "user-", Version: 2, Script: splitNameScript, Rate: 1})
+	w = request(http.MethodPost, "/admin/transforms", string(body))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = request(http.MethodPost, "/admin/transforms/2/cancel", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	info = wait(2, transformCanceled)
+	assert.Equal(t, 0, info.Scanned)
+
+	w = request(http.MethodPost, "/admin/transforms/1/resume", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// 模拟重启之前正在执行的任务，重新加载之后继续执行
+	transforms.mu.Lock()
+	transforms.jobs[1].info.State = transformRunning
+	transforms.jobs[1].info.Rate = 0
+	transforms.jobs[1].info.Cursor = "user-4"
+	transforms.jobs[1].info.Scanned = 1
+	assert.NoError(t, saveTransforms())
+	transforms.mu.Unlock()
+	assert.NoError(t, loadTransforms(fss))
+
+	info = wait(2, transformDone)
+	assert.Equal(t, "user-bad", info.Cursor)
+	assert.Equal(t, 2, info.Migrated)
+	w = request(http.MethodGet, "/table/user-4", "")
+	assert.JSONEq(t, `{"table": {"full_name": "leon ding4"}}`, w.Body.String())
+	w = request(http.MethodGet, "/table/user-6", "")
+	assert.JSONEq(t, `{"table": {"first_name": "leon", "last_name": "ding6"}}`, w.Body.String())
+
+	data, err := os.ReadFile(filepath.Join(fss.GetDirectory(), "transforms.json"))
+	assert.NoError(t, err)
+	var saved []Transform
+	assert.NoError(t, json.Unmarshal(data, &saved))
+	assert.Len(t, saved, 2)
+	assert.Equal(t, transformDone, saved[1].State)
+}
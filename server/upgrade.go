@@ -0,0 +1,146 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/gin-gonic/gin"
+)
+
+// handover 是升级时交接数据目录的状态，active 期间拒绝写请求，writes 是正在处理的写请求数量
+var handover struct {
+	active atomic.Bool
+	writes atomic.Int64
+}
+
+// handoverMiddleware 升级交接期间拒绝写请求，新进程恢复数据目录的时候旧进程只处理读请求
+func handoverMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || probePaths[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		// 先计数再检查状态，BeginHandover 等到计数为 0 之后不会再有写请求进入
+		handover.writes.Add(1)
+		defer handover.writes.Add(-1)
+
+		if handover.active.Load() {
+			c.Header("Retry-After", "1")
+			respondError(c, CodeUnavailable, "server is upgrading, retry later.")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// BeginHandover 开始升级交接，拒绝新的写请求并且等待正在处理的写请求完成，
+// 超过 timeout 还有写请求没有完成时恢复写入并返回错误
+func (hs *HttpServer) BeginHandover(timeout time.Duration) error {
+	handover.active.Store(true)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		n := handover.writes.Load()
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			handover.active.Store(false)
+			return fmt.Errorf("%d write requests did not finish within %s", n, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// AbortHandover 新进程启动失败时恢复写入，旧进程继续提供服务
+func (hs *HttpServer) AbortHandover() {
+	handover.active.Store(false)
+}
+
+// ListenerFiles 复制全部监听地址的文件描述符，升级时传给新进程，顺序和 Binds 相同。
+// 复制之后旧进程关闭监听地址时不再删除 Unix socket 文件，新进程继续在这个文件上接受连接
+func (hs *HttpServer) ListenerFiles() ([]*os.File, error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if len(hs.listeners) == 0 {
+		return nil, errors.New("http server is not listening")
+	}
+
+	files := make([]*os.File, 0, len(hs.listeners))
+	for _, ln := range hs.listeners {
+		f, err := dupListener(ln)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	for _, ln := range hs.listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return files, nil
+}
+
+// InheritListeners 把旧进程传过来的文件描述符恢复为监听地址，传给 Options.Listeners，
+// 恢复之后关闭文件，Unix socket 文件在新进程正常退出时删除
+func InheritListeners(files []*os.File) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(files))
+	for _, f := range files {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to inherit listener %s: %w", f.Name(), err)
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(!conf.BindAddr{Network: "unix", Address: ul.Addr().String()}.IsAbstract())
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// inheritedBinds 返回继承的监听地址，继承之后 bind 和 socket 配置的修改需要重启才能生效
+func inheritedBinds(listeners []net.Listener) []conf.BindAddr {
+	binds := make([]conf.BindAddr, 0, len(listeners))
+	for _, ln := range listeners {
+		addr := ln.Addr()
+		binds = append(binds, conf.BindAddr{Network: addr.Network(), Address: addr.String()})
+	}
+	return binds
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandoverMiddleware(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	require.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	hts := &HttpServer{}
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+		hts.AbortHandover()
+	}()
+
+	// 正在处理的写请求没有完成时放弃交接
+	handover.writes.Add(1)
+	err = hts.BeginHandover(30 * time.Millisecond)
+	assert.ErrorContains(t, err, "1 write requests did not finish")
+	assert.False(t, handover.active.Load())
+	handover.writes.Add(-1)
+
+	require.NoError(t, hts.BeginHandover(time.Second))
+
+	request := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/kv/handover-key", strings.NewReader(`{"value":"v"}`))
+		req.Header.Set("Auth-Token", authPassword)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "server is upgrading")
+
+	w = request(http.MethodDelete)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// 交接期间仍然处理读请求
+	w = request(http.MethodGet)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	hts.AbortHandover()
+	w = request(http.MethodPut)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, int64(0), handover.writes.Load())
+}
+
+func TestInheritListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("passing listeners is not supported on windows")
+	}
+
+	socket := filepath.Join(t.TempDir(), "urnadb.sock")
+	prev, err := New(&Options{Port: 2668, Bind: []conf.BindAddr{
+		{Network: "tcp4", Address: "127.0.0.1:0"},
+		{Network: "unix", Address: socket},
+	}})
+	require.NoError(t, err)
+
+	_, err = prev.ListenerFiles()
+	assert.ErrorContains(t, err, "not listening")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- prev.Startup()
+	}()
+	require.Eventually(t, func() bool {
+		prev.mu.Lock()
+		defer prev.mu.Unlock()
+		return len(prev.listeners) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	files, err := prev.ListenerFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// 旧进程关闭之后 Unix socket 文件仍然存在，已经复制的文件描述符继续接受连接
+	require.NoError(t, prev.serv.Shutdown(context.Background()))
+	assert.NoError(t, <-done)
+	assert.FileExists(t, socket)
+
+	listeners, err := InheritListeners(files)
+	require.NoError(t, err)
+	next, err := New(&Options{Port: 2668, Listeners: listeners})
+	require.NoError(t, err)
+
+	binds := next.Binds()
+	require.Len(t, binds, 2)
+	assert.Equal(t, "tcp", binds[0].Network)
+	assert.True(t, strings.HasPrefix(binds[0].Address, "127.0.0.1:"))
+	assert.Equal(t, conf.BindAddr{Network: "unix", Address: socket}, binds[1])
+
+	go func() {
+		done <- next.Startup()
+	}()
+
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/livez", binds[0].Address))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	conn.Close()
+
+	// 新进程退出时删除 Unix socket 文件
+	require.NoError(t, next.serv.Shutdown(context.Background()))
+	assert.NoError(t, <-done)
+	assert.NoFileExists(t, socket)
+}
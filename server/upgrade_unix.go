@@ -0,0 +1,51 @@
+//go:build unix
+
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// dupListener 复制监听地址的文件描述符，不使用 File 方法，File 会把共享的 socket 设置为阻塞模式，
+// 之后关闭监听地址时 Accept 不会返回
+func dupListener(ln net.Listener) (*os.File, error) {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("cannot pass listener %s to another process", ln.Addr())
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var fd int
+	var dupErr error
+	err = rc.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+		if dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err = errors.Join(err, dupErr); err != nil {
+		return nil, fmt.Errorf("failed to duplicate listener %s: %w", ln.Addr(), err)
+	}
+	return os.NewFile(uintptr(fd), ln.Addr().String()), nil
+}
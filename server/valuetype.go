@@ -0,0 +1,202 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// valueData 是可以整体读写的数据类型，用完之后放回复用池
+type valueData interface {
+	vfs.Serializable
+	utils.Reusable
+}
+
+// valueType 描述一种数据类型的 GET 和 PUT 接口，新增一种整体读写的类型只需要增加一个描述
+type valueType[T valueData] struct {
+	// 响应中值的字段名，MessagePack 透传时也使用这个字段
+	field string
+	// 从复用池取出用于绑定请求体的对象
+	acquire func() T
+	// 把存储的数据解码为对象，返回的对象同样来自复用池
+	decode func(*vfs.Segment) (T, error)
+	// 响应中返回的值
+	value func(T) any
+	ttl   func(T) uint64
+	// 读取时返回 ETag，写入时支持 If-Match 乐观锁
+	revision bool
+	// 写入之前的检查，不通过时已经返回了响应
+	validate func(*gin.Context, string, T) bool
+}
+
+var (
+	setType = &valueType[*types.Set]{
+		field:   "set",
+		acquire: types.AcquireSet,
+		decode:  (*vfs.Segment).ToSet,
+		value:   func(s *types.Set) any { return s.Set },
+		ttl:     func(s *types.Set) uint64 { return s.TTL },
+	}
+	zsetType = &valueType[*types.ZSet]{
+		field:    "list",
+		acquire:  types.AcquireZSet,
+		decode:   (*vfs.Segment).ToZSet,
+		value:    func(z *types.ZSet) any { return z.ZSet },
+		ttl:      func(z *types.ZSet) uint64 { return z.TTL },
+		revision: true,
+	}
+	textType = &valueType[*types.Text]{
+		field:   "text",
+		acquire: types.AcquireText,
+		decode:  (*vfs.Segment).ToText,
+		value:   func(t *types.Text) any { return t.Content },
+		ttl:     func(t *types.Text) uint64 { return t.TTL },
+	}
+	tableType = &valueType[*types.Table]{
+		field:    "table",
+		acquire:  types.AcquireTable,
+		decode:   (*vfs.Segment).ToTable,
+		value:    func(t *types.Table) any { return t.Table },
+		ttl:      func(t *types.Table) uint64 { return t.TTL },
+		revision: true,
+		validate: checkTableSchema,
+	}
+	numberType = &valueType[*types.Number]{
+		field:   "number",
+		acquire: types.AcquireNumber,
+		decode:  (*vfs.Segment).ToNumber,
+		value:   func(n *types.Number) any { return n.Value },
+		ttl:     func(n *types.Number) uint64 { return n.TTL },
+	}
+	collectionType = &valueType[*types.Collection]{
+		field:    "collection",
+		acquire:  types.AcquireCollection,
+		decode:   (*vfs.Segment).ToCollection,
+		value:    func(c *types.Collection) any { return c.Collection },
+		ttl:      func(c *types.Collection) uint64 { return c.TTL },
+		revision: true,
+	}
+)
+
+func (vt *valueType[T]) get(ctx *gin.Context) {
+	_, seg, err := storage.FetchSegmentContext(ctx.Request.Context(), ctx.Param("key"))
+	if err != nil {
+		fetchFailed(ctx, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	if vt.revision {
+		setRevision(ctx, seg)
+	}
+
+	// 客户端接受 MessagePack 的时候直接透传存储的数据
+	if renderRaw(ctx, vt.field, seg) {
+		return
+	}
+
+	data, err := vt.decode(seg)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(data)
+
+	render(ctx, http.StatusOK, gin.H{
+		vt.field: vt.value(data),
+	})
+}
+
+func (vt *valueType[T]) put(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	data := vt.acquire()
+	defer utils.ReleaseToPool(data)
+
+	err := bindBody(ctx, data)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	if vt.validate != nil && !vt.validate(ctx, key, data) {
+		return
+	}
+
+	seg, err := vfs.AcquirePoolSegment(key, data, vt.ttl(data))
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(seg)
+
+	// 和服务端的读改写操作互斥，整体替换之后 Collection 之前封存的分块不再属于这个 key
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	var version uint64
+	if vt.revision {
+		version, err = putRevision(ctx, key, seg)
+	} else {
+		version, err = putSegment(ctx.Request.Context(), key, seg)
+	}
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	err = dropQuicklist(ctx.Request.Context(), key)
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+
+	putSucceed(ctx, version, seg)
+}
+
+// load 解码存储的值，调用者使用完值之后释放返回的对象
+func (vt *valueType[T]) load(seg *vfs.Segment) (any, utils.Reusable, error) {
+	data, err := vt.decode(seg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vt.value(data), data, nil
+}
+
+// valueLoader 屏蔽了类型参数，/kv 接口按照记录中的类型名选择解码方式
+type valueLoader interface {
+	load(seg *vfs.Segment) (any, utils.Reusable, error)
+}
+
+// checkTableSchema 检查 table 是否符合 key 前缀上注册的 schema
+func checkTableSchema(ctx *gin.Context, key string, tab *types.Table) bool {
+	prefix, invalid, err := validateTable(key, tab)
+	if err != nil {
+		failed(ctx, CodeInternal, err)
+		return false
+	}
+	if len(invalid) > 0 {
+		e := newAPIError(ctx, CodeSchemaMismatch, fmt.Sprintf("table does not match the schema of prefix %s.", prefix))
+		ctx.JSON(e.Status(), e.with(gin.H{"errors": invalid}))
+		return false
+	}
+	return true
+}
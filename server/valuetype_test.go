@@ -0,0 +1,260 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestValueTypeControllers(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		kind     string
+		body     string
+		response string
+	}{
+		{"set", `{"set": {"alice": true}}`, `{"set": {"alice": true}}`},
+		{"zset", `{"zset": {"alice": 1.5}}`, `"list"`},
+		{"text", `{"content": "hello"}`, `{"text": "hello"}`},
+		{"table", `{"table": {"name": "alice"}}`, `{"table": {"name": "alice"}}`},
+		{"number", `{"number": 42}`, `{"number": 42}`},
+		{"collection", `{"collection": [1, "a"]}`, `{"collection": [1, "a"]}`},
+	}
+
+	for _, tt := range tests {
+		path := "/" + tt.kind + "/value-" + tt.kind
+		w := request(http.MethodPut, path, tt.body)
+		assert.Equal(t, http.StatusCreated, w.Code, tt.kind)
+
+		w = request(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusOK, w.Code, tt.kind)
+		if strings.HasPrefix(tt.response, "{") {
+			assert.JSONEq(t, tt.response, w.Body.String(), tt.kind)
+		} else {
+			assert.Contains(t, w.Body.String(), tt.response, tt.kind)
+		}
+
+		w = request(http.MethodPut, path, `{"unknown": `)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.kind)
+	}
+
+	// 只有开启了乐观锁的类型返回 ETag
+	assert.NotEmpty(t, request(http.MethodGet, "/table/value-table", "").Header().Get("ETag"))
+	assert.Empty(t, request(http.MethodGet, "/text/value-text", "").Header().Get("ETag"))
+}
+
+func TestTablePagination(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/table/big", `{"table": {"a": 1, "b": {"c": 2}, "d": "x", "e": [1]}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/table/big?offset=1&limit=2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	assert.JSONEq(t, `{"table": {"b": {"c": 2}, "d": "x"}, "total": 4, "more": true}`, w.Body.String())
+
+	w = request(http.MethodGet, "/table/big?fields=e,+a,missing", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"table": {"a": 1, "e": [1]}, "total": 2, "more": false}`, w.Body.String())
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=1001", "offset=x"} {
+		w = request(http.MethodGet, "/table/big?"+query, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	w = request(http.MethodGet, "/table/missing?limit=1", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodPut, "/text/plain", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodGet, "/table/plain?limit=1", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestCollectionRange(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPut, "/collection/feed", `{"collection": [1, 2, 3, 4, 5]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	tests := []struct {
+		query    string
+		response string
+	}{
+		{"start=1&end=2", `{"collection": [2, 3], "total": 5}`},
+		{"start=-2", `{"collection": [4, 5], "total": 5}`},
+		{"start=0&end=2&reverse=true", `{"collection": [5, 4, 3], "total": 5}`},
+		{"start=3&end=1", `{"collection": [], "total": 5}`},
+		{"end=100", `{"collection": [1, 2, 3, 4, 5], "total": 5}`},
+	}
+	for _, tt := range tests {
+		w = request(http.MethodGet, "/collection/feed?"+tt.query, "")
+		assert.Equal(t, http.StatusOK, w.Code, tt.query)
+		assert.JSONEq(t, tt.response, w.Body.String(), tt.query)
+	}
+
+	for _, query := range []string{"start=x", "end=1.5", "reverse=maybe"} {
+		w = request(http.MethodGet, "/collection/feed?"+query, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	w = request(http.MethodPut, "/text/plain", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodGet, "/collection/plain?start=0", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestLargeIntegers(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	// 9007199254740993 是 2^53 + 1，解析为 float64 之后会变成 9007199254740992，
+	// assert.JSONEq 同样使用 float64 比较，所以这里直接比较响应的文本
+	w := request(http.MethodPut, "/table/ids", mimeJSON,
+		[]byte(`{"table": {"id": 9007199254740993, "max": 18446744073709551615, "min": -9223372036854775808, "ratio": 0.5}}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodGet, "/table/ids", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, text := range []string{`"id": 9007199254740993`, `"max": 18446744073709551615`, `"min": -9223372036854775808`, `"ratio": 0.5`} {
+		assert.Contains(t, w.Body.String(), text)
+	}
+
+	w = request(http.MethodPut, "/collection/ids", mimeJSON, []byte(`{"collection": [9007199254740993, {"id": 9007199254740995}]}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request(http.MethodPost, "/collection/ids/push", mimeJSON, []byte(`{"items": [9007199254740997]}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodGet, "/collection/ids", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, text := range []string{"9007199254740993", `"id": 9007199254740995`, "9007199254740997"} {
+		assert.Contains(t, w.Body.String(), text)
+	}
+
+	// MessagePack 写入的整数读取出来都是 int64，不会因为编码宽度变成 int8 之类的类型
+	body, err := msgpack.Marshal(map[string]any{"table": map[string]any{"id": int64(9007199254740993), "small": int8(1)}})
+	assert.NoError(t, err)
+	w = request(http.MethodPut, "/table/packed", mimeMsgPack, body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	_, seg, err := fss.FetchSegment("packed")
+	assert.NoError(t, err)
+	table, err := seg.ToTable()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"id": int64(9007199254740993), "small": int64(1)}, table.Table)
+}
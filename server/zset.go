@@ -0,0 +1,164 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/auula/urnadb/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// errNotZSet 表示 key 上已经存在其他类型的数据
+var errNotZSet = errors.New("key data is not a zset")
+
+// fetchZSet 读取 key 上的 ZSet，key 不存在时返回一个空的 ZSet
+func fetchZSet(ctx context.Context, key string) (*types.ZSet, uint64, uint64, bool, error) {
+	version, seg, err := storage.FetchSegmentContext(ctx, key)
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		return types.AcquireZSet(), 0, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer utils.ReleaseToPool(seg)
+
+	if seg.Type != vfs.ZSet {
+		return nil, 0, 0, true, errNotZSet
+	}
+
+	zset, err := seg.ToZSet()
+	if err != nil {
+		return nil, 0, 0, true, err
+	}
+
+	return zset, version, remainingTTL(seg), true, nil
+}
+
+// AddZSetController 添加成员或者更新成员的分数，key 不存在时创建新的 ZSet，
+// 读取、修改和写回在 key 锁内完成，并发的排行榜写入不会互相覆盖
+func AddZSetController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var body struct {
+		Member string   `json:"member" binding:"required"`
+		Score  *float64 `json:"score" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
+		return
+	}
+
+	zset, version, ttl, exists, err := fetchZSet(ctx.Request.Context(), key)
+	if errors.Is(err, errNotZSet) {
+		respondError(ctx, CodeTypeMismatch, "key data is not a zset.")
+		return
+	}
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(zset)
+
+	old, found := zset.Get(body.Member)
+	if found && old == *body.Score {
+		ctx.JSON(http.StatusOK, gin.H{
+			"zset":    zset.Size(),
+			"added":   false,
+			"changed": false,
+		})
+		return
+	}
+
+	zset.Add(body.Member, *body.Score)
+
+	err = saveSegment(ctx.Request.Context(), key, zset, version, ttl, exists)
+	if err != nil {
+		storageFailed(ctx, CodeConflict, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"zset":    zset.Size(),
+		"added":   !found,
+		"changed": true,
+	})
+}
+
+// RemoveZSetController 删除成员，成员不存在时不会重写 ZSet
+func RemoveZSetController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var body struct {
+		Member string `json:"member" binding:"required"`
+	}
+
+	err := bindBody(ctx, &body)
+	if err != nil {
+		failed(ctx, CodeBadRequest, err)
+		return
+	}
+
+	unlock := storage.LockKey(key)
+	defer unlock()
+
+	if !matchRevision(ctx, key) {
+		return
+	}
+
+	zset, version, ttl, exists, err := fetchZSet(ctx.Request.Context(), key)
+	if errors.Is(err, errNotZSet) {
+		respondError(ctx, CodeTypeMismatch, "key data is not a zset.")
+		return
+	}
+	if err != nil {
+		storageFailed(ctx, CodeInternal, err)
+		return
+	}
+	defer utils.ReleaseToPool(zset)
+
+	if !exists {
+		respondError(ctx, CodeKeyNotFound, "key data not found.")
+		return
+	}
+
+	_, found := zset.Get(body.Member)
+	if found {
+		zset.Remove(body.Member)
+		err = saveSegment(ctx.Request.Context(), key, zset, version, ttl, exists)
+		if err != nil {
+			storageFailed(ctx, CodeConflict, err)
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"zset":    zset.Size(),
+		"removed": found,
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/auula/urnadb/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZSetMembers(t *testing.T) {
+	fss, err := vfs.OpenFS(&vfs.Options{
+		FSPerm:    fs.FileMode(0755),
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	old, wasReady := storage, ready.Load()
+	storage = fss
+	ready.Store(true)
+	defer func() {
+		storage = old
+		ready.Store(wasReady)
+	}()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Auth-Token", authPassword)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/zset/board/remove", `{"member": "u1"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodPost, "/zset/board/add", `{"member": "u1", "score": 3.2}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"zset": 1, "added": true, "changed": true}`, w.Body.String())
+
+	w = request(http.MethodPost, "/zset/board/add", `{"member": "u1", "score": 3.2}`)
+	assert.JSONEq(t, `{"zset": 1, "added": false, "changed": false}`, w.Body.String())
+
+	// 分数为 0 也是有效的分数
+	w = request(http.MethodPost, "/zset/board/add", `{"member": "u1", "score": 0}`)
+	assert.JSONEq(t, `{"zset": 1, "added": false, "changed": true}`, w.Body.String())
+
+	for _, body := range []string{`{"member": "u1"}`, `{"score": 1}`, `{"member": "u1", "score": "high"}`} {
+		w = request(http.MethodPost, "/zset/board/add", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	// 并发的写入者不会丢失更新
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := request(http.MethodPost, "/zset/board/add", fmt.Sprintf(`{"member": "c%d", "score": %d}`, i, i))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}(i)
+	}
+	wg.Wait()
+
+	w = request(http.MethodGet, "/zset/board", "")
+	var board struct {
+		List map[string]float64 `json:"list"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &board))
+	assert.Len(t, board.List, 21)
+	assert.Equal(t, float64(0), board.List["u1"])
+	assert.Equal(t, float64(19), board.List["c19"])
+
+	w = request(http.MethodPost, "/zset/board/remove", `{"member": "u1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"zset": 20, "removed": true}`, w.Body.String())
+
+	w = request(http.MethodPost, "/zset/board/remove", `{"member": "u1"}`)
+	assert.JSONEq(t, `{"zset": 20, "removed": false}`, w.Body.String())
+
+	// 已经存在其他类型数据的 key 返回类型冲突
+	w = request(http.MethodPut, "/text/name", `{"content": "hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = request(http.MethodPost, "/zset/name/add", `{"member": "u1", "score": 1}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = request(http.MethodPost, "/zset/name/remove", `{"member": "u1"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"sync"
 
+	"github.com/auula/urnadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -34,6 +35,8 @@ var collectionPools = sync.Pool{
 	},
 }
 
+var collectionCounter = utils.NewPoolCounter("collection")
+
 func init() {
 	// 预先填充池中的对象，把对象放入池中
 	for i := 0; i < 10; i++ {
@@ -43,12 +46,15 @@ func init() {
 
 // 从对象池获取一个 Collection
 func AcquireCollection() *Collection {
-	return collectionPools.Get().(*Collection)
+	obj := collectionPools.Get().(*Collection)
+	collectionCounter.Acquire(obj)
+	return obj
 }
 
 // 释放 Collection 归还到对象池
 func (cle *Collection) ReleaseToPool() {
 	cle.Clear() // 清理数据，避免脏数据影响复用
+	collectionCounter.Release(cle)
 	collectionPools.Put(cle)
 }
 
@@ -80,14 +86,56 @@ func (cle *Collection) GetItem(index int) (any, error) {
 	return cle.Collection[index], nil
 }
 
+// Range 返回下标在 [start, end] 之间的项目，两端都包含在内，负数下标从末尾开始计算，-1 是最后一项，
+// 超出范围的下标会被截断到列表的边界，start 大于 end 时返回空列表
+func (cle *Collection) Range(start, end int) []any {
+	start, end, ok := RangeBounds(len(cle.Collection), start, end)
+	if !ok {
+		return []any{}
+	}
+	result := make([]any, end-start+1)
+	copy(result, cle.Collection[start:end+1])
+	return result
+}
+
+// RevRange 和 Range 相同，但是下标从最后一项开始计算，返回的项目也是倒序的，
+// 例如 RevRange(0, 9) 返回最近追加的 10 项
+func (cle *Collection) RevRange(start, end int) []any {
+	start, end, ok := RangeBounds(len(cle.Collection), start, end)
+	if !ok {
+		return []any{}
+	}
+	last := len(cle.Collection) - 1
+	result := make([]any, 0, end-start+1)
+	for i := last - start; i >= last-end; i-- {
+		result = append(result, cle.Collection[i])
+	}
+	return result
+}
+
+// Rnage 是 Range 之前的拼写，保留用于兼容
+//
+// Deprecated: use Range instead.
 func (cle *Collection) Rnage(statIndex, endIndex int) ([]any, error) {
-	var result []any
-	for i, v := range cle.Collection {
-		if i >= statIndex && i <= endIndex {
-			result = append(result, v)
-		}
+	return cle.Range(statIndex, endIndex), nil
+}
+
+// RangeBounds 把 [start, end] 中的负数下标转换为正数并截断到长度为 size 的列表范围内，
+// 范围为空时 ok 为 false，Collection 和 ZSet 的范围查询使用相同的规则
+func RangeBounds(size, start, end int) (int, int, bool) {
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= size {
+		end = size - 1
 	}
-	return result, nil
+	return start, end, start <= end
 }
 
 func (cle *Collection) LPush(item any) {
@@ -117,3 +117,37 @@ func TestCollection_ToBytes(t *testing.T) {
 	_, err := cle.ToBytes()
 	assert.NoError(t, err)
 }
+
+func TestCollection_RangeBounds(t *testing.T) {
+	cle := NewCollection()
+	for i := 0; i < 5; i++ {
+		cle.AddItem(i)
+	}
+
+	tests := []struct {
+		start, end int
+		items      []any
+		reversed   []any
+	}{
+		{0, -1, []any{0, 1, 2, 3, 4}, []any{4, 3, 2, 1, 0}},
+		{0, 1, []any{0, 1}, []any{4, 3}},
+		{-2, -1, []any{3, 4}, []any{1, 0}},
+		{3, 100, []any{3, 4}, []any{1, 0}},
+		{-100, 0, []any{0}, []any{4}},
+		{3, 1, []any{}, []any{}},
+		{5, 10, []any{}, []any{}},
+		{0, -6, []any{}, []any{}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.items, cle.Range(tt.start, tt.end), "%d..%d", tt.start, tt.end)
+		assert.Equal(t, tt.reversed, cle.RevRange(tt.start, tt.end), "%d..%d", tt.start, tt.end)
+	}
+
+	// 返回的是副本，修改不会影响原来的列表
+	items := cle.Range(0, 0)
+	items[0] = "changed"
+	assert.Equal(t, 0, cle.Collection[0])
+
+	assert.Equal(t, []any{}, NewCollection().Range(0, -1))
+}
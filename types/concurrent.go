@@ -0,0 +1,92 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "sync"
+
+// 这些类型本身不加锁，数据接口的每个请求都解码自己的副本，只有常驻内存并且被多个 goroutine 共享的值
+// （例如启动时加载、请求处理时修改的存储过程名称）需要使用下面的 SyncSet 包装。包装之后只能通过包装的方法访问原来的值：
+// 单个操作使用读写锁保护，多个操作组成的修改放在 Update 中一次完成，序列化写入存储之前使用 Snapshot 取得不再共享的副本
+
+// SyncSet 是可以并发访问的 Set
+type SyncSet struct {
+	mu  sync.RWMutex
+	set *Set
+}
+
+// NewSyncSet 包装 set，set 为 nil 时创建一个空的 Set
+func NewSyncSet(set *Set) *SyncSet {
+	if set == nil {
+		set = NewSet()
+	}
+	return &SyncSet{set: set}
+}
+
+func (s *SyncSet) Add(value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set.Add(value)
+}
+
+func (s *SyncSet) Remove(value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set.Remove(value)
+}
+
+func (s *SyncSet) Contains(value string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.set.Contains(value)
+}
+
+func (s *SyncSet) Size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.set.Size()
+}
+
+// View 持有读锁调用 fn，fn 不能修改 set，也不能在返回之后继续使用它
+func (s *SyncSet) View(fn func(set *Set)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(s.set)
+}
+
+// Update 持有写锁调用 fn，fn 中的多个修改对其他 goroutine 是一次完成的
+func (s *SyncSet) Update(fn func(set *Set)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.set)
+}
+
+// Snapshot 返回当前内容的副本
+func (s *SyncSet) Snapshot() *Set {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.set.Clone()
+}
+
+func (s *SyncSet) ToBytes() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.set.ToBytes()
+}
+
+func (s *SyncSet) ToJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.set.ToJSON()
+}
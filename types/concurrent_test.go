@@ -0,0 +1,59 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parallel 同时启动 n 个 goroutine 执行 fn，使用 go test -race 检查数据竞争
+func parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSyncSet(t *testing.T) {
+	set := NewSyncSet(nil)
+	parallel(8, func(i int) {
+		for j := 0; j < 100; j++ {
+			set.Add(fmt.Sprintf("%d-%d", i, j))
+			set.Contains("0-0")
+			_, _ = set.ToBytes()
+		}
+	})
+	assert.Equal(t, 800, set.Size())
+
+	snapshot := set.Snapshot()
+	set.Update(func(s *Set) {
+		s.Clear()
+		s.Add("only")
+	})
+	assert.Equal(t, 800, snapshot.Size())
+	assert.True(t, set.Contains("only"))
+	set.View(func(s *Set) {
+		assert.Equal(t, 1, s.Size())
+	})
+}
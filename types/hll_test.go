@@ -0,0 +1,67 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestHLL_Count(t *testing.T) {
+	hll := NewHLL()
+	assert.Equal(t, uint64(0), hll.Count())
+
+	for i := 0; i < 100000; i++ {
+		hll.Add(fmt.Sprintf("member-%d", i))
+	}
+	// 重复的成员不影响基数
+	for i := 0; i < 1000; i++ {
+		hll.Add(fmt.Sprintf("member-%d", i))
+	}
+
+	assert.InEpsilon(t, 100000, float64(hll.Count()), 0.02)
+}
+
+func TestHLL_Merge(t *testing.T) {
+	a, b := NewHLL(), NewHLL()
+	for i := 0; i < 5000; i++ {
+		a.Add(fmt.Sprintf("a-%d", i))
+		b.Add(fmt.Sprintf("b-%d", i))
+	}
+
+	assert.NoError(t, a.Merge(b))
+	assert.InEpsilon(t, 10000, float64(a.Count()), 0.02)
+
+	invalid := &HLL{Registers: make([]uint8, 8)}
+	assert.Error(t, a.Merge(invalid))
+}
+
+func TestHLL_ToBytes(t *testing.T) {
+	hll := AcquireHLL()
+	hll.Add("user-01")
+	hll.Add("user-02")
+
+	bytes, err := hll.ToBytes()
+	assert.NoError(t, err)
+
+	restored := NewHLL()
+	assert.NoError(t, msgpack.Unmarshal(bytes, &restored.Registers))
+	assert.Equal(t, hll.Count(), restored.Count())
+
+	hll.ReleaseToPool()
+}
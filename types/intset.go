@@ -0,0 +1,120 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 成员全部是整数的 Set 使用类似 Redis intset 的紧凑编码，成员排序之后保存第一个成员和相邻成员的差值，
+// 都是 varint 编码，外面包一层 msgpack 的 bin 类型。普通的 Set 编码为 msgpack 的 map，
+// 读取时根据第一个字节区分两种编码，添加了非整数成员之后重新编码时自动使用 map 编码。
+const intsetVersion = 1
+
+// msgpack bin 8、bin 16 和 bin 32 的类型字节
+const (
+	msgpackBin8  = 0xc4
+	msgpackBin16 = 0xc5
+	msgpackBin32 = 0xc6
+)
+
+var errInvalidIntSet = errors.New("invalid intset encoding")
+
+// IsIntSet reports whether data is a Set value in the intset encoding.
+func IsIntSet(data []byte) bool {
+	return len(data) > 0 && (data[0] == msgpackBin8 || data[0] == msgpackBin16 || data[0] == msgpackBin32)
+}
+
+// intsetMembers 返回排序之后的整数成员，存在不是规范整数形式的成员时返回 false，
+// 例如 "007" 和 "+1" 解码之后无法还原为原来的字符串
+func intsetMembers(set map[string]bool) ([]int64, bool) {
+	if len(set) == 0 {
+		return nil, false
+	}
+
+	ints := make([]int64, 0, len(set))
+	for member, ok := range set {
+		if !ok {
+			return nil, false
+		}
+		n, err := strconv.ParseInt(member, 10, 64)
+		if err != nil || strconv.FormatInt(n, 10) != member {
+			return nil, false
+		}
+		ints = append(ints, n)
+	}
+
+	sort.Slice(ints, func(i, j int) bool {
+		return ints[i] < ints[j]
+	})
+	return ints, true
+}
+
+func encodeIntSet(ints []int64) ([]byte, error) {
+	buf := make([]byte, 0, 2+len(ints)*2)
+	buf = append(buf, intsetVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(ints)))
+	buf = binary.AppendVarint(buf, ints[0])
+	for i := 1; i < len(ints); i++ {
+		buf = binary.AppendUvarint(buf, uint64(ints[i]-ints[i-1]))
+	}
+	return msgpack.Marshal(buf)
+}
+
+// DecodeIntSet decodes a Set value in the intset encoding into set.
+func DecodeIntSet(data []byte, set map[string]bool) error {
+	var buf []byte
+	err := msgpack.Unmarshal(data, &buf)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 || buf[0] != intsetVersion {
+		return errInvalidIntSet
+	}
+	buf = buf[1:]
+
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count == 0 || count > uint64(len(buf)) {
+		return errInvalidIntSet
+	}
+	buf = buf[n:]
+
+	value, n := binary.Varint(buf)
+	if n <= 0 {
+		return errInvalidIntSet
+	}
+	buf = buf[n:]
+	set[strconv.FormatInt(value, 10)] = true
+
+	for i := uint64(1); i < count; i++ {
+		delta, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errInvalidIntSet
+		}
+		buf = buf[n:]
+		value += int64(delta)
+		set[strconv.FormatInt(value, 10)] = true
+	}
+
+	if len(buf) != 0 {
+		return errInvalidIntSet
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestIntSet(t *testing.T) {
+	set := NewSet()
+	for _, n := range []int64{math.MinInt64, -1, 0, 7, 1000, math.MaxInt64} {
+		set.Add(strconv.FormatInt(n, 10))
+	}
+
+	data, err := set.ToBytes()
+	assert.NoError(t, err)
+	assert.True(t, IsIntSet(data))
+
+	decoded := NewSet()
+	assert.NoError(t, DecodeIntSet(data, decoded.Set))
+	assert.Equal(t, set.Set, decoded.Set)
+
+	// 添加非整数成员之后使用 map 编码
+	set.Add("alice")
+	data, err = set.ToBytes()
+	assert.NoError(t, err)
+	assert.False(t, IsIntSet(data))
+
+	for _, members := range []map[string]bool{
+		{"007": true},
+		{"+1": true},
+		{"-0": true},
+		{"1": false},
+		{"99999999999999999999": true},
+		{},
+	} {
+		_, ok := intsetMembers(members)
+		assert.False(t, ok, members)
+	}
+}
+
+func TestIntSetSize(t *testing.T) {
+	set := NewSet()
+	for i := 0; i < 10000; i++ {
+		set.Add(strconv.Itoa(100000 + i*3))
+	}
+
+	compact, err := set.ToBytes()
+	assert.NoError(t, err)
+	generic, err := msgpack.Marshal(&set.Set)
+	assert.NoError(t, err)
+	assert.Less(t, len(compact)*5, len(generic))
+}
+
+func TestDecodeIntSetInvalid(t *testing.T) {
+	set := NewSet()
+	set.Add("1")
+	set.Add("5")
+	data, err := set.ToBytes()
+	assert.NoError(t, err)
+
+	var payload []byte
+	assert.NoError(t, msgpack.Unmarshal(data, &payload))
+
+	corrupt := func(payload []byte) []byte {
+		data, err := msgpack.Marshal(payload)
+		assert.NoError(t, err)
+		return data
+	}
+
+	for _, bad := range [][]byte{
+		corrupt(nil),
+		corrupt([]byte{2, 1, 2}),
+		corrupt(payload[:len(payload)-1]),
+		corrupt(append(append([]byte{}, payload...), 0)),
+		corrupt([]byte{intsetVersion, 100, 2}),
+	} {
+		assert.Error(t, DecodeIntSet(bad, map[string]bool{}), bad)
+	}
+}
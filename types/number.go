@@ -19,6 +19,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/auula/urnadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -35,6 +36,8 @@ var numberPools = sync.Pool{
 	},
 }
 
+var numberCounter = utils.NewPoolCounter("number")
+
 func init() {
 	// 预先填充池中的对象，把对象放入池中
 	for i := 0; i < 10; i++ {
@@ -44,12 +47,15 @@ func init() {
 
 // 从对象池获取一个 Number
 func AcquireNumber() *Number {
-	return numberPools.Get().(*Number)
+	obj := numberPools.Get().(*Number)
+	numberCounter.Acquire(obj)
+	return obj
 }
 
 // 释放 Number 归还到对象池
 func (num *Number) ReleaseToPool() {
 	num.Clear()
+	numberCounter.Release(num)
 	numberPools.Put(num)
 }
 
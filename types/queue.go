@@ -0,0 +1,167 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// QueueMessage 是队列中的一条消息，被取出后在 InvisibleUntil 之前对其他消费者不可见，
+// 消费者必须使用 Receipt 确认消息，否则超时之后消息会被重新投递。
+type QueueMessage struct {
+	ID             string `json:"id" msgpack:"id"`
+	Body           any    `json:"body" msgpack:"body"`
+	Receipt        string `json:"receipt,omitempty" msgpack:"receipt"`
+	Deliveries     uint32 `json:"deliveries" msgpack:"deliveries"`
+	EnqueuedAt     int64  `json:"enqueued_at" msgpack:"enqueued_at"`
+	InvisibleUntil int64  `json:"invisible_until,omitempty" msgpack:"invisible_until"`
+}
+
+type Queue struct {
+	Messages []QueueMessage `json:"queue" msgpack:"messages" binding:"required"`
+	Sequence uint64         `json:"sequence,omitempty" msgpack:"sequence"`
+	TTL      uint64         `json:"ttl,omitempty" msgpack:"-"`
+}
+
+var queuePools = sync.Pool{
+	New: func() any {
+		return NewQueue()
+	},
+}
+
+var queueCounter = utils.NewPoolCounter("queue")
+
+func init() {
+	for i := 0; i < 10; i++ {
+		queuePools.Put(NewQueue())
+	}
+}
+
+func AcquireQueue() *Queue {
+	obj := queuePools.Get().(*Queue)
+	queueCounter.Acquire(obj)
+	return obj
+}
+
+func (q *Queue) ReleaseToPool() {
+	q.Clear()
+	queueCounter.Release(q)
+	queuePools.Put(q)
+}
+
+func NewQueue() *Queue {
+	return &Queue{
+		Messages: make([]QueueMessage, 0),
+	}
+}
+
+// Enqueue 把消息追加到队尾并返回消息 ID
+func (q *Queue) Enqueue(body any) string {
+	q.Sequence += 1
+	id := fmt.Sprintf("%d", q.Sequence)
+	q.Messages = append(q.Messages, QueueMessage{
+		ID:         id,
+		Body:       body,
+		EnqueuedAt: time.Now().UnixNano(),
+	})
+	return id
+}
+
+// Dequeue 取出队头第一条可见的消息，并在 visibility 时间内对其他消费者隐藏，
+// 消息不会被删除，超时未确认的消息会再次变为可见。
+func (q *Queue) Dequeue(visibility time.Duration) (*QueueMessage, bool) {
+	now := time.Now()
+	for i := range q.Messages {
+		msg := &q.Messages[i]
+		if msg.InvisibleUntil > now.UnixNano() {
+			continue
+		}
+		msg.Deliveries += 1
+		msg.Receipt = fmt.Sprintf("%s.%d.%d", msg.ID, msg.Deliveries, now.UnixNano())
+		msg.InvisibleUntil = now.Add(visibility).UnixNano()
+		result := *msg
+		return &result, true
+	}
+	return nil, false
+}
+
+// Ack 使用 Receipt 确认并删除消息，消息超时被重新投递之后旧的 Receipt 会失效
+func (q *Queue) Ack(receipt string) error {
+	for i, msg := range q.Messages {
+		if msg.Receipt == receipt && receipt != "" {
+			if msg.InvisibleUntil <= time.Now().UnixNano() {
+				return errors.New("queue message visibility timeout expired")
+			}
+			q.Messages = append(q.Messages[:i], q.Messages[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("queue message receipt not found")
+}
+
+// Visible 返回当前可以被取出的消息数量
+func (q *Queue) Visible() int {
+	now, visible := time.Now().UnixNano(), 0
+	for _, msg := range q.Messages {
+		if msg.InvisibleUntil <= now {
+			visible += 1
+		}
+	}
+	return visible
+}
+
+func (q *Queue) Size() int {
+	return len(q.Messages)
+}
+
+func (q *Queue) Clear() {
+	q.TTL = 0
+	q.Sequence = 0
+	q.Messages = make([]QueueMessage, 0)
+}
+
+func (q *Queue) ToBytes() ([]byte, error) {
+	return msgpack.Marshal(q)
+}
+
+func (q *Queue) ToJSON() ([]byte, error) {
+	return json.Marshal(q)
+}
+
+// UnmarshalJSON 解码 JSON 之后序号不会小于已有消息中最大的 ID，
+// 没有携带 sequence 的 JSON 解码之后新入队的消息不会复用已有的 ID
+func (q *Queue) UnmarshalJSON(data []byte) error {
+	type plain Queue
+	err := json.Unmarshal(data, (*plain)(q))
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range q.Messages {
+		id, err := strconv.ParseUint(msg.ID, 10, 64)
+		if err == nil && id > q.Sequence {
+			q.Sequence = id
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestQueue_DequeueAck(t *testing.T) {
+	queue := NewQueue()
+	queue.Enqueue("job-1")
+	queue.Enqueue("job-2")
+
+	msg, ok := queue.Dequeue(time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "job-1", msg.Body)
+	assert.Equal(t, uint32(1), msg.Deliveries)
+
+	// 第一条消息不可见，下一次取出的是第二条
+	next, ok := queue.Dequeue(time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "job-2", next.Body)
+
+	_, ok = queue.Dequeue(time.Minute)
+	assert.False(t, ok)
+
+	assert.NoError(t, queue.Ack(msg.Receipt))
+	assert.Error(t, queue.Ack(msg.Receipt))
+	assert.Equal(t, 1, queue.Size())
+}
+
+func TestQueue_Redelivery(t *testing.T) {
+	queue := NewQueue()
+	queue.Enqueue("job-1")
+
+	msg, ok := queue.Dequeue(time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, 0, queue.Visible())
+
+	time.Sleep(5 * time.Millisecond)
+
+	// 超时未确认的消息会被重新投递，旧的 Receipt 失效
+	again, ok := queue.Dequeue(time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, msg.ID, again.ID)
+	assert.Equal(t, uint32(2), again.Deliveries)
+	assert.Error(t, queue.Ack(msg.Receipt))
+	assert.NoError(t, queue.Ack(again.Receipt))
+}
+
+func TestQueue_ToBytes(t *testing.T) {
+	queue := AcquireQueue()
+	queue.Enqueue("job-1")
+
+	bytes, err := queue.ToBytes()
+	assert.NoError(t, err)
+
+	restored := NewQueue()
+	assert.NoError(t, msgpack.Unmarshal(bytes, restored))
+	assert.Equal(t, queue.Sequence, restored.Sequence)
+	assert.Equal(t, "1", restored.Messages[0].ID)
+
+	queue.ReleaseToPool()
+}
+
+func TestQueue_UnmarshalJSON(t *testing.T) {
+	queue := AcquireQueue()
+	queue.Enqueue("job-1")
+	queue.Enqueue("job-2")
+	queue.Enqueue("job-3")
+	msg, ok := queue.Dequeue(time.Minute)
+	assert.True(t, ok)
+	assert.NoError(t, queue.Ack(msg.Receipt))
+
+	bytes, err := queue.ToJSON()
+	assert.NoError(t, err)
+
+	restored := NewQueue()
+	assert.NoError(t, json.Unmarshal(bytes, restored))
+	assert.Equal(t, uint64(3), restored.Sequence)
+
+	// 没有 sequence 字段时从已有消息中最大的 ID 继续
+	restored = NewQueue()
+	assert.NoError(t, json.Unmarshal([]byte(`{"queue":[{"id":"7","body":"job-7"},{"id":"2","body":"job-2"}]}`), restored))
+	assert.Equal(t, "8", restored.Enqueue("job-8"))
+
+	queue.ReleaseToPool()
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Point 是时间序列中的一个数据点，Time 为毫秒时间戳
+type Point struct {
+	Time  int64   `json:"ts" msgpack:"ts"`
+	Value float64 `json:"value" msgpack:"value"`
+}
+
+// Series 是时间序列的一个时间桶，数据点按照时间升序保存
+type Series struct {
+	Points []Point `json:"points" msgpack:"points" binding:"required"`
+	TTL    uint64  `json:"ttl,omitempty" msgpack:"-"`
+}
+
+// Aggregate 是降采样之后一个时间间隔内数据点的统计值
+type Aggregate struct {
+	Time  int64   `json:"ts"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Count int     `json:"count"`
+}
+
+var seriesPools = sync.Pool{
+	New: func() any {
+		return NewSeries()
+	},
+}
+
+var seriesCounter = utils.NewPoolCounter("series")
+
+func init() {
+	for i := 0; i < 10; i++ {
+		seriesPools.Put(NewSeries())
+	}
+}
+
+func AcquireSeries() *Series {
+	obj := seriesPools.Get().(*Series)
+	seriesCounter.Acquire(obj)
+	return obj
+}
+
+func (s *Series) ReleaseToPool() {
+	s.Clear()
+	seriesCounter.Release(s)
+	seriesPools.Put(s)
+}
+
+func NewSeries() *Series {
+	return &Series{
+		Points: make([]Point, 0),
+	}
+}
+
+// Add 按照时间顺序插入数据点，相同时间戳的数据点会被覆盖
+func (s *Series) Add(points ...Point) {
+	for _, p := range points {
+		i := sort.Search(len(s.Points), func(i int) bool {
+			return s.Points[i].Time >= p.Time
+		})
+		if i < len(s.Points) && s.Points[i].Time == p.Time {
+			s.Points[i].Value = p.Value
+			continue
+		}
+		s.Points = append(s.Points, Point{})
+		copy(s.Points[i+1:], s.Points[i:])
+		s.Points[i] = p
+	}
+}
+
+// Range 返回 [start, end) 时间范围内的数据点
+func (s *Series) Range(start, end int64) []Point {
+	lo := sort.Search(len(s.Points), func(i int) bool {
+		return s.Points[i].Time >= start
+	})
+	hi := sort.Search(len(s.Points), func(i int) bool {
+		return s.Points[i].Time >= end
+	})
+	return s.Points[lo:hi]
+}
+
+// Downsample 把按时间升序排列的数据点按照 interval 毫秒对齐分组，计算每组的最小值、最大值和平均值
+func Downsample(points []Point, interval int64) []Aggregate {
+	aggregates := make([]Aggregate, 0)
+	for _, p := range points {
+		bucket := p.Time - p.Time%interval
+		if p.Time < 0 && p.Time%interval != 0 {
+			bucket -= interval
+		}
+
+		n := len(aggregates)
+		if n == 0 || aggregates[n-1].Time != bucket {
+			aggregates = append(aggregates, Aggregate{
+				Time: bucket,
+				Min:  math.Inf(1),
+				Max:  math.Inf(-1),
+			})
+			n += 1
+		}
+
+		agg := &aggregates[n-1]
+		agg.Min = math.Min(agg.Min, p.Value)
+		agg.Max = math.Max(agg.Max, p.Value)
+		// Avg 先作为累加和，最后再计算平均值
+		agg.Avg += p.Value
+		agg.Count += 1
+	}
+
+	for i := range aggregates {
+		aggregates[i].Avg /= float64(aggregates[i].Count)
+	}
+
+	return aggregates
+}
+
+func (s *Series) Size() int {
+	return len(s.Points)
+}
+
+func (s *Series) Clear() {
+	s.TTL = 0
+	s.Points = make([]Point, 0)
+}
+
+func (s *Series) ToBytes() ([]byte, error) {
+	return msgpack.Marshal(&s.Points)
+}
+
+func (s *Series) ToJSON() ([]byte, error) {
+	return json.Marshal(s)
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestSeries_Add(t *testing.T) {
+	series := NewSeries()
+	series.Add(Point{Time: 30, Value: 3}, Point{Time: 10, Value: 1}, Point{Time: 20, Value: 2})
+	// 相同时间戳的数据点会被覆盖
+	series.Add(Point{Time: 20, Value: 5})
+
+	assert.Equal(t, []Point{{10, 1}, {20, 5}, {30, 3}}, series.Points)
+	assert.Equal(t, []Point{{20, 5}}, series.Range(15, 30))
+	assert.Empty(t, series.Range(40, 50))
+}
+
+func TestDownsample(t *testing.T) {
+	points := []Point{{0, 1}, {500, 3}, {999, 2}, {1000, 10}, {2500, 4}}
+
+	aggregates := Downsample(points, 1000)
+	assert.Equal(t, []Aggregate{
+		{Time: 0, Min: 1, Max: 3, Avg: 2, Count: 3},
+		{Time: 1000, Min: 10, Max: 10, Avg: 10, Count: 1},
+		{Time: 2000, Min: 4, Max: 4, Avg: 4, Count: 1},
+	}, aggregates)
+
+	assert.Empty(t, Downsample(nil, 1000))
+}
+
+func TestSeries_ToBytes(t *testing.T) {
+	series := AcquireSeries()
+	series.Add(Point{Time: 1, Value: 1.5})
+
+	bytes, err := series.ToBytes()
+	assert.NoError(t, err)
+
+	var points []Point
+	assert.NoError(t, msgpack.Unmarshal(bytes, &points))
+	assert.Equal(t, series.Points, points)
+
+	series.ReleaseToPool()
+	assert.Empty(t, AcquireSeries().Points)
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"sync"
 
+	"github.com/auula/urnadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -32,18 +33,23 @@ var setPools = sync.Pool{
 	},
 }
 
+var setCounter = utils.NewPoolCounter("set")
+
 func init() {
 	for i := 0; i < 10; i++ {
-		zsetPools.Put(NewSet())
+		setPools.Put(NewSet())
 	}
 }
 
 func AcquireSet() *Set {
-	return setPools.Get().(*Set)
+	obj := setPools.Get().(*Set)
+	setCounter.Acquire(obj)
+	return obj
 }
 
 func (s *Set) ReleaseToPool() {
 	s.Clear()
+	setCounter.Release(s)
 	setPools.Put(s)
 }
 
@@ -74,13 +80,26 @@ func (s *Set) Size() int {
 	return len(s.Set)
 }
 
+// Clone 返回 Set 的副本，修改副本不会影响原来的 Set
+func (s *Set) Clone() *Set {
+	set := make(map[string]bool, len(s.Set))
+	for member, ok := range s.Set {
+		set[member] = ok
+	}
+	return &Set{Set: set, TTL: s.TTL}
+}
+
 // 清空 Set
 func (s *Set) Clear() {
 	s.TTL = 0
 	s.Set = make(map[string]bool)
 }
 
+// ToBytes 在成员全部是整数时使用 intset 编码，否则编码为 msgpack map
 func (s *Set) ToBytes() ([]byte, error) {
+	if ints, ok := intsetMembers(s.Set); ok {
+		return encodeIntSet(ints)
+	}
 	return msgpack.Marshal(&s.Set)
 }
 
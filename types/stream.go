@@ -0,0 +1,212 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// StreamEntry 是 Stream 中的一条记录，ID 格式为 <毫秒时间戳>-<序号>
+type StreamEntry struct {
+	ID     string         `json:"id" msgpack:"id"`
+	Fields map[string]any `json:"fields" msgpack:"fields"`
+}
+
+// Stream 是一个只追加的日志结构，Groups 记录每个消费组最后消费到的 ID
+type Stream struct {
+	Entries []StreamEntry     `json:"stream" msgpack:"entries" binding:"required"`
+	Groups  map[string]string `json:"groups,omitempty" msgpack:"groups"`
+	TTL     uint64            `json:"ttl,omitempty" msgpack:"-"`
+}
+
+var streamPools = sync.Pool{
+	New: func() any {
+		return NewStream()
+	},
+}
+
+var streamCounter = utils.NewPoolCounter("stream")
+
+func init() {
+	for i := 0; i < 10; i++ {
+		streamPools.Put(NewStream())
+	}
+}
+
+func AcquireStream() *Stream {
+	obj := streamPools.Get().(*Stream)
+	streamCounter.Acquire(obj)
+	return obj
+}
+
+func (s *Stream) ReleaseToPool() {
+	s.Clear()
+	streamCounter.Release(s)
+	streamPools.Put(s)
+}
+
+func NewStream() *Stream {
+	return &Stream{
+		Entries: make([]StreamEntry, 0),
+		Groups:  make(map[string]string),
+	}
+}
+
+// parseStreamID 把 <ms>-<seq> 格式的 ID 解析为两个整数，方便比较大小
+func parseStreamID(id string) (uint64, uint64, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid stream entry id: %s", id)
+	}
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream entry id: %s", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream entry id: %s", id)
+	}
+	return ms, seq, nil
+}
+
+// compareStreamID 比较两个 ID 的大小，非法的 ID 视为最小值
+func compareStreamID(a, b string) int {
+	ams, aseq, _ := parseStreamID(a)
+	bms, bseq, _ := parseStreamID(b)
+	switch {
+	case ams < bms || (ams == bms && aseq < bseq):
+		return -1
+	case ams == bms && aseq == bseq:
+		return 0
+	}
+	return 1
+}
+
+// LastID 返回最后一条记录的 ID，空 Stream 返回 0-0
+func (s *Stream) LastID() string {
+	if len(s.Entries) == 0 {
+		return "0-0"
+	}
+	return s.Entries[len(s.Entries)-1].ID
+}
+
+// Append 类似于 XADD 追加一条记录并返回生成的 ID，ID 保证单调递增
+func (s *Stream) Append(fields map[string]any) string {
+	ms := uint64(time.Now().UnixMilli())
+	seq := uint64(0)
+
+	lastms, lastseq, _ := parseStreamID(s.LastID())
+	if ms <= lastms {
+		ms, seq = lastms, lastseq+1
+	}
+
+	id := fmt.Sprintf("%d-%d", ms, seq)
+	s.Entries = append(s.Entries, StreamEntry{ID: id, Fields: fields})
+	return id
+}
+
+// Range 返回 ID 在 [start, end] 区间内的记录，start 或 end 为空表示不限制，count <= 0 表示返回全部
+func (s *Stream) Range(start, end string, count int) ([]StreamEntry, error) {
+	if start != "" {
+		if _, _, err := parseStreamID(start); err != nil {
+			return nil, err
+		}
+	}
+	if end != "" {
+		if _, _, err := parseStreamID(end); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]StreamEntry, 0)
+	for _, entry := range s.Entries {
+		if start != "" && compareStreamID(entry.ID, start) < 0 {
+			continue
+		}
+		if end != "" && compareStreamID(entry.ID, end) > 0 {
+			break
+		}
+		result = append(result, entry)
+		if count > 0 && len(result) >= count {
+			break
+		}
+	}
+	return result, nil
+}
+
+// ReadGroup 返回消费组偏移量之后的最多 count 条记录，并把偏移量推进到最后一条返回的记录
+func (s *Stream) ReadGroup(group string, count int) []StreamEntry {
+	offset := s.Groups[group]
+	result := make([]StreamEntry, 0)
+	for _, entry := range s.Entries {
+		if offset != "" && compareStreamID(entry.ID, offset) <= 0 {
+			continue
+		}
+		result = append(result, entry)
+		if count > 0 && len(result) >= count {
+			break
+		}
+	}
+
+	if len(result) > 0 {
+		if s.Groups == nil {
+			s.Groups = make(map[string]string)
+		}
+		s.Groups[group] = result[len(result)-1].ID
+	}
+	return result
+}
+
+// SetOffset 手动设置消费组的偏移量，用于重新消费或者跳过记录
+func (s *Stream) SetOffset(group, id string) error {
+	if group == "" {
+		return errors.New("stream consumer group cannot be empty")
+	}
+	if _, _, err := parseStreamID(id); err != nil {
+		return err
+	}
+	if s.Groups == nil {
+		s.Groups = make(map[string]string)
+	}
+	s.Groups[group] = id
+	return nil
+}
+
+func (s *Stream) Size() int {
+	return len(s.Entries)
+}
+
+func (s *Stream) Clear() {
+	s.TTL = 0
+	s.Entries = make([]StreamEntry, 0)
+	s.Groups = make(map[string]string)
+}
+
+func (s *Stream) ToBytes() ([]byte, error) {
+	return msgpack.Marshal(s)
+}
+
+func (s *Stream) ToJSON() ([]byte, error) {
+	return json.Marshal(s)
+}
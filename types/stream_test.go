@@ -0,0 +1,84 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStream_Append(t *testing.T) {
+	stream := NewStream()
+	assert.Equal(t, "0-0", stream.LastID())
+
+	first := stream.Append(map[string]any{"n": 1})
+	second := stream.Append(map[string]any{"n": 2})
+
+	assert.Equal(t, 2, stream.Size())
+	assert.Equal(t, -1, compareStreamID(first, second))
+	assert.Equal(t, second, stream.LastID())
+}
+
+func TestStream_Range(t *testing.T) {
+	stream := NewStream()
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		ids = append(ids, stream.Append(map[string]any{"n": i}))
+	}
+
+	entries, err := stream.Range(ids[1], ids[3], 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, ids[1], entries[0].ID)
+
+	entries, err = stream.Range("", "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	_, err = stream.Range("bad-id", "", 0)
+	assert.Error(t, err)
+}
+
+func TestStream_ReadGroup(t *testing.T) {
+	stream := NewStream()
+	for i := 0; i < 3; i++ {
+		stream.Append(map[string]any{"n": i})
+	}
+
+	entries := stream.ReadGroup("workers", 2)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, entries[1].ID, stream.Groups["workers"])
+
+	entries = stream.ReadGroup("workers", 0)
+	assert.Len(t, entries, 1)
+	assert.Len(t, stream.ReadGroup("workers", 0), 0)
+
+	// 重置偏移量之后可以重新消费
+	assert.NoError(t, stream.SetOffset("workers", "0-0"))
+	assert.Len(t, stream.ReadGroup("workers", 0), 3)
+	assert.Error(t, stream.SetOffset("", "0-0"))
+}
+
+func TestStream_Clear(t *testing.T) {
+	stream := AcquireStream()
+	stream.Append(map[string]any{"n": 1})
+	stream.TTL = 10
+	stream.ReleaseToPool()
+
+	stream = AcquireStream()
+	assert.Equal(t, 0, stream.Size())
+	assert.Equal(t, uint64(0), stream.TTL)
+}
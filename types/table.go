@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"sync"
 
+	"github.com/auula/urnadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -32,6 +33,8 @@ var tablePools = sync.Pool{
 	},
 }
 
+var tableCounter = utils.NewPoolCounter("table")
+
 func init() {
 	// 预先填充池中的对象，把对象放入池中
 	for i := 0; i < 10; i++ {
@@ -41,13 +44,16 @@ func init() {
 
 // 从对象池获取一个 Table
 func AcquireTable() *Table {
-	return tablePools.Get().(*Table)
+	obj := tablePools.Get().(*Table)
+	tableCounter.Acquire(obj)
+	return obj
 }
 
 // 释放 Table 归还到对象池
 func (tab *Table) ReleaseToPool() {
 	// 清理数据，避免脏数据影响复用
 	tab.Clear()
+	tableCounter.Release(tab)
 	tablePools.Put(tab)
 }
 
@@ -19,6 +19,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/auula/urnadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -33,6 +34,8 @@ var textPools = sync.Pool{
 	},
 }
 
+var textCounter = utils.NewPoolCounter("text")
+
 func init() {
 	for i := 0; i < 10; i++ {
 		textPools.Put(NewText(""))
@@ -40,11 +43,14 @@ func init() {
 }
 
 func AcquireText() *Text {
-	return textPools.Get().(*Text)
+	obj := textPools.Get().(*Text)
+	textCounter.Acquire(obj)
+	return obj
 }
 
 func (text *Text) ReleaseToPool() {
 	text.Clear()
+	textCounter.Release(text)
 	textPools.Put(text)
 }
 
@@ -16,17 +16,19 @@ package types
 
 import (
 	"encoding/json"
-	"sort"
 	"sync"
 
+	"github.com/auula/urnadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
-// ZSet 是一个实现有序集合的结构
+// ZSet 是一个实现有序集合的结构，ZSet 字段保存成员和分数，序列化的也只有这个字段，
+// 排名和范围查询使用的跳表索引在第一次查询时根据 ZSet 字段建立，之后随着 Add 和 Remove 更新。
+// ZSet 字段只能在第一次查询之前由解码写入，之后直接修改 ZSet 字段必须调用 Reindex，否则索引不会感知到修改
 type ZSet struct {
-	ZSet         map[string]float64 `json:"zset" msgpack:"zset" binding:"required"`
-	TTL          uint64             `json:"ttl,omitempty"`
-	sortedScores []string
+	ZSet  map[string]float64 `json:"zset" msgpack:"zset" binding:"required"`
+	TTL   uint64             `json:"ttl,omitempty"`
+	index *zskiplist
 }
 
 var zsetPools = sync.Pool{
@@ -35,6 +37,8 @@ var zsetPools = sync.Pool{
 	},
 }
 
+var zsetCounter = utils.NewPoolCounter("zset")
+
 func init() {
 	for i := 0; i < 10; i++ {
 		zsetPools.Put(NewZSet())
@@ -42,48 +46,52 @@ func init() {
 }
 
 func AcquireZSet() *ZSet {
-	return zsetPools.Get().(*ZSet)
+	obj := zsetPools.Get().(*ZSet)
+	zsetCounter.Acquire(obj)
+	return obj
 }
 
 func (z *ZSet) ReleaseToPool() {
 	z.Clear()
+	zsetCounter.Release(z)
 	zsetPools.Put(z)
 }
 
 // NewZSet 创建一个新的 ZSet
 func NewZSet() *ZSet {
 	return &ZSet{
-		ZSet:         make(map[string]float64),
-		sortedScores: []string{},
+		ZSet: make(map[string]float64),
 	}
 }
 
-// Add 向 ZSet 中添加一个元素，并指定它的分数
+// Add 向 ZSet 中添加一个元素，并指定它的分数，元素已经存在时更新分数
 func (z *ZSet) Add(value string, score float64) {
-	// 如果元素已经存在，更新其分数
-	if _, exists := z.ZSet[value]; exists {
-		z.Remove(value) // 删除旧的元素
+	old, exists := z.ZSet[value]
+	if exists && old == score {
+		return
 	}
-	// 将元素添加到 map 中
 	z.ZSet[value] = score
-	// 将元素添加到 sortedScores 列表中，并按分数排序
-	z.sortedScores = append(z.sortedScores, value)
-	z.sort()
+
+	// 索引还没有建立时只修改 map，等到查询排名时再一次性建立
+	if z.index == nil {
+		return
+	}
+	if exists {
+		z.index.delete(value, old)
+	}
+	z.index.insert(value, score)
 }
 
 // Remove 从 ZSet 中删除一个元素
 func (z *ZSet) Remove(value string) {
-	if _, exists := z.ZSet[value]; exists {
-		delete(z.ZSet, value)
-		// 更新 sortedScores 列表
-		for i, v := range z.sortedScores {
-			if v == value {
-				z.sortedScores = append(z.sortedScores[:i], z.sortedScores[i+1:]...)
-				break
-			}
-		}
+	score, exists := z.ZSet[value]
+	if !exists {
+		return
+	}
+	delete(z.ZSet, value)
+	if z.index != nil {
+		z.index.delete(value, score)
 	}
-	z.sort()
 }
 
 // Get 获取元素的分数
@@ -92,34 +100,53 @@ func (z *ZSet) Get(value string) (float64, bool) {
 	return score, exists
 }
 
-// GetRank 获取元素的排名（按分数排序）
+// GetRank 获取元素的排名（按分数从高到低排序，从 0 开始）
 func (z *ZSet) GetRank(value string) (int, bool) {
-	z.sort()
-	for i, v := range z.sortedScores {
-		if v == value {
-			return i, true
-		}
+	score, exists := z.ZSet[value]
+	if !exists {
+		return -1, false
 	}
-	return -1, false
+	rank := z.sorted().rank(value, score)
+	return rank, rank >= 0
 }
 
-// GetRange 获取指定分数区间内的元素
+// GetRange 获取指定分数区间内的元素，按分数从高到低排列
 func (z *ZSet) GetRange(minScore, maxScore float64) []string {
-	z.sort()
 	var result []string
-	for _, value := range z.sortedScores {
-		if score, exists := z.ZSet[value]; exists && score >= minScore && score <= maxScore {
-			result = append(result, value)
-		}
+	for x := z.sorted().firstInRange(maxScore); x != nil && x.score >= minScore; x = x.levels[0].forward {
+		result = append(result, x.member)
 	}
 	return result
 }
 
-// sort 根据分数对 sortedScores 排序
-func (z *ZSet) sort() {
-	sort.Slice(z.sortedScores, func(i, j int) bool {
-		return z.ZSet[z.sortedScores[i]] > z.ZSet[z.sortedScores[j]]
-	})
+// GetRangeByRank 返回排名在 [start, end] 之间的元素，负数排名从末尾开始计算，-1 是分数最低的元素
+func (z *ZSet) GetRangeByRank(start, end int) []string {
+	start, end, ok := RangeBounds(len(z.ZSet), start, end)
+	if !ok {
+		return []string{}
+	}
+
+	result := make([]string, 0, end-start+1)
+	for x := z.sorted().byRank(start); x != nil && len(result) < cap(result); x = x.levels[0].forward {
+		result = append(result, x.member)
+	}
+	return result
+}
+
+// Reindex 丢弃排序索引，直接修改 ZSet 字段之后调用，下一次查询时重新建立
+func (z *ZSet) Reindex() {
+	z.index = nil
+}
+
+// sorted 返回排序索引，索引没有建立时根据 ZSet 字段建立
+func (z *ZSet) sorted() *zskiplist {
+	if z.index == nil {
+		z.index = newZSkiplist()
+		for member, score := range z.ZSet {
+			z.index.insert(member, score)
+		}
+	}
+	return z.index
 }
 
 func (z *ZSet) Size() int {
@@ -129,7 +156,7 @@ func (z *ZSet) Size() int {
 func (z *ZSet) Clear() {
 	z.TTL = 0
 	z.ZSet = make(map[string]float64)
-	z.sortedScores = make([]string, 0)
+	z.index = nil
 }
 
 func (zs *ZSet) ToBytes() ([]byte, error) {
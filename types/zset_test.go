@@ -105,8 +105,10 @@ func TestZSet_Sort(t *testing.T) {
 	zset.Add("item2", 20.5)
 	zset.Add("item3", 15.0)
 
-	// Test if sortedScores reflects correct order
-	assert.Equal(t, []string{"item2", "item3", "item1"}, zset.sortedScores)
+	// Test if the rank order is sorted by score descending
+	assert.Equal(t, []string{"item2", "item3", "item1"}, zset.GetRangeByRank(0, -1))
+	assert.Equal(t, []string{"item3", "item1"}, zset.GetRangeByRank(-2, 10))
+	assert.Empty(t, zset.GetRangeByRank(2, 1))
 }
 
 func TestZSet_Clear(t *testing.T) {
@@ -0,0 +1,190 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "math/rand"
+
+const (
+	// zskiplistMaxLevel 足够容纳 4^32 个成员
+	zskiplistMaxLevel = 32
+	// zskiplistP 是节点升高一层的概率
+	zskiplistP = 0.25
+)
+
+// zskiplistLevel 的 span 是 forward 和当前节点之间相隔的节点数，用于计算排名
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int
+}
+
+type zskiplistNode struct {
+	member string
+	score  float64
+	levels []zskiplistLevel
+}
+
+// zskiplist 是 ZSet 的排序索引，和 Redis 的实现相同，插入、删除和按排名查找都是 O(log n)，
+// 分数高的成员排在前面，分数相同时按照成员的字典序排列
+type zskiplist struct {
+	head   *zskiplistNode
+	level  int
+	length int
+}
+
+func newZSkiplist() *zskiplist {
+	return &zskiplist{
+		head:  &zskiplistNode{levels: make([]zskiplistLevel, zskiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+// before 判断节点 x 是否排在 (score, member) 之前
+func (x *zskiplistNode) before(score float64, member string) bool {
+	return x.score > score || (x.score == score && x.member < member)
+}
+
+// after 判断节点 x 是否排在 (score, member) 之后
+func (x *zskiplistNode) after(score float64, member string) bool {
+	return x.score < score || (x.score == score && x.member > member)
+}
+
+func randomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+	return level
+}
+
+// insert 插入一个不存在的成员，已经存在的成员需要先 delete
+func (zsl *zskiplist) insert(member string, score float64) {
+	var (
+		update [zskiplistMaxLevel]*zskiplistNode
+		rank   [zskiplistMaxLevel]int
+	)
+
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.head
+			update[i].levels[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zskiplistNode{member: member, score: score, levels: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = x
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+
+	// 新节点没有到达的层跨过了新节点
+	for i := level; i < zsl.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	zsl.length++
+}
+
+// delete 删除成员，成员必须使用它当前的分数
+func (zsl *zskiplist) delete(member string, score float64) bool {
+	var update [zskiplistMaxLevel]*zskiplistNode
+
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.levels[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+
+	for zsl.level > 1 && zsl.head.levels[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// rank 返回成员从 0 开始的排名，成员不存在时返回 -1
+func (zsl *zskiplist) rank(member string, score float64) int {
+	rank := 0
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !x.levels[i].forward.after(score, member) {
+			rank += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if x != zsl.head && x.member == member {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// byRank 返回从 0 开始排名为 rank 的节点
+func (zsl *zskiplist) byRank(rank int) *zskiplistNode {
+	traversed := 0
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank+1 {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange 返回第一个分数不大于 max 的节点
+func (zsl *zskiplist) firstInRange(max float64) *zskiplistNode {
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.score > max {
+			x = x.levels[i].forward
+		}
+	}
+	return x.levels[0].forward
+}
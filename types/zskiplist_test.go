@@ -0,0 +1,103 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// expectedOrder 使用排序得到 ZSet 的期望顺序，和跳表的结果比较
+func expectedOrder(z map[string]float64) []string {
+	members := make([]string, 0, len(z))
+	for member := range z {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] > z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+func TestZSkiplist(t *testing.T) {
+	zset := NewZSet()
+	// 先建立索引，之后的修改都在索引上增量完成
+	zset.sorted()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		member := fmt.Sprintf("m%d", r.Intn(300))
+		if r.Intn(4) == 0 {
+			zset.Remove(member)
+		} else {
+			zset.Add(member, float64(r.Intn(50)))
+		}
+	}
+	assert.Equal(t, len(zset.ZSet), zset.index.length)
+
+	expected := expectedOrder(zset.ZSet)
+	assert.Equal(t, expected, zset.GetRangeByRank(0, -1))
+	for rank, member := range expected {
+		actual, ok := zset.GetRank(member)
+		assert.True(t, ok)
+		assert.Equal(t, rank, actual, member)
+	}
+	assert.Equal(t, expected[10:20], zset.GetRangeByRank(10, 19))
+
+	var inRange []string
+	for _, member := range expected {
+		if score := zset.ZSet[member]; score >= 10 && score <= 20 {
+			inRange = append(inRange, member)
+		}
+	}
+	assert.Equal(t, inRange, zset.GetRange(10, 20))
+}
+
+func TestZSetIndexRebuild(t *testing.T) {
+	zset := NewZSet()
+	zset.Add("a", 1)
+	zset.Add("b", 2)
+	assert.Nil(t, zset.index)
+
+	// 解码只写入 ZSet 字段，序列化格式不包含索引
+	data, err := zset.ToBytes()
+	assert.NoError(t, err)
+	decoded := AcquireZSet()
+	defer decoded.ReleaseToPool()
+	assert.NoError(t, msgpack.Unmarshal(data, &decoded.ZSet))
+	assert.Equal(t, []string{"b", "a"}, decoded.GetRangeByRank(0, -1))
+
+	// 直接修改 ZSet 字段之后调用 Reindex 重新建立索引，成员数量不变的修改同样生效
+	decoded.ZSet["c"] = 3
+	decoded.Reindex()
+	rank, ok := decoded.GetRank("c")
+	assert.True(t, ok)
+	assert.Equal(t, 0, rank)
+
+	delete(decoded.ZSet, "a")
+	decoded.ZSet["d"] = 4
+	decoded.Reindex()
+	rank, ok = decoded.GetRank("d")
+	assert.True(t, ok)
+	assert.Equal(t, 0, rank)
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrNotRunning is returned when the pid file does not exist or the process in it has exited.
+var ErrNotRunning = errors.New("process is not running")
+
+// ReadPidFile 读取 pid 文件中的进程号，文件不存在或者进程已经退出时返回 ErrNotRunning
+func ReadPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrNotRunning
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s: %q", path, data)
+	}
+
+	if !ProcessAlive(pid) {
+		return pid, ErrNotRunning
+	}
+	return pid, nil
+}
+
+// WritePidFile 把当前进程号写入 pid 文件，文件中的进程还在运行时返回错误，已经退出的进程留下的文件直接覆盖
+func WritePidFile(path string) error {
+	pid, err := ReadPidFile(path)
+	if err == nil && pid != os.Getpid() {
+		return fmt.Errorf("another process is running with pid %d in %s", pid, path)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名，读取的一方不会读到写了一半的文件
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RemovePidFile 删除当前进程写入的 pid 文件，文件已经被其他进程覆盖时保留
+func RemovePidFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "urnadb.pid")
+
+	_, err := ReadPidFile(path)
+	assert.ErrorIs(t, err, ErrNotRunning)
+
+	assert.NoError(t, WritePidFile(path))
+	pid, err := ReadPidFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+
+	// 同一个进程可以重复写入
+	assert.NoError(t, WritePidFile(path))
+
+	// 文件中的进程还在运行时不能覆盖
+	assert.NoError(t, os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0644))
+	assert.Error(t, WritePidFile(path))
+
+	// 不是当前进程写入的文件不会被删除
+	assert.NoError(t, RemovePidFile(path))
+	assert.FileExists(t, path)
+
+	// 已经退出的进程留下的文件直接覆盖，4194305 超过了 Linux 进程号的上限 2^22
+	assert.NoError(t, os.WriteFile(path, []byte("4194305"), 0644))
+	_, err = ReadPidFile(path)
+	assert.ErrorIs(t, err, ErrNotRunning)
+	assert.NoError(t, WritePidFile(path))
+
+	assert.NoError(t, RemovePidFile(path))
+	assert.NoFileExists(t, path)
+
+	assert.NoError(t, os.WriteFile(path, []byte("abc"), 0644))
+	_, err = ReadPidFile(path)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNotRunning)
+}
@@ -14,6 +14,13 @@
 
 package utils
 
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
 type Reusable interface {
 	ReleaseToPool()
 }
@@ -23,3 +30,96 @@ func ReleaseToPool(pools ...Reusable) {
 		p.ReleaseToPool()
 	}
 }
+
+// PoolCounter 统计一个对象池借出和归还的对象数量，开启泄漏检测之后，
+// 借出的对象没有归还就被垃圾回收时会记录为泄漏
+type PoolCounter struct {
+	name     string
+	acquired atomic.Uint64
+	released atomic.Uint64
+	leaked   atomic.Uint64
+}
+
+// PoolStats 是对象池的统计信息，InUse 是借出之后还没有归还的对象数量
+type PoolStats struct {
+	Name     string `json:"name"`
+	Acquired uint64 `json:"acquired"`
+	Released uint64 `json:"released"`
+	InUse    int64  `json:"in_use"`
+	Leaked   uint64 `json:"leaked"`
+}
+
+var (
+	poolMu       sync.Mutex
+	poolCounters []*PoolCounter
+	// leakReporter 不为空时开启泄漏检测，借出的对象都会设置 finalizer，对性能有影响，只用于排查问题
+	leakReporter atomic.Pointer[func(pool string)]
+)
+
+// NewPoolCounter 创建并注册对象池的计数器，name 是 ReadPoolStats 中使用的名称
+func NewPoolCounter(name string) *PoolCounter {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	c := &PoolCounter{name: name}
+	poolCounters = append(poolCounters, c)
+	return c
+}
+
+// SetLeakDetection 设置对象泄漏的报告函数，report 为 nil 时关闭泄漏检测，
+// 已经借出的对象不受影响，只检测之后借出的对象
+func SetLeakDetection(report func(pool string)) {
+	if report == nil {
+		leakReporter.Store(nil)
+		return
+	}
+	leakReporter.Store(&report)
+}
+
+// Acquire 记录从对象池借出 obj，obj 必须是对象池中的指针
+func (c *PoolCounter) Acquire(obj any) {
+	c.acquired.Add(1)
+	if leakReporter.Load() == nil {
+		return
+	}
+
+	// 重复归还的对象可能被借出两次，先清除之前的 finalizer
+	runtime.SetFinalizer(obj, nil)
+	runtime.SetFinalizer(obj, func(any) {
+		c.leaked.Add(1)
+		if report := leakReporter.Load(); report != nil {
+			(*report)(c.name)
+		}
+	})
+}
+
+// Release 记录 obj 归还到对象池，清除借出时设置的 finalizer
+func (c *PoolCounter) Release(obj any) {
+	c.released.Add(1)
+	if leakReporter.Load() != nil {
+		runtime.SetFinalizer(obj, nil)
+	}
+}
+
+// ReadPoolStats 返回按照名称排序的全部对象池的统计信息
+func ReadPoolStats() []PoolStats {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	stats := make([]PoolStats, 0, len(poolCounters))
+	for _, c := range poolCounters {
+		acquired, released := c.acquired.Load(), c.released.Load()
+		stats = append(stats, PoolStats{
+			Name:     c.name,
+			Acquired: acquired,
+			Released: released,
+			InUse:    int64(acquired) - int64(released),
+			Leaked:   c.leaked.Load(),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type pooledObject struct {
+	data []byte
+}
+
+func findPoolStats(name string) PoolStats {
+	for _, s := range ReadPoolStats() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return PoolStats{}
+}
+
+func TestPoolCounter(t *testing.T) {
+	name := fmt.Sprintf("counter-test-%d", time.Now().UnixNano())
+	c := NewPoolCounter(name)
+
+	a, b := &pooledObject{}, &pooledObject{}
+	c.Acquire(a)
+	c.Acquire(b)
+	c.Release(a)
+
+	s := findPoolStats(name)
+	if s.Acquired != 2 || s.Released != 1 || s.InUse != 1 || s.Leaked != 0 {
+		t.Fatalf("unexpected pool stats: %+v", s)
+	}
+	c.Release(b)
+}
+
+func TestPoolLeakDetection(t *testing.T) {
+	name := fmt.Sprintf("leak-test-%d", time.Now().UnixNano())
+	c := NewPoolCounter(name)
+
+	leaked := make(chan string, 1)
+	SetLeakDetection(func(pool string) {
+		select {
+		case leaked <- pool:
+		default:
+		}
+	})
+	defer SetLeakDetection(nil)
+
+	// 归还之后被回收的对象不算泄漏
+	released := &pooledObject{data: make([]byte, 8)}
+	c.Acquire(released)
+	c.Release(released)
+	released = nil
+
+	func() {
+		obj := &pooledObject{data: make([]byte, 8)}
+		c.Acquire(obj)
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case pool := <-leaked:
+			if pool != name {
+				t.Fatalf("expected leak of pool %s, got %s", name, pool)
+			}
+			if s := findPoolStats(name); s.Leaked != 1 {
+				t.Fatalf("expected 1 leaked object, got %+v", s)
+			}
+			return
+		case <-deadline:
+			t.Fatal("leaked object was not detected")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
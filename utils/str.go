@@ -15,6 +15,7 @@
 package utils
 
 import (
+	crand "crypto/rand"
 	"math/rand"
 	"strings"
 )
@@ -22,14 +23,15 @@ import (
 // Charset defines the set of characters to be used in generating random strings
 const Charset = "#$@!abcdefghijklmnpqrstuvwxyzABCDEFGHIJKLMNPQRSTUVWXYZ123456789"
 
-// TrimDaemon removes the "-daemon" or "--daemon" arguments from os.Args
+// TrimDaemon removes the "-daemon" or "--daemon" arguments, including the "--daemon=true" form, from os.Args
 func TrimDaemon(args []string) []string {
 	var newArgs []string
 
 	// Iterate through the args slice
 	for i := 1; i < len(args); i++ {
 		// Skip the current argument if it matches the daemon flags
-		if args[i] == "-daemon" || args[i] == "--daemon" {
+		name, _, _ := strings.Cut(args[i], "=")
+		if name == "-daemon" || name == "--daemon" {
 			continue
 		}
 		newArgs = append(newArgs, args[i])
@@ -67,3 +69,24 @@ func RandomString(length int) string {
 	}
 	return string(result)
 }
+
+// SecureRandomString returns a string of length characters from Charset read from crypto/rand,
+// it is used for generated passwords and encryption secrets.
+func SecureRandomString(length int) (string, error) {
+	// 丢弃大于 Charset 长度整数倍的字节，每个字符的概率相同
+	limit := 256 - 256%len(Charset)
+	result := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(result) < length {
+		_, err := crand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(result) < length {
+				result = append(result, Charset[int(b)%len(Charset)])
+			}
+		}
+	}
+	return string(result), nil
+}
@@ -16,6 +16,7 @@ package utils
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"unicode/utf8"
 )
@@ -59,6 +60,11 @@ func TestTrimDaemon(t *testing.T) {
 			input:    []string{"app", "-daemon", "arg1", "arg2", "--daemon", "arg3"},
 			expected: []string{"arg1", "arg2", "arg3"},
 		},
+		// 测试 "--daemon=true" 形式的参数
+		{
+			input:    []string{"app", "--daemon=true", "--port", "2668"},
+			expected: []string{"--port", "2668"},
+		},
 		// 测试不包含 "-daemon" 参数的情况
 		{
 			input:    []string{"app", "arg1", "arg2", "arg3"},
@@ -92,3 +98,25 @@ func TestRandomString(t *testing.T) {
 		t.Errorf("Expected length %d, but got %d", length, utf8.RuneCountInString(randomStr))
 	}
 }
+
+func TestSecureRandomString(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		s, err := SecureRandomString(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s) != 32 {
+			t.Fatalf("Expected 32 characters, but got %d", len(s))
+		}
+		for _, c := range s {
+			if !strings.ContainsRune(Charset, c) {
+				t.Fatalf("Unexpected character %q", c)
+			}
+		}
+		if seen[s] {
+			t.Fatalf("Duplicated random string %s", s)
+		}
+		seen[s] = true
+	}
+}
@@ -0,0 +1,665 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BackupOptions configures continuous backups of sealed regions and checkpoints to an ObjectStore.
+type BackupOptions struct {
+	Store ObjectStore
+	// Retention is how long regions removed by compaction and old checkpoints are kept, 0 keeps them forever
+	Retention time.Duration
+}
+
+// BackupStats reports the content of the backup.
+type BackupStats struct {
+	Regions     int       `json:"regions"`
+	Bytes       int64     `json:"bytes"`
+	Checkpoints int       `json:"checkpoints"`
+	Since       time.Time `json:"since"`
+	LastBackup  time.Time `json:"last_backup"`
+}
+
+// RestoreResult reports what RestoreBackup wrote to the data directory.
+type RestoreResult struct {
+	Regions    int    `json:"regions"`
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// Skipped is the number of records dropped from the first one written after the point in time
+	Skipped int `json:"skipped"`
+}
+
+// ErrObjectNotFound is returned by an ObjectStore when the object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrBackupDisabled is returned when Backup is called without SetBackup.
+var ErrBackupDisabled = errors.New("continuous backup is not enabled")
+
+// ErrBackupRunning is returned when a backup is already in progress.
+var ErrBackupRunning = errors.New("backup is already running")
+
+const manifestObject = "manifest.json"
+
+// backupManifest 记录备份中的 region 和检查点，Since 之前的时间点因为 region 已经过期删除无法恢复，
+// Horizon 是备份时本地的 LSN horizon，恢复之后也不能回滚到更早的 LSN
+type backupManifest struct {
+	Since       time.Time          `json:"since"`
+	LastBackup  time.Time          `json:"last_backup"`
+	Horizon     uint64             `json:"horizon"`
+	Regions     []backupRegion     `json:"regions"`
+	Checkpoints []backupCheckpoint `json:"checkpoints"`
+}
+
+// backupRegion 是一个封存的 region，RemovedAt 是发现本地已经回收的时间，
+// 回收时存活的数据复制到了当时活跃的 Superseded region，它备份之后这个 region 才能过期删除
+type backupRegion struct {
+	ID         uint64     `json:"id"`
+	Object     string     `json:"object"`
+	Size       int64      `json:"size"`
+	Checksum   uint32     `json:"checksum"`
+	SealedAt   time.Time  `json:"sealed_at"`
+	RemovedAt  *time.Time `json:"removed_at,omitempty"`
+	Superseded uint64     `json:"superseded,omitempty"`
+}
+
+type backupCheckpoint struct {
+	Name      string `json:"name"`
+	Object    string `json:"object"`
+	Timestamp int64  `json:"timestamp"`
+	RegionID  uint64 `json:"region_id"`
+}
+
+type backup struct {
+	opt      BackupOptions
+	mu       sync.Mutex
+	manifest *backupManifest
+	running  atomic.Bool
+	worker   *time.Ticker
+}
+
+// SetBackup loads the manifest of the backup in opt.Store, then Backup or RunBackup
+// upload the sealed regions and checkpoints missing from it.
+func (lfs *LogStructuredFS) SetBackup(opt BackupOptions) error {
+	if opt.Store == nil {
+		return errors.New("backup object store cannot be nil")
+	}
+
+	manifest, err := loadManifest(context.Background(), opt.Store)
+	if errors.Is(err, ErrObjectNotFound) {
+		manifest, err = new(backupManifest), nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load backup manifest: %w", err)
+	}
+
+	lfs.mu.Lock()
+	lfs.backup = &backup{opt: opt, manifest: manifest}
+	lfs.mu.Unlock()
+	return nil
+}
+
+// RunBackup runs Backup every interval until StopBackup is called.
+func (lfs *LogStructuredFS) RunBackup(interval time.Duration) {
+	lfs.mu.Lock()
+	if lfs.backup == nil || lfs.backup.worker != nil {
+		lfs.mu.Unlock()
+		return
+	}
+	worker := time.NewTicker(interval)
+	lfs.backup.worker = worker
+	lfs.mu.Unlock()
+
+	go func() {
+		for range worker.C {
+			n, err := lfs.Backup(context.Background())
+			if err != nil && !errors.Is(err, ErrBackupRunning) {
+				vlog.Errorf("failed to backup regions: %v", err)
+				continue
+			}
+			if n > 0 {
+				vlog.Infof("backed up %d sealed regions to object storage", n)
+			}
+		}
+	}()
+}
+
+// StopBackup stops the background worker started by RunBackup.
+func (lfs *LogStructuredFS) StopBackup() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.backup != nil && lfs.backup.worker != nil {
+		lfs.backup.worker.Stop()
+		lfs.backup.worker = nil
+	}
+}
+
+// Backup uploads the sealed regions and the latest checkpoint that are not in the backup yet,
+// then expires the data older than BackupOptions.Retention. It returns the number of uploaded regions.
+func (lfs *LogStructuredFS) Backup(ctx context.Context) (n int, err error) {
+	lfs.mu.RLock()
+	b := lfs.backup
+	lfs.mu.RUnlock()
+	if b == nil {
+		return 0, ErrBackupDisabled
+	}
+	if !b.running.CompareAndSwap(false, true) {
+		return 0, ErrBackupRunning
+	}
+	defer b.running.Store(false)
+
+	// 固定当前的 region，上传期间不会被回收删除
+	snap := lfs.Snapshot()
+	defer snap.Release()
+	active := snap.active
+
+	ctx, span := tracer.Start(ctx, "vfs.Backup", trace.WithAttributes(
+		attribute.Int64("urnadb.region", int64(active)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	existing := make(map[uint64]bool)
+	for _, id := range snap.regions {
+		existing[id] = true
+		// 活跃的 region 还在写入，封存之后再备份
+		if id == active || b.backedUp(id) {
+			continue
+		}
+		err = lfs.backupRegion(ctx, b, id)
+		if err != nil {
+			err = fmt.Errorf("failed to backup region %d: %w", id, err)
+			break
+		}
+		n++
+	}
+
+	if err == nil {
+		err = lfs.backupCheckpoint(ctx, b, active)
+	}
+
+	now := time.Now()
+	if err == nil {
+		b.mu.Lock()
+		for i := range b.manifest.Regions {
+			region := &b.manifest.Regions[i]
+			if region.RemovedAt == nil && !existing[region.ID] {
+				region.RemovedAt, region.Superseded = &now, active
+			}
+		}
+		b.mu.Unlock()
+		err = b.expire(ctx, now)
+	}
+
+	// 上传失败时也保存已经上传的部分，下次不用重新上传
+	b.mu.Lock()
+	b.manifest.LastBackup = now
+	b.manifest.Horizon = lfs.LSNHorizon()
+	b.mu.Unlock()
+	return n, errors.Join(err, b.saveManifest(ctx))
+}
+
+// BackupStats returns the content of the backup, it is empty if the backup is not enabled.
+func (lfs *LogStructuredFS) BackupStats() BackupStats {
+	lfs.mu.RLock()
+	b := lfs.backup
+	lfs.mu.RUnlock()
+	if b == nil {
+		return BackupStats{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := BackupStats{
+		Regions:     len(b.manifest.Regions),
+		Checkpoints: len(b.manifest.Checkpoints),
+		Since:       b.manifest.Since,
+		LastBackup:  b.manifest.LastBackup,
+	}
+	for _, region := range b.manifest.Regions {
+		stats.Bytes += region.Size
+	}
+	return stats
+}
+
+func (lfs *LogStructuredFS) backupRegion(ctx context.Context, b *backup, id uint64) error {
+	fd, release, err := lfs.openRegion(context.Background(), id)
+	if err != nil || fd == nil {
+		return err
+	}
+	defer release()
+
+	finfo, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	checksum, err := checksumFile(fd, finfo.Size())
+	if err != nil {
+		return err
+	}
+
+	region := backupRegion{
+		ID:       id,
+		Object:   "regions/" + formatDataFileName(id),
+		Size:     finfo.Size(),
+		Checksum: checksum,
+		SealedAt: finfo.ModTime(),
+	}
+	err = b.opt.Store.Upload(ctx, region.Object, io.NewSectionReader(fd, 0, region.Size), region.Size)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.manifest.Regions = append(b.manifest.Regions, region)
+	b.mu.Unlock()
+	return nil
+}
+
+// backupCheckpoint 上传最新的检查点，恢复时从检查点开始只需要重放之后的 region
+func (lfs *LogStructuredFS) backupCheckpoint(ctx context.Context, b *backup, active uint64) error {
+	files, err := filepath.Glob(filepath.Join(lfs.directory, "ckpt.*.ids"))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	var latest *backupCheckpoint
+	for _, file := range files {
+		ckpt, ok := parseCheckpointName(filepath.Base(file))
+		if ok && (latest == nil || ckpt.Timestamp > latest.Timestamp) {
+			latest = ckpt
+		}
+	}
+	// 检查点之后的 region 要全部备份之后才能使用，活跃的 region 封存之后再上传
+	if latest == nil || latest.RegionID >= active || b.hasCheckpoint(latest.Name) {
+		return nil
+	}
+
+	// 新的检查点生成之后旧的会被删除，打开之后仍然可以读取
+	fd, err := os.Open(filepath.Join(lfs.directory, latest.Name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	finfo, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	latest.Object = "checkpoints/" + latest.Name
+	err = b.opt.Store.Upload(ctx, latest.Object, fd, finfo.Size())
+	if err != nil {
+		return fmt.Errorf("failed to backup checkpoint %s: %w", latest.Name, err)
+	}
+
+	b.mu.Lock()
+	b.manifest.Checkpoints = append(b.manifest.Checkpoints, *latest)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *backup) backedUp(id uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, region := range b.manifest.Regions {
+		if region.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *backup) hasCheckpoint(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ckpt := range b.manifest.Checkpoints {
+		if ckpt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// expire 删除超过保留时间的 region 和检查点，始终保留最新的检查点
+func (b *backup) expire(ctx context.Context, now time.Time) error {
+	if b.opt.Retention <= 0 {
+		return nil
+	}
+	cutoff := now.Add(-b.opt.Retention)
+
+	b.mu.Lock()
+	regions := append([]backupRegion{}, b.manifest.Regions...)
+	checkpoints := append([]backupCheckpoint{}, b.manifest.Checkpoints...)
+	b.mu.Unlock()
+
+	uploaded := make(map[uint64]bool, len(regions))
+	for _, region := range regions {
+		uploaded[region.ID] = true
+	}
+
+	var (
+		expired = make(map[uint64]bool)
+		since   time.Time
+	)
+	for _, region := range regions {
+		if region.RemovedAt == nil || !region.RemovedAt.Before(cutoff) || !uploaded[region.Superseded] {
+			continue
+		}
+		err := b.opt.Store.Remove(ctx, region.Object)
+		if err != nil {
+			return fmt.Errorf("failed to expire region %d: %w", region.ID, err)
+		}
+		expired[region.ID] = true
+		if region.RemovedAt.After(since) {
+			since = *region.RemovedAt
+		}
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Timestamp < checkpoints[j].Timestamp
+	})
+	dropped := make(map[string]bool)
+	for i := 0; i < len(checkpoints)-1; i++ {
+		if !time.Unix(checkpoints[i].Timestamp, 0).Before(cutoff) {
+			break
+		}
+		err := b.opt.Store.Remove(ctx, checkpoints[i].Object)
+		if err != nil {
+			return fmt.Errorf("failed to expire checkpoint %s: %w", checkpoints[i].Name, err)
+		}
+		dropped[checkpoints[i].Name] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.manifest.Regions[:0]
+	for _, region := range b.manifest.Regions {
+		if !expired[region.ID] {
+			kept = append(kept, region)
+		}
+	}
+	b.manifest.Regions = kept
+	ckpts := b.manifest.Checkpoints[:0]
+	for _, ckpt := range b.manifest.Checkpoints {
+		if !dropped[ckpt.Name] {
+			ckpts = append(ckpts, ckpt)
+		}
+	}
+	b.manifest.Checkpoints = ckpts
+	if since.After(b.manifest.Since) {
+		b.manifest.Since = since
+	}
+	return nil
+}
+
+func (b *backup) saveManifest(ctx context.Context) error {
+	b.mu.Lock()
+	data, err := json.Marshal(b.manifest)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.opt.Store.Upload(ctx, manifestObject, bytes.NewReader(data), int64(len(data)))
+}
+
+func loadManifest(ctx context.Context, store ObjectStore) (*backupManifest, error) {
+	body, err := store.Download(ctx, manifestObject)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var manifest backupManifest
+	err = json.NewDecoder(body).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// parseCheckpointName 解析 ckpt.<ts>.<region>.ids 格式的检查点文件名
+func parseCheckpointName(name string) (*backupCheckpoint, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 4 || parts[0] != "ckpt" || parts[3] != "ids" {
+		return nil, false
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	regionID, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &backupCheckpoint{Name: name, Timestamp: ts, RegionID: regionID}, true
+}
+
+// RestoreBackup writes the state at the point in time at from the backup in store into dir,
+// which must be empty or not exist. A zero at restores the latest backup. Each region is truncated
+// at the first record created after at, writes in the region that was active at the last backup are lost.
+func RestoreBackup(ctx context.Context, store ObjectStore, dir string, at time.Time) (*RestoreResult, error) {
+	manifest, err := loadManifest(ctx, store)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, errors.New("no backup found in object storage")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup manifest: %w", err)
+	}
+
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if at.Before(manifest.Since) {
+		return nil, fmt.Errorf("backup can only restore to a time after %s", manifest.Since.Format(time.RFC3339))
+	}
+
+	files, err := os.ReadDir(dir)
+	if err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("restore directory %s is not empty", dir)
+	}
+	err = os.MkdirAll(dir, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// 使用时间点之前最新的检查点，检查点之前封存的 region 原样恢复，之后的 region 过滤掉时间点之后的记录
+	// 检查点的时间戳精确到秒，同一秒内生成的检查点可能晚于时间点
+	var ckpt *backupCheckpoint
+	for i, c := range manifest.Checkpoints {
+		ts := time.Unix(c.Timestamp, 0)
+		if c.Timestamp < at.Unix() && !ts.Before(manifest.Since) && (ckpt == nil || c.Timestamp > ckpt.Timestamp) {
+			ckpt = &manifest.Checkpoints[i]
+		}
+	}
+
+	sort.Slice(manifest.Regions, func(i, j int) bool {
+		return manifest.Regions[i].ID < manifest.Regions[j].ID
+	})
+
+	result := new(RestoreResult)
+	for _, region := range manifest.Regions {
+		filter := ckpt == nil || region.ID >= ckpt.RegionID
+		// 检查点生成之前已经回收的 region 不会被检查点中的索引引用
+		if !filter && region.RemovedAt != nil && region.RemovedAt.Before(time.Unix(ckpt.Timestamp, 0)) {
+			continue
+		}
+
+		skipped, err := restoreRegion(ctx, store, dir, region, filter, uint64(at.UnixNano()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore region %d: %w", region.ID, err)
+		}
+		result.Regions++
+		result.Skipped += skipped
+	}
+
+	if ckpt != nil {
+		err := downloadObject(ctx, store, ckpt.Object, filepath.Join(dir, ckpt.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore checkpoint %s: %w", ckpt.Name, err)
+		}
+		result.Checkpoint = ckpt.Name
+	}
+
+	// 备份中的历史版本和本地一样被 region 回收丢弃过
+	if manifest.Horizon > 0 {
+		err = writeHorizon(dir, manifest.Horizon)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// restoreRegion 下载并且校验 region，filter 为 true 时截断时间点 at 之后写入的记录
+func restoreRegion(ctx context.Context, store ObjectStore, dir string, region backupRegion, filter bool, at uint64) (int, error) {
+	path := filepath.Join(dir, formatDataFileName(region.ID))
+	err := downloadObject(ctx, store, region.Object, path+".part")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".part")
+
+	src, err := os.Open(path + ".part")
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	checksum, err := checksumFile(src, region.Size)
+	if err != nil {
+		return 0, err
+	}
+	finfo, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if finfo.Size() != region.Size || checksum != region.Checksum {
+		return 0, errors.New("region downloaded from object storage is corrupted")
+	}
+
+	if !filter {
+		return 0, os.Rename(path+".part", path)
+	}
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return 0, err
+	}
+
+	skipped, err := filterRecords(bufio.NewReader(src), dst, at)
+	if err != nil {
+		_ = dst.Close()
+		return 0, err
+	}
+	return skipped, dst.Close()
+}
+
+// filterRecords 按照写入顺序复制 region 中的原始记录，遇到第一条创建时间晚于 at 的记录时截断，
+// 保持之前记录的偏移量不变，检查点中的索引仍然有效，不需要解码数据，恢复时也不需要加密密钥，
+// 旧版本的 region 使用自己版本的解析方法读取记录头部，恢复之后启动时升级
+func filterRecords(r io.Reader, w io.Writer, at uint64) (int, error) {
+	metadata := make([]byte, len(regionMetadata))
+	_, err := io.ReadFull(r, metadata)
+	if err != nil {
+		return 0, errors.New("region metadata mismatch")
+	}
+
+	reader, err := regionFormat("region", metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	_, err = bw.Write(metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	skipped := 0
+	header := make([]byte, reader.headerSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment header: %w", err)
+		}
+
+		var seg Segment
+		err = reader.parseHeader(header, &seg)
+		if err != nil {
+			return 0, err
+		}
+		record := make([]byte, reader.recordSize(&seg))
+		copy(record, header)
+		_, err = io.ReadFull(r, record[reader.headerSize:])
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+
+		if skipped > 0 || seg.CreatedAt > at {
+			skipped++
+			continue
+		}
+		_, err = bw.Write(record)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return skipped, bw.Flush()
+}
+
+func downloadObject(ctx context.Context, store ObjectStore, object, path string) error {
+	body, err := store.Download(ctx, object)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fd, body)
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
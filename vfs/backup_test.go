@@ -0,0 +1,147 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackup(t *testing.T) {
+	open := func(dir string) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Index:     SkipListIndex,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	fetch := func(fss *LogStructuredFS, key string) string {
+		_, seg, err := fss.FetchSegment(key)
+		if err != nil {
+			return ""
+		}
+		text, err := seg.ToText()
+		assert.NoError(t, err)
+		return text.Content
+	}
+
+	ctx := context.Background()
+	fss := open(t.TempDir())
+	put := func(key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	_, err := fss.Backup(ctx)
+	assert.ErrorIs(t, err, ErrBackupDisabled)
+
+	// region 1 在时间点 before 之前封存，region 2 中有检查点，region 3 是活跃的 region
+	put("a", "v1")
+	put("b", "v1")
+	assert.NoError(t, fss.RolloverRegion())
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	put("a", "v2")
+	assert.NoError(t, fss.Checkpoint())
+	put("c", "v1")
+	assert.NoError(t, fss.RolloverRegion())
+	put("d", "v1")
+
+	store := &memoryStore{objects: make(map[string][]byte)}
+	assert.NoError(t, fss.SetBackup(BackupOptions{Store: store}))
+	n, err := fss.Backup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Contains(t, store.objects, manifestObject)
+	stats := fss.BackupStats()
+	assert.Equal(t, 2, stats.Regions)
+	assert.Equal(t, 1, stats.Checkpoints)
+	assert.Greater(t, stats.Bytes, int64(0))
+
+	n, err = fss.Backup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = RestoreBackup(ctx, &memoryStore{objects: make(map[string][]byte)}, t.TempDir(), time.Time{})
+	assert.ErrorContains(t, err, "no backup")
+
+	// 恢复到最新的备份时使用检查点，活跃 region 中的写入没有备份
+	dir := t.TempDir()
+	result, err := RestoreBackup(ctx, store, dir, time.Now().Add(2*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Regions)
+	assert.NotEmpty(t, result.Checkpoint)
+	assert.Equal(t, 0, result.Skipped)
+
+	_, err = RestoreBackup(ctx, store, dir, time.Time{})
+	assert.ErrorContains(t, err, "not empty")
+
+	restored := open(dir)
+	assert.Equal(t, "v2", fetch(restored, "a"))
+	assert.Equal(t, "v1", fetch(restored, "c"))
+	assert.Equal(t, "", fetch(restored, "d"))
+	assert.NoError(t, restored.CloseFS())
+
+	// 恢复到时间点 before 时截断之后写入的记录
+	dir = t.TempDir()
+	result, err = RestoreBackup(ctx, store, dir, before)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Checkpoint)
+	assert.Equal(t, 2, result.Skipped)
+
+	restored = open(dir)
+	assert.Equal(t, "v1", fetch(restored, "a"))
+	assert.Equal(t, "v1", fetch(restored, "b"))
+	assert.Equal(t, "", fetch(restored, "c"))
+	assert.NoError(t, restored.CloseFS())
+
+	// region 1 被回收之后，等到接收存活数据的 region 3 备份之后才过期删除
+	assert.NoError(t, fss.SetBackup(BackupOptions{Store: store, Retention: time.Nanosecond}))
+	fss.mu.Lock()
+	_ = fss.regions[1].Close()
+	delete(fss.regions, 1)
+	fss.mu.Unlock()
+	assert.NoError(t, os.Remove(filepath.Join(fss.directory, formatDataFileName(1))))
+
+	_, err = fss.Backup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fss.BackupStats().Regions)
+
+	assert.NoError(t, fss.RolloverRegion())
+	n, err = fss.Backup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	stats = fss.BackupStats()
+	assert.Equal(t, 2, stats.Regions)
+	assert.Equal(t, 1, stats.Checkpoints)
+	assert.NotContains(t, store.objects, "regions/"+formatDataFileName(1))
+	assert.True(t, stats.Since.After(before))
+
+	_, err = RestoreBackup(ctx, store, t.TempDir(), before)
+	assert.ErrorContains(t, err, "can only restore")
+	assert.NoError(t, fss.CloseFS())
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// prefixUpperBound 返回大于所有以 prefix 开头的 key 的最小字符串，空字符串表示没有上界
+func prefixUpperBound(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// MatchKeys returns the live keys that start with prefix and match the glob pattern of path.Match,
+// an empty pattern matches every key. Keys in the trash are never matched.
+// With SkipListIndex only the keys under prefix are visited, otherwise the regions are scanned.
+func (lfs *LogStructuredFS) MatchKeys(prefix, pattern string) ([]string, error) {
+	if pattern != "" {
+		// 提前检查模式的语法，避免扫描到一半才发现错误
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+		}
+	}
+
+	var keys []string
+	match := func(key string) {
+		if IsTrashKey(key) || !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, key); !ok {
+				return
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	if lfs.keys != nil {
+		var expired []string
+		lfs.keys.ascend(prefix, prefixUpperBound(prefix), func(key string) bool {
+			if _, ok := lfs.StatSegment(key); !ok {
+				expired = append(expired, key)
+				return true
+			}
+			match(key)
+			return true
+		})
+		for _, key := range expired {
+			lfs.keys.remove(key)
+		}
+		return keys, nil
+	}
+
+	err := lfs.RangeSegments(func(seg *Segment) bool {
+		match(seg.GetKeyString())
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteKeys deletes the keys returned by MatchKeys with DeleteSegment, so deleted keys
+// are replicated and moved to the trash like single deletes. It returns the number of deleted keys.
+func (lfs *LogStructuredFS) DeleteKeys(prefix, pattern string) (int, error) {
+	keys, err := lfs.MatchKeys(prefix, pattern)
+	if err != nil {
+		return 0, err
+	}
+	return lfs.deleteKeys(keys)
+}
+
+// deleteKeys 逐个删除 key，返回出错之前删除的个数
+func (lfs *LogStructuredFS) deleteKeys(keys []string) (int, error) {
+	for i, key := range keys {
+		err := lfs.DeleteSegment(key)
+		if err != nil {
+			return i, fmt.Errorf("failed to delete key %s: %w", key, err)
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"path"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixUpperBound(t *testing.T) {
+	assert.Equal(t, "session;", prefixUpperBound("session:"))
+	assert.Equal(t, "b", prefixUpperBound("a\xff"))
+	assert.Equal(t, "", prefixUpperBound("\xff\xff"))
+	assert.Equal(t, "", prefixUpperBound(""))
+}
+
+func TestDeleteKeys(t *testing.T) {
+	for _, index := range []IndexKind{HashIndex, SkipListIndex} {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      t.TempDir(),
+			Threshold: conf.Settings.Region.Threshold,
+			Index:     index,
+		})
+		assert.NoError(t, err)
+
+		for _, key := range []string{"session:1", "session:2", "session:admin", "sessions", "user:1:session"} {
+			seg, err := NewSegment(key, types.NewText("v"), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment(key, seg))
+		}
+
+		keys, err := fss.MatchKeys("session:", "")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"session:1", "session:2", "session:admin"}, keys)
+
+		keys, err = fss.MatchKeys("", "*:session")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user:1:session"}, keys)
+
+		_, err = fss.MatchKeys("", "[")
+		assert.ErrorIs(t, err, path.ErrBadPattern)
+
+		n, err := fss.DeleteKeys("session:", "session:?")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		keys, err = fss.MatchKeys("session", "")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"session:admin", "sessions"}, keys)
+
+		assert.NoError(t, fss.CloseFS())
+	}
+}
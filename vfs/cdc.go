@@ -0,0 +1,179 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// signalLSN 唤醒等待新写入的 WaitLSN，没有等待者时不需要分配 channel，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) signalLSN() {
+	if lfs.lsnSignal != nil {
+		close(lfs.lsnSignal)
+		lfs.lsnSignal = nil
+	}
+}
+
+// WaitLSN blocks until a record with a log sequence number greater than n is written or ctx is done.
+func (lfs *LogStructuredFS) WaitLSN(ctx context.Context, n uint64) error {
+	for {
+		lfs.mu.Lock()
+		if lfs.lsn > n {
+			lfs.mu.Unlock()
+			return nil
+		}
+		if lfs.lsnSignal == nil {
+			lfs.lsnSignal = make(chan struct{})
+		}
+		signal := lfs.lsnSignal
+		lfs.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-signal:
+		}
+	}
+}
+
+// ReadChanges returns up to limit records with a log sequence number greater than since in LSN order,
+// including overwritten versions and tombstones, so a consumer can tail every write by passing the LSN
+// of the last record it received. ErrLSNUnavailable is returned if since is lower than LSNHorizon,
+// the consumer has missed changes removed by compaction and must copy the current data again.
+// The returned segments are not taken from the pool.
+func (lfs *LogStructuredFS) ReadChanges(ctx context.Context, since uint64, limit int) ([]*Segment, error) {
+	err := lfs.checkHorizon(since)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只读取开始时已经写完的记录，active region 末尾可能有正在写入的记录
+	lfs.mu.RLock()
+	lsn, active, end := lfs.lsn, lfs.regionID, lfs.offset
+	lfs.mu.RUnlock()
+	if since >= lsn || limit <= 0 {
+		return nil, nil
+	}
+
+	// region 回收复制的记录不会超过 horizon，所以 since 之后的记录都是按照 region 和位置的顺序追加的
+	changes := make([]*Segment, 0)
+	for _, id := range lfs.regionIDs(true) {
+		if id > active || len(changes) >= limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if lfs.remoteMaxLSN(id) <= since {
+			continue
+		}
+
+		fd, release, err := lfs.openRegion(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if fd == nil {
+			continue
+		}
+
+		bound := int64(-1)
+		if id == active {
+			bound = int64(end)
+		}
+		err = rangeChanges(fd, bound, since, lsn, func(seg *Segment) bool {
+			changes = append(changes, seg)
+			return len(changes) < limit
+		})
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan region %d: %w", id, err)
+		}
+	}
+
+	// 扫描期间 region 回收可能丢弃了需要的记录
+	err = lfs.checkHorizon(since)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].LSN < changes[j].LSN
+	})
+	return changes, nil
+}
+
+// remoteMaxLSN 返回对象存储中的 region 的最大 LSN，存根中记录了每个 key 的最后一条记录，
+// 最大 LSN 的记录一定在其中，不需要下载 region。本地的 region 返回 math.MaxUint64 表示需要扫描
+func (lfs *LogStructuredFS) remoteMaxLSN(id uint64) uint64 {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	region, ok := lfs.remote[id]
+	if !ok {
+		return ^uint64(0)
+	}
+
+	var max uint64
+	for _, entry := range region.Index {
+		if entry.LSN > max {
+			max = entry.LSN
+		}
+	}
+	return max
+}
+
+// rangeChanges 先只读取记录头部，LSN 在 (since, upto] 之间的记录才读取整条记录，bound 小于 0 时读取到文件末尾
+func rangeChanges(fd *os.File, bound int64, since, upto uint64, fn func(seg *Segment) bool) error {
+	if bound < 0 {
+		finfo, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		bound = finfo.Size()
+	}
+
+	var (
+		reader = recordReaders[currentFormat]
+		header = make([]byte, reader.headerSize)
+		offset = int64(len(regionMetadata))
+		region = newRegionReader(fd, bound)
+	)
+	for offset < bound {
+		_, err := region.ReadAt(header, offset)
+		if err != nil {
+			return err
+		}
+
+		var head Segment
+		err = reader.parseHeader(header, &head)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		if head.LSN > since && head.LSN <= upto {
+			_, seg, err := region.readSegment(uint64(offset))
+			if err != nil {
+				return err
+			}
+			if !fn(seg) {
+				return nil
+			}
+		}
+		offset += reader.recordSize(&head)
+	}
+	return nil
+}
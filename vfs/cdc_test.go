@@ -0,0 +1,92 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadChanges(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	put := func(key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("a", "v1")
+	put("b", "v1")
+	assert.NoError(t, fss.RolloverRegion())
+	put("a", "v2")
+	assert.NoError(t, fss.DeleteSegment("b"))
+
+	segs, err := fss.ReadChanges(context.Background(), 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, segs, 4)
+	for i, seg := range segs {
+		assert.Equal(t, uint64(i+1), seg.LSN)
+	}
+	assert.Equal(t, "b", segs[3].GetKeyString())
+	assert.True(t, segs[3].IsTombstone())
+
+	segs, err = fss.ReadChanges(context.Background(), 1, 2)
+	assert.NoError(t, err)
+	assert.Len(t, segs, 2)
+	assert.Equal(t, uint64(2), segs[0].LSN)
+	assert.Equal(t, uint64(3), segs[1].LSN)
+
+	segs, err = fss.ReadChanges(context.Background(), 4, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, segs)
+
+	assert.NoError(t, fss.advanceHorizon())
+	_, err = fss.ReadChanges(context.Background(), 1, 10)
+	assert.ErrorIs(t, err, ErrLSNUnavailable)
+}
+
+func TestWaitLSN(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, fss.WaitLSN(ctx, 0), context.DeadlineExceeded)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fss.WaitLSN(context.Background(), 0)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	seg, err := NewSegment("a", types.NewText("v1"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("a", seg))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitLSN was not woken by the write")
+	}
+
+	assert.NoError(t, fss.WaitLSN(context.Background(), 0))
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"hash/crc32"
+	"os"
+	"sync"
+
+	"github.com/zeebo/xxh3"
+)
+
+// Checksum is the algorithm protecting the records of a region, it is recorded in the region header
+// so regions written with different algorithms can be read by the same file system.
+type Checksum uint8
+
+const (
+	// CRC32 is the IEEE CRC32 used by every region written before the algorithm was configurable.
+	CRC32 Checksum = iota
+	// CRC32C is the Castagnoli CRC32, computed with SSE4.2 or ARMv8 CRC instructions when available.
+	CRC32C
+	// XXH3 is the low 32 bits of the 64-bit XXH3 hash.
+	XXH3
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ParseChecksum converts the name used in configuration files to a Checksum.
+func ParseChecksum(name string) (Checksum, error) {
+	switch name {
+	case "", "crc32":
+		return CRC32, nil
+	case "crc32c":
+		return CRC32C, nil
+	case "xxh3":
+		return XXH3, nil
+	}
+	return CRC32, errors.New("unsupported checksum algorithm: " + name)
+}
+
+func (c Checksum) String() string {
+	switch c {
+	case CRC32:
+		return "crc32"
+	case CRC32C:
+		return "crc32c"
+	case XXH3:
+		return "xxh3"
+	}
+	return "unknown"
+}
+
+func (c Checksum) valid() bool {
+	return c <= XXH3
+}
+
+// sum 按顺序计算多段数据的校验和，记录分成头部、key 和 value 多段写入时不需要拼接，
+// 记录末尾的校验和固定为 4 个字节，XXH3 只保留低 32 位
+func (c Checksum) sum(parts ...[]byte) uint32 {
+	switch c {
+	case CRC32C:
+		return crc32Update(castagnoli, parts)
+	case XXH3:
+		h := xxh3Pool.Get().(*xxh3.Hasher)
+		h.Reset()
+		for _, p := range parts {
+			_, _ = h.Write(p)
+		}
+		sum := h.Sum64()
+		xxh3Pool.Put(h)
+		return uint32(sum)
+	}
+	return crc32Update(crc32.IEEETable, parts)
+}
+
+func crc32Update(table *crc32.Table, parts [][]byte) uint32 {
+	var crc uint32
+	for _, p := range parts {
+		crc = crc32.Update(crc, table, p)
+	}
+	return crc
+}
+
+var xxh3Pool = sync.Pool{
+	New: func() any {
+		return xxh3.New()
+	},
+}
+
+// regionChecksums 缓存已经打开的 region 文件头部记录的校验算法，避免每次读取记录时读取文件头部
+var regionChecksums sync.Map
+
+// regionChecksum 返回 region 文件使用的校验算法
+func regionChecksum(fd *os.File) (Checksum, error) {
+	if sum, ok := regionChecksums.Load(fd); ok {
+		return sum.(Checksum), nil
+	}
+
+	header := make([]byte, len(regionMetadata))
+	_, err := fd.ReadAt(header, 0)
+	if err != nil {
+		return CRC32, err
+	}
+
+	layout, err := regionFormat(fd.Name(), header)
+	if err != nil {
+		return CRC32, err
+	}
+	regionChecksums.Store(fd, layout.checksum)
+	return layout.checksum, nil
+}
+
+// forgetRegion 在 region 文件关闭或者删除之后清除缓存的校验算法
+func forgetRegion(fd *os.File) {
+	regionChecksums.Delete(fd)
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksum(t *testing.T) {
+	for name, want := range map[string]Checksum{"": CRC32, "crc32": CRC32, "crc32c": CRC32C, "xxh3": XXH3} {
+		sum, err := ParseChecksum(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, sum)
+	}
+
+	_, err := ParseChecksum("md5")
+	assert.Error(t, err)
+	assert.Equal(t, "xxh3", XXH3.String())
+
+	data := []byte("urnadb")
+	assert.NotEqual(t, CRC32.sum(data), CRC32C.sum(data))
+	assert.NotEqual(t, CRC32.sum(data), XXH3.sum(data))
+}
+
+func TestOpenFS_Checksum(t *testing.T) {
+	defer func() { checksumAlgorithm = CRC32 }()
+
+	dir := t.TempDir()
+	open := func(sum Checksum) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Checksum:  sum,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	put := func(fss *LogStructuredFS, key string) {
+		seg, err := NewSegment(key, types.NewText(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	_, err := OpenFS(&Options{FSPerm: conf.FSPerm, Path: dir, Threshold: 1, Checksum: XXH3 + 1})
+	assert.Error(t, err)
+
+	fss := open(XXH3)
+	put(fss, "a")
+	assert.NoError(t, fss.CloseFS())
+
+	header := make([]byte, len(regionMetadata))
+	fd, err := os.Open(filepath.Join(dir, formatDataFileName(1)))
+	assert.NoError(t, err)
+	_, err = fd.Read(header)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+	assert.Equal(t, formatHeader(XXH3, currentFormat), header)
+
+	// 修改校验算法之后旧的 region 仍然可以读取，新的记录写入新的 region
+	fss = open(CRC32C)
+	assert.Equal(t, uint64(2), fss.regionID)
+	put(fss, "b")
+	assert.Equal(t, "a", fetchText(fss, "a"))
+	assert.Equal(t, "b", fetchText(fss, "b"))
+	assert.NoError(t, fss.CloseFS())
+
+	// 使用相同的算法重启时继续向当前的 region 追加
+	fss = open(CRC32C)
+	assert.Equal(t, uint64(2), fss.regionID)
+	assert.Equal(t, "a", fetchText(fss, "a"))
+	assert.Equal(t, "b", fetchText(fss, "b"))
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestReadSegment_XXH3Corrupted(t *testing.T) {
+	seg, err := NewSegment("key", types.NewText("value"), 0)
+	assert.NoError(t, err)
+	data, err := serializedSegment(seg, XXH3)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), formatDataFileName(1))
+	region := append(formatHeader(XXH3, currentFormat), data...)
+	assert.NoError(t, os.WriteFile(path, region, conf.FSPerm))
+
+	fd, err := os.Open(path)
+	assert.NoError(t, err)
+	_, segment, err := readSegment(fd, uint64(len(regionMetadata)), SEGMENT_PADDING)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), segment.Key)
+	forgetRegion(fd)
+	assert.NoError(t, fd.Close())
+
+	// 记录的内容被修改之后 XXH3 校验和不一致
+	region[len(region)-6] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, region, conf.FSPerm))
+	fd, err = os.Open(path)
+	assert.NoError(t, err)
+	defer fd.Close()
+	defer forgetRegion(fd)
+	_, _, err = readSegment(fd, uint64(len(regionMetadata)), SEGMENT_PADDING)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
@@ -0,0 +1,307 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/auula/urnadb/types"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec is the serialization format of a segment value, it is recorded in the high bits of
+// the KIND byte of the record header so readers pick the decoder the value was written with.
+type Codec uint8
+
+const (
+	// MsgPack is used by every segment written before the codec was configurable.
+	MsgPack Codec = iota
+	// CBOR encodes the same values as MsgPack, except streams and queues.
+	CBOR
+	// Protobuf encodes numbers as a sint64 field and tables as a google.protobuf.Struct,
+	// integers in tables are stored in two extra fields of Value so they keep their precision.
+	Protobuf
+)
+
+// KIND 字节的低 4 位是数据类型，高 4 位是编解码器
+const (
+	kindMask   = 0x0f
+	codecShift = 4
+)
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+// ParseCodec converts the name used in configuration files to a Codec.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "msgpack":
+		return MsgPack, nil
+	case "cbor":
+		return CBOR, nil
+	case "protobuf":
+		return Protobuf, nil
+	}
+	return MsgPack, errors.New("unsupported value codec: " + name)
+}
+
+func (c Codec) String() string {
+	switch c {
+	case MsgPack:
+		return "msgpack"
+	case CBOR:
+		return "cbor"
+	case Protobuf:
+		return "protobuf"
+	}
+	return "unknown"
+}
+
+// Supports reports whether values of kind can be written with the codec.
+func (c Codec) Supports(kind Kind) bool {
+	switch c {
+	case MsgPack:
+		return true
+	case CBOR:
+		// Stream 和 Queue 整体序列化，部分字段只有 msgpack 标签
+		return kind != Stream && kind != Queue && kind != Unknown
+	case Protobuf:
+		return kind == Number || kind == Table
+	}
+	return false
+}
+
+// CodecPolicy chooses the codec of new values. The codec of the namespace of the key is used first,
+// then the codec of the data type and then Default, skipping codecs that do not support the data type.
+type CodecPolicy struct {
+	Default    Codec
+	Types      map[Kind]Codec
+	Namespaces map[string]Codec
+	// Separator ends the namespace of a key, namespace codecs are not used when it is empty
+	Separator string
+}
+
+// codecs 是新写入的值使用的编解码规则，为空时全部使用 MsgPack
+var codecs atomic.Pointer[CodecPolicy]
+
+// NewCodecPolicy parses the codec names used in configuration files, types are keyed by the
+// data type name and namespaces by the first-level key prefix.
+func NewCodecPolicy(defaultCodec string, kinds, namespaces map[string]string, separator string) (*CodecPolicy, error) {
+	policy := &CodecPolicy{
+		Types:      make(map[Kind]Codec, len(kinds)),
+		Namespaces: make(map[string]Codec, len(namespaces)),
+		Separator:  separator,
+	}
+
+	var err error
+	policy.Default, err = ParseCodec(defaultCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, codecName := range kinds {
+		kind, ok := kindOfName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown data type %s", name)
+		}
+		codec, err := ParseCodec(codecName)
+		if err != nil {
+			return nil, err
+		}
+		if !codec.Supports(kind) {
+			return nil, fmt.Errorf("%s values cannot be encoded with %s", name, codec)
+		}
+		policy.Types[kind] = codec
+	}
+
+	for namespace, codecName := range namespaces {
+		codec, err := ParseCodec(codecName)
+		if err != nil {
+			return nil, err
+		}
+		policy.Namespaces[namespace] = codec
+	}
+
+	return policy, nil
+}
+
+// codecFor 返回 key 的新值使用的编解码器
+func (p *CodecPolicy) codecFor(key string, kind Kind) Codec {
+	if p == nil {
+		return MsgPack
+	}
+
+	if p.Separator != "" {
+		if i := strings.Index(key, p.Separator); i > 0 {
+			if codec, ok := p.Namespaces[key[:i]]; ok && codec.Supports(kind) {
+				return codec
+			}
+		}
+	}
+	if codec, ok := p.Types[kind]; ok && codec.Supports(kind) {
+		return codec
+	}
+	if p.Default.Supports(kind) {
+		return p.Default
+	}
+	return MsgPack
+}
+
+func kindOfName(name string) (Kind, bool) {
+	for kind, s := range KindToString {
+		if s == name && kind != Unknown {
+			return kind, true
+		}
+	}
+	return Unknown, false
+}
+
+// SetCodecs sets the codecs of values written after it returns, existing values keep the codec
+// they were written with. A nil policy writes every value with MsgPack.
+func (lfs *LogStructuredFS) SetCodecs(policy *CodecPolicy) {
+	codecs.Store(policy)
+}
+
+// encodeValue 使用 key 对应的编解码器序列化值，MsgPack 直接使用数据类型自己的序列化方法
+func encodeValue(key string, data Serializable) ([]byte, Codec, error) {
+	kind := toKind(data)
+	codec := codecs.Load().codecFor(key, kind)
+	if codec == MsgPack {
+		bytes, err := data.ToBytes()
+		return bytes, MsgPack, err
+	}
+
+	payload := payloadOf(data)
+	if payload == nil {
+		bytes, err := data.ToBytes()
+		return bytes, MsgPack, err
+	}
+
+	var (
+		bytes []byte
+		err   error
+	)
+	switch codec {
+	case CBOR:
+		bytes, err = cbor.Marshal(payload)
+	case Protobuf:
+		bytes, err = protoMarshal(payload)
+	}
+	if err != nil {
+		return nil, codec, fmt.Errorf("%s encode: %w", codec, err)
+	}
+	return bytes, codec, nil
+}
+
+// payloadOf 返回数据类型序列化的字段，和 Segment 的 ToXxx 方法解码的目标相同
+func payloadOf(data Serializable) any {
+	switch v := data.(type) {
+	case *types.Set:
+		return &v.Set
+	case *types.ZSet:
+		return &v.ZSet
+	case *types.Text:
+		return &v.Content
+	case *types.Table:
+		return &v.Table
+	case *types.Number:
+		return &v.Value
+	case *types.Collection:
+		return &v.Collection
+	case *types.HLL:
+		return &v.Registers
+	case *types.Series:
+		return &v.Points
+	}
+	return nil
+}
+
+// unmarshal 按照写入时的编解码器把值解码到 v 中
+func (s *Segment) unmarshal(v any) error {
+	switch s.Codec {
+	case MsgPack:
+		return msgpackUnmarshal(s.Value, v)
+	case CBOR:
+		return cborDecMode.Unmarshal(s.Value, v)
+	case Protobuf:
+		return protoUnmarshal(s.Value, v)
+	}
+	return fmt.Errorf("unsupported value codec %d", s.Codec)
+}
+
+// msgpackUnmarshal 把 msgpack 中的整数解码为 int64 或 uint64，浮点数解码为 float64，
+// 默认的解码方式按照编码时的宽度解码为 int8、uint16 等类型，同一个值写入之后读取出来的类型不同
+func msgpackUnmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.UseLooseInterfaceDecoding(true)
+	return dec.Decode(v)
+}
+
+// protoMarshal 把 Number 编码为字段 1 的 sint64，Table 编码为增加了整数字段的 google.protobuf.Struct
+func protoMarshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case *int64:
+		b := protowire.AppendTag(nil, 1, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeZigZag(*v)), nil
+	case *map[string]any:
+		return appendProtoStruct(nil, *v)
+	}
+	return nil, fmt.Errorf("protobuf does not support %T", v)
+}
+
+func protoUnmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *int64:
+		*v = 0
+		for len(data) > 0 {
+			num, typ, n := protowire.ConsumeTag(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			if num == 1 && typ == protowire.VarintType {
+				x, n := protowire.ConsumeVarint(data)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				*v = protowire.DecodeZigZag(x)
+				data = data[n:]
+				continue
+			}
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+		return nil
+	case *map[string]any:
+		m, err := consumeProtoStruct(data)
+		if err != nil {
+			return err
+		}
+		*v = m
+		return nil
+	}
+	return fmt.Errorf("protobuf does not support %T", v)
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"math"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCodecPolicy(t *testing.T) {
+	_, err := NewCodecPolicy("json", nil, nil, ":")
+	assert.Error(t, err)
+	_, err = NewCodecPolicy("msgpack", map[string]string{"text": "protobuf"}, nil, ":")
+	assert.Error(t, err)
+	_, err = NewCodecPolicy("msgpack", map[string]string{"unknown": "cbor"}, nil, ":")
+	assert.Error(t, err)
+
+	policy, err := NewCodecPolicy("cbor",
+		map[string]string{"number": "protobuf"},
+		map[string]string{"metrics": "protobuf", "raw": "msgpack"}, ":")
+	assert.NoError(t, err)
+
+	assert.Equal(t, Protobuf, policy.codecFor("counter", Number))
+	assert.Equal(t, CBOR, policy.codecFor("counter", Text))
+	// 命名空间优先于类型，不支持的类型按照类型和默认规则选择
+	assert.Equal(t, MsgPack, policy.codecFor("raw:counter", Number))
+	assert.Equal(t, Protobuf, policy.codecFor("metrics:user", Table))
+	assert.Equal(t, CBOR, policy.codecFor("metrics:name", Text))
+	// 默认的 CBOR 不支持 Stream
+	assert.Equal(t, MsgPack, policy.codecFor("events", Stream))
+
+	var none *CodecPolicy
+	assert.Equal(t, MsgPack, none.codecFor("counter", Number))
+}
+
+func TestSegmentCodecs(t *testing.T) {
+	defer codecs.Store(nil)
+
+	table := types.NewTable()
+	table.Table = map[string]any{"name": "alice", "age": float64(30), "tags": []any{"a", "b"}, "address": map[string]any{"city": "Paris"}}
+	set := types.NewSet()
+	set.Add("alice")
+	series := types.NewSeries()
+	series.Add(types.Point{Time: 1, Value: 1.5})
+
+	values := []Serializable{
+		table,
+		types.NewNumber(math.MinInt64),
+		types.NewNumber(42),
+		types.NewText("hello"),
+		set,
+		series,
+	}
+
+	for _, codec := range []Codec{MsgPack, CBOR, Protobuf} {
+		codecs.Store(&CodecPolicy{Default: codec})
+		for _, data := range values {
+			seg, err := NewSegment("key", data, 0)
+			assert.NoError(t, err)
+			if !codec.Supports(seg.Type) {
+				assert.Equal(t, MsgPack, seg.Codec)
+			} else {
+				assert.Equal(t, codec, seg.Codec, seg.GetTypeString())
+			}
+
+			expected, err := data.(interface{ ToJSON() ([]byte, error) }).ToJSON()
+			assert.NoError(t, err)
+			actual, err := seg.ToJSON()
+			assert.NoError(t, err, codec.String())
+			assert.JSONEq(t, string(expected), string(actual), codec.String())
+		}
+	}
+}
+
+func TestSegmentCodecPersisted(t *testing.T) {
+	defer codecs.Store(nil)
+
+	dir := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open()
+	policy, err := NewCodecPolicy("msgpack", map[string]string{"number": "protobuf"}, nil, ":")
+	assert.NoError(t, err)
+	fss.SetCodecs(policy)
+
+	seg, err := NewSegment("counter", types.NewNumber(-7), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("counter", seg))
+
+	// 修改编解码规则之后旧的值仍然使用写入时的编解码器读取
+	fss.SetCodecs(nil)
+	assert.NoError(t, fss.CloseFS())
+
+	fss = open()
+	defer fss.CloseFS()
+
+	_, seg, err = fss.FetchSegment("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, Protobuf, seg.Codec)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-7), number.Value)
+}
+
+func TestDecodeHeaderV3(t *testing.T) {
+	seg := &Segment{Type: Table, Codec: Protobuf, Key: []byte("k"), Value: []byte{}}
+	e := encodeSegment(seg, CRC32)
+	defer e.release()
+
+	var decoded Segment
+	decodeHeaderV3(e.header[:], &decoded)
+	assert.Equal(t, Table, decoded.Type)
+	assert.Equal(t, Protobuf, decoded.Codec)
+
+	// 之前版本的记录都是 MsgPack
+	decoded.Codec = CBOR
+	decodeHeaderV2(e.header[:], &decoded)
+	assert.Equal(t, MsgPack, decoded.Codec)
+}
+
+func TestProtobufTableIntegers(t *testing.T) {
+	defer codecs.Store(nil)
+	codecs.Store(&CodecPolicy{Default: Protobuf})
+
+	table := types.NewTable()
+	table.Table = map[string]any{
+		"id":    int64(1<<62 + 1),
+		"max":   uint64(math.MaxUint64),
+		"min":   int64(math.MinInt64),
+		"ratio": 0.5,
+		"tags":  []any{int64(9007199254740993), "a", nil, true},
+		"owner": map[string]any{"uid": int64(-9007199254740993)},
+	}
+
+	seg, err := NewSegment("key", table, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, Protobuf, seg.Codec)
+
+	decoded, err := seg.ToTable()
+	assert.NoError(t, err)
+	assert.Equal(t, table.Table, decoded.Table)
+
+	// 之前按照 google.protobuf.Struct 写入的值仍然可以读取
+	st, err := structpb.NewStruct(map[string]any{"age": 30, "name": "alice", "tags": []any{"a"}})
+	assert.NoError(t, err)
+	seg.Value, err = proto.Marshal(st)
+	assert.NoError(t, err)
+	decoded, err = seg.ToTable()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"age": float64(30), "name": "alice", "tags": []any{"a"}}, decoded.Table)
+}
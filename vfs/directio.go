@@ -0,0 +1,191 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// directAlignment 是直接 I/O 要求的内存地址、文件偏移和长度的对齐大小
+	directAlignment = 4096
+	// directBufferSize 是直接 I/O 写入缓冲区的大小，大记录按照这个大小分批写入
+	directBufferSize = 1024 * 1024
+)
+
+// ErrDirectIOUnsupported is returned by OpenFS when Options.DirectIO is set on a platform without direct I/O.
+var ErrDirectIOUnsupported = errors.New("direct I/O is not supported on this platform")
+
+// alignedBufferPool 中的缓冲区起始地址按照 directAlignment 对齐
+var alignedBufferPool = sync.Pool{
+	New: func() any {
+		raw := make([]byte, directBufferSize+directAlignment)
+		shift := 0
+		if rem := int(uintptr(unsafe.Pointer(&raw[0])) & (directAlignment - 1)); rem != 0 {
+			shift = directAlignment - rem
+		}
+		buf := raw[shift : shift+directBufferSize : shift+directBufferSize]
+		return &buf
+	},
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directAlignment - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directAlignment - 1)
+}
+
+// directWriter 绕过页缓存向 active region 追加记录，避免大量导入数据时把热数据挤出页缓存。
+// 缓冲区中只保留最后一个不完整的块，每次写入都把它补齐之后和新的数据一起写入，再把文件截断到实际的长度，
+// 写入返回之后数据已经在文件中，和缓冲写入一样可以通过 region 的文件描述符读取
+type directWriter struct {
+	fd   *os.File
+	buf  *[]byte
+	base int64 // buf[0] 在文件中的偏移，按照 directAlignment 对齐
+	n    int   // buf 中有效数据的长度
+}
+
+// newDirectWriter 打开 region 的直接 I/O 文件描述符，从 end 开始追加
+func newDirectWriter(name string, end int64) (*directWriter, error) {
+	fd, err := openDirectFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &directWriter{
+		fd:  fd,
+		buf: alignedBufferPool.Get().(*[]byte),
+	}
+
+	err = w.load(end)
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// load 从文件中读取 end 所在的不完整的块，之后从 end 开始追加
+func (w *directWriter) load(end int64) error {
+	w.base, w.n = alignDown(end), int(end-alignDown(end))
+	if w.n == 0 {
+		return nil
+	}
+
+	buf := *w.buf
+	n, err := w.fd.ReadAt(buf[:directAlignment], w.base)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read region tail block: %w", err)
+	}
+	if n < w.n {
+		return fmt.Errorf("region is shorter than %d bytes", end)
+	}
+	return nil
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	end := w.base + int64(w.n)
+	buf := *w.buf
+
+	written := 0
+	for written < len(p) {
+		c := copy(buf[w.n:], p[written:])
+		w.n += c
+
+		size := alignUp(int64(w.n))
+		_, err := w.fd.WriteAt(buf[:size], w.base)
+		if err != nil {
+			return 0, w.rollback(end, err)
+		}
+		written += c
+
+		// 完整的块已经写入，只保留最后一个不完整的块
+		full := alignDown(int64(w.n))
+		copy(buf, buf[full:w.n])
+		w.base += full
+		w.n -= int(full)
+	}
+
+	// 补齐的部分超出了实际的长度，截断之后文件的长度和缓冲写入一致
+	err := w.fd.Truncate(w.base + int64(w.n))
+	if err != nil {
+		return 0, w.rollback(end, err)
+	}
+
+	return written, nil
+}
+
+// rollback 写入失败时丢弃这次写入的数据，下一次写入仍然从 end 开始
+func (w *directWriter) rollback(end int64, cause error) error {
+	err := w.fd.Truncate(end)
+	if err == nil {
+		err = w.load(end)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to direct write region: %w", errors.Join(cause, err))
+	}
+	return fmt.Errorf("failed to direct write region: %w", cause)
+}
+
+func (w *directWriter) close() error {
+	if w.buf != nil {
+		alignedBufferPool.Put(w.buf)
+		w.buf = nil
+	}
+	return w.fd.Close()
+}
+
+// regionWriter 返回追加记录使用的 Writer，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) regionWriter() io.Writer {
+	if lfs.direct != nil {
+		return lfs.direct
+	}
+	return lfs.active
+}
+
+// openDirectWriter 在开启直接 I/O 时为新的 active region 打开直接 I/O 的文件描述符，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) openDirectWriter(end int64) error {
+	if !lfs.directIO {
+		return nil
+	}
+
+	lfs.closeDirectWriter()
+
+	w, err := newDirectWriter(lfs.active.Name(), end)
+	if err != nil {
+		return fmt.Errorf("failed to open direct I/O region: %w", err)
+	}
+	lfs.direct = w
+	return nil
+}
+
+// closeDirectWriter 关闭 active region 的直接 I/O 文件描述符，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) closeDirectWriter() {
+	if lfs.direct != nil {
+		err := lfs.direct.close()
+		if err != nil {
+			vlog.Warnf("failed to close direct I/O region: %v", err)
+		}
+		lfs.direct = nil
+	}
+}
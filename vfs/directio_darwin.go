@@ -0,0 +1,36 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openDirectFile 打开 region 之后设置 F_NOCACHE，macOS 没有 O_DIRECT
+func openDirectFile(name string) (*os.File, error) {
+	fd, err := os.OpenFile(name, os.O_RDWR, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_NOCACHE, 1)
+	if errno != 0 {
+		fd.Close()
+		return nil, fmt.Errorf("failed to set F_NOCACHE: %w", errno)
+	}
+
+	return fd, nil
+}
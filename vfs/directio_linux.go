@@ -0,0 +1,24 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile 使用 O_DIRECT 打开 region，读写都不经过页缓存，不能使用 O_APPEND
+func openDirectFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|syscall.O_DIRECT, fsPerm)
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// skipWithoutDirectIO 在不支持直接 I/O 的平台或者文件系统（例如 tmpfs）上跳过测试
+func skipWithoutDirectIO(t *testing.T, dir string) {
+	name := filepath.Join(dir, "probe")
+	assert.NoError(t, os.WriteFile(name, nil, 0644))
+	fd, err := openDirectFile(name)
+	if err != nil {
+		t.Skipf("direct I/O is not available: %v", err)
+	}
+	fd.Close()
+	os.Remove(name)
+}
+
+func TestDirectWriter(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutDirectIO(t, dir)
+
+	name := filepath.Join(dir, "region")
+	assert.NoError(t, os.WriteFile(name, regionMetadata, 0644))
+
+	w, err := newDirectWriter(name, int64(len(regionMetadata)))
+	assert.NoError(t, err)
+
+	expected := bytes.NewBuffer(append([]byte(nil), regionMetadata...))
+	for i, size := range []int{1, 100, directAlignment, directAlignment + 1, directBufferSize + 123, 7} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		n, err := w.Write(data)
+		assert.NoError(t, err)
+		assert.Equal(t, size, n)
+		expected.Write(data)
+
+		content, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Len(), len(content))
+		assert.True(t, bytes.Equal(expected.Bytes(), content))
+	}
+	assert.NoError(t, w.close())
+
+	// 重新打开之后从文件末尾不完整的块继续追加
+	w, err = newDirectWriter(name, int64(expected.Len()))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("tail"))
+	assert.NoError(t, err)
+	expected.WriteString("tail")
+	assert.NoError(t, w.close())
+
+	content, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(expected.Bytes(), content))
+}
+
+func TestDirectIOFS(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutDirectIO(t, dir)
+
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			DirectIO:  true,
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, fss.direct)
+		return fss
+	}
+
+	put := func(fss *LogStructuredFS, key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open()
+	for i := 0; i < 100; i++ {
+		put(fss, fmt.Sprintf("key-%d", i), strings.Repeat("v", i*97))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, strings.Repeat("v", i*97), fetchText(fss, fmt.Sprintf("key-%d", i)))
+	}
+	assert.NoError(t, fss.CloseFS())
+
+	fss = open()
+	defer fss.CloseFS()
+	put(fss, "after", "reopen")
+	assert.Equal(t, "reopen", fetchText(fss, "after"))
+	assert.Equal(t, strings.Repeat("v", 99*97), fetchText(fss, "key-99"))
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// 不超过 smallRecordSize 的记录复制到池化的缓冲区中一次写入，
+// 更大的记录按照 头部、key、value、校验和 分段写入，不复制 value
+const smallRecordSize = 64 * 1024
+
+// encodedSegment 是编码之后的一条记录，头部和校验和保存在自己的数组中，key 和 value 直接引用 Segment 的数据，
+// 写入完成之前不能修改 Segment，使用之后通过 release 放回对象池
+type encodedSegment struct {
+	header  [SEGMENT_PADDING]byte
+	trailer [4]byte
+	parts   [4][]byte
+	size    int
+}
+
+var encodedPool = sync.Pool{
+	New: func() any {
+		return new(encodedSegment)
+	},
+}
+
+var recordBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, smallRecordSize)
+		return &buf
+	},
+}
+
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | LSN 8 | KEY ? | VALUE ? | CHECKSUM 4 |
+// KIND 的低 4 位是数据类型，高 4 位是 Value 的编解码器
+func encodeSegment(seg *Segment, sum Checksum) *encodedSegment {
+	e := encodedPool.Get().(*encodedSegment)
+
+	e.header[0] = byte(seg.Tombstone)
+	e.header[1] = byte(seg.Type) | byte(seg.Codec)<<codecShift
+	binary.LittleEndian.PutUint64(e.header[2:10], seg.ExpiredAt)
+	binary.LittleEndian.PutUint64(e.header[10:18], seg.CreatedAt)
+	binary.LittleEndian.PutUint32(e.header[18:22], seg.KeySize)
+	binary.LittleEndian.PutUint32(e.header[22:26], seg.ValueSize)
+	binary.LittleEndian.PutUint64(e.header[26:34], seg.LSN)
+	binary.LittleEndian.PutUint32(e.trailer[:], sum.sum(e.header[:], seg.Key, seg.Value))
+
+	e.parts = [4][]byte{e.header[:], seg.Key, seg.Value, e.trailer[:]}
+	e.size = SEGMENT_PADDING + len(seg.Key) + len(seg.Value) + len(e.trailer)
+	return e
+}
+
+// Len 返回记录编码之后的长度
+func (e *encodedSegment) Len() int {
+	return e.size
+}
+
+// appendTo 把记录追加到 dst 中并返回追加之后的切片
+func (e *encodedSegment) appendTo(dst []byte) []byte {
+	for _, p := range e.parts {
+		dst = append(dst, p...)
+	}
+	return dst
+}
+
+// writeTo 把记录写入 w，小记录拼接之后一次写入，大记录使用 net.Buffers 分段写入
+func (e *encodedSegment) writeTo(w io.Writer) error {
+	var (
+		n   int64
+		err error
+	)
+	if e.size <= smallRecordSize {
+		buf := recordBufferPool.Get().(*[]byte)
+		*buf = e.appendTo((*buf)[:0])
+		var wn int
+		wn, err = w.Write(*buf)
+		n = int64(wn)
+		recordBufferPool.Put(buf)
+	} else {
+		// net.Buffers 写入时会消耗切片，使用副本保留 parts
+		parts := e.parts
+		bufs := net.Buffers(parts[:])
+		n, err = bufs.WriteTo(w)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to append binary data to active region: %w", err)
+	}
+	if n != int64(e.size) {
+		return fmt.Errorf("partial write error: expected %d bytes, but wrote %d bytes", e.size, n)
+	}
+	return nil
+}
+
+// release 清除对 Segment 数据的引用并且放回对象池
+func (e *encodedSegment) release() {
+	e.parts = [4][]byte{}
+	e.size = 0
+	encodedPool.Put(e)
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeSegment(t *testing.T) {
+	for _, sum := range []Checksum{CRC32, CRC32C, XXH3} {
+		for _, size := range []int{0, 100, smallRecordSize, 3 * smallRecordSize} {
+			seg := &Segment{
+				Tombstone: 0,
+				Type:      Text,
+				ExpiredAt: 11,
+				CreatedAt: 22,
+				LSN:       33,
+				Key:       []byte("key"),
+				KeySize:   3,
+				Value:     bytes.Repeat([]byte{'v'}, size),
+				ValueSize: uint32(size),
+			}
+
+			// 分段计算的校验和和拼接之后计算的一致
+			record := encodeSegment(seg, sum)
+			contiguous := record.appendTo(nil)
+			body := contiguous[:len(contiguous)-4]
+			assert.Equal(t, sum.sum(body), binary.LittleEndian.Uint32(contiguous[len(body):]))
+			assert.Equal(t, int(seg.Size()), record.Len())
+
+			path := filepath.Join(t.TempDir(), formatDataFileName(1))
+			fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, conf.FSPerm)
+			assert.NoError(t, err)
+			_, err = fd.Write(formatHeader(sum, currentFormat))
+			assert.NoError(t, err)
+			assert.NoError(t, record.writeTo(fd))
+			record.release()
+
+			data, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, contiguous, data[len(regionMetadata):])
+
+			_, decoded, err := readSegment(fd, uint64(len(regionMetadata)), SEGMENT_PADDING)
+			assert.NoError(t, err)
+			assert.Equal(t, seg.LSN, decoded.LSN)
+			assert.Equal(t, seg.Value, decoded.Value)
+			forgetRegion(fd)
+			assert.NoError(t, fd.Close())
+		}
+	}
+}
+
+func TestEncodeSegment_LargeValueNoCopy(t *testing.T) {
+	value := bytes.Repeat([]byte{'v'}, 4<<20)
+	seg := &Segment{Type: Text, Key: []byte("key"), KeySize: 3, Value: value, ValueSize: uint32(len(value))}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 10; i++ {
+		record := encodeSegment(seg, CRC32C)
+		assert.NoError(t, record.writeTo(io.Discard))
+		record.release()
+	}
+	runtime.ReadMemStats(&after)
+
+	// 写入大记录时不会复制 value
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(value)))
+}
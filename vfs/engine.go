@@ -0,0 +1,94 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+// 每个索引项除了 Inode 之外的开销：map 中的 inum 和指针，以及 bucket 的元数据和空闲槽位的平均摊销
+const indexEntryOverhead = 8 + 8 + 16
+
+// 有序索引每个节点的开销：节点本身和平均 2 层的 next 指针，不包括 key 的内容
+const skipNodeOverhead = unsafe.Sizeof(skipNode{}) + 2*8
+
+// EngineStats is a point-in-time view of the storage engine internals used for monitoring and alerting.
+type EngineStats struct {
+	// ActiveRegion is the id of the region receiving writes
+	ActiveRegion uint64 `json:"active_region"`
+	// Regions is the number of local and remote regions, including the active region
+	Regions int `json:"regions"`
+	// CompactionBacklog is the overwritten, deleted and tombstone bytes in inactive local regions
+	// that compaction can reclaim
+	CompactionBacklog uint64 `json:"compaction_backlog"`
+	// LastCheckpoint is zero when no index checkpoint has been generated
+	LastCheckpoint time.Time `json:"last_checkpoint"`
+	// IndexMemory is an estimate of the bytes used by the in-memory indexes, excluding key contents
+	IndexMemory uint64 `json:"index_memory"`
+	// IndexSpilled is the size of the index shards spilled to disk by RunIndexSpill
+	IndexSpilled uint64 `json:"index_spilled"`
+	// Recovery is how long OpenFS took to recover the regions and indexes
+	Recovery time.Duration `json:"recovery"`
+}
+
+// EngineStats returns the current storage engine statistics.
+func (lfs *LogStructuredFS) EngineStats() (EngineStats, error) {
+	regions, err := lfs.Regions()
+	if err != nil {
+		return EngineStats{}, err
+	}
+
+	stats := EngineStats{
+		Regions:  len(regions),
+		Recovery: lfs.recovery,
+	}
+
+	lfs.mu.RLock()
+	stats.ActiveRegion = lfs.regionID
+	lfs.mu.RUnlock()
+
+	for _, region := range regions {
+		if !region.Active && !region.Remote {
+			stats.CompactionBacklog += region.DeadBytes
+		}
+	}
+
+	if ts := lfs.checkpointAt.Load(); ts > 0 {
+		stats.LastCheckpoint = time.Unix(ts, 0)
+	}
+
+	index := lfs.IndexStats()
+	stats.IndexMemory, stats.IndexSpilled = index.MemoryBytes, index.SpilledBytes
+	if lfs.keys != nil {
+		lfs.keys.mu.RLock()
+		stats.IndexMemory += uint64(lfs.keys.length) * uint64(skipNodeOverhead)
+		lfs.keys.mu.RUnlock()
+	}
+
+	return stats, nil
+}
+
+// recoverCheckpointTime 使用目录中最新的检查点文件名中的时间作为上次生成检查点的时间
+func (lfs *LogStructuredFS) recoverCheckpointTime() {
+	files, _ := filepath.Glob(filepath.Join(lfs.directory, "*.ids"))
+	for _, file := range files {
+		ckpt, ok := parseCheckpointName(filepath.Base(file))
+		if ok && ckpt.Timestamp > lfs.checkpointAt.Load() {
+			lfs.checkpointAt.Store(ckpt.Timestamp)
+		}
+	}
+}
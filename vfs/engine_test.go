@@ -0,0 +1,81 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineStats(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Index:     SkipListIndex,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	put := func(fss *LogStructuredFS, key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open()
+	stats, err := fss.EngineStats()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Regions)
+	assert.Zero(t, stats.CompactionBacklog)
+	assert.True(t, stats.LastCheckpoint.IsZero())
+	assert.Zero(t, stats.IndexMemory)
+	assert.Greater(t, stats.Recovery, time.Duration(0))
+
+	put(fss, "a", "v1")
+	put(fss, "b", "v1")
+	put(fss, "a", "v2")
+	active := stats.ActiveRegion
+	assert.NoError(t, fss.RolloverRegion())
+
+	// 被覆盖的版本在不再写入的 region 中，等待回收
+	stats, err = fss.EngineStats()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Regions)
+	assert.NotEqual(t, active, stats.ActiveRegion)
+	assert.Greater(t, stats.CompactionBacklog, uint64(0))
+	assert.Greater(t, stats.IndexMemory, uint64(0))
+
+	assert.NoError(t, fss.Checkpoint())
+	stats, err = fss.EngineStats()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), stats.LastCheckpoint, 2*time.Second)
+
+	// 重启之后从检查点文件名恢复上次生成检查点的时间
+	checkpointAt := stats.LastCheckpoint
+	assert.NoError(t, fss.CloseFS())
+	fss = open()
+	defer fss.CloseFS()
+
+	stats, err = fss.EngineStats()
+	assert.NoError(t, err)
+	assert.Equal(t, checkpointAt, stats.LastCheckpoint)
+}
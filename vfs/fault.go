@@ -0,0 +1,117 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// ErrInjectedFault is returned by reads and writes failed by fault injection.
+var ErrInjectedFault = errors.New("injected fault")
+
+// Faults configures fault injection for testing how clients retry and how the file system recovers
+// when the disk is slow or failing. Delay is added to every region read and write. ReadErrorRate and
+// WriteErrorRate are the probabilities that a read or write fails with ErrInjectedFault, and TornWriteRate
+// is the probability that a write stores only part of its record before failing.
+type Faults struct {
+	Delay          time.Duration
+	ReadErrorRate  float64
+	WriteErrorRate float64
+	TornWriteRate  float64
+}
+
+// Validate returns an error if a probability is not between 0 and 1 or the delay is negative.
+func (f Faults) Validate() error {
+	if f.Delay < 0 {
+		return errors.New("fault delay cannot be negative")
+	}
+	for _, rate := range []float64{f.ReadErrorRate, f.WriteErrorRate, f.TornWriteRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault probability %v must be between 0 and 1", rate)
+		}
+	}
+	return nil
+}
+
+// SetFaults enables fault injection, the zero Faults disables it.
+func (lfs *LogStructuredFS) SetFaults(f Faults) error {
+	err := f.Validate()
+	if err != nil {
+		return err
+	}
+	if f == (Faults{}) {
+		lfs.faults.Store(nil)
+		return nil
+	}
+	lfs.faults.Store(&f)
+	vlog.Warnf("Fault injection enabled: delay %s, read errors %v, write errors %v, torn writes %v",
+		f.Delay, f.ReadErrorRate, f.WriteErrorRate, f.TornWriteRate)
+	return nil
+}
+
+// Faults returns the current fault injection settings.
+func (lfs *LogStructuredFS) Faults() Faults {
+	if f := lfs.faults.Load(); f != nil {
+		return *f
+	}
+	return Faults{}
+}
+
+// injectReadFault 在读取 region 之前注入延迟和错误，没有开启时直接返回
+func (lfs *LogStructuredFS) injectReadFault() error {
+	f := lfs.faults.Load()
+	if f == nil {
+		return nil
+	}
+	time.Sleep(f.Delay)
+	if rand.Float64() < f.ReadErrorRate {
+		return fmt.Errorf("failed to read segment: %w", ErrInjectedFault)
+	}
+	return nil
+}
+
+// faultWriter 返回注入延迟、写入错误和不完整写入的 Writer，没有开启时返回 w
+func (lfs *LogStructuredFS) faultWriter(w io.Writer) io.Writer {
+	f := lfs.faults.Load()
+	if f == nil {
+		return w
+	}
+	return &faultWriter{w: w, faults: f}
+}
+
+type faultWriter struct {
+	w      io.Writer
+	faults *Faults
+}
+
+func (fw *faultWriter) Write(p []byte) (int, error) {
+	time.Sleep(fw.faults.Delay)
+	if rand.Float64() < fw.faults.WriteErrorRate {
+		return 0, ErrInjectedFault
+	}
+	// 只写入一部分数据，和写入过程中断电一样在 region 末尾留下不完整的记录
+	if len(p) > 1 && rand.Float64() < fw.faults.TornWriteRate {
+		n, err := fw.w.Write(p[:1+rand.Intn(len(p)-1)])
+		if err != nil {
+			return n, err
+		}
+		return n, ErrInjectedFault
+	}
+	return fw.w.Write(p)
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaults(t *testing.T) {
+	dir := t.TempDir()
+	fss := openLSNTestFS(t, dir)
+
+	put := func(key, content string) error {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		return fss.PutSegment(key, seg)
+	}
+	size := func() int64 {
+		finfo, err := fss.active.Stat()
+		assert.NoError(t, err)
+		return finfo.Size()
+	}
+
+	assert.Error(t, fss.SetFaults(Faults{ReadErrorRate: 2}))
+	assert.Error(t, fss.SetFaults(Faults{Delay: -time.Second}))
+
+	assert.NoError(t, put("a", "v1"))
+	lsn, before := fss.LSN(), size()
+
+	assert.NoError(t, fss.SetFaults(Faults{WriteErrorRate: 1}))
+	assert.ErrorIs(t, put("b", "v1"), ErrInjectedFault)
+	assert.Equal(t, lsn, fss.LSN())
+	assert.Equal(t, before, size())
+
+	// 不完整的记录被截断，之后的写入和重启都不受影响
+	assert.NoError(t, fss.SetFaults(Faults{TornWriteRate: 1}))
+	for i := 0; i < 10; i++ {
+		assert.ErrorIs(t, put("b", "v1"), ErrInjectedFault)
+		assert.Equal(t, before, size())
+	}
+	assert.Equal(t, lsn, fss.LSN())
+
+	assert.NoError(t, fss.SetFaults(Faults{ReadErrorRate: 1, Delay: 20 * time.Millisecond}))
+	assert.Equal(t, Faults{ReadErrorRate: 1, Delay: 20 * time.Millisecond}, fss.Faults())
+	start := time.Now()
+	_, _, err := fss.FetchSegment("a")
+	assert.ErrorIs(t, err, ErrInjectedFault)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	assert.NoError(t, fss.SetFaults(Faults{}))
+	assert.Equal(t, Faults{}, fss.Faults())
+	assert.NoError(t, put("b", "v2"))
+	assert.Equal(t, "v1", fetchText(fss, "a"))
+	assert.NoError(t, fss.CloseFS())
+
+	fss = openLSNTestFS(t, dir)
+	defer fss.CloseFS()
+	assert.Equal(t, "v1", fetchText(fss, "a"))
+	assert.Equal(t, "v2", fetchText(fss, "b"))
+	assert.Equal(t, lsn+1, fss.LSN())
+}
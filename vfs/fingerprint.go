@@ -0,0 +1,284 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// ErrKeyCollision is returned by writes with the fingerprint index when the key collides with two other keys.
+var ErrKeyCollision = errors.New("key fingerprint collides with other keys")
+
+const (
+	// 记录冲突 key 的文件，每一项的格式是 | KLEN 4 | KEY ? |
+	fingerprintFile = "fingerprint.idx"
+	// 冲突的 key 使用这个种子重新计算 inum
+	fingerprintSeed = 0x5bd1e995
+)
+
+// fingerprintTable 记录指纹索引中和已有的 key 哈希冲突的 key，这些 key 改用另一个种子计算 inum。
+// 冲突的 key 只会追加不会删除，inum 只取决于 key 和这个集合，扫描 region、检查点和 WAL 恢复的结果都一致
+type fingerprintTable struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	keys map[string]struct{}
+	size atomic.Int64
+}
+
+// openFingerprintTable 加载数据目录中记录的冲突 key，追加到一半的最后一项被截断
+func openFingerprintTable(directory string) (*fingerprintTable, error) {
+	fd, err := os.OpenFile(filepath.Join(directory, fingerprintFile), os.O_CREATE|os.O_RDWR, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	fp := &fingerprintTable{fd: fd, keys: make(map[string]struct{})}
+	var (
+		reader = bufio.NewReader(fd)
+		header = make([]byte, 4)
+		offset int64
+	)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			break
+		}
+		key := make([]byte, binary.LittleEndian.Uint32(header))
+		_, err = io.ReadFull(reader, key)
+		if err != nil {
+			break
+		}
+		fp.keys[string(key)] = struct{}{}
+		offset += int64(len(header) + len(key))
+	}
+
+	err = fd.Truncate(offset)
+	if err == nil {
+		_, err = fd.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("failed to recover fingerprint collisions: %w", err)
+	}
+	fp.size.Store(int64(len(fp.keys)))
+	return fp, nil
+}
+
+// hasFingerprintCollisions 检查数据目录是否在指纹索引中记录过冲突的 key
+func hasFingerprintCollisions(directory string) bool {
+	finfo, err := os.Stat(filepath.Join(directory, fingerprintFile))
+	return err == nil && finfo.Size() > 0
+}
+
+// fingerprintInum 是冲突的 key 使用的 inum
+func fingerprintInum(key string) uint64 {
+	return murmur3.Sum64WithSeed([]byte(key), fingerprintSeed)
+}
+
+// inum 返回 key 在索引中的 inum，fp 为 nil 时就是 InodeNum
+func (fp *fingerprintTable) inum(key string) uint64 {
+	if fp != nil && fp.collided(key) {
+		return fingerprintInum(key)
+	}
+	return InodeNum(key)
+}
+
+// remap 把 readSegment 使用 InodeNum 计算的 inum 转换成 key 在索引中的 inum
+func (fp *fingerprintTable) remap(inum uint64, key []byte) uint64 {
+	if fp == nil || fp.size.Load() == 0 {
+		return inum
+	}
+	if fp.collided(string(key)) {
+		return fingerprintInum(string(key))
+	}
+	return inum
+}
+
+func (fp *fingerprintTable) collided(key string) bool {
+	if fp.size.Load() == 0 {
+		return false
+	}
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	_, ok := fp.keys[key]
+	return ok
+}
+
+// add 把冲突的 key 写入文件并且同步到磁盘之后才生效，之后写入的记录已经使用新的 inum
+func (fp *fingerprintTable) add(key string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if _, ok := fp.keys[key]; ok {
+		return nil
+	}
+
+	entry := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(key)), uint32(len(key)))
+	entry = append(entry, key...)
+	_, err := fp.fd.Write(entry)
+	if err == nil {
+		err = fp.fd.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record fingerprint collision: %w", err)
+	}
+
+	fp.keys[key] = struct{}{}
+	fp.size.Add(1)
+	return nil
+}
+
+func (fp *fingerprintTable) close() error {
+	return fp.fd.Close()
+}
+
+// indexKind 返回打开文件系统时使用的索引
+func (lfs *LogStructuredFS) indexKind() IndexKind {
+	switch {
+	case lfs.keys != nil:
+		return SkipListIndex
+	case lfs.fingerprints != nil:
+		return FingerprintIndex
+	}
+	return HashIndex
+}
+
+// inodeNum 返回 key 在当前索引中的 inum
+func (lfs *LogStructuredFS) inodeNum(key string) uint64 {
+	return lfs.fingerprints.inum(key)
+}
+
+// recordInum 返回 region 中读出的记录在当前索引中的 inum
+func (lfs *LogStructuredFS) recordInum(inum uint64, seg *Segment) uint64 {
+	return lfs.fingerprints.remap(inum, seg.Key)
+}
+
+// readRecordKey 只读取记录的头部和 key
+func readRecordKey(fd *os.File, position uint64) (string, error) {
+	reader := recordReaders[currentFormat]
+	buf := make([]byte, reader.headerSize)
+	_, err := fd.ReadAt(buf, int64(position))
+	if err != nil {
+		return "", fmt.Errorf("failed to read segment header: %w", err)
+	}
+
+	var seg Segment
+	err = reader.parseHeader(buf, &seg)
+	if err != nil {
+		return "", err
+	}
+
+	key := make([]byte, seg.KeySize)
+	_, err = fd.ReadAt(key, int64(position)+int64(reader.headerSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse key in segment: %w", err)
+	}
+	return string(key), nil
+}
+
+// occupant 读出索引中 inum 指向的记录的 key，inum 不在索引中时 ok 为 false。
+// 调用方持有 lfs.mu，对象存储中的 region 直接从缓存中读取
+func (lfs *LogStructuredFS) occupant(ctx context.Context, inum uint64) (key string, ok bool, err error) {
+	imap := lfs.indexs[inum%uint64(shard)]
+	imap.mu.RLock()
+	inode, ok := imap.lookup(inum)
+	imap.mu.RUnlock()
+	if !ok {
+		return "", false, nil
+	}
+
+	regionID, position := atomic.LoadUint64(&inode.RegionID), atomic.LoadUint64(&inode.Position)
+	fd, ok := lfs.regions[regionID]
+	if !ok {
+		region, remote := lfs.remote[regionID]
+		if !remote {
+			return "", false, fmt.Errorf("data region with ID %d not found", regionID)
+		}
+		if lfs.tier == nil {
+			return "", false, fmt.Errorf("data region with ID %d is in object storage: %w", regionID, ErrTieringDisabled)
+		}
+		var release func()
+		fd, release, err = lfs.tier.cache.acquire(ctx, region)
+		if err != nil {
+			return "", false, err
+		}
+		defer release()
+	}
+
+	key, err = readRecordKey(fd, position)
+	return key, err == nil, err
+}
+
+// resolveInum 返回写入 key 使用的 inum，调用方持有 lfs.mu。指纹索引中 inum 已经被另一个 key 占用时，
+// 把 key 记录为冲突的 key 并且改用另一个种子计算的 inum，两个 inum 都被占用时返回 ErrKeyCollision
+func (lfs *LogStructuredFS) resolveInum(ctx context.Context, key string) (uint64, error) {
+	inum := lfs.inodeNum(key)
+	if lfs.fingerprints == nil {
+		return inum, nil
+	}
+
+	other, ok, err := lfs.occupant(ctx, inum)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || other == key {
+		return inum, nil
+	}
+	if lfs.fingerprints.collided(key) {
+		return 0, fmt.Errorf("%w: %q and %q", ErrKeyCollision, key, other)
+	}
+
+	inum = fingerprintInum(key)
+	other, ok, err = lfs.occupant(ctx, inum)
+	if err != nil {
+		return 0, err
+	}
+	if ok && other != key {
+		return 0, fmt.Errorf("%w: %q and %q", ErrKeyCollision, key, other)
+	}
+
+	err = lfs.fingerprints.add(key)
+	if err != nil {
+		return 0, err
+	}
+	return inum, nil
+}
+
+// matchKey 检查 inode 指向的记录是不是 key 的记录，只有指纹索引需要检查
+func (lfs *LogStructuredFS) matchKey(key string, inode *Inode) bool {
+	if lfs.fingerprints == nil {
+		return true
+	}
+
+	fd, release, err := lfs.openRegion(context.Background(), inode.RegionID)
+	if err != nil || fd == nil {
+		return false
+	}
+	defer release()
+
+	other, err := readRecordKey(fd, inode.Position)
+	return err == nil && other == key
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openFingerprintTestFS(t *testing.T, dir string, index IndexKind) (*LogStructuredFS, error) {
+	return OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+		Index:     index,
+	})
+}
+
+func TestFingerprintIndex_Collision(t *testing.T) {
+	dir := t.TempDir()
+	fss, err := openFingerprintTestFS(t, dir, FingerprintIndex)
+	require.NoError(t, err)
+	assert.Equal(t, "fingerprint", fss.IndexStats().Kind)
+
+	// 64 位的哈希找不到真实的冲突，让 b 的 inum 指向 a 的记录模拟冲突
+	putText(t, fss, "a", "a1")
+	inode, ok := fss.StatSegment("a")
+	require.True(t, ok)
+	forged := InodeNum("b")
+	fss.indexs[forged%uint64(shard)].index[forged] = &inode
+
+	// 读取比较磁盘上的 key，冲突的 key 不存在
+	assert.Empty(t, fetchText(fss, "b"))
+	_, ok = fss.StatSegment("b")
+	assert.False(t, ok)
+	seg, err := NewSegment("b", types.NewText("b0"), 0)
+	require.NoError(t, err)
+	assert.Error(t, fss.UpdateSegmentWithCAS("b", 0, seg))
+
+	// 删除不存在的 key 不会删除另一个 key 的索引项，也不写入墓碑
+	offset := fss.offset
+	require.NoError(t, fss.DeleteSegment("b"))
+	assert.Equal(t, offset, fss.offset)
+	assert.Contains(t, fss.indexs[forged%uint64(shard)].index, forged)
+
+	// 写入冲突的 key 改用另一个 inum
+	putText(t, fss, "b", "b1")
+	assert.Equal(t, 1, fss.IndexStats().Collisions)
+	assert.Equal(t, fingerprintInum("b"), fss.inodeNum("b"))
+	assert.Equal(t, "a1", fetchText(fss, "a"))
+	assert.Equal(t, "b1", fetchText(fss, "b"))
+	putText(t, fss, "b", "b2")
+	assert.Equal(t, "b2", fetchText(fss, "b"))
+	// 真实的冲突中这就是 a 的索引项，不应该出现在索引快照中
+	delete(fss.indexs[forged%uint64(shard)].index, forged)
+	require.NoError(t, fss.CloseFS())
+
+	// 从索引快照和重新扫描 region 恢复之后冲突的 key 仍然可以读取
+	for _, scan := range []bool{false, true} {
+		if scan {
+			require.NoError(t, os.Remove(filepath.Join(dir, indexFileName)))
+		}
+		fss, err = openFingerprintTestFS(t, dir, FingerprintIndex)
+		require.NoError(t, err)
+		assert.Equal(t, 1, fss.IndexStats().Collisions)
+		assert.Equal(t, "a1", fetchText(fss, "a"))
+		assert.Equal(t, "b2", fetchText(fss, "b"))
+		assert.Equal(t, 2, fss.KeysCount())
+		require.NoError(t, fss.CloseFS())
+	}
+
+	// 其他索引找不到冲突的 key，不能打开这个目录
+	_, err = openFingerprintTestFS(t, dir, HashIndex)
+	assert.Error(t, err)
+}
+
+func TestFingerprintIndex_Compaction(t *testing.T) {
+	fss, err := openFingerprintTestFS(t, t.TempDir(), FingerprintIndex)
+	require.NoError(t, err)
+	defer fss.CloseFS()
+
+	putText(t, fss, "a", "a1")
+	require.NoError(t, fss.fingerprints.add("b"))
+	putText(t, fss, "b", "b1")
+	putText(t, fss, "c", "c1")
+	require.NoError(t, fss.DeleteSegment("c"))
+	old := fss.regionID
+	require.NoError(t, fss.RolloverRegion())
+
+	// 迁移记录时使用冲突的 key 在索引中的 inum
+	_, err = fss.compactRegion(old, fss.regions[old])
+	require.NoError(t, err)
+	assert.Equal(t, "a1", fetchText(fss, "a"))
+	assert.Equal(t, "b1", fetchText(fss, "b"))
+	inode, ok := fss.StatSegment("b")
+	require.True(t, ok)
+	assert.NotEqual(t, old, inode.RegionID)
+	assert.Equal(t, 2, fss.KeysCount())
+}
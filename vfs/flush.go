@@ -0,0 +1,123 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// flusher 定期把 active region 同步到磁盘，写入返回之前不会等待同步，
+// 没有同步的数据最多是一个周期内写入的
+type flusher struct {
+	ticker *time.Ticker
+	stop   chan struct{}
+}
+
+// RunFlush syncs the active region to disk every second seconds in the background,
+// bounding the writes that only reached the page cache to one interval.
+func (lfs *LogStructuredFS) RunFlush(second uint32) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.flusher != nil || second == 0 {
+		return
+	}
+
+	f := &flusher{
+		ticker: time.NewTicker(time.Duration(second) * time.Second),
+		stop:   make(chan struct{}),
+	}
+	lfs.flusher = f
+
+	go func() {
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-f.ticker.C:
+				err := lfs.FlushActiveRegion()
+				if err != nil {
+					vlog.Errorf("%v", err)
+				}
+			}
+		}
+	}()
+}
+
+// StopFlush stops the background sync started by RunFlush.
+func (lfs *LogStructuredFS) StopFlush() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	lfs.stopFlush()
+}
+
+// stopFlush 停止后台同步，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) stopFlush() {
+	if lfs.flusher != nil {
+		lfs.flusher.ticker.Stop()
+		close(lfs.flusher.stop)
+		lfs.flusher = nil
+	}
+}
+
+// FlushActiveRegion syncs the active region to disk if it was written after the last sync.
+func (lfs *LogStructuredFS) FlushActiveRegion() error {
+	// 写入在清除标记之后完成时会重新设置标记，下一个周期再同步
+	if !lfs.unflushed.Swap(false) {
+		return nil
+	}
+
+	lfs.mu.RLock()
+	active, wal := lfs.active, lfs.wal
+	lfs.mu.RUnlock()
+
+	// 同步时不持有锁，不阻塞写入，切换之后旧的 active region 已经在切换时同步过
+	err := active.Sync()
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		lfs.unflushed.Store(true)
+		return fmt.Errorf("failed to flush active region: %w", err)
+	}
+
+	// 索引日志和 region 一起同步，切换日志时旧的日志已经同步并关闭
+	err = syncIndexLog(wal)
+	if err != nil {
+		lfs.unflushed.Store(true)
+		return err
+	}
+	return nil
+}
+
+// rolloverRegion 同步当前的 active region 之后创建新的 active region，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) rolloverRegion() error {
+	err := lfs.active.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync active region before rollover: %w", err)
+	}
+	err = syncIndexLog(lfs.wal)
+	if err != nil {
+		return err
+	}
+	lfs.unflushed.Store(false)
+
+	lfs.regions[lfs.regionID] = lfs.active
+	err = lfs.createActiveRegion()
+	if err != nil {
+		return fmt.Errorf("failed to change active regions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushActiveRegion(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	seg, err := NewSegment("key", types.NewText("value"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key", seg))
+	assert.True(t, fss.unflushed.Load())
+
+	assert.NoError(t, fss.FlushActiveRegion())
+	assert.False(t, fss.unflushed.Load())
+	// 没有新的写入时不需要同步
+	assert.NoError(t, fss.FlushActiveRegion())
+
+	// 切换 region 时同步旧的 active region
+	assert.NoError(t, fss.PutSegment("key", seg))
+	assert.NoError(t, fss.RolloverRegion())
+	assert.False(t, fss.unflushed.Load())
+}
+
+func TestRunFlush(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	fss.RunFlush(1)
+	fss.RunFlush(1)
+	assert.NotNil(t, fss.flusher)
+
+	seg, err := NewSegment("key", types.NewText("value"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key", seg))
+
+	assert.Eventually(t, func() bool {
+		return !fss.unflushed.Load()
+	}, 3*time.Second, 50*time.Millisecond)
+
+	fss.StopFlush()
+	assert.Nil(t, fss.flusher)
+	fss.StopFlush()
+}
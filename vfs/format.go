@@ -0,0 +1,206 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 数据文件的头部为 | MAGIC 1 | CHECKSUM 1 | 0x01 | VERSION 1 |，CHECKSUM 是 region 记录使用的校验算法，
+// 校验算法可以配置之前这个字节固定为 0，对应 CRC32，所以已有的文件不需要升级
+const (
+	fileMagic byte = 0xDB
+	// formatV1 的 region 记录头部没有 LSN
+	formatV1 byte = 0x01
+	// formatV2 在 region 记录头部增加了 LSN
+	formatV2 byte = 0x02
+	// formatV3 使用 KIND 字节的高 4 位记录 Value 的编解码器，之前的版本都是 MsgPack
+	formatV3 byte = 0x03
+	// currentFormat 是写入 region 使用的格式，旧版本的 region 在启动时升级到这个版本
+	currentFormat = formatV3
+)
+
+// 记录中 key 和 value 长度的上限，解析时超过上限的长度说明记录已经损坏，在分配内存之前拒绝，
+// 写入时同样检查，保证写入的记录都可以被读取。上限也保证 Segment.Size 不会溢出
+const (
+	maxRecordKeySize   = 64 << 10
+	maxRecordValueSize = 1 << 30
+)
+
+var (
+	// ErrMalformedRecord is returned when a region record is truncated or its header declares impossible lengths.
+	ErrMalformedRecord = errors.New("malformed region record")
+	// ErrRecordTooLarge is returned when a key or value exceeds the size a region record can hold.
+	ErrRecordTooLarge = errors.New("record exceeds size limits")
+)
+
+// ErrUnsupportedFormat is returned when a data file was written in a format version this build cannot read.
+var ErrUnsupportedFormat = errors.New("unsupported data file format")
+
+// FormatError reports a data file whose format version is not supported, Supported is the newest version this build reads.
+type FormatError struct {
+	File      string
+	Version   byte
+	Supported byte
+}
+
+func (e *FormatError) Error() string {
+	if e.Version > e.Supported {
+		return fmt.Sprintf("%s uses format version %d but this build only supports up to version %d, upgrade urnadb to open it", e.File, e.Version, e.Supported)
+	}
+	return fmt.Sprintf("%s uses unsupported format version %d", e.File, e.Version)
+}
+
+func (e *FormatError) Unwrap() error {
+	return ErrUnsupportedFormat
+}
+
+// recordReader 解析一个格式版本的 region 记录，记录的头部长度固定，之后是 key、value 和校验和
+type recordReader struct {
+	headerSize   int
+	decodeHeader func(header []byte, seg *Segment)
+	// 没有 LSN 的格式升级时按照记录的顺序分配 LSN
+	hasLSN bool
+}
+
+// regionLayout 是 region 文件头部描述的记录格式和校验算法
+type regionLayout struct {
+	*recordReader
+	version  byte
+	checksum Checksum
+}
+
+// recordReaders 保存每个格式版本的记录解析方法。修改记录格式时增加新的版本和解析方法，
+// 修改 encodeSegment 并且提升 currentFormat，旧版本的 region 在启动时通过自己版本的解析方法读出，
+// 再按照当前的格式重写，运行期间只会遇到当前格式的 region
+var recordReaders = map[byte]*recordReader{
+	formatV1: {headerSize: 26, decodeHeader: decodeHeaderV1},
+	formatV2: {headerSize: SEGMENT_PADDING, decodeHeader: decodeHeaderV2, hasLSN: true},
+	formatV3: {headerSize: SEGMENT_PADDING, decodeHeader: decodeHeaderV3, hasLSN: true},
+}
+
+// checkRecordSize 检查 key 和 value 的长度没有超过上限
+func checkRecordSize(keySize, valueSize uint32) error {
+	if keySize > maxRecordKeySize || valueSize > maxRecordValueSize {
+		return fmt.Errorf("%w: key is %d bytes and value is %d bytes, limits are %d and %d",
+			ErrRecordTooLarge, keySize, valueSize, maxRecordKeySize, maxRecordValueSize)
+	}
+	return nil
+}
+
+// parseHeader 解析记录头部并且检查 key 和 value 的长度，调用者根据头部中的长度分配内存或者跳过记录之前必须先调用
+func (r *recordReader) parseHeader(header []byte, seg *Segment) error {
+	if len(header) < r.headerSize {
+		return fmt.Errorf("%w: header is %d bytes", ErrMalformedRecord, len(header))
+	}
+	r.decodeHeader(header, seg)
+	err := checkRecordSize(seg.KeySize, seg.ValueSize)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedRecord, err)
+	}
+	return nil
+}
+
+// recordSize 返回头部已经解析过的记录的总长度
+func (r *recordReader) recordSize(seg *Segment) int64 {
+	return int64(r.headerSize) + int64(seg.KeySize) + int64(seg.ValueSize) + 4
+}
+
+// decodeRecord 从 data 中解析一条完整的记录并且校验，data 可以比记录长，返回的 Key 和 Value 可能引用 data。
+// 长度不合法、数据不完整和校验失败都返回错误，不会 panic
+func decodeRecord(data []byte, reader *recordReader, sum Checksum) (*Segment, error) {
+	var seg Segment
+	err := reader.parseHeader(data, &seg)
+	if err != nil {
+		return nil, err
+	}
+
+	size := reader.recordSize(&seg)
+	if int64(len(data)) < size {
+		return nil, fmt.Errorf("%w: record needs %d bytes but only %d are available", ErrMalformedRecord, size, len(data))
+	}
+
+	body := data[:size-4]
+	checksum := binary.LittleEndian.Uint32(data[size-4 : size])
+	if checksum != sum.sum(body) {
+		return nil, fmt.Errorf("failed to %w: %d", ErrChecksumMismatch, checksum)
+	}
+
+	key := body[reader.headerSize : reader.headerSize+int(seg.KeySize)]
+	value, err := transformer.Decode(body[reader.headerSize+int(seg.KeySize):])
+	if err != nil {
+		return nil, fmt.Errorf("failed to transformer decode value in segment: %w", err)
+	}
+
+	seg.Key = key
+	seg.Value = value
+	return &seg, nil
+}
+
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+func decodeHeaderV1(header []byte, seg *Segment) {
+	seg.Tombstone = int8(header[0])
+	seg.Type = Kind(header[1])
+	seg.Codec = MsgPack
+	seg.ExpiredAt = binary.LittleEndian.Uint64(header[2:10])
+	seg.CreatedAt = binary.LittleEndian.Uint64(header[10:18])
+	seg.KeySize = binary.LittleEndian.Uint32(header[18:22])
+	seg.ValueSize = binary.LittleEndian.Uint32(header[22:26])
+}
+
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | LSN 8 | KEY ? | VALUE ? | CRC32 4 |
+func decodeHeaderV2(header []byte, seg *Segment) {
+	decodeHeaderV1(header, seg)
+	seg.LSN = binary.LittleEndian.Uint64(header[26:34])
+}
+
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | LSN 8 | KEY ? | VALUE ? | CRC32 4 |，KIND 的高 4 位是编解码器
+func decodeHeaderV3(header []byte, seg *Segment) {
+	decodeHeaderV2(header, seg)
+	seg.Type = Kind(header[1] & kindMask)
+	seg.Codec = Codec(header[1] >> codecShift)
+}
+
+// formatHeader 返回使用指定校验算法和格式版本的数据文件头部
+func formatHeader(sum Checksum, version byte) []byte {
+	return []byte{fileMagic, byte(sum), 0x01, version}
+}
+
+// isDataFile 检查数据文件头部中除了校验算法和版本之外的固定字节
+func isDataFile(header []byte) bool {
+	return len(header) == len(regionMetadata) && header[0] == fileMagic && header[2] == 0x01
+}
+
+// regionFormat 解析 region 文件头部，没有对应解析方法的版本返回 FormatError
+func regionFormat(name string, header []byte) (*regionLayout, error) {
+	if !isDataFile(header) {
+		return nil, fmt.Errorf("%s is not a region file", name)
+	}
+
+	version := header[3]
+	reader, ok := recordReaders[version]
+	if !ok {
+		return nil, &FormatError{File: name, Version: version, Supported: currentFormat}
+	}
+
+	sum := Checksum(header[1])
+	if !sum.valid() {
+		return nil, fmt.Errorf("%s uses unknown checksum algorithm %d: %w", name, header[1], ErrUnsupportedFormat)
+	}
+
+	return &regionLayout{recordReader: reader, version: version, checksum: sum}, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionFormat(t *testing.T) {
+	layout, err := regionFormat("a.db", regionMetadata)
+	assert.NoError(t, err)
+	assert.Equal(t, currentFormat, layout.version)
+	assert.Equal(t, CRC32, layout.checksum)
+	assert.Equal(t, SEGMENT_PADDING, layout.headerSize)
+
+	layout, err = regionFormat("a.db", dataFileMetadata)
+	assert.NoError(t, err)
+	assert.Equal(t, formatV1, layout.version)
+
+	_, err = regionFormat("a.db", []byte{0x00, 0x00, 0x00, 0x00})
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnsupportedFormat))
+
+	_, err = regionFormat("a.db", formatHeader(CRC32, currentFormat+1))
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+	assert.Contains(t, err.Error(), "upgrade urnadb")
+}
+
+func TestOpenFS_NewerFormat(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, formatDataFileName(1)), formatHeader(CRC32, currentFormat+1), conf.FSPerm))
+
+	_, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	var ferr *FormatError
+	assert.ErrorAs(t, err, &ferr)
+	assert.Equal(t, currentFormat+1, ferr.Version)
+
+	// 更新的版本写入的索引文件同样拒绝打开
+	dir = t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, indexFileName), formatHeader(CRC32, formatV1+1), conf.FSPerm))
+	_, err = OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestUpgradeRegion_CurrentFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), formatDataFileName(1))
+
+	region := append([]byte{}, regionMetadata...)
+	for i, key := range []string{"a", "b"} {
+		seg, err := NewSegment(key, types.NewText(key), 0)
+		assert.NoError(t, err)
+		seg.LSN = uint64(i * 10)
+		data, err := serializedSegment(seg, CRC32)
+		assert.NoError(t, err)
+		region = append(region, data...)
+	}
+	assert.NoError(t, os.WriteFile(path, region, conf.FSPerm))
+
+	// 当前格式的解析方法和 encodeSegment 一致，重写之后的内容不变，已有的 LSN 保持不变
+	upgraded, lsn, err := upgradeRegion(path, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), lsn)
+	assert.Equal(t, 2, upgraded.Records)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, region, data)
+}
+
+// recordSeeds 返回编码之后的正常记录，作为模糊测试的初始语料
+func recordSeeds(t testing.TB) [][]byte {
+	var segs []*Segment
+	for i, value := range []Serializable{types.NewText("hello"), types.NewText(""), types.NewCollection()} {
+		seg, err := NewSegment("key-"+string(rune('a'+i)), value, 0)
+		assert.NoError(t, err)
+		segs = append(segs, seg)
+	}
+	segs = append(segs, NewTombstoneSegment("key-d"))
+
+	var seeds [][]byte
+	for i, seg := range segs {
+		seg.LSN = uint64(i + 1)
+		data, err := serializedSegment(seg, CRC32)
+		assert.NoError(t, err)
+		seeds = append(seeds, data)
+	}
+	return seeds
+}
+
+func TestDecodeRecord_Bounds(t *testing.T) {
+	reader := recordReaders[currentFormat]
+	data := recordSeeds(t)[0]
+
+	seg, err := decodeRecord(data, reader, CRC32)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-a", string(seg.Key))
+
+	// 截断的记录和头部
+	_, err = decodeRecord(data[:len(data)-1], reader, CRC32)
+	assert.ErrorIs(t, err, ErrMalformedRecord)
+	_, err = decodeRecord(data[:10], reader, CRC32)
+	assert.ErrorIs(t, err, ErrMalformedRecord)
+
+	// 损坏的长度在分配内存之前被拒绝
+	corrupted := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(corrupted[22:26], 0xFFFFFFFF)
+	_, err = decodeRecord(corrupted, reader, CRC32)
+	assert.ErrorIs(t, err, ErrMalformedRecord)
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+
+	corrupted = append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(corrupted[18:22], maxRecordKeySize+1)
+	_, err = decodeRecord(corrupted, reader, CRC32)
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+
+	corrupted = append([]byte(nil), data...)
+	corrupted[len(corrupted)-5] ^= 0xFF
+	_, err = decodeRecord(corrupted, reader, CRC32)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestScanRegion_CorruptedLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), formatDataFileName(1))
+	region := append([]byte{}, regionMetadata...)
+	for _, seed := range recordSeeds(t) {
+		region = append(region, seed...)
+	}
+	// 最后一条记录的 value 长度被改为超过文件末尾但是没有超过上限的值
+	last := len(region) - len(recordSeeds(t)[3])
+	binary.LittleEndian.PutUint32(region[last+22:last+26], 1<<20)
+	assert.NoError(t, os.WriteFile(path, region, conf.FSPerm))
+
+	fd, err := os.Open(path)
+	assert.NoError(t, err)
+	defer fd.Close()
+
+	_, err = scanRegionIndex(1, fd, nil)
+	assert.Error(t, err)
+	_, _, err = scanRegionLSN(fd)
+	assert.ErrorIs(t, err, ErrMalformedRecord)
+}
+
+func FuzzDecodeRecord(f *testing.F) {
+	for _, seed := range recordSeeds(f) {
+		f.Add(seed)
+	}
+
+	reader := recordReaders[currentFormat]
+	f.Fuzz(func(t *testing.T, data []byte) {
+		seg, err := decodeRecord(data, reader, CRC32)
+		if err != nil {
+			return
+		}
+		if seg.KeySize > maxRecordKeySize || seg.ValueSize > maxRecordValueSize {
+			t.Fatalf("decoded record exceeds size limits: %d %d", seg.KeySize, seg.ValueSize)
+		}
+
+		// 解析成功的记录重新编码之后和原来的字节相同
+		encoded, err := serializedSegment(seg, CRC32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, data[:len(encoded)]) {
+			t.Fatalf("record does not round trip: %x != %x", encoded, data[:len(encoded)])
+		}
+	})
+}
+
+func FuzzScanRegion(f *testing.F) {
+	var region []byte
+	for _, seed := range recordSeeds(f) {
+		f.Add(seed)
+		region = append(region, seed...)
+	}
+	f.Add(region)
+
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(dir, formatDataFileName(1))
+		err := os.WriteFile(path, append(append([]byte{}, regionMetadata...), data...), conf.FSPerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fd, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		defer regionChecksums.Delete(fd)
+
+		// 损坏的 region 返回错误，不能 panic 或者分配过大的内存
+		_, _ = scanRegionIndex(1, fd, nil)
+		_, _, _ = scanRegionLSN(fd)
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCompactPaused is returned when region compaction has been paused with PauseCompaction.
+var ErrCompactPaused = errors.New("region compaction is paused")
+
+// CompactionStatus describes the state machine of region compaction.
+// State is one of idle, running, paused or failed, Reason tells why compaction is paused or failed.
+type CompactionStatus struct {
+	State  string    `json:"state"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	// Pausing is true while a running compaction finishes the region it is migrating after a pause
+	Pausing bool `json:"pausing,omitempty"`
+}
+
+// gcStateNames 是回收状态对外的名字，GC_INIT 和 GC_INACTIVE 都是空闲
+var gcStateNames = map[GC_STATE]string{
+	GC_INIT:     "idle",
+	GC_ACTIVE:   "running",
+	GC_INACTIVE: "idle",
+	GC_PAUSED:   "paused",
+	GC_FAILED:   "failed",
+}
+
+// compactPause 记录运维暂停回收的原因和时间
+type compactPause struct {
+	reason string
+	at     time.Time
+}
+
+// GCStatus returns the state of region compaction, the reason it is paused or failed and when it entered the state.
+func (lfs *LogStructuredFS) GCStatus() CompactionStatus {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	status := CompactionStatus{
+		State:  gcStateNames[lfs.gcstate],
+		Reason: lfs.gcreason,
+		Since:  lfs.gcsince,
+	}
+	switch {
+	case lfs.gcpause != nil && lfs.gcstate == GC_ACTIVE:
+		status.Pausing = true
+	case lfs.gcpause != nil:
+		status.State, status.Reason, status.Since = gcStateNames[GC_PAUSED], lfs.gcpause.reason, lfs.gcpause.at
+	}
+	return status
+}
+
+// PauseCompaction stops scheduled, expiry and manual compactions from starting until ResumeCompaction is called,
+// so compaction can be held off during peak traffic or an investigation. A compaction already running stops
+// once the region it is migrating is done. Pausing again only replaces the reason.
+func (lfs *LogStructuredFS) PauseCompaction(reason string) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.gcpause == nil {
+		lfs.gcpause = &compactPause{at: time.Now()}
+	}
+	lfs.gcpause.reason = reason
+	compactLog.Infof("region compaction paused: %s", reason)
+}
+
+// ResumeCompaction lets compactions start again after PauseCompaction, it returns false when compaction was not paused.
+func (lfs *LogStructuredFS) ResumeCompaction() bool {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.gcpause == nil {
+		return false
+	}
+	lfs.gcpause = nil
+	compactLog.Info("region compaction resumed")
+	return true
+}
+
+// compactionPaused 回收的循环在每个 region 之前检查，暂停之后不再开始新的 region
+func (lfs *LogStructuredFS) compactionPaused() bool {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	return lfs.gcpause != nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction_PauseResume(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	putText(t, fss, "a", "a1")
+	putText(t, fss, "b", "b1")
+	require.NoError(t, fss.DeleteSegment("a"))
+	putText(t, fss, "b", "b2")
+	old := fss.regionID
+	require.NoError(t, fss.RolloverRegion())
+
+	assert.Equal(t, GC_INIT, fss.GCState())
+	assert.Equal(t, "idle", fss.GCStatus().State)
+
+	// 暂停期间定时、过期和手动触发的回收都不会执行
+	fss.PauseCompaction("peak traffic")
+	fss.PauseCompaction("investigating region corruption")
+	assert.Equal(t, GC_PAUSED, fss.GCState())
+	status := fss.GCStatus()
+	assert.Equal(t, "paused", status.State)
+	assert.Equal(t, "investigating region corruption", status.Reason)
+	assert.False(t, status.Since.IsZero())
+
+	assert.ErrorIs(t, fss.CompactRegions(), ErrCompactPaused)
+	n, err := fss.CompactExpiredRegions(0.5)
+	assert.ErrorIs(t, err, ErrCompactPaused)
+	assert.Equal(t, 0, n)
+	_, ok := fss.regions[old]
+	assert.True(t, ok)
+
+	assert.True(t, fss.ResumeCompaction())
+	assert.False(t, fss.ResumeCompaction())
+	assert.Equal(t, "idle", fss.GCStatus().State)
+
+	n, err = fss.CompactExpiredRegions(0.5)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, GC_INACTIVE, fss.GCState())
+	assert.Equal(t, "b2", fetchText(fss, "b"))
+}
+
+func TestCompaction_Failed(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	putText(t, fss, "a", "a1")
+	require.NoError(t, fss.DeleteSegment("a"))
+	old := fss.regionID
+	require.NoError(t, fss.RolloverRegion())
+
+	// region 文件无法读取时回收失败，记录失败的原因
+	fd := fss.regions[old]
+	closed, err := os.Open(fd.Name())
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	fss.regions[old] = closed
+
+	_, err = fss.CompactExpiredRegions(0.5)
+	assert.Error(t, err)
+	assert.Equal(t, GC_FAILED, fss.GCState())
+	status := fss.GCStatus()
+	assert.Equal(t, "failed", status.State)
+	assert.Equal(t, err.Error(), status.Reason)
+
+	// 暂停优先于失败的状态显示，恢复之后仍然是失败
+	fss.PauseCompaction("")
+	assert.Equal(t, "paused", fss.GCStatus().State)
+	fss.ResumeCompaction()
+	assert.Equal(t, "failed", fss.GCStatus().State)
+
+	fss.regions[old] = fd
+	n, err := fss.CompactExpiredRegions(0.5)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	status = fss.GCStatus()
+	assert.Equal(t, "idle", status.State)
+	assert.Empty(t, status.Reason)
+}
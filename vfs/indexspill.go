@@ -0,0 +1,438 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// ErrIndexSpillUnsupported is returned by RunIndexSpill on platforms without memory-mapped files.
+var ErrIndexSpillUnsupported = errors.New("index spill is not supported on this platform")
+
+// 溢出文件中每个索引项的大小，按照 inum 升序排列，可以二分查找：
+// | INUM 8 | RID 8 | OFS 8 | LEN 4 | PREFIX 4 | EAT 8 | CAT 8 | MVCC 8 |
+const spillEntrySize = 56
+
+// 溢出文件所在的目录，只在进程运行期间使用，重新启动时删除
+const spillDirectory = "spill"
+
+// indexEntryBytes 是内存中每个索引项的估算大小，不包括有序索引中的 key
+const indexEntryBytes = uint64(unsafe.Sizeof(Inode{}) + indexEntryOverhead)
+
+// IndexStats reports how the key index is split between memory and the spill files on disk.
+type IndexStats struct {
+	// Kind is the index kind the file system was opened with
+	Kind string `json:"kind"`
+	// Shards is the number of index shards, SpilledShards of them are in spill files
+	Shards        int `json:"shards"`
+	SpilledShards int `json:"spilled_shards"`
+	// ResidentKeys and SpilledKeys include expired keys that have not been cleaned up yet
+	ResidentKeys int `json:"resident_keys"`
+	SpilledKeys  int `json:"spilled_keys"`
+	// MemoryBytes is the estimated memory of the resident shards, SpilledBytes is the size of the spill files
+	MemoryBytes  uint64 `json:"memory_bytes"`
+	SpilledBytes uint64 `json:"spilled_bytes"`
+	// EntryBytes is the estimated memory of one resident key, use it to size the budget of large keyspaces
+	EntryBytes uint64 `json:"entry_bytes"`
+	// Budget is the memory budget of the resident shards, zero when spilling is not running
+	Budget uint64 `json:"budget"`
+	// Spills and Loads count the shards written to spill files and loaded back into memory by a write
+	Spills uint64 `json:"spills"`
+	Loads  uint64 `json:"loads"`
+	// Collisions is the number of keys moved to a second hash by the fingerprint index
+	Collisions int `json:"collisions"`
+}
+
+// spillFile 是一个溢出到磁盘的索引分片，文件通过 mmap 映射，由操作系统的页缓存决定哪些部分留在内存中
+type spillFile struct {
+	path  string
+	fd    *os.File
+	data  []byte
+	count int
+}
+
+// indexSpiller 按照 interval 检查常驻内存的索引分片，超过 budget 时把最久没有访问的分片溢出到磁盘
+type indexSpiller struct {
+	budget uint64
+	ticker *time.Ticker
+	stop   chan struct{}
+}
+
+// spillCounters 统计溢出到磁盘和被写入加载回内存的分片数量
+type spillCounters struct {
+	spills atomic.Uint64
+	loads  atomic.Uint64
+}
+
+func encodeSpillEntry(buf []byte, inum uint64, inode *Inode) {
+	binary.LittleEndian.PutUint64(buf[0:8], inum)
+	binary.LittleEndian.PutUint64(buf[8:16], atomic.LoadUint64(&inode.RegionID))
+	binary.LittleEndian.PutUint64(buf[16:24], atomic.LoadUint64(&inode.Position))
+	binary.LittleEndian.PutUint32(buf[24:28], atomic.LoadUint32(&inode.Length))
+	binary.LittleEndian.PutUint32(buf[28:32], inode.prefix)
+	binary.LittleEndian.PutUint64(buf[32:40], atomic.LoadUint64(&inode.ExpiredAt))
+	binary.LittleEndian.PutUint64(buf[40:48], atomic.LoadUint64(&inode.CreatedAt))
+	binary.LittleEndian.PutUint64(buf[48:56], atomic.LoadUint64(&inode.mvcc))
+}
+
+func decodeSpillEntry(buf []byte, inode *Inode) uint64 {
+	inode.RegionID = binary.LittleEndian.Uint64(buf[8:16])
+	inode.Position = binary.LittleEndian.Uint64(buf[16:24])
+	inode.Length = binary.LittleEndian.Uint32(buf[24:28])
+	inode.prefix = binary.LittleEndian.Uint32(buf[28:32])
+	inode.ExpiredAt = binary.LittleEndian.Uint64(buf[32:40])
+	inode.CreatedAt = binary.LittleEndian.Uint64(buf[40:48])
+	inode.mvcc = binary.LittleEndian.Uint64(buf[48:56])
+	return binary.LittleEndian.Uint64(buf[0:8])
+}
+
+func (f *spillFile) entry(i int) []byte {
+	return f.data[i*spillEntrySize : (i+1)*spillEntrySize]
+}
+
+// search 二分查找 inum 所在的索引项
+func (f *spillFile) search(inum uint64) (int, bool) {
+	i := sort.Search(f.count, func(i int) bool {
+		return binary.LittleEndian.Uint64(f.entry(i)) >= inum
+	})
+	return i, i < f.count && binary.LittleEndian.Uint64(f.entry(i)) == inum
+}
+
+func (f *spillFile) close() {
+	err := unmapFile(f.data)
+	if err != nil {
+		vlog.Warnf("failed to unmap index spill file %s: %v", f.path, err)
+	}
+	_ = f.fd.Close()
+	_ = os.Remove(f.path)
+}
+
+// writeSpillFile 把分片中的索引项按照 inum 排序之后写入 path 并且映射到内存，调用者持有分片的写锁
+func writeSpillFile(path string, index map[uint64]*Inode) (*spillFile, error) {
+	inums := make([]uint64, 0, len(index))
+	for inum := range index {
+		inums = append(inums, inum)
+	}
+	sort.Slice(inums, func(i, j int) bool {
+		return inums[i] < inums[j]
+	})
+
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		w   = bufio.NewWriterSize(fd, 1<<20)
+		buf [spillEntrySize]byte
+	)
+	for _, inum := range inums {
+		encodeSpillEntry(buf[:], inum, index[inum])
+		_, err = w.Write(buf[:])
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = fd.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	f := &spillFile{path: path, fd: fd, count: len(inums)}
+	if f.count > 0 {
+		f.data, err = mapFile(fd, f.count*spillEntrySize)
+		if err != nil {
+			_ = fd.Close()
+			_ = os.Remove(path)
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// lookup 返回 inum 的 inode，调用者持有分片的锁。溢出的分片返回的是文件中索引项的副本，
+// 修改它不会改变索引，需要修改的调用者先使用 load 把分片加载回内存
+func (imap *indexMap) lookup(inum uint64) (*Inode, bool) {
+	imap.access.Store(time.Now().UnixNano())
+	if imap.spill == nil {
+		inode, ok := imap.index[inum]
+		return inode, ok
+	}
+
+	i, ok := imap.spill.search(inum)
+	if !ok {
+		return nil, false
+	}
+	inode := new(Inode)
+	decodeSpillEntry(imap.spill.entry(i), inode)
+	return inode, true
+}
+
+// rangeInodes 遍历分片中的全部索引项，调用者持有分片的锁，溢出的分片传给 fn 的 inode 会被之后的索引项覆盖，
+// fn 不能保留它
+func (imap *indexMap) rangeInodes(fn func(inum uint64, inode *Inode) bool) {
+	if imap.spill == nil {
+		for inum, inode := range imap.index {
+			if !fn(inum, inode) {
+				return
+			}
+		}
+		return
+	}
+
+	var inode Inode
+	for i := 0; i < imap.spill.count; i++ {
+		inum := decodeSpillEntry(imap.spill.entry(i), &inode)
+		if !fn(inum, &inode) {
+			return
+		}
+	}
+}
+
+// size 返回分片中索引项的数量，调用者持有分片的锁
+func (imap *indexMap) size() int {
+	if imap.spill != nil {
+		return imap.spill.count
+	}
+	return len(imap.index)
+}
+
+// load 把溢出的分片加载回内存，写入和删除 key 之前调用，调用者持有分片的写锁，返回分片是否是溢出的
+func (imap *indexMap) load() bool {
+	imap.access.Store(time.Now().UnixNano())
+	if imap.spill == nil {
+		return false
+	}
+
+	index := make(map[uint64]*Inode, imap.spill.count)
+	for i := 0; i < imap.spill.count; i++ {
+		inode := new(Inode)
+		inum := decodeSpillEntry(imap.spill.entry(i), inode)
+		index[inum] = inode
+	}
+	imap.spill.close()
+	imap.index, imap.spill = index, nil
+	return true
+}
+
+// relocate 把仍然指向 region 中 position 的 inum 的索引项移动到新的位置，调用者持有分片的写锁。
+// 回收迁移记录时使用，溢出的分片直接修改文件中的索引项，不需要加载回内存，返回移动之后的 inode
+func (imap *indexMap) relocate(inum, regionID, position, newRegion, newPosition uint64) (*Inode, bool) {
+	if imap.spill == nil {
+		inode, ok := imap.index[inum]
+		if !ok || atomic.LoadUint64(&inode.RegionID) != regionID || atomic.LoadUint64(&inode.Position) != position {
+			return nil, false
+		}
+		atomic.StoreUint64(&inode.Position, newPosition)
+		atomic.StoreUint64(&inode.RegionID, newRegion)
+		return inode, true
+	}
+
+	i, ok := imap.spill.search(inum)
+	if !ok {
+		return nil, false
+	}
+	entry := imap.spill.entry(i)
+	inode := new(Inode)
+	decodeSpillEntry(entry, inode)
+	if inode.RegionID != regionID || inode.Position != position {
+		return nil, false
+	}
+	inode.RegionID, inode.Position = newRegion, newPosition
+	encodeSpillEntry(entry, inum, inode)
+	return inode, true
+}
+
+// RunIndexSpill checks the resident index shards every interval and writes the least recently used ones
+// to memory-mapped spill files while their estimated memory exceeds budget bytes. Reads of spilled keys
+// search the file, a write or delete loads the shard back into memory until it becomes cold again.
+func (lfs *LogStructuredFS) RunIndexSpill(budget uint64, interval time.Duration) error {
+	if !mmapSupported {
+		return ErrIndexSpillUnsupported
+	}
+	if budget == 0 || interval <= 0 {
+		return errors.New("index spill budget and interval must be greater than 0")
+	}
+
+	lfs.mu.Lock()
+	if lfs.spiller != nil {
+		lfs.mu.Unlock()
+		return nil
+	}
+
+	// 上一次运行留下的溢出文件已经没有用了，索引从检查点或者数据文件恢复
+	dir := filepath.Join(lfs.directory, spillDirectory)
+	err := os.RemoveAll(dir)
+	if err == nil {
+		err = os.MkdirAll(dir, fsPerm)
+	}
+	if err != nil {
+		lfs.mu.Unlock()
+		return fmt.Errorf("failed to prepare index spill directory: %w", err)
+	}
+
+	s := &indexSpiller{
+		budget: budget,
+		ticker: time.NewTicker(interval),
+		stop:   make(chan struct{}),
+	}
+	lfs.spiller = s
+	lfs.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-s.ticker.C:
+				_, err := lfs.SpillIndex()
+				if err != nil {
+					vlog.Warnf("failed to spill index shards: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// StopIndexSpill stops the background check started by RunIndexSpill, spilled shards stay on disk.
+func (lfs *LogStructuredFS) StopIndexSpill() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	lfs.stopIndexSpill()
+}
+
+func (lfs *LogStructuredFS) stopIndexSpill() {
+	if lfs.spiller != nil {
+		lfs.spiller.ticker.Stop()
+		close(lfs.spiller.stop)
+		lfs.spiller = nil
+	}
+}
+
+// SpillIndex writes the least recently used resident shards to spill files until the resident index
+// fits in the budget of RunIndexSpill, it returns the number of spilled shards.
+func (lfs *LogStructuredFS) SpillIndex() (int, error) {
+	lfs.mu.RLock()
+	s := lfs.spiller
+	lfs.mu.RUnlock()
+	if s == nil {
+		return 0, nil
+	}
+
+	type resident struct {
+		imap   *indexMap
+		id     int
+		keys   int
+		access int64
+	}
+	var (
+		shards []resident
+		memory uint64
+	)
+	for i, imap := range lfs.indexs {
+		imap.mu.RLock()
+		if imap.spill == nil {
+			shards = append(shards, resident{imap: imap, id: i, keys: len(imap.index), access: imap.access.Load()})
+			memory += uint64(len(imap.index)) * indexEntryBytes
+		}
+		imap.mu.RUnlock()
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].access < shards[j].access
+	})
+
+	n := 0
+	for _, r := range shards {
+		if memory <= s.budget {
+			break
+		}
+		if r.keys == 0 {
+			continue
+		}
+
+		path := filepath.Join(lfs.directory, spillDirectory, fmt.Sprintf("%02d-%d.idx", r.id, time.Now().UnixNano()))
+		r.imap.mu.Lock()
+		// 统计之后分片可能已经被溢出或者写入，使用加锁之后的状态
+		if r.imap.spill != nil {
+			r.imap.mu.Unlock()
+			continue
+		}
+		keys := len(r.imap.index)
+		f, err := writeSpillFile(path, r.imap.index)
+		if err != nil {
+			r.imap.mu.Unlock()
+			return n, fmt.Errorf("failed to spill index shard %d: %w", r.id, err)
+		}
+		r.imap.index, r.imap.spill = nil, f
+		r.imap.mu.Unlock()
+
+		lfs.spillStats.spills.Add(1)
+		memory -= uint64(r.keys) * indexEntryBytes
+		n++
+		vlog.Infof("index shard %d with %d keys spilled to disk", r.id, keys)
+	}
+	return n, nil
+}
+
+// IndexStats returns how many index shards and keys are in memory and in spill files.
+func (lfs *LogStructuredFS) IndexStats() IndexStats {
+	stats := IndexStats{Kind: lfs.indexKind().String(), Shards: len(lfs.indexs), EntryBytes: indexEntryBytes}
+	if lfs.fingerprints != nil {
+		stats.Collisions = int(lfs.fingerprints.size.Load())
+	}
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		if imap.spill != nil {
+			stats.SpilledShards++
+			stats.SpilledKeys += imap.spill.count
+			stats.SpilledBytes += uint64(imap.spill.count) * spillEntrySize
+		} else {
+			stats.ResidentKeys += len(imap.index)
+		}
+		imap.mu.RUnlock()
+	}
+	stats.MemoryBytes = uint64(stats.ResidentKeys) * indexEntryBytes
+
+	stats.Spills = lfs.spillStats.spills.Load()
+	stats.Loads = lfs.spillStats.loads.Load()
+
+	lfs.mu.RLock()
+	if lfs.spiller != nil {
+		stats.Budget = lfs.spiller.budget
+	}
+	lfs.mu.RUnlock()
+	return stats
+}
+
+// loadShard 把溢出的 imap 加载回内存，调用者持有分片的写锁
+func (lfs *LogStructuredFS) loadShard(imap *indexMap) {
+	if imap.load() {
+		lfs.spillStats.loads.Add(1)
+	}
+}
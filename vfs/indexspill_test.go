@@ -0,0 +1,110 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexSpill(t *testing.T) {
+	dir := t.TempDir()
+	fss := openLSNTestFS(t, dir)
+
+	for i := 0; i < 200; i++ {
+		putText(t, fss, fmt.Sprintf("key-%d", i), fmt.Sprintf("v%d", i))
+	}
+	// 没有调用 RunIndexSpill 时不溢出
+	n, err := fss.SpillIndex()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// 预算小于任何一个分片，全部分片都溢出到磁盘
+	require.NoError(t, fss.RunIndexSpill(1, time.Hour))
+	require.NoError(t, fss.RunIndexSpill(1, time.Hour))
+	n, err = fss.SpillIndex()
+	require.NoError(t, err)
+	assert.Equal(t, shard, n)
+
+	stats := fss.IndexStats()
+	assert.Equal(t, shard, stats.SpilledShards)
+	assert.Equal(t, 200, stats.SpilledKeys)
+	assert.Zero(t, stats.ResidentKeys)
+	assert.Zero(t, stats.MemoryBytes)
+	assert.Equal(t, uint64(200*spillEntrySize), stats.SpilledBytes)
+	assert.Equal(t, uint64(1), stats.Budget)
+
+	// 读取溢出的分片不需要加载回内存
+	assert.Equal(t, 200, fss.KeysCount())
+	assert.Equal(t, "v7", fetchText(fss, "key-7"))
+	_, ok := fss.StatSegment("key-8")
+	assert.True(t, ok)
+	_, ok = fss.StatSegment("missing")
+	assert.False(t, ok)
+	count := 0
+	require.NoError(t, fss.RangeSegments(func(seg *Segment) bool {
+		count++
+		return true
+	}))
+	assert.Equal(t, 200, count)
+	assert.Zero(t, fss.IndexStats().Loads)
+
+	// 回收迁移记录直接修改溢出文件中的索引项
+	old := fss.regionID
+	require.NoError(t, fss.RolloverRegion())
+	for i := 0; i < 150; i++ {
+		require.NoError(t, fss.DeleteSegment(fmt.Sprintf("key-%d", i)))
+	}
+	loads := fss.IndexStats().Loads
+	assert.Greater(t, loads, uint64(0))
+	_, err = fss.SpillIndex()
+	require.NoError(t, err)
+	_, err = fss.compactRegion(old, fss.regions[old])
+	require.NoError(t, err)
+	assert.Equal(t, loads, fss.IndexStats().Loads)
+	assert.Equal(t, shard, fss.IndexStats().SpilledShards)
+	assert.Equal(t, "v199", fetchText(fss, "key-199"))
+	inode, ok := fss.StatSegment("key-199")
+	require.True(t, ok)
+	assert.NotEqual(t, old, inode.RegionID)
+
+	// 写入把分片加载回内存
+	putText(t, fss, "key-199", "updated")
+	stats = fss.IndexStats()
+	assert.Equal(t, shard-1, stats.SpilledShards)
+	assert.Greater(t, stats.MemoryBytes, uint64(0))
+	assert.Equal(t, "updated", fetchText(fss, "key-199"))
+	version, seg, err := fss.FetchSegment("key-198")
+	require.NoError(t, err)
+	require.NoError(t, fss.UpdateSegmentWithCAS("key-198", version, seg))
+	assert.Equal(t, "v198", fetchText(fss, "key-198"))
+
+	snap := fss.Snapshot()
+	assert.Equal(t, 50, snap.Len())
+	snap.Release()
+
+	// 检查点包括溢出的分片，重新打开之后全部 key 都在
+	fss.StopIndexSpill()
+	require.NoError(t, fss.CloseFS())
+	fss = openLSNTestFS(t, dir)
+	defer fss.CloseFS()
+	assert.Equal(t, 50, fss.KeysCount())
+	assert.Equal(t, "v150", fetchText(fss, "key-150"))
+	assert.Empty(t, fetchText(fss, "key-1"))
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// IndexKind selects how keys are indexed in memory.
+type IndexKind uint8
+
+const (
+	// HashIndex only keeps the hash of every key, it is the smallest index but can not scan key ranges.
+	HashIndex IndexKind = iota
+	// SkipListIndex additionally keeps every key in a skiplist ordered lexicographically.
+	SkipListIndex
+	// FingerprintIndex keeps only the hash of every key like HashIndex, reads compare the key stored on disk
+	// and writes move a key whose hash collides with another key to a second hash. It suits long keys.
+	FingerprintIndex
+)
+
+// ErrUnorderedIndex is returned by RangeKeys when the file system uses the hash index.
+var ErrUnorderedIndex = errors.New("range scans require the skiplist index")
+
+// ParseIndexKind converts the name used in configuration files to an IndexKind.
+func ParseIndexKind(name string) (IndexKind, error) {
+	switch name {
+	case "", "hash":
+		return HashIndex, nil
+	case "skiplist":
+		return SkipListIndex, nil
+	case "fingerprint":
+		return FingerprintIndex, nil
+	}
+	return HashIndex, errors.New("unsupported index kind: " + name)
+}
+
+// String returns the name of the index kind used in configuration files.
+func (k IndexKind) String() string {
+	switch k {
+	case SkipListIndex:
+		return "skiplist"
+	case FingerprintIndex:
+		return "fingerprint"
+	}
+	return "hash"
+}
+
+const (
+	maxSkipLevel = 24
+	skipFactor   = 0.25
+)
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// skipList is a sorted set of keys. Only the key text is stored, inodes are
+// still looked up through the hash index so both indexes never disagree on where
+// a record lives.
+type skipList struct {
+	mu     sync.RWMutex
+	head   *skipNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, maxSkipLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (sl *skipList) randomLevel() int {
+	level := 1
+	for level < maxSkipLevel && sl.rand.Float64() < skipFactor {
+		level++
+	}
+	return level
+}
+
+// insert adds key to the list, inserting an existing key is a no-op.
+func (sl *skipList) insert(key string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	var update [maxSkipLevel]*skipNode
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	if next := node.next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+
+	inserted := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		inserted.next[i] = update[i].next[i]
+		update[i].next[i] = inserted
+	}
+	sl.length++
+}
+
+// remove deletes key from the list, removing a missing key is a no-op.
+func (sl *skipList) remove(key string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	var update [maxSkipLevel]*skipNode
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	target := node.next[0]
+	if target == nil || target.key != key {
+		return
+	}
+
+	for i := 0; i < len(target.next); i++ {
+		update[i].next[i] = target.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// ascend calls fn for every key in [start, end) in order until fn returns false,
+// an empty end means there is no upper bound.
+func (sl *skipList) ascend(start, end string, fn func(key string) bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < start {
+			node = node.next[i]
+		}
+	}
+
+	for node = node.next[0]; node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			return
+		}
+		if !fn(node.key) {
+			return
+		}
+	}
+}
+
+func (sl *skipList) size() int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.length
+}
+
+// RangeKeys returns at most limit live keys in [start, end) in lexicographic order,
+// an empty end means there is no upper bound. It is only available with SkipListIndex.
+func (lfs *LogStructuredFS) RangeKeys(start, end string, limit int) ([]string, error) {
+	if lfs.keys == nil {
+		return nil, ErrUnorderedIndex
+	}
+
+	var (
+		keys    = make([]string, 0, limit)
+		expired []string
+	)
+	lfs.keys.ascend(start, end, func(key string) bool {
+		// Keys expire lazily in the hash index, drop them from the skiplist as they are found.
+		if _, ok := lfs.StatSegment(key); !ok {
+			expired = append(expired, key)
+			return true
+		}
+		keys = append(keys, key)
+		return len(keys) < limit
+	})
+
+	for _, key := range expired {
+		lfs.keys.remove(key)
+	}
+
+	return keys, nil
+}
+
+// rebuildKeyIndex fills the skiplist from the data regions, the hash index
+// recovered from checkpoints does not contain the key text.
+// Regions in object storage use the keys kept in their local stubs.
+func (lfs *LogStructuredFS) rebuildKeyIndex() error {
+	lfs.rangeRemoteKeys(func(key string) {
+		lfs.keys.insert(key)
+	})
+	return lfs.rangeSegments(false, func(seg *Segment) bool {
+		lfs.keys.insert(seg.GetKeyString())
+		return true
+	})
+}
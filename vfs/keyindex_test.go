@@ -0,0 +1,106 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipList(t *testing.T) {
+	sl := newSkipList()
+	for _, key := range []string{"d", "b", "a", "c", "b", "e"} {
+		sl.insert(key)
+	}
+	assert.Equal(t, 5, sl.size())
+
+	collect := func(start, end string) []string {
+		var keys []string
+		sl.ascend(start, end, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, collect("", ""))
+	assert.Equal(t, []string{"b", "c"}, collect("b", "d"))
+	assert.Equal(t, []string{"c", "d", "e"}, collect("bb", ""))
+
+	sl.remove("c")
+	sl.remove("missing")
+	assert.Equal(t, 4, sl.size())
+	assert.Equal(t, []string{"b", "d"}, collect("b", "e"))
+}
+
+func TestRangeKeys(t *testing.T) {
+	dir := t.TempDir()
+	open := func(index IndexKind) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Index:     index,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open(SkipListIndex)
+	for i := 5; i >= 1; i-- {
+		key := fmt.Sprintf("event:2024-01-0%d", i)
+		seg, err := NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	seg, err := NewSegment("event:expired", types.NewText("hello"), 1)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("event:expired", seg))
+	assert.NoError(t, fss.DeleteSegment("event:2024-01-03"))
+
+	keys, err := fss.RangeKeys("event:2024-01-02", "event:2024-01-05", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event:2024-01-02", "event:2024-01-04"}, keys)
+
+	keys, err = fss.RangeKeys("", "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event:2024-01-01", "event:2024-01-02"}, keys)
+
+	// 过期的 key 在扫描时会被清理掉
+	time.Sleep(1100 * time.Millisecond)
+	keys, err = fss.RangeKeys("event:e", "", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, 4, fss.keys.size())
+	assert.NoError(t, fss.CloseFS())
+
+	// 重新打开时从数据文件重建有序索引
+	fss = open(SkipListIndex)
+	keys, err = fss.RangeKeys("event:", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event:2024-01-01", "event:2024-01-02", "event:2024-01-04", "event:2024-01-05"}, keys)
+	assert.NoError(t, fss.CloseFS())
+
+	fss = open(HashIndex)
+	_, err = fss.RangeKeys("", "", 10)
+	assert.ErrorIs(t, err, ErrUnorderedIndex)
+	assert.NoError(t, fss.CloseFS())
+}
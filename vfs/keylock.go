@@ -0,0 +1,85 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyLockStripes 是每个文件系统默认的 key 锁分段数量
+const keyLockStripes = 256
+
+// KeyLocks is a striped lock manager for read-modify-write operations. Keys are mapped to a fixed
+// number of mutexes by their inode number, so operations on the same key are serialized while
+// different keys rarely wait for each other, and no lock is allocated per key.
+type KeyLocks struct {
+	stripes []sync.Mutex
+}
+
+// NewKeyLocks returns a lock manager with n stripes, n less than 1 uses a single stripe.
+func NewKeyLocks(n int) *KeyLocks {
+	if n < 1 {
+		n = 1
+	}
+	return &KeyLocks{stripes: make([]sync.Mutex, n)}
+}
+
+func (kl *KeyLocks) stripe(key string) int {
+	return int(InodeNum(key) % uint64(len(kl.stripes)))
+}
+
+// Lock locks the stripe of key and returns the function unlocking it.
+func (kl *KeyLocks) Lock(key string) func() {
+	mu := &kl.stripes[kl.stripe(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// LockKeys locks the stripes of all keys for operations writing more than one key. Stripes are
+// locked in ascending order and only once, so concurrent callers cannot deadlock each other.
+func (kl *KeyLocks) LockKeys(keys ...string) func() {
+	seen := make(map[int]struct{}, len(keys))
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		i := kl.stripe(key)
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, i := range stripes {
+		kl.stripes[i].Lock()
+	}
+	return func() {
+		for j := len(stripes) - 1; j >= 0; j-- {
+			kl.stripes[stripes[j]].Unlock()
+		}
+	}
+}
+
+// LockKey locks key for a read-modify-write operation and returns the function unlocking it.
+// Writers that replace the whole value do not take the lock, the operation should still write
+// back with UpdateSegmentWithCAS to detect them.
+func (lfs *LogStructuredFS) LockKey(key string) func() {
+	return lfs.locks.Lock(key)
+}
+
+// LockKeys is like LockKey for operations writing more than one key.
+func (lfs *LogStructuredFS) LockKeys(keys ...string) func() {
+	return lfs.locks.LockKeys(keys...)
+}
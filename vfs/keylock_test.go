@@ -0,0 +1,118 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLocks(t *testing.T) {
+	locks := NewKeyLocks(4)
+
+	// 读改写在同一个 key 上串行执行，计数不会丢失
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.Lock("counter")
+			defer unlock()
+			v := counter
+			counter = v + 1
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, counter)
+
+	// 多个 key 落在同一个分段上时只加锁一次，不同顺序的调用者不会死锁
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			locks.LockKeys(keys...)()
+		}()
+		go func() {
+			defer wg.Done()
+			reversed := make([]string, len(keys))
+			for j, key := range keys {
+				reversed[len(keys)-1-j] = key
+			}
+			locks.LockKeys(reversed...)()
+		}()
+	}
+	wg.Wait()
+
+	unlock := locks.LockKeys(keys...)
+	unlock()
+	assert.Len(t, NewKeyLocks(0).stripes, 1)
+}
+
+func TestLockKey(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	incr := func() {
+		unlock := fss.LockKey("counter")
+		defer unlock()
+
+		version, seg, err := fss.FetchSegment("counter")
+		value := int64(0)
+		if err == nil {
+			number, err := seg.ToNumber()
+			assert.NoError(t, err)
+			value = number.Value
+		}
+
+		seg, err = NewSegment("counter", types.NewNumber(value+1), 0)
+		assert.NoError(t, err)
+		if version == 0 {
+			assert.NoError(t, fss.PutSegment("counter", seg))
+			return
+		}
+		assert.NoError(t, fss.UpdateSegmentWithCAS("counter", version, seg))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			incr()
+		}()
+	}
+	wg.Wait()
+
+	_, seg, err := fss.FetchSegment("counter")
+	assert.NoError(t, err)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), number.Value)
+}
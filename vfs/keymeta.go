@@ -0,0 +1,120 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// KeyMeta describes where and how the latest version of a key is stored.
+type KeyMeta struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// Codec is the serialization format of the value
+	Codec string `json:"codec"`
+	// Version is the MVCC version used by compare-and-swap updates
+	Version uint64 `json:"version"`
+	LSN     uint64 `json:"lsn"`
+	// RegionID and Position locate the record, Remote is true when the region is in object storage
+	RegionID uint64 `json:"region_id"`
+	Position uint64 `json:"position"`
+	Remote   bool   `json:"remote"`
+	// Size is the bytes of the whole record on disk, ValueSize the bytes of the encoded value
+	Size      uint32 `json:"size"`
+	ValueSize uint32 `json:"value_size"`
+	// Compressed and Encrypted report the value transforms, which apply to every record written by the server
+	Compressed bool       `json:"compressed"`
+	Encrypted  bool       `json:"encrypted"`
+	Checksum   string     `json:"checksum"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// StatKey returns the metadata of a live key from the index and the record header,
+// the value is neither read nor decoded.
+func (lfs *LogStructuredFS) StatKey(ctx context.Context, key string) (*KeyMeta, error) {
+	inode, ok := lfs.StatSegment(key)
+	if !ok {
+		return nil, &inodeNotFound{InodeNum(key), "not found"}
+	}
+
+	lfs.mu.RLock()
+	_, remote := lfs.remote[inode.RegionID]
+	lfs.mu.RUnlock()
+
+	fd, release, err := lfs.openRegion(ctx, inode.RegionID)
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, fmt.Errorf("data region with ID %d not found", inode.RegionID)
+	}
+	defer release()
+
+	// 只读取记录头部和 key，key 用来排除 inum 冲突
+	reader := recordReaders[currentFormat]
+	buf := make([]byte, reader.headerSize)
+	_, err = fd.ReadAt(buf, int64(inode.Position))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment header: %w", err)
+	}
+
+	var seg Segment
+	err = reader.parseHeader(buf, &seg)
+	if err != nil {
+		return nil, err
+	}
+	if seg.KeySize != uint32(len(key)) {
+		return nil, &inodeNotFound{InodeNum(key), "not found"}
+	}
+
+	keybuf := make([]byte, seg.KeySize)
+	_, err = fd.ReadAt(keybuf, int64(inode.Position)+int64(reader.headerSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key in segment: %w", err)
+	}
+	if string(keybuf) != key || seg.IsTombstone() {
+		return nil, &inodeNotFound{InodeNum(key), "not found"}
+	}
+
+	algorithm, err := regionChecksum(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksum algorithm of region: %w", err)
+	}
+
+	meta := &KeyMeta{
+		Key:        key,
+		Type:       seg.GetTypeString(),
+		Codec:      seg.GetCodecString(),
+		Version:    inode.mvcc,
+		LSN:        seg.LSN,
+		RegionID:   inode.RegionID,
+		Position:   inode.Position,
+		Remote:     remote,
+		Size:       inode.Length,
+		ValueSize:  seg.ValueSize,
+		Compressed: transformer.IsCompressionEnabled() && transformer.Compressor != nil,
+		Encrypted:  transformer.IsEncryptionEnabled() && transformer.Encryptor != nil,
+		Checksum:   algorithm.String(),
+		CreatedAt:  time.Unix(0, int64(seg.CreatedAt)),
+	}
+	if seg.ExpiredAt != 0 {
+		expiresAt := time.Unix(0, int64(seg.ExpiredAt))
+		meta.ExpiresAt = &expiresAt
+	}
+	return meta, nil
+}
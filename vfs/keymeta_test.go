@@ -0,0 +1,64 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatKey(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	seg, err := NewSegment("user:1", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("user:1", seg))
+
+	seg, err = NewSegment("session:1", types.NewText("token"), 60)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("session:1", seg))
+	assert.NoError(t, fss.PutSegment("session:1", seg))
+
+	meta, err := fss.StatKey(context.Background(), "user:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "text", meta.Type)
+	assert.Equal(t, fss.regionID, meta.RegionID)
+	assert.Equal(t, uint64(len(regionMetadata)), meta.Position)
+	assert.Greater(t, meta.Size, meta.ValueSize)
+	assert.False(t, meta.Remote)
+	assert.Nil(t, meta.ExpiresAt)
+	assert.WithinDuration(t, time.Now(), meta.CreatedAt, time.Minute)
+	assert.Equal(t, checksumAlgorithm.String(), meta.Checksum)
+
+	meta, err = fss.StatKey(context.Background(), "session:1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), meta.Version)
+	assert.NotNil(t, meta.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *meta.ExpiresAt, 5*time.Second)
+
+	_, err = fss.StatKey(context.Background(), "missing")
+	assert.Error(t, err)
+}
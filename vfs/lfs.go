@@ -16,6 +16,7 @@ package vfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -35,6 +37,8 @@ import (
 	"github.com/auula/urnadb/utils"
 	"github.com/robfig/cron/v3"
 	"github.com/spaolacci/murmur3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -51,7 +55,9 @@ const (
 	GC_INIT GC_STATE = iota // gc 第一次执行就是这个状态
 	GC_ACTIVE
 	GC_INACTIVE
-	SEGMENT_PADDING = 26
+	GC_PAUSED       // 运维暂停了回收，定时和手动触发的回收都不会执行
+	GC_FAILED       // 上一次回收失败，失败原因记录在 gcreason 中
+	SEGMENT_PADDING = 34
 )
 
 var (
@@ -61,13 +67,85 @@ var (
 	fileExtension    = ".db"
 	indexFileName    = "index.db"
 	regionThreshold  = int64(1 * GB) // 1GB
-	dataFileMetadata = []byte{0xDB, 0x00, 0x01, 0x01}
+	dataFileMetadata = formatHeader(CRC32, formatV1)
+	// region 文件头部记录了记录的格式版本和校验算法，旧版本的 region 在启动时升级
+	regionMetadata = formatHeader(CRC32, currentFormat)
+	// 新的 region 使用的校验算法
+	checksumAlgorithm = CRC32
+	// vfs 模块和 region 压缩任务分别使用独立的日志记录器
+	vlog       = clog.Module("vfs")
+	compactLog = clog.Module("compaction")
 )
 
+// ErrChecksumMismatch is returned when a record fails CRC32 validation.
+var ErrChecksumMismatch = errors.New("crc32 checksum mismatch")
+
+// ErrCheckpointRunning is returned when an index checkpoint is already being generated.
+var ErrCheckpointRunning = errors.New("index checkpoint is already running")
+
+// ErrCompactRunning is returned when a region compaction is already in progress.
+var ErrCompactRunning = errors.New("region compaction is already running")
+
+// ErrVersionConflict is returned by UpdateSegmentWithCAS when the key was changed after it was fetched.
+var ErrVersionConflict = errors.New("failed to update data due to version conflict")
+
+// ErrKeyNotFound is matched by errors.Is when a read or an update finds no live record of the key.
+var ErrKeyNotFound = errors.New("key not found")
+
+// inodeNotFound 是 key 不在索引中或者已经过期的错误，保留原来的错误信息并且可以匹配 ErrKeyNotFound
+type inodeNotFound struct {
+	inum   uint64
+	reason string
+}
+
+func (e *inodeNotFound) Error() string {
+	return fmt.Sprintf("inode index for %d %s", e.inum, e.reason)
+}
+
+func (e *inodeNotFound) Is(target error) bool {
+	return target == ErrKeyNotFound
+}
+
+// CorruptedError reports a segment that failed checksum validation at read time.
+type CorruptedError struct {
+	Key      string
+	RegionID uint64
+	Position uint64
+	Err      error
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("segment of key %s corrupted at region %d offset %d: %v", e.Key, e.RegionID, e.Position, e.Err)
+}
+
+func (e *CorruptedError) Unwrap() error {
+	return e.Err
+}
+
+// Repairer fetches a healthy copy of the segment from another node, e.g. a replica.
+type Repairer func(key string) (*Segment, error)
+
+// WriteHook is called after a segment is written successfully, deletes are reported as tombstone segments.
+// It is called while holding the file system lock, so it must be fast and must not call back into the file system.
+type WriteHook func(seg *Segment)
+
 type Options struct {
 	Path      string
 	FSPerm    os.FileMode
 	Threshold uint8
+	// Progress is optional, it reports the startup recovery progress while OpenFS is running
+	Progress *RecoveryProgress
+	// Checksum is the algorithm of new regions, existing regions keep the algorithm in their header
+	Checksum Checksum
+	// Index selects the in-memory key index, SkipListIndex enables RangeKeys
+	Index IndexKind
+	// DirectIO writes the active region bypassing the page cache, O_DIRECT on Linux and F_NOCACHE on macOS
+	DirectIO bool
+	// Separator splits the first-level prefix of keys for the prefix statistics, empty disables them
+	Separator string
+	// PrefixGroup is optional, it returns a group inside the first-level prefix of key that is also
+	// counted by PrefixUsage, or empty. Group names contain the separator so they never equal a first-level prefix
+	PrefixGroup func(key string) string
 }
 
 // Inode represents a file system node with metadata.
@@ -75,6 +153,7 @@ type Inode struct {
 	RegionID  uint64 // Unique identifier for the region
 	Position  uint64 // Position within the file
 	Length    uint32 // Data record length
+	prefix    uint32 // Interned first-level key prefix or prefix group, see prefixTable
 	ExpiredAt uint64 // Expiration time of the Inode (UNIX timestamp in nano seconds)
 	CreatedAt uint64 // Creation time of the Inode (UNIX timestamp in nano seconds)
 	mvcc      uint64 // Multi-version concurrency ID
@@ -83,6 +162,9 @@ type Inode struct {
 type indexMap struct {
 	mu    sync.RWMutex
 	index map[uint64]*Inode
+	// spill 不为 nil 时分片溢出到了磁盘，index 为 nil，access 是最后一次访问的时间，参考 indexspill.go
+	spill  *spillFile
+	access atomic.Int64
 }
 
 // LogStructuredFS represents the virtual file storage system.
@@ -95,35 +177,107 @@ type LogStructuredFS struct {
 	active           *os.File
 	regions          map[uint64]*os.File
 	gcstate          GC_STATE
+	gcreason         string
+	gcsince          time.Time
+	gcpause          *compactPause
 	compactTask      *cron.Cron
+	compactSchedule  string
 	dirtyRegions     []*os.File
 	checkpointWorker *time.Ticker
+	checkpointing    atomic.Bool
+	checkpointAt     atomic.Int64
+	flusher          *flusher
+	directIO         bool
+	direct           *directWriter
+	throttle         atomic.Pointer[compactThrottle]
+	tombstoneGrace   atomic.Int64
+	compaction       compactionStats
+	usage            usageTable
+	prefixes         *prefixTable
+	expiry           *expiryCompactor
+	spiller          *indexSpiller
+	spillStats       spillCounters
+	unflushed        atomic.Bool
+	qmu              sync.Mutex
+	quarantine       map[uint64]map[uint64]struct{}
+	repairer         Repairer
+	wal              *os.File
+	progress         *RecoveryProgress
+	hook             WriteHook
+	keys             *skipList
+	fingerprints     *fingerprintTable
+	replicator       Replicator
+	remote           map[uint64]*remoteRegion
+	tier             *tiering
+	backup           *backup
+	trash            *trash
+	lsn              uint64
+	horizon          uint64
+	lsnSignal        chan struct{}
+	faults           atomic.Pointer[Faults]
+	recovery         time.Duration
+	locks            *KeyLocks
+	pins             snapshotPins
 }
 
 // PutSegment inserts a Segment record into the LogStructuredFS virtual file system.
 func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
-	inum := InodeNum(key)
+	_, err := lfs.PutSegmentContext(context.Background(), key, seg)
+	return err
+}
 
-	bytes, err := serializedSegment(seg)
-	if err != nil {
-		return err
+// PutSegmentContext is like PutSegment but records the write as a span of the trace in ctx,
+// and returns the MVCC version of key after the write, seg.LSN is its log sequence number.
+// The write is abandoned with ctx.Err() if ctx is done before it reaches the active region.
+func (lfs *LogStructuredFS) PutSegmentContext(ctx context.Context, key string, seg *Segment) (version uint64, err error) {
+	_, span := tracer.Start(ctx, "vfs.PutSegment", trace.WithAttributes(
+		attribute.String("urnadb.key", key),
+		attribute.Int("urnadb.segment.size", int(seg.Size())),
+	))
+	defer func() { endSpan(span, err) }()
+	defer lfs.observeLatency(time.Now())
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if lfs.replicator != nil {
+		err := lfs.replicator.Replicate(ctx, &Operation{Kind: OpPut, Key: key, Segment: seg})
+		if err != nil {
+			return 0, err
+		}
+		// 复制日志应用的是 Segment 的副本，从索引中读取应用之后的版本号
+		inode, _ := lfs.StatSegment(key)
+		return inode.mvcc, nil
 	}
 
+	return lfs.putSegment(ctx, key, seg)
+}
+
+func (lfs *LogStructuredFS) putSegment(ctx context.Context, key string, seg *Segment) (uint64, error) {
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 
+	// 等待写锁的时候 ctx 已经结束，还没有写入任何数据可以直接放弃
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	inum, err := lfs.resolveInum(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
 	// Append data to the active region with a lock.
-	err = appendToActiveRegion(lfs.active, bytes)
+	err = lfs.appendWithLSN(seg)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Select an index shard based on the hash function and update it.
 	// To avoid locking the entire index, only the relevant shard is locked.
 	imap := lfs.indexs[inum%uint64(shard)]
-	imap.mu.Lock()
-	// Update the Inode metadata within a critical section.
-	imap.index[inum] = &Inode{
+	inode := &Inode{
 		RegionID:  lfs.regionID,
 		Position:  lfs.offset,
 		Length:    seg.Size(),
@@ -131,18 +285,39 @@ func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
 		ExpiredAt: seg.ExpiredAt,
 		mvcc:      0,
 	}
+	lfs.tagInode(key, inode)
+	imap.mu.Lock()
+	lfs.loadShard(imap)
+	// 覆盖写继续递增原来的版本号，读取之后被覆盖的 key 不能再通过 CAS 更新
+	if old, ok := imap.index[inum]; ok {
+		inode.mvcc = atomic.LoadUint64(&old.mvcc) + 1
+		lfs.usage.remove(old)
+		lfs.prefixes.remove(old)
+	}
+	// Update the Inode metadata within a critical section.
+	imap.index[inum] = inode
+	lfs.usage.add(inode)
+	lfs.prefixes.add(inode)
+	version := inode.mvcc
 	imap.mu.Unlock()
 
+	if lfs.keys != nil {
+		lfs.keys.insert(key)
+	}
+
+	lfs.appendIndexLog(walPut, inum, inode)
+	lfs.notifyWrite(seg)
+
 	lfs.offset += uint64(seg.Size())
 
 	if lfs.offset >= uint64(regionThreshold) {
-		err := lfs.createActiveRegion()
+		err := lfs.rolloverRegion()
 		if err != nil {
-			return err
+			return version, err
 		}
 	}
 
-	return nil
+	return version, nil
 }
 
 func (lfs *LogStructuredFS) BatchFetchSegments(keys ...string) ([]*Segment, error) {
@@ -150,6 +325,9 @@ func (lfs *LogStructuredFS) BatchFetchSegments(keys ...string) ([]*Segment, erro
 	for _, key := range keys {
 		_, seg, err := lfs.FetchSegment(key)
 		if err != nil {
+			for _, s := range segs {
+				s.ReleaseToPool()
+			}
 			return nil, err
 		}
 		segs = append(segs, seg)
@@ -157,82 +335,305 @@ func (lfs *LogStructuredFS) BatchFetchSegments(keys ...string) ([]*Segment, erro
 	return segs, nil
 }
 
+// DeleteSegment deletes key, with the trash enabled the segment is moved into the trash namespace first.
 func (lfs *LogStructuredFS) DeleteSegment(key string) error {
-	seg := NewTombstoneSegment(key)
+	return lfs.DeleteSegmentContext(context.Background(), key)
+}
 
-	bytes, err := serializedSegment(seg)
-	if err != nil {
+// DeleteSegmentContext is like DeleteSegment but records the delete as a span of the trace in ctx.
+// The delete is abandoned with ctx.Err() if ctx is done before the tombstone is written.
+func (lfs *LogStructuredFS) DeleteSegmentContext(ctx context.Context, key string) (err error) {
+	_, span := tracer.Start(ctx, "vfs.DeleteSegment", trace.WithAttributes(
+		attribute.String("urnadb.key", key),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	if lfs.TrashRetention() > 0 && !IsTrashKey(key) {
+		err := lfs.moveToTrash(key)
+		if err != nil {
+			return fmt.Errorf("failed to move key to trash: %w", err)
+		}
+	}
+
+	if lfs.replicator != nil {
+		return lfs.replicator.Replicate(ctx, &Operation{Kind: OpDelete, Key: key})
+	}
+
+	return lfs.deleteSegment(ctx, key)
+}
+
+func (lfs *LogStructuredFS) deleteSegment(ctx context.Context, key string) error {
+	seg := NewTombstoneSegment(key)
+
 	// 写入和更新 offset 应该是一个整体操作
 	lfs.mu.Lock()
-	err = appendToActiveRegion(lfs.active, bytes)
+	if err := ctx.Err(); err != nil {
+		lfs.mu.Unlock()
+		return err
+	}
+
+	inum := lfs.inodeNum(key)
+	if lfs.fingerprints != nil {
+		// 指纹索引中占用这个 inum 的是另一个 key，要删除的 key 不存在，
+		// 写入墓碑会在重新扫描 region 恢复索引时删除另一个 key
+		other, ok, err := lfs.occupant(ctx, inum)
+		if err != nil || (ok && other != key) {
+			lfs.mu.Unlock()
+			return err
+		}
+	}
+
+	err := lfs.appendWithLSN(seg)
 	if err != nil {
 		lfs.mu.Unlock()
 		return err
 	}
 
 	lfs.offset += uint64(seg.Size())
-	lfs.mu.Unlock()
+	lfs.compaction.written.Add(1)
 
-	inum := InodeNum(key)
-	imap := lfs.indexs[inum%uint64(shard)]
-	if imap == nil {
-		return fmt.Errorf("inode index shard for %d not found", inum)
-	}
+	lfs.appendIndexLog(walDelete, inum, nil)
+	lfs.notifyWrite(seg)
 
+	// 释放 lfs.mu 之前更新索引，Snapshot 不会看到 LSN 已经包含删除但是索引中还有这个 key 的状态
+	imap := lfs.indexs[inum%uint64(shard)]
 	imap.mu.Lock()
-	delete(imap.index, inum)
+	// 溢出的分片中没有这个 key 时不需要加载回内存
+	if _, ok := imap.lookup(inum); ok {
+		lfs.loadShard(imap)
+	}
+	if old, ok := imap.index[inum]; ok {
+		lfs.usage.remove(old)
+		lfs.prefixes.remove(old)
+		delete(imap.index, inum)
+	}
 	imap.mu.Unlock()
+	lfs.mu.Unlock()
+
+	if lfs.keys != nil {
+		lfs.keys.remove(key)
+	}
 
 	return nil
 }
 
+// FetchSegment reads the Segment of key and its multi-version concurrency ID.
+// The caller returns the Segment with ReleaseToPool once it is no longer used.
 func (lfs *LogStructuredFS) FetchSegment(key string) (uint64, *Segment, error) {
-	inum := InodeNum(key)
+	return lfs.FetchSegmentContext(context.Background(), key)
+}
+
+// FetchSegmentContext is like FetchSegment but records the read as a span of the trace in ctx.
+// The read returns ctx.Err() if ctx is done before the segment is read from its region,
+// including while waiting for a region in object storage to be downloaded.
+func (lfs *LogStructuredFS) FetchSegmentContext(ctx context.Context, key string) (version uint64, seg *Segment, err error) {
+	_, span := tracer.Start(ctx, "vfs.FetchSegment", trace.WithAttributes(
+		attribute.String("urnadb.key", key),
+	))
+	defer func() { endSpan(span, err) }()
+	defer lfs.observeLatency(time.Now())
+
+	version, seg, err = lfs.fetchSegment(ctx, key)
+	if err == nil {
+		segmentCounter.Acquire(seg)
+	}
+	return version, seg, err
+}
+
+func (lfs *LogStructuredFS) fetchSegment(ctx context.Context, key string) (uint64, *Segment, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	inum := lfs.inodeNum(key)
 	imap := lfs.indexs[inum%uint64(shard)]
 	if imap == nil {
 		return 0, nil, fmt.Errorf("inode index shard for %d not found", inum)
 	}
 
 	imap.mu.RLock()
-	inode, ok := imap.index[inum]
+	inode, ok := imap.lookup(inum)
 	imap.mu.RUnlock()
 	if !ok {
-		return 0, nil, fmt.Errorf("inode index for %d not found", inum)
+		return 0, nil, &inodeNotFound{inum, "not found"}
 	}
 
 	if atomic.LoadUint64(&inode.ExpiredAt) <= uint64(time.Now().UnixNano()) &&
 		atomic.LoadUint64(&inode.ExpiredAt) != 0 {
 		imap.mu.Lock()
-		delete(imap.index, inum)
+		// 读取之后 key 可能已经被重新写入，只删除过期的 inode，溢出的分片中过期的 inode 在加载回内存之后清理
+		if imap.index[inum] == inode {
+			lfs.usage.remove(inode)
+			lfs.prefixes.remove(inode)
+			delete(imap.index, inum)
+		}
 		imap.mu.Unlock()
-		return 0, nil, fmt.Errorf("inode index for %d has expired", inum)
+		return 0, nil, &inodeNotFound{inum, "has expired"}
 	}
 
-	fd, ok := lfs.regions[atomic.LoadUint64(&inode.RegionID)]
-	if !ok {
+	regionID, position := atomic.LoadUint64(&inode.RegionID), atomic.LoadUint64(&inode.Position)
+	if lfs.IsQuarantined(regionID, position) {
+		return lfs.repairSegment(ctx, key, &CorruptedError{
+			Key: key, RegionID: regionID, Position: position, Err: ErrChecksumMismatch,
+		})
+	}
+
+	fd, release, err := lfs.openRegion(ctx, regionID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if fd == nil {
 		return 0, nil, fmt.Errorf("data region with ID %d not found", inode.RegionID)
 	}
 
-	_, segment, err := readSegment(fd, atomic.LoadUint64(&inode.Position), SEGMENT_PADDING)
+	// 慢速磁盘上等待下载或者打开 region 的时候请求可能已经结束
+	if err := ctx.Err(); err != nil {
+		release()
+		return 0, nil, err
+	}
+
+	err = lfs.injectReadFault()
+	if err != nil {
+		release()
+		return 0, nil, err
+	}
+
+	_, segment, err := readSegment(fd, position, SEGMENT_PADDING)
+	release()
 	if err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			lfs.quarantineSegment(regionID, position)
+			vlog.Errorf("Segment of key %s corrupted at region %d offset %d", key, regionID, position)
+			return lfs.repairSegment(ctx, key, &CorruptedError{
+				Key: key, RegionID: regionID, Position: position, Err: err,
+			})
+		}
 		return 0, nil, fmt.Errorf("failed to read segment: %w", err)
 	}
 
+	// 指纹索引中 inum 相同的另一个 key 的记录，要读取的 key 不存在
+	if lfs.fingerprints != nil && string(segment.Key) != key {
+		return 0, nil, &inodeNotFound{inum, "not found"}
+	}
+
 	// Return the fetched segment and multi-version concurrency ID
 	return atomic.LoadUint64(&inode.mvcc), segment, nil
 }
 
+// SetWriteHook sets the hook notified after every successful write or delete.
+func (lfs *LogStructuredFS) SetWriteHook(hook WriteHook) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	lfs.hook = hook
+}
+
+// notifyWrite calls the write hook, the caller must hold lfs.mu.
+func (lfs *LogStructuredFS) notifyWrite(seg *Segment) {
+	if lfs.hook != nil {
+		lfs.hook(seg)
+	}
+}
+
+// SetRepairer sets the source used to re-fetch corrupted segments.
+func (lfs *LogStructuredFS) SetRepairer(repairer Repairer) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	lfs.repairer = repairer
+}
+
+// IsQuarantined reports whether the record at position of region failed checksum validation.
+func (lfs *LogStructuredFS) IsQuarantined(regionID, position uint64) bool {
+	lfs.qmu.Lock()
+	defer lfs.qmu.Unlock()
+	_, ok := lfs.quarantine[regionID][position]
+	return ok
+}
+
+func (lfs *LogStructuredFS) quarantineSegment(regionID, position uint64) {
+	lfs.qmu.Lock()
+	defer lfs.qmu.Unlock()
+	if lfs.quarantine[regionID] == nil {
+		lfs.quarantine[regionID] = make(map[uint64]struct{})
+	}
+	lfs.quarantine[regionID][position] = struct{}{}
+}
+
+// releaseQuarantine 修复之后的记录已经写到新的位置，旧的偏移量不会再被读取
+func (lfs *LogStructuredFS) releaseQuarantine(regionID, position uint64) {
+	lfs.qmu.Lock()
+	defer lfs.qmu.Unlock()
+	delete(lfs.quarantine[regionID], position)
+	if len(lfs.quarantine[regionID]) == 0 {
+		delete(lfs.quarantine, regionID)
+	}
+}
+
+// forgetQuarantine 压缩删除 region 文件之后，该 region 所有隔离的偏移量一起失效
+func (lfs *LogStructuredFS) forgetQuarantine(regionID uint64) {
+	lfs.qmu.Lock()
+	defer lfs.qmu.Unlock()
+	delete(lfs.quarantine, regionID)
+}
+
+type withoutRepairKey struct{}
+
+// WithoutRepair returns a context whose reads report corrupted segments instead of
+// repairing them, replicas serving a repair request use it so repairs never recurse.
+func WithoutRepair(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutRepairKey{}, true)
+}
+
+// repairSegment re-fetches a corrupted segment through the repairer and rewrites it locally,
+// the new record is appended to the active region so the quarantined offset is never read again.
+func (lfs *LogStructuredFS) repairSegment(ctx context.Context, key string, cerr *CorruptedError) (uint64, *Segment, error) {
+	lfs.mu.RLock()
+	repairer := lfs.repairer
+	lfs.mu.RUnlock()
+	if repairer == nil || ctx.Value(withoutRepairKey{}) != nil {
+		return 0, nil, cerr
+	}
+
+	seg, err := repairer(key)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: repair failed: %v", cerr, err)
+	}
+
+	// 修复的是本地损坏的记录，不经过复制日志直接写入
+	_, err = lfs.putSegment(context.Background(), key, seg)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: repair failed: %v", cerr, err)
+	}
+
+	lfs.releaseQuarantine(cerr.RegionID, cerr.Position)
+	vlog.Infof("Segment of key %s repaired from replica", key)
+	return lfs.fetchSegment(ctx, key)
+}
+
 // KeysCount iterate over each index in lfs.indexs.
 func (lfs *LogStructuredFS) KeysCount() int {
 	keys := 0
+	now := uint64(time.Now().UnixNano())
 	for _, imap := range lfs.indexs {
 		imap.mu.Lock()
+		if imap.spill != nil {
+			imap.rangeInodes(func(_ uint64, inode *Inode) bool {
+				if inode.ExpiredAt == 0 || inode.ExpiredAt > now {
+					keys += 1
+				}
+				return true
+			})
+			imap.mu.Unlock()
+			continue
+		}
 		for key, inode := range imap.index {
 			// Clean expired inode
 			if inode.ExpiredAt <= uint64(time.Now().UnixNano()) && inode.ExpiredAt != 0 {
+				lfs.usage.remove(inode)
+				lfs.prefixes.remove(inode)
 				delete(imap.index, key)
 			} else {
 				keys += 1
@@ -243,80 +644,212 @@ func (lfs *LogStructuredFS) KeysCount() int {
 	return keys
 }
 
+// StatSegment returns a copy of the inode that key points to without reading the region file.
+func (lfs *LogStructuredFS) StatSegment(key string) (Inode, bool) {
+	inum := lfs.inodeNum(key)
+	imap := lfs.indexs[inum%uint64(shard)]
+	if imap == nil {
+		return Inode{}, false
+	}
+
+	imap.mu.RLock()
+	inode, ok := imap.lookup(inum)
+	if !ok {
+		imap.mu.RUnlock()
+		return Inode{}, false
+	}
+
+	if inode.ExpiredAt <= uint64(time.Now().UnixNano()) && inode.ExpiredAt != 0 {
+		imap.mu.RUnlock()
+		return Inode{}, false
+	}
+
+	stat := Inode{
+		RegionID:  atomic.LoadUint64(&inode.RegionID),
+		Position:  atomic.LoadUint64(&inode.Position),
+		Length:    atomic.LoadUint32(&inode.Length),
+		ExpiredAt: atomic.LoadUint64(&inode.ExpiredAt),
+		CreatedAt: atomic.LoadUint64(&inode.CreatedAt),
+		mvcc:      atomic.LoadUint64(&inode.mvcc),
+	}
+	imap.mu.RUnlock()
+
+	// 指纹索引释放分片锁之后再从 region 中读取 key，避免持有分片锁获取 lfs.mu
+	return stat, lfs.matchKey(key, &stat)
+}
+
+// RangeSegments 按照 region 的顺序扫描数据文件，只把索引中仍然存活的 Segment 交给 fn 处理，
+// fn 返回 false 时停止遍历。内存索引中只有 inum 没有 key 原文，需要 key 的统计功能都依赖这个扫描。
+// 已经上传到对象存储的 region 会先下载到本地缓存。
+func (lfs *LogStructuredFS) RangeSegments(fn func(seg *Segment) bool) error {
+	return lfs.rangeSegments(true, fn)
+}
+
+// rangeSegments 的 remote 为 false 时跳过已经上传到对象存储的 region
+func (lfs *LogStructuredFS) rangeSegments(remote bool, fn func(seg *Segment) bool) error {
+	for _, regionId := range lfs.regionIDs(remote) {
+		fd, release, err := lfs.openRegion(context.Background(), regionId)
+		if err != nil {
+			return err
+		}
+		if fd == nil {
+			// 扫描期间 region 可能已经被垃圾回收掉了
+			continue
+		}
+
+		more, err := lfs.rangeRegion(regionId, fd, fn)
+		release()
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (lfs *LogStructuredFS) rangeRegion(regionId uint64, fd *os.File, fn func(seg *Segment) bool) (bool, error) {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	reader := newRegionReader(fd, finfo.Size())
+	offset := uint64(len(regionMetadata))
+	for offset < uint64(finfo.Size()) {
+		inum, segment, err := reader.readSegment(offset)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse data file segment: %w", err)
+		}
+
+		inum = lfs.recordInum(inum, segment)
+		imap := lfs.indexs[inum%uint64(shard)]
+		imap.mu.RLock()
+		inode, ok := imap.lookup(inum)
+		alive := ok && !segment.IsTombstone() &&
+			atomic.LoadUint64(&inode.RegionID) == regionId &&
+			atomic.LoadUint64(&inode.Position) == offset
+		imap.mu.RUnlock()
+
+		offset += uint64(segment.Size())
+
+		if !alive || (segment.ExpiredAt != 0 && segment.ExpiredAt <= uint64(time.Now().UnixNano())) {
+			continue
+		}
+
+		if !fn(segment) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 func InodeNum(key string) uint64 {
 	return murmur3.Sum64([]byte(key))
 }
 
 // UpdateSegmentWithCAS 通过类似于 MVCC 来实现更新操作数据一致性
 func (lfs *LogStructuredFS) UpdateSegmentWithCAS(key string, expected uint64, newseg *Segment) error {
-	inum := InodeNum(key)
+	return lfs.UpdateSegmentWithCASContext(context.Background(), key, expected, newseg)
+}
+
+// UpdateSegmentWithCASContext is like UpdateSegmentWithCAS but records the update as a span of the trace in ctx.
+// The update is abandoned with ctx.Err() if ctx is done before it reaches the active region.
+func (lfs *LogStructuredFS) UpdateSegmentWithCASContext(ctx context.Context, key string, expected uint64, newseg *Segment) (err error) {
+	_, span := tracer.Start(ctx, "vfs.UpdateSegmentWithCAS", trace.WithAttributes(
+		attribute.String("urnadb.key", key),
+		attribute.Int("urnadb.segment.size", int(newseg.Size())),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if lfs.replicator != nil {
+		return lfs.replicator.Replicate(ctx, &Operation{Kind: OpCAS, Key: key, Segment: newseg, Expected: expected})
+	}
+
+	return lfs.updateSegmentWithCAS(ctx, key, expected, newseg)
+}
+
+func (lfs *LogStructuredFS) updateSegmentWithCAS(ctx context.Context, key string, expected uint64, newseg *Segment) error {
+	inum := lfs.inodeNum(key)
 	imap := lfs.indexs[inum%uint64(shard)]
 	if imap == nil {
 		return fmt.Errorf("inode index shard for %d not found", inum)
 	}
 
+	// 更新数据时使用全局锁，和写入一样先获取全局锁再获取分片锁，避免和 PutSegment、Snapshot 死锁
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.fingerprints != nil {
+		other, ok, err := lfs.occupant(ctx, inum)
+		if err != nil {
+			return err
+		}
+		if ok && other != key {
+			return &inodeNotFound{inum, "not found"}
+		}
+	}
+
 	// 读取 Inode 信息，使用写锁保证 inode 的稳定性
 	imap.mu.Lock()
+	lfs.loadShard(imap)
 	inode, ok := imap.index[inum]
 	if !ok {
 		imap.mu.Unlock()
-		return fmt.Errorf("inode index for %d not found", inum)
+		return &inodeNotFound{inum, "not found"}
 	}
 
 	// 先进行 MVCC 检查，避免无效的写入
 	if !atomic.CompareAndSwapUint64(&inode.mvcc, expected, expected+1) {
 		imap.mu.Unlock()
-		return errors.New("failed to update data due to version conflict")
+		return ErrVersionConflict
 	}
 
-	// 生成新的数据
-	bytes, err := serializedSegment(newseg)
-	if err != nil {
+	// 放弃更新时恢复版本号，客户端可以使用相同的版本号重试
+	if err := ctx.Err(); err != nil {
+		atomic.StoreUint64(&inode.mvcc, expected)
 		imap.mu.Unlock()
 		return err
 	}
 
-	// 更新数据时使用全局锁
-	lfs.mu.Lock()
-	defer lfs.mu.Unlock()
-
-	err = appendToActiveRegion(lfs.active, bytes)
+	// 生成并写入新的数据
+	err := lfs.appendWithLSN(newseg)
 	if err != nil {
 		imap.mu.Unlock()
 		return fmt.Errorf("failed to update data: %w", err)
 	}
 
 	// 一次性原子更新 Inode 指针
+	lfs.usage.remove(inode)
+	lfs.prefixes.remove(inode)
 	atomic.StoreUint64(&inode.CreatedAt, newseg.CreatedAt)
 	atomic.StoreUint64(&inode.ExpiredAt, newseg.ExpiredAt)
 	atomic.StoreUint64(&inode.RegionID, lfs.regionID)
 	atomic.StoreUint32(&inode.Length, newseg.Size())
 	atomic.StoreUint64(&inode.Position, lfs.offset)
+	lfs.usage.add(inode)
+	lfs.prefixes.add(inode)
 
 	// 确保 offset 只在成功写入后递增
 	atomic.AddUint64(&lfs.offset, uint64(newseg.Size()))
 
+	lfs.appendIndexLog(walPut, inum, inode)
+	lfs.notifyWrite(newseg)
+
 	imap.mu.Unlock()
 	return nil
 }
 
-func (lfs *LogStructuredFS) changeRegions() error {
+// RolloverRegion syncs and seals the active region and starts writing a new one.
+func (lfs *LogStructuredFS) RolloverRegion() error {
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 
-	err := lfs.active.Sync()
-	if err != nil {
-		return fmt.Errorf("failed to change active regions: %w", err)
-	}
-
-	lfs.regions[lfs.regionID] = lfs.active
-
-	err = lfs.createActiveRegion()
-	if err != nil {
-		return fmt.Errorf("failed to chanage active regions: %w", err)
-	}
-
-	return nil
+	return lfs.rolloverRegion()
 }
 
 func (lfs *LogStructuredFS) createActiveRegion() error {
@@ -331,20 +864,22 @@ func (lfs *LogStructuredFS) createActiveRegion() error {
 		return fmt.Errorf("failed to create active region: %w", err)
 	}
 
-	n, err := active.Write(dataFileMetadata)
+	n, err := active.Write(formatHeader(checksumAlgorithm, currentFormat))
 	if err != nil {
 		return fmt.Errorf("failed to write active region metadata: %w", err)
 	}
 
-	if n != len(dataFileMetadata) {
+	if n != len(regionMetadata) {
 		return errors.New("failed to active region metadata write")
 	}
+	regionChecksums.Store(active, checksumAlgorithm)
+	lfs.usage.region(lfs.regionID)
 
 	lfs.active = active
-	lfs.offset = uint64(len(dataFileMetadata))
+	lfs.offset = uint64(len(regionMetadata))
 	lfs.regions[lfs.regionID] = lfs.active
 
-	return nil
+	return lfs.openDirectWriter(int64(lfs.offset))
 }
 
 func (lfs *LogStructuredFS) scanAndRecoverRegions() error {
@@ -371,6 +906,11 @@ func (lfs *LogStructuredFS) scanAndRecoverRegions() error {
 		}
 	}
 
+	err = lfs.scanRemoteRegions(files)
+	if err != nil {
+		return err
+	}
+
 	// Only find the largest file if there are more than one data files
 	if len(lfs.regions) > 0 {
 		var regionIds []uint64
@@ -394,8 +934,13 @@ func (lfs *LogStructuredFS) scanAndRecoverRegions() error {
 		if err != nil {
 			return fmt.Errorf("failed to get region file info: %w", err)
 		}
+		sum, err := regionChecksum(active)
+		if err != nil {
+			return fmt.Errorf("failed to get region checksum algorithm: %w", err)
+		}
 
-		if stat.Size() >= regionThreshold {
+		// 修改了校验算法之后不再向旧的 region 追加记录
+		if stat.Size() >= regionThreshold || sum != checksumAlgorithm {
 			return lfs.createActiveRegion()
 		} else {
 			offset, err := active.Seek(0, io.SeekEnd)
@@ -407,10 +952,16 @@ func (lfs *LogStructuredFS) scanAndRecoverRegions() error {
 		}
 	} else {
 		// If it is an empty directory, create a writable data file
+		// 新的 region ID 不能和已经上传到对象存储的 region 重复
+		for id := range lfs.remote {
+			if id > lfs.regionID {
+				lfs.regionID = id
+			}
+		}
 		return lfs.createActiveRegion()
 	}
 
-	return nil
+	return lfs.openDirectWriter(int64(lfs.offset))
 }
 
 // recoveryIndex performs index recovery operations on data files stored on disk.
@@ -434,20 +985,40 @@ func (lfs *LogStructuredFS) scanAndRecoverIndexs() error {
 		if err != nil {
 			return fmt.Errorf("failed to open index file: %w", err)
 		}
-		defer file.Close()
 
 		err = recoveryIndex(file, lfs.indexs)
+		file.Close()
 		if err != nil {
 			return fmt.Errorf("failed to recover index mapping: %w", err)
 		}
 
+		// 快照只反映上次正常关闭时的索引，之后崩溃不能再用它恢复。
+		// 重启之后到下一次检查点之前的写入不记录在旧的索引日志里，旧的日志也一起删除
+		err = os.Remove(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to remove loaded index file: %w", err)
+		}
+		err = cleanupDirtyIndexLog(lfs.directory, time.Now().Add(time.Hour).Unix())
+		if err != nil {
+			return fmt.Errorf("failed to remove stale index wal file: %w", err)
+		}
+
+		return nil
+	}
+
+	// 优先使用检查点加索引日志恢复，只需要重放日志尾部而不用扫描数据文件
+	ok, err := lfs.recoverFromIndexLog()
+	if err != nil {
+		return err
+	}
+	if ok {
 		return nil
 	}
 
 	// 只有数据文件大于 2 并且有检查点文件才加快启动恢复
 	ckpts, _ := filepath.Glob(filepath.Join(lfs.directory, "*.ids"))
-	if len(lfs.regions) >= 2 && len(ckpts) > 0 {
-		err := scanAndRecoverCheckpoint(ckpts, lfs.regions, lfs.indexs)
+	if len(lfs.regions)+len(lfs.remote) >= 2 && len(ckpts) > 0 {
+		err := scanAndRecoverCheckpoint(ckpts, lfs.regions, lfs.remote, lfs.indexs, lfs.fingerprints, lfs.progress)
 		if err != nil {
 			return err
 		}
@@ -457,7 +1028,7 @@ func (lfs *LogStructuredFS) scanAndRecoverIndexs() error {
 	// If the data files are very large and numerous, recovery time increases significantly.
 	// Frequent garbage collection reduces the size of data files and speeds up startup time.
 	// However, frequent garbage collection may negatively impact overall read/write performance.
-	return crashRecoveryAllIndex(lfs.regions, lfs.indexs)
+	return crashRecoveryAllIndex(lfs.regions, lfs.remote, lfs.indexs, lfs.fingerprints, lfs.progress)
 }
 
 func (lfs *LogStructuredFS) SetCompressor(compressor Compressor) {
@@ -475,103 +1046,115 @@ func (lfs *LogStructuredFS) RunCheckpoint(second uint32) {
 		return
 	}
 
-	// 设置 checkpoint 异步生成周期
-	lfs.checkpointWorker = time.NewTicker(time.Duration(second) * time.Second)
+	// 设置 checkpoint 异步生成周期，停止之后 checkpointWorker 会被清空，协程使用自己的副本
+	worker := time.NewTicker(time.Duration(second) * time.Second)
+	lfs.checkpointWorker = worker
 	lfs.mu.Unlock()
 
-	var chkptState bool = false
-
 	go func() {
-		for range lfs.checkpointWorker.C {
-			// 上一个检查点还在生成就跳过本次的
-			if chkptState {
+		for range worker.C {
+			// 只有数据文件大于 2 个，才生成快速恢复的检查点
+			if len(lfs.regions) < 2 {
+				vlog.Warnf("regions (%d%%) does not meet generated checkpoint status", len(lfs.regions)/10)
 				continue
 			}
 
-			// Toggle checkpoint state
-			chkptState = !chkptState
+			// 上一个检查点还在生成就跳过本次的
+			err := lfs.Checkpoint()
+			if err != nil && !errors.Is(err, ErrCheckpointRunning) {
+				vlog.Errorf("%v", err)
+			}
+		}
+	}()
+}
 
-			// 只有数据文件大于 2 个，才生成快速恢复的检查点
-			if len(lfs.regions) >= 2 {
-				ckpt := checkpointFileName(lfs.regionID)
-				path := filepath.Join(lfs.directory, ckpt)
+// Checkpoint writes a snapshot of the in-memory index, the next startup only replays
+// the index wal written after it. ErrCheckpointRunning is returned if one is already in progress.
+func (lfs *LogStructuredFS) Checkpoint() error {
+	if !lfs.checkpointing.CompareAndSwap(false, true) {
+		return ErrCheckpointRunning
+	}
+	defer lfs.checkpointing.Store(false)
 
-				fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, fsPerm)
-				if err != nil {
-					clog.Errorf("failed to generate index checkpoint file: %v", err)
-					chkptState = !chkptState
-					continue
-				}
+	ts := time.Now().Unix()
 
-				// 先写入 metadata
-				n, err := fd.Write(dataFileMetadata)
-				if err != nil {
-					clog.Errorf("failed to write checkpoint file metadata: %v", err)
-					chkptState = !chkptState
-					_ = utils.FlushToDisk(fd)
-					continue
-				}
-				if n != len(dataFileMetadata) {
-					clog.Warnf("checkpoint file metadata write incomplete")
-					chkptState = !chkptState
-					_ = utils.FlushToDisk(fd)
-					continue
-				}
+	// 先切换索引日志，生成检查点期间的索引修改都会记录在新的日志里
+	lfs.mu.Lock()
+	err := lfs.rotateIndexLog(ts)
+	regionID := lfs.regionID
+	lfs.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to rotate index wal file: %w", err)
+	}
 
-				// 遍历 indexs 确保锁的粒度更小
-				for _, imap := range lfs.indexs {
-					imap.mu.RLock()
-					// 遍历复制的数据，进行序列化写入
-					for inum, inode := range imap.index {
-						bytes, err := serializedIndex(inum, inode)
-						if err != nil {
-							clog.Warnf("failed to serialize index (inum: %d): %v", inum, err)
-							continue
-						}
-
-						_, err = fd.Write(bytes)
-						if err != nil {
-							clog.Errorf("failed to write serialized index (inum: %d): %v", inum, err)
-							continue
-						}
-					}
-					imap.mu.RUnlock()
-				}
+	ckpt := checkpointFileName(ts, regionID)
+	path := filepath.Join(lfs.directory, ckpt)
 
-				// 确保文件在当前循环结束时正确刷盘关闭
-				err = utils.FlushToDisk(fd)
-				if err != nil {
-					clog.Errorf("failed to generated checkpoint file: %v", err)
-					chkptState = !chkptState
-					continue
-				}
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, fsPerm)
+	if err != nil {
+		return fmt.Errorf("failed to generate index checkpoint file: %w", err)
+	}
 
-				// 使用 strings.TrimSuffix 去掉 .tmp 后缀，然后加上 .ids 后缀
-				newckpt := strings.TrimSuffix(ckpt, ".tmp") + ".ids"
-				err = os.Rename(filepath.Join(lfs.directory, ckpt), filepath.Join(lfs.directory, newckpt))
-				if err != nil {
-					clog.Errorf("failed to rename checkpoint temp file: %v", err)
-					chkptState = !chkptState
-					_ = utils.FlushToDisk(fd)
-					continue
-				}
+	// 先写入 metadata
+	n, err := fd.Write(dataFileMetadata)
+	if err != nil {
+		_ = utils.FlushToDisk(fd)
+		return fmt.Errorf("failed to write checkpoint file metadata: %w", err)
+	}
+	if n != len(dataFileMetadata) {
+		_ = utils.FlushToDisk(fd)
+		return errors.New("checkpoint file metadata write incomplete")
+	}
 
-				clog.Infof("generated checkpoint file (%s) successfully", newckpt)
+	// 遍历 indexs 确保锁的粒度更小
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		// 遍历复制的数据，进行序列化写入，溢出到磁盘的分片也要写入检查点
+		imap.rangeInodes(func(inum uint64, inode *Inode) bool {
+			bytes, err := serializedIndex(inum, inode)
+			if err != nil {
+				vlog.Warnf("failed to serialize index (inum: %d): %v", inum, err)
+				return true
+			}
 
-				// 滚动 checkpoint 文件确保只保留 1 份快照
-				err = cleanupDirtyCheckpoint(lfs.directory, newckpt)
-				if err != nil {
-					clog.Warnf("failed to cleanup old checkpoint file: %v", err)
-				}
+			_, err = fd.Write(bytes)
+			if err != nil {
+				vlog.Errorf("failed to write serialized index (inum: %d): %v", inum, err)
+			}
+			return true
+		})
+		imap.mu.RUnlock()
+	}
 
-				// Toggle checkpoint state
-				chkptState = !chkptState
+	// 确保文件正确刷盘关闭
+	err = utils.FlushToDisk(fd)
+	if err != nil {
+		return fmt.Errorf("failed to generated checkpoint file: %w", err)
+	}
 
-			} else {
-				clog.Warnf("regions (%d%%) does not meet generated checkpoint status", len(lfs.regions)/10)
-			}
-		}
-	}()
+	// 使用 strings.TrimSuffix 去掉 .tmp 后缀，然后加上 .ids 后缀
+	newckpt := strings.TrimSuffix(ckpt, ".tmp") + ".ids"
+	err = os.Rename(filepath.Join(lfs.directory, ckpt), filepath.Join(lfs.directory, newckpt))
+	if err != nil {
+		return fmt.Errorf("failed to rename checkpoint temp file: %w", err)
+	}
+
+	vlog.Infof("generated checkpoint file (%s) successfully", newckpt)
+	lfs.checkpointAt.Store(ts)
+
+	// 滚动 checkpoint 文件确保只保留 1 份快照
+	err = cleanupDirtyCheckpoint(lfs.directory, newckpt)
+	if err != nil {
+		vlog.Warnf("failed to cleanup old checkpoint file: %v", err)
+	}
+
+	// 旧的索引日志已经包含在新的检查点里了
+	err = cleanupDirtyIndexLog(lfs.directory, ts)
+	if err != nil {
+		vlog.Warnf("failed to cleanup old index wal file: %v", err)
+	}
+
+	return nil
 }
 
 func (lfs *LogStructuredFS) StopCheckpoint() {
@@ -582,6 +1165,9 @@ func (lfs *LogStructuredFS) StopCheckpoint() {
 		lfs.checkpointWorker.Stop()
 		lfs.checkpointWorker = nil
 	}
+
+	// 停止生成检查点之后的索引修改不再记录，旧的日志不能再用于恢复
+	lfs.discardIndexLog()
 }
 
 // RunCompactRegion 使用 robfig/cron 调度垃圾回收
@@ -598,29 +1184,105 @@ func (lfs *LogStructuredFS) RunCompactRegion(schedule string) error {
 
 	// 添加定时任务
 	_, err := lfs.compactTask.AddFunc(schedule, func() {
-		lfs.mu.Lock()
-		lfs.gcstate = GC_ACTIVE
-		lfs.mu.Unlock()
-
-		err := lfs.cleanupDirtyRegions()
-		if err != nil {
-			clog.Warnf("failed to compact dirty region: %v", err)
+		// 暂停期间跳过这一次调度，失败的原因已经记录在 GCStatus 中
+		err := lfs.CompactRegions()
+		if err != nil && !errors.Is(err, ErrCompactPaused) {
+			compactLog.Warnf("failed to compact dirty region: %v", err)
 		}
-
-		lfs.mu.Lock()
-		lfs.gcstate = GC_INACTIVE
-		lfs.mu.Unlock()
 	})
 
 	if err != nil {
 		return err
 	}
 
+	lfs.mu.Lock()
+	lfs.compactSchedule = schedule
+	lfs.mu.Unlock()
+
 	// 启动定时清理 Region 区域的任务
 	lfs.compactTask.Start()
 	return nil
 }
 
+// CompactSchedule returns the schedule of the region compaction and its next n run times,
+// the schedule is empty when scheduled compaction is not running.
+func (lfs *LogStructuredFS) CompactSchedule(n int) (string, []time.Time) {
+	lfs.mu.RLock()
+	task, schedule := lfs.compactTask, lfs.compactSchedule
+	lfs.mu.RUnlock()
+	if task == nil || schedule == "" {
+		return "", nil
+	}
+
+	entries := task.Entries()
+	if len(entries) == 0 {
+		return schedule, nil
+	}
+
+	runs := make([]time.Time, 0, n)
+	next := time.Now()
+	for len(runs) < n {
+		// 表达式永远不会触发时返回零值，例如 2 月 30 日
+		next = entries[0].Schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+	return schedule, runs
+}
+
+// CompactRegions 立即执行一次 region 垃圾回收，已经有回收任务在执行时返回 ErrCompactRunning
+// 暂停期间返回 ErrCompactPaused，失败的原因记录在 GCStatus 中
+func (lfs *LogStructuredFS) CompactRegions() (err error) {
+	err = lfs.beginCompaction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		lfs.endCompaction(err)
+	}()
+
+	_, span := tracer.Start(context.Background(), "vfs.CompactRegions", trace.WithAttributes(
+		attribute.Int("urnadb.regions", len(lfs.regions)),
+	))
+	err = lfs.cleanupDirtyRegions()
+	endSpan(span, err)
+
+	return err
+}
+
+// beginCompaction 标记开始回收，同一时间只能有一个回收任务，暂停期间返回 ErrCompactPaused
+func (lfs *LogStructuredFS) beginCompaction() error {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.gcstate == GC_ACTIVE {
+		return ErrCompactRunning
+	}
+	if lfs.gcpause != nil {
+		return ErrCompactPaused
+	}
+	// 上传中的 region 不能同时被回收
+	if lfs.tier != nil && lfs.tier.running {
+		return ErrTieringRunning
+	}
+	lfs.gcstate, lfs.gcreason, lfs.gcsince = GC_ACTIVE, "", time.Now()
+	return nil
+}
+
+// endCompaction 标记回收结束，err 不为 nil 时进入 GC_FAILED 状态并且记录原因，
+// 因为暂停而提前结束的回收不算失败
+func (lfs *LogStructuredFS) endCompaction(err error) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	lfs.gcstate, lfs.gcreason, lfs.gcsince = GC_INACTIVE, "", time.Now()
+	if err != nil && !errors.Is(err, ErrCompactPaused) {
+		lfs.gcstate, lfs.gcreason = GC_FAILED, err.Error()
+	}
+}
+
 // StopCompactRegion 关闭垃圾回收
 func (lfs *LogStructuredFS) StopCompactRegion() {
 	lfs.mu.Lock()
@@ -629,13 +1291,19 @@ func (lfs *LogStructuredFS) StopCompactRegion() {
 	if lfs.compactTask != nil {
 		lfs.compactTask.Stop()
 		lfs.compactTask = nil
+		lfs.compactSchedule = ""
 		lfs.gcstate = GC_INIT
 	}
 }
 
 // GCState returns the current garbage collection (GC) state
-// of the LogStructuredFS regions compressor worker.
+// of the LogStructuredFS regions compressor worker, GC_PAUSED once a paused compaction has stopped.
 func (lfs *LogStructuredFS) GCState() GC_STATE {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	if lfs.gcpause != nil && lfs.gcstate != GC_ACTIVE {
+		return GC_PAUSED
+	}
 	return lfs.gcstate
 }
 
@@ -646,6 +1314,11 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 	// Single region max size = 255GB
 	regionThreshold = int64(opt.Threshold) * GB
 
+	if !opt.Checksum.valid() {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %d", opt.Checksum)
+	}
+	checksumAlgorithm = opt.Checksum
+
 	err := checkFileSystem(opt.Path)
 	if err != nil {
 		return nil, err
@@ -656,14 +1329,37 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		mu:               sync.RWMutex{},
 		indexs:           make([]*indexMap, shard),
 		regions:          make(map[uint64]*os.File, 10),
-		offset:           uint64(len(dataFileMetadata)),
+		remote:           make(map[uint64]*remoteRegion),
+		offset:           uint64(len(regionMetadata)),
 		regionID:         0,
 		directory:        opt.Path,
 		gcstate:          GC_INIT,
 		compactTask:      nil,
 		checkpointWorker: nil,
+		quarantine:       make(map[uint64]map[uint64]struct{}),
+		progress:         opt.Progress,
+		directIO:         opt.DirectIO,
+		locks:            NewKeyLocks(keyLockStripes),
+	}
+
+	if opt.Separator != "" {
+		instance.prefixes = newPrefixTable(opt.Separator)
+		instance.prefixes.group = opt.PrefixGroup
+	}
+
+	// 冲突的 key 使用另一个 inum 写入，只有指纹索引能找到它们
+	if opt.Index == FingerprintIndex {
+		instance.fingerprints, err = openFingerprintTable(opt.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open fingerprint index: %w", err)
+		}
+	} else if hasFingerprintCollisions(opt.Path) {
+		return nil, fmt.Errorf("%s has key collisions resolved by the fingerprint index, open it with the fingerprint index", opt.Path)
 	}
 
+	instance.progress.start()
+	recoveryStart := time.Now()
+
 	for i := 0; i < shard; i++ {
 		instance.indexs[i] = &indexMap{
 			mu:    sync.RWMutex{},
@@ -677,10 +1373,33 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		return nil, fmt.Errorf("failed to recover data regions: %w", err)
 	}
 
+	err = instance.recoverLSN()
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover log sequence number: %w", err)
+	}
+
 	err = instance.scanAndRecoverIndexs()
 	if err != nil {
 		return nil, fmt.Errorf("failed to recover regions index: %w", err)
 	}
+	instance.rebuildRegionUsage()
+
+	err = instance.rebuildPrefixUsage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild key prefix statistics: %w", err)
+	}
+
+	if opt.Index == SkipListIndex {
+		instance.keys = newSkipList()
+		err = instance.rebuildKeyIndex()
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild ordered key index: %w", err)
+		}
+	}
+
+	instance.progress.finish(instance.KeysCount())
+	instance.recovery = time.Since(recoveryStart)
+	instance.recoverCheckpointTime()
 
 	// Singleton pattern, but other packages can still create an instance with new(LogStructuredFS), which makes this ineffective
 	return instance, nil
@@ -691,7 +1410,24 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 func (lfs *LogStructuredFS) CloseFS() error {
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
+
+	lfs.stopFlush()
+	lfs.stopExpiryCompaction()
+	lfs.stopIndexSpill()
+	lfs.closeDirectWriter()
+
+	if lfs.tier != nil {
+		lfs.tier.cache.close()
+	}
+	if lfs.fingerprints != nil {
+		_ = lfs.fingerprints.close()
+	}
+
+	// 导出索引快照失败时下次启动还要用检查点加索引日志恢复
+	walErr := lfs.closeIndexLog()
+
 	for _, file := range lfs.regions {
+		forgetRegion(file)
 		err := utils.FlushToDisk(file)
 		if err != nil {
 			// In-memory indexes must be persisted
@@ -705,6 +1441,57 @@ func (lfs *LogStructuredFS) CloseFS() error {
 
 	// If there is a snapshot of the index file, recover from the snapshot.
 	// otherwise, perform a global scan.
+	return errors.Join(walErr, lfs.ExportSnapshotIndex())
+}
+
+// Quiesce stops the background tasks that modify the data directory, syncs the active region
+// and exports the index snapshot, so another process can recover the same directory while
+// this one keeps serving reads. The caller must stop the writes before calling it.
+// It fails with ErrCompactRunning or ErrTieringRunning while such a task is in progress,
+// the stopped tasks are restarted with their Run methods.
+func (lfs *LogStructuredFS) Quiesce() error {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.gcstate == GC_ACTIVE {
+		return ErrCompactRunning
+	}
+	if lfs.tier != nil && lfs.tier.running {
+		return ErrTieringRunning
+	}
+
+	if lfs.compactTask != nil {
+		lfs.compactTask.Stop()
+		lfs.compactTask = nil
+		lfs.compactSchedule = ""
+		lfs.gcstate = GC_INIT
+	}
+	if lfs.checkpointWorker != nil {
+		lfs.checkpointWorker.Stop()
+		lfs.checkpointWorker = nil
+	}
+	lfs.stopIndexSpill()
+	// 新进程从索引快照恢复，不再需要索引日志
+	lfs.discardIndexLog()
+	lfs.stopFlush()
+	lfs.stopExpiryCompaction()
+	if lfs.tier != nil && lfs.tier.worker != nil {
+		lfs.tier.worker.Stop()
+		lfs.tier.worker = nil
+	}
+	if lfs.trash != nil && lfs.trash.worker != nil {
+		lfs.trash.worker.Stop()
+		lfs.trash.worker = nil
+	}
+	if lfs.backup != nil && lfs.backup.worker != nil {
+		lfs.backup.worker.Stop()
+		lfs.backup.worker = nil
+	}
+
+	err := lfs.active.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync active region: %w", err)
+	}
 	return lfs.ExportSnapshotIndex()
 }
 
@@ -744,15 +1531,24 @@ func (lfs *LogStructuredFS) ExportSnapshotIndex() error {
 	for _, imap := range lfs.indexs {
 		imap.mu.RLock()
 		defer imap.mu.RUnlock()
-		for inum, inode := range imap.index {
-			bytes, err := serializedIndex(inum, inode)
+
+		var err error
+		imap.rangeInodes(func(inum uint64, inode *Inode) bool {
+			var bytes []byte
+			bytes, err = serializedIndex(inum, inode)
 			if err != nil {
-				return fmt.Errorf("failed to serialized index (inum: %d): %w", inum, err)
+				err = fmt.Errorf("failed to serialized index (inum: %d): %w", inum, err)
+				return false
 			}
 			_, err = fd.Write(bytes)
 			if err != nil {
-				return fmt.Errorf("failed to write serialized index (inum: %d): %w", inum, err)
+				err = fmt.Errorf("failed to write serialized index (inum: %d): %w", inum, err)
+				return false
 			}
+			return true
+		})
+		if err != nil {
+			return err
 		}
 	}
 
@@ -841,84 +1637,167 @@ func recoveryIndex(fd *os.File, indexs []*indexMap) error {
 // crashRecoveryAllIndex parses the regions file collection and restores the in-memory index with the following.
 // Steps:
 // 1. Crash recovery logic scans all data files.
-// 2. Reads the first 26 bytes of MetaInfo from each data record.
+// 2. Reads the first 34 bytes of MetaInfo from each data record.
 // 3. Replays these records and checks whether the DEL value is 1.
 // 4. If DEL is 1, the corresponding entry is deleted from the in-memory index.
 // 5. Otherwise, the disk metadata is reconstructed into the index.
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
-func crashRecoveryAllIndex(regions map[uint64]*os.File, indexs []*indexMap) error {
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | LSN 8 | KEY ? | VALUE ? | CRC32 4 |
+func crashRecoveryAllIndex(regions map[uint64]*os.File, remote map[uint64]*remoteRegion, indexs []*indexMap, fp *fingerprintTable, progress *RecoveryProgress) error {
 	var regionIds []uint64
 	for v := range regions {
 		regionIds = append(regionIds, v)
 	}
+	for v := range remote {
+		regionIds = append(regionIds, v)
+	}
+
+	return recoverRegionsIndex(regions, remote, regionIds, indexs, fp, progress)
+}
+
+// regionIndex is the final state of every key found in a single region file,
+// a nil inode means the last record of the key in this region is a tombstone.
+type regionIndex map[uint64]*Inode
+
+// scanRegionIndex replays the records of one region file into a region local index.
+// fp 是指纹索引中冲突的 key，其他索引为 nil
+func scanRegionIndex(regionId uint64, fd *os.File, fp *fingerprintTable) (regionIndex, error) {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	local := make(regionIndex)
+	reader := newRegionReader(fd, finfo.Size())
+	offset := uint64(len(regionMetadata))
+
+	for offset < uint64(finfo.Size()) {
+		inum, segment, err := reader.readSegment(offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse data file segment: %w", err)
+		}
+		inum = fp.remap(inum, segment.Key)
+
+		if segment.IsTombstone() {
+			local[inum] = nil
+			offset += uint64(segment.Size())
+			continue
+		}
+
+		if segment.ExpiredAt <= uint64(time.Now().UnixNano()) && segment.ExpiredAt != 0 {
+			offset += uint64(segment.Size())
+			continue
+		}
+
+		local[inum] = &Inode{
+			RegionID:  regionId,
+			Position:  offset,
+			Length:    segment.Size(),
+			CreatedAt: segment.CreatedAt,
+			ExpiredAt: segment.ExpiredAt,
+			mvcc:      0,
+		}
+
+		offset += uint64(segment.Size())
+	}
 
+	return local, nil
+}
+
+// recoverRegionsIndex scans the region files in parallel with a worker pool bounded by GOMAXPROCS,
+// then merges the region local indexes in ascending region id order, so newer records always win.
+// Regions in object storage are recovered from the index kept in their local stubs.
+func recoverRegionsIndex(regions map[uint64]*os.File, remote map[uint64]*remoteRegion, regionIds []uint64, indexs []*indexMap, fp *fingerprintTable, progress *RecoveryProgress) error {
 	sort.Slice(regionIds, func(i, j int) bool {
 		return regionIds[i] < regionIds[j]
 	})
 
 	for _, regionId := range regionIds {
-		fd, ok := regions[uint64(regionId)]
-		if !ok {
+		_, local := regions[regionId]
+		if _, ok := remote[regionId]; !ok && !local {
 			return fmt.Errorf("data file does not exist regions id: %d", regionId)
 		}
+	}
 
-		finfo, err := fd.Stat()
-		if err != nil {
-			return err
-		}
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(regionIds) {
+		workers = len(regionIds)
+	}
 
-		offset := uint64(len(dataFileMetadata))
+	progress.setRegions(len(regionIds))
 
-		for offset < uint64(finfo.Size()) {
-			inum, segment, err := readSegment(fd, offset, SEGMENT_PADDING)
-			if err != nil {
-				return fmt.Errorf("failed to parse data file segment: %w", err)
-			}
+	var (
+		wg      sync.WaitGroup
+		results = make([]regionIndex, len(regionIds))
+		errs    = make([]error, len(regionIds))
+		tasks   = make(chan int, len(regionIds))
+	)
 
-			imap := indexs[inum%uint64(shard)]
-			if imap != nil {
-				if segment.IsTombstone() {
-					delete(imap.index, inum)
-					offset += uint64(segment.Size())
-					continue
-				}
+	for i := range regionIds {
+		tasks <- i
+	}
+	close(tasks)
 
-				if segment.ExpiredAt <= uint64(time.Now().UnixNano()) && segment.ExpiredAt != 0 {
-					offset += uint64(segment.Size())
-					continue
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				if fd, ok := regions[regionIds[i]]; ok {
+					results[i], errs[i] = scanRegionIndex(regionIds[i], fd, fp)
+				} else {
+					results[i] = remote[regionIds[i]].regionIndex(fp)
 				}
+				progress.regionScanned()
+			}
+		}()
+	}
 
-				imap.index[inum] = &Inode{
-					RegionID:  regionId,
-					Position:  offset,
-					Length:    segment.Size(),
-					CreatedAt: segment.CreatedAt,
-					ExpiredAt: segment.ExpiredAt,
-					mvcc:      0,
-				}
+	wg.Wait()
 
-				offset += uint64(segment.Size())
-			} else {
+	for i, regionId := range regionIds {
+		if errs[i] != nil {
+			return fmt.Errorf("failed to recover region %d: %w", regionId, errs[i])
+		}
+
+		for inum, inode := range results[i] {
+			imap := indexs[inum%uint64(shard)]
+			if imap == nil {
 				return errors.New("no corresponding index shard")
 			}
+
+			if inode == nil {
+				delete(imap.index, inum)
+				continue
+			}
+
+			imap.index[inum] = inode
 		}
+
+		progress.addKeys(len(results[i]))
+
+		// 合并完成的分区结果尽早释放
+		results[i] = nil
 	}
 
 	return nil
 }
 
-func validateFileHeader(file *os.File) error {
+func validateFileHeader(file *os.File, metadata []byte) error {
 	var fileHeader [4]byte
 	n, err := file.Read(fileHeader[:])
 	if err != nil {
 		return err
 	}
 
-	if n != len(dataFileMetadata) {
+	if n != len(metadata) {
 		return errors.New("file is too short to contain valid signature")
 	}
 
-	if !bytes.Equal(fileHeader[:], dataFileMetadata[:]) {
+	if !bytes.Equal(fileHeader[:], metadata) {
+		// 其他版本写入的文件返回文件的版本
+		if isDataFile(fileHeader[:]) && fileHeader[3] != metadata[3] {
+			return &FormatError{File: file.Name(), Version: fileHeader[3], Supported: metadata[3]}
+		}
 		return fmt.Errorf("unsupported data file version: %v", file.Name())
 	}
 
@@ -938,20 +1817,30 @@ func checkFileSystem(path string) error {
 		return fmt.Errorf("failed to read directory: %w", err)
 	}
 
+	var legacy []string
 	if len(files) > 0 {
 		for _, file := range files {
 			if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension) {
 				if strings.HasPrefix(file.Name(), "0") {
-					file, err := os.Open(filepath.Join(path, file.Name()))
+					fd, err := os.Open(filepath.Join(path, file.Name()))
 					if err != nil {
 						return fmt.Errorf("failed to check data file: %w", err)
 					}
-					defer file.Close()
+					defer fd.Close()
 
-					err = validateFileHeader(file)
+					header := make([]byte, len(regionMetadata))
+					_, err = io.ReadFull(fd, header)
+					var layout *regionLayout
+					if err == nil {
+						layout, err = regionFormat(fd.Name(), header)
+					}
 					if err != nil {
 						return fmt.Errorf("failed to validated data file header: %w", err)
 					}
+					// 旧版本的 region 升级到当前的格式之后才能使用
+					if layout.version != currentFormat {
+						legacy = append(legacy, file.Name())
+					}
 				}
 			}
 
@@ -962,7 +1851,7 @@ func checkFileSystem(path string) error {
 				}
 				defer file.Close()
 
-				err = validateFileHeader(file)
+				err = validateFileHeader(file, dataFileMetadata)
 				if err != nil {
 					return fmt.Errorf("failed to validated index file header: %w", err)
 				}
@@ -970,90 +1859,56 @@ func checkFileSystem(path string) error {
 		}
 	}
 
+	if len(legacy) > 0 {
+		_, err := upgradeRegions(path, legacy)
+		return err
+	}
 	return nil
 }
 
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | LSN 8 | KEY ? | VALUE ? | CRC32 4 |
 func readSegment(fd *os.File, offset uint64, bufsize int64) (uint64, *Segment, error) {
+	return readSegmentAt(fd, fd, offset, bufsize)
+}
+
+// readSegmentAt 从 r 中读取 fd 的记录，顺序扫描时 r 是带预读缓冲区的 regionReader
+func readSegmentAt(fd *os.File, r io.ReaderAt, offset uint64, bufsize int64) (uint64, *Segment, error) {
 	buf := make([]byte, bufsize)
 
-	_, err := fd.ReadAt(buf, int64(offset))
+	_, err := r.ReadAt(buf, int64(offset))
 	if err != nil {
 		return 0, nil, err
 	}
 
-	var seg Segment
-	readOffset := 0
-
-	// Parse Tombstone (1 byte)
-	seg.Tombstone = int8(buf[readOffset])
-	readOffset++
-
-	// Parse Type (1 byte)
-	seg.Type = Kind(buf[readOffset])
-	readOffset++
-
-	// Parse ExpiredAt (8 bytes)
-	seg.ExpiredAt = binary.LittleEndian.Uint64(buf[readOffset : readOffset+8])
-	readOffset += 8
-
-	// Parse CreatedAt (8 bytes)
-	seg.CreatedAt = binary.LittleEndian.Uint64(buf[readOffset : readOffset+8])
-	readOffset += 8
-
-	// Parse KeySize (4 bytes)
-	seg.KeySize = binary.LittleEndian.Uint32(buf[readOffset : readOffset+4])
-	readOffset += 4
-
-	// Parse ValueSize (4 bytes)
-	seg.ValueSize = binary.LittleEndian.Uint32(buf[readOffset : readOffset+4])
-	readOffset += 4
-
-	// End of Header 26 bytes
-
-	// Read Key data
-	keybuf := make([]byte, seg.KeySize)
-	_, err = fd.ReadAt(keybuf, int64(offset)+int64(readOffset))
+	// 运行期间的 region 都是当前的格式，使用当前版本的解析方法读取记录头部，
+	// 根据头部中的长度分配内存之前先检查长度，损坏的长度不会导致分配过大的内存
+	var header Segment
+	reader := recordReaders[currentFormat]
+	err = reader.parseHeader(buf, &header)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to parse key in segment: %w", err)
+		return 0, nil, fmt.Errorf("failed to parse segment header: %w", err)
 	}
-	readOffset += int(seg.KeySize)
 
-	// Read Value data
-	valuebuf := make([]byte, seg.ValueSize)
-	_, err = fd.ReadAt(valuebuf, int64(offset)+int64(readOffset))
+	// Read key, value and checksum in one call
+	record := make([]byte, reader.recordSize(&header))
+	copy(record, buf)
+	_, err = r.ReadAt(record[len(buf):], int64(offset)+int64(len(buf)))
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to parse value in segment: %w", err)
+		return 0, nil, fmt.Errorf("failed to read segment body: %w", err)
 	}
-	readOffset += int(seg.ValueSize)
 
-	// Read checksum (4 bytes)
-	checksumBuf := make([]byte, 4)
-	_, err = fd.ReadAt(checksumBuf, int64(offset)+int64(readOffset))
+	// Verify checksum with the algorithm recorded in the region header
+	algorithm, err := regionChecksum(fd)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to read checksum in segment: %w", err)
+		return 0, nil, fmt.Errorf("failed to read checksum algorithm of region: %w", err)
 	}
 
-	// Verify checksum
-	checksum := binary.LittleEndian.Uint32(checksumBuf)
-
-	buf = append(buf, keybuf...)
-	buf = append(buf, valuebuf...)
-
-	if checksum != crc32.ChecksumIEEE(buf) {
-		return 0, nil, fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
-	}
-
-	// Update Segment data fields with the read valuebuf and process it through Transformer before use
-	decodedData, err := transformer.Decode(valuebuf)
+	seg, err := decodeRecord(record, reader, algorithm)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to transformer decode value in segment: %w", err)
+		return 0, nil, err
 	}
 
-	seg.Key = keybuf
-	seg.Value = decodedData
-
-	return InodeNum(string(keybuf)), &seg, nil
+	return InodeNum(string(seg.Key)), seg, nil
 }
 
 func generateFileName(regionID uint64) (string, error) {
@@ -1087,8 +1942,8 @@ func formatDataFileName(number uint64) string {
 	return fmt.Sprintf("%010d%s", number, fileExtension)
 }
 
-func checkpointFileName(regionID uint64) string {
-	return fmt.Sprintf("ckpt.%d.%d.tmp", time.Now().Unix(), regionID)
+func checkpointFileName(ts int64, regionID uint64) string {
+	return fmt.Sprintf("ckpt.%d.%d.tmp", ts, regionID)
 }
 
 // serializedIndex serializes the index to a recoverable file snapshot record format:
@@ -1167,57 +2022,12 @@ func deserializedIndex(data []byte) (uint64, *Inode, error) {
 	return inum, &inode, nil
 }
 
-func serializedSegment(seg *Segment) ([]byte, error) {
-	buf := new(bytes.Buffer)
-
-	err := binary.Write(buf, binary.LittleEndian, seg.Tombstone)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write Tombstone: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.Type)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write Type: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.ExpiredAt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write ExpiredAt: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.CreatedAt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write CreatedAt: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.KeySize)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write KeySize: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.ValueSize)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write ValueSize: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.Key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write Key: %w", err)
-	}
-
-	err = binary.Write(buf, binary.LittleEndian, seg.Value)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write Value: %w", err)
-	}
-
-	checksum := crc32.ChecksumIEEE(buf.Bytes())
-
-	err = binary.Write(buf, binary.LittleEndian, checksum)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write checksum: %w", err)
-	}
-
-	return buf.Bytes(), nil
+// serializedSegment 把 seg 序列化为一段连续的当前格式的记录，sum 是写入的 region 使用的校验算法，
+// 写入 region 时使用 encodeSegment 避免复制 value
+func serializedSegment(seg *Segment, sum Checksum) ([]byte, error) {
+	e := encodeSegment(seg, sum)
+	defer e.release()
+	return e.appendTo(make([]byte, 0, e.Len())), nil
 }
 
 // Garbage Collection Compressor
@@ -1234,98 +2044,170 @@ func serializedSegment(seg *Segment) ([]byte, error) {
 func (lfs *LogStructuredFS) cleanupDirtyRegions() error {
 	if len(lfs.regions) >= 5 {
 		var regionIds []uint64
+		lfs.mu.RLock()
 		for v := range lfs.regions {
-			regionIds = append(regionIds, v)
+			// Snapshot 固定的 region 在释放之后再回收，活跃的 region 还在写入，都不能选中
+			if v != lfs.regionID && !lfs.pins.pinned(v) {
+				regionIds = append(regionIds, v)
+			}
 		}
+		lfs.mu.RUnlock()
 		sort.Slice(regionIds, func(i, j int) bool {
 			return regionIds[i] < regionIds[j]
 		})
 
 		// find 40% dirty region
+		lfs.mu.RLock()
 		for i := 0; i < 4 && i < len(regionIds); i++ {
 			lfs.dirtyRegions = append(lfs.dirtyRegions, lfs.regions[regionIds[i]])
 		}
+		lfs.mu.RUnlock()
 
 		// Cleanup dirty region
 		defer func() {
 			lfs.dirtyRegions = nil
 		}()
 
-		for _, fd := range lfs.dirtyRegions {
-			finfo, err := fd.Stat()
+		var retained uint64
+		for i, fd := range lfs.dirtyRegions {
+			// 暂停之后正在迁移的 region 完成就停下，剩下的 region 等恢复之后的下一次回收
+			if lfs.compactionPaused() {
+				return ErrCompactPaused
+			}
+			kept, err := lfs.compactRegion(regionIds[i], fd)
 			if err != nil {
 				return err
 			}
+			retained += kept
+		}
+		lfs.compaction.retained.Store(retained)
+	} else {
+		compactLog.Warnf("dirty regions (%d%%) does not meet garbage collection status", len(lfs.regions)/10)
+	}
 
-			readOffset := uint64(len(dataFileMetadata))
-
-			for readOffset < uint64(finfo.Size()) {
-				inum, segment, err := readSegment(fd, uint64(readOffset), SEGMENT_PADDING)
-				if err != nil {
-					return err
-				}
+	return nil
+}
 
-				imap := lfs.indexs[inum%uint64(shard)]
-				if imap != nil {
-					imap.mu.RLock()
-					inode, ok := imap.index[inum]
-					imap.mu.RUnlock()
+// compactRegion 把 region 中有效的记录和宽限期内的墓碑迁移到 active region 之后删除 region，返回保留的墓碑数量
+func (lfs *LogStructuredFS) compactRegion(regionID uint64, fd *os.File) (uint64, error) {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
 
-					if !ok {
-						continue
-					}
+	var retained, migrated uint64
+	reader := newRegionReader(fd, finfo.Size())
+	readOffset := uint64(len(regionMetadata))
 
-					if isValid(segment, inode) {
-						bytes, err := serializedSegment(segment)
-						if err != nil {
-							return err
-						}
+	for readOffset < uint64(finfo.Size()) {
+		inum, segment, err := reader.readSegment(readOffset)
+		if err != nil {
+			return 0, err
+		}
+		inum = lfs.recordInum(inum, segment)
+		size := uint64(segment.Size())
+		lfs.throttleCompaction(int(size))
+		readOffset += size
+
+		imap := lfs.indexs[inum%uint64(shard)]
+		if imap == nil {
+			return 0, fmt.Errorf("imap is nil for inum = %d", inum)
+		}
+		imap.mu.RLock()
+		inode, ok := imap.lookup(inum)
+		imap.mu.RUnlock()
+
+		if segment.IsTombstone() {
+			// 删除之后重新写入的 key 不再需要墓碑，超过宽限期的删除副本和备份都已经看到，
+			// 更旧的 region 中可能还有这个 key 的记录，只有最旧的 region 才能丢弃过期的墓碑
+			if ok || (lfs.isOldestRegion(regionID) && lfs.tombstoneExpired(segment)) {
+				lfs.compaction.reclaim(size)
+				continue
+			}
+			err = lfs.migrateSegment(inum, segment, regionID, readOffset-size, false)
+			if err != nil {
+				return 0, err
+			}
+			retained++
+			migrated += size
+			continue
+		}
 
-						// 缩小锁的颗粒度
-						lfs.mu.Lock()
-						err = appendToActiveRegion(lfs.active, bytes)
-						if err != nil {
-							lfs.mu.Unlock()
-							return err
-						}
+		if !ok || !isValid(segment, inode) {
+			continue
+		}
+		err = lfs.migrateSegment(inum, segment, regionID, readOffset-size, true)
+		if err != nil {
+			return 0, err
+		}
+		migrated += size
+	}
 
-						delete(lfs.regions, inode.RegionID)
+	// 删除之前保存 horizon，被丢弃的历史版本不能再用于回滚
+	err = lfs.advanceHorizon()
+	if err != nil {
+		return 0, err
+	}
 
-						inode.Position = lfs.offset
-						inode.RegionID = lfs.regionID
+	// Delete dirty region file
+	lfs.mu.Lock()
+	// 回收期间创建的 Snapshot 还在读取这个 region，有效的记录已经迁移，之后的回收再删除
+	if lfs.pins.pinned(regionID) {
+		lfs.mu.Unlock()
+		compactLog.Infof("region %d is pinned by a snapshot, it will be removed by a later compaction", regionID)
+		return retained, nil
+	}
+	delete(lfs.regions, regionID)
+	err = os.Remove(fd.Name())
+	lfs.mu.Unlock()
+	lfs.usage.drop(regionID)
+	lfs.forgetQuarantine(regionID)
+	forgetRegion(fd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove dirty region: %w", err)
+	}
 
-						lfs.offset += uint64(segment.Size())
-						lfs.mu.Unlock()
+	lfs.compaction.reclaimedBytes.Add(uint64(finfo.Size()) - migrated)
+	return retained, nil
+}
 
-						readOffset += uint64(segment.Size())
-					} else {
-						// next segment
-						continue
-					}
+// migrateSegment 把回收的 region 中 position 位置的记录追加到 active region，live 为 false 时迁移的是墓碑
+func (lfs *LogStructuredFS) migrateSegment(inum uint64, segment *Segment, regionID, position uint64, live bool) error {
+	lfs.throttleCompaction(int(segment.Size()))
+	record := encodeSegment(segment, checksumAlgorithm)
 
-				} else {
-					return fmt.Errorf("imap is nil for inum = %d", inum)
-				}
+	// 缩小锁的颗粒度
+	lfs.mu.Lock()
+	err := record.writeTo(lfs.faultWriter(lfs.regionWriter()))
+	record.release()
+	if err != nil {
+		err = lfs.discardTail(err)
+		lfs.mu.Unlock()
+		return err
+	}
+	lfs.unflushed.Store(true)
 
-				if atomic.LoadUint64(&lfs.offset) >= uint64(regionThreshold) {
-					err := lfs.changeRegions()
-					if err != nil {
-						return fmt.Errorf("failed to close active migrate region: %w", err)
-					}
-				}
+	if live {
+		// 迁移期间 key 可能已经被覆盖或者删除，只移动仍然指向原来记录的索引项
+		imap := lfs.indexs[inum%uint64(shard)]
+		imap.mu.Lock()
+		inode, ok := imap.relocate(inum, regionID, position, lfs.regionID, lfs.offset)
+		if ok {
+			lfs.usage.remove(&Inode{RegionID: regionID, Length: inode.Length})
+			lfs.usage.add(inode)
+			lfs.appendIndexLog(walPut, inum, inode)
+		}
+		imap.mu.Unlock()
+	}
 
-				// Delete dirty region file
-				lfs.mu.Lock()
-				err = os.Remove(filepath.Join(lfs.directory, fd.Name()))
-				lfs.mu.Unlock()
-				if err != nil {
-					return fmt.Errorf("failed to remove dirty region: %w", err)
-				}
-			}
+	lfs.offset += uint64(segment.Size())
+	lfs.mu.Unlock()
 
+	if atomic.LoadUint64(&lfs.offset) >= uint64(regionThreshold) {
+		err := lfs.RolloverRegion()
+		if err != nil {
+			return fmt.Errorf("failed to close active migrate region: %w", err)
 		}
-	} else {
-		clog.Warnf("dirty regions (%d%%) does not meet garbage collection status", len(lfs.regions)/10)
 	}
 
 	return nil
@@ -1334,7 +2216,7 @@ func (lfs *LogStructuredFS) cleanupDirtyRegions() error {
 func isValid(seg *Segment, inode *Inode) bool {
 	return !seg.IsTombstone() &&
 		seg.CreatedAt == inode.CreatedAt &&
-		(seg.ExpiredAt == 0 || uint64(time.Now().Unix()) < seg.ExpiredAt)
+		(seg.ExpiredAt == 0 || uint64(time.Now().UnixNano()) < seg.ExpiredAt)
 }
 
 // Start serializing little-endian data, needs to compress seg before writing.
@@ -1383,7 +2265,7 @@ func cleanupDirtyCheckpoint(directory, newCheckpoint string) error {
 	return nil
 }
 
-func scanAndRecoverCheckpoint(files []string, regions map[uint64]*os.File, indexs []*indexMap) error {
+func scanAndRecoverCheckpoint(files []string, regions map[uint64]*os.File, remote map[uint64]*remoteRegion, indexs []*indexMap, fp *fingerprintTable, progress *RecoveryProgress) error {
 	var (
 		ckpt    int
 		path    string
@@ -1418,68 +2300,22 @@ func scanAndRecoverCheckpoint(files []string, regions map[uint64]*os.File, index
 	}
 
 	// 由于检查点不是实时的索引快照，再从检查点之后数据文件进行恢复完整数据
+	pid, err := strconv.Atoi(pauseID)
+	if err != nil {
+		return err
+	}
+
 	var regionIds []uint64
 	for id := range regions {
-		pid, err := strconv.Atoi(pauseID)
-		if err != nil {
-			return err
-		}
 		if id >= uint64(pid) {
 			regionIds = append(regionIds, id)
 		}
 	}
-
-	sort.Slice(regionIds, func(i, j int) bool {
-		return regionIds[i] < regionIds[j]
-	})
-
-	for _, regionId := range regionIds {
-		fd, ok := regions[uint64(regionId)]
-		if !ok {
-			return fmt.Errorf("data file does not exist regions id: %d", regionId)
-		}
-
-		finfo, err := fd.Stat()
-		if err != nil {
-			return err
-		}
-
-		offset := uint64(len(dataFileMetadata))
-
-		for offset < uint64(finfo.Size()) {
-			inum, segment, err := readSegment(fd, offset, SEGMENT_PADDING)
-			if err != nil {
-				return fmt.Errorf("failed to parse data file segment: %w", err)
-			}
-
-			imap := indexs[inum%uint64(shard)]
-			if imap != nil {
-				if segment.IsTombstone() {
-					delete(imap.index, inum)
-					offset += uint64(segment.Size())
-					continue
-				}
-
-				if segment.ExpiredAt <= uint64(time.Now().UnixNano()) && segment.ExpiredAt != 0 {
-					offset += uint64(segment.Size())
-					continue
-				}
-
-				imap.index[inum] = &Inode{
-					RegionID:  regionId,
-					Position:  offset,
-					Length:    segment.Size(),
-					CreatedAt: segment.CreatedAt,
-					ExpiredAt: segment.ExpiredAt,
-					mvcc:      0,
-				}
-
-				offset += uint64(segment.Size())
-			} else {
-				return errors.New("no corresponding index shard")
-			}
+	for id := range remote {
+		if id >= uint64(pid) {
+			regionIds = append(regionIds, id)
 		}
 	}
 
-	return nil
+	return recoverRegionsIndex(regions, remote, regionIds, indexs, fp, progress)
 }
@@ -15,10 +15,12 @@
 package vfs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -98,7 +100,7 @@ func TestReadSegment(t *testing.T) {
 	}
 
 	// 将 Segment 数据转化为字节数组
-	bytes, err := serializedSegment(seg)
+	bytes, err := serializedSegment(seg, CRC32)
 	if err != nil {
 		t.Fatalf("failed to serialized segment:%v", err)
 	}
@@ -110,15 +112,15 @@ func TestReadSegment(t *testing.T) {
 	}
 	defer os.Remove(tmpFile.Name())
 
-	// 写入测试数据
-	_, err = tmpFile.Write(bytes)
+	// 写入测试数据，readSegment 从 region 头部读取校验算法
+	_, err = tmpFile.Write(append(append([]byte{}, regionMetadata...), bytes...))
 	if err != nil {
 		t.Fatalf("failed to write test data to temp file: %v", err)
 	}
 
 	// 使用 readSegment 读取并测试数据
-	offset := uint64(0)
-	inum, segment, err := readSegment(tmpFile, offset, 26)
+	offset := uint64(len(regionMetadata))
+	inum, segment, err := readSegment(tmpFile, offset, SEGMENT_PADDING)
 	if err != nil {
 		t.Fatalf("expected no error, but got: %v", err)
 	}
@@ -512,6 +514,7 @@ func TestVFSOpertions(t *testing.T) {
 
 	_, _, err = fss.FetchSegment("key-01")
 	assert.Equal(t, err.Error(), "inode index for 9171687345308829835 not found")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
 
 	err = fss.ExportSnapshotIndex()
 	assert.NoError(t, err)
@@ -525,3 +528,326 @@ func TestVFSOpertions(t *testing.T) {
 
 	os.RemoveAll(conf.Settings.Path)
 }
+
+func TestRangeSegments(t *testing.T) {
+	err := os.RemoveAll(conf.Settings.Path)
+	assert.NoError(t, err)
+
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      conf.Settings.Path,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(fmt.Sprintf("key-%d", i), seg))
+	}
+
+	// 覆盖写和删除之后旧版本的 Segment 不应该再被遍历到
+	seg, err := NewSegment("key-0", types.NewText("world"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-0", seg))
+	assert.NoError(t, fss.DeleteSegment("key-2"))
+
+	keys := make(map[string]int)
+	err = fss.RangeSegments(func(seg *Segment) bool {
+		keys[seg.GetKeyString()] += 1
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"key-0": 1, "key-1": 1}, keys)
+
+	inode, ok := fss.StatSegment("key-0")
+	assert.True(t, ok)
+	assert.Equal(t, seg.Size(), inode.Length)
+
+	_, ok = fss.StatSegment("key-2")
+	assert.False(t, ok)
+
+	assert.NoError(t, fss.CloseFS())
+	os.RemoveAll(conf.Settings.Path)
+}
+
+func TestFetchSegment_Corrupted(t *testing.T) {
+	err := os.RemoveAll(conf.Settings.Path)
+	assert.NoError(t, err)
+
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      conf.Settings.Path,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("key-1", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-1", seg))
+
+	// 篡改 value 中的一个字节模拟静默损坏
+	inode, ok := fss.StatSegment("key-1")
+	assert.True(t, ok)
+	fd, err := os.OpenFile(fss.regions[inode.RegionID].Name(), os.O_WRONLY, conf.FSPerm)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xFF}, int64(inode.Position)+26+int64(seg.KeySize))
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	_, _, err = fss.FetchSegment("key-1")
+	var cerr *CorruptedError
+	assert.ErrorAs(t, err, &cerr)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.True(t, fss.IsQuarantined(inode.RegionID, inode.Position))
+
+	fss.SetRepairer(func(key string) (*Segment, error) {
+		return NewSegment(key, types.NewText("hello"), 0)
+	})
+
+	// 副本响应修复请求时不再向其他副本修复
+	_, _, err = fss.FetchSegmentContext(WithoutRepair(context.Background()), "key-1")
+	assert.ErrorAs(t, err, &cerr)
+
+	_, repaired, err := fss.FetchSegment("key-1")
+	assert.NoError(t, err)
+	text, err := repaired.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", text.Content)
+	assert.False(t, fss.IsQuarantined(inode.RegionID, inode.Position))
+
+	assert.NoError(t, fss.CloseFS())
+	os.RemoveAll(conf.Settings.Path)
+}
+
+func TestRecoverRegionsIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	writeRegion := func(regionId uint64, segs ...*Segment) *os.File {
+		fd, err := os.OpenFile(filepath.Join(dir, formatDataFileName(regionId)), os.O_CREATE|os.O_RDWR, conf.FSPerm)
+		assert.NoError(t, err)
+		_, err = fd.Write(regionMetadata)
+		assert.NoError(t, err)
+		for _, seg := range segs {
+			bytes, err := serializedSegment(seg, CRC32)
+			assert.NoError(t, err)
+			_, err = fd.Write(bytes)
+			assert.NoError(t, err)
+		}
+		return fd
+	}
+
+	text := func(key, content string) *Segment {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		return seg
+	}
+
+	regions := map[uint64]*os.File{
+		1: writeRegion(1, text("key-a", "v1"), text("key-b", "v1")),
+		2: writeRegion(2, NewTombstoneSegment("key-a"), text("key-b", "v2")),
+		3: writeRegion(3, text("key-c", "v1")),
+	}
+	defer func() {
+		for _, fd := range regions {
+			fd.Close()
+		}
+	}()
+
+	indexs := make([]*indexMap, shard)
+	for i := 0; i < shard; i++ {
+		indexs[i] = &indexMap{mu: sync.RWMutex{}, index: make(map[uint64]*Inode)}
+	}
+
+	err := crashRecoveryAllIndex(regions, nil, indexs, nil, nil)
+	assert.NoError(t, err)
+
+	lookup := func(key string) (*Inode, bool) {
+		inum := InodeNum(key)
+		inode, ok := indexs[inum%uint64(shard)].index[inum]
+		return inode, ok
+	}
+
+	_, ok := lookup("key-a")
+	assert.False(t, ok)
+
+	inode, ok := lookup("key-b")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), inode.RegionID)
+
+	inode, ok = lookup("key-c")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), inode.RegionID)
+	assert.Equal(t, uint64(len(regionMetadata)), inode.Position)
+}
+
+func TestSetWriteHook(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	events := make([]string, 0)
+	fss.SetWriteHook(func(seg *Segment) {
+		events = append(events, fmt.Sprintf("%s:%v", seg.GetKeyString(), seg.IsTombstone()))
+	})
+
+	seg, err := NewSegment("key-01", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+
+	version, _, err := fss.FetchSegment("key-01")
+	assert.NoError(t, err)
+	assert.NoError(t, fss.UpdateSegmentWithCAS("key-01", version, seg))
+	assert.NoError(t, fss.DeleteSegment("key-01"))
+
+	assert.Equal(t, []string{"key-01:false", "key-01:false", "key-01:true"}, events)
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestUpdateSegmentWithCAS_Overwritten(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	seg, err := NewSegment("key-01", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+
+	version, _, err := fss.FetchSegment("key-01")
+	assert.NoError(t, err)
+
+	// 读取之后被覆盖写的 key 版本号已经变化，CAS 不能覆盖别人的修改
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+	assert.ErrorIs(t, fss.UpdateSegmentWithCAS("key-01", version, seg), ErrVersionConflict)
+
+	version, _, err = fss.FetchSegment("key-01")
+	assert.NoError(t, err)
+	assert.NoError(t, fss.UpdateSegmentWithCAS("key-01", version, seg))
+}
+
+func TestSegmentContext(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	seg, err := NewSegment("key-01", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+
+	// 已经结束的 ctx 不会写入任何数据
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err = fss.FetchSegmentContext(ctx, "key-01")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = fss.PutSegmentContext(ctx, "key-02", seg)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, fss.DeleteSegmentContext(ctx, "key-01"), context.Canceled)
+
+	version, _, err := fss.FetchSegment("key-01")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, fss.UpdateSegmentWithCASContext(ctx, "key-01", version, seg), context.Canceled)
+	assert.Equal(t, 1, fss.KeysCount())
+
+	// 写锁被占用期间 ctx 超时，拿到锁之后放弃写入，版本号保持不变
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	fss.mu.Lock()
+	done := make(chan error)
+	go func() {
+		done <- fss.UpdateSegmentWithCASContext(ctx, "key-01", version, seg)
+	}()
+	<-ctx.Done()
+	fss.mu.Unlock()
+	assert.ErrorIs(t, <-done, context.DeadlineExceeded)
+
+	assert.NoError(t, fss.UpdateSegmentWithCAS("key-01", version, seg))
+	_, _, err = fss.FetchSegment("key-02")
+	assert.Error(t, err)
+}
+
+func TestCompactSchedule(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: 1,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	schedule, runs := fss.CompactSchedule(3)
+	assert.Empty(t, schedule)
+	assert.Empty(t, runs)
+
+	assert.NoError(t, fss.RunCompactRegion("0 0 3 * * *"))
+	schedule, runs = fss.CompactSchedule(3)
+	assert.Equal(t, "0 0 3 * * *", schedule)
+	assert.Len(t, runs, 3)
+	for i, run := range runs {
+		assert.Equal(t, 3, run.Hour())
+		if i > 0 {
+			assert.True(t, run.After(runs[i-1]))
+		}
+	}
+
+	fss.StopCompactRegion()
+	schedule, _ = fss.CompactSchedule(3)
+	assert.Empty(t, schedule)
+}
+
+func TestQuiesce(t *testing.T) {
+	dir := t.TempDir()
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+	}
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+	fss.RunFlush(1)
+	fss.RunCheckpoint(60)
+	assert.NoError(t, fss.RunCompactRegion("@every 1h"))
+
+	for i := 0; i < 3; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(fmt.Sprintf("key-%d", i), seg))
+	}
+	assert.NoError(t, fss.DeleteSegment("key-2"))
+
+	// 垃圾回收期间不能交接数据目录
+	fss.gcstate = GC_ACTIVE
+	assert.ErrorIs(t, fss.Quiesce(), ErrCompactRunning)
+	fss.gcstate = GC_INACTIVE
+
+	assert.NoError(t, fss.Quiesce())
+	assert.Nil(t, fss.compactTask)
+	assert.Nil(t, fss.checkpointWorker)
+	assert.Nil(t, fss.flusher)
+	assert.FileExists(t, filepath.Join(dir, indexFileName))
+
+	// 另一个进程从同一个目录恢复的同时，原来的实例仍然可以读取
+	next, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, next.KeysCount())
+	_, seg, err := next.FetchSegment("key-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", seg.GetKeyString())
+
+	_, _, err = fss.FetchSegment("key-0")
+	assert.NoError(t, err)
+
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, next.CloseFS())
+}
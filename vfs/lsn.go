@@ -0,0 +1,557 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+)
+
+// horizonFileName 保存 region 回收时的 LSN，回收可能丢弃了这之前的历史版本
+const horizonFileName = "horizon.lsn"
+
+// ErrLSNUnavailable is returned when the history needed to roll back to an LSN was removed by compaction.
+var ErrLSNUnavailable = errors.New("log sequence number is no longer available")
+
+// RollbackResult reports the keys changed by RestoreToLSN.
+type RollbackResult struct {
+	LSN uint64 `json:"lsn"`
+	// Restored is the number of keys rewritten with the value they had at LSN
+	Restored int `json:"restored"`
+	// Deleted is the number of keys that did not exist at LSN
+	Deleted int `json:"deleted"`
+}
+
+// LSN returns the log sequence number of the last write.
+func (lfs *LogStructuredFS) LSN() uint64 {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	return lfs.lsn
+}
+
+// LSNHorizon returns the lowest log sequence number RestoreToLSN can roll back to.
+func (lfs *LogStructuredFS) LSNHorizon() uint64 {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	return lfs.horizon
+}
+
+// appendWithLSN 给 seg 分配下一个 LSN 并且追加到 active region，写入失败时不消耗 LSN，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) appendWithLSN(seg *Segment) error {
+	err := checkRecordSize(seg.KeySize, seg.ValueSize)
+	if err != nil {
+		return err
+	}
+
+	seg.LSN = lfs.lsn + 1
+	record := encodeSegment(seg, checksumAlgorithm)
+	err = record.writeTo(lfs.faultWriter(lfs.regionWriter()))
+	record.release()
+	if err != nil {
+		return lfs.discardTail(err)
+	}
+	lfs.lsn = seg.LSN
+	lfs.unflushed.Store(true)
+	lfs.signalLSN()
+	return nil
+}
+
+// discardTail 截断写入失败时留在 active region 末尾的不完整记录，否则之后追加的记录在文件中的位置
+// 和索引中的位置错开，重启时也无法解析这个 region。调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) discardTail(cause error) error {
+	if lfs.direct != nil {
+		return lfs.direct.rollback(int64(lfs.offset), cause)
+	}
+	err := lfs.active.Truncate(int64(lfs.offset))
+	if err != nil {
+		return fmt.Errorf("failed to discard incomplete record: %w", errors.Join(cause, err))
+	}
+	return cause
+}
+
+// recoverLSN 从最新的有记录的 region 中恢复 LSN，被回收的 region 中的 LSN 不会超过保存的 horizon
+func (lfs *LogStructuredFS) recoverLSN() error {
+	horizon, err := readHorizon(lfs.directory)
+	if err != nil {
+		return err
+	}
+	lfs.horizon, lfs.lsn = horizon, horizon
+
+	ids := lfs.regionIDs(true)
+	for i := len(ids) - 1; i >= 0; i-- {
+		var (
+			max   uint64
+			found bool
+		)
+		if fd, ok := lfs.regions[ids[i]]; ok {
+			max, found, err = scanRegionLSN(fd)
+			if err != nil {
+				return fmt.Errorf("failed to scan region %d: %w", ids[i], err)
+			}
+		} else {
+			// 远程 region 的存根中记录了每个 key 的最后一条记录，不需要下载
+			for _, entry := range lfs.remote[ids[i]].Index {
+				if entry.LSN > max {
+					max = entry.LSN
+				}
+				found = true
+			}
+		}
+
+		if max > lfs.lsn {
+			lfs.lsn = max
+		}
+		if found {
+			break
+		}
+	}
+
+	return nil
+}
+
+// advanceHorizon 在回收 region 之前保存当前的 LSN，之后 RestoreToLSN 不能回滚到更早的版本
+func (lfs *LogStructuredFS) advanceHorizon() error {
+	lfs.mu.RLock()
+	lsn, horizon := lfs.lsn, lfs.horizon
+	lfs.mu.RUnlock()
+	if lsn == horizon {
+		return nil
+	}
+
+	err := writeHorizon(lfs.directory, lsn)
+	if err != nil {
+		return fmt.Errorf("failed to save lsn horizon: %w", err)
+	}
+
+	lfs.mu.Lock()
+	if lsn > lfs.horizon {
+		lfs.horizon = lsn
+	}
+	lfs.mu.Unlock()
+	return nil
+}
+
+func readHorizon(directory string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(directory, horizonFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) != len(dataFileMetadata)+8 || !bytes.HasPrefix(data, dataFileMetadata) {
+		return 0, errors.New("lsn horizon file metadata mismatch")
+	}
+	return binary.LittleEndian.Uint64(data[len(dataFileMetadata):]), nil
+}
+
+func writeHorizon(directory string, lsn uint64) error {
+	path := filepath.Join(directory, horizonFileName)
+	fd, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return err
+	}
+
+	data := binary.LittleEndian.AppendUint64(append([]byte{}, dataFileMetadata...), lsn)
+	_, err = fd.Write(data)
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	err = utils.FlushToDisk(fd)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".part", path)
+}
+
+// scanRegionLSN 只读取记录头部，返回 region 中最大的 LSN 以及是否有记录
+func scanRegionLSN(fd *os.File) (uint64, bool, error) {
+	return scanRecordLSN(fd, recordReaders[currentFormat])
+}
+
+// scanRecordLSN 使用 reader 的格式读取记录头部，返回最大的 LSN 以及是否有记录
+func scanRecordLSN(fd *os.File, reader *recordReader) (uint64, bool, error) {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var (
+		max    uint64
+		header = make([]byte, reader.headerSize)
+		offset = int64(len(regionMetadata))
+	)
+	for offset < finfo.Size() {
+		_, err := fd.ReadAt(header, offset)
+		if err != nil {
+			return 0, false, err
+		}
+
+		var seg Segment
+		err = reader.parseHeader(header, &seg)
+		if err != nil {
+			return 0, false, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		if seg.LSN > max {
+			max = seg.LSN
+		}
+		offset += reader.recordSize(&seg)
+	}
+	if offset > finfo.Size() {
+		return 0, false, fmt.Errorf("%w: last record extends past the end of the region", ErrMalformedRecord)
+	}
+
+	return max, offset > int64(len(regionMetadata)), nil
+}
+
+// upgradeRegions 把旧版本的 region 重写为当前的格式，没有 LSN 的记录按照 region 和记录的顺序分配 LSN。
+// 记录的位置发生了变化，先删除索引快照、检查点和索引日志，启动时重新扫描 region 恢复索引，
+// 分配 LSN 之前被回收的历史版本已经无法找到，所以 horizon 设置为升级之后的 LSN
+func upgradeRegions(directory string, names []string) ([]RegionUpgrade, error) {
+	for _, pattern := range []string{indexFileName, "ckpt.*", "*" + walExtension, "0*" + fileExtension + ".part"} {
+		files, err := filepath.Glob(filepath.Join(directory, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			err := os.Remove(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove %s before upgrade: %w", filepath.Base(file), err)
+			}
+		}
+	}
+
+	// 升级中断之后重新启动时，从已经升级的 region 和其他带有 LSN 的 region 中的最大 LSN 继续分配
+	var lsn uint64
+	files, err := filepath.Glob(filepath.Join(directory, "0*"+fileExtension))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		max, err := regionMaxLSN(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan region %s: %w", filepath.Base(file), err)
+		}
+		if max > lsn {
+			lsn = max
+		}
+	}
+
+	sort.Strings(names)
+	var (
+		assigned = false
+		upgraded = make([]RegionUpgrade, 0, len(names))
+	)
+	for _, name := range names {
+		result, next, err := upgradeRegion(filepath.Join(directory, name), lsn)
+		if err != nil {
+			return upgraded, fmt.Errorf("failed to upgrade region %s: %w", name, err)
+		}
+		assigned = assigned || next > lsn
+		lsn = next
+		upgraded = append(upgraded, *result)
+		vlog.Infof("upgraded region %s from format version %d to %d, verified %d records with log sequence numbers up to %d",
+			name, result.From, currentFormat, result.Records, lsn)
+	}
+
+	if !assigned {
+		return upgraded, nil
+	}
+	return upgraded, writeHorizon(directory, lsn)
+}
+
+// regionMaxLSN 返回 region 中最大的 LSN，格式中没有 LSN 的 region 返回 0
+func regionMaxLSN(path string) (uint64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	layout, err := readRegionLayout(fd, filepath.Base(path))
+	if err != nil || !layout.hasLSN {
+		return 0, err
+	}
+	max, _, err := scanRecordLSN(fd, layout.recordReader)
+	return max, err
+}
+
+// upgradeRegion 使用 region 自己版本的解析方法读出每条记录并且校验，按照当前的格式重写并且重新计算校验和，
+// 数据不需要解码，格式中没有 LSN 时从 lsn 之后按照顺序分配。重写的文件重新读取校验之后才替换原来的 region，
+// 中途失败时原来的 region 保持不变
+func upgradeRegion(path string, lsn uint64) (*RegionUpgrade, uint64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(path + ".part")
+
+	var (
+		r, w    = bufio.NewReader(src), bufio.NewWriter(dst)
+		digest  = newRecordDigest()
+		records int
+		layout  *regionLayout
+	)
+	layout, err = readRegionLayout(r, filepath.Base(path))
+	// 升级之后的 region 继续使用原来的校验算法
+	if err == nil {
+		_, err = w.Write(formatHeader(layout.checksum, currentFormat))
+	}
+	if err == nil {
+		err = readRecords(r, layout, func(seg *Segment) error {
+			if !layout.hasLSN {
+				lsn++
+				seg.LSN = lsn
+			}
+			recordDigest(digest, seg)
+			records++
+
+			record := encodeSegment(seg, layout.checksum)
+			defer record.release()
+			return record.writeTo(w)
+		})
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = utils.FlushToDisk(dst)
+	} else {
+		_ = dst.Close()
+	}
+	if err == nil {
+		err = verifyRegion(path+".part", records, digest.Sum64())
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = os.Rename(path+".part", path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &RegionUpgrade{Name: filepath.Base(path), From: layout.version, Records: records}, lsn, nil
+}
+
+// RestoreToLSN rolls back every key changed after the log sequence number n to the value it had at n,
+// keys created after n are deleted. The rollback is written as new records so it can be rolled back too,
+// writes made while it runs are kept. ErrLSNUnavailable is returned if n is lower than LSNHorizon.
+func (lfs *LogStructuredFS) RestoreToLSN(n uint64) (*RollbackResult, error) {
+	lfs.mu.RLock()
+	lsn := lfs.lsn
+	lfs.mu.RUnlock()
+
+	err := lfs.checkHorizon(n)
+	if err != nil || n >= lsn {
+		return &RollbackResult{LSN: n}, err
+	}
+
+	// 第一遍找出 n 之后修改过的 key，第二遍找出这些 key 在 n 之前的最后一个版本
+	versions := make(map[string]*Segment)
+	err = lfs.rangeHistory(context.Background(), func(seg *Segment) {
+		if seg.LSN > n {
+			versions[seg.GetKeyString()] = nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = lfs.rangeHistory(context.Background(), func(seg *Segment) {
+		key := seg.GetKeyString()
+		last, ok := versions[key]
+		if ok && seg.LSN <= n && (last == nil || seg.LSN > last.LSN) {
+			versions[key] = seg
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 扫描期间 region 回收可能丢弃了需要的版本
+	err = lfs.checkHorizon(n)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := &RollbackResult{LSN: n}
+	now := uint64(time.Now().UnixNano())
+	for _, key := range keys {
+		seg := versions[key]
+		if seg == nil || seg.IsTombstone() || (seg.ExpiredAt != 0 && seg.ExpiredAt <= now) {
+			if _, ok := lfs.StatSegment(key); !ok {
+				continue
+			}
+			err := lfs.DeleteSegment(key)
+			if err != nil {
+				return result, fmt.Errorf("failed to roll back key %s: %w", key, err)
+			}
+			result.Deleted++
+			continue
+		}
+
+		restored, err := seg.Reencode()
+		if err != nil {
+			return result, err
+		}
+		// 回滚是一次新的写入，副本之间按照创建时间比较新旧
+		restored.CreatedAt = now
+		err = lfs.PutSegment(key, restored)
+		if err != nil {
+			return result, fmt.Errorf("failed to roll back key %s: %w", key, err)
+		}
+		result.Restored++
+	}
+
+	return result, nil
+}
+
+// RestoreToTime rolls back to the last log sequence number written at or before t, see RestoreToLSN.
+func (lfs *LogStructuredFS) RestoreToTime(t time.Time) (*RollbackResult, error) {
+	var (
+		n  uint64
+		at = uint64(t.UnixNano())
+	)
+	err := lfs.rangeHistory(context.Background(), func(seg *Segment) {
+		if seg.CreatedAt <= at && seg.LSN > n {
+			n = seg.LSN
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lfs.RestoreToLSN(n)
+}
+
+func (lfs *LogStructuredFS) checkHorizon(n uint64) error {
+	horizon := lfs.LSNHorizon()
+	if n < horizon {
+		return fmt.Errorf("%w: history before LSN %d was removed by region compaction", ErrLSNUnavailable, horizon)
+	}
+	return nil
+}
+
+// FetchSegmentsAt returns the record of key that was current at each of the log sequence numbers,
+// found by scanning the history kept in regions that were not compacted yet. The result is nil
+// at an LSN where the key did not exist or was deleted, ErrLSNUnavailable is returned if an LSN
+// is lower than LSNHorizon. The returned segments are not taken from the pool.
+func (lfs *LogStructuredFS) FetchSegmentsAt(ctx context.Context, key string, lsns ...uint64) ([]*Segment, error) {
+	for _, n := range lsns {
+		err := lfs.checkHorizon(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 每个 LSN 取不超过它的最后一个版本，region 回收会复制记录，不能依赖记录在文件中的顺序
+	found := make([]*Segment, len(lsns))
+	err := lfs.rangeHistory(ctx, func(seg *Segment) {
+		if seg.GetKeyString() != key {
+			return
+		}
+		for i, n := range lsns {
+			if seg.LSN <= n && (found[i] == nil || seg.LSN > found[i].LSN) {
+				found[i] = seg
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 扫描期间 region 回收可能丢弃了需要的版本
+	for _, n := range lsns {
+		err = lfs.checkHorizon(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, seg := range found {
+		if seg != nil && seg.IsTombstone() {
+			found[i] = nil
+		}
+	}
+	return found, nil
+}
+
+// rangeHistory 按照 region 的顺序遍历所有记录，包括已经被覆盖的版本和删除记录
+func (lfs *LogStructuredFS) rangeHistory(ctx context.Context, fn func(seg *Segment)) error {
+	for _, id := range lfs.regionIDs(true) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fd, release, err := lfs.openRegion(ctx, id)
+		if err != nil {
+			return err
+		}
+		if fd == nil {
+			continue
+		}
+
+		err = rangeRecords(fd, fn)
+		release()
+		if err != nil {
+			return fmt.Errorf("failed to scan region %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func rangeRecords(fd *os.File, fn func(seg *Segment)) error {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := newRegionReader(fd, finfo.Size())
+	offset := uint64(len(regionMetadata))
+	for offset < uint64(finfo.Size()) {
+		_, segment, err := reader.readSegment(offset)
+		if err != nil {
+			return err
+		}
+		offset += uint64(segment.Size())
+		fn(segment)
+	}
+	return nil
+}
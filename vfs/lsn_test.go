@@ -0,0 +1,184 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func openLSNTestFS(t *testing.T, dir string) *LogStructuredFS {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	return fss
+}
+
+func fetchText(fss *LogStructuredFS, key string) string {
+	_, seg, err := fss.FetchSegment(key)
+	if err != nil {
+		return ""
+	}
+	text, err := seg.ToText()
+	if err != nil {
+		return ""
+	}
+	return text.Content
+}
+
+func TestRestoreToLSN(t *testing.T) {
+	dir := t.TempDir()
+	fss := openLSNTestFS(t, dir)
+	put := func(key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("a", "v1")
+	put("b", "v1")
+	_, seg, err := fss.FetchSegment("b")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seg.LSN)
+	assert.NoError(t, fss.RolloverRegion())
+
+	// 重启之后从最新的有记录的 region 中恢复 LSN
+	assert.NoError(t, fss.CloseFS())
+	fss = openLSNTestFS(t, dir)
+	assert.Equal(t, uint64(2), fss.LSN())
+
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// 误操作删除和覆盖了数据
+	assert.NoError(t, fss.DeleteSegment("a"))
+	put("b", "v2")
+	put("c", "v1")
+	assert.Equal(t, uint64(5), fss.LSN())
+
+	result, err := fss.RestoreToLSN(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Restored)
+	assert.Equal(t, 1, result.Deleted)
+	assert.Equal(t, "v1", fetchText(fss, "a"))
+	assert.Equal(t, "v1", fetchText(fss, "b"))
+	assert.Equal(t, "", fetchText(fss, "c"))
+	assert.Equal(t, uint64(8), fss.LSN())
+
+	// 回滚本身也可以被回滚
+	result, err = fss.RestoreToLSN(5)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Restored)
+	assert.Equal(t, 1, result.Deleted)
+	assert.Equal(t, "", fetchText(fss, "a"))
+	assert.Equal(t, "v2", fetchText(fss, "b"))
+	assert.Equal(t, "v1", fetchText(fss, "c"))
+
+	_, err = fss.RestoreToTime(before)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", fetchText(fss, "a"))
+	assert.Equal(t, "v1", fetchText(fss, "b"))
+	assert.Equal(t, "", fetchText(fss, "c"))
+
+	// region 回收之后不能回滚到更早的 LSN
+	assert.NoError(t, fss.advanceHorizon())
+	_, err = fss.RestoreToLSN(2)
+	assert.ErrorIs(t, err, ErrLSNUnavailable)
+
+	lsn := fss.LSN()
+	assert.NoError(t, fss.CloseFS())
+	fss = openLSNTestFS(t, dir)
+	defer fss.CloseFS()
+	assert.Equal(t, lsn, fss.LSN())
+	assert.Equal(t, lsn, fss.LSNHorizon())
+}
+
+func TestFetchSegmentsAt(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	put := func(key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("a", "v1")
+	put("b", "v1")
+	assert.NoError(t, fss.RolloverRegion())
+	put("a", "v2")
+	assert.NoError(t, fss.DeleteSegment("a"))
+
+	segs, err := fss.FetchSegmentsAt(context.Background(), "a", 0, 1, 2, 3, 4)
+	assert.NoError(t, err)
+	assert.Len(t, segs, 5)
+	assert.Nil(t, segs[0])
+	for i, content := range []string{"v1", "v1", "v2"} {
+		text, err := segs[i+1].ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, content, text.Content)
+	}
+	assert.Nil(t, segs[4])
+
+	assert.NoError(t, fss.advanceHorizon())
+	_, err = fss.FetchSegmentsAt(context.Background(), "a", 1)
+	assert.ErrorIs(t, err, ErrLSNUnavailable)
+}
+
+func TestUpgradeRegions(t *testing.T) {
+	dir := t.TempDir()
+
+	// 第一个版本的记录头部没有 LSN
+	legacy := func(key, content string) []byte {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		data, err := serializedSegment(seg, CRC32)
+		assert.NoError(t, err)
+		record := append(append([]byte{}, data[:26]...), data[34:len(data)-4]...)
+		return binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+	}
+
+	region := append([]byte{}, dataFileMetadata...)
+	region = append(region, legacy("a", "v1")...)
+	region = append(region, legacy("b", "v1")...)
+	region = append(region, legacy("a", "v2")...)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, formatDataFileName(1)), region, conf.FSPerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, indexFileName), dataFileMetadata, conf.FSPerm))
+
+	fss := openLSNTestFS(t, dir)
+	defer fss.CloseFS()
+
+	assert.Equal(t, "v2", fetchText(fss, "a"))
+	assert.Equal(t, "v1", fetchText(fss, "b"))
+	assert.Equal(t, uint64(3), fss.LSN())
+	assert.Equal(t, uint64(3), fss.LSNHorizon())
+
+	_, seg, err := fss.FetchSegment("a")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), seg.LSN)
+}
@@ -0,0 +1,267 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrPrefixDisabled is returned by the prefix operations when Options.Separator is empty.
+var ErrPrefixDisabled = errors.New("key prefix statistics are disabled")
+
+// prefixUsage 是一个一级前缀或者前缀分组下的 key 数量和字节数，分组的 parent 是所在的一级前缀
+type prefixUsage struct {
+	name   string
+	parent *prefixUsage
+	keys   atomic.Int64
+	bytes  atomic.Int64
+}
+
+// prefixTable 把一级前缀编号保存在 Inode 中，删除和过期清理时不需要 key 原文也能更新统计，
+// 编号 0 是没有分隔符的 key
+type prefixTable struct {
+	separator string
+	group     func(key string) string
+	mu        sync.RWMutex
+	ids       map[string]uint32
+	usages    []*prefixUsage
+}
+
+func newPrefixTable(separator string) *prefixTable {
+	return &prefixTable{
+		separator: separator,
+		ids:       map[string]uint32{"": 0},
+		usages:    []*prefixUsage{{name: ""}},
+	}
+}
+
+// prefixOf 返回 key 的一级前缀，没有分隔符的 key 返回空字符串
+func (t *prefixTable) prefixOf(key string) string {
+	if i := strings.Index(key, t.separator); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// intern 返回 key 所属的前缀分组的编号，没有分组时返回一级前缀的编号
+func (t *prefixTable) intern(key string) uint32 {
+	prefix := t.prefixOf(key)
+	if t.group == nil {
+		return t.internName(prefix, nil)
+	}
+	group := t.group(key)
+	if group == "" {
+		return t.internName(prefix, nil)
+	}
+	return t.internName(group, t.usage(t.internName(prefix, nil)))
+}
+
+func (t *prefixTable) internName(name string, parent *prefixUsage) uint32 {
+	t.mu.RLock()
+	id, ok := t.ids[name]
+	t.mu.RUnlock()
+	if ok {
+		return id
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, ok = t.ids[name]
+	if !ok {
+		id = uint32(len(t.usages))
+		t.ids[name] = id
+		t.usages = append(t.usages, &prefixUsage{name: name, parent: parent})
+	}
+	return id
+}
+
+func (t *prefixTable) usage(id uint32) *prefixUsage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.usages[id]
+}
+
+func (t *prefixTable) add(inode *Inode) {
+	if t == nil {
+		return
+	}
+	// 分组中的 key 同时计入所在的一级前缀
+	for u := t.usage(inode.prefix); u != nil; u = u.parent {
+		u.keys.Add(1)
+		u.bytes.Add(int64(atomic.LoadUint32(&inode.Length)))
+	}
+}
+
+func (t *prefixTable) remove(inode *Inode) {
+	if t == nil {
+		return
+	}
+	for u := t.usage(inode.prefix); u != nil; u = u.parent {
+		u.keys.Add(-1)
+		u.bytes.Add(-int64(atomic.LoadUint32(&inode.Length)))
+	}
+}
+
+// tagInode 记录新写入的 inode 所属的一级前缀
+func (lfs *LogStructuredFS) tagInode(key string, inode *Inode) {
+	if lfs.prefixes != nil {
+		inode.prefix = lfs.prefixes.intern(key)
+	}
+}
+
+// rebuildPrefixUsage 在启动恢复索引之后扫描一次 region 找到每个 inode 的 key，
+// 对象存储中的 region 使用本地存根中的 key，不需要下载
+func (lfs *LogStructuredFS) rebuildPrefixUsage() error {
+	if lfs.prefixes == nil {
+		return nil
+	}
+
+	tag := func(key string, regionID, position uint64) {
+		inum := lfs.inodeNum(key)
+		imap := lfs.indexs[inum%uint64(shard)]
+		imap.mu.Lock()
+		inode, ok := imap.index[inum]
+		if ok && inode.RegionID == regionID && inode.Position == position {
+			inode.prefix = lfs.prefixes.intern(key)
+			lfs.prefixes.add(inode)
+		}
+		imap.mu.Unlock()
+	}
+
+	for id, fd := range lfs.regions {
+		finfo, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+
+		reader := newRegionReader(fd, finfo.Size())
+		offset := uint64(len(regionMetadata))
+		for offset < uint64(finfo.Size()) {
+			_, seg, err := reader.readSegment(offset)
+			if err != nil {
+				return fmt.Errorf("failed to parse data file segment: %w", err)
+			}
+			if !seg.IsTombstone() {
+				tag(seg.GetKeyString(), id, offset)
+			}
+			offset += uint64(seg.Size())
+		}
+	}
+
+	for id, region := range lfs.remote {
+		for _, entry := range region.Index {
+			if !entry.Deleted {
+				tag(entry.Key, id, entry.Position)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PrefixInfo is the number of keys and the bytes of their latest versions under a first-level key prefix.
+// Expired keys are counted until they are read, listed or compacted.
+type PrefixInfo struct {
+	// Prefix is the part of the key before the first separator, empty for keys without a separator
+	Prefix string `json:"prefix"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// Separator returns the separator of the first-level key prefix, empty when prefix statistics are disabled.
+func (lfs *LogStructuredFS) Separator() string {
+	if lfs.prefixes == nil {
+		return ""
+	}
+	return lfs.prefixes.separator
+}
+
+// Prefixes returns the statistics of the first-level prefixes that have keys, sorted by prefix.
+func (lfs *LogStructuredFS) Prefixes() ([]PrefixInfo, error) {
+	if lfs.prefixes == nil {
+		return nil, ErrPrefixDisabled
+	}
+
+	lfs.prefixes.mu.RLock()
+	usages := append([]*prefixUsage(nil), lfs.prefixes.usages...)
+	lfs.prefixes.mu.RUnlock()
+
+	infos := make([]PrefixInfo, 0, len(usages))
+	for _, u := range usages {
+		if keys := u.keys.Load(); keys > 0 && u.parent == nil {
+			infos = append(infos, PrefixInfo{Prefix: u.name, Keys: keys, Bytes: u.bytes.Load()})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Prefix < infos[j].Prefix
+	})
+	return infos, nil
+}
+
+// PrefixUsage returns the statistics of a first-level prefix or a prefix group of Options.PrefixGroup,
+// the empty prefix is the keys without a separator.
+func (lfs *LogStructuredFS) PrefixUsage(prefix string) (PrefixInfo, error) {
+	if lfs.prefixes == nil {
+		return PrefixInfo{}, ErrPrefixDisabled
+	}
+
+	info := PrefixInfo{Prefix: prefix}
+	lfs.prefixes.mu.RLock()
+	id, ok := lfs.prefixes.ids[prefix]
+	lfs.prefixes.mu.RUnlock()
+	if ok {
+		u := lfs.prefixes.usage(id)
+		info.Keys, info.Bytes = u.keys.Load(), u.bytes.Load()
+	}
+	return info, nil
+}
+
+// hasPrefix 判断 key 是否属于一级前缀 prefix
+func (lfs *LogStructuredFS) hasPrefix(key, prefix string) bool {
+	return lfs.prefixes.prefixOf(key) == prefix
+}
+
+// ScanPrefix calls fn for the live segments of the keys under a first-level prefix until fn returns false.
+func (lfs *LogStructuredFS) ScanPrefix(prefix string, fn func(seg *Segment) bool) error {
+	if lfs.prefixes == nil {
+		return ErrPrefixDisabled
+	}
+
+	return lfs.RangeSegments(func(seg *Segment) bool {
+		if !lfs.hasPrefix(seg.GetKeyString(), prefix) {
+			return true
+		}
+		return fn(seg)
+	})
+}
+
+// DeletePrefix deletes every key under a first-level prefix with DeleteSegment and returns the number of deleted keys.
+func (lfs *LogStructuredFS) DeletePrefix(prefix string) (int, error) {
+	var keys []string
+	err := lfs.ScanPrefix(prefix, func(seg *Segment) bool {
+		keys = append(keys, seg.GetKeyString())
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return lfs.deleteKeys(keys)
+}
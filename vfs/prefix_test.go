@@ -0,0 +1,148 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixes(t *testing.T) {
+	dir := t.TempDir()
+	open := func(separator string) *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Separator: separator,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	put := func(fss *LogStructuredFS, key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open("/")
+	put(fss, "app/user/1", "v1")
+	put(fss, "app/user/2", "v1")
+	put(fss, "app/user/1", "v2")
+	put(fss, "cache/1", "v1")
+	put(fss, "plain", "v1")
+	assert.NoError(t, fss.RolloverRegion())
+	put(fss, "cache/2", "v1")
+	assert.NoError(t, fss.DeleteSegment("cache/1"))
+
+	prefixes, err := fss.Prefixes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "app", "cache"}, []string{prefixes[0].Prefix, prefixes[1].Prefix, prefixes[2].Prefix})
+	assert.Equal(t, int64(2), prefixes[1].Keys)
+	assert.Equal(t, int64(1), prefixes[2].Keys)
+	assert.Greater(t, prefixes[1].Bytes, prefixes[2].Bytes)
+
+	var keys []string
+	assert.NoError(t, fss.ScanPrefix("app", func(seg *Segment) bool {
+		keys = append(keys, seg.GetKeyString())
+		return true
+	}))
+	assert.ElementsMatch(t, []string{"app/user/1", "app/user/2"}, keys)
+
+	// 重启之后从数据文件重建的统计和增量维护的一致
+	assert.NoError(t, fss.CloseFS())
+	fss = open("/")
+	rebuilt, err := fss.Prefixes()
+	assert.NoError(t, err)
+	assert.Equal(t, prefixes, rebuilt)
+
+	n, err := fss.DeletePrefix("app")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	usage, err := fss.PrefixUsage("app")
+	assert.NoError(t, err)
+	assert.Equal(t, PrefixInfo{Prefix: "app"}, usage)
+	_, ok := fss.StatSegment("app/user/2")
+	assert.False(t, ok)
+	_, ok = fss.StatSegment("cache/2")
+	assert.True(t, ok)
+
+	// 没有分隔符时不统计前缀
+	assert.NoError(t, fss.CloseFS())
+	fss = open("")
+	defer fss.CloseFS()
+	_, err = fss.Prefixes()
+	assert.ErrorIs(t, err, ErrPrefixDisabled)
+	_, err = fss.DeletePrefix("cache")
+	assert.ErrorIs(t, err, ErrPrefixDisabled)
+}
+
+func TestPrefixGroups(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Separator: ":",
+			PrefixGroup: func(key string) string {
+				if rest, ok := strings.CutPrefix(key, "ts:"); ok {
+					return "ts:" + strings.SplitN(rest, ":", 2)[0]
+				}
+				return ""
+			},
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	put := func(fss *LogStructuredFS, key string) {
+		seg, err := NewSegment(key, types.NewText("v1"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open()
+	put(fss, "ts:app:cpu:1")
+	put(fss, "ts:app:cpu:2")
+	put(fss, "ts:web:cpu:1")
+	put(fss, "app:1")
+	assert.NoError(t, fss.DeleteSegment("ts:app:cpu:2"))
+
+	check := func(fss *LogStructuredFS) {
+		group, err := fss.PrefixUsage("ts:app")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), group.Keys)
+		ts, err := fss.PrefixUsage("ts")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), ts.Keys)
+		assert.Equal(t, 2*group.Bytes, ts.Bytes)
+
+		// 分组不出现在一级前缀的列表中
+		prefixes, err := fss.Prefixes()
+		assert.NoError(t, err)
+		assert.Len(t, prefixes, 2)
+	}
+	check(fss)
+
+	// 重启之后重建的分组统计和增量维护的一致
+	assert.NoError(t, fss.CloseFS())
+	fss = open()
+	defer fss.CloseFS()
+	check(fss)
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RecoveryProgress tracks the startup recovery of OpenFS,
+// it is safe to read from other goroutines while the file system is still opening.
+// All methods are nil-safe so recovery code does not need to check whether progress is tracked.
+type RecoveryProgress struct {
+	startedAt      atomic.Int64
+	finishedAt     atomic.Int64
+	regionsTotal   atomic.Int64
+	regionsScanned atomic.Int64
+	keysLoaded     atomic.Int64
+}
+
+// RecoveryStatus is a point-in-time snapshot of RecoveryProgress.
+type RecoveryStatus struct {
+	Done           bool          `json:"done"`
+	RegionsTotal   int64         `json:"regions_total"`
+	RegionsScanned int64         `json:"regions_scanned"`
+	KeysLoaded     int64         `json:"keys_loaded"`
+	Elapsed        time.Duration `json:"elapsed"`
+	ETA            time.Duration `json:"eta"`
+}
+
+func NewRecoveryProgress() *RecoveryProgress {
+	return new(RecoveryProgress)
+}
+
+// Status returns the current progress, ETA is estimated from the average scan time of regions.
+func (p *RecoveryProgress) Status() RecoveryStatus {
+	if p == nil {
+		return RecoveryStatus{}
+	}
+
+	status := RecoveryStatus{
+		Done:           p.finishedAt.Load() != 0,
+		RegionsTotal:   p.regionsTotal.Load(),
+		RegionsScanned: p.regionsScanned.Load(),
+		KeysLoaded:     p.keysLoaded.Load(),
+	}
+
+	started := p.startedAt.Load()
+	if started == 0 {
+		return status
+	}
+
+	end := time.Now().UnixNano()
+	if status.Done {
+		end = p.finishedAt.Load()
+	}
+	status.Elapsed = time.Duration(end - started)
+
+	if !status.Done && status.RegionsScanned > 0 && status.RegionsTotal > status.RegionsScanned {
+		remaining := status.RegionsTotal - status.RegionsScanned
+		status.ETA = status.Elapsed / time.Duration(status.RegionsScanned) * time.Duration(remaining)
+	}
+
+	return status
+}
+
+func (p *RecoveryProgress) start() {
+	if p != nil {
+		p.startedAt.Store(time.Now().UnixNano())
+	}
+}
+
+func (p *RecoveryProgress) setRegions(total int) {
+	if p != nil {
+		p.regionsTotal.Store(int64(total))
+		p.regionsScanned.Store(0)
+	}
+}
+
+func (p *RecoveryProgress) regionScanned() {
+	if p != nil {
+		p.regionsScanned.Add(1)
+	}
+}
+
+func (p *RecoveryProgress) addKeys(n int) {
+	if p != nil {
+		p.keysLoaded.Add(int64(n))
+	}
+}
+
+func (p *RecoveryProgress) finish(keys int) {
+	if p != nil {
+		p.keysLoaded.Store(int64(keys))
+		p.finishedAt.Store(time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryProgress(t *testing.T) {
+	var empty *RecoveryProgress
+	assert.Equal(t, RecoveryStatus{}, empty.Status())
+
+	progress := NewRecoveryProgress()
+	progress.start()
+	progress.setRegions(4)
+	progress.regionScanned()
+	progress.addKeys(10)
+
+	status := progress.Status()
+	assert.False(t, status.Done)
+	assert.Equal(t, int64(4), status.RegionsTotal)
+	assert.Equal(t, int64(1), status.RegionsScanned)
+	assert.Equal(t, int64(10), status.KeysLoaded)
+	assert.True(t, status.ETA >= 0)
+
+	progress.finish(12)
+	status = progress.Status()
+	assert.True(t, status.Done)
+	assert.Equal(t, int64(12), status.KeysLoaded)
+	assert.Equal(t, int64(0), int64(status.ETA))
+}
+
+func TestOpenFS_Progress(t *testing.T) {
+	dir := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("key-01", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+	// 模拟崩溃，不导出索引快照，重新打开时扫描数据文件
+	for _, fd := range fss.regions {
+		assert.NoError(t, fd.Close())
+	}
+
+	progress := NewRecoveryProgress()
+	fss, err = OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+		Progress:  progress,
+	})
+	assert.NoError(t, err)
+
+	status := progress.Status()
+	assert.True(t, status.Done)
+	assert.Equal(t, int64(1), status.RegionsTotal)
+	assert.Equal(t, int64(1), status.RegionsScanned)
+	assert.Equal(t, int64(1), status.KeysLoaded)
+
+	assert.NoError(t, fss.CloseFS())
+}
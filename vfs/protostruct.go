@@ -0,0 +1,281 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Table 使用的 protobuf 消息和 google.protobuf.Struct 的编码相同，Value 增加了两个整数字段，
+// 整数不再转换为 double，超过 2^53 的整数写入之后读取出来不会丢失精度。
+// 其他实现解码时会跳过这两个字段，之前按照 google.protobuf.Struct 写入的值仍然可以读取。
+const (
+	protoStructFields = 1 // Struct.fields，map<string, Value>
+
+	protoEntryKey   = 1
+	protoEntryValue = 2
+
+	protoNullValue   = 1
+	protoNumberValue = 2
+	protoStringValue = 3
+	protoBoolValue   = 4
+	protoStructValue = 5
+	protoListValue   = 6
+	protoIntValue    = 7 // sint64
+	protoUintValue   = 8 // uint64
+
+	protoListValues = 1 // ListValue.values
+)
+
+func appendProtoStruct(b []byte, m map[string]any) ([]byte, error) {
+	for key, value := range m {
+		entry := protowire.AppendTag(nil, protoEntryKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, key)
+
+		val, err := appendProtoValue(nil, value)
+		if err != nil {
+			return nil, err
+		}
+		entry = protowire.AppendTag(entry, protoEntryValue, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, val)
+
+		b = protowire.AppendTag(b, protoStructFields, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+func appendProtoList(b []byte, list []any) ([]byte, error) {
+	for _, value := range list {
+		val, err := appendProtoValue(nil, value)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, protoListValues, protowire.BytesType)
+		b = protowire.AppendBytes(b, val)
+	}
+	return b, nil
+}
+
+// appendProtoValue 编码一个 Value，支持的类型和 structpb.NewValue 相同，[]byte 同样编码为 base64 字符串
+func appendProtoValue(b []byte, value any) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		b = protowire.AppendTag(b, protoNullValue, protowire.VarintType)
+		return protowire.AppendVarint(b, 0), nil
+	case bool:
+		b = protowire.AppendTag(b, protoBoolValue, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v)), nil
+	case string:
+		b = protowire.AppendTag(b, protoStringValue, protowire.BytesType)
+		return protowire.AppendString(b, v), nil
+	case []byte:
+		b = protowire.AppendTag(b, protoStringValue, protowire.BytesType)
+		return protowire.AppendString(b, base64.StdEncoding.EncodeToString(v)), nil
+	case float32:
+		return appendProtoDouble(b, float64(v)), nil
+	case float64:
+		return appendProtoDouble(b, v), nil
+	case int:
+		return appendProtoInt(b, int64(v)), nil
+	case int8:
+		return appendProtoInt(b, int64(v)), nil
+	case int16:
+		return appendProtoInt(b, int64(v)), nil
+	case int32:
+		return appendProtoInt(b, int64(v)), nil
+	case int64:
+		return appendProtoInt(b, v), nil
+	case uint:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint8:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint16:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint32:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint64:
+		return appendProtoUint(b, v), nil
+	case map[string]any:
+		st, err := appendProtoStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, protoStructValue, protowire.BytesType)
+		return protowire.AppendBytes(b, st), nil
+	case []any:
+		list, err := appendProtoList(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, protoListValue, protowire.BytesType)
+		return protowire.AppendBytes(b, list), nil
+	}
+	return nil, fmt.Errorf("invalid type: %T", value)
+}
+
+func appendProtoDouble(b []byte, v float64) []byte {
+	b = protowire.AppendTag(b, protoNumberValue, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendProtoInt(b []byte, v int64) []byte {
+	b = protowire.AppendTag(b, protoIntValue, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+}
+
+func appendProtoUint(b []byte, v uint64) []byte {
+	b = protowire.AppendTag(b, protoUintValue, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// consumeProtoFields 依次把 data 中的字段交给 fn，fn 返回字段值占用的字节数，返回 -1 时跳过这个字段
+func consumeProtoFields(data []byte, fn func(num protowire.Number, typ protowire.Type, data []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func consumeProtoStruct(data []byte) (map[string]any, error) {
+	m := make(map[string]any)
+	err := consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		if num != protoStructFields || typ != protowire.BytesType {
+			return -1, nil
+		}
+		entry, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+
+		var (
+			key   string
+			value any
+		)
+		err := consumeProtoFields(entry, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+			if typ != protowire.BytesType || (num != protoEntryKey && num != protoEntryValue) {
+				return -1, nil
+			}
+			b, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			if num == protoEntryKey {
+				key = string(b)
+				return n, nil
+			}
+			v, err := consumeProtoValue(b)
+			if err != nil {
+				return 0, err
+			}
+			value = v
+			return n, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		m[key] = value
+		return n, nil
+	})
+	return m, err
+}
+
+func consumeProtoList(data []byte) ([]any, error) {
+	list := make([]any, 0)
+	err := consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		if num != protoListValues || typ != protowire.BytesType {
+			return -1, nil
+		}
+		b, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		value, err := consumeProtoValue(b)
+		if err != nil {
+			return 0, err
+		}
+		list = append(list, value)
+		return n, nil
+	})
+	return list, err
+}
+
+// consumeProtoValue 解码一个 Value，double 解码为 float64，整数字段解码为 int64 或 uint64，
+// Value 是 oneof，出现多个字段时使用最后一个
+func consumeProtoValue(data []byte) (any, error) {
+	var value any
+	err := consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch {
+		case num == protoNullValue && typ == protowire.VarintType:
+			_, n := protowire.ConsumeVarint(data)
+			value = nil
+			return n, nil
+		case num == protoNumberValue && typ == protowire.Fixed64Type:
+			x, n := protowire.ConsumeFixed64(data)
+			value = math.Float64frombits(x)
+			return n, nil
+		case num == protoBoolValue && typ == protowire.VarintType:
+			x, n := protowire.ConsumeVarint(data)
+			value = protowire.DecodeBool(x)
+			return n, nil
+		case num == protoIntValue && typ == protowire.VarintType:
+			x, n := protowire.ConsumeVarint(data)
+			value = protowire.DecodeZigZag(x)
+			return n, nil
+		case num == protoUintValue && typ == protowire.VarintType:
+			x, n := protowire.ConsumeVarint(data)
+			value = x
+			return n, nil
+		case typ != protowire.BytesType:
+			return -1, nil
+		}
+
+		b, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		var err error
+		switch num {
+		case protoStringValue:
+			value = string(b)
+		case protoStructValue:
+			value, err = consumeProtoStruct(b)
+		case protoListValue:
+			value, err = consumeProtoList(b)
+		}
+		return n, err
+	})
+	return value, err
+}
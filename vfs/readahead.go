@@ -0,0 +1,141 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+const (
+	// 预读窗口的初始大小和上限，连续的顺序读取每次把窗口扩大一倍，随机读取恢复到初始大小
+	readAheadMin = 64 * 1024
+	readAheadMax = 4 * 1024 * 1024
+)
+
+// regionReader 是顺序扫描 region 使用的读取器。读取的位置紧跟在上一次读取之后（或者向前跳过不超过一个窗口）时
+// 认为是顺序访问，一次读入整个预读窗口并且扩大窗口，同时提示内核提前读取下一个窗口，
+// 在机械硬盘和网络存储上把每条记录两次小的读取合并成少量大的读取。只读取扫描开始时 region 的长度以内的数据，
+// 不会读到 active region 中正在写入的部分
+type regionReader struct {
+	fd     *os.File
+	limit  int64
+	buf    []byte
+	start  int64 // buf[0] 在文件中的偏移
+	next   int64 // 上一次读取结束的位置
+	window int
+	// advised 是已经提示内核预读到的位置
+	advised int64
+}
+
+// newRegionReader 返回从 fd 中顺序读取 limit 以内数据的读取器
+func newRegionReader(fd *os.File, limit int64) *regionReader {
+	return &regionReader{
+		fd:     fd,
+		limit:  limit,
+		next:   -1,
+		window: readAheadMin,
+	}
+}
+
+// ReadAt 优先从预读的缓冲区中读取，超出 limit 的部分返回 io.EOF
+func (r *regionReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.limit {
+		return 0, io.EOF
+	}
+
+	want := p
+	if off+int64(len(p)) > r.limit {
+		want = p[:r.limit-off]
+	}
+
+	if off >= r.start && off+int64(len(want)) <= r.start+int64(len(r.buf)) {
+		n := copy(want, r.buf[off-r.start:])
+		r.next = off + int64(n)
+		return r.eof(n, len(p))
+	}
+
+	r.adapt(off)
+	if len(want) >= r.window {
+		// 大记录直接读入调用方的缓冲区，不经过预读缓冲区复制
+		n, err := r.fd.ReadAt(want, off)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		r.next = off + int64(n)
+		return r.eof(n, len(p))
+	}
+
+	size := int64(r.window)
+	if off+size > r.limit {
+		size = r.limit - off
+	}
+	if cap(r.buf) < int(size) {
+		r.buf = make([]byte, size, r.window)
+	}
+	n, err := r.fd.ReadAt(r.buf[:size], off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	r.buf, r.start = r.buf[:n], off
+	r.advise(off + int64(n))
+
+	n = copy(want, r.buf)
+	r.next = off + int64(n)
+	return r.eof(n, len(p))
+}
+
+func (r *regionReader) eof(n, want int) (int, error) {
+	if n < want {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// adapt 根据这次读取和上一次读取的位置调整预读窗口
+func (r *regionReader) adapt(off int64) {
+	if r.next >= 0 && off >= r.next && off-r.next <= int64(r.window) {
+		if r.window < readAheadMax {
+			r.window *= 2
+		}
+		return
+	}
+	r.window = readAheadMin
+	r.advised = 0
+}
+
+// advise 顺序访问时提示内核在后台读取缓冲区之后的下一个窗口
+func (r *regionReader) advise(end int64) {
+	if r.window == readAheadMin {
+		return
+	}
+	from, to := end, end+int64(r.window)
+	if r.advised > from {
+		from = r.advised
+	}
+	if to > r.limit {
+		to = r.limit
+	}
+	if to <= from {
+		return
+	}
+	adviseWillNeed(r.fd, from, to-from)
+	r.advised = to
+}
+
+// readSegment 和 readSegment 函数相同，数据从预读的缓冲区中读取
+func (r *regionReader) readSegment(offset uint64) (uint64, *Segment, error) {
+	return readSegmentAt(r.fd, r, offset, SEGMENT_PADDING)
+}
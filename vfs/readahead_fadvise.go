@@ -0,0 +1,30 @@
+//go:build linux && (amd64 || arm64)
+
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// POSIX_FADV_WILLNEED，region 的文件描述符同时用于随机读取，不使用会影响整个文件的 POSIX_FADV_SEQUENTIAL
+const fadvWillNeed = 3
+
+// adviseWillNeed 提示内核在后台把 [offset, offset+size) 读入页缓存
+func adviseWillNeed(fd *os.File, offset, size int64) {
+	_, _, _ = syscall.Syscall6(syscall.SYS_FADVISE64, fd.Fd(), uintptr(offset), uintptr(size), fadvWillNeed, 0, 0)
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionReader_Scan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), formatDataFileName(1))
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%05d", i)
+	}
+	region := writeTestRegion(t, path, currentFormat, 1, keys...)
+
+	// 扫描长度之后的数据模拟 active region 中正在写入的部分
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, conf.FSPerm)
+	require.NoError(t, err)
+	defer fd.Close()
+	_, err = fd.Write(make([]byte, SEGMENT_PADDING*2))
+	require.NoError(t, err)
+
+	reader := newRegionReader(fd, int64(len(region)))
+	offset := uint64(len(regionMetadata))
+	for i := 0; offset < uint64(len(region)); i++ {
+		inum, seg, err := reader.readSegment(offset)
+		require.NoError(t, err)
+		want, expected, err := readSegment(fd, offset, SEGMENT_PADDING)
+		require.NoError(t, err)
+		assert.Equal(t, want, inum)
+		assert.Equal(t, expected, seg)
+		assert.Equal(t, keys[i], seg.GetKeyString())
+		offset += uint64(seg.Size())
+	}
+	assert.Greater(t, reader.window, readAheadMin)
+
+	// 不会读到扫描长度之后的数据
+	_, _, err = reader.readSegment(offset)
+	assert.ErrorIs(t, err, io.EOF)
+	n, err := reader.ReadAt(make([]byte, 16), int64(len(region))-8)
+	assert.Equal(t, 8, n)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRegionReader_Adapt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), formatDataFileName(1))
+	data := make([]byte, 3*readAheadMax)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	require.NoError(t, os.WriteFile(path, data, conf.FSPerm))
+	fd, err := os.Open(path)
+	require.NoError(t, err)
+	defer fd.Close()
+
+	// 连续的顺序读取每次扩大一倍窗口，直到上限
+	reader := newRegionReader(fd, int64(len(data)))
+	buf := make([]byte, 100)
+	windows := []int{reader.window}
+	for off := int64(0); off+100 <= int64(len(data)); off += 100 {
+		_, err := reader.ReadAt(buf, off)
+		require.NoError(t, err)
+		require.Equal(t, data[off:off+100], buf)
+		if reader.window != windows[len(windows)-1] {
+			windows = append(windows, reader.window)
+		}
+	}
+	assert.Equal(t, []int{readAheadMin, 2 * readAheadMin, 4 * readAheadMin, 8 * readAheadMin,
+		16 * readAheadMin, 32 * readAheadMin, readAheadMax}, windows)
+
+	// 随机读取恢复初始窗口
+	_, err = reader.ReadAt(buf, 10)
+	require.NoError(t, err)
+	assert.Equal(t, data[10:110], buf)
+	assert.Equal(t, readAheadMin, reader.window)
+
+	// 大于窗口的读取直接读入调用方的缓冲区
+	large := make([]byte, 2*readAheadMin)
+	_, err = reader.ReadAt(large, int64(len(data))-int64(len(large)))
+	require.NoError(t, err)
+	assert.Equal(t, data[len(data)-len(large):], large)
+}
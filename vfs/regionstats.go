@@ -0,0 +1,245 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TTLBuckets are the upper bounds of the remaining TTL buckets in RegionStats.Expiring,
+// the last bucket of Expiring counts the bytes expiring after the largest bound.
+var TTLBuckets = [...]time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// RegionStats describes how much of a local region is still referenced by the index.
+type RegionStats struct {
+	RegionID uint64 `json:"region_id"`
+	// Size is the bytes of the records in the region, excluding the region header
+	Size uint64 `json:"size"`
+	// Live is the bytes of the records referenced by the index and not expired yet
+	Live uint64 `json:"live"`
+	// Expired is the bytes of the records referenced by the index whose TTL has passed
+	Expired uint64 `json:"expired"`
+	// Expiring is the histogram of the live bytes with a TTL by the remaining time, see TTLBuckets
+	Expiring [len(TTLBuckets) + 1]uint64 `json:"expiring"`
+}
+
+// DeadRatio returns the share of the region that compaction would reclaim,
+// the overwritten, deleted and expired records.
+func (s RegionStats) DeadRatio() float64 {
+	if s.Size == 0 || s.Live >= s.Size {
+		return 0
+	}
+	return float64(s.Size-s.Live) / float64(s.Size)
+}
+
+// expiryCompactor 定期统计 region 中过期的数据，只回收死数据比例超过阈值的 region
+type expiryCompactor struct {
+	ticker *time.Ticker
+	stop   chan struct{}
+}
+
+// RegionStats computes the statistics of the local regions from the in-memory index, sorted by region id.
+func (lfs *LogStructuredFS) RegionStats() ([]RegionStats, error) {
+	now := time.Now()
+
+	lfs.mu.RLock()
+	stats := make(map[uint64]*RegionStats, len(lfs.regions))
+	for id, fd := range lfs.regions {
+		finfo, err := fd.Stat()
+		if err != nil {
+			lfs.mu.RUnlock()
+			return nil, fmt.Errorf("failed to get region %d file info: %w", id, err)
+		}
+		s := &RegionStats{RegionID: id}
+		if size := finfo.Size() - int64(len(regionMetadata)); size > 0 {
+			s.Size = uint64(size)
+		}
+		stats[id] = s
+	}
+	lfs.mu.RUnlock()
+
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		imap.rangeInodes(func(_ uint64, inode *Inode) bool {
+			// 已经上传到对象存储的 region 不在本地统计
+			s, ok := stats[atomic.LoadUint64(&inode.RegionID)]
+			if !ok {
+				return true
+			}
+
+			length := uint64(atomic.LoadUint32(&inode.Length))
+			expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+			if expiredAt == 0 {
+				s.Live += length
+				return true
+			}
+
+			remaining := time.Duration(int64(expiredAt) - now.UnixNano())
+			if remaining <= 0 {
+				s.Expired += length
+				return true
+			}
+
+			s.Live += length
+			bucket := sort.Search(len(TTLBuckets), func(i int) bool {
+				return remaining <= TTLBuckets[i]
+			})
+			s.Expiring[bucket] += length
+			return true
+		})
+		imap.mu.RUnlock()
+	}
+
+	result := make([]RegionStats, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RegionID < result[j].RegionID
+	})
+	return result, nil
+}
+
+// CompactExpiredRegions compacts the sealed regions whose dead ratio is at least ratio,
+// instead of the oldest regions picked by CompactRegions. It returns the number of compacted regions.
+func (lfs *LogStructuredFS) CompactExpiredRegions(ratio float64) (n int, err error) {
+	err = lfs.beginCompaction()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		lfs.endCompaction(err)
+	}()
+
+	stats, err := lfs.RegionStats()
+	if err != nil {
+		return 0, err
+	}
+
+	lfs.mu.RLock()
+	var (
+		ids []uint64
+		fds []*os.File
+	)
+	for _, s := range stats {
+		// 活跃的 region 还在写入，Snapshot 固定的 region 还在读取，都不能回收
+		if s.RegionID == lfs.regionID || s.DeadRatio() < ratio || lfs.pins.pinned(s.RegionID) {
+			continue
+		}
+		ids = append(ids, s.RegionID)
+		fds = append(fds, lfs.regions[s.RegionID])
+	}
+	lfs.mu.RUnlock()
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	_, span := tracer.Start(context.Background(), "vfs.CompactExpiredRegions", trace.WithAttributes(
+		attribute.Int("urnadb.regions", len(ids)),
+	))
+
+	var retained uint64
+	for i, id := range ids {
+		if lfs.compactionPaused() {
+			endSpan(span, ErrCompactPaused)
+			return i, ErrCompactPaused
+		}
+		kept, err := lfs.compactRegion(id, fds[i])
+		if err != nil {
+			endSpan(span, err)
+			return i, err
+		}
+		retained += kept
+	}
+	lfs.compaction.retained.Store(retained)
+	endSpan(span, nil)
+
+	compactLog.Infof("compacted %d regions with dead ratio above %.0f%%", len(ids), ratio*100)
+	return len(ids), nil
+}
+
+// RunExpiryCompaction checks the region statistics every second seconds and compacts
+// the regions whose dead ratio is at least ratio.
+func (lfs *LogStructuredFS) RunExpiryCompaction(second uint32, ratio float64) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.expiry != nil || second == 0 {
+		return
+	}
+
+	c := &expiryCompactor{
+		ticker: time.NewTicker(time.Duration(second) * time.Second),
+		stop:   make(chan struct{}),
+	}
+	lfs.expiry = c
+
+	go func() {
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-c.ticker.C:
+				_, err := lfs.CompactExpiredRegions(ratio)
+				if err != nil && err != ErrCompactRunning && err != ErrTieringRunning && err != ErrCompactPaused {
+					compactLog.Warnf("failed to compact expired regions: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// StopExpiryCompaction stops the background check started by RunExpiryCompaction.
+func (lfs *LogStructuredFS) StopExpiryCompaction() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	lfs.stopExpiryCompaction()
+}
+
+// stopExpiryCompaction 停止后台检查，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) stopExpiryCompaction() {
+	if lfs.expiry != nil {
+		lfs.expiry.ticker.Stop()
+		close(lfs.expiry.stop)
+		lfs.expiry = nil
+	}
+}
+
+// isOldestRegion 判断 regionID 之前是否已经没有本地或者对象存储中的 region
+func (lfs *LogStructuredFS) isOldestRegion(regionID uint64) bool {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	for id := range lfs.regions {
+		if id < regionID {
+			return false
+		}
+	}
+	for id := range lfs.remote {
+		if id < regionID {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactExpiredRegions(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	put := func(key string, expiredAt time.Time) {
+		seg, err := NewSegment(key, types.NewText(strings.Repeat("v", 1000)), 0)
+		assert.NoError(t, err)
+		if !expiredAt.IsZero() {
+			seg.ExpiredAt = uint64(expiredAt.UnixNano())
+		}
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("live", time.Time{})
+	put("later", time.Now().Add(2*time.Hour))
+	for i := 0; i < 4; i++ {
+		put(fmt.Sprintf("session-%d", i), time.Now().Add(100*time.Millisecond))
+	}
+	expiredRegion := fss.regionID
+	assert.NoError(t, fss.RolloverRegion())
+	put("other", time.Time{})
+	liveRegion := fss.regionID
+	assert.NoError(t, fss.RolloverRegion())
+
+	time.Sleep(200 * time.Millisecond)
+
+	stats, err := fss.RegionStats()
+	assert.NoError(t, err)
+	assert.Len(t, stats, 3)
+	s := stats[0]
+	assert.Equal(t, expiredRegion, s.RegionID)
+	assert.Equal(t, s.Size, s.Live+s.Expired)
+	assert.Greater(t, s.Expired, s.Live)
+	assert.Greater(t, s.Expiring[2], uint64(0))
+	assert.Less(t, s.Expiring[2], s.Live)
+	assert.Greater(t, s.DeadRatio(), 0.6)
+	assert.Equal(t, 0.0, stats[1].DeadRatio())
+
+	n, err := fss.CompactExpiredRegions(0.5)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, ok := fss.regions[expiredRegion]
+	assert.False(t, ok)
+	_, ok = fss.regions[liveRegion]
+	assert.True(t, ok)
+	assert.Greater(t, fss.CompactionStats().BytesReclaimed, uint64(0))
+
+	assert.NotEmpty(t, fetchText(fss, "live"))
+	assert.NotEmpty(t, fetchText(fss, "later"))
+	assert.NotEmpty(t, fetchText(fss, "other"))
+	assert.Empty(t, fetchText(fss, "session-0"))
+
+	// 没有超过阈值的 region 时不回收
+	n, err = fss.CompactExpiredRegions(0.5)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// regionUsage 是一个 region 中被索引引用的 key 数量和字节数，索引修改时增量更新
+type regionUsage struct {
+	keys      atomic.Int64
+	live      atomic.Int64
+	createdAt time.Time
+}
+
+// usageTable 按照 region ID 保存 regionUsage，启动时从恢复的索引中重建
+type usageTable struct {
+	mu      sync.RWMutex
+	regions map[uint64]*regionUsage
+}
+
+func (t *usageTable) region(id uint64) *regionUsage {
+	t.mu.RLock()
+	u, ok := t.regions[id]
+	t.mu.RUnlock()
+	if ok {
+		return u
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.regions == nil {
+		t.regions = make(map[uint64]*regionUsage)
+	}
+	u, ok = t.regions[id]
+	if !ok {
+		u = &regionUsage{createdAt: time.Now()}
+		t.regions[id] = u
+	}
+	return u
+}
+
+// add 记录 inode 引用了它所在的 region
+func (t *usageTable) add(inode *Inode) {
+	u := t.region(atomic.LoadUint64(&inode.RegionID))
+	u.keys.Add(1)
+	u.live.Add(int64(atomic.LoadUint32(&inode.Length)))
+}
+
+// remove 记录 inode 不再引用它所在的 region，必须在修改 inode 的位置之前调用
+func (t *usageTable) remove(inode *Inode) {
+	u := t.region(atomic.LoadUint64(&inode.RegionID))
+	u.keys.Add(-1)
+	u.live.Add(-int64(atomic.LoadUint32(&inode.Length)))
+}
+
+func (t *usageTable) get(id uint64) *regionUsage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.regions[id]
+}
+
+func (t *usageTable) drop(id uint64) {
+	t.mu.Lock()
+	delete(t.regions, id)
+	t.mu.Unlock()
+}
+
+// rebuildRegionUsage 在启动恢复索引之后统计每个 region 的引用，之后由写入、删除和回收增量更新
+func (lfs *LogStructuredFS) rebuildRegionUsage() {
+	usage := make(map[uint64]*regionUsage, len(lfs.regions)+len(lfs.remote))
+	for id, fd := range lfs.regions {
+		u := &regionUsage{}
+		// region 的创建时间是第一条记录的写入时间，空的 region 使用文件的修改时间
+		_, seg, err := readSegment(fd, uint64(len(regionMetadata)), SEGMENT_PADDING)
+		if err == nil {
+			u.createdAt = time.Unix(0, int64(seg.CreatedAt))
+		} else if finfo, err := fd.Stat(); err == nil {
+			u.createdAt = finfo.ModTime()
+		}
+		usage[id] = u
+	}
+	for id := range lfs.remote {
+		usage[id] = &regionUsage{}
+	}
+
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		for _, inode := range imap.index {
+			u, ok := usage[inode.RegionID]
+			if !ok {
+				continue
+			}
+			u.keys.Add(1)
+			u.live.Add(int64(inode.Length))
+		}
+		imap.mu.RUnlock()
+	}
+
+	lfs.usage.mu.Lock()
+	lfs.usage.regions = usage
+	lfs.usage.mu.Unlock()
+}
+
+// RegionInfo is the metadata of a region with the key statistics maintained incrementally by writes,
+// deletes and compaction. Expired records stay live until they are read, listed or compacted.
+type RegionInfo struct {
+	RegionID uint64 `json:"region_id"`
+	Active   bool   `json:"active"`
+	Remote   bool   `json:"remote"`
+	// Keys is the number of keys whose latest version is in the region
+	Keys int64 `json:"keys"`
+	// Size is the bytes of the records in the region, excluding the region header
+	Size uint64 `json:"size"`
+	// LiveBytes is the bytes of the latest versions, DeadBytes the overwritten, deleted and tombstone bytes
+	LiveBytes uint64 `json:"live_bytes"`
+	DeadBytes uint64 `json:"dead_bytes"`
+	// Amplification is Size divided by LiveBytes, the disk space used for each byte of live data
+	Amplification float64 `json:"amplification"`
+	// CreatedAt is unknown for regions that were already in object storage at startup
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Regions returns the metadata of the local and remote regions sorted by region id.
+func (lfs *LogStructuredFS) Regions() ([]RegionInfo, error) {
+	lfs.mu.RLock()
+	infos := make([]RegionInfo, 0, len(lfs.regions)+len(lfs.remote))
+	for id, fd := range lfs.regions {
+		info := RegionInfo{RegionID: id, Active: id == lfs.regionID}
+		size := int64(lfs.offset)
+		if !info.Active {
+			finfo, err := fd.Stat()
+			if err != nil {
+				lfs.mu.RUnlock()
+				return nil, fmt.Errorf("failed to get region %d file info: %w", id, err)
+			}
+			size = finfo.Size()
+		}
+		if size -= int64(len(regionMetadata)); size > 0 {
+			info.Size = uint64(size)
+		}
+		infos = append(infos, info)
+	}
+	for id, region := range lfs.remote {
+		info := RegionInfo{RegionID: id, Remote: true}
+		if size := region.Size - int64(len(regionMetadata)); size > 0 {
+			info.Size = uint64(size)
+		}
+		infos = append(infos, info)
+	}
+	lfs.mu.RUnlock()
+
+	for i := range infos {
+		info := &infos[i]
+		u := lfs.usage.get(info.RegionID)
+		if u == nil {
+			info.DeadBytes = info.Size
+			continue
+		}
+		info.Keys = u.keys.Load()
+		if live := u.live.Load(); live > 0 {
+			info.LiveBytes = uint64(live)
+		}
+		if info.Size > info.LiveBytes {
+			info.DeadBytes = info.Size - info.LiveBytes
+		}
+		if info.LiveBytes > 0 {
+			info.Amplification = float64(info.Size) / float64(info.LiveBytes)
+		}
+		if !u.createdAt.IsZero() {
+			createdAt := u.createdAt
+			info.CreatedAt = &createdAt
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RegionID < infos[j].RegionID
+	})
+	return infos, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegions(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	put := func(fss *LogStructuredFS, key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open()
+	put(fss, "a", "v1")
+	put(fss, "b", "v1")
+	put(fss, "a", "v2")
+	assert.NoError(t, fss.RolloverRegion())
+	assert.NoError(t, fss.DeleteSegment("b"))
+	put(fss, "c", "v1")
+
+	_, seg, err := fss.FetchSegment("c")
+	assert.NoError(t, err)
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	seg.ReleaseToPool()
+	text.Content = "v2"
+	updated, err := NewSegment("c", text, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.UpdateSegmentWithCAS("c", 0, updated))
+
+	regions, err := fss.Regions()
+	assert.NoError(t, err)
+	assert.Len(t, regions, 2)
+
+	sealed, active := regions[0], regions[1]
+	assert.False(t, sealed.Active)
+	assert.True(t, active.Active)
+	assert.NotNil(t, sealed.CreatedAt)
+
+	// 被覆盖和删除的版本是死数据
+	assert.Equal(t, int64(1), sealed.Keys)
+	assert.Equal(t, sealed.Size, sealed.LiveBytes+sealed.DeadBytes)
+	assert.Greater(t, sealed.DeadBytes, sealed.LiveBytes)
+	assert.Greater(t, sealed.Amplification, 2.0)
+	assert.Equal(t, int64(1), active.Keys)
+	assert.Greater(t, active.DeadBytes, uint64(0))
+
+	// 重启之后从索引重建的统计和增量维护的一致
+	assert.NoError(t, fss.CloseFS())
+	fss = open()
+	defer fss.CloseFS()
+
+	rebuilt, err := fss.Regions()
+	assert.NoError(t, err)
+	assert.Len(t, rebuilt, 2)
+	for i := range rebuilt {
+		assert.Equal(t, regions[i].Keys, rebuilt[i].Keys)
+		assert.Equal(t, regions[i].Size, rebuilt[i].Size)
+		assert.Equal(t, regions[i].LiveBytes, rebuilt[i].LiveBytes)
+	}
+}
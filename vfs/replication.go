@@ -0,0 +1,118 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// OpKind is the kind of a replicated write operation.
+type OpKind uint8
+
+const (
+	OpPut OpKind = iota
+	OpDelete
+	OpCAS
+)
+
+// Operation is a write that is committed through a Replicator before it is applied.
+type Operation struct {
+	Kind     OpKind   `msgpack:"kind"`
+	Key      string   `msgpack:"key"`
+	Segment  *Segment `msgpack:"segment,omitempty"`
+	Expected uint64   `msgpack:"expected,omitempty"`
+}
+
+// Replicator commits write operations to a replicated log. Replicate must only return
+// after the operation has been applied locally through Apply, with the error Apply returned.
+type Replicator interface {
+	Replicate(ctx context.Context, op *Operation) error
+}
+
+// SetReplicator routes PutSegment, DeleteSegment and UpdateSegmentWithCAS through r,
+// it must be called before the file system starts serving writes.
+func (lfs *LogStructuredFS) SetReplicator(r Replicator) {
+	lfs.replicator = r
+}
+
+// Apply writes a committed operation to the local file system, it is called by the Replicator.
+func (lfs *LogStructuredFS) Apply(op *Operation) error {
+	switch op.Kind {
+	case OpPut:
+		_, err := lfs.putSegment(context.Background(), op.Key, op.Segment)
+		return err
+	case OpDelete:
+		return lfs.deleteSegment(context.Background(), op.Key)
+	case OpCAS:
+		return lfs.updateSegmentWithCAS(context.Background(), op.Key, op.Expected, op.Segment)
+	}
+	return fmt.Errorf("unknown replicated operation kind %d", op.Kind)
+}
+
+// Restore replaces the contents of the file system with a snapshot written by Snapshot.Export,
+// keys missing from the snapshot are deleted.
+func (lfs *LogStructuredFS) Restore(r io.Reader) error {
+	dec := msgpack.NewDecoder(bufio.NewReader(r))
+	restored := make(map[string]struct{})
+
+	for {
+		var seg Segment
+		err := dec.Decode(&seg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode snapshot segment: %w", err)
+		}
+
+		// 读取出来的 Value 已经被 transformer 解码过，写入之前需要重新编码
+		encoded, err := seg.Reencode()
+		if err != nil {
+			return err
+		}
+
+		_, err = lfs.putSegment(context.Background(), seg.GetKeyString(), encoded)
+		if err != nil {
+			return err
+		}
+		restored[seg.GetKeyString()] = struct{}{}
+	}
+
+	var stale []string
+	err := lfs.RangeSegments(func(seg *Segment) bool {
+		if _, ok := restored[seg.GetKeyString()]; !ok {
+			stale = append(stale, seg.GetKeyString())
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range stale {
+		err := lfs.deleteSegment(context.Background(), key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// loopbackReplicator 把操作编码之后直接应用到另外一个文件系统和本地文件系统
+type loopbackReplicator struct {
+	local, follower *LogStructuredFS
+	ops             []OpKind
+}
+
+func (r *loopbackReplicator) Replicate(ctx context.Context, op *Operation) error {
+	data, err := msgpack.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	var decoded Operation
+	err = msgpack.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	r.ops = append(r.ops, op.Kind)
+	err = r.follower.Apply(&decoded)
+	if err != nil {
+		return err
+	}
+	return r.local.Apply(op)
+}
+
+func TestReplicator(t *testing.T) {
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      t.TempDir(),
+			Threshold: conf.Settings.Region.Threshold,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	leader, follower := open(), open()
+	defer leader.CloseFS()
+	defer follower.CloseFS()
+
+	r := &loopbackReplicator{local: leader, follower: follower}
+	leader.SetReplicator(r)
+
+	for _, key := range []string{"user:1", "user:2"} {
+		seg, err := NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, leader.PutSegment(key, seg))
+	}
+
+	seg, err := NewSegment("user:1", types.NewText("world"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, leader.UpdateSegmentWithCAS("user:1", 0, seg))
+	assert.Error(t, leader.UpdateSegmentWithCAS("user:1", 0, seg))
+	assert.NoError(t, leader.DeleteSegment("user:2"))
+
+	assert.Equal(t, []OpKind{OpPut, OpPut, OpCAS, OpCAS, OpDelete}, r.ops)
+
+	for _, fss := range []*LogStructuredFS{leader, follower} {
+		version, seg, err := fss.FetchSegment("user:1")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), version)
+		text, err := seg.ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, "world", text.Content)
+
+		_, _, err = fss.FetchSegment("user:2")
+		assert.Error(t, err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      t.TempDir(),
+			Threshold: conf.Settings.Region.Threshold,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	source, target := open(), open()
+	defer source.CloseFS()
+	defer target.CloseFS()
+
+	put := func(fss *LogStructuredFS, key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put(source, "user:1", "hello")
+	put(source, "user:2", "world")
+	put(target, "user:1", "stale")
+	put(target, "user:3", "removed")
+
+	var buf bytes.Buffer
+	snap := source.Snapshot()
+	assert.NoError(t, snap.Export(context.Background(), &buf))
+	snap.Release()
+	assert.NoError(t, target.Restore(&buf))
+
+	assert.Equal(t, 2, target.KeysCount())
+	for key, content := range map[string]string{"user:1": "hello", "user:2": "world"} {
+		_, seg, err := target.FetchSegment(key)
+		assert.NoError(t, err)
+		text, err := seg.ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, content, text.Content)
+	}
+
+	_, _, err := target.FetchSegment("user:3")
+	assert.Error(t, err)
+}
@@ -15,12 +15,15 @@
 package vfs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/auula/urnadb/types"
+	"github.com/auula/urnadb/utils"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -34,6 +37,10 @@ const (
 	Number
 	Unknown
 	Collection
+	Stream
+	HLL
+	Queue
+	Series
 )
 
 var KindToString = map[Kind]string{
@@ -44,9 +51,13 @@ var KindToString = map[Kind]string{
 	Number:     "number",
 	Unknown:    "unknown",
 	Collection: "collection",
+	Stream:     "stream",
+	HLL:        "hll",
+	Queue:      "queue",
+	Series:     "series",
 }
 
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | LSN 8 | KEY ? | VALUE ? | CRC32 4 |
 type Segment struct {
 	Tombstone int8
 	Type      Kind
@@ -54,8 +65,12 @@ type Segment struct {
 	CreatedAt uint64
 	KeySize   uint32
 	ValueSize uint32
-	Key       []byte
-	Value     []byte
+	// LSN 是写入时分配的单调递增的日志序列号，region 回收时复制的记录保留原来的 LSN
+	LSN uint64
+	// Codec 是 Value 的序列化格式，和 Type 保存在同一个字节中
+	Codec Codec
+	Key   []byte
+	Value []byte
 }
 
 // Available segment in the pool
@@ -65,6 +80,10 @@ var segmentPool = sync.Pool{
 	},
 }
 
+// segmentCounter 统计交给调用者的 Segment，包括 AcquirePoolSegment 和读取返回的 Segment，
+// 这些 Segment 都需要调用者通过 ReleaseToPool 归还
+var segmentCounter = utils.NewPoolCounter("segment")
+
 func init() {
 	// 预先填充池中的对象
 	for i := 0; i < 100; i++ {
@@ -79,12 +98,13 @@ type Serializable interface {
 
 func AcquirePoolSegment(key string, data Serializable, ttl uint64) (*Segment, error) {
 	seg := segmentPool.Get().(*Segment)
+	segmentCounter.Acquire(seg)
 	timestamp, expiredAt := uint64(time.Now().UnixNano()), uint64(0)
 	if ttl > 0 {
 		expiredAt = uint64(time.Now().Add(time.Second * time.Duration(ttl)).UnixNano())
 	}
 
-	bytes, err := data.ToBytes()
+	bytes, codec, err := encodeValue(key, data)
 	if err != nil {
 		seg.ReleaseToPool()
 		return nil, err
@@ -98,6 +118,7 @@ func AcquirePoolSegment(key string, data Serializable, ttl uint64) (*Segment, er
 
 	// 只能这样初始化复用 segment 结构
 	seg.Type = toKind(data)
+	seg.Codec = codec
 	seg.Tombstone = 0
 	seg.CreatedAt = timestamp
 	seg.ExpiredAt = expiredAt
@@ -111,6 +132,7 @@ func AcquirePoolSegment(key string, data Serializable, ttl uint64) (*Segment, er
 
 func (seg *Segment) ReleaseToPool() {
 	seg.Clear()
+	segmentCounter.Release(seg)
 	segmentPool.Put(seg)
 }
 
@@ -122,6 +144,8 @@ func (s *Segment) Clear() {
 	s.ExpiredAt = 0
 	s.ValueSize = 0
 	s.Tombstone = 0
+	s.LSN = 0
+	s.Codec = MsgPack
 }
 
 // NewSegment 使用数据类型初始化并返回对应的 Segment
@@ -131,7 +155,7 @@ func NewSegment(key string, data Serializable, ttl uint64) (*Segment, error) {
 		expiredAt = uint64(time.Now().Add(time.Second * time.Duration(ttl)).UnixNano())
 	}
 
-	bytes, err := data.ToBytes()
+	bytes, codec, err := encodeValue(key, data)
 	if err != nil {
 		return nil, err
 	}
@@ -145,6 +169,7 @@ func NewSegment(key string, data Serializable, ttl uint64) (*Segment, error) {
 	// 如果类型不匹配，则返回错误
 	return &Segment{
 		Type:      toKind(data),
+		Codec:     codec,
 		Tombstone: 0,
 		CreatedAt: timestamp,
 		ExpiredAt: expiredAt,
@@ -156,6 +181,53 @@ func NewSegment(key string, data Serializable, ttl uint64) (*Segment, error) {
 
 }
 
+// WithTTL 返回一个只修改了过期时间的新 Segment，ttl 为 0 表示永不过期
+func (s *Segment) WithTTL(ttl uint64) (*Segment, error) {
+	timestamp, expiredAt := uint64(time.Now().UnixNano()), uint64(0)
+	if ttl > 0 {
+		expiredAt = uint64(time.Now().Add(time.Second * time.Duration(ttl)).UnixNano())
+	}
+
+	// 读取出来的 Value 已经被 transformer 解码过，写入之前需要重新编码
+	encodedata, err := transformer.Encode(s.Value)
+	if err != nil {
+		return nil, fmt.Errorf("transformer encode: %w", err)
+	}
+
+	return &Segment{
+		Type:      s.Type,
+		Codec:     s.Codec,
+		Tombstone: 0,
+		CreatedAt: timestamp,
+		ExpiredAt: expiredAt,
+		KeySize:   s.KeySize,
+		ValueSize: uint32(len(encodedata)),
+		Key:       append([]byte(nil), s.Key...),
+		Value:     encodedata,
+	}, nil
+}
+
+// Reencode 返回一个 Value 重新编码过的副本，创建时间和过期时间保持不变，
+// 用于把读取出来的 Segment 原样写入到其他文件系统
+func (s *Segment) Reencode() (*Segment, error) {
+	encodedata, err := transformer.Encode(s.Value)
+	if err != nil {
+		return nil, fmt.Errorf("transformer encode: %w", err)
+	}
+
+	return &Segment{
+		Type:      s.Type,
+		Codec:     s.Codec,
+		Tombstone: 0,
+		CreatedAt: s.CreatedAt,
+		ExpiredAt: s.ExpiredAt,
+		KeySize:   s.KeySize,
+		ValueSize: uint32(len(encodedata)),
+		Key:       append([]byte(nil), s.Key...),
+		Value:     encodedata,
+	}, nil
+}
+
 func NewTombstoneSegment(key string) *Segment {
 	timestamp, expiredAt := uint64(time.Now().UnixNano()), uint64(0)
 	return &Segment{
@@ -178,6 +250,11 @@ func (s *Segment) GetTypeString() string {
 	return KindToString[s.Type]
 }
 
+// GetCodecString 返回 Value 的序列化格式名称
+func (s *Segment) GetCodecString() string {
+	return s.Codec.String()
+}
+
 func (s *Segment) GetKeyString() string {
 	return string(s.Key)
 }
@@ -192,7 +269,12 @@ func (s *Segment) ToSet() (*types.Set, error) {
 		return nil, fmt.Errorf("not support conversion to set type")
 	}
 	set := types.AcquireSet()
-	err := msgpack.Unmarshal(s.Value, &set.Set)
+	var err error
+	if s.IsIntSet() {
+		err = types.DecodeIntSet(s.Value, set.Set)
+	} else {
+		err = s.unmarshal(&set.Set)
+	}
 	if err != nil {
 		set.ReleaseToPool()
 		return nil, err
@@ -200,12 +282,18 @@ func (s *Segment) ToSet() (*types.Set, error) {
 	return set, nil
 }
 
+// IsIntSet reports whether the segment is a Set whose integer members are stored in the compact
+// intset encoding instead of a msgpack map.
+func (s *Segment) IsIntSet() bool {
+	return s.Type == Set && s.Codec == MsgPack && types.IsIntSet(s.Value)
+}
+
 func (s *Segment) ToZSet() (*types.ZSet, error) {
 	if s.Type != ZSet {
 		return nil, fmt.Errorf("not support conversion to zset type")
 	}
 	zset := types.AcquireZSet()
-	err := msgpack.Unmarshal(s.Value, &zset.ZSet)
+	err := s.unmarshal(&zset.ZSet)
 	if err != nil {
 		zset.ReleaseToPool()
 		return nil, err
@@ -218,7 +306,7 @@ func (s *Segment) ToText() (*types.Text, error) {
 		return nil, fmt.Errorf("not support conversion to text type")
 	}
 	text := types.AcquireText()
-	err := msgpack.Unmarshal(s.Value, &text.Content)
+	err := s.unmarshal(&text.Content)
 	if err != nil {
 		text.ReleaseToPool()
 		return nil, err
@@ -231,7 +319,7 @@ func (s *Segment) ToCollection() (*types.Collection, error) {
 		return nil, fmt.Errorf("not support conversion to collection type")
 	}
 	collection := types.AcquireCollection()
-	err := msgpack.Unmarshal(s.Value, &collection.Collection)
+	err := s.unmarshal(&collection.Collection)
 	if err != nil {
 		collection.ReleaseToPool()
 		return nil, err
@@ -239,12 +327,35 @@ func (s *Segment) ToCollection() (*types.Collection, error) {
 	return collection, nil
 }
 
+// CollectionSize returns the number of items of a collection. Values written with MsgPack only
+// have the array header read, the items are not decoded.
+func (s *Segment) CollectionSize() (int, error) {
+	if s.Type != Collection {
+		return 0, fmt.Errorf("not support conversion to collection type")
+	}
+	if s.Codec == MsgPack {
+		n, err := msgpack.NewDecoder(bytes.NewReader(s.Value)).DecodeArrayLen()
+		if err != nil {
+			return 0, err
+		}
+		// nil 的数组长度为 -1
+		if n < 0 {
+			n = 0
+		}
+		return n, nil
+	}
+
+	var items []cbor.RawMessage
+	err := s.unmarshal(&items)
+	return len(items), err
+}
+
 func (s *Segment) ToTable() (*types.Table, error) {
 	if s.Type != Table {
 		return nil, fmt.Errorf("not support conversion to table type")
 	}
 	table := types.AcquireTable()
-	err := msgpack.Unmarshal(s.Value, &table.Table)
+	err := s.unmarshal(&table.Table)
 	if err != nil {
 		table.ReleaseToPool()
 		return nil, err
@@ -257,7 +368,7 @@ func (s *Segment) ToNumber() (*types.Number, error) {
 		return nil, fmt.Errorf("not support conversion to number type")
 	}
 	number := types.AcquireNumber()
-	err := msgpack.Unmarshal(s.Value, &number.Value)
+	err := s.unmarshal(&number.Value)
 	if err != nil {
 		number.ReleaseToPool()
 		return nil, err
@@ -265,6 +376,58 @@ func (s *Segment) ToNumber() (*types.Number, error) {
 	return number, nil
 }
 
+func (s *Segment) ToStream() (*types.Stream, error) {
+	if s.Type != Stream {
+		return nil, fmt.Errorf("not support conversion to stream type")
+	}
+	stream := types.AcquireStream()
+	err := s.unmarshal(stream)
+	if err != nil {
+		stream.ReleaseToPool()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Segment) ToHLL() (*types.HLL, error) {
+	if s.Type != HLL {
+		return nil, fmt.Errorf("not support conversion to hll type")
+	}
+	hll := types.AcquireHLL()
+	err := s.unmarshal(&hll.Registers)
+	if err != nil {
+		hll.ReleaseToPool()
+		return nil, err
+	}
+	return hll, nil
+}
+
+func (s *Segment) ToQueue() (*types.Queue, error) {
+	if s.Type != Queue {
+		return nil, fmt.Errorf("not support conversion to queue type")
+	}
+	queue := types.AcquireQueue()
+	err := s.unmarshal(queue)
+	if err != nil {
+		queue.ReleaseToPool()
+		return nil, err
+	}
+	return queue, nil
+}
+
+func (s *Segment) ToSeries() (*types.Series, error) {
+	if s.Type != Series {
+		return nil, fmt.Errorf("not support conversion to series type")
+	}
+	series := types.AcquireSeries()
+	err := s.unmarshal(&series.Points)
+	if err != nil {
+		series.ReleaseToPool()
+		return nil, err
+	}
+	return series, nil
+}
+
 func (s *Segment) TTL() int64 {
 	now := uint64(time.Now().UnixNano())
 	if s.ExpiredAt > 0 && s.ExpiredAt > now {
@@ -273,6 +436,11 @@ func (s *Segment) TTL() int64 {
 	return -1
 }
 
+// KindOf 返回数据类型对应的 Kind
+func KindOf(data Serializable) Kind {
+	return toKind(data)
+}
+
 // 将类型映射为 Kind 的辅助函数
 func toKind(data Serializable) Kind {
 	switch data.(type) {
@@ -288,6 +456,14 @@ func toKind(data Serializable) Kind {
 		return Number
 	case *types.Collection:
 		return Collection
+	case *types.Stream:
+		return Stream
+	case *types.HLL:
+		return HLL
+	case *types.Queue:
+		return Queue
+	case *types.Series:
+		return Series
 	}
 	return Unknown
 }
@@ -334,6 +510,30 @@ func (s *Segment) ToJSON() ([]byte, error) {
 			return nil, err
 		}
 		return collection.ToJSON()
+	case Stream:
+		stream, err := s.ToStream()
+		if err != nil {
+			return nil, err
+		}
+		return stream.ToJSON()
+	case HLL:
+		hll, err := s.ToHLL()
+		if err != nil {
+			return nil, err
+		}
+		return hll.ToJSON()
+	case Queue:
+		queue, err := s.ToQueue()
+		if err != nil {
+			return nil, err
+		}
+		return queue.ToJSON()
+	case Series:
+		series, err := s.ToSeries()
+		if err != nil {
+			return nil, err
+		}
+		return series.ToJSON()
 	}
 
 	return nil, errors.New("unknown data type")
@@ -65,7 +65,7 @@ func TestSegmentSize(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Ensure the size is calculated correctly
-	assert.Equal(t, uint32(53), segment.Size())
+	assert.Equal(t, uint32(61), segment.Size())
 }
 
 func TestToSet(t *testing.T) {
@@ -146,7 +146,7 @@ func TestToText(t *testing.T) {
 func TestToList(t *testing.T) {
 	// 创建 List 数据
 	listData := types.Collection{
-		Collection: []any{"item1", "item2", int8(123)},
+		Collection: []any{"item1", "item2", int64(123)},
 	}
 
 	segment, err := NewSegment("test-key-01", &listData, 0)
@@ -165,7 +165,7 @@ func TestToTable(t *testing.T) {
 	tablesData := types.Table{
 		Table: map[string]interface{}{
 			"key1": "value1",
-			"key2": int8(42),
+			"key2": int64(42),
 		},
 	}
 
@@ -179,3 +179,83 @@ func TestToTable(t *testing.T) {
 
 	assert.Equal(t, tablesData.Table, result.Table)
 }
+
+// TestToStream 测试 ToStream 方法
+func TestToStream(t *testing.T) {
+	stream := types.NewStream()
+	id := stream.Append(map[string]any{"event": "login"})
+	assert.NoError(t, stream.SetOffset("billing", id))
+
+	segment, err := NewSegment("test-key-01", stream, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "stream", segment.GetTypeString())
+
+	result, err := segment.ToStream()
+	assert.NoError(t, err)
+	assert.Equal(t, stream.Entries, result.Entries)
+	assert.Equal(t, id, result.Groups["billing"])
+}
+
+// TestToHLL 测试 ToHLL 方法
+func TestToHLL(t *testing.T) {
+	hll := types.NewHLL()
+	hll.Add("user-01")
+	hll.Add("user-02")
+
+	segment, err := NewSegment("test-key-01", hll, 0)
+	assert.NoError(t, err)
+
+	result, err := segment.ToHLL()
+	assert.NoError(t, err)
+	assert.Equal(t, hll.Count(), result.Count())
+}
+
+func TestCollectionSize(t *testing.T) {
+	defer codecs.Store(nil)
+
+	collection := types.NewCollection()
+	collection.Collection = []any{1, "a", map[string]any{"b": true}}
+
+	for _, codec := range []Codec{MsgPack, CBOR} {
+		codecs.Store(&CodecPolicy{Default: codec})
+		seg, err := NewSegment("list", collection, 0)
+		assert.NoError(t, err)
+		size, err := seg.CollectionSize()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, size, codec.String())
+	}
+
+	seg, err := NewSegment("empty", types.NewCollection(), 0)
+	assert.NoError(t, err)
+	size, err := seg.CollectionSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	seg, err = NewSegment("text", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	_, err = seg.CollectionSize()
+	assert.Error(t, err)
+}
+
+func TestSegmentIntSet(t *testing.T) {
+	set := types.NewSet()
+	set.Add("42")
+	set.Add("-7")
+
+	seg, err := NewSegment("ids", set, 0)
+	assert.NoError(t, err)
+	assert.True(t, seg.IsIntSet())
+
+	decoded, err := seg.ToSet()
+	assert.NoError(t, err)
+	assert.Equal(t, set.Set, decoded.Set)
+
+	set.Add("alice")
+	seg, err = NewSegment("ids", set, 0)
+	assert.NoError(t, err)
+	assert.False(t, seg.IsIntSet())
+
+	decoded, err = seg.ToSet()
+	assert.NoError(t, err)
+	assert.Equal(t, set.Set, decoded.Set)
+}
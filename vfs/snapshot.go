@@ -0,0 +1,273 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ErrSnapshotReleased is returned when a Snapshot is used after Release.
+var ErrSnapshotReleased = errors.New("snapshot has been released")
+
+// Snapshot is a frozen view of the file system at the moment LogStructuredFS.Snapshot was called.
+// Reads and iteration through it see every key as it was then, writes made afterwards are not visible.
+// The regions it references are pinned, compaction skips them until Release is called.
+type Snapshot struct {
+	lfs *LogStructuredFS
+	lsn uint64
+	at  uint64
+	// regions 是升序排列的固定的 region，active 是创建时的活跃 region，end 是其中已经写入的长度
+	regions  []uint64
+	active   uint64
+	end      uint64
+	index    map[uint64]Inode
+	released atomic.Bool
+}
+
+// snapshotPins 记录每个 region 被多少个 Snapshot 固定，被固定的 region 不会被回收删除
+type snapshotPins struct {
+	mu      sync.Mutex
+	regions map[uint64]int
+}
+
+func (p *snapshotPins) pin(ids []uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.regions == nil {
+		p.regions = make(map[uint64]int)
+	}
+	for _, id := range ids {
+		p.regions[id]++
+	}
+}
+
+func (p *snapshotPins) unpin(ids []uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		p.regions[id]--
+		if p.regions[id] <= 0 {
+			delete(p.regions, id)
+		}
+	}
+}
+
+func (p *snapshotPins) pinned(id uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.regions[id] > 0
+}
+
+// Snapshot pins the current regions and copies the index, then returns a view unaffected by later writes.
+// Writes are blocked while the index is copied. The caller must Release the snapshot once it is done,
+// the pinned regions cannot be reclaimed until then.
+func (lfs *LogStructuredFS) Snapshot() *Snapshot {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	// 写入、删除和回收迁移都持有 lfs.mu 写锁，持有读锁时索引、LSN 和 region 列表是一致的
+	snap := &Snapshot{
+		lfs:     lfs,
+		lsn:     lfs.lsn,
+		at:      uint64(time.Now().UnixNano()),
+		regions: make([]uint64, 0, len(lfs.regions)+len(lfs.remote)),
+		active:  lfs.regionID,
+		end:     lfs.offset,
+	}
+	for id := range lfs.regions {
+		snap.regions = append(snap.regions, id)
+	}
+	for id := range lfs.remote {
+		snap.regions = append(snap.regions, id)
+	}
+	sort.Slice(snap.regions, func(i, j int) bool {
+		return snap.regions[i] < snap.regions[j]
+	})
+	lfs.pins.pin(snap.regions)
+
+	size := 0
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		size += imap.size()
+		imap.mu.RUnlock()
+	}
+	snap.index = make(map[uint64]Inode, size)
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		imap.rangeInodes(func(inum uint64, inode *Inode) bool {
+			expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+			if expiredAt != 0 && expiredAt <= snap.at {
+				return true
+			}
+			snap.index[inum] = Inode{
+				RegionID:  atomic.LoadUint64(&inode.RegionID),
+				Position:  atomic.LoadUint64(&inode.Position),
+				Length:    atomic.LoadUint32(&inode.Length),
+				ExpiredAt: expiredAt,
+				CreatedAt: atomic.LoadUint64(&inode.CreatedAt),
+				mvcc:      atomic.LoadUint64(&inode.mvcc),
+			}
+			return true
+		})
+		imap.mu.RUnlock()
+	}
+
+	return snap
+}
+
+// LSN returns the log sequence number of the last write visible in the snapshot.
+func (s *Snapshot) LSN() uint64 {
+	return s.lsn
+}
+
+// Len returns the number of live keys in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.index)
+}
+
+// Fetch reads the Segment key had when the snapshot was taken and its multi-version concurrency ID.
+// The caller returns the Segment with ReleaseToPool once it is no longer used.
+func (s *Snapshot) Fetch(ctx context.Context, key string) (uint64, *Segment, error) {
+	if s.released.Load() {
+		return 0, nil, ErrSnapshotReleased
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	inum := s.lfs.inodeNum(key)
+	inode, ok := s.index[inum]
+	if !ok {
+		return 0, nil, &inodeNotFound{inum, "not found in snapshot"}
+	}
+
+	fd, release, err := s.lfs.openRegion(ctx, inode.RegionID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if fd == nil {
+		return 0, nil, fmt.Errorf("data region with ID %d of snapshot not found", inode.RegionID)
+	}
+	_, seg, err := readSegment(fd, inode.Position, SEGMENT_PADDING)
+	release()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read segment: %w", err)
+	}
+	if s.lfs.fingerprints != nil && string(seg.Key) != key {
+		return 0, nil, &inodeNotFound{inum, "not found in snapshot"}
+	}
+
+	segmentCounter.Acquire(seg)
+	return inode.mvcc, seg, nil
+}
+
+// Range calls fn for every live Segment of the snapshot in region order, iteration stops when fn returns false.
+// Regions in object storage are downloaded to the local cache first.
+func (s *Snapshot) Range(ctx context.Context, fn func(seg *Segment) bool) error {
+	for _, id := range s.regions {
+		if s.released.Load() {
+			return ErrSnapshotReleased
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fd, release, err := s.lfs.openRegion(ctx, id)
+		if err != nil {
+			return err
+		}
+		if fd == nil {
+			return fmt.Errorf("data region with ID %d of snapshot not found", id)
+		}
+
+		more, err := s.rangeRegion(id, fd, fn)
+		release()
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeRegion 遍历 region 中被快照索引引用的记录，活跃的 region 只读取到创建快照时的位置
+func (s *Snapshot) rangeRegion(id uint64, fd *os.File, fn func(seg *Segment) bool) (bool, error) {
+	end := s.end
+	if id != s.active {
+		finfo, err := fd.Stat()
+		if err != nil {
+			return false, err
+		}
+		end = uint64(finfo.Size())
+	}
+
+	reader := newRegionReader(fd, int64(end))
+	offset := uint64(len(regionMetadata))
+	for offset < end {
+		inum, seg, err := reader.readSegment(offset)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse data file segment: %w", err)
+		}
+
+		inode, ok := s.index[s.lfs.recordInum(inum, seg)]
+		alive := ok && !seg.IsTombstone() && inode.RegionID == id && inode.Position == offset
+		offset += uint64(seg.Size())
+		if !alive {
+			continue
+		}
+
+		if !fn(seg) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Export writes every live Segment of the snapshot to w, the output is read by LogStructuredFS.Restore.
+func (s *Snapshot) Export(ctx context.Context, w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	enc := msgpack.NewEncoder(buf)
+
+	var inner error
+	err := s.Range(ctx, func(seg *Segment) bool {
+		inner = enc.Encode(seg)
+		return inner == nil
+	})
+	if err != nil {
+		return err
+	}
+	if inner != nil {
+		return fmt.Errorf("failed to encode snapshot segment: %w", inner)
+	}
+
+	return buf.Flush()
+}
+
+// Release unpins the regions of the snapshot, it can be called more than once.
+func (s *Snapshot) Release() {
+	if s.released.CompareAndSwap(false, true) {
+		s.lfs.pins.unpin(s.regions)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotText 通过快照读取 key 的文本内容，不存在时返回空字符串
+func snapshotText(t *testing.T, snap *Snapshot, key string) string {
+	_, seg, err := snap.Fetch(context.Background(), key)
+	if err != nil {
+		return ""
+	}
+	defer seg.ReleaseToPool()
+	text, err := seg.ToText()
+	require.NoError(t, err)
+	return text.Content
+}
+
+func putText(t *testing.T, fss *LogStructuredFS, key, content string) {
+	seg, err := NewSegment(key, types.NewText(content), 0)
+	require.NoError(t, err)
+	require.NoError(t, fss.PutSegment(key, seg))
+}
+
+func TestSnapshot_FrozenView(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	putText(t, fss, "a", "a1")
+	putText(t, fss, "b", "b1")
+	putText(t, fss, "gone", "x")
+	require.NoError(t, fss.DeleteSegment("gone"))
+
+	snap := fss.Snapshot()
+	defer snap.Release()
+	assert.Equal(t, fss.LSN(), snap.LSN())
+	assert.Equal(t, 2, snap.Len())
+
+	// 创建快照之后的写入、删除和 CAS 更新都不可见
+	putText(t, fss, "a", "a2")
+	require.NoError(t, fss.DeleteSegment("b"))
+	putText(t, fss, "c", "c1")
+	version, _, err := fss.FetchSegment("a")
+	require.NoError(t, err)
+	seg, err := NewSegment("a", types.NewText("a3"), 0)
+	require.NoError(t, err)
+	require.NoError(t, fss.UpdateSegmentWithCAS("a", version, seg))
+	require.NoError(t, fss.RolloverRegion())
+
+	assert.Equal(t, "a1", snapshotText(t, snap, "a"))
+	assert.Equal(t, "b1", snapshotText(t, snap, "b"))
+	assert.Empty(t, snapshotText(t, snap, "c"))
+	assert.Empty(t, snapshotText(t, snap, "gone"))
+	assert.Equal(t, "a3", fetchText(fss, "a"))
+	assert.Empty(t, fetchText(fss, "b"))
+
+	keys := map[string]string{}
+	require.NoError(t, snap.Range(context.Background(), func(seg *Segment) bool {
+		text, err := seg.ToText()
+		require.NoError(t, err)
+		keys[seg.GetKeyString()] = text.Content
+		return true
+	}))
+	assert.Equal(t, map[string]string{"a": "a1", "b": "b1"}, keys)
+
+	// 导出的内容恢复到另一个文件系统
+	var buf bytes.Buffer
+	require.NoError(t, snap.Export(context.Background(), &buf))
+	target := openLSNTestFS(t, t.TempDir())
+	defer target.CloseFS()
+	require.NoError(t, target.Restore(&buf))
+	assert.Equal(t, 2, target.KeysCount())
+	assert.Equal(t, "b1", fetchText(target, "b"))
+
+	snap.Release()
+	snap.Release()
+	_, _, err = snap.Fetch(context.Background(), "a")
+	assert.ErrorIs(t, err, ErrSnapshotReleased)
+	assert.ErrorIs(t, snap.Range(context.Background(), func(*Segment) bool { return true }), ErrSnapshotReleased)
+}
+
+func TestSnapshot_PinsRegions(t *testing.T) {
+	fss := openLSNTestFS(t, t.TempDir())
+	defer fss.CloseFS()
+
+	putText(t, fss, "a", "a1")
+	putText(t, fss, "b", "b1")
+	old := fss.regionID
+	require.NoError(t, fss.RolloverRegion())
+
+	snap := fss.Snapshot()
+	putText(t, fss, "a", "a2")
+	putText(t, fss, "b", "b2")
+	require.NoError(t, fss.RolloverRegion())
+
+	// 被快照固定的 region 不会被选中回收
+	n, err := fss.CompactExpiredRegions(0.5)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// 开始回收之后才创建的快照固定的 region 在迁移之后保留
+	_, err = fss.compactRegion(old, fss.regions[old])
+	require.NoError(t, err)
+	_, ok := fss.regions[old]
+	assert.True(t, ok)
+	assert.Equal(t, "a1", snapshotText(t, snap, "a"))
+	assert.Equal(t, "b1", snapshotText(t, snap, "b"))
+	assert.Equal(t, "a2", fetchText(fss, "a"))
+
+	snap.Release()
+	n, err = fss.CompactExpiredRegions(0.5)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, ok = fss.regions[old]
+	assert.False(t, ok)
+	assert.Equal(t, "b2", fetchText(fss, "b"))
+}
+
+func TestSnapshot_PinsRegionsFromCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	// 只有 0 号 region 的目录可以正常打开
+	fd, err := os.Create(filepath.Join(dir, formatDataFileName(0)))
+	require.NoError(t, err)
+	_, err = fd.Write(regionMetadata)
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	fss := openLSNTestFS(t, dir)
+	defer fss.CloseFS()
+	putText(t, fss, "a", "a1")
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, fss.RolloverRegion())
+		putText(t, fss, "b", fmt.Sprintf("b%d", i))
+	}
+	snap := fss.Snapshot()
+	pinned := append([]uint64(nil), snap.regions...)
+
+	putText(t, fss, "a", "a2")
+	require.NoError(t, fss.RolloverRegion())
+	putText(t, fss, "c", "c1")
+	unpinned := fss.regionID
+	require.NoError(t, fss.RolloverRegion())
+
+	// 回收跳过快照固定的 region 和活跃的 region
+	require.NoError(t, fss.CompactRegions())
+	_, ok := fss.regions[unpinned]
+	assert.False(t, ok)
+	for _, id := range pinned {
+		_, ok := fss.regions[id]
+		assert.True(t, ok, id)
+	}
+	_, ok = fss.regions[fss.regionID]
+	assert.True(t, ok)
+	assert.Equal(t, "a1", snapshotText(t, snap, "a"))
+	assert.Equal(t, "a2", fetchText(fss, "a"))
+	assert.Equal(t, "c1", fetchText(fss, "c"))
+
+	// 释放之后最旧的 region 可以回收
+	snap.Release()
+	require.NoError(t, fss.CompactRegions())
+	_, ok = fss.regions[pinned[0]]
+	assert.False(t, ok)
+	assert.Equal(t, "a2", fetchText(fss, "a"))
+	assert.Equal(t, "b3", fetchText(fss, "b"))
+}
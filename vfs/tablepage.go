@@ -0,0 +1,174 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// TablePage is a slice of the entries of a table ordered by field name.
+type TablePage struct {
+	Entries map[string]any
+	// Total is the number of entries matching the selected fields
+	Total int
+	// More reports whether entries exist after the page
+	More bool
+}
+
+// tableEntry 记录字段的值在 msgpack 数据中的位置，只有分页选中的值才会被解码
+type tableEntry struct {
+	field      string
+	start, end int
+}
+
+// ToTablePage returns limit entries of a table starting at offset in field name order. When fields
+// is not empty only those fields are returned. Values written with MsgPack are decoded lazily, the
+// values outside the page are skipped without being decoded.
+func (s *Segment) ToTablePage(offset, limit int, fields []string) (*TablePage, error) {
+	if s.Type != Table {
+		return nil, fmt.Errorf("not support conversion to table type")
+	}
+	if offset < 0 || limit <= 0 {
+		return nil, fmt.Errorf("invalid table page offset %d limit %d", offset, limit)
+	}
+
+	var selected map[string]struct{}
+	if len(fields) > 0 {
+		selected = make(map[string]struct{}, len(fields))
+		for _, field := range fields {
+			selected[field] = struct{}{}
+		}
+	}
+
+	if s.Codec != MsgPack {
+		return s.decodeTablePage(offset, limit, selected)
+	}
+
+	entries, err := s.scanTable(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].field < entries[j].field
+	})
+
+	page := &TablePage{Entries: make(map[string]any), Total: len(entries)}
+	if offset >= len(entries) {
+		return page, nil
+	}
+	entries = entries[offset:]
+	if len(entries) > limit {
+		entries, page.More = entries[:limit], true
+	}
+
+	for _, e := range entries {
+		var value any
+		err := msgpackUnmarshal(s.Value[e.start:e.end], &value)
+		if err != nil {
+			return nil, err
+		}
+		page.Entries[e.field] = value
+	}
+
+	return page, nil
+}
+
+// scanTable 只解码 msgpack map 的字段名，值使用 Skip 跳过并记录下位置
+func (s *Segment) scanTable(selected map[string]struct{}) ([]tableEntry, error) {
+	// bytes.Reader 实现了 io.ByteScanner，解码器不会额外缓冲，读取的位置就是数据的偏移量
+	reader := bytes.NewReader(s.Value)
+	dec := msgpack.NewDecoder(reader)
+
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	size := n
+	if selected != nil && len(selected) < size {
+		size = len(selected)
+	}
+	entries := make([]tableEntry, 0, size)
+
+	for i := 0; i < n; i++ {
+		field, err := dec.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+
+		start := len(s.Value) - reader.Len()
+		err = dec.Skip()
+		if err != nil {
+			return nil, err
+		}
+
+		if selected != nil {
+			if _, ok := selected[field]; !ok {
+				continue
+			}
+		}
+
+		entries = append(entries, tableEntry{
+			field: field,
+			start: start,
+			end:   len(s.Value) - reader.Len(),
+		})
+	}
+
+	return entries, nil
+}
+
+// decodeTablePage 其他编解码器写入的值需要整体解码之后再分页
+func (s *Segment) decodeTablePage(offset, limit int, selected map[string]struct{}) (*TablePage, error) {
+	var table map[string]any
+	err := s.unmarshal(&table)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(table))
+	for field := range table {
+		if selected != nil {
+			if _, ok := selected[field]; !ok {
+				continue
+			}
+		}
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	page := &TablePage{Entries: make(map[string]any), Total: len(names)}
+	if offset >= len(names) {
+		return page, nil
+	}
+	names = names[offset:]
+	if len(names) > limit {
+		names, page.More = names[:limit], true
+	}
+
+	for _, field := range names {
+		page.Entries[field] = table[field]
+	}
+
+	return page, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToTablePage(t *testing.T) {
+	defer codecs.Store(nil)
+
+	table := types.NewTable()
+	for i := 0; i < 10; i++ {
+		table.AddItem(fmt.Sprintf("f%02d", i), map[string]any{"n": int8(i), "tags": []any{"a"}})
+	}
+
+	for _, codec := range []Codec{MsgPack, CBOR} {
+		codecs.Store(&CodecPolicy{Default: codec})
+		seg, err := NewSegment("big", table, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, codec, seg.Codec)
+
+		page, err := seg.ToTablePage(3, 4, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, page.Total)
+		assert.True(t, page.More)
+		assert.Len(t, page.Entries, 4)
+		for _, field := range []string{"f03", "f04", "f05", "f06"} {
+			assert.Contains(t, page.Entries, field, codec.String())
+		}
+		assert.Equal(t, []any{"a"}, page.Entries["f03"].(map[string]any)["tags"])
+
+		page, err = seg.ToTablePage(8, 4, nil)
+		assert.NoError(t, err)
+		assert.False(t, page.More)
+		assert.Len(t, page.Entries, 2)
+
+		page, err = seg.ToTablePage(0, 10, []string{"f09", "f01", "missing"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, page.Total)
+		assert.Len(t, page.Entries, 2)
+		assert.Contains(t, page.Entries, "f01")
+		assert.Contains(t, page.Entries, "f09")
+
+		page, err = seg.ToTablePage(20, 10, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, page.Entries)
+		assert.Equal(t, 10, page.Total)
+
+		_, err = seg.ToTablePage(0, 0, nil)
+		assert.Error(t, err)
+	}
+
+	seg, err := NewSegment("text", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	_, err = seg.ToTablePage(0, 10, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySamples 是一个调整周期内最多保留的前台请求延迟样本数
+	latencySamples = 4096
+	// throttleAdjustInterval 是根据前台 p99 延迟调整回收速率的周期
+	throttleAdjustInterval = time.Second
+	// throttleMinFactor 是退避之后的最低速率相对于配置速率的比例
+	throttleMinFactor = 16
+)
+
+// latencyWindow 记录一个调整周期内前台读写请求的延迟，回收任务自己的读写不计入
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	w.mu.Lock()
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, d)
+	}
+	w.mu.Unlock()
+}
+
+// drain 返回周期内的 p99 延迟并且清空样本，没有样本时返回 false
+func (w *latencyWindow) drain() (time.Duration, bool) {
+	w.mu.Lock()
+	samples := w.samples
+	w.samples = make([]time.Duration, 0, len(samples))
+	w.mu.Unlock()
+
+	if len(samples) == 0 {
+		return 0, false
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	return samples[(len(samples)*99)/100], true
+}
+
+// compactThrottle 是限制回收任务读写速率的令牌桶，设置了目标延迟时，
+// 前台请求的 p99 延迟超过目标之后速率减半，恢复之后逐步回到配置的速率
+type compactThrottle struct {
+	mu       sync.Mutex
+	budget   float64 // 配置的速率（字节/秒）
+	target   time.Duration
+	rate     float64 // 当前的速率（字节/秒）
+	tokens   float64
+	last     time.Time
+	adjusted time.Time
+	latency  latencyWindow
+}
+
+func newCompactThrottle(mbps uint32, target time.Duration) *compactThrottle {
+	budget := float64(mbps) * MB
+	now := time.Now()
+	return &compactThrottle{
+		budget:   budget,
+		target:   target,
+		rate:     budget,
+		tokens:   budget,
+		last:     now,
+		adjusted: now,
+	}
+}
+
+// wait 消耗 n 字节的令牌，令牌不足时阻塞到令牌足够为止
+func (t *compactThrottle) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	t.adjust(now)
+
+	// 桶的容量是 1 秒的速率，单次读写超过容量时透支，之后等待补齐
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	t.tokens -= float64(n)
+
+	var delay time.Duration
+	if t.tokens < 0 {
+		delay = time.Duration(-t.tokens / t.rate * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// adjust 每个周期根据前台请求的 p99 延迟调整速率，调用者必须持有 t.mu
+func (t *compactThrottle) adjust(now time.Time) {
+	elapsed := now.Sub(t.adjusted)
+	if t.target <= 0 || elapsed < throttleAdjustInterval {
+		return
+	}
+	t.adjusted = now
+
+	p99, ok := t.latency.drain()
+	// 两次回收之间积累的样本已经过时，丢弃之后下一个周期重新统计
+	if elapsed > 2*throttleAdjustInterval {
+		return
+	}
+	if ok && p99 > t.target {
+		rate := t.rate / 2
+		if min := t.budget / throttleMinFactor; rate < min {
+			rate = min
+		}
+		if rate < t.rate {
+			compactLog.Infof("foreground p99 latency %v exceeds %v, compaction backs off to %.2f MB/s", p99, t.target, rate/MB)
+		}
+		t.rate = rate
+		return
+	}
+
+	// 没有前台请求或者延迟恢复之后每个周期增加配置速率的 1/4
+	if t.rate < t.budget {
+		t.rate += t.budget / 4
+		if t.rate > t.budget {
+			t.rate = t.budget
+		}
+	}
+}
+
+// SetCompactThrottle limits the region compaction reads and writes to mbps MB/s, 0 removes the limit.
+// When latency is positive, compaction backs off while the foreground p99 latency is above it.
+func (lfs *LogStructuredFS) SetCompactThrottle(mbps uint32, latency time.Duration) {
+	if mbps == 0 {
+		lfs.throttle.Store(nil)
+		return
+	}
+	lfs.throttle.Store(newCompactThrottle(mbps, latency))
+}
+
+// throttleCompaction 按照限速消耗回收任务读写的 n 字节
+func (lfs *LogStructuredFS) throttleCompaction(n int) {
+	if t := lfs.throttle.Load(); t != nil {
+		t.wait(n)
+	}
+}
+
+// observeLatency 记录从 start 开始的前台请求延迟，只有设置了目标延迟时才记录
+func (lfs *LogStructuredFS) observeLatency(start time.Time) {
+	if t := lfs.throttle.Load(); t != nil && t.target > 0 {
+		t.latency.observe(time.Since(start))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactThrottleWait(t *testing.T) {
+	th := newCompactThrottle(1, 0)
+
+	// 桶中有 1 秒的令牌，第一次读写不等待
+	start := time.Now()
+	th.wait(MB)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	start = time.Now()
+	th.wait(MB / 4)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestCompactThrottleBackoff(t *testing.T) {
+	th := newCompactThrottle(16, 10*time.Millisecond)
+	budget := th.budget
+
+	slow := func() {
+		for i := 0; i < 100; i++ {
+			th.latency.observe(50 * time.Millisecond)
+		}
+	}
+
+	// p99 超过目标之后速率减半，最低是配置速率的 1/16
+	for i := 0; i < 6; i++ {
+		slow()
+		th.adjusted = time.Now().Add(-throttleAdjustInterval)
+		th.adjust(time.Now())
+	}
+	assert.Equal(t, budget/throttleMinFactor, th.rate)
+
+	// 延迟恢复之后逐步回到配置的速率
+	for i := 0; i < 5; i++ {
+		th.latency.observe(time.Millisecond)
+		th.adjusted = time.Now().Add(-throttleAdjustInterval)
+		th.adjust(time.Now())
+	}
+	assert.Equal(t, budget, th.rate)
+
+	// 两次回收之间积累的样本不参与调整
+	slow()
+	th.adjusted = time.Now().Add(-time.Hour)
+	th.adjust(time.Now())
+	assert.Equal(t, budget, th.rate)
+	_, ok := th.latency.drain()
+	assert.False(t, ok)
+}
+
+func TestSetCompactThrottle(t *testing.T) {
+	lfs := &LogStructuredFS{}
+
+	lfs.observeLatency(time.Now())
+	lfs.throttleCompaction(MB)
+
+	lfs.SetCompactThrottle(8, time.Millisecond)
+	assert.NotNil(t, lfs.throttle.Load())
+	lfs.observeLatency(time.Now().Add(-time.Second))
+	p99, ok := lfs.throttle.Load().latency.drain()
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, p99, time.Second)
+
+	lfs.SetCompactThrottle(0, 0)
+	assert.Nil(t, lfs.throttle.Load())
+}
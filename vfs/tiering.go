@@ -0,0 +1,775 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ObjectStore is the remote storage cold regions are uploaded to, e.g. an S3 bucket.
+type ObjectStore interface {
+	Upload(ctx context.Context, name string, r io.Reader, size int64) error
+	Download(ctx context.Context, name string) (io.ReadCloser, error)
+	Remove(ctx context.Context, name string) error
+}
+
+// TieringOptions configures uploading cold sealed regions to an ObjectStore.
+type TieringOptions struct {
+	Store ObjectStore
+	// After is how long a sealed region must stay unmodified before it is uploaded
+	After time.Duration
+	// CacheDir keeps the regions downloaded on read, it defaults to the cache directory under the data path
+	CacheDir string
+	// CacheRegions is the maximum number of downloaded regions kept in CacheDir
+	CacheRegions int
+}
+
+// TieringStats reports where the regions of the file system are stored.
+type TieringStats struct {
+	LocalRegions  int   `json:"local_regions"`
+	RemoteRegions int   `json:"remote_regions"`
+	RemoteBytes   int64 `json:"remote_bytes"`
+	CachedRegions int   `json:"cached_regions"`
+}
+
+// ErrTieringDisabled is returned when a region in object storage is read without SetTiering.
+var ErrTieringDisabled = errors.New("region tiering is not enabled")
+
+// ErrTieringRunning is returned when cold regions are already being uploaded.
+var ErrTieringRunning = errors.New("region tiering is already running")
+
+const (
+	remoteExtension     = ".remote"
+	defaultCacheRegions = 4
+	// 上传之后本地 region 的文件句柄延迟关闭，等待已经查到这个 region 的读请求完成
+	retireGrace = time.Minute
+)
+
+// remoteRegion 是已经上传到对象存储的 region 在本地保留的存根，Index 是 region 中每个 key 的最终状态，
+// 恢复索引和重建有序索引时不需要下载整个 region
+type remoteRegion struct {
+	ID       uint64        `msgpack:"id"`
+	Object   string        `msgpack:"object"`
+	Size     int64         `msgpack:"size"`
+	Checksum uint32        `msgpack:"checksum"`
+	TieredAt int64         `msgpack:"tiered_at"`
+	Index    []remoteInode `msgpack:"index"`
+}
+
+type remoteInode struct {
+	Key       string `msgpack:"key"`
+	Position  uint64 `msgpack:"position"`
+	Length    uint32 `msgpack:"length"`
+	CreatedAt uint64 `msgpack:"created_at"`
+	ExpiredAt uint64 `msgpack:"expired_at"`
+	LSN       uint64 `msgpack:"lsn"`
+	Deleted   bool   `msgpack:"deleted,omitempty"`
+}
+
+type tiering struct {
+	opt     TieringOptions
+	cache   *regionCache
+	running bool
+	worker  *time.Ticker
+}
+
+// SetTiering enables reading the regions in opt.Store and uploading cold regions with
+// TierRegions or RunTiering. Regions uploaded before cannot be read until it is called.
+func (lfs *LogStructuredFS) SetTiering(opt TieringOptions) error {
+	if opt.Store == nil {
+		return errors.New("tiering object store cannot be nil")
+	}
+	if opt.CacheDir == "" {
+		opt.CacheDir = filepath.Join(lfs.directory, "cache")
+	}
+	if opt.CacheRegions <= 0 {
+		opt.CacheRegions = defaultCacheRegions
+	}
+
+	cache, err := newRegionCache(opt.CacheDir, opt.CacheRegions, opt.Store)
+	if err != nil {
+		return fmt.Errorf("failed to open region cache: %w", err)
+	}
+
+	lfs.mu.Lock()
+	lfs.tier = &tiering{opt: opt, cache: cache}
+	lfs.mu.Unlock()
+	return nil
+}
+
+// RunTiering uploads cold regions every interval until StopTiering is called.
+func (lfs *LogStructuredFS) RunTiering(interval time.Duration) {
+	lfs.mu.Lock()
+	if lfs.tier == nil || lfs.tier.worker != nil {
+		lfs.mu.Unlock()
+		return
+	}
+	worker := time.NewTicker(interval)
+	lfs.tier.worker = worker
+	lfs.mu.Unlock()
+
+	go func() {
+		for range worker.C {
+			n, err := lfs.TierRegions(context.Background())
+			if err != nil && !errors.Is(err, ErrTieringRunning) && !errors.Is(err, ErrCompactRunning) {
+				vlog.Errorf("failed to tier cold regions: %v", err)
+				continue
+			}
+			if n > 0 {
+				vlog.Infof("uploaded %d cold regions to object storage", n)
+			}
+		}
+	}()
+}
+
+// StopTiering stops the background worker started by RunTiering.
+func (lfs *LogStructuredFS) StopTiering() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.tier != nil && lfs.tier.worker != nil {
+		lfs.tier.worker.Stop()
+		lfs.tier.worker = nil
+	}
+}
+
+// TierRegions uploads the sealed regions unmodified for TieringOptions.After to object storage
+// and keeps a local stub of each, then removes the oldest uploaded regions without live keys.
+// It returns the number of uploaded regions, it cannot run together with a region compaction.
+func (lfs *LogStructuredFS) TierRegions(ctx context.Context) (n int, err error) {
+	lfs.mu.Lock()
+	tier := lfs.tier
+	switch {
+	case tier == nil:
+		lfs.mu.Unlock()
+		return 0, ErrTieringDisabled
+	case lfs.gcstate == GC_ACTIVE:
+		lfs.mu.Unlock()
+		return 0, ErrCompactRunning
+	case tier.running:
+		lfs.mu.Unlock()
+		return 0, ErrTieringRunning
+	}
+	tier.running = true
+
+	// 活跃的 region 还在写入，不能上传
+	deadline := time.Now().Add(-tier.opt.After)
+	var cold []uint64
+	for id, fd := range lfs.regions {
+		if id == lfs.regionID {
+			continue
+		}
+		finfo, err := fd.Stat()
+		if err == nil && finfo.ModTime().Before(deadline) {
+			cold = append(cold, id)
+		}
+	}
+	lfs.mu.Unlock()
+
+	defer func() {
+		lfs.mu.Lock()
+		tier.running = false
+		lfs.mu.Unlock()
+	}()
+
+	ctx, span := tracer.Start(ctx, "vfs.TierRegions", trace.WithAttributes(
+		attribute.Int("urnadb.regions", len(cold)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	sort.Slice(cold, func(i, j int) bool {
+		return cold[i] < cold[j]
+	})
+
+	for _, id := range cold {
+		err := lfs.tierRegion(ctx, tier, id)
+		if err != nil {
+			return n, fmt.Errorf("failed to tier region %d: %w", id, err)
+		}
+		n++
+	}
+
+	return n, lfs.dropRemoteRegions(ctx, tier)
+}
+
+// tierRegion 上传一个 region 并且写入本地存根之后才删除本地文件，中途失败时本地文件仍然有效
+func (lfs *LogStructuredFS) tierRegion(ctx context.Context, tier *tiering, id uint64) error {
+	lfs.mu.RLock()
+	fd, ok := lfs.regions[id]
+	lfs.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	region, err := buildRemoteRegion(id, fd, lfs.fingerprints)
+	if err != nil {
+		return err
+	}
+
+	err = tier.opt.Store.Upload(ctx, region.Object, io.NewSectionReader(fd, 0, region.Size), region.Size)
+	if err != nil {
+		return fmt.Errorf("failed to upload region: %w", err)
+	}
+
+	err = writeRemoteRegion(lfs.directory, region)
+	if err != nil {
+		return fmt.Errorf("failed to write remote region stub: %w", err)
+	}
+
+	lfs.mu.Lock()
+	delete(lfs.regions, id)
+	lfs.remote[id] = region
+	lfs.mu.Unlock()
+
+	time.AfterFunc(retireGrace, func() {
+		forgetRegion(fd)
+		_ = fd.Close()
+	})
+
+	return os.Remove(filepath.Join(lfs.directory, formatDataFileName(id)))
+}
+
+// dropRemoteRegions 从最旧的 region 开始删除已经没有存活 key 的远程 region，
+// 只删除最旧的是因为其中的删除记录在全量扫描恢复时还会遮盖更旧的 region 中的数据
+func (lfs *LogStructuredFS) dropRemoteRegions(ctx context.Context, tier *tiering) error {
+	live := make(map[uint64]bool)
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		imap.rangeInodes(func(_ uint64, inode *Inode) bool {
+			live[atomic.LoadUint64(&inode.RegionID)] = true
+			return true
+		})
+		imap.mu.RUnlock()
+	}
+
+	for _, id := range lfs.regionIDs(true) {
+		lfs.mu.RLock()
+		region, ok := lfs.remote[id]
+		lfs.mu.RUnlock()
+		if !ok || live[id] || lfs.pins.pinned(id) {
+			return nil
+		}
+
+		err := lfs.advanceHorizon()
+		if err != nil {
+			return err
+		}
+
+		err = tier.opt.Store.Remove(ctx, region.Object)
+		if err != nil {
+			return fmt.Errorf("failed to remove region %d from object storage: %w", id, err)
+		}
+
+		lfs.mu.Lock()
+		delete(lfs.remote, id)
+		lfs.mu.Unlock()
+		tier.cache.drop(id)
+		lfs.usage.drop(id)
+
+		err = os.Remove(filepath.Join(lfs.directory, remoteFileName(id)))
+		if err != nil {
+			return fmt.Errorf("failed to remove remote region stub: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// scanRemoteRegions 恢复远程 region 的存根，上传之后没有来得及删除的本地文件仍然有效，这时删除存根
+func (lfs *LogStructuredFS) scanRemoteRegions(files []os.DirEntry) error {
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), fileExtension+remoteExtension) {
+			continue
+		}
+
+		path := filepath.Join(lfs.directory, file.Name())
+		region, err := readRemoteRegion(path)
+		if err != nil {
+			return fmt.Errorf("failed to read remote region stub %s: %w", file.Name(), err)
+		}
+
+		if _, ok := lfs.regions[region.ID]; ok {
+			err := os.Remove(path)
+			if err != nil {
+				return fmt.Errorf("failed to remove remote region stub: %w", err)
+			}
+			continue
+		}
+		lfs.remote[region.ID] = region
+	}
+
+	return nil
+}
+
+// regionIDs 返回升序排列的 region ID，remote 为 true 时包含已经上传到对象存储的 region
+func (lfs *LogStructuredFS) regionIDs(remote bool) []uint64 {
+	lfs.mu.RLock()
+	ids := make([]uint64, 0, len(lfs.regions)+len(lfs.remote))
+	for id := range lfs.regions {
+		ids = append(ids, id)
+	}
+	if remote {
+		for id := range lfs.remote {
+			ids = append(ids, id)
+		}
+	}
+	lfs.mu.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// openRegion 返回 region 的文件，对象存储中的 region 先下载到本地缓存，用完之后调用 release。
+// region 不存在时返回的文件为 nil，ctx 结束时不再等待下载完成
+func (lfs *LogStructuredFS) openRegion(ctx context.Context, id uint64) (fd *os.File, release func(), err error) {
+	lfs.mu.RLock()
+	fd, ok := lfs.regions[id]
+	region, remote := lfs.remote[id]
+	tier := lfs.tier
+	lfs.mu.RUnlock()
+
+	if ok {
+		return fd, func() {}, nil
+	}
+	if !remote {
+		return nil, func() {}, nil
+	}
+	if tier == nil {
+		return nil, nil, fmt.Errorf("data region with ID %d is in object storage: %w", id, ErrTieringDisabled)
+	}
+	return tier.cache.acquire(ctx, region)
+}
+
+// rangeRemoteKeys 使用存根中的索引遍历远程 region 中仍然存活的 key
+func (lfs *LogStructuredFS) rangeRemoteKeys(fn func(key string)) {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	now := uint64(time.Now().UnixNano())
+	for id, region := range lfs.remote {
+		for _, entry := range region.Index {
+			if entry.Deleted || (entry.ExpiredAt != 0 && entry.ExpiredAt <= now) {
+				continue
+			}
+
+			inum := lfs.inodeNum(entry.Key)
+			imap := lfs.indexs[inum%uint64(shard)]
+			imap.mu.RLock()
+			inode, ok := imap.lookup(inum)
+			alive := ok && atomic.LoadUint64(&inode.RegionID) == id &&
+				atomic.LoadUint64(&inode.Position) == entry.Position
+			imap.mu.RUnlock()
+
+			if alive {
+				fn(entry.Key)
+			}
+		}
+	}
+}
+
+// TieringStats returns the number of local, remote and cached regions.
+func (lfs *LogStructuredFS) TieringStats() TieringStats {
+	lfs.mu.RLock()
+	stats := TieringStats{
+		LocalRegions:  len(lfs.regions),
+		RemoteRegions: len(lfs.remote),
+	}
+	for _, region := range lfs.remote {
+		stats.RemoteBytes += region.Size
+	}
+	tier := lfs.tier
+	lfs.mu.RUnlock()
+
+	if tier != nil {
+		stats.CachedRegions = tier.cache.len()
+	}
+	return stats
+}
+
+// buildRemoteRegion 计算 region 文件的校验和，并且记录其中每个 key 的最后一条记录
+func buildRemoteRegion(id uint64, fd *os.File, fp *fingerprintTable) (*remoteRegion, error) {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	checksum, err := checksumFile(fd, finfo.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	region := &remoteRegion{
+		ID:       id,
+		Object:   formatDataFileName(id),
+		Size:     finfo.Size(),
+		Checksum: checksum,
+		TieredAt: time.Now().Unix(),
+	}
+
+	last := make(map[uint64]int)
+	reader := newRegionReader(fd, finfo.Size())
+	offset := uint64(len(regionMetadata))
+	for offset < uint64(finfo.Size()) {
+		inum, segment, err := reader.readSegment(offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse data file segment: %w", err)
+		}
+		inum = fp.remap(inum, segment.Key)
+
+		entry := remoteInode{
+			Key:       segment.GetKeyString(),
+			Position:  offset,
+			Length:    segment.Size(),
+			CreatedAt: segment.CreatedAt,
+			ExpiredAt: segment.ExpiredAt,
+			LSN:       segment.LSN,
+			Deleted:   segment.IsTombstone(),
+		}
+		offset += uint64(segment.Size())
+
+		if i, ok := last[inum]; ok {
+			region.Index[i] = entry
+			continue
+		}
+		last[inum] = len(region.Index)
+		region.Index = append(region.Index, entry)
+	}
+
+	return region, nil
+}
+
+// regionIndex 把存根中的索引转换成和扫描 region 文件相同的结果
+func (r *remoteRegion) regionIndex(fp *fingerprintTable) regionIndex {
+	local := make(regionIndex, len(r.Index))
+	now := uint64(time.Now().UnixNano())
+
+	for _, entry := range r.Index {
+		inum := fp.inum(entry.Key)
+		if entry.Deleted {
+			local[inum] = nil
+			continue
+		}
+		if entry.ExpiredAt != 0 && entry.ExpiredAt <= now {
+			continue
+		}
+		local[inum] = &Inode{
+			RegionID:  r.ID,
+			Position:  entry.Position,
+			Length:    entry.Length,
+			CreatedAt: entry.CreatedAt,
+			ExpiredAt: entry.ExpiredAt,
+		}
+	}
+
+	return local
+}
+
+func remoteFileName(id uint64) string {
+	return formatDataFileName(id) + remoteExtension
+}
+
+// writeRemoteRegion 先写入临时文件再重命名，崩溃时不会留下不完整的存根
+func writeRemoteRegion(dir string, region *remoteRegion) error {
+	data, err := msgpack.Marshal(region)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, remoteFileName(region.ID))
+	fd, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(append(append([]byte{}, regionMetadata...), data...))
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	err = utils.FlushToDisk(fd)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".part", path)
+}
+
+func readRemoteRegion(path string) (*remoteRegion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(regionMetadata) || !isDataFile(data[:len(regionMetadata)]) {
+		return nil, errors.New("remote region stub metadata mismatch")
+	}
+
+	// 旧版本的 region 上传之后无法在本地升级
+	version := data[3]
+	if version != currentFormat {
+		if version < currentFormat {
+			return nil, fmt.Errorf("remote region was tiered in format version %d and is no longer supported", version)
+		}
+		return nil, &FormatError{File: filepath.Base(path), Version: version, Supported: currentFormat}
+	}
+
+	var region remoteRegion
+	err = msgpack.Unmarshal(data[len(regionMetadata):], &region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &region, nil
+}
+
+// regionCache 保存从对象存储下载的 region，超过 limit 时淘汰最久没有读取并且没有在使用的 region
+type regionCache struct {
+	dir     string
+	limit   int
+	store   ObjectStore
+	mu      sync.Mutex
+	entries map[uint64]*cachedRegion
+}
+
+type cachedRegion struct {
+	fd    *os.File
+	err   error
+	ready chan struct{}
+	refs  int
+	used  time.Time
+}
+
+func newRegionCache(dir string, limit int, store ObjectStore) (*regionCache, error) {
+	err := os.MkdirAll(dir, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// 上次运行留下的缓存无法确认是否完整，直接清理
+	for _, pattern := range []string{"*" + fileExtension, "*.part"} {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			err := os.Remove(file)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &regionCache{
+		dir:     dir,
+		limit:   limit,
+		store:   store,
+		entries: make(map[uint64]*cachedRegion),
+	}, nil
+}
+
+// acquire 返回 region 的本地缓存，同一个 region 同时只会下载一次。
+// 下载在后台进行并且不受 ctx 影响，ctx 结束时调用者直接返回，其他等待者仍然可以使用下载的结果
+func (c *regionCache) acquire(ctx context.Context, region *remoteRegion) (*os.File, func(), error) {
+	c.mu.Lock()
+	e, ok := c.entries[region.ID]
+	if !ok {
+		e = &cachedRegion{ready: make(chan struct{})}
+		c.entries[region.ID] = e
+	}
+	e.refs++
+	e.used = time.Now()
+	c.mu.Unlock()
+
+	if !ok {
+		go func() {
+			e.fd, e.err = c.download(region)
+			close(e.ready)
+		}()
+	}
+
+	release := func() {
+		c.release(region.ID, e)
+	}
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		// 下载完成之后再释放引用，避免下载中的 region 被淘汰
+		go func() {
+			<-e.ready
+			release()
+		}()
+		return nil, nil, ctx.Err()
+	}
+	if e.err != nil {
+		release()
+		return nil, nil, e.err
+	}
+	return e.fd, release, nil
+}
+
+func (c *regionCache) release(id uint64, e *cachedRegion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.refs--
+	if e.err != nil {
+		// 下载失败的不缓存，下次读取重新下载
+		if c.entries[id] == e {
+			delete(c.entries, id)
+		}
+		return
+	}
+
+	// 已经被删除的 region 等最后一个读取者用完再关闭
+	if c.entries[id] != e {
+		if e.refs == 0 {
+			c.remove(e)
+		}
+		return
+	}
+
+	c.evict()
+}
+
+// evict 淘汰超出数量的缓存，调用时需要持有锁
+func (c *regionCache) evict() {
+	for len(c.entries) > c.limit {
+		var (
+			victim uint64
+			oldest *cachedRegion
+		)
+		for id, e := range c.entries {
+			if e.refs > 0 || e.fd == nil {
+				continue
+			}
+			if oldest == nil || e.used.Before(oldest.used) {
+				victim, oldest = id, e
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(c.entries, victim)
+		c.remove(oldest)
+	}
+}
+
+// drop 删除已经不在对象存储中的 region 的缓存
+func (c *regionCache) drop(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	delete(c.entries, id)
+	if e.refs == 0 && e.fd != nil {
+		c.remove(e)
+	}
+}
+
+func (c *regionCache) remove(e *cachedRegion) {
+	forgetRegion(e.fd)
+	_ = e.fd.Close()
+	err := os.Remove(e.fd.Name())
+	if err != nil {
+		vlog.Warnf("failed to remove cached region: %v", err)
+	}
+}
+
+func (c *regionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// close 关闭所有缓存的文件，缓存的内容在下次启动时清理
+func (c *regionCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, e := range c.entries {
+		if e.fd != nil {
+			forgetRegion(e.fd)
+			_ = e.fd.Close()
+		}
+		delete(c.entries, id)
+	}
+}
+
+// checksumFile 计算文件前 size 字节的 crc32 校验和
+func checksumFile(fd *os.File, size int64) (uint32, error) {
+	hash := crc32.NewIEEE()
+	_, err := io.Copy(hash, io.NewSectionReader(fd, 0, size))
+	if err != nil {
+		return 0, fmt.Errorf("failed to checksum region: %w", err)
+	}
+	return hash.Sum32(), nil
+}
+
+// download 下载完整的 region 并且校验大小和校验和之后才放入缓存
+func (c *regionCache) download(region *remoteRegion) (*os.File, error) {
+	body, err := c.store.Download(context.Background(), region.Object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download region %d: %w", region.ID, err)
+	}
+	defer body.Close()
+
+	path := filepath.Join(c.dir, formatDataFileName(region.ID))
+	fd, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fd, hash), body)
+	if err == nil && (n != region.Size || hash.Sum32() != region.Checksum) {
+		err = fmt.Errorf("region %d downloaded from object storage is corrupted", region.ID)
+	}
+	if err == nil {
+		err = fd.Close()
+	} else {
+		_ = fd.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".part", path)
+	}
+	if err != nil {
+		_ = os.Remove(path + ".part")
+		return nil, err
+	}
+
+	return os.Open(path)
+}
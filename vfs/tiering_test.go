@@ -0,0 +1,228 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStore 是保存在内存中的对象存储
+type memoryStore struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	downloads int
+}
+
+func (m *memoryStore) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.objects[name] = data
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[name]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	m.downloads++
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStore) Remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	delete(m.objects, name)
+	m.mu.Unlock()
+	return nil
+}
+
+func TestTierRegions(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+			Index:     SkipListIndex,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+
+	fss := open()
+	put := func(key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	fetch := func(key string) (string, error) {
+		_, seg, err := fss.FetchSegment(key)
+		if err != nil {
+			return "", err
+		}
+		text, err := seg.ToText()
+		if err != nil {
+			return "", err
+		}
+		return text.Content, nil
+	}
+
+	// region 1 和 region 2 封存之后上传，region 3 是活跃的 region
+	put("a", "hello")
+	put("b", "hello")
+	assert.NoError(t, fss.RolloverRegion())
+	put("c", "world")
+	assert.NoError(t, fss.DeleteSegment("a"))
+	assert.NoError(t, fss.RolloverRegion())
+
+	_, err := fss.TierRegions(context.Background())
+	assert.ErrorIs(t, err, ErrTieringDisabled)
+
+	store := &memoryStore{objects: make(map[string][]byte)}
+	assert.NoError(t, fss.SetTiering(TieringOptions{Store: store, CacheRegions: 1}))
+
+	time.Sleep(10 * time.Millisecond)
+	n, err := fss.TierRegions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, store.objects, 2)
+	assert.NoFileExists(t, filepath.Join(dir, formatDataFileName(1)))
+	assert.FileExists(t, filepath.Join(dir, remoteFileName(1)))
+	stats := fss.TieringStats()
+	assert.Equal(t, 1, stats.LocalRegions)
+	assert.Equal(t, 2, stats.RemoteRegions)
+	assert.Greater(t, stats.RemoteBytes, int64(0))
+
+	// 读取时下载并且缓存远程 region，超过缓存数量时淘汰最旧的
+	content, err := fetch("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", content)
+	_, err = fetch("b")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.downloads)
+
+	content, err = fetch("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "world", content)
+	assert.Equal(t, 1, fss.TieringStats().CachedRegions)
+
+	var keys []string
+	assert.NoError(t, fss.RangeSegments(func(seg *Segment) bool {
+		keys = append(keys, seg.GetKeyString())
+		return true
+	}))
+	assert.Equal(t, []string{"b", "c"}, keys)
+
+	// 没有快照索引时从存根恢复索引，有序索引也不需要下载
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(dir, indexFileName)))
+	fss = open()
+	defer fss.CloseFS()
+
+	keys, err = fss.RangeKeys("", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, keys)
+	_, err = fetch("a")
+	assert.Error(t, err)
+	_, err = fetch("b")
+	assert.ErrorIs(t, err, ErrTieringDisabled)
+
+	store.downloads = 0
+	assert.NoError(t, fss.SetTiering(TieringOptions{Store: store}))
+	content, err = fetch("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", content)
+	assert.Equal(t, 1, store.downloads)
+
+	// 下载的 region 校验失败时不会缓存
+	store.objects[formatDataFileName(2)][len(regionMetadata)] ^= 0xFF
+	_, err = fetch("c")
+	assert.ErrorContains(t, err, "corrupted")
+	store.objects[formatDataFileName(2)][len(regionMetadata)] ^= 0xFF
+
+	// 只删除最旧的、已经没有存活 key 的远程 region
+	put("c", "updated")
+	_, err = fss.TierRegions(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, store.objects, 2)
+
+	put("b", "updated")
+	_, err = fss.TierRegions(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, store.objects)
+	assert.NoFileExists(t, filepath.Join(dir, remoteFileName(1)))
+	assert.NoFileExists(t, filepath.Join(dir, remoteFileName(2)))
+	assert.Equal(t, 0, fss.TieringStats().RemoteRegions)
+
+	content, err = fetch("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "updated", content)
+}
+
+// slowStore 在 gate 关闭之前阻塞下载
+type slowStore struct {
+	*memoryStore
+	gate chan struct{}
+}
+
+func (s *slowStore) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	<-s.gate
+	return s.memoryStore.Download(ctx, name)
+}
+
+func TestRegionCacheContext(t *testing.T) {
+	data := []byte("region data")
+	store := &slowStore{
+		memoryStore: &memoryStore{objects: map[string][]byte{"region": data}},
+		gate:        make(chan struct{}),
+	}
+	cache, err := newRegionCache(t.TempDir(), 1, store)
+	assert.NoError(t, err)
+	defer cache.close()
+
+	region := &remoteRegion{ID: 1, Object: "region", Size: int64(len(data)), Checksum: crc32.ChecksumIEEE(data)}
+
+	// 等待下载的读取在 ctx 超时之后直接返回，下载继续在后台进行
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = cache.acquire(ctx, region)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(store.gate)
+	fd, release, err := cache.acquire(context.Background(), region)
+	assert.NoError(t, err)
+	assert.NotNil(t, fd)
+	release()
+	assert.Equal(t, 1, store.downloads)
+	assert.Equal(t, 1, cache.len())
+}
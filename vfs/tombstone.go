@@ -0,0 +1,73 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// compactionStats 统计墓碑的写入和回收，以及垃圾回收释放的空间
+type compactionStats struct {
+	written        atomic.Uint64
+	retained       atomic.Uint64
+	reclaimed      atomic.Uint64
+	tombstoneBytes atomic.Uint64
+	reclaimedBytes atomic.Uint64
+}
+
+// reclaim 记录垃圾回收丢弃了一个 size 字节的墓碑
+func (s *compactionStats) reclaim(size uint64) {
+	s.reclaimed.Add(1)
+	s.tombstoneBytes.Add(size)
+}
+
+// CompactionStats reports the tombstones and the space handled by region compaction since startup.
+type CompactionStats struct {
+	// TombstonesWritten is the number of tombstones appended by deletes
+	TombstonesWritten uint64 `json:"tombstones_written"`
+	// TombstonesRetained is the number of tombstones kept by the last compaction because they are within the grace period
+	TombstonesRetained uint64 `json:"tombstones_retained"`
+	// TombstonesReclaimed is the number of tombstones dropped by compaction
+	TombstonesReclaimed uint64 `json:"tombstones_reclaimed"`
+	// TombstoneBytesReclaimed is the space of the dropped tombstones
+	TombstoneBytesReclaimed uint64 `json:"tombstone_bytes_reclaimed"`
+	// BytesReclaimed is the space freed by compaction, including stale records and dropped tombstones
+	BytesReclaimed uint64 `json:"bytes_reclaimed"`
+}
+
+// CompactionStats returns the tombstone and reclaimed space counters of region compaction.
+func (lfs *LogStructuredFS) CompactionStats() CompactionStats {
+	return CompactionStats{
+		TombstonesWritten:       lfs.compaction.written.Load(),
+		TombstonesRetained:      lfs.compaction.retained.Load(),
+		TombstonesReclaimed:     lfs.compaction.reclaimed.Load(),
+		TombstoneBytesReclaimed: lfs.compaction.tombstoneBytes.Load(),
+		BytesReclaimed:          lfs.compaction.reclaimedBytes.Load(),
+	}
+}
+
+// SetTombstoneGrace keeps tombstones younger than grace during compaction,
+// so replicas and backups that have not seen the delete yet do not bring the key back.
+// A zero grace drops tombstones at the first compaction.
+func (lfs *LogStructuredFS) SetTombstoneGrace(grace time.Duration) {
+	lfs.tombstoneGrace.Store(int64(grace))
+}
+
+// tombstoneExpired 判断墓碑是否已经超过宽限期，墓碑的 CreatedAt 是删除的时间
+func (lfs *LogStructuredFS) tombstoneExpired(seg *Segment) bool {
+	grace := time.Duration(lfs.tombstoneGrace.Load())
+	return time.Since(time.Unix(0, int64(seg.CreatedAt))) >= grace
+}
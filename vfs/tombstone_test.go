@@ -0,0 +1,78 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstoneGrace(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	put := func(key, content string) {
+		seg, err := NewSegment(key, types.NewText(content), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	rollover := func(n int) {
+		for i := 0; i < n; i++ {
+			assert.NoError(t, fss.RolloverRegion())
+		}
+	}
+
+	put("a", "v1")
+	put("b", "v1")
+	put("c", "v1")
+	assert.NoError(t, fss.DeleteSegment("a"))
+	assert.NoError(t, fss.DeleteSegment("c"))
+	// 删除之后重新写入的 key 不需要保留墓碑
+	put("c", "v2")
+	rollover(4)
+
+	fss.SetTombstoneGrace(time.Hour)
+	assert.NoError(t, fss.CompactRegions())
+
+	stats := fss.CompactionStats()
+	assert.Equal(t, uint64(2), stats.TombstonesWritten)
+	assert.Equal(t, uint64(1), stats.TombstonesRetained)
+	assert.Equal(t, uint64(1), stats.TombstonesReclaimed)
+	assert.Greater(t, stats.BytesReclaimed, stats.TombstoneBytesReclaimed)
+	assert.Equal(t, "", fetchText(fss, "a"))
+	assert.Equal(t, "v1", fetchText(fss, "b"))
+	assert.Equal(t, "v2", fetchText(fss, "c"))
+
+	// 保留的墓碑迁移到了新的 region，超过宽限期之后在下一次回收中丢弃
+	rollover(4)
+	fss.SetTombstoneGrace(0)
+	assert.NoError(t, fss.CompactRegions())
+
+	stats = fss.CompactionStats()
+	assert.Equal(t, uint64(0), stats.TombstonesRetained)
+	assert.Equal(t, uint64(2), stats.TombstonesReclaimed)
+	assert.Equal(t, "", fetchText(fss, "a"))
+	assert.Equal(t, "v1", fetchText(fss, "b"))
+	assert.Equal(t, "v2", fetchText(fss, "c"))
+}
@@ -0,0 +1,199 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// TrashNamespace is the namespace DeleteSegment moves deleted keys into when the trash is enabled.
+const TrashNamespace = "__trash__"
+
+const trashPrefix = TrashNamespace + ":"
+
+// ErrNotInTrash is returned by Undelete when the key is not in the trash or its retention has passed.
+var ErrNotInTrash = errors.New("key is not in the trash")
+
+// ErrKeyExists is returned by Undelete when the key has been written again after it was deleted.
+var ErrKeyExists = errors.New("key already exists")
+
+// trash 开启之后删除的 key 先移动到回收站，CreatedAt 是删除的时间，超过 retention 之后被清理
+type trash struct {
+	retention time.Duration
+	worker    *time.Ticker
+}
+
+// TrashKey returns the key a deleted key is kept under in the trash.
+func TrashKey(key string) string {
+	return trashPrefix + key
+}
+
+// IsTrashKey reports whether key belongs to the trash namespace.
+func IsTrashKey(key string) bool {
+	return strings.HasPrefix(key, trashPrefix)
+}
+
+// SetTrash enables the trash, DeleteSegment keeps a copy of deleted keys for retention.
+// Keys in the trash namespace are always deleted permanently.
+func (lfs *LogStructuredFS) SetTrash(retention time.Duration) error {
+	if retention <= 0 {
+		return errors.New("trash retention must be greater than 0")
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+	if lfs.trash != nil {
+		lfs.trash.retention = retention
+		return nil
+	}
+	lfs.trash = &trash{retention: retention}
+	return nil
+}
+
+// RunTrashPurge runs PurgeTrash every interval until StopTrashPurge is called.
+func (lfs *LogStructuredFS) RunTrashPurge(interval time.Duration) {
+	lfs.mu.Lock()
+	if lfs.trash == nil || lfs.trash.worker != nil {
+		lfs.mu.Unlock()
+		return
+	}
+	worker := time.NewTicker(interval)
+	lfs.trash.worker = worker
+	lfs.mu.Unlock()
+
+	go func() {
+		for range worker.C {
+			n, err := lfs.PurgeTrash()
+			if err != nil {
+				vlog.Errorf("failed to purge trash: %v", err)
+				continue
+			}
+			if n > 0 {
+				vlog.Infof("purged %d keys out of trash retention", n)
+			}
+		}
+	}()
+}
+
+// StopTrashPurge stops the background worker started by RunTrashPurge.
+func (lfs *LogStructuredFS) StopTrashPurge() {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.trash != nil && lfs.trash.worker != nil {
+		lfs.trash.worker.Stop()
+		lfs.trash.worker = nil
+	}
+}
+
+// TrashRetention returns how long deleted keys are kept, 0 means the trash is disabled.
+func (lfs *LogStructuredFS) TrashRetention() time.Duration {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	if lfs.trash == nil {
+		return 0
+	}
+	return lfs.trash.retention
+}
+
+// moveToTrash 把 key 当前的数据复制到回收站，过期时间保持不变，key 不存在时什么都不做
+func (lfs *LogStructuredFS) moveToTrash(key string) error {
+	_, seg, err := lfs.FetchSegment(key)
+	if err != nil {
+		return nil
+	}
+
+	// 读取出来的 Value 已经被 transformer 解码过，写入之前需要重新编码
+	trashed, err := seg.Reencode()
+	seg.ReleaseToPool()
+	if err != nil {
+		return err
+	}
+	trashed.Key = []byte(TrashKey(key))
+	trashed.KeySize = uint32(len(trashed.Key))
+	trashed.CreatedAt = uint64(time.Now().UnixNano())
+
+	return lfs.PutSegment(TrashKey(key), trashed)
+}
+
+// Undelete moves key out of the trash, the restored key keeps the expiration it had when it was deleted.
+func (lfs *LogStructuredFS) Undelete(key string) error {
+	retention := lfs.TrashRetention()
+	if retention == 0 || IsTrashKey(key) {
+		return ErrNotInTrash
+	}
+
+	_, seg, err := lfs.FetchSegment(TrashKey(key))
+	if err != nil {
+		return ErrNotInTrash
+	}
+	defer seg.ReleaseToPool()
+	if expiredFromTrash(seg, retention) {
+		return ErrNotInTrash
+	}
+	if _, ok := lfs.StatSegment(key); ok {
+		return ErrKeyExists
+	}
+
+	restored, err := seg.Reencode()
+	if err != nil {
+		return err
+	}
+	restored.Key = []byte(key)
+	restored.KeySize = uint32(len(restored.Key))
+	restored.CreatedAt = uint64(time.Now().UnixNano())
+
+	err = lfs.PutSegment(key, restored)
+	if err != nil {
+		return err
+	}
+
+	return lfs.DeleteSegment(TrashKey(key))
+}
+
+// PurgeTrash permanently deletes the keys kept in the trash longer than the retention.
+// It returns the number of purged keys.
+func (lfs *LogStructuredFS) PurgeTrash() (int, error) {
+	retention := lfs.TrashRetention()
+	if retention == 0 {
+		return 0, nil
+	}
+
+	var keys []string
+	err := lfs.RangeSegments(func(seg *Segment) bool {
+		if IsTrashKey(seg.GetKeyString()) && expiredFromTrash(seg, retention) {
+			keys = append(keys, seg.GetKeyString())
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		err := lfs.DeleteSegment(key)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+func expiredFromTrash(seg *Segment, retention time.Duration) bool {
+	return time.Since(time.Unix(0, int64(seg.CreatedAt))) >= retention
+}
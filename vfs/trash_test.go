@@ -0,0 +1,89 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	put := func(key, content string, ttl uint64) {
+		seg, err := NewSegment(key, types.NewText(content), ttl)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 没有开启回收站时直接删除
+	put("a", "v1", 0)
+	assert.NoError(t, fss.DeleteSegment("a"))
+	assert.ErrorIs(t, fss.Undelete("a"), ErrNotInTrash)
+	assert.Error(t, fss.SetTrash(0))
+
+	assert.NoError(t, fss.SetTrash(time.Hour))
+	put("b", "v1", 0)
+	put("c", "v1", 3600)
+	assert.NoError(t, fss.DeleteSegment("b"))
+	assert.NoError(t, fss.DeleteSegment("c"))
+	assert.Equal(t, "", fetchText(fss, "b"))
+	assert.Equal(t, "v1", fetchText(fss, TrashKey("b")))
+
+	// 删除不存在的 key 不会写入回收站
+	assert.NoError(t, fss.DeleteSegment("d"))
+	_, ok := fss.StatSegment(TrashKey("d"))
+	assert.False(t, ok)
+
+	// 恢复之后 key 保留删除之前的过期时间，回收站中的副本被清理
+	assert.NoError(t, fss.Undelete("c"))
+	_, seg, err := fss.FetchSegment("c")
+	assert.NoError(t, err)
+	assert.Greater(t, seg.TTL(), int64(3500))
+	_, ok = fss.StatSegment(TrashKey("c"))
+	assert.False(t, ok)
+	_, ok = fss.StatSegment(TrashKey(TrashKey("c")))
+	assert.False(t, ok)
+
+	// 删除之后重新写入的 key 不能被覆盖
+	put("b", "v2", 0)
+	assert.ErrorIs(t, fss.Undelete("b"), ErrKeyExists)
+	assert.NoError(t, fss.DeleteSegment("b"))
+	assert.Equal(t, "v2", fetchText(fss, TrashKey("b")))
+
+	n, err := fss.PurgeTrash()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// 超过保留时间之后不能恢复并且被清理
+	assert.NoError(t, fss.SetTrash(time.Nanosecond))
+	assert.ErrorIs(t, fss.Undelete("b"), ErrNotInTrash)
+	n, err = fss.PurgeTrash()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, ok = fss.StatSegment(TrashKey("b"))
+	assert.False(t, ok)
+	assert.Equal(t, 1, fss.KeysCount())
+}
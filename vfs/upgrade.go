@@ -0,0 +1,263 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// UpgradeOptions selects the regions UpgradeData rewrites. From is the format version to upgrade,
+// zero upgrades every older version. To must be the version this build writes, zero means CurrentFormat.
+type UpgradeOptions struct {
+	From byte
+	To   byte
+	// DryRun reads and verifies the selected regions without rewriting them
+	DryRun bool
+}
+
+// RegionUpgrade is a region rewritten, or selected with DryRun, by UpgradeData.
+type RegionUpgrade struct {
+	Name    string `json:"name"`
+	From    byte   `json:"from"`
+	Records int    `json:"records"`
+}
+
+// UpgradeResult reports what UpgradeData did to the data directory.
+type UpgradeResult struct {
+	// Regions are the regions upgraded, or the ones that would be upgraded with DryRun
+	Regions []RegionUpgrade `json:"regions"`
+	// Current is the number of regions that were already in the target format
+	Current int `json:"current"`
+	// Remaining are older regions not selected by From, the server upgrades them at startup
+	Remaining []RegionUpgrade `json:"remaining,omitempty"`
+}
+
+// CurrentFormat returns the region format version this build writes.
+func CurrentFormat() byte {
+	return currentFormat
+}
+
+// UpgradeData rewrites the regions in directory that use an older format version into the current one,
+// the same upgrade OpenFS performs at startup, so it can be run and verified offline ahead of time.
+// Every region is verified after it is rewritten and replaces the original atomically, an interrupted
+// upgrade resumes from the regions that are left. The directory must not be open by a running server.
+func UpgradeData(directory string, opt UpgradeOptions) (*UpgradeResult, error) {
+	if opt.To == 0 {
+		opt.To = currentFormat
+	}
+	if opt.To != currentFormat {
+		return nil, fmt.Errorf("%w: cannot upgrade to format version %d, this build writes version %d",
+			ErrUnsupportedFormat, opt.To, currentFormat)
+	}
+	if _, ok := recordReaders[opt.From]; opt.From != 0 && (!ok || opt.From >= opt.To) {
+		return nil, fmt.Errorf("%w: cannot upgrade from format version %d to %d", ErrUnsupportedFormat, opt.From, opt.To)
+	}
+
+	files, err := filepath.Glob(filepath.Join(directory, "0*"+fileExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var (
+		result   = new(UpgradeResult)
+		selected []string
+	)
+	for _, file := range files {
+		layout, err := regionFileLayout(file)
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Base(file)
+		switch {
+		case layout.version == currentFormat:
+			result.Current++
+		case opt.From == 0 || layout.version == opt.From:
+			selected = append(selected, name)
+		default:
+			result.Remaining = append(result.Remaining, RegionUpgrade{Name: name, From: layout.version})
+		}
+	}
+
+	if !opt.DryRun {
+		if len(selected) > 0 {
+			result.Regions, err = upgradeRegions(directory, selected)
+		}
+		return result, err
+	}
+
+	for _, name := range selected {
+		region, err := inspectRegion(filepath.Join(directory, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify region %s: %w", name, err)
+		}
+		result.Regions = append(result.Regions, *region)
+	}
+	return result, nil
+}
+
+// regionFileLayout 读取 region 文件头部描述的格式
+func regionFileLayout(path string) (*regionLayout, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	layout, err := readRegionLayout(fd, filepath.Base(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to validated data file header: %w", err)
+	}
+	return layout, nil
+}
+
+// readRegionLayout 从 r 中读出 region 文件头部并且解析，之后 r 的位置是第一条记录
+func readRegionLayout(r io.Reader, name string) (*regionLayout, error) {
+	metadata := make([]byte, len(regionMetadata))
+	_, err := io.ReadFull(r, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return regionFormat(name, metadata)
+}
+
+// readRecords 使用 layout 的格式依次读出 r 中的记录并且校验，fn 收到的记录不会被之后的读取覆盖，
+// 不完整的记录和校验失败都返回错误
+func readRecords(r io.Reader, layout *regionLayout, fn func(seg *Segment) error) error {
+	var (
+		header = make([]byte, layout.headerSize)
+		offset = int64(len(regionMetadata))
+	)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: record at offset %d: %w", ErrMalformedRecord, offset, err)
+		}
+
+		var seg Segment
+		err = layout.parseHeader(header, &seg)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		body := make([]byte, int(seg.KeySize)+int(seg.ValueSize)+4)
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return fmt.Errorf("%w: record at offset %d: %w", ErrMalformedRecord, offset, err)
+		}
+
+		checksum := binary.LittleEndian.Uint32(body[len(body)-4:])
+		if checksum != layout.checksum.sum(header, body[:len(body)-4]) {
+			return fmt.Errorf("record at offset %d: failed to %w: %d", offset, ErrChecksumMismatch, checksum)
+		}
+
+		seg.Key, seg.Value = body[:seg.KeySize], body[seg.KeySize:len(body)-4]
+		err = fn(&seg)
+		if err != nil {
+			return err
+		}
+		offset += layout.recordSize(&seg)
+	}
+}
+
+// newRecordDigest 返回记录内容摘要使用的哈希
+func newRecordDigest() hash.Hash64 {
+	return fnv.New64a()
+}
+
+// recordDigest 把记录的内容加入摘要，重写前后内容相同的记录得到相同的摘要，用来确认升级没有改变数据
+func recordDigest(h hash.Hash64, seg *Segment) {
+	var buf [31]byte
+	buf[0] = byte(seg.Tombstone)
+	buf[1] = byte(seg.Type)
+	buf[2] = byte(seg.Codec)
+	binary.LittleEndian.PutUint64(buf[3:11], seg.ExpiredAt)
+	binary.LittleEndian.PutUint64(buf[11:19], seg.CreatedAt)
+	binary.LittleEndian.PutUint64(buf[19:27], seg.LSN)
+	binary.LittleEndian.PutUint32(buf[27:31], seg.KeySize)
+	_, _ = h.Write(buf[:])
+	_, _ = h.Write(seg.Key)
+	_, _ = h.Write(seg.Value)
+}
+
+// verifyRegion 使用当前格式的解析方法重新读取升级之后的 region，检查每条记录的校验和，
+// 记录数量和内容摘要必须和升级之前读出的相同
+func verifyRegion(path string, records int, sum uint64) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+	layout, err := readRegionLayout(r, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if layout.version != currentFormat {
+		return fmt.Errorf("upgraded region uses format version %d", layout.version)
+	}
+
+	var (
+		digest = newRecordDigest()
+		count  int
+	)
+	err = readRecords(r, layout, func(seg *Segment) error {
+		recordDigest(digest, seg)
+		count++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify upgraded region: %w", err)
+	}
+	if count != records || digest.Sum64() != sum {
+		return errors.New("upgraded region does not match the original records")
+	}
+	return nil
+}
+
+// inspectRegion 读取并且校验 region 中的全部记录，不做任何修改
+func inspectRegion(path string) (*RegionUpgrade, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+	layout, err := readRegionLayout(r, filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+
+	region := &RegionUpgrade{Name: filepath.Base(path), From: layout.version}
+	err = readRecords(r, layout, func(seg *Segment) error {
+		region.Records++
+		return nil
+	})
+	return region, err
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestRegion 写入一个指定格式版本的 region，第一个版本的记录头部没有 LSN
+func writeTestRegion(t *testing.T, path string, version byte, lsn uint64, keys ...string) []byte {
+	region := formatHeader(CRC32, version)
+	for i, key := range keys {
+		seg, err := NewSegment(key, types.NewText(key+"-value"), 0)
+		require.NoError(t, err)
+		seg.LSN = lsn + uint64(i)
+		data, err := serializedSegment(seg, CRC32)
+		require.NoError(t, err)
+		if version == formatV1 {
+			record := append(append([]byte{}, data[:26]...), data[34:len(data)-4]...)
+			data = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+		}
+		region = append(region, data...)
+	}
+	require.NoError(t, os.WriteFile(path, region, conf.FSPerm))
+	return region
+}
+
+func TestUpgradeData(t *testing.T) {
+	dir := t.TempDir()
+	v1 := writeTestRegion(t, filepath.Join(dir, formatDataFileName(1)), formatV1, 0, "a", "b", "c")
+	writeTestRegion(t, filepath.Join(dir, formatDataFileName(2)), formatV2, 10, "d")
+	writeTestRegion(t, filepath.Join(dir, formatDataFileName(3)), currentFormat, 20, "e")
+
+	// 试运行只校验选中的 region，不修改文件
+	result, err := UpgradeData(dir, UpgradeOptions{From: formatV1, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []RegionUpgrade{{Name: formatDataFileName(1), From: formatV1, Records: 3}}, result.Regions)
+	assert.Equal(t, []RegionUpgrade{{Name: formatDataFileName(2), From: formatV2}}, result.Remaining)
+	assert.Equal(t, 1, result.Current)
+	data, err := os.ReadFile(filepath.Join(dir, formatDataFileName(1)))
+	require.NoError(t, err)
+	assert.Equal(t, v1, data)
+
+	// 没有 LSN 的记录从其他 region 中最大的 LSN 之后分配
+	result, err = UpgradeData(dir, UpgradeOptions{From: formatV1, To: formatV3})
+	require.NoError(t, err)
+	assert.Equal(t, []RegionUpgrade{{Name: formatDataFileName(1), From: formatV1, Records: 3}}, result.Regions)
+	assert.Len(t, result.Remaining, 1)
+	horizon, err := readHorizon(dir)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(23), horizon)
+
+	// 继续升级剩下的 region，已经升级的 region 不会再次重写
+	result, err = UpgradeData(dir, UpgradeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []RegionUpgrade{{Name: formatDataFileName(2), From: formatV2, Records: 1}}, result.Regions)
+	assert.Equal(t, 2, result.Current)
+	assert.Empty(t, result.Remaining)
+
+	result, err = UpgradeData(dir, UpgradeOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, result.Regions)
+	assert.Equal(t, 3, result.Current)
+
+	fss := openLSNTestFS(t, dir)
+	defer fss.CloseFS()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.Equal(t, key+"-value", fetchText(fss, key))
+	}
+	_, seg, err := fss.FetchSegment("c")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(23), seg.LSN)
+	_, seg, err = fss.FetchSegment("d")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), seg.LSN)
+}
+
+func TestUpgradeData_Options(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := UpgradeData(dir, UpgradeOptions{To: currentFormat + 1})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+	_, err = UpgradeData(dir, UpgradeOptions{From: currentFormat})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+	_, err = UpgradeData(dir, UpgradeOptions{From: 0x7F})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	result, err := UpgradeData(dir, UpgradeOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, result.Regions)
+	assert.Equal(t, byte(formatV3), CurrentFormat())
+}
+
+func TestUpgradeData_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, formatDataFileName(1))
+	region := writeTestRegion(t, path, formatV1, 0, "a", "b")
+	region[len(region)-6] ^= 0xFF
+	require.NoError(t, os.WriteFile(path, region, conf.FSPerm))
+
+	// 上一次升级中断留下的临时文件在重新升级时删除
+	require.NoError(t, os.WriteFile(path+".part", []byte("partial"), conf.FSPerm))
+
+	_, err := UpgradeData(dir, UpgradeOptions{DryRun: true})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// 校验失败的 region 保持原样，不会重新计算校验和掩盖损坏
+	_, err = UpgradeData(dir, UpgradeOptions{})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, region, data)
+	assert.NoFileExists(t, path+".part")
+}
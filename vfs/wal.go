@@ -0,0 +1,352 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auula/urnadb/utils"
+)
+
+// The index WAL records every index mutation between two checkpoints,
+// crash recovery loads the latest checkpoint and replays the WAL tail
+// instead of re-scanning the regions written after the checkpoint.
+// | OP 1 | INUM 8 | RID 8 | POS 8 | LEN 4 | EAT 8 | CAT 8 | CRC32 4 |
+const (
+	walPut    byte = 1
+	walDelete byte = 2
+
+	walExtension  = ".wal"
+	walRecordSize = 49
+)
+
+// walFileName 返回与检查点时间戳对应的索引日志文件名
+func walFileName(ts int64) string {
+	return fmt.Sprintf("index.%d%s", ts, walExtension)
+}
+
+func parseWalFileName(name string) (int64, error) {
+	parts := strings.Split(filepath.Base(name), ".")
+	if len(parts) != 3 || parts[0] != "index" {
+		return 0, fmt.Errorf("invalid index wal file name: %s", name)
+	}
+	return strconv.ParseInt(parts[1], 10, 64)
+}
+
+// rotateIndexLog 在生成检查点之前切换到新的索引日志，之后的索引修改都记录到新日志中，
+// 调用者必须持有 lfs.mu 写锁。
+func (lfs *LogStructuredFS) rotateIndexLog(ts int64) error {
+	fd, err := os.OpenFile(filepath.Join(lfs.directory, walFileName(ts)), appendOnlyLog, fsPerm)
+	if err != nil {
+		return fmt.Errorf("failed to create index wal file: %w", err)
+	}
+
+	n, err := fd.Write(dataFileMetadata)
+	if err != nil || n != len(dataFileMetadata) {
+		fd.Close()
+		return fmt.Errorf("failed to write index wal metadata: %v", err)
+	}
+
+	if lfs.wal != nil {
+		_ = utils.FlushToDisk(lfs.wal)
+	}
+
+	lfs.wal = fd
+	return nil
+}
+
+// appendIndexLog 追加一条索引修改记录，调用者必须持有 lfs.mu 写锁。
+// 写入失败时丢弃全部索引日志，恢复时退回到扫描数据文件，保证不会用不完整的日志恢复索引。
+func (lfs *LogStructuredFS) appendIndexLog(op byte, inum uint64, inode *Inode) {
+	if lfs.wal == nil {
+		return
+	}
+
+	if inode == nil {
+		inode = new(Inode)
+	}
+
+	bytes, err := serializedIndex(inum, inode)
+	if err == nil {
+		err = appendToActiveRegion(lfs.wal, append([]byte{op}, bytes...))
+	}
+
+	if err != nil {
+		vlog.Errorf("failed to append index wal, fallback to regions scan recovery: %v", err)
+		lfs.discardIndexLog()
+	}
+}
+
+// syncIndexLog 把索引日志同步到磁盘，没有开启索引日志或者日志已经切换关闭时直接返回
+func syncIndexLog(wal *os.File) error {
+	if wal == nil {
+		return nil
+	}
+	err := wal.Sync()
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("failed to flush index wal: %w", err)
+	}
+	return nil
+}
+
+// closeIndexLog 同步并关闭当前的索引日志，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) closeIndexLog() error {
+	if lfs.wal == nil {
+		return nil
+	}
+	err := utils.FlushToDisk(lfs.wal)
+	lfs.wal = nil
+	if err != nil {
+		return fmt.Errorf("failed to close index wal: %w", err)
+	}
+	return nil
+}
+
+// discardIndexLog 关闭并删除全部索引日志，调用者必须持有 lfs.mu 写锁
+func (lfs *LogStructuredFS) discardIndexLog() {
+	if lfs.wal != nil {
+		_ = lfs.wal.Close()
+		lfs.wal = nil
+	}
+
+	err := cleanupDirtyIndexLog(lfs.directory, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		vlog.Warnf("failed to cleanup index wal file: %v", err)
+	}
+}
+
+// cleanupDirtyIndexLog 删除时间戳早于 ts 的索引日志，这些日志已经包含在新的检查点中
+func cleanupDirtyIndexLog(directory string, ts int64) error {
+	files, err := filepath.Glob(filepath.Join(directory, "*"+walExtension))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		fts, err := parseWalFileName(file)
+		if err != nil || fts >= ts {
+			continue
+		}
+		err = os.Remove(file)
+		if err != nil {
+			return fmt.Errorf("deleted old index wal file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// indexLogsSince 返回时间戳不早于 ts 的索引日志，按时间顺序排列
+func indexLogsSince(directory string, ts int64) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(directory, "*"+walExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	type wal struct {
+		ts   int64
+		path string
+	}
+
+	wals := make([]wal, 0, len(files))
+	for _, file := range files {
+		fts, err := parseWalFileName(file)
+		if err != nil || fts < ts {
+			continue
+		}
+		wals = append(wals, wal{ts: fts, path: file})
+	}
+
+	sort.Slice(wals, func(i, j int) bool {
+		return wals[i].ts < wals[j].ts
+	})
+
+	paths := make([]string, 0, len(wals))
+	for _, w := range wals {
+		paths = append(paths, w.path)
+	}
+	return paths, nil
+}
+
+// replayIndexLog 按顺序重放索引日志，尾部没有写完整的记录会被忽略。
+// 日志中的 inum 在写入时已经按照指纹索引中冲突的 key 换算过，重放时直接使用
+func replayIndexLog(fd *os.File, indexs []*indexMap) error {
+	err := validateFileHeader(fd, dataFileMetadata)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, walRecordSize)
+	offset := int64(len(dataFileMetadata))
+	for {
+		_, err := fd.ReadAt(buf, offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read index wal record: %w", err)
+		}
+		offset += walRecordSize
+
+		inum, inode, err := deserializedIndex(buf[1:])
+		if err != nil {
+			vlog.Warnf("index wal torn record at offset %d ignored: %v", offset-walRecordSize, err)
+			return nil
+		}
+
+		imap := indexs[inum%uint64(shard)]
+		if imap == nil {
+			return fmt.Errorf("no corresponding index shard for inum: %d", inum)
+		}
+
+		if buf[0] == walDelete ||
+			(inode.ExpiredAt <= uint64(time.Now().UnixNano()) && inode.ExpiredAt != 0) {
+			delete(imap.index, inum)
+			continue
+		}
+
+		imap.index[inum] = inode
+	}
+}
+
+// recoverFromIndexLog 使用最新的检查点加上之后的索引日志恢复索引，再重放日志之后写入数据文件的记录，
+// 没有可用的检查点或者日志时返回 false，由调用者退回到扫描数据文件的方式恢复。
+func (lfs *LogStructuredFS) recoverFromIndexLog() (bool, error) {
+	directory, indexs := lfs.directory, lfs.indexs
+	ckpts, _ := filepath.Glob(filepath.Join(directory, "*.ids"))
+
+	var (
+		latest int64 = -1
+		path   string
+	)
+	for _, file := range ckpts {
+		parts := strings.Split(filepath.Base(file), ".")
+		if len(parts) != 4 {
+			continue
+		}
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err == nil && ts > latest {
+			latest, path = ts, file
+		}
+	}
+
+	if path == "" || !utils.IsExist(filepath.Join(directory, walFileName(latest))) {
+		return false, nil
+	}
+
+	wals, err := indexLogsSince(directory, latest)
+	if err != nil {
+		return false, err
+	}
+
+	ckpt, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open checkpoint file: %w", err)
+	}
+	defer ckpt.Close()
+
+	err = recoveryIndex(ckpt, indexs)
+	if err != nil {
+		return false, fmt.Errorf("failed to recover data from checkpoint: %w", err)
+	}
+
+	for _, file := range wals {
+		fd, err := os.Open(file)
+		if err != nil {
+			return false, fmt.Errorf("failed to open index wal file: %w", err)
+		}
+
+		err = replayIndexLog(fd, indexs)
+		fd.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to replay index wal %s: %w", filepath.Base(file), err)
+		}
+	}
+
+	err = lfs.recoverRegionTail()
+	if err != nil {
+		return false, fmt.Errorf("failed to recover records after index wal: %w", err)
+	}
+
+	return true, nil
+}
+
+// recoverRegionTail 重放索引中最后一条记录之后写入 region 的记录。region 可能先于索引日志落盘，
+// 这些已经确认的写入只存在于数据文件中。region 中的记录按照写入顺序排列，从更早的位置开始重放结果也一样，
+// 尾部没有写完整的记录会被忽略
+func (lfs *LogStructuredFS) recoverRegionTail() error {
+	var (
+		regionID uint64
+		offset   = uint64(len(regionMetadata))
+	)
+	for _, imap := range lfs.indexs {
+		for _, inode := range imap.index {
+			end := inode.Position + uint64(inode.Length)
+			if inode.RegionID > regionID || (inode.RegionID == regionID && end > offset) {
+				regionID, offset = inode.RegionID, end
+			}
+		}
+	}
+
+	now := uint64(time.Now().UnixNano())
+	for _, id := range lfs.regionIDs(false) {
+		if id < regionID {
+			continue
+		}
+		if id > regionID {
+			offset = uint64(len(regionMetadata))
+		}
+
+		fd := lfs.regions[id]
+		finfo, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+
+		reader := newRegionReader(fd, finfo.Size())
+		for offset < uint64(finfo.Size()) {
+			inum, segment, err := reader.readSegment(offset)
+			if err != nil {
+				vlog.Warnf("region %d torn record at offset %d ignored: %v", id, offset, err)
+				break
+			}
+			inum = lfs.recordInum(inum, segment)
+			imap := lfs.indexs[inum%uint64(shard)]
+
+			if segment.IsTombstone() || (segment.ExpiredAt <= now && segment.ExpiredAt != 0) {
+				delete(imap.index, inum)
+			} else {
+				imap.index[inum] = &Inode{
+					RegionID:  id,
+					Position:  offset,
+					Length:    segment.Size(),
+					CreatedAt: segment.CreatedAt,
+					ExpiredAt: segment.ExpiredAt,
+				}
+			}
+			offset += uint64(segment.Size())
+		}
+	}
+
+	return nil
+}
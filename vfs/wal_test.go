@@ -0,0 +1,162 @@
+// Copyright 2022 Leon Ding <ding_ms@outlook.com> https://urnadb.github.io
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/auula/urnadb/conf"
+	"github.com/auula/urnadb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWalFileName(t *testing.T) {
+	ts, err := parseWalFileName(walFileName(1700000000))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000000), ts)
+
+	_, err = parseWalFileName("ckpt.1700000000.1.ids")
+	assert.Error(t, err)
+}
+
+func TestRecoverFromIndexLog(t *testing.T) {
+	dir := t.TempDir()
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      dir,
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	// 检查点之前写入的数据只存在于检查点里
+	seg, err := NewSegment("key-0", types.NewText("hello"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-0", seg))
+
+	fss.mu.Lock()
+	assert.NoError(t, fss.rotateIndexLog(100))
+	fss.mu.Unlock()
+
+	ckpt, err := os.Create(filepath.Join(dir, "ckpt.100.1.ids"))
+	assert.NoError(t, err)
+	_, err = ckpt.Write(dataFileMetadata)
+	assert.NoError(t, err)
+	for _, imap := range fss.indexs {
+		for inum, inode := range imap.index {
+			bytes, err := serializedIndex(inum, inode)
+			assert.NoError(t, err)
+			_, err = ckpt.Write(bytes)
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, ckpt.Close())
+
+	// 检查点之后的修改只记录在索引日志里
+	for i := 1; i < 3; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewText("world"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(fmt.Sprintf("key-%d", i), seg))
+	}
+	assert.NoError(t, fss.DeleteSegment("key-0"))
+
+	// 模拟日志尾部写了一半的记录
+	_, err = fss.wal.Write([]byte{walPut, 0x01, 0x02})
+	assert.NoError(t, err)
+
+	replay := func() (*LogStructuredFS, bool) {
+		indexs := make([]*indexMap, shard)
+		for i := 0; i < shard; i++ {
+			indexs[i] = &indexMap{mu: sync.RWMutex{}, index: make(map[uint64]*Inode)}
+		}
+		recovered := &LogStructuredFS{directory: dir, indexs: indexs, regions: fss.regions}
+		ok, err := recovered.recoverFromIndexLog()
+		assert.NoError(t, err)
+		return recovered, ok
+	}
+
+	verify := func(recovered *LogStructuredFS) {
+		for i := 0; i < 3; i++ {
+			inum := InodeNum(fmt.Sprintf("key-%d", i))
+			inode, exists := recovered.indexs[inum%uint64(shard)].index[inum]
+			expected, _ := fss.StatSegment(fmt.Sprintf("key-%d", i))
+			if i == 0 {
+				assert.False(t, exists)
+				continue
+			}
+			assert.True(t, exists)
+			assert.Equal(t, expected.Position, inode.Position)
+			assert.Equal(t, expected.RegionID, inode.RegionID)
+		}
+	}
+
+	recovered, ok := replay()
+	assert.True(t, ok)
+	verify(recovered)
+
+	// region 先于索引日志落盘，日志中缺少的写入从数据文件中恢复
+	assert.NoError(t, fss.wal.Truncate(int64(len(dataFileMetadata))))
+	recovered, ok = replay()
+	assert.True(t, ok)
+	verify(recovered)
+
+	// 停止检查点之后日志被丢弃，恢复时退回到扫描数据文件
+	fss.StopCheckpoint()
+	_, ok = replay()
+	assert.False(t, ok)
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestRecoverAfterCleanRestart(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *LogStructuredFS {
+		fss, err := OpenFS(&Options{
+			FSPerm:    conf.FSPerm,
+			Path:      dir,
+			Threshold: conf.Settings.Region.Threshold,
+		})
+		assert.NoError(t, err)
+		return fss
+	}
+	put := func(fss *LogStructuredFS, key string) {
+		seg, err := NewSegment(key, types.NewText("hello"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	fss := open()
+	put(fss, "key-0")
+	assert.NoError(t, fss.CloseFS())
+
+	// 正常关闭之后重启，加载过的索引快照被删除
+	fss = open()
+	_, err := os.Stat(filepath.Join(dir, indexFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, fss.Checkpoint())
+	put(fss, "key-1")
+
+	// 不关闭直接重新打开模拟崩溃，重启之后的写入不能丢失
+	crashed := open()
+	for _, key := range []string{"key-0", "key-1"} {
+		_, ok := crashed.StatSegment(key)
+		assert.True(t, ok, key)
+	}
+
+	assert.NoError(t, crashed.CloseFS())
+}